@@ -0,0 +1,148 @@
+use std::collections::{BTreeMap, HashMap};
+use std::path::{Path, PathBuf};
+
+use crate::calc;
+use crate::disk::{self, DiskInfo};
+use crate::filter::{self, Filters};
+use crate::hash_algorithm::{Digest, HashAlgorithm};
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::target_file;
+
+/// ディスク
+/// diskファイルが置かれたフォルダをルートとする。
+#[derive(Debug, Clone)]
+pub struct Disk {
+    disk_info: DiskInfo,
+}
+
+impl Disk {
+    /// 指定されたパスを含むディスクを返す。
+    /// パスから上のフォルダに向かってdiskファイルを探す。
+    pub fn containing(path: &Path) -> Result<Disk, Errors> {
+        let disk_info = disk::find_disk_containing(path)?;
+        Ok(Disk { disk_info })
+    }
+
+    /// ディスクIDを返す。
+    pub fn id(&self) -> &str {
+        &self.disk_info.id
+    }
+
+    /// ディスクのルートのパスを返す。
+    pub fn root(&self) -> &Path {
+        &self.disk_info.root_path
+    }
+}
+
+/// ハッシュファイルの内容
+/// 正規化ファイルパスとハッシュをパス順に保持する。
+#[derive(Debug, Clone)]
+pub struct HashSet {
+    algorithm: HashAlgorithm,
+    hashes: BTreeMap<PathBuf, Digest>,
+}
+
+impl HashSet {
+    /// 空のハッシュファイルの内容を作成する。
+    pub fn new(algorithm: HashAlgorithm) -> HashSet {
+        HashSet {
+            algorithm,
+            hashes: BTreeMap::new(),
+        }
+    }
+
+    /// ハッシュファイルを読み込む。
+    /// 同じパスの行が重複していれば最後の行を使う。
+    pub fn load(hash_filepath: &Path) -> Result<HashSet, Errors> {
+        let algorithm = match hash_file::read_algorithm(hash_filepath)? {
+            Some(algorithm) => algorithm,
+            None => {
+                return Err(log::make_error!(
+                    "ハッシュファイルがありません。: {}",
+                    hash_filepath.to_str().unwrap()
+                )
+                .as_errors())
+            }
+        };
+        let hashes = hash_file::load_hash_info(hash_filepath)?
+            .into_iter()
+            .collect();
+        Ok(HashSet { algorithm, hashes })
+    }
+
+    /// ハッシュファイルに出力する。
+    pub fn save(&self, hash_filepath: &Path) -> Result<(), Errors> {
+        let hash_info_map: HashMap<PathBuf, Digest> = self
+            .hashes
+            .iter()
+            .map(|(path, hash)| (path.clone(), *hash))
+            .collect();
+        hash_file::write_calculated_hash(hash_filepath, self.algorithm, hash_info_map)
+    }
+
+    /// アルゴリズムを返す。
+    pub fn algorithm(&self) -> HashAlgorithm {
+        self.algorithm
+    }
+
+    /// 指定されたパスのハッシュを返す。
+    pub fn get(&self, path: &Path) -> Option<&Digest> {
+        self.hashes.get(path)
+    }
+
+    /// ハッシュを追加する。
+    /// 同じパスのハッシュがあれば置き換える。
+    pub fn insert(&mut self, path: PathBuf, hash: Digest) {
+        self.hashes.insert(path, hash);
+    }
+
+    /// 記録されたファイルの数を返す。
+    pub fn len(&self) -> usize {
+        self.hashes.len()
+    }
+
+    /// パスとハッシュをパス順に返す。
+    pub fn iter(&self) -> impl Iterator<Item = (&Path, &Digest)> {
+        self.hashes
+            .iter()
+            .map(|(path, hash)| (path.as_path(), hash))
+    }
+}
+
+/// フィルター設定ファイルと同じ形式の内容からフィルター設定一覧を作成する。
+/// 最初のセクションより前に書かれたフィルターを使用する。
+pub fn parse_filters(filter_conf: &str) -> Result<Filters, Errors> {
+    filter::parse_filters(filter_conf)
+}
+
+/// ファイルのハッシュを計算して返す。
+pub fn calc_file_hash(filepath: &Path, algorithm: HashAlgorithm) -> Result<Digest, Errors> {
+    let mut buffer = vec![0u8; calc::BUFFER_SIZE];
+    calc::calc_file_hash(filepath, &mut buffer, algorithm).map_err(|error| vec![error.error])
+}
+
+/// ディスクの対象ファイルのハッシュを計算して返す。
+/// ファイルを1つずつ計算し、読み込めなかったファイルがあれば全てのエラーを返す。
+pub fn calc_disk_hashes(
+    disk: &Disk,
+    filters: &Filters,
+    algorithm: HashAlgorithm,
+) -> Result<HashSet, Errors> {
+    let mut hash_set = HashSet::new(algorithm);
+    let mut errors = vec![];
+    let mut buffer = vec![0u8; calc::BUFFER_SIZE];
+
+    for target_file in target_file::list_target_files(&disk.disk_info, filters) {
+        match calc::calc_file_hash(target_file.actual_path(), &mut buffer, algorithm) {
+            Ok(hash) => hash_set.insert(target_file.normalized_path().to_path_buf(), hash),
+            Err(file_error) => errors.push(file_error.error),
+        }
+    }
+
+    if errors.len() == 0 {
+        Ok(hash_set)
+    } else {
+        Err(errors)
+    }
+}
@@ -0,0 +1,156 @@
+use std::fs::{self, File};
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::process;
+use std::time::{Duration, SystemTime};
+
+use crate::log;
+
+/// 一時ファイルの名前の末尾
+const TEMP_FILE_SUFFIX: &str = ".bcbc-tmp";
+
+/// この時間より前に更新された一時ファイルは中断された実行の残骸とみなす
+/// 他の実行が書き込み中の一時ファイルを削除しないよう余裕を持たせる。
+const LEFTOVER_AGE: Duration = Duration::from_secs(60 * 60);
+
+/// ファイルに内容を書き込む。
+/// 同じフォルダの一時ファイルに書き込んでディスクに書き出してから置き換えるので、
+/// 途中で中断されても書きかけのファイルが残ることはない。
+pub fn write<P: AsRef<Path>, C: AsRef<[u8]>>(path: P, contents: C) -> io::Result<()> {
+    let path = path.as_ref();
+    let temp_filepath = temp_filepath_of(path);
+
+    let result = File::create(temp_filepath.as_path())
+        .and_then(|mut file| {
+            file.write_all(contents.as_ref())?;
+            file.sync_all()
+        })
+        .and_then(|_| fs::rename(temp_filepath.as_path(), path));
+    if result.is_err() {
+        let _ = fs::remove_file(temp_filepath.as_path());
+    }
+    result?;
+
+    sync_parent_folder(path);
+    Ok(())
+}
+
+/// 置き換えたことが電源断などで失われないよう、フォルダのエントリーをディスクに書き出す。
+/// ファイルの内容は書き出し済みなので、失敗しても無視する。
+#[cfg(unix)]
+fn sync_parent_folder(path: &Path) {
+    if let Some(folder) = path.parent() {
+        let folder = if folder.as_os_str().len() == 0 {
+            Path::new(".")
+        } else {
+            folder
+        };
+        let _ = File::open(folder).and_then(|folder| folder.sync_all());
+    }
+}
+
+/// Windowsではフォルダを開いて書き出せないので何もしない。
+#[cfg(not(unix))]
+fn sync_parent_folder(_path: &Path) {}
+
+/// フォルダにファイルを作成できるかを返す。
+/// 一時ファイルを作成して削除する。フォルダがなければfalseを返す。
+pub fn is_writable(folder: &Path) -> bool {
+    let temp_filepath = temp_filepath_of(folder.join("write-test").as_path());
+    match File::create(temp_filepath.as_path()) {
+        Ok(_) => {
+            let _ = fs::remove_file(temp_filepath.as_path());
+            true
+        }
+        Err(_) => false,
+    }
+}
+
+/// 書き込み先のファイルに対応する一時ファイルのパスを返す。
+/// 同時に実行された他のプロセスと重ならないようプロセスIDを含める。
+fn temp_filepath_of(path: &Path) -> PathBuf {
+    let file_name = path.file_name().unwrap().to_str().unwrap();
+    path.with_file_name(format!(
+        ".{}.{}{}",
+        file_name,
+        process::id(),
+        TEMP_FILE_SUFFIX
+    ))
+}
+
+/// フォルダに残っている、中断された実行の一時ファイルを削除する。
+/// サブフォルダは指定された深さまで辿る。0ならフォルダの直下だけを対象にする。
+pub fn remove_leftovers(folder: &Path, depth: usize) {
+    let now = SystemTime::now();
+    let mut number_of_removed = 0;
+    remove_leftovers_in(folder, depth, now, &mut number_of_removed);
+
+    if number_of_removed > 0 {
+        log::warn(
+            format!(
+                "中断された実行の一時ファイルを{}件削除しました。: {}",
+                number_of_removed,
+                folder.to_str().unwrap()
+            )
+            .as_str(),
+        );
+    }
+}
+
+/// フォルダの一時ファイルを削除し、残りの深さがあればサブフォルダも同じく削除する。
+fn remove_leftovers_in(
+    folder: &Path,
+    depth: usize,
+    now: SystemTime,
+    number_of_removed: &mut usize,
+) {
+    let read_dir = match folder.read_dir() {
+        Ok(read_dir) => read_dir,
+        Err(_) => return,
+    };
+
+    for entry in read_dir.flatten() {
+        let path = entry.path();
+        let file_type = match entry.file_type() {
+            Ok(file_type) => file_type,
+            Err(_) => continue,
+        };
+
+        if file_type.is_dir() {
+            if depth > 0 {
+                remove_leftovers_in(path.as_path(), depth - 1, now, number_of_removed);
+            }
+        } else if file_type.is_file() && is_leftover(path.as_path(), now) {
+            match fs::remove_file(path.as_path()) {
+                Ok(_) => *number_of_removed += 1,
+                Err(error) => log::warn(
+                    format!(
+                        "一時ファイルを削除できませんでした。: {}: {}",
+                        path.to_str().unwrap(),
+                        error
+                    )
+                    .as_str(),
+                ),
+            }
+        }
+    }
+}
+
+/// 中断された実行の一時ファイルであるかを返す。
+fn is_leftover(path: &Path, now: SystemTime) -> bool {
+    let is_temp_file = path
+        .file_name()
+        .and_then(|file_name| file_name.to_str())
+        .map_or(false, |file_name| file_name.ends_with(TEMP_FILE_SUFFIX));
+    if !is_temp_file {
+        return false;
+    }
+
+    match fs::metadata(path).and_then(|metadata| metadata.modified()) {
+        Ok(modified) => match now.duration_since(modified) {
+            Ok(age) => age >= LEFTOVER_AGE,
+            Err(_) => false,
+        },
+        Err(_) => false,
+    }
+}
@@ -0,0 +1,282 @@
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::clock;
+use crate::file_error::FileErrorCategory;
+use crate::log::{self, Errors};
+use crate::target_file::{self, TargetFile};
+
+/// この回数続けてエラーになったファイルを自動的に除外する
+const IGNORE_THRESHOLD: usize = 3;
+
+/// 連続してエラーになった回数を記録するフォルダを返す。
+fn failures_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("failures")
+}
+
+/// 自動的に除外するファイルの一覧を保存するフォルダを返す。
+fn ignored_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("ignored")
+}
+
+/// 自動的に除外するファイル
+/// 対象ファイルを一覧にしながら除外できるよう、ファイルを1件ずつ判定する。
+pub struct IgnoredFiles {
+    ignored_paths: BTreeSet<PathBuf>,
+    /// 除外したファイルの数
+    number_of_ignored: usize,
+}
+
+impl IgnoredFiles {
+    /// ディスクの自動的に除外するファイルの一覧を読み込む。
+    pub fn load(output_folder: &Path, disk_id: &str) -> Result<IgnoredFiles, Errors> {
+        Ok(IgnoredFiles {
+            ignored_paths: load_ignored_paths(output_folder, disk_id)?,
+            number_of_ignored: 0,
+        })
+    }
+
+    /// 対象ファイルを除外するか判定し、除外するファイルを数える。
+    pub fn ignores(&mut self, target_file: &TargetFile) -> bool {
+        let ignored = self.ignored_paths.contains(target_file.normalized_path());
+        if ignored {
+            self.number_of_ignored += 1;
+        }
+        ignored
+    }
+
+    /// 除外するファイルがあれば、除外したファイルの件数を出力する。
+    pub fn log(&self, output_folder: &Path, disk_id: &str) {
+        if self.ignored_paths.len() == 0 {
+            return;
+        }
+        log::info(
+            format!(
+                "{}: 繰り返しエラーになった{}件のファイルを除外しました。: {}",
+                disk_id,
+                self.number_of_ignored,
+                ignored_folder(output_folder)
+                    .join(disk_id)
+                    .to_str()
+                    .unwrap()
+            )
+            .as_str(),
+        );
+    }
+}
+
+/// 自動的に除外するファイルを対象ファイルの一覧から除外する。
+pub fn remove_ignored_files(
+    output_folder: &Path,
+    disk_id: &str,
+    target_files: Vec<TargetFile>,
+) -> Result<Vec<TargetFile>, Errors> {
+    let mut ignored_files = IgnoredFiles::load(output_folder, disk_id)?;
+    let target_files: Vec<TargetFile> = target_files
+        .into_iter()
+        .filter(|target_file| !ignored_files.ignores(target_file))
+        .collect();
+    ignored_files.log(output_folder, disk_id);
+
+    Ok(target_files)
+}
+
+/// 今回エラーになったファイルで連続してエラーになった回数を更新する。
+/// 回数がしきい値に達したファイルは除外する一覧に追加し、レポートを出力する。
+/// 範囲が指定された場合は、範囲外のファイルの回数をそのまま残す。
+pub fn record_failures(
+    output_folder: &Path,
+    disk_id: &str,
+    failures: &Vec<(PathBuf, FileErrorCategory)>,
+    scope: Option<&Path>,
+) -> Result<(), Errors> {
+    let failures_filepath = failures_folder(output_folder).join(disk_id);
+    let previous_counts = load_failure_counts(failures_filepath.as_path())?;
+
+    // 今回エラーにならなかったファイルは回数をリセットする
+    let mut counts: BTreeMap<PathBuf, (usize, FileErrorCategory)> = previous_counts
+        .iter()
+        .filter(|(path, _)| !target_file::is_in_scope(path, scope))
+        .map(|(path, count)| (path.clone(), *count))
+        .collect();
+    let mut newly_ignored = vec![];
+    for (path, category) in failures {
+        let count = previous_counts.get(path).map_or(0, |(count, _)| *count) + 1;
+        if count >= IGNORE_THRESHOLD {
+            newly_ignored.push((path.clone(), *category));
+        } else {
+            counts.insert(path.clone(), (count, *category));
+        }
+    }
+
+    write_failure_counts(failures_filepath.as_path(), &counts)?;
+
+    if newly_ignored.len() > 0 {
+        add_ignored_paths(output_folder, disk_id, &newly_ignored)?;
+        let report_filepath = write_report(output_folder, disk_id, &newly_ignored)?;
+        log::warn(
+            format!(
+                "{}: {}回続けてエラーになった{}件のファイルを次回から除外します。: {}",
+                disk_id,
+                IGNORE_THRESHOLD,
+                newly_ignored.len(),
+                report_filepath.to_str().unwrap()
+            )
+            .as_str(),
+        );
+    }
+
+    Ok(())
+}
+
+/// 自動的に除外するファイルの一覧を読み込む。
+/// 一覧がなければ空のセットを返す。
+fn load_ignored_paths(output_folder: &Path, disk_id: &str) -> Result<BTreeSet<PathBuf>, Errors> {
+    let ignored_filepath = ignored_folder(output_folder).join(disk_id);
+    if !ignored_filepath.is_file() {
+        return Ok(BTreeSet::new());
+    }
+
+    match fs::read_to_string(ignored_filepath.as_path()) {
+        Ok(contents) => Ok(contents
+            .lines()
+            .filter(|line| line.len() > 0)
+            .map(PathBuf::from)
+            .collect()),
+        Err(error) => Err(
+            log::make_error!("除外するファイルの一覧を読み込めませんでした。")
+                .with(&error)
+                .as_errors(),
+        ),
+    }
+}
+
+/// 自動的に除外するファイルの一覧にパスを追加する。
+fn add_ignored_paths(
+    output_folder: &Path,
+    disk_id: &str,
+    newly_ignored: &Vec<(PathBuf, FileErrorCategory)>,
+) -> Result<(), Errors> {
+    let mut ignored_paths = load_ignored_paths(output_folder, disk_id)?;
+    for (path, _) in newly_ignored {
+        ignored_paths.insert(path.clone());
+    }
+
+    let mut contents = String::new();
+    for path in ignored_paths {
+        contents.push_str(path.to_str().unwrap());
+        contents.push('\n');
+    }
+
+    write_file(
+        ignored_folder(output_folder).join(disk_id).as_path(),
+        &contents,
+        "除外するファイルの一覧",
+    )
+}
+
+/// 連続してエラーになった回数の記録を読み込む。
+/// 記録がなければ空のマップを返す。
+fn load_failure_counts(
+    failures_filepath: &Path,
+) -> Result<BTreeMap<PathBuf, (usize, FileErrorCategory)>, Errors> {
+    let mut counts = BTreeMap::new();
+    if !failures_filepath.is_file() {
+        return Ok(counts);
+    }
+
+    let contents = match fs::read_to_string(failures_filepath) {
+        Ok(contents) => contents,
+        Err(error) => {
+            return Err(log::make_error!("エラー回数の記録を読み込めませんでした。")
+                .with(&error)
+                .as_errors())
+        }
+    };
+
+    for (i, line) in contents.lines().enumerate() {
+        let mut fields = line.split('\t');
+        match (
+            fields.next(),
+            fields.next().map(|count| count.parse::<usize>()),
+            fields.next().and_then(FileErrorCategory::from_name),
+        ) {
+            (Some(path), Some(Ok(count)), Some(category)) => {
+                counts.insert(PathBuf::from(path), (count, category));
+            }
+            _ => {
+                return log::with_line_number(
+                    Err(log::make_error!("エラー回数の記録の形式が不正です。").as_errors()),
+                    failures_filepath,
+                    i + 1,
+                )
+            }
+        }
+    }
+
+    Ok(counts)
+}
+
+/// 連続してエラーになった回数を記録する。
+/// 1行に"パス 回数 分類"をタブ区切りで出力する。
+fn write_failure_counts(
+    failures_filepath: &Path,
+    counts: &BTreeMap<PathBuf, (usize, FileErrorCategory)>,
+) -> Result<(), Errors> {
+    let mut contents = String::new();
+    for (path, (count, category)) in counts {
+        contents.push_str(
+            format!(
+                "{}\t{}\t{}\n",
+                path.to_str().unwrap(),
+                count,
+                category.name()
+            )
+            .as_str(),
+        );
+    }
+
+    write_file(failures_filepath, &contents, "エラー回数の記録")
+}
+
+/// 新たに除外したファイルの一覧を出力する。
+/// 1行に"パス 分類"をタブ区切りで出力する。
+fn write_report(
+    output_folder: &Path,
+    disk_id: &str,
+    newly_ignored: &Vec<(PathBuf, FileErrorCategory)>,
+) -> Result<PathBuf, Errors> {
+    let timestamp = clock::now().format("%Y%m%d%H%M%S");
+    let report_filepath = output_folder
+        .join("ignored-report")
+        .join(format!("{}-{}", disk_id, timestamp));
+
+    let mut contents = String::new();
+    for (path, category) in newly_ignored {
+        contents.push_str(format!("{}\t{}\n", path.to_str().unwrap(), category.label()).as_str());
+    }
+
+    write_file(report_filepath.as_path(), &contents, "除外レポート")?;
+
+    Ok(report_filepath)
+}
+
+/// フォルダを作成してファイルを出力する。
+fn write_file(filepath: &Path, contents: &str, name: &str) -> Result<(), Errors> {
+    if let Err(error) = fs::create_dir_all(filepath.parent().unwrap()) {
+        return Err(
+            log::make_error!("{}のフォルダを作成できませんでした。", name)
+                .with(&error)
+                .as_errors(),
+        );
+    }
+
+    match atomic_write::write(filepath, contents) {
+        Ok(_) => Ok(()),
+        Err(error) => Err(log::make_error!("{}の出力に失敗しました。", name)
+            .with(&error)
+            .as_errors()),
+    }
+}
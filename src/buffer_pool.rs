@@ -0,0 +1,87 @@
+use std::mem;
+use std::ops::{Deref, DerefMut};
+use std::sync::Mutex;
+
+/// 読み込み用のバッファの置き場
+/// ファイルやディスクの計算のたびに大きなバッファを確保し直さないよう、使い終わったバッファを次の計算で使い回す。
+/// 置き場のバッファは、同時に計算していたスレッドの数まで増え、全てのディスクの計算を終えるまで保持する。
+pub struct BufferPool {
+    /// バッファのバイト数
+    buffer_size: usize,
+    /// 使われていないバッファ
+    buffers: Mutex<Vec<Vec<u8>>>,
+}
+
+impl BufferPool {
+    /// 指定されたバイト数のバッファの置き場を作成する。
+    pub fn new(buffer_size: usize) -> BufferPool {
+        BufferPool {
+            buffer_size,
+            buffers: Mutex::new(vec![]),
+        }
+    }
+
+    /// 使われていないバッファを取り出す。
+    /// 置き場が空なら新しく確保する。
+    pub fn take(&self) -> PooledBuffer<'_> {
+        let buffer = self
+            .buffers
+            .lock()
+            .unwrap()
+            .pop()
+            .unwrap_or_else(|| vec![0u8; self.buffer_size]);
+        PooledBuffer { pool: self, buffer }
+    }
+
+    /// 使われていないバッファを全て破棄する。
+    /// メモリ使用量が上限を超えたときに、置き場に残ったバッファを解放するために使う。
+    pub fn clear(&self) {
+        self.buffers.lock().unwrap().clear();
+    }
+}
+
+/// 置き場から取り出したバッファ
+/// 破棄すると置き場に戻す。縮小したバッファは戻さない。
+pub struct PooledBuffer<'a> {
+    /// 取り出した置き場
+    pool: &'a BufferPool,
+    /// バッファ
+    buffer: Vec<u8>,
+}
+
+impl PooledBuffer<'_> {
+    /// バッファを指定されたバイト数に縮小し、余った領域を解放する。
+    pub fn shrink(&mut self, size: usize) {
+        if self.buffer.len() > size {
+            self.buffer = vec![0u8; size];
+        }
+    }
+
+    /// バッファを置き場に戻さずに破棄する。
+    pub fn discard(mut self) {
+        self.buffer = vec![];
+    }
+}
+
+impl Deref for PooledBuffer<'_> {
+    type Target = [u8];
+
+    fn deref(&self) -> &[u8] {
+        &self.buffer
+    }
+}
+
+impl DerefMut for PooledBuffer<'_> {
+    fn deref_mut(&mut self) -> &mut [u8] {
+        &mut self.buffer
+    }
+}
+
+impl Drop for PooledBuffer<'_> {
+    fn drop(&mut self) {
+        if self.buffer.len() == self.pool.buffer_size {
+            let buffer = mem::take(&mut self.buffer);
+            self.pool.buffers.lock().unwrap().push(buffer);
+        }
+    }
+}
@@ -1,46 +1,262 @@
-use std::collections::HashMap;
-use std::fs::File;
-use std::io::{Read, Write};
+use std::collections::{BTreeSet, HashMap, HashSet};
+use std::fs::{self, File};
+use std::io::{self, Read, Seek, SeekFrom, Write};
+use std::mem;
 use std::path::{Path, PathBuf};
-use std::sync::atomic::{AtomicBool, Ordering};
-use std::sync::mpsc::Sender;
-use std::sync::Arc;
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::sync::mpsc::{self, Receiver, RecvTimeoutError, Sender};
+use std::sync::{Arc, Condvar, Mutex};
 use std::thread::{self, JoinHandle};
-use std::time::Duration;
-
-use md5::Digest;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
 
+use crate::auto_ignore::{self, IgnoredFiles};
+use crate::buffer_pool::BufferPool;
+use crate::callbacks::{Callbacks, DiskDone, FileDone, FileFailure, FileStart};
+use crate::checkpoint::Checkpoint;
+use crate::clock;
+use crate::completion_action;
 use crate::disk::DiskInfo;
+use crate::extra_hashes;
+use crate::file_error::{FileError, FileErrorCategory, FileErrorSummary};
 use crate::filter::Filters;
-use crate::hash_file;
+use crate::hash_algorithm::{Digest, HashAlgorithm, HashContext, TreeContext, TREE_CHUNK_SIZE};
+use crate::hash_file::{self, FileStamp};
+use crate::hash_store::{self, HashStorage};
+use crate::helper_pool::{self, HelperPool};
 use crate::interruption;
+use crate::last_verified;
 use crate::log::{self, Errors};
+use crate::memory;
+use crate::mismatch_report::MismatchReport;
+use crate::page_cache;
+use crate::plan::{self, VerificationPlan};
 use crate::progress::{ProgressSender, ProgressUpdate};
+use crate::read_back::{self, ReadBackTarget};
+use crate::retry::{self, RetryPolicy};
+use crate::run_summary::{DiskSummary, RunSummary};
+use crate::symlinks;
 use crate::target_file;
 use crate::target_file::TargetFile;
+use crate::target_queue::TargetQueue;
+use crate::throughput;
+use crate::trimmed;
+use crate::truncation::TruncationCheck;
+use path_slash::PathExt;
 
 /// バッファサイズ
-const BUFFER_SIZE: usize = 10 << 20;
+pub const BUFFER_SIZE: usize = 10 << 20;
+
+/// 一部のディスクの処理に失敗した場合の終了コード
+pub const PARTIAL_FAILURE_EXIT_CODE: i32 = 1;
+
+/// 処理に失敗したディスクがあったか
+static DISK_FAILED: AtomicBool = AtomicBool::new(false);
+
+/// 空いた枠で計算スレッドを追加できるかを確認する間隔
+const HELPER_CHECK_INTERVAL: Duration = Duration::from_millis(500);
+
+/// 全速力で計算する場合のバッファサイズ
+/// 読み込みとハッシュ計算で半分ずつ使う。
+pub const FULL_SPEED_BUFFER_SIZE: usize = 128 << 20;
+
+/// 1つのファイルの塊を並行して読み込むスレッドの数の上限
+const MAX_CHUNK_READERS: usize = 8;
+
+/// ハッシュ計算と検証の指定
+/// 実行オプションから一度だけ作成し、ディスクごとのスレッドで共有する。
+#[derive(Clone)]
+pub struct CalcOptions {
+    /// 検証だけを行うか
+    pub verify_only: bool,
+    /// 検証で見つかった移動したファイルのパスをハッシュファイルで書き換えるか
+    pub update_renamed: bool,
+    /// 指定されれば、最後に検証してからこの日数が経ったファイルだけを検証する
+    pub older_than_days: Option<u64>,
+    /// 指定されれば、この検証計画でディスクに割り当てた1回の読み込み量だけを検証する
+    pub quota_plan: Option<VerificationPlan>,
+    /// 全速力で計算するか
+    pub full_speed: bool,
+    /// ハッシュ計算の範囲のディスクルートからの相対パス
+    pub scope: Option<PathBuf>,
+    /// 代替データストリームも計算するか
+    pub alternate_streams: bool,
+    /// 読み込み用のバッファのバイト数
+    pub buffer_size: Option<usize>,
+    /// このバイト数以上のファイルを塊に分けて並行して読み込む
+    pub chunked_threshold: Option<u64>,
+    /// 同時に計算するディスクの数
+    pub disks: Option<usize>,
+    /// 1台のディスクで同時に計算するファイルの数
+    pub workers: usize,
+    /// メモリ使用量の上限のバイト数
+    pub memory_limit: Option<u64>,
+    /// 読み込みに失敗したファイルの再試行の方針
+    pub retry_policy: RetryPolicy,
+    /// 書き込み直後に読み込み直して検証するファイルの割合(%)
+    pub verify_after_calc: Option<u64>,
+    /// 同じ読み込みで追加で計算するアルゴリズム
+    pub extra_algorithms: Vec<HashAlgorithm>,
+    /// ハッシュ情報の保存先
+    pub hash_storage: HashStorage,
+    /// 計算を終えたディスクでdiskファイルのon-completeの処理を行うか
+    pub run_completion_actions: bool,
+}
+
+/// ディスクごとのスレッドで使う、実行全体で共有する資源
+struct SharedResources {
+    /// 読み込み用のバッファ
+    buffer_pool: Arc<BufferPool>,
+    /// メモリ使用量の上限を超えたか
+    memory_exceeded: Arc<AtomicBool>,
+    /// 計算を終えたディスクの空いた枠
+    /// 空いた枠を使わないディスクではNoneにする。
+    helper_pool: Option<Arc<HelperPool>>,
+}
+
+/// ハッシュ計算の対象ディスク
+/// グループごとに出力フォルダ、フィルター、アルゴリズムが異なることがある。
+pub struct DiskTarget {
+    pub disk_info: DiskInfo,
+    /// ハッシュファイルの出力フォルダ
+    pub output_folder: PathBuf,
+    pub filters: Filters,
+    pub algorithm: Option<HashAlgorithm>,
+    /// 封印されたディスクか
+    pub sealed: bool,
+    /// 失敗したファイルを再試行する場合は、その一覧
+    /// 一覧のファイルだけを計算する。
+    pub failed_paths: Option<BTreeSet<PathBuf>>,
+}
 
 /// ディスクごとにハッシュ計算スレッドを開始する。
+/// 検証だけを行う場合はハッシュファイルを更新せず、ハッシュファイルのファイルを読み込み直して比較する。
+/// 同時に計算するディスクの数が指定された場合は、計算中のディスクが終わるまで次のディスクを待たせる。
+/// 1台のディスクでは指定された数のファイルを同時に計算する。
+/// メモリ使用量の上限が指定された場合は、上限を超えるとメモリの使用を抑えて計算を続ける。
+/// 決定的モードではディスクを指定された順に1台ずつ、ファイルを1つずつ計算する。
+/// 検証で見つかった差異は差異の記録にも追加する。
+/// 移動を更新する指定なら、検証で見つかった移動したファイルのパスをハッシュファイルで書き換える。
+/// ディスクごとに読み込んだファイルの数やバイト数を集計に記録する。
+/// 一時的な読み込みの失敗は再試行の方針に従って読み込み直す。
+/// 全てのディスクを同時に計算する場合は、計算を終えたディスクの空いた枠で、
+/// SSDなど並行して読み込んでも遅くならないディスクの残りのファイルを計算する。
+/// 書き込み直後の検証の割合が指定された場合は、計算したファイルの一部か全てをキャッシュを使わずに読み込み直して検証する。
+/// 完了後の処理を行う指定なら、計算を終えたディスクでdiskファイルのon-completeの処理を行う。
 pub fn start_calculation(
-    disk_info_list: Vec<DiskInfo>,
-    output_folder: &Path,
-    filters: Filters,
+    disk_targets: Vec<DiskTarget>,
     progress_tx: Sender<ProgressUpdate>,
+    callbacks: Callbacks,
+    mismatch_report: MismatchReport,
+    run_summary: RunSummary,
+    options: CalcOptions,
 ) -> Result<HashMap<String, JoinHandle<Result<(), Errors>>>, Errors> {
-    let mut worker_handles = HashMap::with_capacity(disk_info_list.len());
+    let mut worker_handles = HashMap::with_capacity(disk_targets.len());
+    // 読み込み用のバッファは全てのディスクで使い回す
+    let buffer_pool = Arc::new(BufferPool::new(
+        options
+            .buffer_size
+            .unwrap_or(default_buffer_size(options.full_speed)),
+    ));
+    let disk_slots = options.disks.map(|disks| Arc::new(DiskSlots::new(disks)));
+    let memory_exceeded = memory::start_memory_watchdog(options.memory_limit);
+    let deterministic = clock::is_deterministic();
+    let workers = if deterministic { 1 } else { options.workers };
+    let options = Arc::new(CalcOptions { workers, ..options });
+    // 同時に計算するディスクの数が指定された場合、空いた枠は次のディスクが使う
+    let helper_pool = if options.disks.is_none() && !deterministic && disk_targets.len() > 1 {
+        Some(Arc::new(HelperPool::new()))
+    } else {
+        None
+    };
+    // 決定的モードで前のディスクの計算が終わったことを受け取る
+    // 前のディスクのスレッドが送信側を破棄すると受信が終わる
+    let mut previous_turn: Option<Receiver<()>> = None;
 
-    for disk_info in disk_info_list {
+    for disk_target in disk_targets {
         // マップのキーにするためコピーを取っておく
-        let disk_id = disk_info.id.clone();
+        let disk_id = disk_target.disk_info.id.clone();
 
-        let progress_sender = ProgressSender::new(disk_info.index, progress_tx.clone());
+        let progress_sender = ProgressSender::new(disk_target.disk_info.index, progress_tx.clone());
 
-        let output_folder = output_folder.to_path_buf();
-        let filters = filters.clone();
+        let callbacks = callbacks.clone();
+        let options = options.clone();
+        let disk_slots = disk_slots.clone();
+        let memory_exceeded = memory_exceeded.clone();
+        let mismatch_report = mismatch_report.clone();
+        let run_summary = run_summary.clone();
+        let helper_pool = helper_pool.clone();
+        let buffer_pool = buffer_pool.clone();
+        // 空いた枠を使うのは並行して読み込んでも遅くならないディスクだけにする
+        let accepts_helpers = helper_pool.is_some()
+            && helper_pool::is_solid_state(disk_target.disk_info.root_path.as_path());
+        let (turn_tx, turn_rx) = mpsc::channel::<()>();
+        let previous_turn = if deterministic {
+            previous_turn.replace(turn_rx)
+        } else {
+            None
+        };
         let worker_handle = thread::spawn(move || {
-            calc_procedure(disk_info, output_folder, filters, progress_sender)
+            if let Some(previous_turn) = previous_turn {
+                let _ = previous_turn.recv();
+            }
+            // スレッドが終わるまで保持し、終わったら次のディスクに順番を渡す
+            let _turn = turn_tx;
+            let _slot = disk_slots.as_ref().map(|disk_slots| disk_slots.acquire());
+            let disk_id = disk_target.disk_info.id.clone();
+            let resources = SharedResources {
+                buffer_pool,
+                memory_exceeded,
+                helper_pool: helper_pool.clone().filter(|_| accepts_helpers),
+            };
+            let completed_disk = (options.run_completion_actions
+                && disk_target.disk_info.on_complete.len() > 0)
+                .then(|| disk_target.disk_info.clone());
+            // 封印されたディスクは検証だけを行う
+            let result = if disk_target.sealed || options.verify_only {
+                let result = verify_procedure(
+                    disk_target,
+                    progress_sender,
+                    callbacks.clone(),
+                    resources,
+                    &mismatch_report,
+                    &run_summary,
+                    &options,
+                );
+                // 差異以外の理由で検証できなかったディスクも差異として記録する
+                if let Err(errors) = &result {
+                    mismatch_report.failed(&disk_id, errors);
+                }
+                result
+            } else {
+                calc_procedure(
+                    disk_target,
+                    progress_sender,
+                    callbacks.clone(),
+                    resources,
+                    &run_summary,
+                    &options,
+                )
+            };
+            // 計算を終えたディスクの枠を他のディスクに空ける
+            if let Some(helper_pool) = &helper_pool {
+                helper_pool.release(workers);
+            }
+            // diskファイルの指定に従って、計算を終えたディスクを取り外せるようにする
+            // 中断やエラーで終わった場合は続きを計算できるよう何もしない
+            if let Some(completed_disk) = &completed_disk {
+                if result.is_ok() && !interruption::is_interrupted() {
+                    completion_action::run_completion_actions(completed_disk);
+                }
+            }
+            callbacks.disk_done(&DiskDone {
+                disk_id: &disk_id,
+                errors: result
+                    .as_ref()
+                    .err()
+                    .map_or(&[], |errors| errors.as_slice()),
+                interrupted: interruption::is_interrupted(),
+            });
+            result
         });
 
         worker_handles.insert(disk_id, worker_handle);
@@ -49,127 +265,1699 @@ pub fn start_calculation(
     Ok(worker_handles)
 }
 
+/// 同時にハッシュ計算できるディスクの枠
+struct DiskSlots {
+    /// 空いている枠の数
+    available: Mutex<usize>,
+    /// 枠が空いたことの通知
+    released: Condvar,
+}
+
+/// 使用中の枠
+/// 破棄されると枠を空ける。
+struct DiskSlot<'a> {
+    disk_slots: &'a DiskSlots,
+}
+
+impl DiskSlots {
+    fn new(disks: usize) -> DiskSlots {
+        DiskSlots {
+            available: Mutex::new(disks),
+            released: Condvar::new(),
+        }
+    }
+
+    /// 枠が空くまで待って使用する。
+    fn acquire(&self) -> DiskSlot<'_> {
+        let mut available = self.available.lock().unwrap();
+        while *available == 0 {
+            available = self.released.wait(available).unwrap();
+        }
+        *available -= 1;
+        DiskSlot { disk_slots: self }
+    }
+}
+
+impl Drop for DiskSlot<'_> {
+    fn drop(&mut self) {
+        *self.disk_slots.available.lock().unwrap() += 1;
+        self.disk_slots.released.notify_one();
+    }
+}
+
 /// ハッシュ計算スレッドのルーチン。
 fn calc_procedure(
-    disk_info: DiskInfo,
-    output_folder: PathBuf,
-    filters: Filters,
+    disk_target: DiskTarget,
     progress_sender: ProgressSender,
+    callbacks: Callbacks,
+    resources: SharedResources,
+    run_summary: &RunSummary,
+    options: &CalcOptions,
 ) -> Result<(), Errors> {
+    let DiskTarget {
+        disk_info,
+        output_folder,
+        filters,
+        algorithm,
+        failed_paths,
+        ..
+    } = disk_target;
+    let SharedResources {
+        buffer_pool,
+        memory_exceeded,
+        helper_pool,
+    } = resources;
+    let CalcOptions {
+        full_speed,
+        chunked_threshold,
+        alternate_streams,
+        workers,
+        retry_policy,
+        verify_after_calc,
+        hash_storage,
+        ..
+    } = *options;
+    let scope = options.scope.as_deref();
+    let extra_algorithms = &options.extra_algorithms;
     // ハッシュ計算の初期処理を行う
-    let (hash_filepath, target_files) =
-        init_calc_procedure(&disk_info, output_folder, &filters, &progress_sender)?;
+    let (hash_filepath, algorithm, hash_info_map, stamp_map, number_of_recorded) =
+        init_calc_procedure(
+            &disk_info,
+            output_folder.as_path(),
+            &progress_sender,
+            scope.as_deref(),
+            alternate_streams,
+            algorithm,
+            hash_storage,
+        )?;
+    // ハッシュファイルと同じアルゴリズムは追加で計算しない
+    let extra_algorithms: Vec<HashAlgorithm> = extra_algorithms
+        .iter()
+        .copied()
+        .filter(|extra_algorithm| *extra_algorithm != algorithm)
+        .collect();
+    let mut ignored_files = IgnoredFiles::load(output_folder.as_path(), &disk_info.id)?;
+    let mut truncation_check = TruncationCheck::new(output_folder.as_path(), &disk_info.id)?;
 
     // ハッシュファイルを追記モードで開く
     let mut hash_file = hash_file::open_hash_file(hash_filepath.as_path())?;
 
-    // ファイル読み込み用のバッファ
-    let mut buffer = vec![0u8; BUFFER_SIZE];
-
     // ファイルごとに発生したエラーの一覧
     let mut per_file_errors: Errors = vec![];
+    let mut file_error_summary = FileErrorSummary::new();
+    // エラーになったファイルと分類の一覧
+    let mut failures = vec![];
+    let mut number_of_vanished = 0;
+    // このハッシュ計算でハッシュファイルに追記した行数
+    let mut number_of_written = 0;
+    // 追記した行のうち、ハッシュファイルになかったファイルの行数
+    let mut number_of_added = 0;
+    // 計算し直した、前回の計算から変更されたファイル
+    let mut rehashed: HashSet<PathBuf> = HashSet::new();
+    // 書き込み直後の検証で読み込み直すファイルの一覧
+    let mut read_back_targets: Vec<ReadBackTarget> = vec![];
+    // 追加のアルゴリズムで計算したハッシュ
+    let mut extra_hashed: Vec<(PathBuf, Vec<Digest>)> = vec![];
 
-    for target_file in target_files.iter() {
-        // 新規ファイル計算開始メッセージを送信する
-        progress_sender.send_message(ProgressUpdate::new_file(
-            target_file.normalized_path().to_path_buf(),
-        ))?;
-        // 対象ファイルを開く
-        let mut file = match open_target_file(target_file.actual_path()) {
-            Ok(file) => file,
-            Err(errors) => {
-                per_file_errors.push(errors.into_iter().next().unwrap());
-                continue;
+    // 読み込み速度の計測
+    // 並行して計算した時間を重複して数えないよう、ファイルごとの時間ではなく全体の経過時間で計測する
+    let mut read_bytes = 0;
+    let start_time = Instant::now();
+
+    // 対象ファイルを一覧にしながら、ハッシュを計算できたファイルから順にハッシュファイルに出力する
+    let target_queue = TargetQueue::new();
+    let (result, mut listing) = thread::scope(|thread_scope| {
+        let lister = thread_scope.spawn(|| {
+            let listing = list_calc_targets(
+                &disk_info,
+                output_folder.as_path(),
+                &filters,
+                &progress_sender,
+                scope.as_deref(),
+                alternate_streams,
+                failed_paths.as_ref(),
+                &hash_info_map,
+                &stamp_map,
+                &mut ignored_files,
+                &mut truncation_check,
+                &target_queue,
+            );
+            target_queue.finish();
+            listing
+        });
+        let result = hash_target_files(
+            &disk_info,
+            output_folder.as_path(),
+            &target_queue,
+            &progress_sender,
+            &callbacks,
+            full_speed,
+            &buffer_pool,
+            chunked_threshold,
+            algorithm,
+            &extra_algorithms,
+            workers,
+            &memory_exceeded,
+            retry_policy,
+            helper_pool.as_deref(),
+            |target_file, result, extra_hashes| {
+                let hash = match result {
+                    Ok(hash) => hash,
+                    // 一覧にした後に削除されたファイルはエラーにせず、対象から除外する
+                    Err(file_error) if file_error.category == FileErrorCategory::Vanished => {
+                        log::info(
+                            format!(
+                                "{}: 一覧にした後に削除されたファイルです。: {}",
+                                &disk_info.id,
+                                target_file.normalized_path().to_str().unwrap()
+                            )
+                            .as_str(),
+                        );
+                        number_of_vanished += 1;
+                        return progress_sender
+                            .send_message(ProgressUpdate::vanished(target_file.size));
+                    }
+                    Err(file_error) => {
+                        file_error_summary.add(file_error.category);
+                        failures.push((
+                            target_file.normalized_path().to_path_buf(),
+                            file_error.category,
+                        ));
+                        per_file_errors.push(file_error.error);
+                        // 処理できなかったファイルも完了とする
+                        return progress_sender.send_message(ProgressUpdate::done());
+                    }
+                };
+                read_bytes += target_file.size;
+                // ハッシュファイルの行を作成する
+                let hash_file_line = hash_file::add_stamped_hash_file_line(
+                    String::new(),
+                    target_file.normalized_path(),
+                    &hash,
+                    target_file.stamp().as_ref(),
+                );
+                // ハッシュファイルに行を出力する
+                if let Err(error) = hash_file.write_all(hash_file_line.as_bytes()) {
+                    return Err(log::make_error!("ハッシュファイルに書き込めません。")
+                        .with(&error)
+                        .as_errors());
+                }
+                number_of_written += 1;
+                if extra_hashes.len() > 0 {
+                    extra_hashed.push((target_file.normalized_path().to_path_buf(), extra_hashes));
+                }
+                if hash_info_map.contains_key(target_file.normalized_path()) {
+                    rehashed.insert(target_file.normalized_path().to_path_buf());
+                } else {
+                    number_of_added += 1;
+                }
+                // リンク先を記録したシンボリックリンクは読み込み直しても同じハッシュにならない
+                if let Some(percent) =
+                    verify_after_calc.filter(|_| target_file.link_target().is_none())
+                {
+                    if read_back::is_sampled(&hash, percent) {
+                        read_back_targets.push(ReadBackTarget {
+                            actual_path: target_file.actual_path().to_path_buf(),
+                            normalized_path: target_file.normalized_path().to_path_buf(),
+                            hash,
+                        });
+                    }
+                }
+
+                // ファイル計算完了メッセージを送信する
+                progress_sender.send_message(ProgressUpdate::done())
+            },
+        );
+        (result, lister.join().unwrap())
+    });
+    // 中断やエラーで終わった場合も、計算済みの行はディスクに書き出しておく
+    hash_file::sync_hash_file(&hash_file, hash_filepath.as_path())?;
+    // 中断した場合もそれまでの実績を集計する
+    run_summary.record(
+        &disk_info.id,
+        DiskSummary {
+            files_hashed: number_of_written,
+            bytes: read_bytes,
+            elapsed: start_time.elapsed(),
+            read_errors: failures.len(),
+            resume_skipped: listing.number_of_skipped,
+            filter_skipped: listing.number_of_filtered,
+            label: disk_info.metadata.label.clone(),
+            ..Default::default()
+        },
+    );
+    // エラーで終わった場合も、計算できたファイルの追加のハッシュは記録しておく
+    if result.is_err() {
+        extra_hashes::record_extra_hashes(
+            output_folder.as_path(),
+            &disk_info.id,
+            &extra_algorithms,
+            mem::take(&mut extra_hashed),
+        )?;
+        return result;
+    }
+    if listing.number_of_unsettled > 0 {
+        log::info(
+            format!(
+                "{}: 更新されたばかりの{}件のファイルは次の確認で計算します。",
+                &disk_info.id, listing.number_of_unsettled
+            )
+            .as_str(),
+        );
+    }
+    // 最後まで一覧にした場合は、空のファイルと前回より極端に小さくなったファイルを報告し、
+    // リンク先を記録するシンボリックリンクのリンク先を保存する
+    if listing.completed {
+        truncation_check.finish(output_folder.as_path(), &disk_info.id, scope.as_deref())?;
+        symlinks::record_link_targets(
+            output_folder.as_path(),
+            &disk_info.id,
+            mem::take(&mut listing.symlinks),
+            scope.as_deref(),
+        )?;
+    }
+    // 中断した場合も、追記したハッシュファイルを整理して書き直す
+    rewrite_hash_file(
+        &disk_info.id,
+        output_folder.as_path(),
+        hash_storage,
+        algorithm,
+        &hash_info_map,
+        &listing,
+        &rehashed,
+        number_of_recorded + number_of_added,
+    )?;
+    extra_hashes::record_extra_hashes(
+        output_folder.as_path(),
+        &disk_info.id,
+        &extra_algorithms,
+        extra_hashed,
+    )?;
+    if interruption::is_interrupted() {
+        return Ok(());
+    }
+
+    // ハッシュファイルに記録した後で、計算したファイルをディスクから読み込み直して検証する
+    if verify_after_calc.is_some() {
+        per_file_errors.append(&mut read_back::verify_read_back(
+            &disk_info.id,
+            number_of_written,
+            &read_back_targets,
+            &mut buffer_pool.take(),
+            algorithm,
+        ));
+    }
+
+    throughput::record_throughput(
+        output_folder.as_path(),
+        &disk_info.id,
+        read_bytes,
+        start_time.elapsed(),
+    )?;
+    file_error_summary.log(&disk_info.id);
+    auto_ignore::record_failures(
+        output_folder.as_path(),
+        &disk_info.id,
+        &failures,
+        scope.as_deref(),
+    )?;
+    retry::record_failed(
+        output_folder.as_path(),
+        &disk_info.id,
+        &failures,
+        scope.as_deref(),
+    )?;
+    if number_of_vanished > 0 {
+        log::info(
+            format!(
+                "{}: 処理中に削除された{}件のファイルを対象から除外しました。",
+                &disk_info.id, number_of_vanished
+            )
+            .as_str(),
+        );
+    }
+
+    if per_file_errors.len() == 0 {
+        Ok(())
+    } else {
+        Err(per_file_errors)
+    }
+}
+
+/// ハッシュファイルの検証スレッドのルーチン。
+/// ハッシュファイルは更新せず、ハッシュファイルにあるファイルを読み込み直してハッシュを比較する。
+/// ハッシュが異なるファイル、なくなったファイル、読み込めないファイルをエラーにする。
+/// 封印されたディスクは追加されたファイルもエラーにする。
+/// なくなったファイルと同じハッシュとバイト数のファイルが追加されていれば、消失と追加ではなく移動としてエラーにする。
+/// 移動を更新する指定なら、封印されていないディスクのハッシュファイルのパスを移動先に書き換え、エラーにしない。
+fn verify_procedure(
+    disk_target: DiskTarget,
+    progress_sender: ProgressSender,
+    callbacks: Callbacks,
+    resources: SharedResources,
+    mismatch_report: &MismatchReport,
+    run_summary: &RunSummary,
+    options: &CalcOptions,
+) -> Result<(), Errors> {
+    let DiskTarget {
+        disk_info,
+        output_folder,
+        filters,
+        algorithm,
+        sealed,
+        ..
+    } = disk_target;
+    let SharedResources {
+        buffer_pool,
+        memory_exceeded,
+        helper_pool,
+    } = resources;
+    let CalcOptions {
+        update_renamed,
+        older_than_days,
+        full_speed,
+        chunked_threshold,
+        alternate_streams,
+        workers,
+        retry_policy,
+        hash_storage,
+        ..
+    } = *options;
+    let scope = options.scope.as_deref();
+    // 初期化メッセージを送信する
+    progress_sender.send_message(ProgressUpdate::init(disk_info.id.clone()))?;
+    // ハッシュファイルの情報をマップにする
+    // 範囲が指定された場合は範囲内の情報だけを検証する
+    let hash_filepath = output_folder.join(&disk_info.id);
+    if !hash_filepath.is_file() {
+        return Err(
+            log::make_error!("{}: 検証するハッシュファイルがありません。", &disk_info.id)
+                .as_errors(),
+        );
+    }
+    // 検証するディスクを表す文言
+    let disk_label = if sealed {
+        "封印されたディスク"
+    } else {
+        "ディスク"
+    };
+    // ハッシュファイルのアルゴリズムで検証する
+    let algorithm = hash_file::resolve_algorithm(hash_filepath.as_path(), algorithm)?;
+    let (hash_info_map, stamp_map) =
+        hash_store::load_hash_info(hash_storage, output_folder.as_path(), &disk_info.id)?;
+    let hash_info_map: HashMap<PathBuf, Digest> = hash_info_map
+        .into_iter()
+        .filter(|(target_filepath, _)| {
+            is_in_scope(target_filepath, scope.as_deref(), alternate_streams)
+        })
+        .collect();
+    // 対象ファイルを一覧にする
+    let (target_files, number_of_filtered) =
+        target_file::count_filtered_scoped_target_files(&disk_info, &filters, scope.as_deref());
+    let target_files = in_stable_order(with_alternate_streams(
+        &disk_info.id,
+        target_files,
+        alternate_streams,
+    ));
+
+    // 差異の一覧
+    let mut differences: Errors = vec![];
+    // 種類ごとの差異の件数
+    let mut number_of_mismatched = 0;
+    let mut number_of_unreadable = 0;
+
+    // ハッシュファイルにあってディスクにないファイル
+    let (_, missing_hash_info_map) =
+        hash_file::remove_hash_info_for_missing_file(hash_info_map.clone(), &target_files);
+    // 移動したファイルを探せるよう、なくなったファイルをハッシュとバイト数で引けるようにする
+    // バイト数が記録されていないファイルは移動先の候補を絞れないので探さない
+    let mut missing_index: HashMap<(Digest, u64), Vec<PathBuf>> = HashMap::new();
+    for (target_filepath, expected_hash) in missing_hash_info_map.iter() {
+        if let Some(stamp) = stamp_map.get(target_filepath) {
+            missing_index
+                .entry((*expected_hash, stamp.size))
+                .or_default()
+                .push(target_filepath.clone());
+        }
+    }
+    let missing_sizes: HashSet<u64> = missing_index.keys().map(|(_, size)| *size).collect();
+
+    // 最後に検証した日時を指定されていれば、期限の過ぎたファイルだけを検証する
+    // 検証計画の割り当てでも、最後に検証した日時の古いファイルから検証する
+    let last_verified = if older_than_days.is_some() || options.quota_plan.is_some() {
+        hash_store::load_last_verified(hash_storage, output_folder.as_path(), &disk_info.id)?
+    } else {
+        HashMap::new()
+    };
+    let mut number_of_not_due = 0;
+
+    // ディスクにあってハッシュファイルにないファイル
+    // なくなったファイルとバイト数が同じファイルは移動先の候補としてハッシュを計算する
+    // 封印されていないディスクは次のハッシュ計算で追加されるので差異にしない
+    let mut verified_files = vec![];
+    let mut added_files = vec![];
+    for target_file in target_files {
+        if hash_info_map.contains_key(target_file.normalized_path()) {
+            if let Some(days) = older_than_days {
+                if !last_verified::is_due(&last_verified, target_file.normalized_path(), days) {
+                    number_of_not_due += 1;
+                    continue;
+                }
             }
-        };
-        // ファイルを読み込んでハッシュを計算する
-        let hash = match read_and_calc_hash(&progress_sender, &mut buffer, &mut file) {
-            Ok(hash) => hash,
-            Err(errors) => {
-                per_file_errors.push(errors.into_iter().next().unwrap());
-                continue;
+            verified_files.push(target_file);
+        } else {
+            if sealed {
+                added_files.push(target_file.normalized_path().to_path_buf());
+            }
+            if missing_sizes.contains(&target_file.size) {
+                verified_files.push(target_file);
+            }
+        }
+    }
+    // 検証計画の割り当てが指定されていれば、1回の読み込み量を超える分は次の実行で検証する
+    let mut number_of_over_quota = 0;
+    if let Some(quota_plan) = &options.quota_plan {
+        if let Some(bytes_per_run) = plan::bytes_per_run(
+            output_folder.as_path(),
+            &disk_info.id,
+            disk_info.priority,
+            quota_plan,
+        )? {
+            let number_of_listed = verified_files.len();
+            verified_files = select_within_quota(
+                verified_files,
+                &hash_info_map,
+                &last_verified,
+                bytes_per_run,
+            );
+            number_of_over_quota = number_of_listed - verified_files.len();
+            if number_of_over_quota > 0 {
+                log::info(
+                    format!(
+                        "{}: 検証計画の1回の読み込み量({:.2}GB)を超える{}件のファイルは次の実行で検証します。",
+                        &disk_info.id,
+                        bytes_per_run as f64 / (1u64 << 30) as f64,
+                        number_of_over_quota
+                    )
+                    .as_str(),
+                );
             }
-        };
-        // ハッシュファイルの行を作成する
-        let hash_file_line =
-            hash_file::add_hash_file_line(String::new(), target_file.normalized_path(), &hash);
-        // ハッシュファイルに行を出力する
-        if let Err(error) = hash_file.write(hash_file_line.as_bytes()) {
-            return Err(log::make_error!("ハッシュファイルに書き込めません。")
-                .with(&error)
-                .as_errors());
         }
-        hash_file.flush().unwrap();
+    }
+
+    // メッセージを送信する
+    let number_of_files = verified_files.len();
+    let total_size = target_file::calc_total_size(&verified_files);
+    progress_sender.send_message(ProgressUpdate::list_targets(number_of_files, total_size))?;
+
+    // 読み込み速度の計測
+    // 並行して計算した時間を重複して数えないよう、ファイルごとの時間ではなく全体の経過時間で計測する
+    let mut read_bytes = 0;
+    let start_time = Instant::now();
+
+    let mut file_error_summary = FileErrorSummary::new();
+    // 移動したファイルの移動元、移動先、移動先のバイト数と更新日時
+    let mut renames: Vec<(PathBuf, PathBuf, Option<FileStamp>)> = vec![];
+    let mut number_of_read = 0;
+    // ハッシュが一致したファイル
+    let mut matched_paths = vec![];
+
+    let result = hash_target_files(
+        &disk_info,
+        output_folder.as_path(),
+        &TargetQueue::from_files(verified_files),
+        &progress_sender,
+        &callbacks,
+        full_speed,
+        &buffer_pool,
+        chunked_threshold,
+        algorithm,
+        &[],
+        workers,
+        &memory_exceeded,
+        retry_policy,
+        helper_pool.as_deref(),
+        |target_file, result, _| {
+            let expected_hash = hash_info_map.get(target_file.normalized_path());
+            match result {
+                // 移動先の候補なら、同じハッシュとバイト数のなくなったファイルを移動元とする
+                Ok(hash) if expected_hash.is_none() => {
+                    number_of_read += 1;
+                    read_bytes += target_file.size;
+                    if let Some(from) = missing_index
+                        .get_mut(&(hash, target_file.size))
+                        .and_then(|from| from.pop())
+                    {
+                        renames.push((
+                            from,
+                            target_file.normalized_path().to_path_buf(),
+                            target_file.stamp(),
+                        ));
+                    }
+                }
+                Ok(hash) => {
+                    number_of_read += 1;
+                    read_bytes += target_file.size;
+                    // ハッシュファイルのハッシュと比較する
+                    if expected_hash == Some(&hash) {
+                        matched_paths.push(target_file.normalized_path().to_path_buf());
+                    } else {
+                        number_of_mismatched += 1;
+                        mismatch_report.mismatch(
+                            &disk_info.id,
+                            target_file.normalized_path(),
+                            expected_hash,
+                            &hash,
+                        );
+                        differences.push(log::make_error!(
+                            "{}: {}のファイルのハッシュが異なります。: {}",
+                            &disk_info.id,
+                            disk_label,
+                            target_file.normalized_path().to_str().unwrap()
+                        ));
+                    }
+                }
+                // 移動先の候補を読み込めなければ移動を判定しない
+                Err(_) if expected_hash.is_none() => {}
+                Err(file_error) => {
+                    number_of_unreadable += 1;
+                    file_error_summary.add(file_error.category);
+                    mismatch_report.unreadable(
+                        &disk_info.id,
+                        target_file.normalized_path(),
+                        &file_error,
+                    );
+                    differences.push(file_error.error);
+                }
+            }
 
-        // ファイル計算完了メッセージを送信する
-        progress_sender.send_message(ProgressUpdate::done())?;
+            // ファイル計算完了メッセージを送信する
+            progress_sender.send_message(ProgressUpdate::done())
+        },
+    );
+    // 中断した場合もそれまでの実績を集計する
+    run_summary.record(
+        &disk_info.id,
+        DiskSummary {
+            files_hashed: number_of_read,
+            bytes: read_bytes,
+            elapsed: start_time.elapsed(),
+            resume_skipped: number_of_not_due + number_of_over_quota,
+            filter_skipped: number_of_filtered,
+            read_errors: number_of_unreadable,
+            label: disk_info.metadata.label.clone(),
+            ..Default::default()
+        },
+    );
+    // 中断やエラーで終わった場合も、検証できたファイルは記録しておく
+    hash_store::record_verified(
+        hash_storage,
+        output_folder.as_path(),
+        &disk_info.id,
+        matched_paths,
+    )?;
+    if number_of_not_due > 0 {
+        log::info(
+            format!(
+                "{}: {}日以内に検証した{}件のファイルは検証しません。",
+                &disk_info.id,
+                older_than_days.unwrap(),
+                number_of_not_due
+            )
+            .as_str(),
+        );
+    }
+    result?;
+    // 中断した場合は検証していないファイルがあるので差異を判断しない
+    if interruption::is_interrupted() {
+        return Ok(());
     }
 
-    if per_file_errors.len() == 0 {
+    // 移動したファイルは消失と追加ではなく移動として扱う
+    renames.sort_by(|a, b| (&a.0, &a.1).cmp(&(&b.0, &b.1)));
+    let renamed_from: HashSet<&PathBuf> = renames.iter().map(|(from, _, _)| from).collect();
+    let renamed_to: HashSet<&PathBuf> = renames.iter().map(|(_, to, _)| to).collect();
+    let mut number_of_missing = 0;
+    for (target_filepath, expected_hash) in missing_hash_info_map.iter() {
+        if renamed_from.contains(target_filepath) {
+            continue;
+        }
+        number_of_missing += 1;
+        mismatch_report.missing(&disk_info.id, target_filepath, expected_hash);
+        differences.push(log::make_error!(
+            "{}: {}からファイルがなくなっています。: {}",
+            &disk_info.id,
+            disk_label,
+            target_filepath.to_str().unwrap()
+        ));
+    }
+    for added_file in added_files.iter() {
+        if renamed_to.contains(added_file) {
+            continue;
+        }
+        mismatch_report.added(&disk_info.id, added_file);
+        differences.push(log::make_error!(
+            "{}: 封印されたディスクにファイルが追加されています。: {}",
+            &disk_info.id,
+            added_file.to_str().unwrap()
+        ));
+    }
+
+    // 移動したファイルは、指定されればハッシュファイルのパスを移動先に書き換える
+    // 封印されたディスクのハッシュファイルは書き換えない
+    let number_of_renamed = renames.len();
+    if number_of_renamed > 0 && update_renamed && !sealed {
+        update_renamed_paths(
+            hash_storage,
+            output_folder.as_path(),
+            &disk_info.id,
+            algorithm,
+            &renames,
+        )?;
+        for (from, to, _) in renames.iter() {
+            log::info(
+                format!(
+                    "{}: ハッシュファイルのパスを移動先に更新しました。: {} -> {}",
+                    &disk_info.id,
+                    from.to_str().unwrap(),
+                    to.to_str().unwrap()
+                )
+                .as_str(),
+            );
+        }
+    } else {
+        for (from, to, _) in renames.iter() {
+            mismatch_report.renamed(&disk_info.id, from, to);
+            differences.push(log::make_error!(
+                "{}: {}のファイルが移動されています。: {} -> {}",
+                &disk_info.id,
+                disk_label,
+                from.to_str().unwrap(),
+                to.to_str().unwrap()
+            ));
+        }
+        if number_of_renamed > 0 && !sealed {
+            log::info(
+                format!(
+                    "{}: --update-renamedを付けて検証すると、ハッシュファイルのパスを移動先に更新します。",
+                    &disk_info.id
+                )
+                .as_str(),
+            );
+        }
+    }
+
+    throughput::record_throughput(
+        output_folder.as_path(),
+        &disk_info.id,
+        read_bytes,
+        start_time.elapsed(),
+    )?;
+    file_error_summary.log(&disk_info.id);
+
+    if differences.len() == 0 {
+        log::info(
+            format!(
+                "{}: {}の検証で差異はありませんでした。({}ファイル)",
+                &disk_info.id, disk_label, number_of_files
+            )
+            .as_str(),
+        );
         Ok(())
     } else {
-        Err(per_file_errors)
+        log::error(
+            format!(
+                "{}: {}に{}件の差異があります。(ハッシュ不一致 {}件 / 消失 {}件 / 移動 {}件 / 読み込み不可 {}件)",
+                &disk_info.id,
+                disk_label,
+                differences.len(),
+                number_of_mismatched,
+                number_of_missing,
+                number_of_renamed,
+                number_of_unreadable
+            )
+            .as_str(),
+        );
+        Err(differences)
     }
 }
 
+/// 移動したファイルのハッシュファイルの行を、移動先のパスとバイト数と更新日時に書き換える。
+/// 範囲外の行も含めてハッシュファイル全体を読み込み直して出力する。
+fn update_renamed_paths(
+    hash_storage: HashStorage,
+    output_folder: &Path,
+    disk_id: &str,
+    algorithm: HashAlgorithm,
+    renames: &[(PathBuf, PathBuf, Option<FileStamp>)],
+) -> Result<(), Errors> {
+    let (mut hash_info_map, mut stamp_map) =
+        hash_store::load_hash_info(hash_storage, output_folder, disk_id)?;
+    for (from, to, stamp) in renames {
+        if let Some(hash) = hash_info_map.remove(from) {
+            hash_info_map.insert(to.clone(), hash);
+        }
+        stamp_map.remove(from);
+        if let Some(stamp) = stamp {
+            stamp_map.insert(to.clone(), *stamp);
+        }
+    }
+    hash_store::write_hash_info(
+        hash_storage,
+        output_folder,
+        disk_id,
+        algorithm,
+        hash_info_map,
+        &stamp_map,
+    )
+}
+
+/// ハッシュ計算の後に書き込んだハッシュファイルを読み込み直し、ファイルの数が書き込んだファイルの数と一致するか確認する。
+/// 変更されたファイルは同じパスの行を追記しているので、パスごとに数える。
+/// 読み込めない行があっても、数が一致しなくてもエラーにする。
+fn check_written_hash_file(
+    disk_id: &str,
+    hash_filepath: &Path,
+    number_of_expected: usize,
+) -> Result<(), Errors> {
+    let number_of_lines = match hash_file::load_hash_info_with_duplicates(hash_filepath) {
+        Ok((hash_info_map, _)) => hash_info_map.len(),
+        Err(mut errors) => {
+            errors.push(log::make_error!(
+                "{}: 書き込んだハッシュファイルを読み込み直せませんでした。出力先のディスクを確認してください。",
+                disk_id
+            ));
+            return Err(errors);
+        }
+    };
+    if number_of_lines != number_of_expected {
+        return Err(log::make_error!(
+            "{}: 書き込んだハッシュファイルの行数が一致しません。出力先のディスクを確認してください。(書き込み {}件 / 読み込み {}件)",
+            disk_id,
+            number_of_expected,
+            number_of_lines
+        )
+        .as_errors());
+    }
+    Ok(())
+}
+
 /// ハッシュ計算の初期処理を行う。
+/// ハッシュファイルがなければアルゴリズムのヘッダーだけを出力し、以降は追記する。
+/// ハッシュファイル、アルゴリズム、範囲内のハッシュ情報マップとバイト数と更新日時のマップ、
+/// ハッシュファイルの範囲外も含めた行数を返す。
 fn init_calc_procedure(
     disk_info: &DiskInfo,
-    output_folder: PathBuf,
-    filters: &Filters,
+    output_folder: &Path,
     progress_sender: &ProgressSender,
-) -> Result<(PathBuf, Vec<TargetFile>), Errors> {
+    scope: Option<&Path>,
+    alternate_streams: bool,
+    algorithm: Option<HashAlgorithm>,
+    hash_storage: HashStorage,
+) -> Result<
+    (
+        PathBuf,
+        HashAlgorithm,
+        HashMap<PathBuf, Digest>,
+        HashMap<PathBuf, FileStamp>,
+        usize,
+    ),
+    Errors,
+> {
     // 初期化メッセージを送信する
     progress_sender.send_message(ProgressUpdate::init(disk_info.id.clone()))?;
     // ハッシュファイルのパスを取得する
     let hash_filepath = output_folder.join(&disk_info.id);
+    // ハッシュファイルのアルゴリズムを決める
+    let algorithm = hash_file::resolve_algorithm(hash_filepath.as_path(), algorithm)?;
     // ハッシュファイルの情報をマップにする
-    let hash_info_map = hash_file::load_hash_info(hash_filepath.as_path())?;
-    // ハッシュファイルをバックアップする
-    let backup_filepath = hash_file::backup(hash_filepath.as_path())?;
-    // 対象ファイルを一覧にする
-    let target_files = target_file::list_target_files(disk_info.root_path.as_path(), &filters);
-    // ハッシュ情報マップから対象ファイルが存在しない情報を削除する
-    let hash_info_map = hash_file::remove_hash_info_for_missing_file(hash_info_map, &target_files);
-    // 対象ファイルの一覧からハッシュファイルに情報があったものを除外する
-    let target_files = target_file::remove_calculated_file(target_files, &hash_info_map);
-    // 計算済みのハッシュをファイルに出力する
-    hash_file::write_calculated_hash(hash_filepath.as_path(), hash_info_map)?;
-    // ハッシュファイルのバックアップを削除する
+    let (hash_info_map, stamp_map) =
+        hash_store::load_hash_info(hash_storage, output_folder, &disk_info.id)?;
+    let number_of_recorded = hash_info_map.len();
+    // 範囲外の情報は手を付けずにハッシュファイルに残す
+    let hash_info_map: HashMap<_, _> = hash_info_map
+        .into_iter()
+        .filter(|(target_filepath, _)| is_in_scope(target_filepath, scope, alternate_streams))
+        .collect();
+    hash_file::prepare_hash_file(hash_filepath.as_path(), algorithm)?;
+    // 対象ファイルは一覧にしながら進捗に加えていく
+    progress_sender.send_message(ProgressUpdate::list_targets(0, 0))?;
+
+    Ok((
+        hash_filepath,
+        algorithm,
+        hash_info_map,
+        stamp_map,
+        number_of_recorded,
+    ))
+}
+
+/// ハッシュ計算の対象ファイルを一覧にした結果
+#[derive(Default)]
+struct Listing {
+    /// 最後まで一覧にしたか
+    completed: bool,
+    /// フィルターで対象外にしたファイルの数
+    number_of_filtered: usize,
+    /// 計算済みか、再試行で失敗していないため計算しないファイルの数
+    number_of_skipped: usize,
+    /// ディスクにあった、ハッシュファイルに記録されたファイル
+    found: HashSet<PathBuf>,
+    /// 前回の計算から変更されたファイル
+    changed: Vec<PathBuf>,
+    /// バイト数と更新日時が記録されていなかったファイルの現在のバイト数と更新日時
+    new_stamps: Vec<(PathBuf, FileStamp)>,
+    /// リンク先を記録するシンボリックリンクの正規化ファイルパスとリンク先
+    symlinks: Vec<(PathBuf, PathBuf)>,
+    /// 更新されたばかりのため、次の確認まで計算しないファイルの数
+    number_of_unsettled: usize,
+}
+
+/// ハッシュ計算の対象ファイルを一覧にしながら、計算するファイルを待ち行列に追加する。
+/// 一覧の全体をメモリに持たないよう、ディスクを探索しながら1件ずつ判定する。
+/// 計算済みで変更されていないファイルと、再試行で失敗していないファイルは追加しない。
+/// 追加したファイルは、計算スレッドが取り出す前に総ファイル数と総容量として進捗に送信する。
+/// 決定的モードでは計算する順序がディスクのエントリーの順序に左右されないよう、全て一覧にしてからパス順に追加する。
+/// 中断を受けたら一覧にするのをやめる。
+fn list_calc_targets(
+    disk_info: &DiskInfo,
+    output_folder: &Path,
+    filters: &Filters,
+    progress_sender: &ProgressSender,
+    scope: Option<&Path>,
+    alternate_streams: bool,
+    failed_paths: Option<&BTreeSet<PathBuf>>,
+    hash_info_map: &HashMap<PathBuf, Digest>,
+    stamp_map: &HashMap<PathBuf, FileStamp>,
+    ignored_files: &mut IgnoredFiles,
+    truncation_check: &mut TruncationCheck,
+    target_queue: &TargetQueue,
+) -> Listing {
+    let mut listing = Listing::default();
+    let mut add_target_file = |target_file: TargetFile| -> bool {
+        if interruption::is_interrupted() {
+            return false;
+        }
+        // 繰り返しエラーになったファイルを除外する
+        if ignored_files.ignores(&target_file) {
+            return true;
+        }
+        let target_filepath = target_file.normalized_path();
+        if let Some(link_target) = target_file.link_target() {
+            listing
+                .symlinks
+                .push((target_filepath.to_path_buf(), link_target.to_path_buf()));
+        }
+        // 書き込み中のファイルを計算しないよう、更新されたばかりのファイルは次の確認まで待つ
+        // 記録済みのファイルは前回の行を残す
+        if is_unsettled(&target_file, filters.settle()) {
+            if hash_info_map.contains_key(target_filepath) {
+                listing.found.insert(target_filepath.to_path_buf());
+            }
+            listing.number_of_unsettled += 1;
+            return true;
+        }
+        // 空のファイルと前回より極端に小さくなったファイルを確認する
+        truncation_check.observe(&target_file);
+        // 前回の計算からバイト数か更新日時が変わったファイルは計算し直す
+        if hash_info_map.contains_key(target_filepath) {
+            listing.found.insert(target_filepath.to_path_buf());
+            let changed = match (target_file.stamp(), stamp_map.get(target_filepath)) {
+                (Some(current_stamp), Some(recorded_stamp)) => current_stamp != *recorded_stamp,
+                (Some(current_stamp), None) => {
+                    listing
+                        .new_stamps
+                        .push((target_filepath.to_path_buf(), current_stamp));
+                    false
+                }
+                (None, _) => false,
+            };
+            if !changed {
+                listing.number_of_skipped += 1;
+                return true;
+            }
+            log::info(
+                format!(
+                    "{}: 前回の計算から変更されたファイルです。ハッシュを計算し直します。: {}",
+                    &disk_info.id,
+                    target_filepath.to_str().unwrap()
+                )
+                .as_str(),
+            );
+            listing.changed.push(target_filepath.to_path_buf());
+        }
+        // 再試行する場合は、ハッシュファイルの更新は通常のハッシュ計算と同じく行い、計算だけを失敗したファイルに絞る
+        if let Some(failed_paths) = failed_paths {
+            if !failed_paths.contains(target_filepath) {
+                listing.number_of_skipped += 1;
+                return true;
+            }
+        }
+        if progress_sender
+            .send_message(ProgressUpdate::add_targets(1, target_file.size))
+            .is_err()
+        {
+            return false;
+        }
+        target_queue.push(target_file)
+    };
+
+    let (completed, number_of_filtered) = if clock::is_deterministic() {
+        let (target_files, number_of_filtered) =
+            target_file::count_filtered_scoped_target_files(disk_info, filters, scope);
+        let target_files = in_stable_order(with_alternate_streams(
+            &disk_info.id,
+            target_files,
+            alternate_streams,
+        ));
+        let completed = target_files.into_iter().all(&mut add_target_file);
+        (completed, number_of_filtered)
+    } else {
+        let mut completed = true;
+        let mut number_of_streams = 0;
+        let number_of_filtered =
+            target_file::walk_scoped_target_files(disk_info, filters, scope, &mut |target_file| {
+                completed = if alternate_streams {
+                    let target_files = target_file::add_alternate_streams(vec![target_file]);
+                    number_of_streams += target_files.len() - 1;
+                    target_files.into_iter().all(&mut add_target_file)
+                } else {
+                    add_target_file(target_file)
+                };
+                completed
+            });
+        if number_of_streams > 0 {
+            log::info(
+                format!(
+                    "{}: 代替データストリームが{}件あります。",
+                    &disk_info.id, number_of_streams
+                )
+                .as_str(),
+            );
+        }
+        (completed, number_of_filtered)
+    };
+    ignored_files.log(output_folder, &disk_info.id);
+
+    listing.completed = completed;
+    listing.number_of_filtered = number_of_filtered;
+    listing
+}
+
+/// ファイルが指定された時間より最近に更新されたかを返す。
+/// 時間が指定されていないか、更新日時を取得できなければfalseを返す。
+fn is_unsettled(target_file: &TargetFile, settle: Option<Duration>) -> bool {
+    let (settle, stamp) = match (settle, target_file.stamp()) {
+        (Some(settle), Some(stamp)) => (settle, stamp),
+        _ => return false,
+    };
+    let now = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_secs();
+    stamp.modified + settle.as_secs() > now
+}
+
+/// 追記を終えたハッシュファイルを整理して書き直す。
+/// 変更されたファイルは古い行の後に新しい行を追記しているので、同じパスの行は最後の行を使う。
+/// 計算し直せなかった変更されたファイルの古い行と、最後まで一覧にした場合はディスクにないファイルの行を削除する。
+/// バイト数と更新日時が記録されていなかった行には、現在のバイト数と更新日時を記録する。
+/// 範囲外の行はそのまま残す。
+fn rewrite_hash_file(
+    disk_id: &str,
+    output_folder: &Path,
+    hash_storage: HashStorage,
+    algorithm: HashAlgorithm,
+    recorded_hash_info_map: &HashMap<PathBuf, Digest>,
+    listing: &Listing,
+    rehashed: &HashSet<PathBuf>,
+    number_of_expected: usize,
+) -> Result<(), Errors> {
+    let hash_filepath = output_folder.join(disk_id);
+    let hash_filepath = hash_filepath.as_path();
+    // 出力先のディスクの不具合で書き込みが失われていないか、ハッシュファイルを読み込み直して確認する
+    // 追記した行はハッシュファイルにしかないので、データベースに保存する場合もハッシュファイルを読み込む
+    check_written_hash_file(disk_id, hash_filepath, number_of_expected)?;
+    let (mut hash_info_map, _) = hash_file::load_hash_info_with_duplicates(hash_filepath)?;
+    let mut stamp_map = hash_file::load_file_stamps(hash_filepath)?;
+
+    for changed_filepath in listing.changed.iter() {
+        if !rehashed.contains(changed_filepath) {
+            hash_info_map.remove(changed_filepath);
+        }
+    }
+    if listing.completed {
+        // ハッシュ情報マップから対象ファイルが存在しない情報を削除する
+        let trimmed_hash_info_map: HashMap<PathBuf, Digest> = recorded_hash_info_map
+            .iter()
+            .filter(|(target_filepath, _)| !listing.found.contains(*target_filepath))
+            .map(|(target_filepath, hash)| (target_filepath.clone(), *hash))
+            .collect();
+        for target_filepath in trimmed_hash_info_map.keys() {
+            hash_info_map.remove(target_filepath);
+        }
+        // 削除した情報は後で戻せるように保存しておく
+        trimmed::save_trimmed_hash_info(output_folder, disk_id, algorithm, &trimmed_hash_info_map)?;
+    }
+    stamp_map.extend(listing.new_stamps.iter().cloned());
+
+    let backup_filepath = hash_file::backup(hash_filepath)?;
+    hash_store::write_hash_info(
+        hash_storage,
+        output_folder,
+        disk_id,
+        algorithm,
+        hash_info_map,
+        &stamp_map,
+    )?;
     hash_file::delete_backup(backup_filepath);
-    // メッセージを送信する
+    Ok(())
+}
+
+/// ハッシュ計算で計算するファイルを一覧にする。
+/// ハッシュ計算の初期処理と同じく、ディスクにないファイルと変更されたファイルの情報を除いてハッシュファイルと照合するが、
+/// ハッシュファイルなどは変更しない。
+pub fn list_files_to_hash(
+    disk_info: &DiskInfo,
+    output_folder: &Path,
+    filters: &Filters,
+    scope: Option<&Path>,
+    alternate_streams: bool,
+) -> Result<Vec<TargetFile>, Errors> {
+    let hash_filepath = output_folder.join(&disk_info.id);
+    let hash_info_map: HashMap<_, _> = hash_file::load_hash_info(hash_filepath.as_path())?
+        .into_iter()
+        .filter(|(target_filepath, _)| is_in_scope(target_filepath, scope, alternate_streams))
+        .collect();
+    let mut stamp_map = hash_file::load_file_stamps(hash_filepath.as_path())?;
+    let target_files = target_file::list_scoped_target_files(disk_info, filters, scope);
+    let target_files = in_stable_order(with_alternate_streams(
+        &disk_info.id,
+        target_files,
+        alternate_streams,
+    ));
+    let target_files =
+        auto_ignore::remove_ignored_files(output_folder, &disk_info.id, target_files)?;
+    let (hash_info_map, _) =
+        hash_file::remove_hash_info_for_missing_file(hash_info_map, &target_files);
+    let (hash_info_map, _) =
+        hash_file::remove_hash_info_for_changed_file(hash_info_map, &mut stamp_map, &target_files);
+    Ok(target_file::remove_calculated_file(
+        target_files,
+        &hash_info_map,
+    ))
+}
+
+/// 検証するファイルのうち、最後に検証した日時の古いファイルから1回の読み込み量に達するまでを選ぶ。
+/// 検証したことのないファイルを最も古いものとし、少なくとも1件は選ぶ。
+/// ハッシュファイルにない移動先の候補は、移動を判定できるよう読み込み量に関係なく選ぶ。
+/// 選んだファイルは元の順序のまま返す。
+fn select_within_quota(
+    target_files: Vec<TargetFile>,
+    hash_info_map: &HashMap<PathBuf, Digest>,
+    last_verified: &HashMap<PathBuf, u64>,
+    bytes_per_run: u64,
+) -> Vec<TargetFile> {
+    let mut selected: Vec<bool> = target_files
+        .iter()
+        .map(|target_file| !hash_info_map.contains_key(target_file.normalized_path()))
+        .collect();
+    let mut oldest_first: Vec<usize> = (0..target_files.len())
+        .filter(|&index| !selected[index])
+        .collect();
+    oldest_first.sort_by_key(|&index| {
+        last_verified
+            .get(target_files[index].normalized_path())
+            .copied()
+    });
+
+    let mut selected_bytes = 0;
+    for index in oldest_first {
+        if selected_bytes >= bytes_per_run {
+            break;
+        }
+        selected_bytes += target_files[index].size;
+        selected[index] = true;
+    }
+
+    target_files
+        .into_iter()
+        .zip(selected)
+        .filter(|(_, selected)| *selected)
+        .map(|(target_file, _)| target_file)
+        .collect()
+}
+
+/// 決定的モードでは対象ファイルをパス順に並べる。
+/// 計算する順序とハッシュファイルに追記する順序がディスクのエントリーの順序に左右されないようにする。
+fn in_stable_order(mut target_files: Vec<TargetFile>) -> Vec<TargetFile> {
+    if clock::is_deterministic() {
+        target_files.sort_by(|a, b| a.normalized_path().cmp(b.normalized_path()));
+    }
+    target_files
+}
+
+/// 代替データストリームを扱う場合は対象ファイルの一覧に追加し、件数を出力する。
+fn with_alternate_streams(
+    disk_id: &str,
+    target_files: Vec<TargetFile>,
+    alternate_streams: bool,
+) -> Vec<TargetFile> {
+    if !alternate_streams {
+        return target_files;
+    }
+
     let number_of_files = target_files.len();
-    let total_size = target_file::calc_total_size(&target_files);
-    progress_sender.send_message(ProgressUpdate::list_targets(number_of_files, total_size))?;
+    let target_files = target_file::add_alternate_streams(target_files);
+    let number_of_streams = target_files.len() - number_of_files;
+    if number_of_streams > 0 {
+        log::info(
+            format!(
+                "{}: 代替データストリームが{}件あります。",
+                disk_id, number_of_streams
+            )
+            .as_str(),
+        );
+    }
+    target_files
+}
 
-    Ok((hash_filepath, target_files))
+/// ハッシュファイルのパスが処理する範囲に含まれるかを返す。
+/// 代替データストリームを扱わない場合、代替データストリームのパスは範囲外としてそのまま残す。
+fn is_in_scope(target_filepath: &Path, scope: Option<&Path>, alternate_streams: bool) -> bool {
+    target_file::is_in_scope(target_filepath, scope)
+        && (alternate_streams || !target_file::is_alternate_stream(target_filepath))
+}
+
+/// ファイル読み込み用のバッファのサイズの初期値を返す。
+pub fn default_buffer_size(full_speed: bool) -> usize {
+    if full_speed {
+        FULL_SPEED_BUFFER_SIZE
+    } else {
+        BUFFER_SIZE
+    }
+}
+
+/// 対象ファイルのハッシュを計算し、計算が終わったファイルから順に結果を渡す。
+/// 対象ファイルは待ち行列から取り出すので、一覧にし終える前から計算を始められる。
+/// 同時に計算するファイルの数だけスレッドを起動し、それぞれのスレッドで置き場からバッファを取り出す。
+/// 結果はこの関数を呼び出したスレッドで渡すので、ハッシュファイルへの書き込みは並行しない。
+/// 追加のアルゴリズムのハッシュは、計算できたファイルの結果とともに渡す。
+/// メモリ使用量が上限を超えたら、1つのスレッドだけを残してバッファを縮小し、置き場のバッファを破棄する。
+/// 空いた枠が渡された場合は、枠が空くたびに計算スレッドを追加して残りのファイルを計算する。
+/// 巨大なファイルの計算の途中経過は出力フォルダに保存する。
+/// 中断した場合は結果を渡していない残りのファイルの件数と容量を出力する。
+fn hash_target_files<F>(
+    disk_info: &DiskInfo,
+    output_folder: &Path,
+    target_queue: &TargetQueue,
+    progress_sender: &ProgressSender,
+    callbacks: &Callbacks,
+    full_speed: bool,
+    buffer_pool: &BufferPool,
+    chunked_threshold: Option<u64>,
+    algorithm: HashAlgorithm,
+    extra_algorithms: &[HashAlgorithm],
+    workers: usize,
+    memory_exceeded: &AtomicBool,
+    retry_policy: RetryPolicy,
+    helper_pool: Option<&HelperPool>,
+    mut on_hashed: F,
+) -> Result<(), Errors>
+where
+    F: FnMut(&TargetFile, Result<Digest, FileError>, Vec<Digest>) -> Result<(), Errors>,
+{
+    thread::scope(|scope| {
+        let (result_tx, result_rx) = mpsc::channel();
+        let run_worker = |worker_index: usize, result_tx: Sender<_>| {
+            let mut buffer = buffer_pool.take();
+            loop {
+                // 中断を受けたらファイルの区切りで停止する
+                if interruption::is_interrupted() {
+                    break;
+                }
+                if memory_exceeded.load(Ordering::Relaxed) {
+                    // 残りのファイルは最初のスレッドで計算する
+                    if worker_index > 0 {
+                        buffer.discard();
+                        break;
+                    }
+                    if buffer.len() > memory::LOW_MEMORY_BUFFER_SIZE {
+                        buffer.shrink(memory::LOW_MEMORY_BUFFER_SIZE);
+                        buffer_pool.clear();
+                    }
+                }
+                let target_file = match target_queue.pop() {
+                    Some(target_file) => target_file,
+                    None => break,
+                };
+                callbacks.file_start(&FileStart {
+                    disk_id: &disk_info.id,
+                    path: target_file.normalized_path(),
+                    size: target_file.size,
+                });
+                // 新規ファイル計算開始メッセージを送信する
+                if let Err(errors) = progress_sender.send_message(ProgressUpdate::new_file(
+                    target_file.normalized_path().to_path_buf(),
+                )) {
+                    let _ = result_tx.send(Err(errors));
+                    break;
+                }
+                // 対象ファイルを開いてハッシュを計算する
+                let result = calc_target_file_hash(
+                    disk_info,
+                    output_folder,
+                    &target_file,
+                    progress_sender,
+                    &mut buffer,
+                    callbacks,
+                    full_speed,
+                    chunked_threshold,
+                    algorithm,
+                    extra_algorithms,
+                    retry_policy,
+                );
+                // ファイルの途中で中断した場合は結果を渡さずに停止する
+                if let Err(file_error) = &result {
+                    if file_error.category == FileErrorCategory::Interrupted {
+                        break;
+                    }
+                }
+                // 受信側がエラーで終了していれば計算を打ち切る
+                if result_tx.send(Ok((target_file, result))).is_err() {
+                    break;
+                }
+            }
+        };
+        let mut number_of_workers =
+            workers.clamp(1, target_queue.remaining().unwrap_or(workers).max(1));
+        for worker_index in 0..number_of_workers {
+            let result_tx = result_tx.clone();
+            scope.spawn(move || run_worker(worker_index, result_tx));
+        }
+        // 空いた枠で計算スレッドを追加できる間は、送信側の元を残しておく
+        let mut helper_tx = helper_pool.map(|_| result_tx.clone());
+        // 全てのスレッドが終われば受信も終わるように、送信側の元を破棄する
+        drop(result_tx);
+
+        let mut number_of_hashed = 0;
+        let mut hashed_size = 0;
+        let result = loop {
+            match result_rx.recv_timeout(HELPER_CHECK_INTERVAL) {
+                Ok(Ok((target_file, result))) => {
+                    let (result, extra_hashes) = match result {
+                        Ok((hash, extra_hashes)) => (Ok(hash), extra_hashes),
+                        Err(file_error) => (Err(file_error), vec![]),
+                    };
+                    if let Err(errors) = on_hashed(&target_file, result, extra_hashes) {
+                        break Err(errors);
+                    }
+                    number_of_hashed += 1;
+                    hashed_size += target_file.size;
+                }
+                Ok(Err(errors)) => break Err(errors),
+                Err(RecvTimeoutError::Timeout) => {}
+                Err(RecvTimeoutError::Disconnected) => break Ok(()),
+            }
+
+            let (helper_pool, result_tx) = match (helper_pool, &helper_tx) {
+                (Some(helper_pool), Some(result_tx)) => (helper_pool, result_tx),
+                _ => continue,
+            };
+            // 残りのファイルがなくなるか、追加しても計算できない状態になれば追加をやめる
+            // 一覧にしている途中で残りの数がわからなければ、空いた枠の分だけ追加する
+            let remaining = target_queue.remaining().unwrap_or(usize::MAX);
+            if remaining == 0
+                || interruption::is_interrupted()
+                || memory_exceeded.load(Ordering::Relaxed)
+            {
+                helper_tx = None;
+                continue;
+            }
+            let mut number_of_helpers = 0;
+            while number_of_helpers < remaining {
+                let helper_slot = match helper_pool.try_acquire() {
+                    Some(helper_slot) => helper_slot,
+                    None => break,
+                };
+                let worker_index = number_of_workers;
+                let result_tx = result_tx.clone();
+                scope.spawn(move || {
+                    // スレッドが終わるまで枠を使い続ける
+                    let _helper_slot = helper_slot;
+                    run_worker(worker_index, result_tx)
+                });
+                number_of_workers += 1;
+                number_of_helpers += 1;
+            }
+            if number_of_helpers > 0 {
+                log::info(
+                    format!(
+                        "{}: 空いた枠で計算スレッドを{}個追加しました。",
+                        disk_info.id, number_of_helpers
+                    )
+                    .as_str(),
+                );
+            }
+        };
+        // エラーで終わった場合も、一覧にするのをやめさせて計算スレッドを終わらせる
+        target_queue.close();
+        result?;
+        if interruption::is_interrupted() {
+            let (number_of_listed, listed_size) = target_queue.listed();
+            log_interrupted(
+                &disk_info.id,
+                number_of_listed.saturating_sub(number_of_hashed),
+                listed_size.saturating_sub(hashed_size),
+            );
+        }
+        Ok(())
+    })
+}
+
+/// 対象ファイルを開いてハッシュを計算し、結果をコールバックに通知する。
+/// 全速力で計算する場合は読み込みとハッシュ計算を別のスレッドで並行して行う。
+/// 追加のアルゴリズムが指定されていれば、同じ読み込みでそのハッシュも計算して返す。
+/// 巨大なファイルは途中経過を保存し、保存された途中経過があれば続きから計算する。
+/// 追加のアルゴリズムの内部状態は保存しないので、追加のアルゴリズムがあれば途中経過を使わない。
+/// 塊ごとに計算できるアルゴリズムでは、閾値以上の巨大なファイルの塊を並行して読み込む。
+/// 塊を並行して計算する場合も途中経過は使わない。
+/// 一時的な読み込みの失敗は、待ち時間を倍にしながら指定の回数まで最初から読み込み直す。
+fn calc_target_file_hash(
+    disk_info: &DiskInfo,
+    output_folder: &Path,
+    target_file: &TargetFile,
+    progress_sender: &ProgressSender,
+    buffer: &mut [u8],
+    callbacks: &Callbacks,
+    full_speed: bool,
+    chunked_threshold: Option<u64>,
+    algorithm: HashAlgorithm,
+    extra_algorithms: &[HashAlgorithm],
+    retry_policy: RetryPolicy,
+) -> Result<(Digest, Vec<Digest>), FileError> {
+    let start_time = Instant::now();
+    let chunked = algorithm.supports_chunks()
+        && extra_algorithms.len() == 0
+        && chunked_threshold.map_or(false, |chunked_threshold| {
+            target_file.size >= chunked_threshold
+        });
+    let mut checkpoint = if extra_algorithms.len() == 0 && !chunked {
+        Checkpoint::of(output_folder, &disk_info.id, target_file, algorithm)
+    } else {
+        None
+    };
+
+    // リンク先を記録するシンボリックリンクは、リンク先を辿らずリンク先のパスのハッシュにする
+    if let Some(link_target) = target_file.link_target() {
+        let hash = calc_link_target_hash(link_target, algorithm);
+        let extra_hashes = extra_algorithms
+            .iter()
+            .map(|extra_algorithm| calc_link_target_hash(link_target, *extra_algorithm))
+            .collect();
+        if let Err(errors) = progress_sender.send_message(ProgressUpdate::read(target_file.size)) {
+            return Err(FileError {
+                category: FileErrorCategory::Other,
+                error: errors.into_iter().next().unwrap(),
+            });
+        }
+        callbacks.file_done(&FileDone {
+            disk_id: &disk_info.id,
+            path: target_file.normalized_path(),
+            size: target_file.size,
+            duration: start_time.elapsed(),
+            hash: &hash,
+        });
+        return Ok((hash, extra_hashes));
+    }
+
+    let mut extra_contexts = extra_contexts_of(extra_algorithms);
+    let result = if chunked {
+        read_chunks_and_calc_hash(progress_sender, buffer.len(), target_file.actual_path())
+    } else {
+        open_target_file(target_file.actual_path()).and_then(|mut file| {
+            let context = resume_from_checkpoint(
+                &disk_info.id,
+                target_file,
+                checkpoint.as_mut(),
+                &mut file,
+                progress_sender,
+                algorithm,
+            )?;
+            if full_speed {
+                read_ahead_and_calc_hash(
+                    progress_sender,
+                    buffer,
+                    &mut file,
+                    target_file.actual_path(),
+                    context,
+                    &mut extra_contexts,
+                    checkpoint.as_mut(),
+                )
+            } else {
+                read_and_calc_hash(
+                    Some(progress_sender),
+                    buffer,
+                    &mut file,
+                    target_file.actual_path(),
+                    context,
+                    &mut extra_contexts,
+                    checkpoint.as_mut(),
+                )
+            }
+        })
+    };
+    let result = result.map(|hash| (hash, compute_extra_hashes(extra_contexts)));
+    // 途中で中断した場合は途中経過を残し、結果も出力しない
+    if let Err(file_error) = &result {
+        if file_error.category == FileErrorCategory::Interrupted {
+            return result;
+        }
+    }
+    // 読み直した分を二重に数えないよう、再試行では進捗を送信せず途中経過も使わない
+    let mut result = result;
+    let mut attempt = 0;
+    while let Err(file_error) = &result {
+        if !retry_policy.should_retry(file_error.category, attempt) {
+            break;
+        }
+        log::warn(
+            format!(
+                "{}: 読み込みに失敗しました。再試行します。({}/{}): {}",
+                &disk_info.id,
+                attempt + 1,
+                retry_policy.retries,
+                target_file.normalized_path().to_str().unwrap()
+            )
+            .as_str(),
+        );
+        retry_policy.wait(attempt);
+        if interruption::is_interrupted() {
+            return Err(FileError::interrupted(
+                target_file.actual_path().to_str().unwrap(),
+            ));
+        }
+        attempt += 1;
+        result = calc_file_hashes(
+            target_file.actual_path(),
+            buffer,
+            algorithm,
+            extra_algorithms,
+        );
+    }
+    if attempt > 0 && result.is_ok() {
+        log::info(
+            format!(
+                "{}: 再試行で読み込めました。: {}",
+                &disk_info.id,
+                target_file.normalized_path().to_str().unwrap()
+            )
+            .as_str(),
+        );
+    }
+    if let Some(checkpoint) = checkpoint {
+        checkpoint.remove();
+    }
+
+    match result {
+        Ok((hash, extra_hashes)) => {
+            callbacks.file_done(&FileDone {
+                disk_id: &disk_info.id,
+                path: target_file.normalized_path(),
+                size: target_file.size,
+                duration: start_time.elapsed(),
+                hash: &hash,
+            });
+            Ok((hash, extra_hashes))
+        }
+        Err(file_error) => {
+            callbacks.error(&FileFailure {
+                disk_id: &disk_info.id,
+                path: target_file.normalized_path(),
+                duration: start_time.elapsed(),
+                category: file_error.category.name(),
+                error: &file_error.error,
+            });
+            Err(file_error)
+        }
+    }
+}
+
+/// 保存された途中経過があれば、内部状態を復元して対象ファイルを途中の位置まで進める。
+/// 途中経過がなければ新しいコンテキストを返す。
+fn resume_from_checkpoint(
+    disk_id: &str,
+    target_file: &TargetFile,
+    checkpoint: Option<&mut Checkpoint>,
+    file: &mut File,
+    progress_sender: &ProgressSender,
+    algorithm: HashAlgorithm,
+) -> Result<HashContext, FileError> {
+    let (checkpoint, context) = match checkpoint {
+        Some(checkpoint) => match checkpoint.restore() {
+            Some(context) => (checkpoint, context),
+            None => return Ok(algorithm.context()),
+        },
+        None => return Ok(algorithm.context()),
+    };
+    let offset = checkpoint.offset();
+    if let Err(error) = file.seek(SeekFrom::Start(offset)) {
+        return Err(FileError::from_io(
+            "対象ファイルを読み込めません。",
+            target_file.actual_path().to_str().unwrap(),
+            &error,
+        ));
+    }
+    log::info(
+        format!(
+            "{}: 保存された途中経過から計算を再開します。({}MB目から): {}",
+            disk_id,
+            offset >> 20,
+            target_file.normalized_path().to_str().unwrap()
+        )
+        .as_str(),
+    );
+    // 読み込み済みの部分も進捗に含める
+    if let Err(errors) = progress_sender.send_message(ProgressUpdate::read(offset)) {
+        return Err(FileError {
+            category: FileErrorCategory::Other,
+            error: errors.into_iter().next().unwrap(),
+        });
+    }
+
+    Ok(context)
 }
 
 /// 対象ファイルを開く。
-fn open_target_file(target_filepath: &Path) -> Result<File, Errors> {
+fn open_target_file(target_filepath: &Path) -> Result<File, FileError> {
     match File::open(target_filepath) {
         Ok(target_file) => Ok(target_file),
-        Err(error) => Err(log::make_error!("対象ファイルが開けませんでした。")
-            .with(&error)
-            .as_errors()),
+        Err(error) => Err(FileError::from_io(
+            "対象ファイルが開けませんでした。",
+            target_filepath.to_str().unwrap(),
+            &error,
+        )),
     }
 }
 
+/// ファイルを開いてハッシュを計算して返す。
+/// 進捗は送信しない。
+pub fn calc_file_hash(
+    filepath: &Path,
+    buffer: &mut [u8],
+    algorithm: HashAlgorithm,
+) -> Result<Digest, FileError> {
+    calc_file_hashes(filepath, buffer, algorithm, &[]).map(|(hash, _)| hash)
+}
+
+/// ファイルを開いて、ハッシュと追加のアルゴリズムのハッシュを1回の読み込みで計算して返す。
+/// 進捗は送信しない。
+fn calc_file_hashes(
+    filepath: &Path,
+    buffer: &mut [u8],
+    algorithm: HashAlgorithm,
+    extra_algorithms: &[HashAlgorithm],
+) -> Result<(Digest, Vec<Digest>), FileError> {
+    let mut file = open_target_file(filepath)?;
+    let mut extra_contexts = extra_contexts_of(extra_algorithms);
+    let hash = read_and_calc_hash(
+        None,
+        buffer,
+        &mut file,
+        filepath,
+        algorithm.context(),
+        &mut extra_contexts,
+        None,
+    )?;
+    Ok((hash, compute_extra_hashes(extra_contexts)))
+}
+
+/// 追加のアルゴリズムのコンテキストを作成する。
+fn extra_contexts_of(extra_algorithms: &[HashAlgorithm]) -> Vec<HashContext> {
+    extra_algorithms
+        .iter()
+        .map(|algorithm| algorithm.context())
+        .collect()
+}
+
+/// 追加のアルゴリズムのハッシュを計算する。
+fn compute_extra_hashes(extra_contexts: Vec<HashContext>) -> Vec<Digest> {
+    extra_contexts
+        .into_iter()
+        .map(|context| context.compute())
+        .collect()
+}
+
+/// シンボリックリンクのリンク先のパスのハッシュを計算して返す。
+/// 環境によらず同じハッシュになるよう、区切り文字をスラッシュにしたパスで計算する。
+pub fn calc_link_target_hash(link_target: &Path, algorithm: HashAlgorithm) -> Digest {
+    let mut context = algorithm.context();
+    context.consume(link_target.to_slash_lossy().as_bytes());
+    context.compute()
+}
+
+/// ページキャッシュを使わずにファイルを開いてハッシュを計算して返す。
+/// 進捗は送信しない。
+pub fn calc_uncached_file_hash(
+    filepath: &Path,
+    buffer: &mut [u8],
+    algorithm: HashAlgorithm,
+) -> Result<Digest, FileError> {
+    let mut file = open_target_file(filepath)?;
+    page_cache::bypass(&file);
+    read_and_calc_hash(
+        None,
+        buffer,
+        &mut file,
+        filepath,
+        algorithm.context(),
+        &mut [],
+        None,
+    )
+}
+
 /// ファイルを読み込んでハッシュを計算して返す。
+/// 追加のアルゴリズムのコンテキストにも同じデータを渡し、1回の読み込みで計算する。
+/// 進捗送信オブジェクトが指定されていれば読み込んだバイト数を送信する。
+/// 途中経過が指定されていれば間隔ごとに保存し、中断を受けたらその場で保存して停止する。
 fn read_and_calc_hash(
-    progress_sender: &ProgressSender,
+    progress_sender: Option<&ProgressSender>,
     mut buffer: &mut [u8],
     target_file: &mut File,
-) -> Result<Digest, Errors> {
-    let mut context = md5::Context::new();
-
+    target_filepath: &Path,
+    mut context: HashContext,
+    extra_contexts: &mut [HashContext],
+    mut checkpoint: Option<&mut Checkpoint>,
+) -> Result<Digest, FileError> {
     loop {
         let red_size = match target_file.read(&mut buffer) {
             Ok(red_size) => red_size,
             Err(error) => {
-                return Err(log::make_error!("対象ファイルを読み込めません。")
-                    .with(&error)
-                    .as_errors());
+                return Err(FileError::from_io(
+                    "対象ファイルを読み込めません。",
+                    target_filepath.to_str().unwrap(),
+                    &error,
+                ));
             }
         };
 
@@ -187,22 +1975,262 @@ fn read_and_calc_hash(
                 context.consume([*&buffer[i]]);
             }
         }
+        for extra_context in extra_contexts.iter_mut() {
+            extra_context.consume(&buffer[..red_size]);
+        }
+        if let Some(checkpoint) = checkpoint.as_deref_mut() {
+            checkpoint.advance(red_size, &context);
+            if interruption::is_interrupted() {
+                checkpoint.save(&context);
+                return Err(FileError::interrupted(target_filepath.to_str().unwrap()));
+            }
+        }
 
-        progress_sender.send_message(ProgressUpdate::read(red_size as u64))?;
+        // 進捗を送信できなくてもハッシュ計算は続けられないため、その他のエラーとする
+        if let Some(progress_sender) = progress_sender {
+            if let Err(errors) = progress_sender.send_message(ProgressUpdate::read(red_size as u64))
+            {
+                return Err(FileError {
+                    category: FileErrorCategory::Other,
+                    error: errors.into_iter().next().unwrap(),
+                });
+            }
+        }
     }
 
     Ok(context.compute())
 }
 
+/// 読み込みスレッドで先読みしながらハッシュを計算して返す。
+/// バッファを半分ずつに分け、片方にファイルを読み込んでいる間にもう片方のハッシュを計算する。
+/// 追加のアルゴリズムのコンテキストにも同じデータを渡す。
+/// 途中経過が指定されていれば間隔ごとに保存し、中断を受けたらその場で保存して停止する。
+fn read_ahead_and_calc_hash(
+    progress_sender: &ProgressSender,
+    buffer: &mut [u8],
+    target_file: &mut File,
+    target_filepath: &Path,
+    mut context: HashContext,
+    extra_contexts: &mut [HashContext],
+    mut checkpoint: Option<&mut Checkpoint>,
+) -> Result<Digest, FileError> {
+    let (first_half, second_half) = buffer.split_at_mut(buffer.len() / 2);
+
+    // 読み込み済みのバッファと空いたバッファをスレッド間で受け渡す
+    let (filled_tx, filled_rx) = mpsc::channel::<(&mut [u8], usize)>();
+    let (empty_tx, empty_rx) = mpsc::channel::<&mut [u8]>();
+    empty_tx.send(first_half).unwrap();
+    empty_tx.send(second_half).unwrap();
+
+    thread::scope(|scope| {
+        // 読み込みスレッド
+        let reader = scope.spawn(move || -> Result<(), io::Error> {
+            while let Ok(chunk) = empty_rx.recv() {
+                let red_size = target_file.read(chunk)?;
+                // 読み込みが終わったことはサイズ0で伝える
+                if filled_tx.send((chunk, red_size)).is_err() || red_size == 0 {
+                    break;
+                }
+            }
+            Ok(())
+        });
+
+        // 中断や進捗の送信失敗で計算を止めた理由
+        let mut stop_error = None;
+
+        while let Ok((chunk, red_size)) = filled_rx.recv() {
+            if red_size == 0 {
+                break;
+            }
+            context.consume(&chunk[..red_size]);
+            for extra_context in extra_contexts.iter_mut() {
+                extra_context.consume(&chunk[..red_size]);
+            }
+            if let Some(checkpoint) = checkpoint.as_deref_mut() {
+                checkpoint.advance(red_size, &context);
+                if interruption::is_interrupted() {
+                    checkpoint.save(&context);
+                    stop_error = Some(FileError::interrupted(target_filepath.to_str().unwrap()));
+                    break;
+                }
+            }
+
+            // 進捗を送信できなくてもハッシュ計算は続けられないため、その他のエラーとする
+            if let Err(errors) = progress_sender.send_message(ProgressUpdate::read(red_size as u64))
+            {
+                stop_error = Some(FileError {
+                    category: FileErrorCategory::Other,
+                    error: errors.into_iter().next().unwrap(),
+                });
+                break;
+            }
+            // 読み込みスレッドが終了していれば送れないが、その場合は次の受信で終了する
+            let _ = empty_tx.send(chunk);
+        }
+        // 読み込みスレッドが待機していれば終了させる
+        drop(empty_tx);
+        drop(filled_rx);
+
+        if let Err(error) = reader.join().unwrap() {
+            return Err(FileError::from_io(
+                "対象ファイルを読み込めません。",
+                target_filepath.to_str().unwrap(),
+                &error,
+            ));
+        }
+        match stop_error {
+            Some(file_error) => Err(file_error),
+            None => Ok(context.compute()),
+        }
+    })
+}
+
+/// ファイルを塊に分けて、複数のスレッドで並行して読み込んでハッシュを計算して返す。
+/// スレッドごとにファイルを開き、次の塊を取り合いながらそれぞれの位置から読み込む。
+/// 1つのスレッドで読み込むより速く読み込めるディスクで、1つの巨大なファイルを速く計算するために使う。
+/// 中断を受けたら途中経過を保存せずに停止する。
+fn read_chunks_and_calc_hash(
+    progress_sender: &ProgressSender,
+    buffer_size: usize,
+    target_filepath: &Path,
+) -> Result<Digest, FileError> {
+    let file_size = match fs::metadata(target_filepath) {
+        Ok(metadata) => metadata.len(),
+        Err(error) => {
+            return Err(FileError::from_io(
+                "対象ファイルを読み込めません。",
+                target_filepath.to_str().unwrap(),
+                &error,
+            ))
+        }
+    };
+    let number_of_chunks = file_size.div_ceil(TREE_CHUNK_SIZE) as usize;
+    let number_of_readers = thread::available_parallelism()
+        .map_or(1, |parallelism| parallelism.get())
+        .min(MAX_CHUNK_READERS)
+        .min(number_of_chunks)
+        .max(1);
+    let next_chunk = AtomicUsize::new(0);
+    // いずれかのスレッドが失敗したら、他のスレッドも読み込みをやめる
+    let stopped = AtomicBool::new(false);
+    let chunk_hashes: Mutex<Vec<Option<Digest>>> = Mutex::new(vec![None; number_of_chunks]);
+
+    let read_chunks = || -> Result<(), FileError> {
+        let mut file = open_target_file(target_filepath)?;
+        let mut buffer = vec![0u8; buffer_size.min(TREE_CHUNK_SIZE as usize)];
+        loop {
+            let index = next_chunk.fetch_add(1, Ordering::Relaxed);
+            if index >= number_of_chunks || stopped.load(Ordering::Relaxed) {
+                return Ok(());
+            }
+            let offset = index as u64 * TREE_CHUNK_SIZE;
+            if let Err(error) = file.seek(SeekFrom::Start(offset)) {
+                return Err(FileError::from_io(
+                    "対象ファイルを読み込めません。",
+                    target_filepath.to_str().unwrap(),
+                    &error,
+                ));
+            }
+            let mut context = HashAlgorithm::Sha256.context();
+            let mut remaining = TREE_CHUNK_SIZE.min(file_size - offset);
+            while remaining > 0 {
+                if interruption::is_interrupted() {
+                    return Err(FileError::interrupted(target_filepath.to_str().unwrap()));
+                }
+                let size = (buffer.len() as u64).min(remaining) as usize;
+                if let Err(error) = file.read_exact(&mut buffer[..size]) {
+                    return Err(FileError::from_io(
+                        "対象ファイルを読み込めません。",
+                        target_filepath.to_str().unwrap(),
+                        &error,
+                    ));
+                }
+                context.consume(&buffer[..size]);
+                remaining -= size as u64;
+                // 進捗を送信できなくてもハッシュ計算は続けられないため、その他のエラーとする
+                if let Err(errors) = progress_sender.send_message(ProgressUpdate::read(size as u64))
+                {
+                    return Err(FileError {
+                        category: FileErrorCategory::Other,
+                        error: errors.into_iter().next().unwrap(),
+                    });
+                }
+            }
+            chunk_hashes.lock().unwrap()[index] = Some(context.compute());
+        }
+    };
+
+    thread::scope(|scope| {
+        let readers: Vec<_> = (0..number_of_readers)
+            .map(|_| {
+                scope.spawn(|| {
+                    let result = read_chunks();
+                    if result.is_err() {
+                        stopped.store(true, Ordering::Relaxed);
+                    }
+                    result
+                })
+            })
+            .collect();
+        // 中断以外のエラーがあれば、中断よりそちらを優先して返す
+        let mut first_error: Option<FileError> = None;
+        for reader in readers {
+            if let Err(file_error) = reader.join().unwrap() {
+                match &first_error {
+                    Some(error) if error.category != FileErrorCategory::Interrupted => {}
+                    _ => first_error = Some(file_error),
+                }
+            }
+        }
+        if let Some(file_error) = first_error {
+            return Err(file_error);
+        }
+        let chunk_hashes: Vec<Digest> = chunk_hashes
+            .lock()
+            .unwrap()
+            .iter()
+            .map(|chunk_hash| chunk_hash.unwrap())
+            .collect();
+        Ok(TreeContext::combine(&chunk_hashes))
+    })
+}
+
+/// 中断によりディスクのハッシュ計算を停止したことを、残りのファイルの件数と容量とともに出力する。
+fn log_interrupted(disk_id: &str, remain_files: usize, remain_size: u64) {
+    log::info(
+        format!(
+            "{}: 中断したため、計算済みのファイルまでで停止しました。(残り {}ファイル / {:.2}GB)",
+            disk_id,
+            remain_files,
+            remain_size as f64 / (1u64 << 30) as f64
+        )
+        .as_str(),
+    );
+}
+
+/// 処理に失敗したディスクがあったかを記録する。
+pub fn set_disk_failed(disk_failed: bool) {
+    DISK_FAILED.store(disk_failed, Ordering::Relaxed);
+}
+
+/// 直前の実行で処理に失敗したディスクがあったかを返す。
+/// 失敗したディスクがあっても、他のディスクは最後まで処理する。
+pub fn has_disk_failures() -> bool {
+    DISK_FAILED.load(Ordering::Relaxed)
+}
+
 /// ハッシュ計算の完了を待つ。
+/// 中断を受けた場合も、全てのスレッドがファイルの区切りで停止するのを待ってからエラーにする。
 pub fn wait_calculations(
     worker_handles: HashMap<String, JoinHandle<Result<(), Errors>>>,
 ) -> Result<(), Errors> {
-    // Ctrl+Cハンドラを設定する
-    let interruption_handler = interruption::set_interruption_handler()?;
     // スレッド終了チェック間隔
     let check_interval = Duration::from_millis(500);
 
+    // エラーの出力順が実行ごとに変わらないようディスクID順に待つ
+    let mut worker_handles: Vec<(String, JoinHandle<Result<(), Errors>>)> =
+        worker_handles.into_iter().collect();
+    worker_handles.sort_by(|a, b| a.0.cmp(&b.0));
     for (disk_id, worker_handle) in worker_handles {
         // 一定時間ごとにスレッドが終了しているかチェックする
         let mut finished = false;
@@ -210,7 +2238,6 @@ pub fn wait_calculations(
             if worker_handle.is_finished() {
                 finished = true;
             } else {
-                check_interruption(&interruption_handler)?;
                 thread::sleep(check_interval);
             }
         }
@@ -225,17 +2252,23 @@ pub fn wait_calculations(
                     .as_str(),
                 );
                 log::log_errors(errors);
+                set_disk_failed(true);
             }
         }
     }
 
-    Ok(())
-}
-
-/// Ctrl+Cによる割り込みを受けていたらエラーを発生させる。
-fn check_interruption(interruption_handler: &Arc<AtomicBool>) -> Result<(), Errors> {
-    match interruption_handler.load(Ordering::Relaxed) {
-        true => Err(log::make_error!("ユーザーにより処理が停止されました。").as_errors()),
-        false => Ok(()),
+    // 実行時間の上限で停止した場合は予定どおりの終了なのでエラーにしない
+    if interruption::is_time_limit_reached() {
+        log::info(
+            "実行時間の上限に達したため停止しました。次回の実行では計算済みのファイルの続きから計算します。",
+        );
+        return Ok(());
     }
+    if interruption::is_interrupted() {
+        return Err(log::make_error!(
+            "ユーザーにより処理が停止されました。次回の実行では計算済みのファイルの続きから計算します。"
+        )
+        .as_errors());
+    }
+    Ok(())
 }
@@ -0,0 +1,167 @@
+use std::path::Path;
+use std::sync::Arc;
+use std::time::Duration;
+
+use crate::hash_algorithm::Digest;
+use crate::log::Error;
+use crate::path_normalizer::CustomStep;
+
+/// ファイルのハッシュ計算を開始したイベント
+pub struct FileStart<'a> {
+    /// ディスクID
+    pub disk_id: &'a str,
+    /// 正規化ファイルパス
+    pub path: &'a Path,
+    /// バイト数
+    pub size: u64,
+}
+
+/// ファイルのハッシュを計算できたイベント
+pub struct FileDone<'a> {
+    /// ディスクID
+    pub disk_id: &'a str,
+    /// 正規化ファイルパス
+    pub path: &'a Path,
+    /// バイト数
+    pub size: u64,
+    /// 計算にかかった時間
+    pub duration: Duration,
+    /// ハッシュ
+    pub hash: &'a Digest,
+}
+
+/// ファイルのハッシュを計算できなかったイベント
+pub struct FileFailure<'a> {
+    /// ディスクID
+    pub disk_id: &'a str,
+    /// 正規化ファイルパス
+    pub path: &'a Path,
+    /// 計算にかかった時間
+    pub duration: Duration,
+    /// エラーの分類名
+    /// 一覧にした後に削除されたファイルは"vanished"になる。
+    pub category: &'static str,
+    /// エラー情報
+    pub error: &'a Error,
+}
+
+/// ディスクの処理が終わったイベント
+pub struct DiskDone<'a> {
+    /// ディスクID
+    pub disk_id: &'a str,
+    /// ディスクで発生したエラー
+    /// エラーがなければ空になる。
+    pub errors: &'a [Error],
+    /// 中断して終わったか
+    pub interrupted: bool,
+}
+
+/// ファイルのハッシュ計算開始のコールバック
+type FileStartCallback = Arc<dyn Fn(&FileStart) + Send + Sync>;
+
+/// ファイルのハッシュ計算完了のコールバック
+type FileDoneCallback = Arc<dyn Fn(&FileDone) + Send + Sync>;
+
+/// ファイルのエラーのコールバック
+type FileFailureCallback = Arc<dyn Fn(&FileFailure) + Send + Sync>;
+
+/// ディスクの処理完了のコールバック
+type DiskDoneCallback = Arc<dyn Fn(&DiskDone) + Send + Sync>;
+
+/// ハッシュ計算と検証のイベントを受け取るコールバック一覧
+/// ハッシュ計算スレッドから呼び出されるので、スレッド間で共有できる関数を登録する。
+/// 同じイベントに複数のコールバックを登録した場合は登録した順に呼び出す。
+#[derive(Clone, Default)]
+pub struct Callbacks {
+    file_start: Vec<FileStartCallback>,
+    file_done: Vec<FileDoneCallback>,
+    error: Vec<FileFailureCallback>,
+    disk_done: Vec<DiskDoneCallback>,
+    normalize_path: Vec<CustomStep>,
+}
+
+impl Callbacks {
+    /// コールバックが登録されていない一覧を作成する。
+    pub fn new() -> Callbacks {
+        Callbacks::default()
+    }
+
+    /// ファイルのハッシュ計算を開始した時のコールバックを登録する。
+    pub fn on_file_start(
+        mut self,
+        callback: impl Fn(&FileStart) + Send + Sync + 'static,
+    ) -> Callbacks {
+        self.file_start.push(Arc::new(callback));
+        self
+    }
+
+    /// ファイルのハッシュを計算できた時のコールバックを登録する。
+    pub fn on_file_done(
+        mut self,
+        callback: impl Fn(&FileDone) + Send + Sync + 'static,
+    ) -> Callbacks {
+        self.file_done.push(Arc::new(callback));
+        self
+    }
+
+    /// ファイルのハッシュを計算できなかった時のコールバックを登録する。
+    pub fn on_error(
+        mut self,
+        callback: impl Fn(&FileFailure) + Send + Sync + 'static,
+    ) -> Callbacks {
+        self.error.push(Arc::new(callback));
+        self
+    }
+
+    /// ディスクの処理が終わった時のコールバックを登録する。
+    pub fn on_disk_done(
+        mut self,
+        callback: impl Fn(&DiskDone) + Send + Sync + 'static,
+    ) -> Callbacks {
+        self.disk_done.push(Arc::new(callback));
+        self
+    }
+
+    /// 対象ファイルのパスを正規化する時の変換を登録する。
+    /// 設定された正規化の手順の後に適用し、変換後のパスをハッシュファイルに記録する。
+    pub fn on_normalize_path(
+        mut self,
+        step: impl Fn(&str) -> String + Send + Sync + 'static,
+    ) -> Callbacks {
+        self.normalize_path.push(Arc::new(step));
+        self
+    }
+
+    /// パスの正規化の変換一覧を返す。
+    pub(crate) fn path_normalizers(&self) -> &[CustomStep] {
+        &self.normalize_path
+    }
+
+    /// ファイルのハッシュ計算開始を通知する。
+    pub(crate) fn file_start(&self, event: &FileStart) {
+        for callback in self.file_start.iter() {
+            callback(event);
+        }
+    }
+
+    /// ファイルのハッシュ計算完了を通知する。
+    pub(crate) fn file_done(&self, event: &FileDone) {
+        for callback in self.file_done.iter() {
+            callback(event);
+        }
+    }
+
+    /// ファイルのエラーを通知する。
+    pub(crate) fn error(&self, event: &FileFailure) {
+        for callback in self.error.iter() {
+            callback(event);
+        }
+    }
+
+    /// ディスクの処理完了を通知する。
+    pub(crate) fn disk_done(&self, event: &DiskDone) {
+        for callback in self.disk_done.iter() {
+            callback(event);
+        }
+    }
+}
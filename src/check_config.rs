@@ -0,0 +1,105 @@
+use std::fs;
+use std::path::Path;
+
+use crate::disk;
+use crate::filter;
+use crate::log::{self, Error, Errors};
+use crate::pinned;
+use crate::registry;
+use crate::run_options::RunOptions;
+use crate::serve_auth::AccessControl;
+
+/// 書き込めるか確認するために作成するファイルの名前
+const PROBE_FILE_NAME: &str = ".bcbc-check-config";
+
+/// 設定ファイル、diskファイル、フォルダの権限を確認する。
+/// 途中で問題が見つかっても確認を続け、全ての問題をまとめて返す。
+pub fn check_config(run_options: &RunOptions) -> Result<(), Errors> {
+    let mut errors = vec![];
+
+    log::info("フォルダを確認します。");
+    check_folders(run_options, &mut errors);
+
+    log::info("フィルター設定を確認します。");
+    errors.append(&mut filter::check_filters(run_options));
+
+    log::info("必須ファイル設定ファイルを確認します。");
+    if let Err(mut pinned_errors) = pinned::check_pinned_conf(run_options.config_folder()) {
+        errors.append(&mut pinned_errors);
+    }
+
+    log::info("アクセス制御の設定ファイルを確認します。");
+    if let Err(mut serve_errors) = AccessControl::load(run_options.config_folder()) {
+        errors.append(&mut serve_errors);
+    }
+
+    log::info("ディスクレジストリを確認します。");
+    if let Err(mut registry_errors) = registry::load_registry(run_options.registry_filepath()) {
+        errors.append(&mut registry_errors);
+    }
+
+    // ディスクルートが指定されなければカレントフォルダから遡ってdiskファイルを探す
+    log::info("diskファイルを確認します。");
+    errors.append(&mut disk::check_disk_files(run_options));
+
+    if errors.len() == 0 {
+        log::info("設定に問題はありません。");
+        Ok(())
+    } else {
+        log::warn(format!("{}件の問題が見つかりました。", errors.len()).as_str());
+        Err(errors)
+    }
+}
+
+/// 設定フォルダが読み込めることと、出力フォルダとディスクレジストリのフォルダに書き込めることを確認する。
+/// 出力フォルダがまだなければ作成できるかを確認する。
+fn check_folders(run_options: &RunOptions, errors: &mut Vec<Error>) {
+    let config_folder = run_options.config_folder();
+    if let Err(error) = config_folder.read_dir() {
+        errors.push(
+            log::make_error!(
+                "設定フォルダが読み込めません。: {}",
+                config_folder.to_str().unwrap()
+            )
+            .with(&error),
+        );
+    }
+
+    // 出力フォルダがなければ最初の実行で作成されるので、作成先のフォルダを確認する
+    let output_folder = run_options.output_folder();
+    let writable_folder = if output_folder.is_dir() {
+        Some(output_folder)
+    } else {
+        output_folder.parent()
+    };
+    if let Some(folder) = writable_folder {
+        if let Err(error) = check_writable(folder) {
+            errors.push(
+                log::make_error!(
+                    "出力フォルダに書き込めません。: {}",
+                    folder.to_str().unwrap()
+                )
+                .with(&error),
+            );
+        }
+    }
+
+    if let Some(registry_folder) = run_options.registry_filepath().parent() {
+        if let Err(error) = check_writable(registry_folder) {
+            errors.push(
+                log::make_error!(
+                    "ディスクレジストリのフォルダに書き込めません。: {}",
+                    registry_folder.to_str().unwrap()
+                )
+                .with(&error),
+            );
+        }
+    }
+}
+
+/// フォルダにファイルを作成して削除できるかを確認する。
+fn check_writable(folder: &Path) -> std::io::Result<()> {
+    let probe_filepath = folder.join(PROBE_FILE_NAME);
+    fs::write(probe_filepath.as_path(), "")?;
+    fs::remove_file(probe_filepath.as_path())
+}
@@ -0,0 +1,155 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::hash_algorithm::{Digest, HashAlgorithm, HashContext, TREE_CHUNK_SIZE};
+use crate::log;
+use crate::target_file::TargetFile;
+
+/// 途中経過を保存する間隔のバイト数
+/// このバイト数より大きいファイルだけを途中から再開できるようにする。
+pub const CHECKPOINT_INTERVAL: u64 = 1 << 30;
+
+/// 巨大なファイルのハッシュ計算の途中経過
+/// 出力フォルダの`checkpoints`にファイルごとに保存し、計算が終わったら削除する。
+/// 計算し終えた塊ごとのハッシュを保存するので、途中経過から再開できるアルゴリズムだけを対象にする。
+pub struct Checkpoint {
+    /// 途中経過のファイルのパス
+    filepath: PathBuf,
+    /// 対象ファイルとアルゴリズムの識別情報
+    /// 保存した時と一致しなければ途中経過を使わない。
+    identity: String,
+    algorithm: HashAlgorithm,
+    /// 読み込んだバイト数
+    /// 途中経過から再開した直後は、計算し終えた塊の終わりの位置になる。
+    offset: u64,
+    /// 最後に保存した時の読み込んだバイト数
+    saved_offset: u64,
+}
+
+impl Checkpoint {
+    /// 途中経過を保存する対象のファイルであれば途中経過を作成する。
+    /// 間隔より小さいファイルと、更新日時が取得できず変更を判定できないファイルは対象にしない。
+    /// 途中経過から再開できないアルゴリズムも対象にしない。
+    pub fn of(
+        output_folder: &Path,
+        disk_id: &str,
+        target_file: &TargetFile,
+        algorithm: HashAlgorithm,
+    ) -> Option<Checkpoint> {
+        if target_file.size <= CHECKPOINT_INTERVAL || !algorithm.supports_resume() {
+            return None;
+        }
+        let stamp = target_file.stamp()?;
+        let path = target_file.normalized_path().to_str().unwrap();
+
+        // パスに使えない文字を含まないよう、パスのハッシュをファイル名にする
+        let mut path_context = HashAlgorithm::XxHash64.context();
+        path_context.consume(path.as_bytes());
+        let filename = format!(
+            "{}-{}",
+            disk_id,
+            hex::encode(path_context.compute().to_vec())
+        );
+
+        let identity = format!(
+            "path={}\nsize={}\nmodified={}\nalgorithm={}\nchunk_size={}\n",
+            path,
+            stamp.size,
+            stamp.modified,
+            algorithm.name(),
+            TREE_CHUNK_SIZE
+        );
+
+        Some(Checkpoint {
+            filepath: checkpoint_folder(output_folder).join(filename),
+            identity,
+            algorithm,
+            offset: 0,
+            saved_offset: 0,
+        })
+    }
+
+    /// 保存された途中経過があり、対象ファイルとアルゴリズムが変わっていなければ塊ごとのハッシュから計算を復元する。
+    /// 復元できた場合は読み込んだバイト数も途中経過の位置にする。
+    /// 塊の数と位置が合わないなど、途中経過が壊れていれば使わない。
+    pub fn restore(&mut self) -> Option<HashContext> {
+        let contents = fs::read_to_string(self.filepath.as_path()).ok()?;
+        let mut lines = contents.strip_prefix(self.identity.as_str())?.lines();
+        let offset = lines.next()?.strip_prefix("offset=")?.parse::<u64>().ok()?;
+        let chunks = hex::decode(lines.next()?.strip_prefix("chunks=")?).ok()?;
+        let digest_length = self.algorithm.digest_length();
+        if chunks.len() % digest_length != 0
+            || (chunks.len() / digest_length) as u64 * TREE_CHUNK_SIZE != offset
+        {
+            return None;
+        }
+        let chunk_hashes: Vec<Digest> = chunks
+            .chunks(digest_length)
+            .map(Digest::from_slice)
+            .collect();
+        let context = HashContext::resume(self.algorithm, chunk_hashes)?;
+
+        self.offset = offset;
+        self.saved_offset = offset;
+        Some(context)
+    }
+
+    /// 読み込んだバイト数を返す。
+    pub fn offset(&self) -> u64 {
+        self.offset
+    }
+
+    /// 読み込んだバイト数を進め、前回の保存から間隔を超えていれば途中経過を保存する。
+    pub fn advance(&mut self, red_size: usize, context: &HashContext) {
+        self.offset += red_size as u64;
+        if self.offset - self.saved_offset >= CHECKPOINT_INTERVAL {
+            self.save(context);
+        }
+    }
+
+    /// 計算し終えた塊ごとのハッシュを途中経過として保存する。
+    /// 計算中の塊は保存しないので、再開する場合はその塊の先頭から読み直す。
+    /// 保存できなくてもハッシュ計算は続けられるので、警告だけを出力する。
+    pub fn save(&mut self, context: &HashContext) {
+        let (completed_offset, chunk_hashes) = match context.resumable_state() {
+            Some(state) => state,
+            None => return,
+        };
+        let mut chunks = String::new();
+        for chunk_hash in chunk_hashes {
+            chunks.push_str(&hex::encode(chunk_hash.to_vec()));
+        }
+        let contents = format!(
+            "{}offset={}\nchunks={}\n",
+            self.identity, completed_offset, chunks
+        );
+        let result = fs::create_dir_all(self.filepath.parent().unwrap())
+            .and_then(|_| atomic_write::write(self.filepath.as_path(), contents));
+        match result {
+            Ok(_) => self.saved_offset = self.offset,
+            Err(error) => {
+                log::warn(
+                    format!(
+                        "ハッシュ計算の途中経過を保存できませんでした。: {}: {}",
+                        self.filepath.to_str().unwrap(),
+                        error
+                    )
+                    .as_str(),
+                );
+            }
+        }
+    }
+
+    /// 計算が終わったら途中経過を削除する。
+    pub fn remove(self) {
+        if self.filepath.is_file() {
+            let _ = fs::remove_file(self.filepath.as_path());
+        }
+    }
+}
+
+/// 途中経過を保存するフォルダのパスを返す。
+fn checkpoint_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("checkpoints")
+}
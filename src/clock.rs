@@ -0,0 +1,43 @@
+use std::sync::Mutex;
+use std::time::Duration;
+
+use chrono::{DateTime, Local, NaiveDateTime, TimeZone};
+
+/// 固定する日時の形式
+pub const FIXED_TIME_FORMAT: &str = "%Y-%m-%d %H:%M:%S";
+
+/// 決定的モードで使う固定の日時
+/// 指定されていなければ現在日時を使う。
+static FIXED_TIME: Mutex<Option<DateTime<Local>>> = Mutex::new(None);
+
+/// 日時を固定して決定的モードにする。
+/// Noneなら固定を解除して現在日時を使う。
+pub fn set_fixed_time(fixed_time: Option<NaiveDateTime>) {
+    *FIXED_TIME.lock().unwrap() =
+        fixed_time.and_then(|fixed_time| Local.from_local_datetime(&fixed_time).earliest());
+}
+
+/// 現在日時を返す。
+/// 決定的モードでは固定の日時を返す。
+pub fn now() -> DateTime<Local> {
+    match *FIXED_TIME.lock().unwrap() {
+        Some(fixed_time) => fixed_time,
+        None => Local::now(),
+    }
+}
+
+/// 決定的モードであるかを返す。
+/// 決定的モードでは同じデータに対して同じ内容のハッシュファイル、ログ、レポートを出力する。
+pub fn is_deterministic() -> bool {
+    FIXED_TIME.lock().unwrap().is_some()
+}
+
+/// 出力する所要時間を返す。
+/// 決定的モードでは実行ごとに変わらないよう0にする。
+pub fn reported_duration(duration: Duration) -> Duration {
+    if is_deterministic() {
+        Duration::ZERO
+    } else {
+        duration
+    }
+}
@@ -0,0 +1,274 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::hash_algorithm::Digest;
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::merged_hash_file;
+use crate::tags;
+
+/// グループ内のファイル
+/// どのディスクにあるファイルかを保持する。
+struct GroupEntry {
+    disk_id: String,
+    hash: Digest,
+}
+
+/// 差分
+enum Difference<'a> {
+    /// 1つ目のグループにしかない
+    OnlyInFirst(&'a GroupEntry),
+    /// 2つ目のグループにしかない
+    OnlyInSecond(&'a GroupEntry),
+    /// ハッシュが異なる
+    Mismatched(&'a GroupEntry, &'a GroupEntry),
+}
+
+/// 2つのグループのハッシュファイルを比較して差分を出力する。
+/// 修正リストの出力先が指定されていれば、コピー元のディスクごとに修正リストを出力する。
+/// ハッシュファイルとタグはそれぞれのグループの出力フォルダから読み込む。
+pub fn compare_groups(
+    first_output_folder: &Path,
+    second_output_folder: &Path,
+    first_group: char,
+    second_group: char,
+    fix_list_folder: Option<&Path>,
+    preferred_group: Option<char>,
+) -> Result<(), Errors> {
+    let first_entries = load_group_entries(first_output_folder, first_group)?;
+    let second_entries = load_group_entries(second_output_folder, second_group)?;
+
+    let differences = find_differences(&first_entries, &second_entries);
+    // タグが付いたファイルは行の末尾にタグを出力する
+    let tag_index = tags::load_tag_index(&[first_output_folder, second_output_folder])?;
+
+    let mut number_of_only_in_first = 0;
+    let mut number_of_only_in_second = 0;
+    let mut number_of_mismatched = 0;
+
+    // 差分を1行ずつ出力する
+    for (target_filepath, difference) in differences.iter() {
+        let tags_of = |entry: &GroupEntry| tag_index.tags_of(&entry.disk_id, target_filepath);
+        let target_filepath = target_filepath.to_str().unwrap();
+        match difference {
+            Difference::OnlyInFirst(entry) => {
+                println!(
+                    "<\t{}\t{}{}",
+                    target_filepath,
+                    entry.disk_id,
+                    tags::tags_column(&tags_of(entry))
+                );
+                number_of_only_in_first += 1;
+            }
+            Difference::OnlyInSecond(entry) => {
+                println!(
+                    ">\t{}\t{}{}",
+                    target_filepath,
+                    entry.disk_id,
+                    tags::tags_column(&tags_of(entry))
+                );
+                number_of_only_in_second += 1;
+            }
+            Difference::Mismatched(first_entry, second_entry) => {
+                let mut tags = tags_of(first_entry);
+                tags.append(&mut tags_of(second_entry));
+                tags.sort();
+                tags.dedup();
+                println!(
+                    "!\t{}\t{}\t{}{}",
+                    target_filepath,
+                    first_entry.disk_id,
+                    second_entry.disk_id,
+                    tags::tags_column(&tags)
+                );
+                number_of_mismatched += 1;
+            }
+        }
+    }
+
+    log::info(
+        format!(
+            "{}のみ {}件 / {}のみ {}件 / 不一致 {}件",
+            first_group,
+            number_of_only_in_first,
+            second_group,
+            number_of_only_in_second,
+            number_of_mismatched
+        )
+        .as_str(),
+    );
+
+    if let Some(fix_list_folder) = fix_list_folder {
+        let fix_lists = make_fix_lists(&differences, first_group, second_group, preferred_group);
+        write_fix_lists(fix_list_folder, &fix_lists)?;
+    }
+
+    Ok(())
+}
+
+/// 指定されたグループのハッシュファイルを読み込んでファイルパスをキーとするマップにする。
+/// 同じファイルが複数のディスクにある場合は最初に読み込んだディスクのものを使う。
+fn load_group_entries(
+    output_folder: &Path,
+    disk_group: char,
+) -> Result<BTreeMap<PathBuf, GroupEntry>, Errors> {
+    let mut hash_filepaths: Vec<PathBuf> = merged_hash_file::find_hash_files(output_folder)?
+        .into_iter()
+        .filter(|hash_filepath| disk_group_of(hash_filepath) == disk_group)
+        .collect();
+    hash_filepaths.sort();
+
+    if hash_filepaths.len() == 0 {
+        return Err(
+            log::make_error!("グループ{}のハッシュファイルがありません。", disk_group).as_errors(),
+        );
+    }
+
+    let mut group_entries = BTreeMap::new();
+    for hash_filepath in hash_filepaths {
+        let disk_id = hash_filepath
+            .file_name()
+            .unwrap()
+            .to_str()
+            .unwrap()
+            .to_string();
+        for (target_filepath, hash) in hash_file::load_hash_info(hash_filepath.as_path())? {
+            group_entries.entry(target_filepath).or_insert(GroupEntry {
+                disk_id: disk_id.clone(),
+                hash,
+            });
+        }
+    }
+
+    Ok(group_entries)
+}
+
+/// ハッシュファイルのパスからグループを返す。
+fn disk_group_of(hash_filepath: &Path) -> char {
+    hash_filepath
+        .file_name()
+        .unwrap()
+        .to_str()
+        .unwrap()
+        .chars()
+        .next()
+        .unwrap()
+}
+
+/// 2つのグループの差分をファイルパス順に一覧にする。
+fn find_differences<'a>(
+    first_entries: &'a BTreeMap<PathBuf, GroupEntry>,
+    second_entries: &'a BTreeMap<PathBuf, GroupEntry>,
+) -> BTreeMap<&'a Path, Difference<'a>> {
+    let mut differences = BTreeMap::new();
+
+    for (target_filepath, first_entry) in first_entries {
+        match second_entries.get(target_filepath) {
+            None => {
+                differences.insert(
+                    target_filepath.as_path(),
+                    Difference::OnlyInFirst(first_entry),
+                );
+            }
+            Some(second_entry) if second_entry.hash != first_entry.hash => {
+                differences.insert(
+                    target_filepath.as_path(),
+                    Difference::Mismatched(first_entry, second_entry),
+                );
+            }
+            Some(_) => {}
+        }
+    }
+
+    for (target_filepath, second_entry) in second_entries {
+        if !first_entries.contains_key(target_filepath) {
+            differences.insert(
+                target_filepath.as_path(),
+                Difference::OnlyInSecond(second_entry),
+            );
+        }
+    }
+
+    differences
+}
+
+/// 差分からコピー元のディスクとコピー先のグループごとの修正リストを作成する。
+/// ハッシュが異なるファイルは、正しいグループが指定されている場合だけそのグループからコピーする。
+fn make_fix_lists<'a>(
+    differences: &BTreeMap<&'a Path, Difference<'a>>,
+    first_group: char,
+    second_group: char,
+    preferred_group: Option<char>,
+) -> BTreeMap<(String, char), Vec<&'a Path>> {
+    let mut fix_lists = BTreeMap::<(String, char), Vec<&Path>>::new();
+
+    for (target_filepath, difference) in differences {
+        let source = match difference {
+            Difference::OnlyInFirst(entry) => Some((entry.disk_id.clone(), second_group)),
+            Difference::OnlyInSecond(entry) => Some((entry.disk_id.clone(), first_group)),
+            Difference::Mismatched(first_entry, second_entry) => match preferred_group {
+                Some(group) if group == first_group => {
+                    Some((first_entry.disk_id.clone(), second_group))
+                }
+                Some(group) if group == second_group => {
+                    Some((second_entry.disk_id.clone(), first_group))
+                }
+                _ => None,
+            },
+        };
+        if let Some(source) = source {
+            fix_lists.entry(source).or_default().push(target_filepath);
+        }
+    }
+
+    fix_lists
+}
+
+/// 修正リストをファイルに出力する。
+/// ファイル名は"コピー元のディスクID-コピー先のグループ"とし、1行に1つディスクルートからの相対パスを出力する。
+fn write_fix_lists(
+    fix_list_folder: &Path,
+    fix_lists: &BTreeMap<(String, char), Vec<&Path>>,
+) -> Result<(), Errors> {
+    if let Err(error) = fs::create_dir_all(fix_list_folder) {
+        return Err(log::make_error!(
+            "修正リストのフォルダを作成できませんでした。: {}",
+            fix_list_folder.to_str().unwrap()
+        )
+        .with(&error)
+        .as_errors());
+    }
+
+    for ((source_disk_id, target_group), target_filepaths) in fix_lists {
+        let fix_list_filepath =
+            fix_list_folder.join(format!("{}-{}", source_disk_id, target_group));
+
+        let mut contents = String::new();
+        for target_filepath in target_filepaths {
+            contents.push_str(target_filepath.to_str().unwrap());
+            contents.push('\n');
+        }
+
+        if let Err(error) = atomic_write::write(fix_list_filepath.as_path(), &contents) {
+            return Err(log::make_error!(
+                "修正リストの作成に失敗しました。: {}",
+                fix_list_filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors());
+        }
+
+        log::info(
+            format!(
+                "修正リストを出力しました。: {} ({}件)",
+                fix_list_filepath.to_str().unwrap(),
+                target_filepaths.len()
+            )
+            .as_str(),
+        );
+    }
+
+    Ok(())
+}
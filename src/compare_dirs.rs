@@ -0,0 +1,120 @@
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+use std::thread;
+
+use crate::calc;
+use crate::disk::{DiskInfo, DiskMetadata, Priority};
+use crate::filter::Filters;
+use crate::hash_algorithm::{Digest, HashAlgorithm};
+use crate::log::{self, Errors};
+use crate::target_file;
+
+/// 2つのフォルダ配下のファイルのハッシュを計算して比較し、差分を出力する。
+/// diskファイルやハッシュファイルは使用しない。
+/// 1行に1つの差分を記号とパスのタブ区切りで出力する。
+/// 記号は1つ目にしかなければ'<'、2つ目にしかなければ'>'、ハッシュが異なれば'!'とする。
+pub fn compare_dirs(
+    first_dir: &Path,
+    second_dir: &Path,
+    filters: &Filters,
+    algorithm: HashAlgorithm,
+    buffer_size: usize,
+) -> Result<(), Errors> {
+    for dir in [first_dir, second_dir] {
+        if !dir.is_dir() {
+            return Err(
+                log::make_error!("フォルダではありません。: {}", dir.to_str().unwrap()).as_errors(),
+            );
+        }
+    }
+
+    log::info("フォルダの比較を開始します。");
+
+    // 別のディスクであることが多いので並行して計算する
+    let (first_hashes, second_hashes) = thread::scope(|scope| {
+        let first = scope.spawn(|| hash_dir(first_dir, filters, algorithm, buffer_size));
+        let second = scope.spawn(|| hash_dir(second_dir, filters, algorithm, buffer_size));
+        (first.join().unwrap(), second.join().unwrap())
+    });
+    let (first_hashes, mut errors) = first_hashes;
+    let (second_hashes, mut second_errors) = second_hashes;
+    errors.append(&mut second_errors);
+
+    let mut number_of_only_in_first = 0;
+    let mut number_of_only_in_second = 0;
+    let mut number_of_mismatched = 0;
+    let mut number_of_identical = 0;
+
+    let mut paths: Vec<&PathBuf> = first_hashes.keys().chain(second_hashes.keys()).collect();
+    paths.sort();
+    paths.dedup();
+    for path in paths {
+        match (first_hashes.get(path), second_hashes.get(path)) {
+            (Some(_), None) => {
+                println!("<\t{}", path.to_str().unwrap());
+                number_of_only_in_first += 1;
+            }
+            (None, Some(_)) => {
+                println!(">\t{}", path.to_str().unwrap());
+                number_of_only_in_second += 1;
+            }
+            (Some(first_hash), Some(second_hash)) if first_hash != second_hash => {
+                println!("!\t{}", path.to_str().unwrap());
+                number_of_mismatched += 1;
+            }
+            _ => number_of_identical += 1,
+        }
+    }
+
+    log::info(
+        format!(
+            "一致 {}件 / 1つ目のみ {}件 / 2つ目のみ {}件 / 不一致 {}件",
+            number_of_identical,
+            number_of_only_in_first,
+            number_of_only_in_second,
+            number_of_mismatched
+        )
+        .as_str(),
+    );
+
+    if errors.len() == 0 {
+        Ok(())
+    } else {
+        Err(errors)
+    }
+}
+
+/// フォルダ配下の対象ファイルのハッシュを計算する。
+/// 計算できなかったファイルはエラーの一覧に加えて処理を続ける。
+fn hash_dir(
+    dir: &Path,
+    filters: &Filters,
+    algorithm: HashAlgorithm,
+    buffer_size: usize,
+) -> (BTreeMap<PathBuf, Digest>, Errors) {
+    // フォルダをディスクルートとみなして対象ファイルを一覧にする
+    let disk_info = DiskInfo {
+        index: 0,
+        id: String::new(),
+        root_path: dir.to_path_buf(),
+        sub_roots: vec![],
+        priority: Priority::Normal,
+        on_complete: vec![],
+        metadata: DiskMetadata::default(),
+    };
+    let target_files = target_file::list_target_files(&disk_info, filters);
+
+    let mut buffer = vec![0u8; buffer_size];
+    let mut hashes = BTreeMap::new();
+    let mut errors = vec![];
+    for target_file in target_files {
+        match calc::calc_file_hash(target_file.actual_path(), &mut buffer, algorithm) {
+            Ok(hash) => {
+                hashes.insert(target_file.normalized_path().to_path_buf(), hash);
+            }
+            Err(file_error) => errors.push(file_error.error),
+        }
+    }
+
+    (hashes, errors)
+}
@@ -0,0 +1,192 @@
+use std::process::Command;
+
+use crate::disk::DiskInfo;
+use crate::log::{self, Errors};
+use crate::smart;
+
+/// ディスクの計算を終えた後の処理
+/// diskファイルのon-completeで指定し、夜間に処理したディスクを朝に安全に取り外せるようにする。
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum CompletionAction {
+    /// ディスクのファイルシステムをアンマウントする
+    Unmount,
+    /// ディスクを取り外せる状態にする
+    Eject,
+    /// ディスクの回転を止める
+    SpinDown,
+    /// コマンドを実行する
+    Run(String),
+}
+
+impl CompletionAction {
+    /// on-completeの値から処理を作成する。
+    /// 値が不正であればエラーメッセージを返す。
+    pub fn parse(value: &str) -> Result<CompletionAction, &'static str> {
+        match value.split_once(' ') {
+            Some(("run", command)) if command.trim().len() > 0 => {
+                Ok(CompletionAction::Run(command.trim().to_string()))
+            }
+            _ => match value {
+                "unmount" => Ok(CompletionAction::Unmount),
+                "eject" => Ok(CompletionAction::Eject),
+                "spindown" => Ok(CompletionAction::SpinDown),
+                _ => Err("完了時の処理はunmount、eject、spindown、run コマンドのいずれかを指定してください。"),
+            },
+        }
+    }
+
+    /// 処理の名前を返す。
+    pub fn name(&self) -> &str {
+        match self {
+            CompletionAction::Unmount => "unmount",
+            CompletionAction::Eject => "eject",
+            CompletionAction::SpinDown => "spindown",
+            CompletionAction::Run(command) => command.as_str(),
+        }
+    }
+}
+
+/// 計算を終えたディスクの完了時の処理を指定された順に行う。
+/// 失敗した場合は後の処理を行わず警告を出力する。
+/// ハッシュ計算自体は終わっているので、失敗しても計算の結果には影響させない。
+pub fn run_completion_actions(disk_info: &DiskInfo) {
+    for action in disk_info.on_complete.iter() {
+        if let Err(errors) = run_completion_action(disk_info, action) {
+            log::warn(
+                format!(
+                    "{}: 完了時の処理に失敗したため、残りの処理を中止します。: {}",
+                    &disk_info.id,
+                    action.name()
+                )
+                .as_str(),
+            );
+            for error in errors {
+                log::warn(error.to_string().as_str());
+            }
+            return;
+        }
+        log::info(
+            format!(
+                "{}: 完了時の処理を行いました。: {}",
+                &disk_info.id,
+                action.name()
+            )
+            .as_str(),
+        );
+    }
+}
+
+/// 完了時の処理を1つ行う。
+fn run_completion_action(disk_info: &DiskInfo, action: &CompletionAction) -> Result<(), Errors> {
+    match action {
+        CompletionAction::Run(command) => run_command(
+            shell_command(command)
+                .env("BCBC_DISK_ID", &disk_info.id)
+                .env("BCBC_DISK_ROOT", &disk_info.root_path),
+        ),
+        _ => {
+            // サブルートは別のデバイスにあることがあるので、先にサブルートのデバイスから処理する
+            let mut devices: Vec<String> = vec![];
+            for root in disk_info
+                .sub_roots
+                .iter()
+                .map(|sub_root| sub_root.path.as_path())
+                .chain([disk_info.root_path.as_path()])
+            {
+                match smart::device_of(root) {
+                    Some(device) if !devices.contains(&device) => devices.push(device),
+                    Some(_) => {}
+                    None => {
+                        return Err(log::make_error!(
+                            "ディスクのデバイスがわかりません。: {}",
+                            root.to_str().unwrap()
+                        )
+                        .as_errors())
+                    }
+                }
+            }
+            for device in devices.iter() {
+                run_command(&mut device_command(action, device)?)?;
+            }
+            Ok(())
+        }
+    }
+}
+
+/// コマンドを実行し、正常に終了しなければエラーを返す。
+fn run_command(command: &mut Command) -> Result<(), Errors> {
+    let program = command.get_program().to_string_lossy().to_string();
+    let output = match command.output() {
+        Ok(output) => output,
+        Err(error) => {
+            return Err(
+                log::make_error!("コマンドを実行できませんでした。: {}", program)
+                    .with(&error)
+                    .as_errors(),
+            )
+        }
+    };
+    if !output.status.success() {
+        return Err(log::make_error!(
+            "コマンドが失敗しました。: {}: {}",
+            program,
+            String::from_utf8_lossy(&output.stderr).trim()
+        )
+        .as_errors());
+    }
+    Ok(())
+}
+
+/// シェルでコマンドを実行するコマンドを作成する。
+#[cfg(not(windows))]
+fn shell_command(command: &str) -> Command {
+    let mut shell = Command::new("sh");
+    shell.arg("-c").arg(command);
+    shell
+}
+
+/// シェルでコマンドを実行するコマンドを作成する。
+#[cfg(windows)]
+fn shell_command(command: &str) -> Command {
+    let mut shell = Command::new("cmd");
+    shell.arg("/C").arg(command);
+    shell
+}
+
+/// デバイスに対して処理を行うコマンドを作成する。
+#[cfg(target_os = "linux")]
+fn device_command(action: &CompletionAction, device: &str) -> Result<Command, Errors> {
+    let (program, args): (&str, &[&str]) = match action {
+        CompletionAction::Unmount => ("umount", &[]),
+        // ejectはアンマウントしてから取り外せる状態にする
+        CompletionAction::Eject => ("eject", &[]),
+        CompletionAction::SpinDown => ("hdparm", &["-y"]),
+        CompletionAction::Run(_) => unreachable!(),
+    };
+    let mut command = Command::new(program);
+    command.args(args).arg(device);
+    Ok(command)
+}
+
+/// デバイスに対して処理を行うコマンドを作成する。
+#[cfg(target_os = "macos")]
+fn device_command(action: &CompletionAction, device: &str) -> Result<Command, Errors> {
+    let verb = match action {
+        CompletionAction::Unmount => "unmount",
+        CompletionAction::Eject => "eject",
+        CompletionAction::SpinDown => {
+            return Err(log::make_error!("この環境ではspindownを行えません。").as_errors())
+        }
+        CompletionAction::Run(_) => unreachable!(),
+    };
+    let mut command = Command::new("diskutil");
+    command.arg(verb).arg(device);
+    Ok(command)
+}
+
+/// デバイスに対して処理を行うコマンドを作成する。
+/// LinuxとmacOS以外では行えない。
+#[cfg(not(any(target_os = "linux", target_os = "macos")))]
+fn device_command(action: &CompletionAction, _device: &str) -> Result<Command, Errors> {
+    Err(log::make_error!("この環境では{}を行えません。", action.name()).as_errors())
+}
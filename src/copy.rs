@@ -0,0 +1,473 @@
+use std::fs::{self, File};
+use std::io::{Read, Write};
+use std::path::{Path, PathBuf};
+
+use crate::calc;
+use crate::disk::{self, DiskInfo, DiskMetadata, Priority};
+use crate::filter::Filters;
+use crate::hash_algorithm::{Digest, HashAlgorithm};
+use crate::hash_file;
+use crate::log::{self, Error, Errors};
+use crate::page_cache;
+use crate::path_normalizer::PathNormalizer;
+use crate::registry;
+use crate::seal;
+use crate::target_file::{self, TargetFile};
+
+/// コピー先
+struct Destination {
+    /// コピー先のフォルダの絶対パス
+    folder: PathBuf,
+    /// 検証する場合のコピー先のディスク
+    disk_info: Option<DiskInfo>,
+}
+
+/// コピー元のフォルダ配下のファイルを1つ以上のコピー先のフォルダにコピーする。
+/// コピー元は1回だけ読み込んで全てのコピー先に書き込み、同時にコピー元のハッシュを計算する。
+/// 検証する指定ならコピー先を読み直してハッシュを比較し、検証できたファイルはコピー先のディスクのハッシュファイルに追記する。
+pub fn copy_files(
+    output_folder: &Path,
+    registry_filepath: &Path,
+    source_folder: &Path,
+    destination_folders: &[PathBuf],
+    filters: &Filters,
+    verify: bool,
+    algorithm: Option<HashAlgorithm>,
+    buffer_size: usize,
+) -> Result<(), Errors> {
+    if !source_folder.is_dir() {
+        return Err(log::make_error!(
+            "コピー元がフォルダではありません。: {}",
+            source_folder.to_str().unwrap()
+        )
+        .as_errors());
+    }
+
+    let (destinations, algorithm) = prepare_destinations(
+        output_folder,
+        registry_filepath,
+        destination_folders,
+        verify,
+        algorithm,
+    )?;
+
+    // コピー元のフォルダをディスクルートとみなして対象ファイルを一覧にする
+    let source_disk = DiskInfo {
+        index: 0,
+        id: String::new(),
+        root_path: source_folder.to_path_buf(),
+        sub_roots: vec![],
+        priority: Priority::Normal,
+        on_complete: vec![],
+        metadata: DiskMetadata::default(),
+    };
+    let source_files = target_file::list_target_files(&source_disk, filters);
+
+    log::info("コピーを開始します。");
+    if verify && !page_cache::SUPPORTED {
+        log::warn("この環境ではページキャッシュを使わずに読み込めないため、キャッシュから読み込むことがあります。");
+    }
+
+    let mut buffer = vec![0u8; buffer_size];
+    let mut errors = vec![];
+    let mut number_of_copied = 0;
+    let mut number_of_skipped = 0;
+
+    for source_file in source_files.iter() {
+        let relative_path = source_file
+            .actual_path()
+            .strip_prefix(source_folder)
+            .unwrap();
+
+        // 上書きはしない
+        let mut copied_destinations = vec![];
+        for destination in destinations.iter() {
+            let destination_filepath = destination.folder.join(relative_path);
+            if destination_filepath.exists() {
+                log::info(
+                    format!(
+                        "コピー先にファイルがあるためスキップします。: {}",
+                        destination_filepath.to_str().unwrap()
+                    )
+                    .as_str(),
+                );
+                number_of_skipped += 1;
+            } else {
+                copied_destinations.push((destination, destination_filepath));
+            }
+        }
+        if copied_destinations.len() == 0 {
+            continue;
+        }
+
+        let destination_filepaths: Vec<PathBuf> = copied_destinations
+            .iter()
+            .map(|(_, destination_filepath)| destination_filepath.clone())
+            .collect();
+        let (source_hash, written) = match copy_file(
+            source_file.actual_path(),
+            &destination_filepaths,
+            &mut buffer,
+            algorithm,
+            &mut errors,
+        ) {
+            Ok(result) => result,
+            Err(mut copy_errors) => {
+                errors.append(&mut copy_errors);
+                continue;
+            }
+        };
+
+        for ((destination, destination_filepath), written) in
+            copied_destinations.into_iter().zip(written)
+        {
+            if !written {
+                continue;
+            }
+            if let Some(disk_info) = &destination.disk_info {
+                if let Err(mut verify_errors) = verify_and_append_hash(
+                    output_folder,
+                    disk_info,
+                    destination_filepath.as_path(),
+                    source_file.size,
+                    &source_hash,
+                    &mut buffer,
+                    algorithm,
+                    filters.path_normalizer(),
+                ) {
+                    errors.append(&mut verify_errors);
+                    continue;
+                }
+            }
+
+            log::info(
+                format!(
+                    "コピーしました。: {}",
+                    destination_filepath.to_str().unwrap()
+                )
+                .as_str(),
+            );
+            number_of_copied += 1;
+        }
+    }
+
+    log::info(
+        format!(
+            "コピーを終了しました。コピー {}件 / スキップ {}件 / エラー {}件",
+            number_of_copied,
+            number_of_skipped,
+            errors.len()
+        )
+        .as_str(),
+    );
+
+    if errors.len() == 0 {
+        Ok(())
+    } else {
+        Err(errors)
+    }
+}
+
+/// コピー先のフォルダを作成し、検証する場合はコピー先のディスクを調べる。
+/// コピー元のハッシュを全てのコピー先で使うので、コピー先のハッシュファイルのアルゴリズムは揃っている必要がある。
+fn prepare_destinations(
+    output_folder: &Path,
+    registry_filepath: &Path,
+    destination_folders: &[PathBuf],
+    verify: bool,
+    algorithm: Option<HashAlgorithm>,
+) -> Result<(Vec<Destination>, HashAlgorithm), Errors> {
+    let mut destinations = vec![];
+    let mut resolved_algorithm: Option<HashAlgorithm> = None;
+
+    for destination_folder in destination_folders {
+        if let Err(error) = fs::create_dir_all(destination_folder) {
+            return Err(log::make_error!(
+                "コピー先のフォルダを作成できませんでした。: {}",
+                destination_folder.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors());
+        }
+
+        // 検証する場合はコピー先のディスクのハッシュファイルに追記する
+        // ハッシュファイルに追記するのでハッシュファイルのアルゴリズムで計算する
+        let disk_info = if verify {
+            let disk_info = find_destination_disk(destination_folder, registry_filepath)?;
+            if seal::is_sealed(output_folder, &disk_info.id) {
+                return Err(log::make_error!(
+                    "ディスク{}は封印されているためコピーできません。",
+                    &disk_info.id
+                )
+                .as_errors());
+            }
+            hash_file::ensure_output_folder(output_folder)?;
+            let disk_algorithm = hash_file::resolve_algorithm(
+                output_folder.join(&disk_info.id).as_path(),
+                algorithm,
+            )?;
+            match resolved_algorithm {
+                Some(resolved_algorithm) if resolved_algorithm != disk_algorithm => {
+                    return Err(log::make_error!(
+                        "コピー先のディスクのハッシュアルゴリズムが揃っていません。: {}({}) / {}",
+                        &disk_info.id,
+                        disk_algorithm.name(),
+                        resolved_algorithm.name()
+                    )
+                    .as_errors());
+                }
+                _ => resolved_algorithm = Some(disk_algorithm),
+            }
+            Some(disk_info)
+        } else {
+            None
+        };
+
+        destinations.push(Destination {
+            folder: fs::canonicalize(destination_folder).unwrap(),
+            disk_info,
+        });
+    }
+
+    let algorithm = resolved_algorithm
+        .or(algorithm)
+        .unwrap_or(HashAlgorithm::Md5);
+    Ok((destinations, algorithm))
+}
+
+/// ファイルを全てのコピー先にコピーし、コピー元のハッシュとコピー先ごとに書き込めたかを返す。
+/// コピー元は1回だけ読み込み、読み込んだ内容からハッシュを計算する。
+/// コピー元を読み込めなければエラーを返すが、コピー先に書き込めない場合はエラー情報一覧に追加して残りのコピー先への書き込みを続ける。
+fn copy_file(
+    source_filepath: &Path,
+    destination_filepaths: &[PathBuf],
+    buffer: &mut [u8],
+    algorithm: HashAlgorithm,
+    errors: &mut Vec<Error>,
+) -> Result<(Digest, Vec<bool>), Errors> {
+    let mut source_file = match File::open(source_filepath) {
+        Ok(source_file) => source_file,
+        Err(error) => {
+            return Err(log::make_error!(
+                "コピー元のファイルが開けませんでした。: {}",
+                source_filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors())
+        }
+    };
+
+    // 書き込めなくなったコピー先はNoneにする
+    let mut destination_files: Vec<Option<File>> = destination_filepaths
+        .iter()
+        .map(
+            |destination_filepath| match create_destination_file(destination_filepath) {
+                Ok(destination_file) => Some(destination_file),
+                Err(error) => {
+                    errors.push(error);
+                    None
+                }
+            },
+        )
+        .collect();
+
+    let mut context = algorithm.context();
+    loop {
+        let red_size = match source_file.read(buffer) {
+            Ok(red_size) => red_size,
+            Err(error) => {
+                return Err(log::make_error!(
+                    "コピー元のファイルを読み込めません。: {}",
+                    source_filepath.to_str().unwrap()
+                )
+                .with(&error)
+                .as_errors())
+            }
+        };
+        if red_size == 0 {
+            break;
+        }
+
+        context.consume(&buffer[..red_size]);
+        for (destination_file, destination_filepath) in
+            destination_files.iter_mut().zip(destination_filepaths)
+        {
+            if let Some(file) = destination_file {
+                if let Err(error) = file.write_all(&buffer[..red_size]) {
+                    errors.push(
+                        log::make_error!(
+                            "コピー先のファイルに書き込めません。: {}",
+                            destination_filepath.to_str().unwrap()
+                        )
+                        .with(&error),
+                    );
+                    *destination_file = None;
+                }
+            }
+        }
+    }
+
+    // 読み直す前にディスクに書き込ませる
+    for (destination_file, destination_filepath) in
+        destination_files.iter_mut().zip(destination_filepaths)
+    {
+        if let Some(file) = destination_file {
+            if let Err(error) = file.sync_all() {
+                errors.push(
+                    log::make_error!(
+                        "コピー先のファイルをディスクに書き込めません。: {}",
+                        destination_filepath.to_str().unwrap()
+                    )
+                    .with(&error),
+                );
+                *destination_file = None;
+            }
+        }
+    }
+
+    let written = destination_files
+        .iter()
+        .map(|destination_file| destination_file.is_some())
+        .collect();
+    Ok((context.compute(), written))
+}
+
+/// コピー先のフォルダを作成してファイルを作成する。
+fn create_destination_file(destination_filepath: &Path) -> Result<File, Error> {
+    if let Some(parent) = destination_filepath.parent() {
+        if let Err(error) = fs::create_dir_all(parent) {
+            return Err(log::make_error!(
+                "コピー先のフォルダを作成できませんでした。: {}",
+                parent.to_str().unwrap()
+            )
+            .with(&error));
+        }
+    }
+
+    match File::create(destination_filepath) {
+        Ok(destination_file) => Ok(destination_file),
+        Err(error) => Err(log::make_error!(
+            "コピー先のファイルを作成できませんでした。: {}",
+            destination_filepath.to_str().unwrap()
+        )
+        .with(&error)),
+    }
+}
+
+/// コピー先をページキャッシュを使わずに読み直してハッシュを比較し、一致すればコピー先のディスクのハッシュファイルに追記する。
+/// 書き込んだ内容がキャッシュに残っていると、ディスクに正しく書き込めたかを検証できないため、キャッシュを使わずに読み込む。
+fn verify_and_append_hash(
+    output_folder: &Path,
+    disk_info: &DiskInfo,
+    destination_filepath: &Path,
+    size: u64,
+    source_hash: &Digest,
+    buffer: &mut [u8],
+    algorithm: HashAlgorithm,
+    path_normalizer: &PathNormalizer,
+) -> Result<(), Errors> {
+    let destination_hash =
+        match calc::calc_uncached_file_hash(destination_filepath, buffer, algorithm) {
+            Ok(destination_hash) => destination_hash,
+            Err(file_error) => return Err(vec![file_error.error]),
+        };
+    if &destination_hash != source_hash {
+        return Err(log::make_error!(
+            "コピー先のハッシュがコピー元と異なります。: {}",
+            destination_filepath.to_str().unwrap()
+        )
+        .as_errors());
+    }
+
+    let (root, prefix, actual_path) = root_and_prefix_of(disk_info, destination_filepath)?;
+    let destination_file =
+        TargetFile::new(root.as_path(), prefix, actual_path, size, path_normalizer).with_modified(
+            fs::metadata(destination_filepath)
+                .and_then(|metadata| metadata.modified())
+                .ok(),
+        );
+    append_hash(
+        output_folder,
+        &disk_info.id,
+        algorithm,
+        &destination_file,
+        source_hash,
+    )
+}
+
+/// コピー先のフォルダを含むディスクのディスク情報を返す。
+/// diskファイルのあるルートの配下になければ、登録済みのディスクのサブルートから探す。
+fn find_destination_disk(
+    destination_folder: &Path,
+    registry_filepath: &Path,
+) -> Result<DiskInfo, Errors> {
+    match disk::find_disk_containing(destination_folder) {
+        Ok(disk_info) => Ok(disk_info),
+        Err(errors) => {
+            let registry = registry::load_registry(registry_filepath)?;
+            disk::find_disk_with_sub_root_containing(destination_folder, &registry).ok_or(errors)
+        }
+    }
+}
+
+/// コピー先のファイルを含むディスクのルートかサブルートと、正規化ファイルパスのプレフィックスを、ファイルの絶対パスとともに返す。
+/// サブルートの中のファイルは、calcと同じ正規化ファイルパスになるようサブルートのプレフィックスを付ける。
+fn root_and_prefix_of<'a>(
+    disk_info: &'a DiskInfo,
+    filepath: &Path,
+) -> Result<(PathBuf, &'a Path, PathBuf), Errors> {
+    let filepath = match fs::canonicalize(filepath) {
+        Ok(filepath) => filepath,
+        Err(error) => {
+            return Err(log::make_error!(
+                "パスを絶対パスにできませんでした。: {}",
+                filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors())
+        }
+    };
+    for sub_root in disk_info.sub_roots.iter() {
+        if let Ok(sub_root_path) = fs::canonicalize(&sub_root.path) {
+            if filepath.starts_with(&sub_root_path) {
+                return Ok((sub_root_path, Path::new(&sub_root.prefix), filepath));
+            }
+        }
+    }
+    match fs::canonicalize(&disk_info.root_path) {
+        Ok(root_path) if filepath.starts_with(&root_path) => {
+            Ok((root_path, Path::new(""), filepath))
+        }
+        _ => Err(log::make_error!(
+            "コピー先がディスク{}の中にありません。: {}",
+            &disk_info.id,
+            filepath.to_str().unwrap()
+        )
+        .as_errors()),
+    }
+}
+
+/// コピー先のディスクのハッシュファイルに行を追記する。
+fn append_hash(
+    output_folder: &Path,
+    disk_id: &str,
+    algorithm: HashAlgorithm,
+    target_file: &TargetFile,
+    hash: &Digest,
+) -> Result<(), Errors> {
+    let hash_filepath = output_folder.join(disk_id);
+    hash_file::prepare_hash_file(hash_filepath.as_path(), algorithm)?;
+    let mut hash_file = hash_file::open_hash_file(hash_filepath.as_path())?;
+    let hash_file_line = hash_file::add_stamped_hash_file_line(
+        String::new(),
+        target_file.normalized_path(),
+        hash,
+        target_file.stamp().as_ref(),
+    );
+    match hash_file.write_all(hash_file_line.as_bytes()) {
+        Ok(_) => Ok(()),
+        Err(error) => Err(log::make_error!("ハッシュファイルに書き込めません。")
+            .with(&error)
+            .as_errors()),
+    }
+}
@@ -0,0 +1,254 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::hash_algorithm::{Digest, HashAlgorithm};
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::seal;
+use crate::target_file;
+
+/// `--output-format`でmd5sumなどと互換の形式を指定する名前
+pub const FORMAT_NAME: &str = "coreutils";
+
+/// md5sumなどと互換の形式のファイルを出力するフォルダを返す。
+fn coreutils_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("coreutils")
+}
+
+/// アルゴリズムに対応するコマンドで慣習的に使われる拡張子を返す。
+fn extension_of(algorithm: HashAlgorithm) -> &'static str {
+    match algorithm {
+        HashAlgorithm::Md5 => "md5",
+        HashAlgorithm::Sha1 => "sha1",
+        HashAlgorithm::Sha256 => "sha256",
+        HashAlgorithm::Sha512 => "sha512",
+        HashAlgorithm::Blake2b => "b2",
+        HashAlgorithm::XxHash64 => "xxh64",
+        // 対応するコマンドはないので、アルゴリズム名から記号を除いたものにする
+        HashAlgorithm::Sha256Tree => "sha256tree",
+    }
+}
+
+/// ディスクのハッシュファイルをmd5sumなどと互換の"ハッシュ  パス"の形式で出力する。
+/// 出力したファイルはディスクルートで`sha256sum -c`などに渡して検証できる。
+pub fn export_hash_files(output_folder: &Path, disk_ids: &[String]) -> Result<(), Errors> {
+    let coreutils_folder = coreutils_folder(output_folder);
+    if let Err(error) = fs::create_dir_all(coreutils_folder.as_path()) {
+        return Err(log::make_error!(
+            "md5sum互換のファイルの出力先を作成できませんでした。: {}",
+            coreutils_folder.to_str().unwrap()
+        )
+        .with(&error)
+        .as_errors());
+    }
+
+    for disk_id in disk_ids {
+        let hash_filepath = output_folder.join(disk_id);
+        let algorithm = match hash_file::read_algorithm(hash_filepath.as_path())? {
+            Some(algorithm) => algorithm,
+            None => continue,
+        };
+        let hash_info_map = hash_file::load_hash_info(hash_filepath.as_path())?;
+
+        let mut contents = String::new();
+        for (target_filepath, hash) in hash_file::sorted_hash_info(&hash_info_map) {
+            contents.push_str(&to_sum_line(target_filepath, hash));
+        }
+
+        let sum_filepath =
+            coreutils_folder.join(format!("{}.{}", disk_id, extension_of(algorithm)));
+        if let Err(error) = atomic_write::write(sum_filepath.as_path(), contents) {
+            return Err(log::make_error!(
+                "md5sum互換のファイルを出力できませんでした。: {}",
+                sum_filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors());
+        }
+        log::info(
+            format!(
+                "md5sum互換のファイルを出力しました。: {}",
+                sum_filepath.to_str().unwrap()
+            )
+            .as_str(),
+        );
+    }
+
+    Ok(())
+}
+
+/// "ハッシュ  パス"の1行にする。
+/// パスに改行か"\"を含む場合は、coreutilsと同じく行頭に"\"を付けてエスケープする。
+fn to_sum_line(target_filepath: &Path, hash: &Digest) -> String {
+    let path = target_filepath.to_str().unwrap();
+    let hash = hex::encode(hash.to_vec());
+    if path.contains('\n') || path.contains('\\') {
+        let escaped = path.replace('\\', "\\\\").replace('\n', "\\n");
+        format!("\\{}  {}\n", hash, escaped)
+    } else {
+        format!("{}  {}\n", hash, path)
+    }
+}
+
+/// md5sumなどと互換の形式のファイルを読み込み、ディスクのハッシュファイルに取り込む。
+/// アルゴリズムは、ハッシュファイルがあればそのアルゴリズム、指定があれば指定のアルゴリズム、
+/// どちらもなければハッシュの長さから判定する。
+/// ハッシュファイルに同じパスの行があれば取り込んだハッシュで置き換える。
+pub fn import_sum_file(
+    output_folder: &Path,
+    sum_filepath: &Path,
+    disk_id: &str,
+    requested: Option<HashAlgorithm>,
+) -> Result<(), Errors> {
+    if seal::is_sealed(output_folder, disk_id) {
+        return Err(
+            log::make_error!("ディスク{}は封印されているため取り込めません。", disk_id).as_errors(),
+        );
+    }
+
+    let contents = match fs::read_to_string(sum_filepath) {
+        Ok(contents) => contents,
+        Err(error) => {
+            return Err(log::make_error!(
+                "md5sum互換のファイルを読み込めませんでした。: {}",
+                sum_filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors())
+        }
+    };
+    let mut sum_lines = vec![];
+    for (i, line) in contents.lines().enumerate() {
+        if line.len() == 0 {
+            continue;
+        }
+        sum_lines.push(log::with_line_number(
+            parse_sum_line(line),
+            sum_filepath,
+            i + 1,
+        )?);
+    }
+
+    let hash_filepath = output_folder.join(disk_id);
+    let algorithm = match hash_file::read_algorithm(hash_filepath.as_path())? {
+        Some(_) => hash_file::resolve_algorithm(hash_filepath.as_path(), requested)?,
+        None => match requested {
+            Some(requested) => requested,
+            None => guess_algorithm(&sum_lines)?,
+        },
+    };
+
+    let mut hash_info_map = hash_file::load_hash_info(hash_filepath.as_path())?;
+    let mut stamp_map = hash_file::load_file_stamps(hash_filepath.as_path())?;
+    for (i, (target_filepath, hash)) in sum_lines.iter().enumerate() {
+        if hash.len() != algorithm.digest_length() {
+            return Err(log::make_error!(
+                "ハッシュの長さがアルゴリズム{}と一致しません。: {}: {}番目のハッシュ",
+                algorithm.name(),
+                sum_filepath.to_str().unwrap(),
+                i + 1
+            )
+            .as_errors());
+        }
+        // 取り込んだハッシュはバイト数と更新日時がわからないので、置き換えた行の記録も消す
+        stamp_map.remove(target_filepath);
+        hash_info_map.insert(target_filepath.clone(), *hash);
+    }
+
+    hash_file::ensure_output_folder(output_folder)?;
+    hash_file::write_calculated_hash_with_stamps(
+        hash_filepath.as_path(),
+        algorithm,
+        hash_info_map,
+        &stamp_map,
+    )?;
+    log::info(
+        format!(
+            "{}件のハッシュをディスク{}のハッシュファイルに取り込みました。",
+            sum_lines.len(),
+            disk_id
+        )
+        .as_str(),
+    );
+
+    Ok(())
+}
+
+/// "ハッシュ  パス"の形式の行をパースする。
+/// パスの前の"*"(バイナリモード)と"./"は取り除く。
+fn parse_sum_line(line: &str) -> Result<(PathBuf, Digest), Errors> {
+    let (escaped, line) = match line.strip_prefix('\\') {
+        Some(line) => (true, line),
+        None => (false, line),
+    };
+    let (hash, path) = match line.split_once(' ') {
+        Some((hash, path)) => (hash, path),
+        None => return Err(log::make_error!("行の形式が不正です。").as_errors()),
+    };
+    let path = path
+        .strip_prefix(' ')
+        .or_else(|| path.strip_prefix('*'))
+        .unwrap_or(path);
+    let path = path.strip_prefix("./").unwrap_or(path);
+    let path = if escaped {
+        unescape(path)
+    } else {
+        path.to_string()
+    };
+
+    let hash = match hex::decode(hash) {
+        Ok(hash) if hash.len() > 0 => Digest::from_slice(&hash),
+        _ => return Err(log::make_error!("ハッシュが不正です。: {}", hash).as_errors()),
+    };
+    match target_file::normalize_relative_path(&path) {
+        Some(path) if path.as_os_str().len() > 0 => Ok((path, hash)),
+        _ => Err(log::make_error!("パスが不正です。: {}", path).as_errors()),
+    }
+}
+
+/// coreutilsでエスケープされたパスを元に戻す。
+fn unescape(path: &str) -> String {
+    let mut unescaped = String::new();
+    let mut chars = path.chars();
+    while let Some(c) = chars.next() {
+        if c != '\\' {
+            unescaped.push(c);
+            continue;
+        }
+        match chars.next() {
+            Some('n') => unescaped.push('\n'),
+            Some(c) => unescaped.push(c),
+            None => unescaped.push('\\'),
+        }
+    }
+    unescaped
+}
+
+/// ハッシュの長さからアルゴリズムを判定する。
+/// SHA-512とBLAKE2bは長さが同じなので判定できない。
+fn guess_algorithm(sum_lines: &[(PathBuf, Digest)]) -> Result<HashAlgorithm, Errors> {
+    let length = match sum_lines.first() {
+        Some((_, hash)) => hash.len(),
+        None => return Ok(HashAlgorithm::Md5),
+    };
+    let candidates: Vec<HashAlgorithm> = [
+        HashAlgorithm::Md5,
+        HashAlgorithm::Sha1,
+        HashAlgorithm::Sha256,
+        HashAlgorithm::Sha512,
+        HashAlgorithm::Blake2b,
+        HashAlgorithm::XxHash64,
+    ]
+    .into_iter()
+    .filter(|algorithm| algorithm.digest_length() == length)
+    .collect();
+
+    match candidates[..] {
+        [algorithm] => Ok(algorithm),
+        _ => Err(log::make_error!(
+            "ハッシュの長さからアルゴリズムを判定できません。--algoで指定してください。"
+        )
+        .as_errors()),
+    }
+}
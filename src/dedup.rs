@@ -0,0 +1,122 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::clock;
+use crate::hash_algorithm::{Digest, HashAlgorithm};
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::merged_hash_file;
+use crate::seal;
+
+/// ハッシュファイルの重複した行を削除する。
+/// ディスクIDが指定されなければ全てのハッシュファイルを対象にする。
+pub fn dedup_hash_files(output_folder: &Path, disk_ids: &Vec<String>) -> Result<(), Errors> {
+    let hash_filepaths = if disk_ids.len() == 0 {
+        merged_hash_file::find_hash_files(output_folder)?
+    } else {
+        disk_ids
+            .iter()
+            .map(|disk_id| output_folder.join(disk_id))
+            .collect()
+    };
+
+    // 1つのハッシュファイルで問題が発生しても他のハッシュファイルは処理する
+    let mut errors = vec![];
+    for hash_filepath in hash_filepaths {
+        if let Err(mut dedup_errors) = dedup_hash_file(output_folder, hash_filepath.as_path()) {
+            errors.append(&mut dedup_errors);
+        }
+    }
+
+    if errors.len() == 0 {
+        Ok(())
+    } else {
+        Err(errors)
+    }
+}
+
+/// ハッシュファイルを1つ処理する。
+fn dedup_hash_file(output_folder: &Path, hash_filepath: &Path) -> Result<(), Errors> {
+    let disk_id = hash_filepath.file_name().unwrap().to_str().unwrap();
+
+    if !hash_filepath.is_file() {
+        return Err(
+            log::make_error!("ディスク{}のハッシュファイルがありません。", disk_id).as_errors(),
+        );
+    }
+
+    let (hash_info_map, duplicates) = hash_file::load_hash_info_with_duplicates(hash_filepath)?;
+    if duplicates.len() == 0 {
+        log::info(format!("{}: 重複した行はありません。", disk_id).as_str());
+        return Ok(());
+    }
+
+    // 封印されたディスクのハッシュファイルは変更しない
+    if seal::is_sealed(output_folder, disk_id) {
+        log::warn(
+            format!(
+                "{}: 重複した行が{}件ありますが、封印されたディスクのため変更しません。",
+                disk_id,
+                duplicates.len()
+            )
+            .as_str(),
+        );
+        return Ok(());
+    }
+
+    let report_filepath = write_report(output_folder, disk_id, &duplicates)?;
+    let algorithm = hash_file::read_algorithm(hash_filepath)?.unwrap_or(HashAlgorithm::Md5);
+    let stamp_map = hash_file::load_file_stamps(hash_filepath)?;
+    hash_file::write_calculated_hash_with_stamps(
+        hash_filepath,
+        algorithm,
+        hash_info_map,
+        &stamp_map,
+    )?;
+
+    log::info(
+        format!(
+            "{}: 重複した行を{}件削除しました。: {}",
+            disk_id,
+            duplicates.len(),
+            report_filepath.to_str().unwrap()
+        )
+        .as_str(),
+    );
+
+    Ok(())
+}
+
+/// 削除した行の一覧を出力する。
+/// ハッシュファイルと同じ"パス:ハッシュ"の形式で出力する。
+fn write_report(
+    output_folder: &Path,
+    disk_id: &str,
+    duplicates: &Vec<(PathBuf, Digest)>,
+) -> Result<PathBuf, Errors> {
+    let report_folder = output_folder.join("duplicates");
+    if let Err(error) = fs::create_dir_all(report_folder.as_path()) {
+        return Err(
+            log::make_error!("重複レポートのフォルダを作成できませんでした。")
+                .with(&error)
+                .as_errors(),
+        );
+    }
+
+    let timestamp = clock::now().format("%Y%m%d%H%M%S");
+    let report_filepath = report_folder.join(format!("{}-{}", disk_id, timestamp));
+
+    let mut report_contents = String::new();
+    for (target_filepath, hash) in duplicates {
+        report_contents =
+            hash_file::add_hash_file_line(report_contents, target_filepath.as_path(), hash);
+    }
+
+    match atomic_write::write(report_filepath.as_path(), &report_contents) {
+        Ok(_) => Ok(report_filepath),
+        Err(error) => Err(log::make_error!("重複レポートの作成に失敗しました。")
+            .with(&error)
+            .as_errors()),
+    }
+}
@@ -0,0 +1,164 @@
+use std::collections::{BTreeMap, BTreeSet, HashMap};
+use std::path::{Path, PathBuf};
+
+use crate::disk;
+use crate::hash_algorithm::{Digest, HashAlgorithm};
+use crate::hash_file;
+use crate::log::{self, Errors};
+
+/// 2つのハッシュファイルを比較して、全てのファイルを1行ずつタブ区切りで出力する。
+/// 行頭の記号は"="が一致、"<"が1つ目にしかない、">"が2つ目にしかない、"!"がハッシュの不一致を表す。
+/// ハッシュファイルはグループ名なら統合ハッシュファイル、ディスクIDならディスクのハッシュファイル、
+/// それ以外ならファイルのパスとして探す。
+/// 出力フォルダはそれぞれのハッシュファイルのグループの出力フォルダを渡す。
+pub fn diff_hash_files(
+    first_output_folder: &Path,
+    second_output_folder: &Path,
+    current_folder: &Path,
+    first: &str,
+    second: &str,
+) -> Result<(), Errors> {
+    let first_filepath = resolve_hash_filepath(first_output_folder, current_folder, first)?;
+    let second_filepath = resolve_hash_filepath(second_output_folder, current_folder, second)?;
+
+    // アルゴリズムが異なればハッシュを比較できない
+    let first_algorithm = read_algorithm(first_filepath.as_path())?;
+    let second_algorithm = read_algorithm(second_filepath.as_path())?;
+    if first_algorithm != second_algorithm {
+        return Err(log::make_error!(
+            "ハッシュファイルのアルゴリズムが異なるため比較できません。: {}={}, {}={}",
+            first,
+            first_algorithm.name(),
+            second,
+            second_algorithm.name()
+        )
+        .as_errors());
+    }
+
+    let first_hash_info_map = hash_file::load_hash_info(first_filepath.as_path())?;
+    let second_hash_info_map = hash_file::load_hash_info(second_filepath.as_path())?;
+
+    let mut number_of_identical = 0;
+    let mut number_of_only_in_first = 0;
+    let mut number_of_only_in_second = 0;
+    let mut number_of_mismatched = 0;
+
+    for (target_filepath, (first_hash, second_hash)) in
+        pair_hashes(&first_hash_info_map, &second_hash_info_map)
+    {
+        let target_filepath = target_filepath.to_str().unwrap();
+        match (first_hash, second_hash) {
+            (Some(first_hash), Some(second_hash)) if first_hash == second_hash => {
+                println!(
+                    "=\t{}\t{}",
+                    target_filepath,
+                    hex::encode(first_hash.to_vec())
+                );
+                number_of_identical += 1;
+            }
+            (Some(first_hash), Some(second_hash)) => {
+                println!(
+                    "!\t{}\t{}\t{}",
+                    target_filepath,
+                    hex::encode(first_hash.to_vec()),
+                    hex::encode(second_hash.to_vec())
+                );
+                number_of_mismatched += 1;
+            }
+            (Some(first_hash), None) => {
+                println!(
+                    "<\t{}\t{}",
+                    target_filepath,
+                    hex::encode(first_hash.to_vec())
+                );
+                number_of_only_in_first += 1;
+            }
+            (None, Some(second_hash)) => {
+                println!(
+                    ">\t{}\t{}",
+                    target_filepath,
+                    hex::encode(second_hash.to_vec())
+                );
+                number_of_only_in_second += 1;
+            }
+            (None, None) => {}
+        }
+    }
+
+    log::info(
+        format!(
+            "一致 {}件 / {}のみ {}件 / {}のみ {}件 / 不一致 {}件",
+            number_of_identical,
+            first,
+            number_of_only_in_first,
+            second,
+            number_of_only_in_second,
+            number_of_mismatched
+        )
+        .as_str(),
+    );
+
+    Ok(())
+}
+
+/// 2つのハッシュ情報マップのハッシュをファイルパスごとに組にしてパス順に並べる。
+fn pair_hashes<'a>(
+    first_hash_info_map: &'a HashMap<PathBuf, Digest>,
+    second_hash_info_map: &'a HashMap<PathBuf, Digest>,
+) -> BTreeMap<&'a PathBuf, (Option<&'a Digest>, Option<&'a Digest>)> {
+    let target_filepaths: BTreeSet<&PathBuf> = first_hash_info_map
+        .keys()
+        .chain(second_hash_info_map.keys())
+        .collect();
+
+    target_filepaths
+        .into_iter()
+        .map(|target_filepath| {
+            (
+                target_filepath,
+                (
+                    first_hash_info_map.get(target_filepath),
+                    second_hash_info_map.get(target_filepath),
+                ),
+            )
+        })
+        .collect()
+}
+
+/// 比較対象がグループ名かディスクIDならそのグループを返す。
+/// ファイルのパスならNoneを返す。
+pub fn group_of_target(target: &str) -> Option<char> {
+    let is_disk_group = target.len() == 1 && target.chars().all(|c| c.is_ascii_uppercase());
+    if is_disk_group || disk::DISK_ID_PATTERN.is_match(target) {
+        target.chars().next()
+    } else {
+        None
+    }
+}
+
+/// 比較対象のハッシュファイルのパスを返す。
+fn resolve_hash_filepath(
+    output_folder: &Path,
+    current_folder: &Path,
+    target: &str,
+) -> Result<PathBuf, Errors> {
+    let hash_filepath = match group_of_target(target) {
+        Some(_) => output_folder.join(target),
+        None => current_folder.join(target),
+    };
+
+    if hash_filepath.is_file() {
+        Ok(hash_filepath)
+    } else {
+        Err(log::make_error!(
+            "ハッシュファイルがありません。: {}",
+            hash_filepath.to_str().unwrap()
+        )
+        .as_errors())
+    }
+}
+
+/// ハッシュファイルのアルゴリズムを返す。
+fn read_algorithm(hash_filepath: &Path) -> Result<HashAlgorithm, Errors> {
+    Ok(hash_file::read_algorithm(hash_filepath)?.unwrap_or(HashAlgorithm::Md5))
+}
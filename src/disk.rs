@@ -1,46 +1,287 @@
+use std::collections::BTreeMap;
 use std::fs;
 use std::path::{Path, PathBuf};
 
+use chrono::NaiveDate;
 use once_cell::sync::Lazy;
 use regex::Regex;
 
+use crate::completion_action::CompletionAction;
 use crate::log::{self, Error, Errors};
+use crate::messages;
+use crate::registry::{self, DiskRegistry};
+use crate::run_options::RunOptions;
 
 #[derive(Debug, Clone)]
 pub struct DiskInfo {
     pub index: usize,
     pub id: String,
     pub root_path: PathBuf,
+    pub sub_roots: Vec<SubRoot>,
+    pub priority: Priority,
+    pub on_complete: Vec<CompletionAction>,
+    pub metadata: DiskMetadata,
 }
 
+impl DiskInfo {
+    /// ディスクのグループを返す。
+    pub fn group(&self) -> char {
+        self.id.chars().next().unwrap()
+    }
+}
+
+/// ディスクの優先度
+/// 優先度の高い順に並ぶ。
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Priority {
+    High,
+    Normal,
+    Low,
+}
+
+impl Priority {
+    /// 優先度の名前から優先度を返す。
+    /// 優先度の名前でなければNoneを返す。
+    pub fn from_name(name: &str) -> Option<Priority> {
+        match name {
+            "high" => Some(Priority::High),
+            "normal" => Some(Priority::Normal),
+            "low" => Some(Priority::Low),
+            _ => None,
+        }
+    }
+
+    /// 優先度の名前を返す。
+    pub fn name(&self) -> &'static str {
+        match self {
+            Priority::High => "high",
+            Priority::Normal => "normal",
+            Priority::Low => "low",
+        }
+    }
+}
+
+/// ディスクの管理用の情報
+/// ハッシュ計算には使わず、ディスクを見分けるために記録する。
+#[derive(Debug, Clone, Default)]
+pub struct DiskMetadata {
+    /// ディスクに貼ったラベルなどの名前
+    pub label: Option<String>,
+    /// ディスクのシリアル番号
+    pub serial: Option<String>,
+    /// ディスクを購入した日付
+    pub purchased: Option<NaiveDate>,
+    /// メモ
+    pub notes: Option<String>,
+    /// diskファイルを作成した日付
+    pub created: Option<NaiveDate>,
+    /// ディスクの容量のバイト数
+    pub capacity: Option<u64>,
+}
+
+impl DiskMetadata {
+    /// "キー=値"の形式の設定が管理用の情報であれば取り込む。
+    /// 管理用の情報のキーでなければfalseを返す。
+    /// 同じキーを2回指定した場合はエラーにする。
+    pub fn parse_setting(&mut self, key: &str, value: &str) -> Result<bool, &'static str> {
+        let already_set = match key {
+            "label" => self.label.is_some(),
+            "serial" => self.serial.is_some(),
+            "purchased" => self.purchased.is_some(),
+            "notes" => self.notes.is_some(),
+            "created" => self.created.is_some(),
+            "capacity" => self.capacity.is_some(),
+            _ => false,
+        };
+        if already_set {
+            return Err("同じキーが2回指定されています。");
+        }
+        match key {
+            "label" => self.label = Some(value.to_string()),
+            "serial" => self.serial = Some(value.to_string()),
+            "purchased" => self.purchased = Some(parse_date(value)?),
+            "notes" => self.notes = Some(value.to_string()),
+            "created" => self.created = Some(parse_date(value)?),
+            "capacity" => {
+                self.capacity = Some(
+                    value
+                        .parse::<u64>()
+                        .map_err(|_| "容量はバイト数で指定してください。")?,
+                );
+            }
+            _ => return Ok(false),
+        }
+        Ok(true)
+    }
+
+    /// 管理用の情報を、diskファイルと同じ"キー=値"の形式の行にする。
+    pub fn to_setting_lines(&self) -> String {
+        let mut lines = String::new();
+        let settings = [
+            ("label", self.label.clone()),
+            ("serial", self.serial.clone()),
+            (
+                "purchased",
+                self.purchased
+                    .map(|date| date.format(DATE_FORMAT).to_string()),
+            ),
+            ("notes", self.notes.clone()),
+            (
+                "created",
+                self.created
+                    .map(|date| date.format(DATE_FORMAT).to_string()),
+            ),
+            (
+                "capacity",
+                self.capacity.map(|capacity| capacity.to_string()),
+            ),
+        ];
+        for (key, value) in settings {
+            if let Some(value) = value {
+                lines.push_str(format!("{}={}\n", key, value).as_str());
+            }
+        }
+        lines
+    }
+
+    /// ログに出力する、ディスクを見分けるための情報を返す。
+    /// ラベル、シリアル番号、購入日のいずれもなければNoneを返す。
+    pub fn summary(&self) -> Option<String> {
+        let mut items = vec![];
+        if let Some(label) = &self.label {
+            items.push(format!("{}: {}", messages::translate("ラベル"), label));
+        }
+        if let Some(serial) = &self.serial {
+            items.push(format!(
+                "{}: {}",
+                messages::translate("シリアル番号"),
+                serial
+            ));
+        }
+        if let Some(purchased) = &self.purchased {
+            items.push(format!(
+                "{}: {}",
+                messages::translate("購入日"),
+                purchased.format(DATE_FORMAT)
+            ));
+        }
+        if items.len() == 0 {
+            None
+        } else {
+            Some(items.join(" / "))
+        }
+    }
+}
+
+/// diskファイルに記録する日付をパースする。
+fn parse_date(value: &str) -> Result<NaiveDate, &'static str> {
+    NaiveDate::parse_from_str(value, DATE_FORMAT)
+        .map_err(|_| "日付はYYYY-MM-DDの形式で指定してください。")
+}
+
+/// サブルート
+/// 1つのディスクが複数のマウントポイントにまたがる場合の2つ目以降のルート。
+/// 配下のファイルはプレフィックスを付けたパスでハッシュファイルに記録する。
+#[derive(Debug, Clone)]
+pub struct SubRoot {
+    pub prefix: String,
+    pub path: PathBuf,
+}
+
+/// diskファイルに記録する日付の形式
+pub const DATE_FORMAT: &str = "%Y-%m-%d";
+
 /// ディスクIDの正規表現パターン
 pub static DISK_ID_PATTERN: Lazy<Regex> = Lazy::new(|| Regex::new(r"^[A-Z]\d+$").unwrap());
 
 /// ディスク情報一覧を作成する。
-pub fn list_disk_info(
-    current_folder: &Path,
-    disk_roots: &Vec<PathBuf>,
-) -> Result<Vec<DiskInfo>, Errors> {
-    let disk_files = list_disk_files(current_folder, &disk_roots)?;
+pub fn list_disk_info(run_options: &RunOptions) -> Result<Vec<DiskInfo>, Errors> {
+    let disk_files = list_disk_files(
+        run_options.current_folder(),
+        run_options.disk_roots(),
+        run_options.discovery_folders(),
+    )?;
 
     let mut errors = Vec::<Error>::new();
     let (disk_files, missing_disk_files) = divide_disk_files_by_existence(disk_files);
     add_missing_disk_file_errors(&mut errors, &missing_disk_files);
-    let (mut disk_info_list, mut load_errors) = load_disk_info_list(&disk_files);
+    let (disk_info_list, mut load_errors) = load_disk_info_list(&disk_files);
     errors.append(&mut load_errors);
+    let mut disk_info_list = select_disk_info(
+        disk_info_list,
+        run_options.only_disk_ids(),
+        run_options.excluded_disk_ids(),
+    );
+    add_duplicate_disk_id_errors(&mut errors, &disk_info_list);
     raise_errors(errors)?;
+    if disk_info_list.len() == 0 {
+        return Err(log::make_error!("処理対象のディスクがありません。").as_errors());
+    }
 
+    // 発行済みのディスクIDと照合する
+    // 読み取り専用モードと一覧だけを出力する場合はレジストリを更新しない
+    registry::check_and_register(
+        run_options.registry_filepath(),
+        &disk_info_list,
+        !run_options.read_only() && !run_options.dry_run(),
+    )?;
+
+    // 優先度の高いディスクから処理する
+    disk_info_list.sort_by_key(|disk_info| disk_info.priority);
     index_disk_info(&mut disk_info_list);
     Ok(disk_info_list)
 }
 
+/// diskファイルを読み込み、見つかった問題を全て返す。
+/// ディスクレジストリとの照合も行うが、レジストリは更新しない。
+pub fn check_disk_files(run_options: &RunOptions) -> Vec<Error> {
+    let disk_files = match list_disk_files(
+        run_options.current_folder(),
+        run_options.disk_roots(),
+        run_options.discovery_folders(),
+    ) {
+        Ok(disk_files) => disk_files,
+        Err(errors) => return errors,
+    };
+
+    let mut errors = Vec::<Error>::new();
+    let (disk_files, missing_disk_files) = divide_disk_files_by_existence(disk_files);
+    add_missing_disk_file_errors(&mut errors, &missing_disk_files);
+    let (disk_info_list, mut load_errors) = load_disk_info_list(&disk_files);
+    errors.append(&mut load_errors);
+    add_duplicate_disk_id_errors(&mut errors, &disk_info_list);
+    if errors.len() == 0 {
+        if let Err(mut registry_errors) =
+            registry::check_and_register(run_options.registry_filepath(), &disk_info_list, false)
+        {
+            errors.append(&mut registry_errors);
+        }
+    }
+
+    errors
+}
+
 /// diskファイル一覧を作成する。
 fn list_disk_files(
     current_folder: &Path,
     disk_roots: &Vec<PathBuf>,
+    discovery_folders: &Vec<PathBuf>,
 ) -> Result<Vec<PathBuf>, Errors> {
-    if disk_roots.len() > 0 {
-        Ok(list_disk_files_by(disk_roots))
+    if disk_roots.len() > 0 || discovery_folders.len() > 0 {
+        let mut disk_files = list_disk_files_by(disk_roots);
+        for discovery_folder in discovery_folders {
+            let mut discovered_disk_files = discover_disk_files(discovery_folder.as_path());
+            log::info(
+                format!(
+                    "{}個のdiskファイルが見つかりました。: {}",
+                    discovered_disk_files.len(),
+                    discovery_folder.to_str().unwrap()
+                )
+                .as_str(),
+            );
+            disk_files.append(&mut discovered_disk_files);
+        }
+        Ok(disk_files)
     } else {
         match find_disk_file(current_folder) {
             Some(disk_file) => Ok(vec![disk_file]),
@@ -57,6 +298,49 @@ fn list_disk_files_by(disk_roots: &Vec<PathBuf>) -> Vec<PathBuf> {
         .collect()
 }
 
+/// 指定されたフォルダ配下のdiskファイルを深さに関係なく探して一覧にする。
+/// diskファイルが見つかったフォルダはディスクルートとみなし、それより下は探さない。
+fn discover_disk_files(folder: &Path) -> Vec<PathBuf> {
+    let mut disk_files = vec![];
+    discover_disk_files_recursive(&mut disk_files, folder);
+    disk_files.sort();
+    disk_files
+}
+
+/// 指定されたフォルダ配下のdiskファイルを一覧に追加する。
+fn discover_disk_files_recursive(disk_files: &mut Vec<PathBuf>, folder: &Path) {
+    // このフォルダにディスクIDが書かれたdiskファイルがあればディスクルートとする
+    let disk_file = folder.join("disk");
+    if disk_file.is_file() {
+        match fs::read_to_string(disk_file.as_path()) {
+            Ok(contents) if read_disk_id(&contents).is_some() => {
+                disk_files.push(disk_file);
+                return;
+            }
+            _ => log::warn(
+                format!(
+                    "ディスクIDが書かれていないdiskファイルを無視します。: {}",
+                    disk_file.to_str().unwrap()
+                )
+                .as_str(),
+            ),
+        }
+    }
+
+    // 読み込めないフォルダとシンボリックリンクは探さない
+    if let Ok(dir_entry_iter) = folder.read_dir() {
+        for dir_entry_result in dir_entry_iter {
+            if let Ok(dir_entry) = dir_entry_result {
+                if let Ok(file_type) = dir_entry.file_type() {
+                    if file_type.is_dir() {
+                        discover_disk_files_recursive(disk_files, dir_entry.path().as_path());
+                    }
+                }
+            }
+        }
+    }
+}
+
 /// カレントフォルダから開始して、上位フォルダに遡りながらdiskファイルを探す。
 fn find_disk_file(current_folder: &Path) -> Option<PathBuf> {
     // 編集のためコピーする
@@ -95,6 +379,53 @@ fn add_missing_disk_file_errors(errors: &mut Vec<Error>, missing_disk_files: &Ve
     }
 }
 
+/// 指定されたパスを含むディスクのディスク情報を返す。
+/// パスから上のフォルダに向かってdiskファイルを探す。
+pub fn find_disk_containing(path: &Path) -> Result<DiskInfo, Errors> {
+    let path = match fs::canonicalize(path) {
+        Ok(path) => path,
+        Err(error) => {
+            return Err(log::make_error!(
+                "パスを絶対パスにできませんでした。: {}",
+                path.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors())
+        }
+    };
+
+    for folder in path.ancestors() {
+        let disk_file = folder.join("disk");
+        if disk_file.is_file() {
+            return load_disk_info(disk_file.as_path()).map_err(|error| error.as_errors());
+        }
+    }
+
+    Err(log::make_error!(
+        "ディスクの中のパスではありません。: {}",
+        path.to_str().unwrap()
+    )
+    .as_errors())
+}
+
+/// 指定されたパスを含むサブルートを持つディスクのディスク情報を、登録済みのディスクから探して返す。
+/// サブルートにはdiskファイルがないため、登録済みのルートのdiskファイルを読み込んでサブルートを調べる。
+pub fn find_disk_with_sub_root_containing(
+    path: &Path,
+    registry: &DiskRegistry,
+) -> Option<DiskInfo> {
+    let path = fs::canonicalize(path).ok()?;
+    registry
+        .roots()
+        .filter_map(|root| load_disk_info(root.join("disk").as_path()).ok())
+        .find(|disk_info| {
+            disk_info.sub_roots.iter().any(|sub_root| {
+                fs::canonicalize(&sub_root.path)
+                    .map_or(false, |sub_root_path| path.starts_with(sub_root_path))
+            })
+        })
+}
+
 /// diskファイルを読み込んでディスク情報一覧を作成する。
 /// 読み込みに失敗したdiskファイルについてはディスク情報は作成せず、エラー情報を一覧に追加する。
 fn load_disk_info_list(disk_files: &Vec<PathBuf>) -> (Vec<DiskInfo>, Vec<Error>) {
@@ -119,22 +450,7 @@ fn load_disk_info(disk_file: &Path) -> Result<DiskInfo, Error> {
         Ok(disk_file_bytes) => {
             // UTF-8でデコードする
             match String::from_utf8(disk_file_bytes) {
-                Ok(disk_file_contents) => {
-                    let disk_file_contents = disk_file_contents.trim().to_string();
-
-                    if !DISK_ID_PATTERN.is_match(&disk_file_contents) {
-                        return Err(log::make_error!(
-                            "diskファイルの内容が不正です。: {}",
-                            disk_file.to_str().unwrap()
-                        ));
-                    }
-
-                    Ok(DiskInfo {
-                        index: 0,
-                        id: disk_file_contents,
-                        root_path: disk_file.parent().unwrap().to_path_buf(),
-                    })
-                }
+                Ok(disk_file_contents) => parse_disk_file(disk_file, &disk_file_contents),
                 Err(error) => Err(log::make_error!(
                     "diskファイルの内容が不正です。: {}",
                     disk_file.to_str().unwrap()
@@ -150,6 +466,194 @@ fn load_disk_info(disk_file: &Path) -> Result<DiskInfo, Error> {
     }
 }
 
+/// diskファイルの内容からディスク情報を作成する。
+/// 1行目がディスクID、2行目以降は"キー=値"の形式の設定とする。
+fn parse_disk_file(disk_file: &Path, disk_file_contents: &str) -> Result<DiskInfo, Error> {
+    let root_path = disk_file.parent().unwrap().to_path_buf();
+
+    let disk_id = match read_disk_id(disk_file_contents) {
+        Some(disk_id) => disk_id.to_string(),
+        None => {
+            return Err(log::make_error!(
+                "diskファイルの内容が不正です。: {}",
+                disk_file.to_str().unwrap()
+            ))
+        }
+    };
+
+    let mut sub_roots: Vec<SubRoot> = vec![];
+    let mut priority = Priority::Normal;
+    let mut on_complete: Vec<CompletionAction> = vec![];
+    let mut metadata = DiskMetadata::default();
+
+    for (line_number, line) in setting_lines(disk_file_contents) {
+        let invalid_line = |message: &str| {
+            log::make_error!(
+                "diskファイルの内容が不正です。: {}: {}行目: {}",
+                disk_file.to_str().unwrap(),
+                line_number,
+                message
+            )
+        };
+
+        let (key, value) = match line.split_once('=') {
+            Some((key, value)) => (key.trim(), value.trim()),
+            None => return Err(invalid_line("\"キー=値\"の形式ではありません。")),
+        };
+
+        match key {
+            "root" => {
+                let sub_root = parse_sub_root(root_path.as_path(), value).map_err(invalid_line)?;
+                if sub_roots
+                    .iter()
+                    .any(|other| other.prefix == sub_root.prefix)
+                {
+                    return Err(invalid_line("サブルートのプレフィックスが重複しています。"));
+                }
+                if !sub_root.path.is_dir() {
+                    return Err(invalid_line("サブルートのフォルダがありません。"));
+                }
+                sub_roots.push(sub_root);
+            }
+            "priority" => {
+                priority = Priority::from_name(value).ok_or_else(|| {
+                    invalid_line("優先度はhigh、normal、lowのいずれかを指定してください。")
+                })?;
+            }
+            "on-complete" => {
+                on_complete.push(CompletionAction::parse(value).map_err(invalid_line)?);
+            }
+            _ => {
+                if !metadata.parse_setting(key, value).map_err(invalid_line)? {
+                    return Err(invalid_line("不明なキーです。"));
+                }
+            }
+        }
+    }
+
+    Ok(DiskInfo {
+        index: 0,
+        id: disk_id,
+        root_path,
+        sub_roots,
+        priority,
+        on_complete,
+        metadata,
+    })
+}
+
+/// diskファイルの内容からディスクIDを取り出す。
+/// ディスクIDの形式でなければNoneを返す。
+pub fn read_disk_id(disk_file_contents: &str) -> Option<&str> {
+    let disk_id = disk_file_contents
+        .lines()
+        .map(|line| line.trim())
+        .find(|line| line.len() > 0)?;
+    if DISK_ID_PATTERN.is_match(disk_id) {
+        Some(disk_id)
+    } else {
+        None
+    }
+}
+
+/// diskファイルの2行目以降の設定行を行番号とともに一覧にする。
+/// 空白行と#から始まるコメント行は除く。
+fn setting_lines(disk_file_contents: &str) -> Vec<(usize, &str)> {
+    disk_file_contents
+        .lines()
+        .enumerate()
+        .map(|(i, line)| (i + 1, line.trim()))
+        .filter(|(_, line)| line.len() > 0)
+        .skip(1)
+        .filter(|(_, line)| !line.starts_with('#'))
+        .collect()
+}
+
+/// "プレフィックス パス"の形式の値からサブルートを作成する。
+/// パスが相対パスであればディスクルートからの相対パスとする。
+/// ハッシュファイルのパスが重ならないよう、ディスクルート直下と同じ名前のプレフィックスと、
+/// ディスクルートの中のサブルートはエラーにする。
+fn parse_sub_root(root_path: &Path, value: &str) -> Result<SubRoot, &'static str> {
+    match value.split_once(char::is_whitespace) {
+        Some((prefix, path)) => {
+            let path = path.trim();
+            if prefix.contains('/') || prefix.contains('\\') {
+                return Err("サブルートのプレフィックスにパス区切り文字は使えません。");
+            }
+            if root_path.join(prefix).symlink_metadata().is_ok() {
+                return Err(
+                    "サブルートのプレフィックスがディスクルート直下のファイルかフォルダと同じ名前です。",
+                );
+            }
+            let path = root_path.join(path);
+            if is_inside_folder(path.as_path(), root_path) {
+                return Err("サブルートがディスクルートの中にあります。");
+            }
+            Ok(SubRoot {
+                prefix: prefix.to_string(),
+                path,
+            })
+        }
+        None => Err("サブルートは\"プレフィックス パス\"の形式で指定してください。"),
+    }
+}
+
+/// パスがフォルダかその中を指しているかを返す。
+/// シンボリックリンクや".."を解決できればそれを解決して比べる。
+fn is_inside_folder(path: &Path, folder: &Path) -> bool {
+    match (fs::canonicalize(path), fs::canonicalize(folder)) {
+        (Ok(path), Ok(folder)) => path.starts_with(folder),
+        _ => path.starts_with(folder),
+    }
+}
+
+/// コマンドラインで指定されたディスクIDで処理するディスクを選択する。
+/// 見つからなかったディスクIDは警告を出力する。
+fn select_disk_info(
+    disk_info_list: Vec<DiskInfo>,
+    only_disk_ids: &Vec<String>,
+    excluded_disk_ids: &Vec<String>,
+) -> Vec<DiskInfo> {
+    for disk_id in only_disk_ids.iter().chain(excluded_disk_ids.iter()) {
+        if !disk_info_list
+            .iter()
+            .any(|disk_info| &disk_info.id == disk_id)
+        {
+            log::warn(format!("指定されたディスク{}が見つかりません。", disk_id).as_str());
+        }
+    }
+
+    disk_info_list
+        .into_iter()
+        .filter(|disk_info| only_disk_ids.len() == 0 || only_disk_ids.contains(&disk_info.id))
+        .filter(|disk_info| !excluded_disk_ids.contains(&disk_info.id))
+        .collect()
+}
+
+/// 同じディスクIDのディスクが複数あればエラー情報を一覧に追加する。
+/// 同じハッシュファイルに複数のディスクの内容が混ざるのを防ぐため。
+fn add_duplicate_disk_id_errors(errors: &mut Vec<Error>, disk_info_list: &Vec<DiskInfo>) {
+    let mut roots_by_id = BTreeMap::<&str, Vec<&Path>>::new();
+    for disk_info in disk_info_list {
+        roots_by_id
+            .entry(disk_info.id.as_str())
+            .or_default()
+            .push(disk_info.root_path.as_path());
+    }
+
+    for (disk_id, roots) in roots_by_id {
+        if roots.len() > 1 {
+            let roots: Vec<&str> = roots.iter().map(|root| root.to_str().unwrap()).collect();
+            let error = log::make_error!(
+                "ディスクID{}が複数のディスクで使われています。: {}",
+                disk_id,
+                roots.join(", ")
+            );
+            errors.push(error);
+        }
+    }
+}
+
 /// エラー情報一覧が空なら何もしない。
 /// 空でなければエラーを発生させる。
 fn raise_errors(errors: Vec<Error>) -> Result<(), Errors> {
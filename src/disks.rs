@@ -0,0 +1,157 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::SystemTime;
+
+use chrono::{DateTime, Local};
+
+use crate::atomic_write;
+use crate::disk::{DiskInfo, DiskMetadata};
+use crate::hash_file;
+use crate::last_verified;
+use crate::log::{self, Errors};
+use crate::merged_hash_file;
+use crate::messages;
+
+/// 一覧に出力する日時の形式
+const LISTED_TIME_FORMAT: &str = "%Y-%m-%d %H:%M";
+
+/// ディスクの管理用の情報の写しを保存するフォルダを返す。
+fn disks_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("disks")
+}
+
+/// diskファイルの管理用の情報を出力フォルダに写して保存する。
+/// 取り外したディスクの情報も一覧やレポートに出力できるよう、ハッシュ計算と検証のたびに保存し直す。
+/// 管理用の情報があればログにも出力する。
+pub fn record_metadata(output_folder: &Path, disk_info: &DiskInfo) -> Result<(), Errors> {
+    if let Some(summary) = disk_info.metadata.summary() {
+        log::info(format!("{}: {}", &disk_info.id, summary).as_str());
+    }
+
+    let metadata_filepath = disks_folder(output_folder).join(&disk_info.id);
+    let contents = disk_info.metadata.to_setting_lines();
+    // 管理用の情報がなく前回の写しもなければ何も作成しない
+    if contents.len() == 0 && !metadata_filepath.is_file() {
+        return Ok(());
+    }
+    if let Err(error) = fs::create_dir_all(metadata_filepath.parent().unwrap()) {
+        return Err(log::make_error!(
+            "{}: ディスクの情報の保存先を作成できませんでした。",
+            &disk_info.id
+        )
+        .with(&error)
+        .as_errors());
+    }
+    match atomic_write::write(metadata_filepath.as_path(), contents) {
+        Ok(_) => Ok(()),
+        Err(error) => Err(log::make_error!(
+            "{}: ディスクの情報を保存できませんでした。",
+            &disk_info.id
+        )
+        .with(&error)
+        .as_errors()),
+    }
+}
+
+/// 出力フォルダに保存したディスクの管理用の情報を読み込む。
+/// 保存されていなければ空の情報を返す。
+pub fn load_metadata(output_folder: &Path, disk_id: &str) -> Result<DiskMetadata, Errors> {
+    let metadata_filepath = disks_folder(output_folder).join(disk_id);
+    let mut metadata = DiskMetadata::default();
+    if !metadata_filepath.is_file() {
+        return Ok(metadata);
+    }
+
+    let contents = match fs::read_to_string(metadata_filepath.as_path()) {
+        Ok(contents) => contents,
+        Err(error) => {
+            return Err(
+                log::make_error!("{}: ディスクの情報を読み込めませんでした。", disk_id)
+                    .with(&error)
+                    .as_errors(),
+            )
+        }
+    };
+    for (i, line) in contents.lines().enumerate() {
+        let parsed = match line.split_once('=') {
+            Some((key, value)) => metadata.parse_setting(key, value),
+            None => Err("\"キー=値\"の形式ではありません。"),
+        };
+        if !matches!(parsed, Ok(true)) {
+            return log::with_line_number(
+                Err(log::make_error!("ディスクの情報の形式が不正です。").as_errors()),
+                metadata_filepath.as_path(),
+                i + 1,
+            );
+        }
+    }
+
+    Ok(metadata)
+}
+
+/// 出力フォルダのハッシュファイルがある全てのディスクを一覧にして出力する。
+/// ディスクごとに、管理用の情報、ハッシュファイルの行数、最後に計算した日時、最後に検証した日時を出力する。
+/// 最後に計算した日時はハッシュファイル、最後に検証した日時は検証日時の記録の更新日時とする。
+pub fn list_disks(output_folders: &[&Path]) -> Result<(), Errors> {
+    let mut hash_filepaths = vec![];
+    for output_folder in output_folders {
+        if output_folder.is_dir() {
+            hash_filepaths.append(&mut merged_hash_file::find_hash_files(output_folder)?);
+        }
+    }
+    if hash_filepaths.len() == 0 {
+        return Err(log::make_error!("ハッシュファイルがありません。").as_errors());
+    }
+    hash_filepaths.sort_by(|a, b| a.file_name().cmp(&b.file_name()));
+
+    // 読み込めないディスクがあれば何も出力しない
+    let mut rows = vec![];
+    for hash_filepath in hash_filepaths.iter() {
+        let output_folder = hash_filepath.parent().unwrap();
+        let disk_id = hash_filepath.file_name().unwrap().to_str().unwrap();
+        let metadata = load_metadata(output_folder, disk_id)?;
+        let number_of_entries = hash_file::load_hash_info(hash_filepath.as_path())?.len();
+        let verified_filepath = last_verified::verified_filepath(output_folder, disk_id);
+        rows.push(format!(
+            "{}\t{}\t{}\t{}\t{}\t{}\t{}\t{}",
+            disk_id,
+            metadata.label.as_deref().unwrap_or("-"),
+            metadata.serial.as_deref().unwrap_or("-"),
+            metadata
+                .purchased
+                .map_or("-".to_string(), |date| date.to_string()),
+            number_of_entries,
+            modified_time_of(hash_filepath.as_path()),
+            modified_time_of(verified_filepath.as_path()),
+            metadata.notes.as_deref().unwrap_or("-")
+        ));
+    }
+
+    println!(
+        "{}",
+        messages::translate(
+            "ディスクID\tラベル\tシリアル番号\t購入日\t行数\t最後の計算\t最後の検証\tメモ"
+        )
+    );
+    for row in rows {
+        println!("{}", row);
+    }
+
+    Ok(())
+}
+
+/// ファイルの更新日時を一覧に出力する形式で返す。
+/// ファイルがなければ"-"を返す。
+fn modified_time_of(filepath: &Path) -> String {
+    match fs::metadata(filepath).and_then(|metadata| metadata.modified()) {
+        Ok(modified) => format_time(modified),
+        Err(_) => "-".to_string(),
+    }
+}
+
+/// 日時を一覧に出力する形式にする。
+fn format_time(time: SystemTime) -> String {
+    DateTime::<Local>::from(time)
+        .format(LISTED_TIME_FORMAT)
+        .to_string()
+}
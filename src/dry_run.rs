@@ -0,0 +1,109 @@
+use std::path::Path;
+
+use serde_json::json;
+
+use crate::calc::{self, DiskTarget};
+use crate::log::{self, Errors};
+use crate::mismatch_report::OutputFormat;
+use crate::target_file;
+
+/// ハッシュ計算で計算するファイルとバイト数を標準出力に出力する。
+/// ディスクの探索、フィルター、ハッシュファイルとの照合は実際のハッシュ計算と同じく行うが、
+/// ファイルの内容は読み込まず、ハッシュファイルも変更しない。
+/// 出力形式にJSONが指定されればディスクごとの一覧と合計を1つのJSONで出力する。
+pub fn print_files_to_hash(
+    disk_targets: &[DiskTarget],
+    scope: Option<&Path>,
+    alternate_streams: bool,
+    output_format: Option<OutputFormat>,
+) -> Result<(), Errors> {
+    let mut disk_records = vec![];
+    let mut total_files = 0;
+    let mut total_size = 0;
+
+    for disk_target in disk_targets {
+        let disk_id = &disk_target.disk_info.id;
+        // 封印されたディスクは検証だけを行うので計算するファイルはない
+        let target_files = if disk_target.sealed {
+            log::info(format!("{}: 封印されたディスクは検証だけを行います。", disk_id).as_str());
+            vec![]
+        } else {
+            calc::list_files_to_hash(
+                &disk_target.disk_info,
+                disk_target.output_folder.as_path(),
+                &disk_target.filters,
+                scope,
+                alternate_streams,
+            )?
+        };
+        let disk_size = target_file::calc_total_size(&target_files);
+
+        match output_format {
+            Some(OutputFormat::Json) => {
+                let files: Vec<serde_json::Value> = target_files
+                    .iter()
+                    .map(|target_file| {
+                        json!({
+                            "path": target_file.normalized_path().to_str().unwrap(),
+                            "size": target_file.size,
+                        })
+                    })
+                    .collect();
+                disk_records.push(json!({
+                    "disk": disk_id,
+                    "files": files,
+                    "number_of_files": target_files.len(),
+                    "total_size": disk_size,
+                }));
+            }
+            _ => {
+                for target_file in target_files.iter() {
+                    println!(
+                        "{}:{}\t{}",
+                        disk_id,
+                        target_file.normalized_path().to_str().unwrap(),
+                        target_file.size
+                    );
+                }
+            }
+        }
+        log::info(
+            format!(
+                "{}: ハッシュ計算するファイルは{}件 / {:.2}GBです。",
+                disk_id,
+                target_files.len(),
+                to_gigabytes(disk_size)
+            )
+            .as_str(),
+        );
+
+        total_files += target_files.len();
+        total_size += disk_size;
+    }
+
+    if let Some(OutputFormat::Json) = output_format {
+        println!(
+            "{}",
+            json!({
+                "disks": disk_records,
+                "number_of_files": total_files,
+                "total_size": total_size,
+            })
+        );
+    }
+    log::info(
+        format!(
+            "ハッシュ計算するファイルは合計{}件 / {:.2}GBです。ファイルの読み込みとハッシュファイルの更新は行いませんでした。",
+            total_files,
+            to_gigabytes(total_size)
+        )
+        .as_str(),
+    );
+
+    Ok(())
+}
+
+/// バイト数をGB単位にする。
+fn to_gigabytes(size: u64) -> f64 {
+    size as f64 / (1u64 << 30) as f64
+}
@@ -0,0 +1,136 @@
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+
+use crate::hash_algorithm::Digest;
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::merged_hash_file;
+
+/// 同じハッシュのファイルの組
+struct DuplicateSet {
+    /// ハッシュ
+    hash: Digest,
+    /// ファイルのバイト数
+    /// 組のファイルのうち1つでもバイト数が記録されていればそのバイト数を使う。
+    size: Option<u64>,
+    /// ディスクIDとファイルパス
+    files: Vec<(String, PathBuf)>,
+}
+
+impl DuplicateSet {
+    /// 1つだけを残して削除した場合に空けられる容量を返す。
+    fn reclaimable_size(&self) -> u64 {
+        self.size.unwrap_or(0) * (self.files.len() as u64 - 1)
+    }
+}
+
+/// グループごとに、ディスクをまたいで同じハッシュのファイルの組を出力する。
+/// 組は空けられる容量の大きい順に、ハッシュ、バイト数、ファイル数の行に続けて"ディスクID:パス"の行を出力する。
+/// 空のファイルはどれも同じハッシュになるので対象にしない。
+pub fn report_duplicates(groups: &[(char, &Path)]) -> Result<(), Errors> {
+    // 集計できないグループがあれば何も出力しない
+    let mut group_sets = vec![];
+    for (group, output_folder) in groups {
+        group_sets.push((*group, find_duplicates(*group, output_folder)?));
+    }
+
+    for (group, duplicate_sets) in group_sets.iter() {
+        for duplicate_set in duplicate_sets.iter() {
+            let size = match duplicate_set.size {
+                Some(size) => size.to_string(),
+                None => "-".to_string(),
+            };
+            println!(
+                "{}\t{}\t{}",
+                hex::encode(duplicate_set.hash.to_vec()),
+                size,
+                duplicate_set.files.len()
+            );
+            for (disk_id, target_filepath) in duplicate_set.files.iter() {
+                println!("\t{}:{}", disk_id, target_filepath.to_str().unwrap());
+            }
+        }
+
+        let reclaimable_size: u64 = duplicate_sets
+            .iter()
+            .map(|duplicate_set| duplicate_set.reclaimable_size())
+            .sum();
+        log::info(
+            format!(
+                "グループ{}に同じ内容のファイルの組が{}組あります。重複を削除すると{:.2}GB空けられます。",
+                group,
+                duplicate_sets.len(),
+                reclaimable_size as f64 / (1u64 << 30) as f64
+            )
+            .as_str(),
+        );
+        let number_of_unknown_size = duplicate_sets
+            .iter()
+            .filter(|duplicate_set| duplicate_set.size.is_none())
+            .count();
+        if number_of_unknown_size > 0 {
+            log::warn(
+                format!(
+                    "グループ{}の{}組はバイト数が記録されていないため、空けられる容量に含めていません。",
+                    group, number_of_unknown_size
+                )
+                .as_str(),
+            );
+        }
+    }
+
+    Ok(())
+}
+
+/// グループのハッシュファイルを読み込んで、同じハッシュのファイルの組を一覧にする。
+/// 組は空けられる容量の大きい順、同じならハッシュの順に並べ、組のファイルはディスクIDとパスの順に並べる。
+fn find_duplicates(group: char, output_folder: &Path) -> Result<Vec<DuplicateSet>, Errors> {
+    let mut duplicate_map: HashMap<Digest, DuplicateSet> = HashMap::new();
+    let mut number_of_hash_files = 0;
+
+    for hash_filepath in merged_hash_file::find_hash_files(output_folder)? {
+        let disk_id = hash_filepath.file_name().unwrap().to_str().unwrap();
+        if !disk_id.starts_with(group) {
+            continue;
+        }
+        number_of_hash_files += 1;
+        let stamp_map = hash_file::load_file_stamps(hash_filepath.as_path())?;
+        for (target_filepath, hash) in hash_file::load_hash_info(hash_filepath.as_path())? {
+            let size = stamp_map.get(&target_filepath).map(|stamp| stamp.size);
+            if size == Some(0) {
+                continue;
+            }
+            let duplicate_set = duplicate_map.entry(hash).or_insert(DuplicateSet {
+                hash,
+                size: None,
+                files: vec![],
+            });
+            if duplicate_set.size.is_none() {
+                duplicate_set.size = size;
+            }
+            duplicate_set
+                .files
+                .push((disk_id.to_string(), target_filepath));
+        }
+    }
+
+    if number_of_hash_files == 0 {
+        return Err(
+            log::make_error!("グループ{}のハッシュファイルがありません。", group).as_errors(),
+        );
+    }
+
+    let mut duplicate_sets: Vec<DuplicateSet> = duplicate_map
+        .into_values()
+        .filter(|duplicate_set| duplicate_set.files.len() > 1)
+        .collect();
+    for duplicate_set in duplicate_sets.iter_mut() {
+        duplicate_set.files.sort();
+    }
+    duplicate_sets.sort_by(|a, b| {
+        b.reclaimable_size()
+            .cmp(&a.reclaimable_size())
+            .then(a.hash.cmp(&b.hash))
+    });
+    Ok(duplicate_sets)
+}
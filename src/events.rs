@@ -0,0 +1,96 @@
+use std::fs::{File, OpenOptions};
+use std::io::Write;
+use std::path::Path;
+use std::sync::{Arc, Mutex};
+
+use serde_json::json;
+
+use crate::callbacks::{Callbacks, FileDone, FileFailure};
+use crate::clock;
+use crate::file_error::FileErrorCategory;
+use crate::log::{self, Errors};
+
+/// イベントログ
+/// ファイルごとの処理結果を1行1レコードのJSONで出力する。
+#[derive(Clone)]
+struct EventLog {
+    file: Arc<Mutex<File>>,
+}
+
+/// イベントログを開き、ファイルごとの処理結果を出力するコールバックを登録する。
+/// 出力先が指定されていなければ何も登録しない。
+pub fn add_event_log(
+    callbacks: Callbacks,
+    event_filepath: Option<&Path>,
+) -> Result<Callbacks, Errors> {
+    let event_log = match event_filepath {
+        Some(event_filepath) => EventLog::open(event_filepath)?,
+        None => return Ok(callbacks),
+    };
+
+    let error_event_log = event_log.clone();
+    Ok(callbacks
+        .on_file_done(move |event| event_log.record_success(event))
+        .on_error(move |event| error_event_log.record_error(event)))
+}
+
+impl EventLog {
+    /// イベントログを開く。
+    /// ファイルがすでにあれば追記する。
+    fn open(event_filepath: &Path) -> Result<EventLog, Errors> {
+        match OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(event_filepath)
+        {
+            Ok(file) => Ok(EventLog {
+                file: Arc::new(Mutex::new(file)),
+            }),
+            Err(error) => Err(log::make_error!(
+                "イベントログファイルを開けませんでした。: {}",
+                event_filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors()),
+        }
+    }
+
+    /// ハッシュを計算できたファイルのイベントを出力する。
+    fn record_success(&self, event: &FileDone) {
+        self.record(json!({
+            "time": clock::now().to_rfc3339(),
+            "disk": event.disk_id,
+            "path": event.path.to_str().unwrap(),
+            "result": "ok",
+            "duration_ms": clock::reported_duration(event.duration).as_millis() as u64,
+            "bytes": event.size,
+            "hash": hex::encode(event.hash.to_vec()),
+        }));
+    }
+
+    /// ハッシュを計算できなかったファイルのイベントを出力する。
+    /// 一覧にした後に削除されたファイルはエラーではなく消失として出力する。
+    fn record_error(&self, event: &FileFailure) {
+        self.record(json!({
+            "time": clock::now().to_rfc3339(),
+            "disk": event.disk_id,
+            "path": event.path.to_str().unwrap(),
+            "result": if event.category == FileErrorCategory::Vanished.name() { "vanished" } else { "error" },
+            "duration_ms": clock::reported_duration(event.duration).as_millis() as u64,
+            "category": event.category,
+            "error": event.error.to_string(),
+        }));
+    }
+
+    /// レコードを1行出力する。
+    /// 出力に失敗してもハッシュ計算は止めずに警告だけ出す。
+    fn record(&self, record: serde_json::Value) {
+        let mut line = record.to_string();
+        line.push('\n');
+
+        let mut file = self.file.lock().unwrap();
+        if let Err(error) = file.write_all(line.as_bytes()) {
+            log::warn(format!("イベントログに書き込めませんでした。: {}", error).as_str());
+        }
+    }
+}
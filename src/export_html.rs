@@ -0,0 +1,194 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use serde_json::json;
+
+use crate::atomic_write;
+use crate::clock;
+use crate::disk;
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::merged_hash_file;
+use crate::truncation;
+
+/// ページの雛形
+/// データとタイトルを埋め込んで1つのHTMLファイルにする。
+const PAGE_TEMPLATE: &str = r#"<!DOCTYPE html>
+<html lang="ja">
+<head>
+<meta charset="utf-8">
+<title>bcbc: {{TITLE}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+input { width: 40em; padding: 0.3em; }
+details { margin-left: 1.2em; }
+summary { cursor: pointer; }
+.file { margin-left: 2.4em; white-space: nowrap; }
+.hash { color: #888; font-family: monospace; }
+.size { color: #555; }
+#results div { white-space: nowrap; }
+</style>
+</head>
+<body>
+<h1>{{TITLE}}</h1>
+<p id="summary"></p>
+<p><input id="search" type="search" placeholder="パスかハッシュで検索"></p>
+<div id="results"></div>
+<div id="tree"></div>
+<script>
+const DATA = {{DATA}};
+const MAX_RESULTS = 500;
+
+function formatSize(size) {
+  if (size === null) return "";
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let value = size, unit = 0;
+  while (value >= 1024 && unit < units.length - 1) { value /= 1024; unit++; }
+  return (unit === 0 ? value : value.toFixed(2)) + units[unit];
+}
+
+function fileLine(file, fullPath) {
+  const div = document.createElement("div");
+  div.className = "file";
+  const name = fullPath ? (file.disk ? file.disk + ":" : "") + file.path : file.path.split("/").pop();
+  div.textContent = name + " ";
+  const size = document.createElement("span");
+  size.className = "size";
+  size.textContent = formatSize(file.size) + " ";
+  const hash = document.createElement("span");
+  hash.className = "hash";
+  hash.textContent = file.hash;
+  div.append(size, hash);
+  return div;
+}
+
+function buildTree() {
+  const root = { folders: {}, files: [], size: 0, count: 0 };
+  for (const file of DATA.files) {
+    const segments = (file.disk ? file.disk + "/" + file.path : file.path).split("/");
+    let node = root;
+    for (const segment of segments.slice(0, -1)) {
+      node.size += file.size || 0; node.count++;
+      node = node.folders[segment] = node.folders[segment] || { folders: {}, files: [], size: 0, count: 0 };
+    }
+    node.size += file.size || 0; node.count++;
+    node.files.push(file);
+  }
+  return root;
+}
+
+function renderNode(node, container) {
+  for (const name of Object.keys(node.folders).sort()) {
+    const child = node.folders[name];
+    const details = document.createElement("details");
+    const summary = document.createElement("summary");
+    summary.textContent = name + "/ (" + child.count + "ファイル " + formatSize(child.size) + ")";
+    details.append(summary);
+    // 開いたときに初めて中身を作る
+    details.addEventListener("toggle", () => {
+      if (details.open && details.childElementCount === 1) renderNode(child, details);
+    });
+    container.append(details);
+  }
+  for (const file of node.files) container.append(fileLine(file, false));
+}
+
+const tree = buildTree();
+document.getElementById("summary").textContent =
+  tree.count + "ファイル " + formatSize(tree.size) + " / 作成日時 " + DATA.created;
+renderNode(tree, document.getElementById("tree"));
+
+document.getElementById("search").addEventListener("input", (event) => {
+  const keyword = event.target.value.trim().toLowerCase();
+  const results = document.getElementById("results");
+  results.replaceChildren();
+  document.getElementById("tree").hidden = keyword.length > 0;
+  if (keyword.length === 0) return;
+  const matched = DATA.files.filter((file) =>
+    file.path.toLowerCase().includes(keyword) || file.hash.startsWith(keyword));
+  for (const file of matched.slice(0, MAX_RESULTS)) results.append(fileLine(file, true));
+  const count = document.createElement("p");
+  count.textContent = matched.length + "件" + (matched.length > MAX_RESULTS ? "（先頭" + MAX_RESULTS + "件を表示）" : "");
+  results.prepend(count);
+});
+</script>
+</body>
+</html>
+"#;
+
+/// ディスクかグループのハッシュファイルを、ブラウザーで閲覧できる1つのHTMLファイルに出力する。
+/// ファイルサイズは前回のハッシュ計算で記録したものを使う。
+pub fn export_html(output_folder: &Path, target: &str, export_folder: &Path) -> Result<(), Errors> {
+    // ディスクIDならそのディスク、グループ名ならグループの全ディスクを出力する
+    let is_group = !disk::DISK_ID_PATTERN.is_match(target);
+    let mut hash_filepaths: Vec<PathBuf> = merged_hash_file::find_hash_files(output_folder)?
+        .into_iter()
+        .filter(|hash_filepath| {
+            let disk_id = hash_filepath.file_name().unwrap().to_str().unwrap();
+            disk_id == target || (is_group && disk_id.starts_with(target))
+        })
+        .collect();
+    hash_filepaths.sort();
+
+    if hash_filepaths.len() == 0 {
+        return Err(log::make_error!("{}のハッシュファイルがありません。", target).as_errors());
+    }
+
+    let mut files = vec![];
+    for hash_filepath in hash_filepaths.iter() {
+        let disk_id = hash_filepath.file_name().unwrap().to_str().unwrap();
+        let sizes = truncation::load_recorded_sizes(output_folder, disk_id)?;
+        let mut hash_info: Vec<(PathBuf, String)> =
+            hash_file::load_hash_info(hash_filepath.as_path())?
+                .into_iter()
+                .map(|(target_filepath, hash)| (target_filepath, hex::encode(hash.to_vec())))
+                .collect();
+        hash_info.sort();
+
+        for (target_filepath, hash) in hash_info {
+            files.push(json!({
+                // グループの場合はディスクごとに分けて表示する
+                "disk": if is_group { Some(disk_id) } else { None },
+                "path": target_filepath.to_str().unwrap(),
+                "hash": hash,
+                "size": sizes.get(&target_filepath),
+            }));
+        }
+    }
+
+    let data = json!({
+        "created": clock::now().format("%Y-%m-%d %H:%M:%S").to_string(),
+        "files": files,
+    });
+    // スクリプトの中に埋め込むため、終了タグと解釈される並びを避ける
+    let data = data.to_string().replace("</", "<\\/");
+    let page = PAGE_TEMPLATE
+        .replace("{{TITLE}}", target)
+        .replace("{{DATA}}", data.as_str());
+
+    if let Err(error) = fs::create_dir_all(export_folder) {
+        return Err(log::make_error!(
+            "出力先のフォルダを作成できませんでした。: {}",
+            export_folder.to_str().unwrap()
+        )
+        .with(&error)
+        .as_errors());
+    }
+    let page_filepath = export_folder.join(format!("{}.html", target));
+    if let Err(error) = atomic_write::write(page_filepath.as_path(), page) {
+        return Err(log::make_error!("HTMLファイルの出力に失敗しました。")
+            .with(&error)
+            .as_errors());
+    }
+
+    log::info(
+        format!(
+            "{}件のファイルをHTMLファイルに出力しました。: {}",
+            files.len(),
+            page_filepath.to_str().unwrap()
+        )
+        .as_str(),
+    );
+
+    Ok(())
+}
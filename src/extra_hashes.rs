@@ -0,0 +1,69 @@
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::hash_algorithm::{Digest, HashAlgorithm};
+use crate::hash_file;
+use crate::log::{self, Errors};
+
+/// 追加のアルゴリズムのハッシュファイルを保存するフォルダを返す。
+fn digests_folder(output_folder: &Path, algorithm: HashAlgorithm) -> PathBuf {
+    output_folder.join("digests").join(algorithm.name())
+}
+
+/// 追加のアルゴリズムで計算したハッシュを、アルゴリズムごとのハッシュファイルに記録する。
+/// 追加のハッシュファイルは`digests/アルゴリズム/ディスクID`に、ハッシュファイルと同じ形式で保存する。
+/// ハッシュファイルからなくなったファイルの行は削除し、ハッシュファイルと同じファイルだけを残す。
+/// 追加のハッシュがないファイルがあれば件数を出力する。
+pub fn record_extra_hashes(
+    output_folder: &Path,
+    disk_id: &str,
+    extra_algorithms: &[HashAlgorithm],
+    hashed: Vec<(PathBuf, Vec<Digest>)>,
+) -> Result<(), Errors> {
+    if extra_algorithms.len() == 0 {
+        return Ok(());
+    }
+    // 追記したハッシュファイルを整理する前にも呼ぶので、重複した行があっても警告しない
+    let (hash_info_map, _) =
+        hash_file::load_hash_info_with_duplicates(output_folder.join(disk_id).as_path())?;
+    let recorded: HashSet<&PathBuf> = hash_info_map.keys().collect();
+
+    for (index, algorithm) in extra_algorithms.iter().enumerate() {
+        let digests_folder = digests_folder(output_folder, *algorithm);
+        if let Err(error) = fs::create_dir_all(digests_folder.as_path()) {
+            return Err(log::make_error!(
+                "追加のハッシュファイルの保存先を作成できませんでした。: {}",
+                digests_folder.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors());
+        }
+        let digests_filepath = digests_folder.join(disk_id);
+        let mut digest_map: HashMap<PathBuf, Digest> = if digests_filepath.is_file() {
+            hash_file::load_hash_info(digests_filepath.as_path())?
+        } else {
+            HashMap::new()
+        };
+        for (target_filepath, digests) in hashed.iter() {
+            digest_map.insert(target_filepath.clone(), digests[index]);
+        }
+        digest_map.retain(|target_filepath, _| recorded.contains(target_filepath));
+
+        let number_of_missing = recorded.len() - digest_map.len();
+        hash_file::write_calculated_hash(digests_filepath.as_path(), *algorithm, digest_map)?;
+        if number_of_missing > 0 {
+            log::info(
+                format!(
+                    "{}: {}件のファイルは{}のハッシュがありません。追加のアルゴリズムは計算したファイルにだけ記録します。",
+                    disk_id,
+                    number_of_missing,
+                    algorithm.name()
+                )
+                .as_str(),
+            );
+        }
+    }
+
+    Ok(())
+}
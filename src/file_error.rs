@@ -0,0 +1,130 @@
+use std::collections::BTreeMap;
+use std::io;
+
+use crate::log::{self, Error};
+use crate::messages;
+
+/// ファイルごとのエラーの分類
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum FileErrorCategory {
+    /// 権限がない
+    PermissionDenied,
+    /// 読み込みに失敗した
+    IoError,
+    /// 一覧にした後に削除された
+    Vanished,
+    /// パスが長すぎる
+    PathTooLong,
+    /// 計算の途中で中断した
+    Interrupted,
+    /// その他
+    Other,
+}
+
+impl FileErrorCategory {
+    /// 入出力エラーの種類から分類を判定する。
+    pub fn of(error: &io::Error) -> FileErrorCategory {
+        match error.kind() {
+            io::ErrorKind::PermissionDenied => FileErrorCategory::PermissionDenied,
+            io::ErrorKind::NotFound => FileErrorCategory::Vanished,
+            io::ErrorKind::InvalidFilename => FileErrorCategory::PathTooLong,
+            _ => FileErrorCategory::IoError,
+        }
+    }
+
+    /// イベントログなどに出力する名前を返す。
+    pub fn name(&self) -> &'static str {
+        match self {
+            FileErrorCategory::PermissionDenied => "permission_denied",
+            FileErrorCategory::IoError => "io_error",
+            FileErrorCategory::Vanished => "vanished",
+            FileErrorCategory::PathTooLong => "path_too_long",
+            FileErrorCategory::Interrupted => "interrupted",
+            FileErrorCategory::Other => "other",
+        }
+    }
+
+    /// 名前から分類を返す。
+    pub fn from_name(name: &str) -> Option<FileErrorCategory> {
+        match name {
+            "permission_denied" => Some(FileErrorCategory::PermissionDenied),
+            "io_error" => Some(FileErrorCategory::IoError),
+            "vanished" => Some(FileErrorCategory::Vanished),
+            "path_too_long" => Some(FileErrorCategory::PathTooLong),
+            "interrupted" => Some(FileErrorCategory::Interrupted),
+            "other" => Some(FileErrorCategory::Other),
+            _ => None,
+        }
+    }
+
+    /// ログに出力する説明を返す。
+    pub fn label(&self) -> &'static str {
+        match self {
+            FileErrorCategory::PermissionDenied => "権限なし",
+            FileErrorCategory::IoError => "読み込み失敗",
+            FileErrorCategory::Vanished => "処理中に消失",
+            FileErrorCategory::PathTooLong => "パスが長すぎる",
+            FileErrorCategory::Interrupted => "中断",
+            FileErrorCategory::Other => "その他",
+        }
+    }
+}
+
+/// ファイルごとのエラー
+pub struct FileError {
+    pub category: FileErrorCategory,
+    pub error: Error,
+}
+
+impl FileError {
+    /// 入出力エラーからファイルごとのエラーを作成する。
+    pub fn from_io(message: &str, target_filepath: &str, error: &io::Error) -> FileError {
+        FileError {
+            category: FileErrorCategory::of(error),
+            error: log::make_error!("{}: {}", message, target_filepath).with(error),
+        }
+    }
+
+    /// ファイルの途中で計算を中断したことを表すエラーを作成する。
+    pub fn interrupted(target_filepath: &str) -> FileError {
+        FileError {
+            category: FileErrorCategory::Interrupted,
+            error: log::make_error!("計算の途中で中断しました。: {}", target_filepath),
+        }
+    }
+}
+
+/// ファイルごとのエラーの分類別の件数
+pub struct FileErrorSummary {
+    counts: BTreeMap<FileErrorCategory, usize>,
+}
+
+impl FileErrorSummary {
+    pub fn new() -> FileErrorSummary {
+        FileErrorSummary {
+            counts: BTreeMap::new(),
+        }
+    }
+
+    /// エラーを1件数える。
+    pub fn add(&mut self, category: FileErrorCategory) {
+        *self.counts.entry(category).or_insert(0) += 1;
+    }
+
+    /// 分類別の件数をログに出力する。
+    /// エラーがなければ何も出力しない。
+    pub fn log(&self, disk_id: &str) {
+        if self.counts.len() == 0 {
+            return;
+        }
+
+        let counts: Vec<String> = self
+            .counts
+            .iter()
+            .map(|(category, count)| {
+                messages::translate(&format!("{} {}件", category.label(), count)).into_owned()
+            })
+            .collect();
+        log::warn(format!("{}: ファイルのエラー: {}", disk_id, counts.join(" / ")).as_str());
+    }
+}
@@ -1,23 +1,72 @@
-use std::fs;
+use std::ffi::OsStr;
+use std::fs::{self, Metadata};
 use std::path::{Path, PathBuf};
+use std::time::Duration;
 
-use crate::log::{self, Errors};
-use crate::run_options::RunOptions;
+use crate::glob;
+use crate::log::{self, Error, Errors};
+use crate::path_normalizer::PathNormalizer;
+use crate::run_options::{PatternFile, RunOptions};
 use path_slash::PathExt;
 use regex::Regex;
 use unicode_normalization::UnicodeNormalization;
 
+/// フィルターでサイズの条件を使う場合の接頭辞
+const SIZE_PREFIX: &str = "size";
+
+/// フィルターで拡張子の一覧を使う場合の接頭辞
+const EXTENSION_PREFIX: &str = "ext:";
+
+/// パターンファイルで正規表現パターンを使う場合の接頭辞
+const REGEX_PREFIX: &str = "regex:";
+
 /// フィルター設定
 #[derive(Clone)]
 pub struct Filter {
-    pattern: Regex,
+    condition: Condition,
     inclusive: bool,
 }
 
+/// フィルターがファイルに一致する条件
+#[derive(Clone)]
+enum Condition {
+    /// ディスクルートからの相対パスに一致する正規表現
+    Pattern(Regex),
+    /// ファイルサイズの比較と比較するバイト数
+    Size(SizeComparison, u64),
+    /// 小文字にした拡張子の一覧
+    Extensions(Vec<String>),
+}
+
+/// ファイルサイズの比較
+#[derive(Clone, Copy)]
+enum SizeComparison {
+    Greater,
+    GreaterOrEqual,
+    Less,
+    LessOrEqual,
+}
+
 impl Filter {
     /// 指定されたファイルを対象とすべきか判定する。
-    pub fn matches(&self, filepath: &Path) -> FilterMatch {
-        match self.pattern.is_match(filepath.to_str().unwrap()) {
+    pub fn matches(&self, filepath: &Path, size: u64) -> FilterMatch {
+        let is_match = match &self.condition {
+            Condition::Pattern(pattern) => pattern.is_match(filepath.to_str().unwrap()),
+            Condition::Size(comparison, bytes) => match comparison {
+                SizeComparison::Greater => size > *bytes,
+                SizeComparison::GreaterOrEqual => size >= *bytes,
+                SizeComparison::Less => size < *bytes,
+                SizeComparison::LessOrEqual => size <= *bytes,
+            },
+            Condition::Extensions(extensions) => match filepath.extension() {
+                Some(extension) => {
+                    let extension = extension.to_str().unwrap().to_lowercase();
+                    extensions.contains(&extension)
+                }
+                None => false,
+            },
+        };
+        match is_match {
             true => match self.inclusive {
                 true => FilterMatch::INCLUDE,
                 false => FilterMatch::EXCLUDE,
@@ -34,22 +83,140 @@ pub enum FilterMatch {
     MISMATCHED,
 }
 
+/// OSが作成する不要なファイルとフォルダの名前
+/// 大文字と小文字は区別しない。
+const JUNK_NAMES: [&str; 10] = [
+    "Thumbs.db",
+    "ehthumbs.db",
+    "desktop.ini",
+    ".DS_Store",
+    ".Spotlight-V100",
+    ".Trashes",
+    ".fseventsd",
+    ".TemporaryItems",
+    "$RECYCLE.BIN",
+    "System Volume Information",
+];
+
+/// macOSがリソースフォークを保存するファイルの名前の接頭辞
+const APPLE_DOUBLE_PREFIX: &str = "._";
+
+/// Windowsの隠し属性
+const FILE_ATTRIBUTE_HIDDEN: u32 = 0x2;
+
+/// Windowsのシステム属性
+const FILE_ATTRIBUTE_SYSTEM: u32 = 0x4;
+
+/// 種類で対象外にするファイルとフォルダ
+/// フォルダが該当すればフォルダ配下も全て対象外にする。
+#[derive(Clone, Copy, Default)]
+pub struct SkipRules {
+    /// "."で始まるものとWindowsの隠し属性のもの
+    hidden: bool,
+    /// Windowsのシステム属性のもの
+    system: bool,
+    /// OSが作成する不要なもの
+    junk: bool,
+}
+
+impl SkipRules {
+    /// "hidden,junk"のようにカンマ区切りの種類名をパースする。
+    /// "none"は何も対象外にしない。種類名が不正であればNoneを返す。
+    pub fn from_names(names: &str) -> Option<SkipRules> {
+        let mut skip_rules = SkipRules::default();
+        for name in names.split(',').map(|name| name.trim()) {
+            match name {
+                "hidden" => skip_rules.hidden = true,
+                "system" => skip_rules.system = true,
+                "junk" => skip_rules.junk = true,
+                "none" => (),
+                _ => return None,
+            }
+        }
+        Some(skip_rules)
+    }
+
+    /// フォルダのエントリーを対象外にするか判定する。
+    fn skips(&self, name: &OsStr, metadata: &Metadata) -> bool {
+        let name = name.to_string_lossy();
+        if self.hidden && (name.starts_with('.') || has_attribute(metadata, FILE_ATTRIBUTE_HIDDEN))
+        {
+            return true;
+        }
+        if self.system && has_attribute(metadata, FILE_ATTRIBUTE_SYSTEM) {
+            return true;
+        }
+        if self.junk
+            && (name.starts_with(APPLE_DOUBLE_PREFIX)
+                || JUNK_NAMES
+                    .iter()
+                    .any(|junk_name| junk_name.eq_ignore_ascii_case(&name)))
+        {
+            return true;
+        }
+        false
+    }
+}
+
+/// Windowsのファイル属性を持っているか判定する。
+#[cfg(windows)]
+fn has_attribute(metadata: &Metadata, attribute: u32) -> bool {
+    use std::os::windows::fs::MetadataExt;
+
+    metadata.file_attributes() & attribute != 0
+}
+
+/// Windows以外にはファイル属性がないので常にfalseを返す。
+#[cfg(not(windows))]
+fn has_attribute(_metadata: &Metadata, _attribute: u32) -> bool {
+    false
+}
+
+/// シンボリックリンクの扱い
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum SymlinkPolicy {
+    /// 対象外にする
+    Skip,
+    /// リンク先のファイルやフォルダを対象にする
+    #[default]
+    Follow,
+    /// リンク先のパスを記録する
+    Record,
+}
+
+impl SymlinkPolicy {
+    /// 名前からシンボリックリンクの扱いを返す。名前が不正であればNoneを返す。
+    pub fn from_name(name: &str) -> Option<SymlinkPolicy> {
+        match name {
+            "skip" => Some(SymlinkPolicy::Skip),
+            "follow" => Some(SymlinkPolicy::Follow),
+            "record" => Some(SymlinkPolicy::Record),
+            _ => None,
+        }
+    }
+}
+
 /// フィルター設定一覧
 #[derive(Clone)]
 pub struct Filters {
     filters: Vec<Filter>,
+    skip_rules: SkipRules,
+    path_normalizer: PathNormalizer,
+    symlink_policy: SymlinkPolicy,
+    settle: Option<Duration>,
 }
 
 impl Filters {
     /// 指定されたファイルがハッシュ計算の対象であるか判定する。
-    pub fn is_target(&self, filepath: &Path) -> bool {
+    /// サイズの条件はファイルサイズと比較する。
+    pub fn is_target(&self, filepath: &Path, size: u64) -> bool {
         // ファイルパスをNFCにする
         let norm_path = filepath.to_str().unwrap().nfc().to_string();
         let norm_path = Path::new(&norm_path).to_slash().unwrap();
         let norm_path = Path::new(&norm_path);
 
         for filter in self.filters.iter() {
-            match filter.matches(norm_path) {
+            match filter.matches(norm_path, size) {
                 FilterMatch::MISMATCHED => continue,
                 FilterMatch::INCLUDE => return true,
                 FilterMatch::EXCLUDE => return false,
@@ -58,15 +225,204 @@ impl Filters {
         // 一致するフィルターがなければ対象としない
         return false;
     }
+
+    /// フォルダのエントリーを種類で対象外にするか判定する。
+    pub fn skips(&self, name: &OsStr, metadata: &Metadata) -> bool {
+        self.skip_rules.skips(name, metadata)
+    }
+
+    /// 対象ファイルのパスを正規化する時の変換を追加する。
+    /// スラッシュ区切りとNFCへの変換の後に適用し、変換後のパスをハッシュファイルに記録する。
+    pub fn with_path_normalizer(
+        mut self,
+        step: impl Fn(&str) -> String + Send + Sync + 'static,
+    ) -> Filters {
+        self.path_normalizer = self.path_normalizer.with_step(step);
+        self
+    }
+
+    /// パスの正規化の手順を返す。
+    pub(crate) fn path_normalizer(&self) -> &PathNormalizer {
+        &self.path_normalizer
+    }
+
+    /// シンボリックリンクの扱いを返す。
+    pub(crate) fn symlink_policy(&self) -> SymlinkPolicy {
+        self.symlink_policy
+    }
+
+    /// 更新されてからこの時間が経っていないファイルを計算しない場合に、その時間を返す。
+    pub(crate) fn settle(&self) -> Option<Duration> {
+        self.settle
+    }
 }
 
 /// フィルター設定一覧を作成する処理フローを実行する。
 pub fn load_filters(run_options: &RunOptions) -> Result<Filters, Errors> {
+    load_filters_with_profile(run_options, run_options.filter_profile())
+}
+
+/// グループのフィルタープロファイルでフィルター設定を読み込んで一覧にする。
+pub fn load_group_filters(run_options: &RunOptions, group: char) -> Result<Filters, Errors> {
+    load_filters_with_profile(run_options, run_options.filter_profile_of(group))
+}
+
+/// 指定されたフィルタープロファイルでフィルター設定を読み込んで一覧にする。
+fn load_filters_with_profile(
+    run_options: &RunOptions,
+    filter_profile: Option<&str>,
+) -> Result<Filters, Errors> {
+    // コマンドラインで指定されたパターンファイルのフィルターをフィルター設定ファイルより優先する
+    let mut filters = vec![];
+    for pattern_file in run_options.pattern_files() {
+        filters.append(&mut load_pattern_file(pattern_file)?);
+    }
+
     let filter_conf_file = filter_conf_filepath(run_options.config_folder());
     let filter_conf_bytes = read_filter_conf_file(filter_conf_file.as_path())?;
     let filter_conf = parse_utf8(filter_conf_bytes)?;
     let filter_conf = to_nfc(filter_conf);
-    parse_filter_conf(&filter_conf)
+    let mut conf_filters = parse_filter_conf(&filter_conf, filter_profile)?;
+    filters.append(&mut conf_filters.filters);
+
+    Ok(Filters {
+        filters,
+        skip_rules: run_options.skip_rules(),
+        path_normalizer: run_options.path_normalizer().clone(),
+        symlink_policy: run_options.symlink_policy(),
+        settle: run_options.settle(),
+    })
+}
+
+/// フィルター設定ファイルの内容からフィルター設定一覧を作成する。
+/// 最初のセクションより前に書かれたフィルターを使用する。
+pub fn parse_filters(filter_conf: &str) -> Result<Filters, Errors> {
+    parse_filter_conf(&to_nfc(filter_conf.to_string()), None)
+}
+
+/// パターンファイルとフィルター設定ファイルを読み込み、見つかった問題を全て返す。
+pub fn check_filters(run_options: &RunOptions) -> Vec<Error> {
+    let mut errors = vec![];
+
+    for pattern_file in run_options.pattern_files() {
+        if let Err(mut pattern_errors) = load_pattern_file(pattern_file) {
+            errors.append(&mut pattern_errors);
+        }
+    }
+
+    let filter_conf_file = filter_conf_filepath(run_options.config_folder());
+    // グループごとのフィルタープロファイルも確認する
+    let mut filter_profiles = vec![run_options.filter_profile()];
+    for group in run_options.configured_groups() {
+        let filter_profile = run_options.filter_profile_of(group);
+        if !filter_profiles.contains(&filter_profile) {
+            filter_profiles.push(filter_profile);
+        }
+    }
+    for filter_profile in filter_profiles {
+        let result = read_filter_conf_file(filter_conf_file.as_path())
+            .and_then(parse_utf8)
+            .map(to_nfc)
+            .and_then(|filter_conf| parse_filter_conf(&filter_conf, filter_profile));
+        if let Err(mut conf_errors) = result {
+            errors.append(&mut conf_errors);
+        }
+    }
+
+    errors
+}
+
+/// パターンファイルを読み込んでフィルター一覧を作成する。
+/// 空白行と#か;から始まるコメント行を除き、1行を1つのrsyncのフィルターパターンとする。
+/// "+ "と"- "から始まる行はオプションに関係なく対象と対象外にする。
+/// "glob:"から始まる行はglobパターン、"regex:"から始まる行は正規表現パターンとする。
+fn load_pattern_file(pattern_file: &PatternFile) -> Result<Vec<Filter>, Errors> {
+    let filepath = pattern_file.path.as_path();
+    let contents = match fs::read(filepath) {
+        Ok(bytes) => match String::from_utf8(bytes) {
+            Ok(contents) => to_nfc(contents),
+            Err(error) => {
+                return Err(log::make_error!(
+                    "パターンファイルがUTF-8のテキストファイルではありません。: {}",
+                    filepath.to_str().unwrap()
+                )
+                .with(&error)
+                .as_errors())
+            }
+        },
+        Err(error) => {
+            return Err(log::make_error!(
+                "パターンファイルが読み込めませんでした。: {}",
+                filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors())
+        }
+    };
+
+    let mut filters = vec![];
+    let mut errors = vec![];
+
+    for (i, line) in contents.lines().enumerate() {
+        let line = line.trim();
+        if line.len() == 0 || line.starts_with('#') || line.starts_with(';') {
+            continue;
+        }
+        let (inclusive, line) = if let Some(line) = line.strip_prefix("+ ") {
+            (true, line.trim_start())
+        } else if let Some(line) = line.strip_prefix("- ") {
+            (false, line.trim_start())
+        } else {
+            (pattern_file.inclusive, line)
+        };
+        if let Some(glob) = line.strip_prefix(glob::GLOB_PREFIX) {
+            match glob::to_regex(glob) {
+                Ok(pattern) => filters.push(Filter {
+                    condition: Condition::Pattern(pattern),
+                    inclusive,
+                }),
+                Err(message) => errors.push(log::make_error!(
+                    "パターンファイルのglobパターンが不正です。: {}: {}行目: {}",
+                    filepath.to_str().unwrap(),
+                    i + 1,
+                    message
+                )),
+            }
+            continue;
+        }
+        if let Some(regex) = line.strip_prefix(REGEX_PREFIX) {
+            match Regex::new(regex) {
+                Ok(pattern) => filters.push(Filter {
+                    condition: Condition::Pattern(pattern),
+                    inclusive,
+                }),
+                Err(_) => errors.push(log::make_error!(
+                    "パターンファイルの正規表現パターンが不正です。: {}: {}行目",
+                    filepath.to_str().unwrap(),
+                    i + 1
+                )),
+            }
+            continue;
+        }
+        match glob::rsync_to_regex(line) {
+            Ok(pattern) => filters.push(Filter {
+                condition: Condition::Pattern(pattern),
+                inclusive,
+            }),
+            Err(message) => errors.push(log::make_error!(
+                "パターンファイルのパターンが不正です。: {}: {}行目: {}",
+                filepath.to_str().unwrap(),
+                i + 1,
+                message
+            )),
+        }
+    }
+
+    if errors.len() == 0 {
+        Ok(filters)
+    } else {
+        Err(errors)
+    }
 }
 
 /// フィルター設定ファイルのパスを返す。
@@ -101,16 +457,41 @@ fn to_nfc(filter_conf: String) -> String {
     filter_conf.as_str().nfc().to_string()
 }
 
-/// フィルター設定ファイルの内容からフィルター一覧を作成する。
-fn parse_filter_conf(filter_conf: &str) -> Result<Filters, Errors> {
+/// フィルター設定ファイルの内容から指定されたプロファイルのフィルター一覧を作成する。
+/// プロファイルが指定されなければ最初のセクションより前に書かれたフィルターを使用する。
+fn parse_filter_conf(filter_conf: &str, profile: Option<&str>) -> Result<Filters, Errors> {
     let mut filters: Vec<Filter> = vec![];
 
     let mut errors = vec![];
 
+    // 読み込み中のセクションのプロファイル名
+    let mut current_profile: Option<&str> = None;
+    // 出現したプロファイル名の一覧
+    let mut profile_names: Vec<&str> = vec![];
+
     // エラーメッセージに行番号を出力するためenumerateする
     for (i, line) in filter_conf.lines().enumerate() {
+        // セクション行ならプロファイルを切り替える
+        if let Some(profile_name) = parse_section_line(line) {
+            if profile_name.len() == 0 || profile_names.contains(&profile_name) {
+                let error = log::make_error!(
+                    "フィルター設定ファイルの形式が不正です。: {}行目: {}",
+                    i + 1,
+                    "プロファイル名が空か、重複しています。"
+                );
+                errors.push(error);
+            }
+            profile_names.push(profile_name);
+            current_profile = Some(profile_name);
+            continue;
+        }
+
         match parse_filter_conf_line(line) {
-            Ok(Some(filter)) => filters.push(filter),
+            Ok(Some(filter)) => {
+                if current_profile == profile {
+                    filters.push(filter);
+                }
+            }
             Ok(None) => {}
             Err(message) => {
                 let error = log::make_error!(
@@ -123,14 +504,39 @@ fn parse_filter_conf(filter_conf: &str) -> Result<Filters, Errors> {
         }
     }
 
+    if let Some(profile) = profile {
+        if !profile_names.contains(&profile) {
+            let error = log::make_error!("フィルタープロファイル{}がありません。", profile);
+            errors.push(error);
+        }
+    }
+
     if errors.len() == 0 {
-        Ok(Filters { filters })
+        Ok(Filters {
+            filters,
+            skip_rules: SkipRules::default(),
+            path_normalizer: PathNormalizer::default(),
+            symlink_policy: SymlinkPolicy::default(),
+            settle: None,
+        })
     } else {
         Err(errors)
     }
 }
 
+/// フィルター設定ファイルの行が"[プロファイル名]"の形式のセクション行であればプロファイル名を返す。
+fn parse_section_line(line: &str) -> Option<&str> {
+    let line = line.trim();
+    if line.starts_with('[') && line.ends_with(']') && line.len() >= 2 {
+        Some(line[1..line.len() - 1].trim())
+    } else {
+        None
+    }
+}
+
 /// フィルター設定ファイルの1行からフィルター設定を作成する。
+/// 記号の後が"glob:"から始まればglobパターン、"size"と比較演算子から始まればサイズの条件、
+/// "ext:"から始まればカンマ区切りの拡張子の一覧とする。
 fn parse_filter_conf_line(line: &str) -> Result<Option<Filter>, &'static str> {
     // コメント行
     if line.starts_with('#') {
@@ -148,12 +554,41 @@ fn parse_filter_conf_line(line: &str) -> Result<Option<Filter>, &'static str> {
             // 1文字目が + or -
             if first_char == '+' || first_char == '-' {
                 let pattern = chars.collect::<String>();
+                let inclusive = first_char == '+';
+                // globパターン
+                if let Some(glob) = pattern.strip_prefix(glob::GLOB_PREFIX) {
+                    let condition = Condition::Pattern(glob::to_regex(glob)?);
+                    return Ok(Some(Filter {
+                        condition,
+                        inclusive,
+                    }));
+                }
+                // サイズの条件
+                if let Some(size_condition) = pattern.strip_prefix(SIZE_PREFIX) {
+                    if size_condition.starts_with(['<', '>']) {
+                        let condition = parse_size_condition(size_condition)?;
+                        return Ok(Some(Filter {
+                            condition,
+                            inclusive,
+                        }));
+                    }
+                }
+                // 拡張子の一覧
+                if let Some(extensions) = pattern.strip_prefix(EXTENSION_PREFIX) {
+                    let condition = parse_extensions(extensions)?;
+                    return Ok(Some(Filter {
+                        condition,
+                        inclusive,
+                    }));
+                }
                 // 正規表現パターンあり
                 if pattern.len() > 0 {
                     // 正規表現パターンのパースに成功
                     if let Ok(pattern) = Regex::new(&pattern) {
-                        let inclusive = first_char == '+';
-                        let filter = Filter { pattern, inclusive };
+                        let filter = Filter {
+                            condition: Condition::Pattern(pattern),
+                            inclusive,
+                        };
                         Ok(Some(filter))
                     }
                     // 正規表現パターンが不正
@@ -174,3 +609,50 @@ fn parse_filter_conf_line(line: &str) -> Result<Option<Filter>, &'static str> {
         None => Ok(None),
     }
 }
+
+/// ">100M"や"<=1K"のような比較演算子とサイズをパースする。
+/// 単位はK、M、G、T(1024倍ずつ)で、省略するとバイト数とする。
+fn parse_size_condition(size_condition: &str) -> Result<Condition, &'static str> {
+    const INVALID_SIZE: &str = "サイズの条件が不正です。(例: size>100M, size<=1K)";
+
+    let (comparison, size) = if let Some(size) = size_condition.strip_prefix(">=") {
+        (SizeComparison::GreaterOrEqual, size)
+    } else if let Some(size) = size_condition.strip_prefix("<=") {
+        (SizeComparison::LessOrEqual, size)
+    } else if let Some(size) = size_condition.strip_prefix('>') {
+        (SizeComparison::Greater, size)
+    } else if let Some(size) = size_condition.strip_prefix('<') {
+        (SizeComparison::Less, size)
+    } else {
+        return Err(INVALID_SIZE);
+    };
+
+    let size = size.trim();
+    let (number, shift) = match size.chars().last().map(|unit| unit.to_ascii_uppercase()) {
+        Some('K') => (&size[..size.len() - 1], 10),
+        Some('M') => (&size[..size.len() - 1], 20),
+        Some('G') => (&size[..size.len() - 1], 30),
+        Some('T') => (&size[..size.len() - 1], 40),
+        _ => (size, 0),
+    };
+    match number.trim().parse::<u64>() {
+        Ok(number) if number.leading_zeros() >= shift => {
+            Ok(Condition::Size(comparison, number << shift))
+        }
+        _ => Err(INVALID_SIZE),
+    }
+}
+
+/// "jpg,png"のようなカンマ区切りの拡張子の一覧をパースする。
+/// 先頭の"."は省略でき、大文字と小文字は区別しない。
+fn parse_extensions(extensions: &str) -> Result<Condition, &'static str> {
+    let extensions: Vec<String> = extensions
+        .split(',')
+        .map(|extension| extension.trim().trim_start_matches('.').to_lowercase())
+        .filter(|extension| extension.len() > 0)
+        .collect();
+    if extensions.len() == 0 {
+        return Err("拡張子がありません。");
+    }
+    Ok(Condition::Extensions(extensions))
+}
@@ -1,54 +1,983 @@
 use std::collections::HashMap;
-use std::path::PathBuf;
+use std::io::{self, IsTerminal, Write};
+use std::path::{Path, PathBuf};
 use std::thread;
-use std::time::Duration;
+use std::time::{Duration, Instant};
 
-use crate::calc;
-use crate::disk;
+use crate::atomic_write;
+use crate::calc::{self, DiskTarget};
+use crate::callbacks::Callbacks;
+use crate::check_config;
+use crate::clock;
+use crate::compare;
+use crate::compare_dirs;
+use crate::copy;
+use crate::coreutils;
+use crate::dedup;
+use crate::diff;
+use crate::disk::{self, DiskInfo};
+use crate::disks;
+use crate::dry_run;
+use crate::dupes;
+use crate::events;
+use crate::export_html;
 use crate::filter;
+use crate::hash_algorithm::HashAlgorithm;
 use crate::hash_file;
+use crate::help;
+use crate::init_disk;
+use crate::interruption;
+use crate::label;
 use crate::log::{self, Errors};
 use crate::merged_hash_file;
-use crate::progress;
-use crate::run_options::RunOptions;
+use crate::messages::{self, Language};
+use crate::mismatch_report::{self, MismatchReport};
+use crate::output_lock;
+use crate::pinned;
+use crate::plan;
+use crate::post_restore;
+use crate::progress::{self, ProgressSubscriber};
+use crate::prune;
+use crate::read_only;
+use crate::retention;
+use crate::retry;
+use crate::run_options::{Command, RunOptions};
+use crate::run_summary::RunSummary;
+use crate::scrub;
+use crate::seal;
+use crate::serve;
+use crate::setup;
+use crate::smart;
+use crate::spot_check;
+use crate::stream_hash;
+use crate::streams;
+use crate::sync;
+use crate::tags::{self, TagTarget};
+use crate::throughput;
+use crate::trimmed;
+use crate::usage;
 
 /// 主処理。
+/// 購読者が指定された場合はハッシュ計算の進捗状況を通知する。
+/// ハッシュ計算と検証のイベントはコールバックに通知する。
 pub fn main_procedure(
     current_folder: PathBuf,
     args: Vec<String>,
     envs: HashMap<String, String>,
+    subscriber: Option<ProgressSubscriber>,
+    callbacks: Callbacks,
 ) -> Result<(), Errors> {
+    // ヘルプが要求されたら設定を読み込まずに出力する
+    if let Some(command_name) = help::requested_help(&args) {
+        return help::print_help(command_name);
+    }
+    // 起動設定の読み込みで発生したエラーも指定の言語で出力できるよう先に言語を決める
+    messages::set_language(
+        messages::requested_language(&args, &envs).unwrap_or(Language::Japanese),
+    );
+    // 初期設定はBCBCHOMEがなくても作成できるよう起動設定を読み込まずに作成する
+    if setup::requested_setup(&args) {
+        return setup::setup(&envs);
+    }
     // 起動設定を構造体に変換する
-    let run_options = RunOptions::new(current_folder, args, envs)?;
+    let mut run_options = RunOptions::new(current_folder, args, envs)?;
+    // 設定ファイルで指定された言語も反映する
+    messages::set_language(run_options.language());
+    // ライブラリの利用者が登録したパスの変換を正規化に加える
+    run_options.add_path_normalizers(callbacks.path_normalizers());
+    // 日時が指定されれば固定して決定的モードにする
+    clock::set_fixed_time(run_options.fixed_time());
+    // 差異や進捗状況を標準出力に出力する場合は混ざらないようログを標準エラー出力に出力する
+    log::use_stderr(run_options.uses_stdout_for_output());
+    mismatch_report::set_mismatched(false);
+    calc::set_disk_failed(false);
     // ツール名とバージョンを出力する
     log::info(format!("bcbc v{}", env!("CARGO_PKG_VERSION")).as_str());
-    // フィルター設定を読み込んで一覧にする
-    let filters = filter::load_filters(&run_options)?;
+    // 名前空間を使う場合は出力先を確認できるよう出力する
+    if let Some(namespace) = run_options.namespace() {
+        log::info(
+            format!(
+                "名前空間{}を使用します。: {}",
+                namespace,
+                run_options.output_folder().to_str().unwrap()
+            )
+            .as_str(),
+        );
+    }
+    // ライブUSBの読み取り専用の媒体などで出力フォルダに書き込めなくても、
+    // ハッシュ計算と検証は読み取り専用モードで実行できるようにする
+    if (run_options.command() == Command::Calc || run_options.command() == Command::Verify)
+        && !run_options.read_only()
+        && !run_options.dry_run()
+        && !is_home_writable(&run_options)
+    {
+        log::warn("出力フォルダかディスクレジストリのフォルダに書き込めないため、読み取り専用モードで実行します。");
+        run_options.fall_back_to_read_only();
+    }
+    // 他のbcbcと同時にハッシュファイルを書き換えないよう、変更する処理の間は出力フォルダをロックする
+    let _output_locks = if run_options.modifies_output() {
+        output_lock::lock_output_folders(&run_options.output_folders())?
+    } else {
+        vec![]
+    };
+    // 中断された実行の一時ファイルが残っていれば削除する
+    // 読み取り専用モードとdry-runでは何も書き込まないので、出力を変更する処理でだけ削除する
+    if (run_options.modifies_output() || run_options.command() == Command::Watch)
+        && !run_options.read_only()
+        && !run_options.dry_run()
+    {
+        remove_leftovers(&run_options);
+    }
+
+    match run_options.command() {
+        Command::Calc | Command::Verify | Command::Retry => {
+            run_calc(&run_options, subscriber, callbacks)
+        }
+        Command::Watch => run_watch(&run_options, callbacks),
+        Command::Check => spot_check::check_files(&run_options),
+        Command::Sync => run_sync(&run_options),
+        Command::Compare => run_compare(&run_options),
+        Command::CompareDirs => run_compare_dirs(&run_options),
+        Command::Copy => run_copy(&run_options),
+        Command::Hash => run_hash(&run_options),
+        Command::Merge => run_merge(&run_options),
+        Command::Clean => run_clean(&run_options),
+        Command::ImportSums => run_import_sums(&run_options),
+        Command::PostRestore => post_restore::post_restore(&run_options),
+        Command::ImportScrub => scrub::import_scrub_report(
+            run_options.scrub_report_filepath(),
+            run_options.mount_folder(),
+            run_options.registry_filepath(),
+            &run_options.output_folders(),
+            run_options.path_normalizer(),
+        ),
+        Command::Dedup => run_dedup(&run_options),
+        Command::Tag => {
+            let target = TagTarget::parse(run_options.tag_target())?;
+            tags::add_tag(
+                run_options.output_folder_of(target.disk_id.chars().next().unwrap()),
+                &target,
+                run_options.tag().unwrap(),
+            )
+        }
+        Command::Untag => {
+            let target = TagTarget::parse(run_options.tag_target())?;
+            tags::remove_tag(
+                run_options.output_folder_of(target.disk_id.chars().next().unwrap()),
+                &target,
+                run_options.tag(),
+            )
+        }
+        Command::Label => label::write_labels(
+            run_options.output_folder(),
+            run_options.registry_filepath(),
+            &disk_output_folders(&run_options, run_options.label_disk_ids())?,
+            run_options.base_url(),
+        ),
+        Command::ExportHtml => {
+            let (target, export_folder) = run_options.export_html_target();
+            export_html::export_html(
+                run_options.output_folder_of(target.chars().next().unwrap()),
+                target,
+                export_folder,
+            )
+        }
+        Command::Tags => {
+            tags::list_tags(&run_options.output_folders(), run_options.tags_disk_ids())
+        }
+        Command::RestoreTrimmed => run_restore_trimmed(&run_options),
+        Command::Seal => run_seal(&run_options),
+        Command::CheckPinned => run_check_pinned(&run_options),
+        Command::CheckConfig => check_config::check_config(&run_options),
+        Command::Diff => {
+            let (first, second) = run_options.diff_targets();
+            let output_folder_of = |target: &str| match diff::group_of_target(target) {
+                Some(group) => run_options.output_folder_of(group),
+                None => run_options.output_folder(),
+            };
+            diff::diff_hash_files(
+                output_folder_of(first),
+                output_folder_of(second),
+                run_options.current_folder(),
+                first,
+                second,
+            )
+        }
+        Command::Retention => run_retention(&run_options),
+        Command::Usage => run_usage(&run_options),
+        Command::Dupes => run_dupes(&run_options),
+        Command::Disks => disks::list_disks(&run_options.output_folders()),
+        Command::Init => {
+            let (disk_root, group, label) = run_options.init_target();
+            init_disk::init_disk(
+                disk_root,
+                group,
+                label,
+                run_options.output_folder_of(group),
+                run_options.registry_filepath(),
+            )
+        }
+        Command::Prune => run_prune(&run_options),
+        Command::Throughput => throughput::report_throughput(
+            run_options.output_folder(),
+            run_options.throughput_disk_ids(),
+        ),
+        Command::Plan => plan::plan_verification(
+            run_options.registry_filepath(),
+            &disk_output_folders(&run_options, run_options.plan_disk_ids())?,
+            &run_options.verification_plan(),
+        ),
+        Command::Serve => serve::serve(&run_options),
+    }
+}
+
+/// ディスクIDと、そのディスクのハッシュファイルがある出力フォルダの組の一覧を返す。
+/// ディスクIDが指定されなければ、全ての出力フォルダのハッシュファイルのディスクをID順に返す。
+/// グループの出力フォルダを設定する前のハッシュファイルが残っていても、グループの出力フォルダのものだけを返す。
+fn disk_output_folders<'a>(
+    run_options: &'a RunOptions,
+    disk_ids: &Vec<String>,
+) -> Result<Vec<(String, &'a Path)>, Errors> {
+    if disk_ids.len() > 0 {
+        return Ok(disk_ids
+            .iter()
+            .map(|disk_id| {
+                let group = disk_id.chars().next().unwrap();
+                (disk_id.clone(), run_options.output_folder_of(group))
+            })
+            .collect());
+    }
+
+    let mut disks = vec![];
+    for output_folder in run_options.output_folders() {
+        if !output_folder.is_dir() {
+            continue;
+        }
+        for hash_filepath in merged_hash_file::find_hash_files(output_folder)? {
+            let disk_id = hash_filepath.file_name().unwrap().to_str().unwrap();
+            if run_options.output_folder_of(disk_id.chars().next().unwrap()) == output_folder {
+                disks.push((disk_id.to_string(), output_folder));
+            }
+        }
+    }
+    disks.sort();
+    Ok(disks)
+}
+
+/// ディスクIDと出力フォルダの組の一覧を、出力フォルダごとのディスクIDの一覧にまとめる。
+fn group_by_output_folder(disks: Vec<(String, &Path)>) -> Vec<(&Path, Vec<String>)> {
+    let mut grouped: Vec<(&Path, Vec<String>)> = vec![];
+    for (disk_id, output_folder) in disks {
+        match grouped
+            .iter_mut()
+            .find(|(grouped_folder, _)| *grouped_folder == output_folder)
+        {
+            Some((_, disk_ids)) => disk_ids.push(disk_id),
+            None => grouped.push((output_folder, vec![disk_id])),
+        }
+    }
+    grouped
+}
+
+/// ハッシュ計算の出力先
+/// グループごとの出力フォルダが設定されていれば出力フォルダごとに分ける。
+struct CalcOutput {
+    /// 元の出力フォルダ
+    output_folder: PathBuf,
+    /// ハッシュファイルを出力するフォルダ
+    /// 読み取り専用モードなら一時フォルダになる。
+    work_folder: PathBuf,
+    /// この出力フォルダに出力するディスク情報一覧
+    disk_info_list: Vec<DiskInfo>,
+}
+
+impl CalcOutput {
+    /// 出力するディスクのID一覧を返す。
+    fn disk_ids(&self) -> Vec<String> {
+        self.disk_info_list
+            .iter()
+            .map(|disk_info| disk_info.id.clone())
+            .collect()
+    }
+}
+
+/// 出力フォルダ、設定フォルダ、ディスクレジストリのフォルダに残っている一時ファイルを削除する。
+/// 出力フォルダは`digests/アルゴリズム`などのサブフォルダにも書き込むので2階層下まで辿る。
+/// 設定フォルダとディスクレジストリのフォルダは利用者のホームフォルダなどの場合もあるので直下だけを対象にする。
+fn remove_leftovers(run_options: &RunOptions) {
+    for output_folder in run_options.output_folders() {
+        atomic_write::remove_leftovers(output_folder, 2);
+    }
+    atomic_write::remove_leftovers(run_options.config_folder(), 0);
+    if let Some(registry_folder) = run_options.registry_filepath().parent() {
+        atomic_write::remove_leftovers(registry_folder, 0);
+    }
+}
+
+/// ディスクレジストリのフォルダと、作成済みの出力フォルダに書き込めるかを返す。
+fn is_home_writable(run_options: &RunOptions) -> bool {
+    let mut folders = run_options.output_folders();
+    if let Some(registry_folder) = run_options.registry_filepath().parent() {
+        folders.push(registry_folder);
+    }
+    folders
+        .into_iter()
+        .filter(|folder| folder.is_dir())
+        .all(|folder| atomic_write::is_writable(folder))
+}
+
+/// ハッシュ計算を実行する。
+/// 検証ならハッシュファイルを更新せず、ハッシュファイルにあるファイルを読み込み直して比較する。
+fn run_calc(
+    run_options: &RunOptions,
+    subscriber: Option<ProgressSubscriber>,
+    callbacks: Callbacks,
+) -> Result<(), Errors> {
+    let verify_only = run_options.command() == Command::Verify;
     // ディスク情報を一覧にする
-    let disk_info_list =
-        disk::list_disk_info(run_options.current_folder(), run_options.disk_roots())?;
+    let disk_info_list = disk::list_disk_info(run_options)?;
+    // 全速力で計算する場合は内容を表示して確認する
+    if run_options.full_speed()
+        && !run_options.dry_run()
+        && !confirm_full_speed(disk_info_list.len(), run_options.buffer_size())?
+    {
+        log::info("ハッシュ計算を中止しました。");
+        return Ok(());
+    }
+    // 代替データストリームはWindowsでのみ扱える
+    let alternate_streams = run_options.alternate_streams() && streams::SUPPORTED;
+    if run_options.alternate_streams() && !streams::SUPPORTED {
+        log::warn("代替データストリームはWindowsでのみ扱えるため、--streamsを無視します。");
+    }
+    // ディスクを出力フォルダごとに分ける
+    let mut calc_outputs: Vec<CalcOutput> = vec![];
+    for disk_info in disk_info_list {
+        let output_folder = run_options.output_folder_of(disk_info.group());
+        match calc_outputs
+            .iter_mut()
+            .find(|calc_output| calc_output.output_folder == output_folder)
+        {
+            Some(calc_output) => calc_output.disk_info_list.push(disk_info),
+            None => calc_outputs.push(CalcOutput {
+                output_folder: output_folder.to_path_buf(),
+                work_folder: output_folder.to_path_buf(),
+                disk_info_list: vec![disk_info],
+            }),
+        }
+    }
     // 出力フォルダの作成
-    hash_file::ensure_output_folder(run_options.output_folder())?;
+    // 読み取り専用モードなら一時フォルダに出力する
+    // 一覧だけを出力する場合は元の出力フォルダのハッシュファイルと照合するだけなので作成しない
+    for calc_output in calc_outputs.iter_mut() {
+        if run_options.dry_run() {
+            continue;
+        }
+        if run_options.read_only() {
+            calc_output.work_folder =
+                read_only::prepare_work_folder(calc_output.output_folder.as_path())?;
+        } else {
+            hash_file::ensure_output_folder(calc_output.output_folder.as_path())?;
+        }
+    }
+
+    // ディスクのデバイスのSMART情報を記録する
+    if run_options.smart() && !run_options.dry_run() {
+        for calc_output in calc_outputs.iter() {
+            smart::capture_smart_data(
+                calc_output.work_folder.as_path(),
+                &calc_output.disk_info_list,
+            )?;
+        }
+    }
+
+    // 取り外した後も一覧やレポートで見分けられるよう、diskファイルの管理用の情報を保存する
+    if !run_options.dry_run() {
+        for calc_output in calc_outputs.iter() {
+            for disk_info in calc_output.disk_info_list.iter() {
+                disks::record_metadata(calc_output.work_folder.as_path(), disk_info)?;
+            }
+        }
+    }
+
+    // ディスクごとにフィルター、アルゴリズムを決める
+    // フィルター設定はグループごとに1回だけ読み込む
+    let mut group_filters = HashMap::new();
+    let mut disk_targets = vec![];
+    for calc_output in calc_outputs.iter() {
+        // 封印されたディスクは読み取り専用モードでも元の出力フォルダで判定する
+        let sealed_disk_ids = seal::load_sealed_disk_ids(calc_output.output_folder.as_path())?;
+        for disk_info in calc_output.disk_info_list.iter() {
+            let group = disk_info.group();
+            let sealed = sealed_disk_ids.contains(&disk_info.id);
+            // 再試行する場合は失敗したファイルの一覧があるディスクだけを計算する
+            let failed_paths = if run_options.command() == Command::Retry {
+                let failed_paths =
+                    retry::load_failed_paths(calc_output.output_folder.as_path(), &disk_info.id)?;
+                if sealed || failed_paths.len() == 0 {
+                    log::info(
+                        format!("{}: 再試行するファイルはありません。", &disk_info.id).as_str(),
+                    );
+                    continue;
+                }
+                Some(failed_paths)
+            } else {
+                None
+            };
+            if !group_filters.contains_key(&group) {
+                group_filters.insert(group, filter::load_group_filters(run_options, group)?);
+            }
+            disk_targets.push(DiskTarget {
+                disk_info: disk_info.clone(),
+                output_folder: calc_output.work_folder.clone(),
+                filters: group_filters[&group].clone(),
+                algorithm: run_options.algorithm_of(group),
+                sealed,
+                failed_paths,
+            });
+        }
+    }
+    if run_options.command() == Command::Retry && disk_targets.len() == 0 {
+        return Ok(());
+    }
 
-    log::info("ハッシュ計算を開始します。");
+    // ハッシュ計算するファイルの一覧だけを出力する
+    if run_options.dry_run() {
+        return dry_run::print_files_to_hash(
+            &disk_targets,
+            run_options.scope(),
+            alternate_streams,
+            run_options.output_format(),
+        );
+    }
+
+    if verify_only {
+        log::info("ハッシュファイルの検証を開始します。");
+    } else if run_options.command() == Command::Retry {
+        log::info("失敗したファイルのハッシュ計算を再試行します。");
+    } else {
+        log::info("ハッシュ計算を開始します。");
+    }
 
     // 進捗監視スレッドの開始
-    let progress_tx = progress::start_progress_monitor();
+    // cronなどで端末以外に出力する場合は間隔を空けて出力する
+    let heartbeat_interval = if io::stdout().is_terminal() {
+        None
+    } else {
+        Some(Duration::from_secs(run_options.heartbeat_seconds()))
+    };
+    // 端末ではディスクごとの行を描いて更新する
+    // 標準出力を機械処理用の出力に使う場合は、出力に混ざらないようログに出力する
+    let tui = heartbeat_interval.is_none()
+        && !run_options.no_tui()
+        && !run_options.uses_stdout_for_output();
+    // 全速力で計算する場合はファイルごとに進捗状況を出力しない
+    let progress_tx = progress::start_progress_monitor(
+        run_options.progress_format(),
+        heartbeat_interval,
+        !run_options.full_speed(),
+        tui,
+        subscriber,
+    );
+    // ファイルごとの処理結果の出力先を開き、コールバックとして登録する
+    let callbacks = events::add_event_log(callbacks, run_options.event_filepath())?;
+    // Ctrl+CとSIGTERMを受けたらファイルの区切りで停止する
+    interruption::set_interruption_handler()?;
+    // 実行時間の上限に達した場合も同じくファイルの区切りで停止する
+    interruption::set_time_limit(run_options.max_duration());
+    // 外部のツールが停止ファイルを作成した場合も同じくファイルの区切りで停止する
+    interruption::watch_stop_file(run_options.stop_filepath());
+    // 検証したディスクの一覧と差異の記録
+    let mut verified_disk_ids: Vec<String> = disk_targets
+        .iter()
+        .map(|disk_target| disk_target.disk_info.id.clone())
+        .collect();
+    verified_disk_ids.sort();
+    let mismatch_report = MismatchReport::new();
+    // ディスクごとの実績の集計
+    let run_summary = RunSummary::new();
+    let start_time = Instant::now();
+    // ハッシュ計算と検証の指定
+    let calc_options = calc::CalcOptions {
+        verify_only,
+        update_renamed: run_options.update_renamed(),
+        quota_plan: run_options.verify_quota(),
+        older_than_days: run_options.verify_older_than_days(),
+        full_speed: run_options.full_speed(),
+        scope: run_options.scope().map(Path::to_path_buf),
+        alternate_streams,
+        buffer_size: run_options.buffer_size(),
+        chunked_threshold: run_options.chunked_threshold(),
+        disks: run_options.disks(),
+        workers: run_options.workers().unwrap_or(1),
+        memory_limit: run_options.memory_limit(),
+        retry_policy: run_options.retry_policy(),
+        verify_after_calc: run_options.verify_after_calc(),
+        extra_algorithms: run_options.extra_algorithms().to_vec(),
+        hash_storage: run_options.hash_storage(),
+        // 監視の確認ごとや再試行でディスクを取り外さないよう、完了後の処理は計算と検証でだけ行う
+        run_completion_actions: matches!(run_options.command(), Command::Calc | Command::Verify),
+    };
     // ハッシュ計算スレッドの開始
     let worker_handles = calc::start_calculation(
-        disk_info_list,
-        run_options.output_folder(),
-        filters,
+        disk_targets,
         progress_tx,
+        callbacks,
+        mismatch_report.clone(),
+        run_summary.clone(),
+        calc_options,
     )?;
     // ハッシュ計算の完了を待つ
-    calc::wait_calculations(worker_handles)?;
+    let result = calc::wait_calculations(worker_handles);
     // 最後の進捗状況を表示するため一瞬待機する
     thread::sleep(Duration::from_millis(10));
+    // 中断やエラーで終わった場合も、それまでの実績を出力する
+    let elapsed = start_time.elapsed();
+    run_summary.log(elapsed);
+    if run_options.summary() {
+        let report_filepath = run_summary.write_report(run_options.output_folder(), elapsed)?;
+        log::info(
+            format!(
+                "集計レポートを保存しました。: {}",
+                report_filepath.to_str().unwrap()
+            )
+            .as_str(),
+        );
+    }
+    // 検証ではハッシュファイルを更新しないので統合などは不要
+    if verify_only {
+        // 中断した場合は検証していないファイルがあるので差異を出力しない
+        if interruption::is_interrupted() {
+            return result;
+        }
+        // 差異は検証できなかったディスクも含めて出力する
+        if let Some(output_format) = run_options.output_format() {
+            mismatch_report.print(output_format, &verified_disk_ids);
+        }
+        // 移動したファイルのパスを書き換えた場合は統合ハッシュファイルを作り直す
+        if run_options.update_renamed() {
+            for calc_output in calc_outputs.iter() {
+                merged_hash_file::integrate_hash_files(calc_output.work_folder.as_path())?;
+            }
+        }
+        result?;
+        log::info("ハッシュファイルの検証を終了しました。");
+        // CIなどで判定できるよう、差異があれば専用の終了コードで終了する
+        if mismatch_report.len() > 0 {
+            mismatch_report::set_mismatched(true);
+            return Err(
+                log::make_error!("検証で{}件の差異がありました。", mismatch_report.len())
+                    .as_errors(),
+            );
+        }
+        return Ok(());
+    }
+    result?;
     // ハッシュファイルを統合する
-    merged_hash_file::integrate_hash_files(run_options.output_folder())?;
+    // 統合しない場合は後でmergeを実行する
+    if run_options.no_merge() {
+        log::info("統合ハッシュファイルは作り直しません。bcbc mergeで作り直してください。");
+    } else {
+        for calc_output in calc_outputs.iter() {
+            merged_hash_file::integrate_hash_files(calc_output.work_folder.as_path())?;
+        }
+    }
 
     log::info("ハッシュ計算を終了しました。");
 
+    for calc_output in calc_outputs.iter() {
+        let disk_ids = calc_output.disk_ids();
+
+        // 読み取り専用モードなら元のハッシュファイルとの差分をレポートする
+        if run_options.read_only() {
+            read_only::write_report(
+                calc_output.output_folder.as_path(),
+                calc_output.work_folder.as_path(),
+                &disk_ids,
+            )?;
+        }
+
+        // ハッシュファイルのあるディスクのないマシンでも検証できるよう、md5sum互換の形式でも出力する
+        if run_options.coreutils_output() {
+            coreutils::export_hash_files(calc_output.work_folder.as_path(), &disk_ids)?;
+        }
+
+        // 処理したディスクとそのグループの必須ファイルを確認する
+        // 実行時間の上限で停止した場合は計算していないファイルがあるので確認しない
+        if !interruption::is_time_limit_reached() {
+            pinned::check_pinned_files(
+                calc_output.work_folder.as_path(),
+                run_options.config_folder(),
+                Some(&disk_ids),
+            )?;
+        }
+    }
+
+    Ok(())
+}
+
+/// 中断を受けるまで、一定間隔でディスクを確認して追加か変更されたファイルのハッシュを計算する。
+/// 確認のたびに通常のハッシュ計算を行い、計算済みで変更されていないファイルは読み込まない。
+/// 他のbcbcがハッシュファイルを書き換えられるよう、出力フォルダは計算している間だけロックする。
+/// 確認でエラーになっても監視は続ける。
+fn run_watch(run_options: &RunOptions, callbacks: Callbacks) -> Result<(), Errors> {
+    // 確認を待っている間もCtrl+Cと停止ファイルで停止する
+    interruption::set_interruption_handler()?;
+    interruption::watch_stop_file(run_options.stop_filepath());
+    log::info(
+        format!(
+            "ディスクの監視を開始します。{}秒ごとに確認します。",
+            run_options.poll_interval().as_secs()
+        )
+        .as_str(),
+    );
+    loop {
+        let next_poll = Instant::now() + run_options.poll_interval();
+        match output_lock::lock_output_folders(&run_options.output_folders()) {
+            Ok(_output_locks) => {
+                if let Err(errors) = run_calc(run_options, None, callbacks.clone()) {
+                    log::log_errors(errors);
+                }
+            }
+            Err(errors) => {
+                log::log_errors(errors);
+                log::warn("出力フォルダをロックできなかったため、次の確認で計算します。");
+            }
+        }
+        while !interruption::is_interrupted() && Instant::now() < next_poll {
+            thread::sleep(Duration::from_secs(1));
+        }
+        if interruption::is_interrupted() {
+            break;
+        }
+    }
+    log::info("ディスクの監視を終了しました。");
+
+    Ok(())
+}
+
+/// 全速力で計算する内容を表示し、続行するか確認する。
+/// 端末から実行されていなければ確認せずに続行する。
+fn confirm_full_speed(number_of_disks: usize, buffer_size: Option<usize>) -> Result<bool, Errors> {
+    log::info("全速力でハッシュ計算を行います。");
+    log::info(
+        format!(
+            "読み込み用のバッファをディスクごとに{}MBから{}MBに増やします。",
+            buffer_size.unwrap_or(calc::default_buffer_size(false)) >> 20,
+            buffer_size.unwrap_or(calc::default_buffer_size(true)) >> 20
+        )
+        .as_str(),
+    );
+    log::info(
+        format!(
+            "ディスクごとに読み込みスレッドを追加し、計算スレッドを{}から{}に増やします。",
+            number_of_disks,
+            number_of_disks * 2
+        )
+        .as_str(),
+    );
+    log::info("進捗状況はファイルごとには出力せず、1秒ごとに出力します。");
+
+    if !io::stdin().is_terminal() {
+        return Ok(true);
+    }
+
+    print!("{}", messages::translate("続行しますか？ [y/N] "));
+    if let Err(error) = io::stdout().flush() {
+        return Err(log::make_error!("確認を表示できませんでした。")
+            .with(&error)
+            .as_errors());
+    }
+    let mut answer = String::new();
+    if let Err(error) = io::stdin().read_line(&mut answer) {
+        return Err(log::make_error!("確認の回答を読み込めませんでした。")
+            .with(&error)
+            .as_errors());
+    }
+
+    Ok(matches!(answer.trim(), "y" | "Y" | "yes"))
+}
+
+/// 他の環境のハッシュファイルを取り込む。
+/// ハッシュファイルはディスクのグループの出力フォルダに取り込む。
+fn run_sync(run_options: &RunOptions) -> Result<(), Errors> {
+    // 出力フォルダの作成
+    for output_folder in run_options.output_folders() {
+        hash_file::ensure_output_folder(output_folder)?;
+    }
+    // ハッシュファイルを取り込む
+    sync::sync_hash_files(
+        |group| run_options.output_folder_of(group),
+        run_options.sync_source(),
+    )?;
+    // ハッシュファイルを統合する
+    for output_folder in run_options.output_folders() {
+        merged_hash_file::integrate_hash_files(output_folder)?;
+    }
+
+    Ok(())
+}
+
+/// 2つのグループのハッシュファイルを比較する。
+fn run_compare(run_options: &RunOptions) -> Result<(), Errors> {
+    let (first_group, second_group) = run_options.compared_groups();
+    compare::compare_groups(
+        run_options.output_folder_of(first_group),
+        run_options.output_folder_of(second_group),
+        first_group,
+        second_group,
+        run_options.fix_list_folder(),
+        run_options.preferred_group(),
+    )
+}
+
+/// 削除した行をハッシュファイルに戻す。
+/// 保存ファイルの名前のディスクIDから、戻す先のグループの出力フォルダを決める。
+fn run_restore_trimmed(run_options: &RunOptions) -> Result<(), Errors> {
+    let mut restored_output_folders: Vec<&Path> = vec![];
+    for trimmed_filepath in run_options.trimmed_filepaths() {
+        let disk_id = trimmed::disk_id_of(trimmed_filepath)?;
+        let output_folder = run_options.output_folder_of(disk_id.chars().next().unwrap());
+        trimmed::restore_trimmed_hash_info(output_folder, trimmed_filepath)?;
+        if !restored_output_folders.contains(&output_folder) {
+            restored_output_folders.push(output_folder);
+        }
+    }
+    // ハッシュファイルを統合する
+    for output_folder in restored_output_folders {
+        merged_hash_file::integrate_hash_files(output_folder)?;
+    }
+
+    Ok(())
+}
+
+/// ディスクを封印する。
+/// 封印はディスクのグループの出力フォルダに記録する。
+fn run_seal(run_options: &RunOptions) -> Result<(), Errors> {
+    let disks = disk_output_folders(run_options, run_options.seal_disk_ids())?;
+    let mut errors = vec![];
+    for (output_folder, disk_ids) in group_by_output_folder(disks) {
+        if let Err(mut seal_errors) = seal::seal_disks(output_folder, &disk_ids) {
+            errors.append(&mut seal_errors);
+        }
+    }
+
+    if errors.len() == 0 {
+        Ok(())
+    } else {
+        Err(errors)
+    }
+}
+
+/// 全ての必須ファイルがハッシュファイルにあるか確認する。
+fn run_check_pinned(run_options: &RunOptions) -> Result<(), Errors> {
+    pinned::check_pinned_files(
+        run_options.output_folder(),
+        run_options.config_folder(),
+        None,
+    )?;
+    log::info("全ての必須ファイルがあります。");
+
+    Ok(())
+}
+
+/// ディスクのファイルを更新日時で監査する。
+fn run_retention(run_options: &RunOptions) -> Result<(), Errors> {
+    // フィルター設定を読み込んで一覧にする
+    let filters = filter::load_filters(run_options)?;
+    // ディスク情報を一覧にする
+    let disk_info_list = disk::list_disk_info(run_options)?;
+
+    retention::audit_retention(
+        run_options.output_folder(),
+        &disk_info_list,
+        &filters,
+        &run_options.retention_policy(),
+    )
+}
+
+/// 2つのフォルダのファイルを比較する。
+fn run_compare_dirs(run_options: &RunOptions) -> Result<(), Errors> {
+    // フィルター設定を読み込んで一覧にする
+    let filters = filter::load_filters(run_options)?;
+    let (first_dir, second_dir) = run_options.compared_dirs();
+
+    compare_dirs::compare_dirs(
+        first_dir,
+        second_dir,
+        &filters,
+        run_options.algorithm().unwrap_or(HashAlgorithm::Md5),
+        run_options.buffer_size().unwrap_or(calc::BUFFER_SIZE),
+    )
+}
+
+/// ファイルをコピーしてコピー先のハッシュファイルに記録する。
+fn run_copy(run_options: &RunOptions) -> Result<(), Errors> {
+    // フィルター設定を読み込んで一覧にする
+    let filters = filter::load_filters(run_options)?;
+    let (source_folder, destination_folders) = run_options.copy_folders();
+
+    copy::copy_files(
+        run_options.output_folder(),
+        run_options.registry_filepath(),
+        source_folder,
+        destination_folders,
+        &filters,
+        run_options.verify(),
+        run_options.algorithm(),
+        run_options.buffer_size().unwrap_or(calc::BUFFER_SIZE),
+    )?;
+    // 検証した場合はハッシュファイルに追記したので統合する
+    if run_options.verify() {
+        merged_hash_file::integrate_hash_files(run_options.output_folder())?;
+    }
+
+    Ok(())
+}
+
+/// ハッシュファイルを統合する。
+/// 作り直す指定なら既存の統合ハッシュファイルを削除してから統合する。
+fn run_merge(run_options: &RunOptions) -> Result<(), Errors> {
+    // グループごとの出力フォルダも統合する
+    for output_folder in run_options.output_folders() {
+        if run_options.rebuild() {
+            merged_hash_file::remove_merged_hash_files(output_folder)?;
+        }
+        merged_hash_file::integrate_hash_files(output_folder)?;
+    }
+
+    Ok(())
+}
+
+/// グループごとの容量を集計する。
+/// グループが指定されなければハッシュファイルがある全てのグループを集計する。
+fn run_usage(run_options: &RunOptions) -> Result<(), Errors> {
+    let groups = match run_options.usage_groups() {
+        groups if groups.len() > 0 => groups,
+        _ => usage::list_groups(&run_options.output_folders())?,
+    };
+    if groups.len() == 0 {
+        return Err(log::make_error!("ハッシュファイルがありません。").as_errors());
+    }
+
+    let groups: Vec<(char, &Path)> = groups
+        .into_iter()
+        .map(|group| (group, run_options.output_folder_of(group)))
+        .collect();
+    usage::report_usage(&groups)
+}
+
+/// グループごとに、同じ内容のファイルの組を出力する。
+/// グループが指定されなければハッシュファイルのある全てのグループを対象にする。
+fn run_dupes(run_options: &RunOptions) -> Result<(), Errors> {
+    let groups = match run_options.dupes_groups() {
+        groups if groups.len() > 0 => groups,
+        _ => usage::list_groups(&run_options.output_folders())?,
+    };
+    if groups.len() == 0 {
+        return Err(log::make_error!("ハッシュファイルがありません。").as_errors());
+    }
+
+    let groups: Vec<(char, &Path)> = groups
+        .into_iter()
+        .map(|group| (group, run_options.output_folder_of(group)))
+        .collect();
+    dupes::report_duplicates(&groups)
+}
+
+/// md5sum互換のファイルをディスクのハッシュファイルに取り込む。
+fn run_import_sums(run_options: &RunOptions) -> Result<(), Errors> {
+    let (sum_filepath, disk_id) = run_options.import_sums_target();
+    let output_folder = run_options.output_folder_of(disk_id.chars().next().unwrap());
+    coreutils::import_sum_file(
+        output_folder,
+        sum_filepath,
+        disk_id,
+        run_options.algorithm(),
+    )?;
+    merged_hash_file::integrate_hash_files(output_folder)
+}
+
+/// ハッシュファイルから、ディスクにないファイルの行を削除する。
+/// 1台のディスクで問題が発生しても他のディスクは処理する。
+fn run_prune(run_options: &RunOptions) -> Result<(), Errors> {
+    let disk_info_list = disk::list_disk_info(run_options)?;
+    let mut errors = vec![];
+    let mut pruned_output_folders: Vec<&Path> = vec![];
+    for disk_info in disk_info_list.iter() {
+        let output_folder = run_options.output_folder_of(disk_info.group());
+        let filters = filter::load_group_filters(run_options, disk_info.group())?;
+        match prune::prune_hash_file(
+            output_folder,
+            disk_info,
+            &filters,
+            run_options.report_only(),
+        ) {
+            Ok(0) => {}
+            Ok(_) => {
+                if !pruned_output_folders.contains(&output_folder) {
+                    pruned_output_folders.push(output_folder);
+                }
+            }
+            Err(mut prune_errors) => errors.append(&mut prune_errors),
+        }
+    }
+    // 行を削除した出力フォルダは統合ハッシュファイルを作り直す
+    for output_folder in pruned_output_folders {
+        merged_hash_file::integrate_hash_files(output_folder)?;
+    }
+
+    if errors.len() == 0 {
+        Ok(())
+    } else {
+        Err(errors)
+    }
+}
+
+/// 中断された実行が残したファイルを削除する。
+/// 一時ファイルは起動時に削除しているので、ハッシュファイルのバックアップを削除する。
+fn run_clean(run_options: &RunOptions) -> Result<(), Errors> {
+    for output_folder in run_options.output_folders() {
+        hash_file::remove_leftover_backups(output_folder)?;
+    }
+
+    Ok(())
+}
+
+/// ハッシュファイルの重複した行を削除する。
+/// ディスクIDが指定されなければ全ての出力フォルダのハッシュファイルを対象にする。
+fn run_dedup(run_options: &RunOptions) -> Result<(), Errors> {
+    let disks = disk_output_folders(run_options, run_options.dedup_disk_ids())?;
+    let mut errors = vec![];
+    for (output_folder, disk_ids) in group_by_output_folder(disks) {
+        if let Err(mut dedup_errors) = dedup::dedup_hash_files(output_folder, &disk_ids) {
+            errors.append(&mut dedup_errors);
+        }
+        merged_hash_file::integrate_hash_files(output_folder)?;
+    }
+
+    if errors.len() == 0 {
+        Ok(())
+    } else {
+        Err(errors)
+    }
+}
+
+/// 標準入力などのハッシュを計算する。
+fn run_hash(run_options: &RunOptions) -> Result<(), Errors> {
+    let target = run_options.stream_target();
+    let recorded = target.is_some();
+
+    stream_hash::hash_streams(
+        run_options.output_folder(),
+        run_options.stream_inputs(),
+        target,
+        run_options.algorithm(),
+        run_options.buffer_size().unwrap_or(calc::BUFFER_SIZE),
+    )?;
+    // ハッシュファイルに記録した場合は統合する
+    if recorded {
+        merged_hash_file::integrate_hash_files(run_options.output_folder())?;
+    }
+
     Ok(())
 }
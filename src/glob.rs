@@ -0,0 +1,117 @@
+use regex::Regex;
+
+/// フィルターでglobパターンを使う場合の接頭辞
+pub const GLOB_PREFIX: &str = "glob:";
+
+/// globパターンをディスクルートからの相対パス全体に一致する正規表現にする。
+/// "**"は0個以上のフォルダ、"*"と"?"はスラッシュ以外の0文字以上と1文字、
+/// "[...]"は文字クラス("[!...]"は否定)、"{a,b}"はいずれか、"\"は次の1文字そのものに一致する。
+/// パターンが不正であればエラーメッセージを返す。
+pub fn to_regex(glob: &str) -> Result<Regex, &'static str> {
+    let pattern = format!("^{}$", translate(glob)?);
+    Regex::new(&pattern).map_err(|_| "globパターンが不正です。")
+}
+
+/// rsyncのフィルターパターンをディスクルートからの相対パスに一致する正規表現にする。
+/// "/"から始まるパターンはディスクルートから、それ以外はどの深さのフォルダからでも一致させる。
+/// 一致したフォルダの配下にも一致し、"/"で終わるパターンはフォルダの配下にだけ一致する。
+/// ワイルドカードの書き方はglobパターンと同じ。
+pub fn rsync_to_regex(rsync_pattern: &str) -> Result<Regex, &'static str> {
+    let (anchored, rest) = match rsync_pattern.strip_prefix('/') {
+        Some(rest) => (true, rest),
+        None => (false, rsync_pattern),
+    };
+    let (folder_only, rest) = match rest.strip_suffix('/') {
+        Some(rest) => (true, rest),
+        None => (false, rest),
+    };
+    let glob = if anchored || rest.starts_with("**/") {
+        rest.to_string()
+    } else {
+        format!("**/{}", rest)
+    };
+
+    let pattern = if folder_only {
+        format!("^{}/.*$", translate(&glob)?)
+    } else {
+        format!("^{}(?:/.*)?$", translate(&glob)?)
+    };
+    Regex::new(&pattern).map_err(|_| "globパターンが不正です。")
+}
+
+/// globパターンを前後の"^"と"$"を除いた正規表現の文字列にする。
+fn translate(glob: &str) -> Result<String, &'static str> {
+    if glob.len() == 0 {
+        return Err("globパターンがありません。");
+    }
+
+    let chars: Vec<char> = glob.chars().collect();
+    let mut pattern = String::new();
+    // "{a,b}"の中にいる深さ
+    let mut brace_depth = 0;
+    let mut i = 0;
+    while i < chars.len() {
+        let c = chars[i];
+        match c {
+            '*' if chars.get(i + 1) == Some(&'*') => {
+                let starts_segment = i == 0 || chars[i - 1] == '/';
+                let ends_segment = i + 2 == chars.len() || chars[i + 2] == '/';
+                if !starts_segment || !ends_segment {
+                    return Err("globパターンの\"**\"はフォルダ名全体に書いてください。");
+                }
+                if i + 2 == chars.len() {
+                    // 末尾の"**"は全てに一致する
+                    pattern.push_str(".*");
+                    i += 2;
+                } else {
+                    // "**/"は0個以上のフォルダに一致する
+                    pattern.push_str("(?:[^/]*/)*");
+                    i += 3;
+                }
+                continue;
+            }
+            '*' => pattern.push_str("[^/]*"),
+            '?' => pattern.push_str("[^/]"),
+            '[' => {
+                let end = match chars[i + 1..].iter().skip(1).position(|&c| c == ']') {
+                    Some(position) => i + 2 + position,
+                    None => return Err("globパターンの\"[\"が閉じていません。"),
+                };
+                let class: String = chars[i + 1..end].iter().collect();
+                let class = match class.strip_prefix('!') {
+                    Some(negated) => format!("^{}", negated),
+                    None => class,
+                };
+                pattern.push('[');
+                pattern.push_str(&class.replace('\\', "\\\\").replace('[', "\\["));
+                pattern.push(']');
+                i = end + 1;
+                continue;
+            }
+            '{' => {
+                brace_depth += 1;
+                pattern.push_str("(?:");
+            }
+            ',' if brace_depth > 0 => pattern.push('|'),
+            '}' if brace_depth > 0 => {
+                brace_depth -= 1;
+                pattern.push(')');
+            }
+            '\\' => match chars.get(i + 1) {
+                Some(escaped) => {
+                    pattern.push_str(&regex::escape(&escaped.to_string()));
+                    i += 2;
+                    continue;
+                }
+                None => return Err("globパターンが\"\\\"で終わっています。"),
+            },
+            _ => pattern.push_str(&regex::escape(&c.to_string())),
+        }
+        i += 1;
+    }
+    if brace_depth > 0 {
+        return Err("globパターンの\"{\"が閉じていません。");
+    }
+
+    Ok(pattern)
+}
@@ -0,0 +1,256 @@
+use std::fmt;
+use std::mem;
+use std::ops::Deref;
+
+use sha2::Digest as _;
+
+/// ハッシュの最大のバイト数
+const MAX_DIGEST_LENGTH: usize = 64;
+
+/// ツリーハッシュで1つのハッシュにまとめる塊のバイト数
+pub const TREE_CHUNK_SIZE: u64 = 64 << 20;
+
+/// ハッシュアルゴリズム
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum HashAlgorithm {
+    Md5,
+    Sha1,
+    Sha256,
+    Sha512,
+    Blake2b,
+    XxHash64,
+    Sha256Tree,
+}
+
+impl HashAlgorithm {
+    /// アルゴリズム名からアルゴリズムを返す。
+    /// アルゴリズム名でなければNoneを返す。
+    pub fn from_name(name: &str) -> Option<HashAlgorithm> {
+        match name {
+            "md5" => Some(HashAlgorithm::Md5),
+            "sha1" => Some(HashAlgorithm::Sha1),
+            "sha256" => Some(HashAlgorithm::Sha256),
+            "sha512" => Some(HashAlgorithm::Sha512),
+            "blake2b" => Some(HashAlgorithm::Blake2b),
+            "xxhash64" => Some(HashAlgorithm::XxHash64),
+            "sha256-tree" => Some(HashAlgorithm::Sha256Tree),
+            _ => None,
+        }
+    }
+
+    /// アルゴリズム名を返す。
+    pub fn name(&self) -> &'static str {
+        match self {
+            HashAlgorithm::Md5 => "md5",
+            HashAlgorithm::Sha1 => "sha1",
+            HashAlgorithm::Sha256 => "sha256",
+            HashAlgorithm::Sha512 => "sha512",
+            HashAlgorithm::Blake2b => "blake2b",
+            HashAlgorithm::XxHash64 => "xxhash64",
+            HashAlgorithm::Sha256Tree => "sha256-tree",
+        }
+    }
+
+    /// ハッシュのバイト数を返す。
+    pub fn digest_length(&self) -> usize {
+        match self {
+            HashAlgorithm::Md5 => 16,
+            HashAlgorithm::Sha1 => 20,
+            HashAlgorithm::Sha256 => 32,
+            HashAlgorithm::Sha512 => 64,
+            HashAlgorithm::Blake2b => 64,
+            HashAlgorithm::XxHash64 => 8,
+            HashAlgorithm::Sha256Tree => 32,
+        }
+    }
+
+    /// ファイルを塊に分けて、塊ごとに並行して計算できるアルゴリズムかを返す。
+    pub fn supports_chunks(&self) -> bool {
+        *self == HashAlgorithm::Sha256Tree
+    }
+
+    /// 計算の途中経過を保存して再開できるアルゴリズムかを返す。
+    /// ツリーハッシュは計算し終えた塊のハッシュから再開できる。
+    /// 他のアルゴリズムは内部状態を取り出す手段がないため再開できない。
+    pub fn supports_resume(&self) -> bool {
+        *self == HashAlgorithm::Sha256Tree
+    }
+
+    /// ハッシュ計算のコンテキストを作成する。
+    pub fn context(&self) -> HashContext {
+        match self {
+            HashAlgorithm::Md5 => HashContext::Md5(md5::Context::new()),
+            HashAlgorithm::Sha1 => HashContext::Sha1(sha1::Sha1::new()),
+            HashAlgorithm::Sha256 => HashContext::Sha256(sha2::Sha256::new()),
+            HashAlgorithm::Sha512 => HashContext::Sha512(sha2::Sha512::new()),
+            HashAlgorithm::Blake2b => HashContext::Blake2b(blake2::Blake2b512::new()),
+            HashAlgorithm::XxHash64 => HashContext::XxHash64(xxhash_rust::xxh64::Xxh64::new(0)),
+            HashAlgorithm::Sha256Tree => HashContext::Sha256Tree(TreeContext::new()),
+        }
+    }
+}
+
+/// ハッシュ計算のコンテキスト
+pub enum HashContext {
+    Md5(md5::Context),
+    Sha1(sha1::Sha1),
+    Sha256(sha2::Sha256),
+    Sha512(sha2::Sha512),
+    Blake2b(blake2::Blake2b512),
+    XxHash64(xxhash_rust::xxh64::Xxh64),
+    Sha256Tree(TreeContext),
+}
+
+impl HashContext {
+    /// データをハッシュ計算に使用する。
+    pub fn consume<T: AsRef<[u8]>>(&mut self, data: T) {
+        let data = data.as_ref();
+        match self {
+            HashContext::Md5(context) => context.consume(data),
+            HashContext::Sha1(context) => context.update(data),
+            HashContext::Sha256(context) => context.update(data),
+            HashContext::Sha512(context) => context.update(data),
+            HashContext::Blake2b(context) => context.update(data),
+            HashContext::XxHash64(context) => context.update(data),
+            HashContext::Sha256Tree(context) => context.consume(data),
+        }
+    }
+
+    /// ハッシュを計算する。
+    pub fn compute(self) -> Digest {
+        match self {
+            HashContext::Md5(context) => Digest::from_slice(&context.compute().0),
+            HashContext::Sha1(context) => Digest::from_slice(&context.finalize()),
+            HashContext::Sha256(context) => Digest::from_slice(&context.finalize()),
+            HashContext::Sha512(context) => Digest::from_slice(&context.finalize()),
+            HashContext::Blake2b(context) => Digest::from_slice(&context.finalize()),
+            // 正規の表現であるビッグエンディアンにする
+            HashContext::XxHash64(context) => Digest::from_slice(&context.digest().to_be_bytes()),
+            HashContext::Sha256Tree(context) => context.compute(),
+        }
+    }
+
+    /// 途中経過として保存できる内部状態を返す。
+    /// 計算し終えた塊のバイト数と、塊ごとのハッシュを返す。計算中の塊は含めない。
+    /// 途中経過から再開できないアルゴリズムであればNoneを返す。
+    pub fn resumable_state(&self) -> Option<(u64, &[Digest])> {
+        match self {
+            HashContext::Sha256Tree(context) => Some((
+                context.chunk_hashes.len() as u64 * TREE_CHUNK_SIZE,
+                &context.chunk_hashes,
+            )),
+            _ => None,
+        }
+    }
+
+    /// 計算し終えた塊ごとのハッシュからコンテキストを復元する。
+    /// 再開する位置は塊の数と塊のバイト数を掛けた位置になる。
+    /// 途中経過から再開できないアルゴリズムであればNoneを返す。
+    pub fn resume(algorithm: HashAlgorithm, chunk_hashes: Vec<Digest>) -> Option<HashContext> {
+        match algorithm {
+            HashAlgorithm::Sha256Tree => Some(HashContext::Sha256Tree(TreeContext {
+                chunk_hashes,
+                ..TreeContext::new()
+            })),
+            _ => None,
+        }
+    }
+}
+
+/// ツリーハッシュの計算のコンテキスト
+/// ファイルを先頭から決まったバイト数の塊に分けて塊ごとのSHA-256を計算し、
+/// 塊のハッシュを順に連結したデータのSHA-256をファイルのハッシュとする。
+/// 塊ごとに独立して計算できるので、巨大なファイルは塊を並行して読み込んで計算できる。
+pub struct TreeContext {
+    /// 計算し終えた塊のハッシュ
+    /// 途中経過として保存できるよう、連結して計算するのはファイルの終わりまで待つ。
+    chunk_hashes: Vec<Digest>,
+    /// 計算中の塊のコンテキスト
+    chunk: sha2::Sha256,
+    /// 計算中の塊に使用したバイト数
+    chunk_size: u64,
+}
+
+impl TreeContext {
+    /// 新しいコンテキストを作成する。
+    fn new() -> TreeContext {
+        TreeContext {
+            chunk_hashes: vec![],
+            chunk: sha2::Sha256::new(),
+            chunk_size: 0,
+        }
+    }
+
+    /// データを塊の区切りで分けてハッシュ計算に使用する。
+    fn consume(&mut self, mut data: &[u8]) {
+        while data.len() > 0 {
+            let size = ((TREE_CHUNK_SIZE - self.chunk_size) as usize).min(data.len());
+            self.chunk.update(&data[..size]);
+            self.chunk_size += size as u64;
+            data = &data[size..];
+            if self.chunk_size == TREE_CHUNK_SIZE {
+                self.finish_chunk();
+            }
+        }
+    }
+
+    /// 計算中の塊のハッシュを連結する。
+    fn finish_chunk(&mut self) {
+        let chunk = mem::replace(&mut self.chunk, sha2::Sha256::new());
+        self.chunk_hashes
+            .push(Digest::from_slice(&chunk.finalize()));
+        self.chunk_size = 0;
+    }
+
+    /// ハッシュを計算する。
+    /// 空のファイルは塊がないので、空のデータのSHA-256になる。
+    fn compute(mut self) -> Digest {
+        if self.chunk_size > 0 {
+            self.finish_chunk();
+        }
+        TreeContext::combine(&self.chunk_hashes)
+    }
+
+    /// 塊ごとに計算したハッシュを順に連結して、ファイルのハッシュを計算する。
+    /// 塊のハッシュはSHA-256で計算したものを渡す。
+    pub fn combine(chunk_hashes: &[Digest]) -> Digest {
+        let mut root = sha2::Sha256::new();
+        for chunk_hash in chunk_hashes {
+            root.update(&chunk_hash[..]);
+        }
+        Digest::from_slice(&root.finalize())
+    }
+}
+
+/// ハッシュ
+/// アルゴリズムによってバイト数が異なるが、コピーして扱えるよう最大のバイト数の配列に格納する。
+#[derive(Clone, Copy, PartialEq, Eq, Hash, PartialOrd, Ord)]
+pub struct Digest {
+    bytes: [u8; MAX_DIGEST_LENGTH],
+    length: usize,
+}
+
+impl Digest {
+    /// バイト列からハッシュを作成する。
+    /// 最大のバイト数を超える部分は切り捨てる。
+    pub fn from_slice(slice: &[u8]) -> Digest {
+        let length = slice.len().min(MAX_DIGEST_LENGTH);
+        let mut bytes = [0u8; MAX_DIGEST_LENGTH];
+        bytes[..length].copy_from_slice(&slice[..length]);
+        Digest { bytes, length }
+    }
+}
+
+impl Deref for Digest {
+    type Target = [u8];
+
+    fn deref(&self) -> &[u8] {
+        &self.bytes[..self.length]
+    }
+}
+
+impl fmt::Debug for Digest {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", hex::encode(self.to_vec()))
+    }
+}
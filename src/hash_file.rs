@@ -1,14 +1,36 @@
 use std::collections::{HashMap, HashSet};
 use std::fs;
 use std::fs::File;
+use std::io::{BufRead, BufReader};
 use std::path::{Path, PathBuf};
 
 use hex;
-use md5::Digest;
 
+use crate::atomic_write;
+use crate::hash_algorithm::{Digest, HashAlgorithm};
 use crate::log::{self, Errors};
 use crate::target_file::TargetFile;
 
+/// ハッシュファイルの1行目に書くアルゴリズムのヘッダーの接頭辞
+/// ヘッダーがないハッシュファイルはMD5で計算したものとする。
+const ALGORITHM_HEADER_PREFIX: &str = "#algorithm=";
+
+/// ハッシュファイルのバックアップの拡張子
+const BACKUP_EXTENSION: &str = ".backup";
+
+/// パスをエスケープした行の先頭に付ける文字
+/// 正規化ファイルパスは'/'で始まらないので、エスケープしていない以前の形式の行と区別できる。
+const ESCAPED_PATH_PREFIX: char = '/';
+
+/// ハッシュを計算した時点のファイルのバイト数と更新日時
+/// ハッシュファイルの行の後ろにタブ区切りで記録する。
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct FileStamp {
+    pub size: u64,
+    /// 更新日時のUNIX時間の秒数
+    pub modified: u64,
+}
+
 /// 出力フォルダを作成する。
 pub fn ensure_output_folder(output_folder: &Path) -> Result<(), Errors> {
     match fs::create_dir_all(output_folder) {
@@ -23,23 +45,161 @@ pub fn ensure_output_folder(output_folder: &Path) -> Result<(), Errors> {
 }
 
 /// ハッシュファイルを読み込んでハッシュ情報マップを作成する。
+/// 同じパスの行が重複していれば警告し、最後の行を使う。
 pub fn load_hash_info(hash_filepath: &Path) -> Result<HashMap<PathBuf, Digest>, Errors> {
-    // ハッシュファイルがなければ空のマップを返す
+    let (hash_info_map, duplicates) = load_hash_info_with_duplicates(hash_filepath)?;
+
+    if duplicates.len() > 0 {
+        let number_of_conflicts = duplicates
+            .iter()
+            .filter(|(target_filepath, hash)| hash_info_map.get(target_filepath) != Some(hash))
+            .count();
+        log::warn(
+            format!(
+                "同じパスの行が{}件重複しています。うち{}件はハッシュが異なります。最後の行を使用します。: {}",
+                duplicates.len(),
+                number_of_conflicts,
+                hash_filepath.to_str().unwrap()
+            )
+            .as_str(),
+        );
+    }
+
+    Ok(hash_info_map)
+}
+
+/// ハッシュファイルを読み込んでハッシュ情報マップを作成する。
+/// 同じパスの行が重複していれば最後の行を使い、使わなかった行の一覧も返す。
+pub fn load_hash_info_with_duplicates(
+    hash_filepath: &Path,
+) -> Result<(HashMap<PathBuf, Digest>, Vec<(PathBuf, Digest)>), Errors> {
+    let mut hash_info_map = HashMap::new();
+    let mut duplicates = vec![];
+    for (target_filepath, hash, _) in load_hash_file_lines(hash_filepath)? {
+        if let Some(previous_hash) = hash_info_map.insert(target_filepath.clone(), hash) {
+            duplicates.push((target_filepath, previous_hash));
+        }
+    }
+
+    Ok((hash_info_map, duplicates))
+}
+
+/// ハッシュファイルを読み込んで、ファイルごとに記録されたバイト数と更新日時のマップを作成する。
+/// 同じパスの行が重複していれば最後の行を使う。バイト数と更新日時がない行は含めない。
+pub fn load_file_stamps(hash_filepath: &Path) -> Result<HashMap<PathBuf, FileStamp>, Errors> {
+    let mut stamp_map = HashMap::new();
+    for (target_filepath, _, stamp) in load_hash_file_lines(hash_filepath)? {
+        match stamp {
+            Some(stamp) => stamp_map.insert(target_filepath, stamp),
+            None => stamp_map.remove(&target_filepath),
+        };
+    }
+
+    Ok(stamp_map)
+}
+
+/// ハッシュファイルを読み込んで、行ごとの対象ファイル、ハッシュ、バイト数と更新日時の一覧を作成する。
+fn load_hash_file_lines(
+    hash_filepath: &Path,
+) -> Result<Vec<(PathBuf, Digest, Option<FileStamp>)>, Errors> {
+    // ハッシュファイルがなければ空の一覧を返す
     if !hash_filepath.is_file() {
-        return Ok(HashMap::with_capacity(0));
+        return Ok(vec![]);
     }
 
     let hash_file_bytes = read_hash_file(hash_filepath)?;
     let hash_file_contents = decode_hash_file_contents(hash_file_bytes)?;
 
-    let mut hash_info_map = HashMap::new();
-    for (i, line) in hash_file_contents.lines().enumerate() {
-        let (target_filepath, hash) =
-            log::with_line_number(parse_hash_file_line(line), hash_filepath, i + 1)?;
-        hash_info_map.insert(target_filepath, hash);
+    // 1行目がヘッダーならアルゴリズムを取得し、ハッシュの長さを確認する
+    let mut lines = hash_file_contents.lines().enumerate().peekable();
+    let algorithm = match lines
+        .peek()
+        .and_then(|(_, line)| parse_algorithm_header(line))
+    {
+        Some(algorithm) => {
+            lines.next();
+            log::with_line_number(algorithm, hash_filepath, 1)?
+        }
+        None => HashAlgorithm::Md5,
+    };
+
+    let mut hash_file_lines = vec![];
+    for (i, line) in lines {
+        hash_file_lines.push(log::with_line_number(
+            parse_hash_file_line(line, algorithm),
+            hash_filepath,
+            i + 1,
+        )?);
     }
 
-    Ok(hash_info_map)
+    Ok(hash_file_lines)
+}
+
+/// ハッシュファイルのアルゴリズムを返す。
+/// ハッシュファイルがなければNoneを返す。
+pub fn read_algorithm(hash_filepath: &Path) -> Result<Option<HashAlgorithm>, Errors> {
+    if !hash_filepath.is_file() {
+        return Ok(None);
+    }
+
+    // ヘッダーは1行目にしかないので全体は読まない
+    let mut first_line = String::new();
+    if let Err(error) =
+        File::open(hash_filepath).and_then(|file| BufReader::new(file).read_line(&mut first_line))
+    {
+        return Err(log::make_error!(
+            "ハッシュファイルが読み込めませんでした。: {}",
+            hash_filepath.to_str().unwrap()
+        )
+        .with(&error)
+        .as_errors());
+    }
+
+    match parse_algorithm_header(first_line.trim_end()) {
+        Some(algorithm) => log::with_line_number(algorithm, hash_filepath, 1).map(Some),
+        None => Ok(Some(HashAlgorithm::Md5)),
+    }
+}
+
+/// ハッシュファイルで使うアルゴリズムを決める。
+/// ハッシュファイルがあればそのアルゴリズムを使い、指定されたアルゴリズムと異なればエラーにする。
+/// ハッシュファイルがなければ指定されたアルゴリズムを使い、指定がなければMD5とする。
+pub fn resolve_algorithm(
+    hash_filepath: &Path,
+    requested: Option<HashAlgorithm>,
+) -> Result<HashAlgorithm, Errors> {
+    match (read_algorithm(hash_filepath)?, requested) {
+        (Some(recorded), Some(requested)) if recorded != requested => Err(log::make_error!(
+            "ハッシュファイルのアルゴリズム{}と指定されたアルゴリズム{}が異なります。: {}",
+            recorded.name(),
+            requested.name(),
+            hash_filepath.to_str().unwrap()
+        )
+        .as_errors()),
+        (Some(recorded), _) => Ok(recorded),
+        (None, requested) => Ok(requested.unwrap_or(HashAlgorithm::Md5)),
+    }
+}
+
+/// ハッシュファイルの行がアルゴリズムのヘッダーであればアルゴリズムを返す。
+/// ヘッダーでなければNoneを返す。
+pub fn parse_algorithm_header(line: &str) -> Option<Result<HashAlgorithm, Errors>> {
+    let name = line.strip_prefix(ALGORITHM_HEADER_PREFIX)?;
+    Some(match HashAlgorithm::from_name(name) {
+        Some(algorithm) => Ok(algorithm),
+        None => Err(
+            log::make_error!("ハッシュファイルのアルゴリズムが不明です。: {}", name).as_errors(),
+        ),
+    })
+}
+
+/// アルゴリズムのヘッダー行を返す。
+/// MD5なら以前の形式と同じになるようヘッダーを付けない。
+pub fn algorithm_header(algorithm: HashAlgorithm) -> String {
+    match algorithm {
+        HashAlgorithm::Md5 => String::new(),
+        _ => format!("{}{}\n", ALGORITHM_HEADER_PREFIX, algorithm.name()),
+    }
 }
 
 /// ハッシュファイルを読み込む
@@ -68,34 +228,106 @@ fn decode_hash_file_contents(hash_file_bytes: Vec<u8>) -> Result<String, Errors>
 }
 
 /// ハッシュファイルの行をパースする。
-fn parse_hash_file_line(line: &str) -> Result<(PathBuf, Digest), Errors> {
+fn parse_hash_file_line(
+    line: &str,
+    algorithm: HashAlgorithm,
+) -> Result<(PathBuf, Digest, Option<FileStamp>), Errors> {
+    let (line, stamp) = split_file_stamp(line);
     let (target_filepath, hash) = get_filepath_and_hash(line)?;
-    let target_filepath = PathBuf::from(target_filepath);
-    let hash = decode_hash(hash)?;
+    let target_filepath = PathBuf::from(unescape_path(target_filepath)?);
+    let hash = decode_hash(hash, algorithm)?;
 
-    Ok((target_filepath, hash))
+    Ok((target_filepath, hash, stamp))
+}
+
+/// ハッシュファイルの行から後ろにタブ区切りで記録されたバイト数と更新日時を分ける。
+/// 以前の形式の行など、バイト数と更新日時がなければ行全体とNoneを返す。
+fn split_file_stamp(line: &str) -> (&str, Option<FileStamp>) {
+    let mut fields = line.rsplitn(3, '\t');
+    match (fields.next(), fields.next(), fields.next()) {
+        (Some(modified), Some(size), Some(rest)) => {
+            match (size.parse::<u64>(), modified.parse::<u64>()) {
+                (Ok(size), Ok(modified)) => (rest, Some(FileStamp { size, modified })),
+                _ => (line, None),
+            }
+        }
+        _ => (line, None),
+    }
 }
 
 /// ハッシュファイルの行から対象ファイルとハッシュを抽出する。
+/// 代替データストリームのパスは':'を含むので最後の':'で分ける。
 fn get_filepath_and_hash(line: &str) -> Result<(&str, &str), Errors> {
-    match line.split_once(':') {
+    match line.rsplit_once(':') {
         Some((target_filepath, hash)) => Ok((target_filepath, hash)),
         None => Err(log::make_error!("ハッシュファイルの形式が不正です。").as_errors()),
     }
 }
 
+/// ハッシュファイルに出力するパスを返す。
+/// 改行やタブを含むパスは行の区切りやバイト数と更新日時の区切りと区別できないので、
+/// 先頭に'/'を付け、"\"、改行、復帰、タブを"\\"、"\n"、"\r"、"\t"にエスケープする。
+/// それ以外のパスは以前の形式と同じくそのまま出力する。
+fn escape_path(target_filepath: &str) -> String {
+    if !target_filepath.contains(['\n', '\r', '\t']) {
+        return target_filepath.to_string();
+    }
+
+    let mut escaped = String::from(ESCAPED_PATH_PREFIX);
+    for c in target_filepath.chars() {
+        match c {
+            '\\' => escaped.push_str("\\\\"),
+            '\n' => escaped.push_str("\\n"),
+            '\r' => escaped.push_str("\\r"),
+            '\t' => escaped.push_str("\\t"),
+            c => escaped.push(c),
+        }
+    }
+    escaped
+}
+
+/// ハッシュファイルのパスがエスケープされていれば元に戻す。
+fn unescape_path(target_filepath: &str) -> Result<String, Errors> {
+    let escaped = match target_filepath.strip_prefix(ESCAPED_PATH_PREFIX) {
+        Some(escaped) => escaped,
+        None => return Ok(target_filepath.to_string()),
+    };
+
+    let mut unescaped = String::new();
+    let mut chars = escaped.chars();
+    while let Some(c) = chars.next() {
+        if c != '\\' {
+            unescaped.push(c);
+            continue;
+        }
+        match chars.next() {
+            Some('\\') => unescaped.push('\\'),
+            Some('n') => unescaped.push('\n'),
+            Some('r') => unescaped.push('\r'),
+            Some('t') => unescaped.push('\t'),
+            _ => {
+                return Err(
+                    log::make_error!("ハッシュファイルのパスのエスケープが不正です。").as_errors(),
+                )
+            }
+        }
+    }
+    Ok(unescaped)
+}
+
 /// 文字列のハッシュをバイナリーに変換する。
-fn decode_hash(hash: &str) -> Result<Digest, Errors> {
+/// アルゴリズムのハッシュの長さでなければエラーにする。
+fn decode_hash(hash: &str, algorithm: HashAlgorithm) -> Result<Digest, Errors> {
     match hex::decode(hash) {
         // Vec<u8>をDigestに変換する
-        Ok(hash_vec) => {
-            let mut hash = [0u8; 16];
-            for (i, value) in hash_vec.iter().enumerate() {
-                hash[i] = *value;
-            }
-            let hash = Digest(hash);
-            Ok(hash)
+        Ok(hash_vec) if hash_vec.len() == algorithm.digest_length() => {
+            Ok(Digest::from_slice(&hash_vec))
         }
+        Ok(_) => Err(log::make_error!(
+            "ハッシュの長さが{}のハッシュではありません。",
+            algorithm.name()
+        )
+        .as_errors()),
         Err(_) => Err(log::make_error!("ハッシュファイルの形式が不正です。").as_errors()),
     }
 }
@@ -106,7 +338,7 @@ pub fn backup(hash_filepath: &Path) -> Result<Option<PathBuf>, Errors> {
         return Ok(None);
     }
 
-    let backup_filepath = hash_filepath.with_extension(".backup");
+    let backup_filepath = hash_filepath.with_extension(BACKUP_EXTENSION);
     match fs::copy(hash_filepath, backup_filepath.as_path()) {
         Ok(_) => Ok(Some(backup_filepath)),
         Err(error) => Err(
@@ -117,11 +349,108 @@ pub fn backup(hash_filepath: &Path) -> Result<Option<PathBuf>, Errors> {
     }
 }
 
+/// 出力フォルダに残っている、中断された実行のハッシュファイルのバックアップを削除する。
+/// 元のハッシュファイルがなくなっている場合は、バックアップが唯一の記録なので残して警告する。
+pub fn remove_leftover_backups(output_folder: &Path) -> Result<(), Errors> {
+    let read_dir = match output_folder.read_dir() {
+        Ok(read_dir) => read_dir,
+        Err(error) => {
+            return Err(log::make_error!(
+                "出力フォルダが読み込めません。: {}",
+                output_folder.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors())
+        }
+    };
+
+    let mut number_of_removed = 0;
+    for entry in read_dir.flatten() {
+        let backup_filepath = entry.path();
+        if !backup_filepath.is_file() {
+            continue;
+        }
+        // 拡張子の前に区切りの"."が付くので"ID..backup"の名前になっている
+        let hash_filepath = match backup_filepath
+            .to_str()
+            .and_then(|path| path.strip_suffix(BACKUP_EXTENSION))
+            .and_then(|path| path.strip_suffix('.'))
+        {
+            Some(hash_filepath) => PathBuf::from(hash_filepath),
+            None => continue,
+        };
+        if !hash_filepath.is_file() {
+            log::warn(
+                format!(
+                    "元のハッシュファイルがないバックアップは削除しません。: {}",
+                    backup_filepath.to_str().unwrap()
+                )
+                .as_str(),
+            );
+            continue;
+        }
+        match fs::remove_file(backup_filepath.as_path()) {
+            Ok(_) => number_of_removed += 1,
+            Err(error) => {
+                return Err(log::make_error!(
+                    "ハッシュファイルのバックアップを削除できませんでした。: {}",
+                    backup_filepath.to_str().unwrap()
+                )
+                .with(&error)
+                .as_errors())
+            }
+        }
+    }
+
+    log::info(
+        format!(
+            "ハッシュファイルのバックアップを{}件削除しました。: {}",
+            number_of_removed,
+            output_folder.to_str().unwrap()
+        )
+        .as_str(),
+    );
+
+    Ok(())
+}
+
+/// ハッシュ情報マップから、記録されたバイト数か更新日時が対象ファイルと異なるファイルの情報を削除する。
+/// バイト数と更新日時の記録がない情報は、対象ファイルの現在のバイト数と更新日時を記録する。
+/// 残ったハッシュ情報マップと、削除したファイルの一覧を返す。
+pub fn remove_hash_info_for_changed_file(
+    mut hash_info_map: HashMap<PathBuf, Digest>,
+    stamp_map: &mut HashMap<PathBuf, FileStamp>,
+    target_files: &Vec<TargetFile>,
+) -> (HashMap<PathBuf, Digest>, Vec<PathBuf>) {
+    let mut changed_filepaths = vec![];
+    for target_file in target_files {
+        let target_filepath = target_file.normalized_path();
+        let current_stamp = match target_file.stamp() {
+            Some(current_stamp) if hash_info_map.contains_key(target_filepath) => current_stamp,
+            _ => continue,
+        };
+        match stamp_map.get(target_filepath) {
+            Some(recorded_stamp) if *recorded_stamp != current_stamp => {
+                hash_info_map.remove(target_filepath);
+                stamp_map.remove(target_filepath);
+                changed_filepaths.push(target_filepath.to_path_buf());
+            }
+            Some(_) => {}
+            None => {
+                stamp_map.insert(target_filepath.to_path_buf(), current_stamp);
+            }
+        }
+    }
+
+    (hash_info_map, changed_filepaths)
+}
+
 /// ハッシュ情報マップから対象ファイル一覧に存在しないファイルの情報を削除する。
+/// 残ったハッシュ情報マップと、削除したハッシュ情報のマップを返す。
 pub fn remove_hash_info_for_missing_file(
     mut hash_info_map: HashMap<PathBuf, Digest>,
     target_files: &Vec<TargetFile>,
-) -> HashMap<PathBuf, Digest> {
+) -> (HashMap<PathBuf, Digest>, HashMap<PathBuf, Digest>) {
     let mut exist_keys = HashSet::with_capacity(hash_info_map.len());
     for target_file in target_files {
         if hash_info_map.contains_key(target_file.normalized_path()) {
@@ -137,21 +466,38 @@ pub fn remove_hash_info_for_missing_file(
         }
     }
 
+    let mut removed_hash_info_map = HashMap::with_capacity(remove_keys.len());
     for remove_key in remove_keys {
-        hash_info_map.remove(&remove_key);
+        if let Some(hash) = hash_info_map.remove(&remove_key) {
+            removed_hash_info_map.insert(remove_key, hash);
+        }
     }
 
-    hash_info_map
+    (hash_info_map, removed_hash_info_map)
 }
 
 /// 計算済みのハッシュをファイルに出力する。
+/// アルゴリズムがMD5以外なら1行目にヘッダーを出力する。
 pub fn write_calculated_hash(
     hash_filepath: &Path,
+    algorithm: HashAlgorithm,
     hash_info_map: HashMap<PathBuf, Digest>,
 ) -> Result<(), Errors> {
-    let hash_file_contents = to_hash_file_contents(&hash_info_map);
+    write_calculated_hash_with_stamps(hash_filepath, algorithm, hash_info_map, &HashMap::new())
+}
 
-    match fs::write(hash_filepath, &hash_file_contents) {
+/// 計算済みのハッシュを、記録されたバイト数と更新日時とともにファイルに出力する。
+/// アルゴリズムがMD5以外なら1行目にヘッダーを出力する。
+pub fn write_calculated_hash_with_stamps(
+    hash_filepath: &Path,
+    algorithm: HashAlgorithm,
+    hash_info_map: HashMap<PathBuf, Digest>,
+    stamp_map: &HashMap<PathBuf, FileStamp>,
+) -> Result<(), Errors> {
+    let hash_file_contents =
+        to_hash_file_contents(algorithm_header(algorithm), &hash_info_map, stamp_map);
+
+    match atomic_write::write(hash_filepath, &hash_file_contents) {
         Ok(_) => Ok(()),
         Err(error) => Err(log::make_error!("ハッシュファイルの作成に失敗しました")
             .with(&error)
@@ -160,21 +506,51 @@ pub fn write_calculated_hash(
 }
 
 /// ハッシュ情報マップをハッシュファイルの内容に変換する。
-fn to_hash_file_contents(hash_info_map: &HashMap<PathBuf, Digest>) -> String {
-    let mut hash_file_contents = String::new();
+fn to_hash_file_contents(
+    header: String,
+    hash_info_map: &HashMap<PathBuf, Digest>,
+    stamp_map: &HashMap<PathBuf, FileStamp>,
+) -> String {
+    let mut hash_file_contents = header;
 
-    for (target_filepath, hash) in hash_info_map {
-        hash_file_contents = add_hash_file_line(hash_file_contents, target_filepath, hash);
+    for (target_filepath, hash) in sorted_hash_info(hash_info_map) {
+        hash_file_contents = add_stamped_hash_file_line(
+            hash_file_contents,
+            target_filepath,
+            hash,
+            stamp_map.get(target_filepath),
+        );
     }
 
     hash_file_contents
 }
 
+/// ハッシュ情報マップをパス順に並べる。
+/// 出力するたびに順序が変わらないようにする。
+pub fn sorted_hash_info(hash_info_map: &HashMap<PathBuf, Digest>) -> Vec<(&PathBuf, &Digest)> {
+    let mut hash_info: Vec<(&PathBuf, &Digest)> = hash_info_map.iter().collect();
+    hash_info.sort_by_key(|(target_filepath, _)| *target_filepath);
+    hash_info
+}
+
 /// バッファにハッシュ情報を1行追記する。
-pub fn add_hash_file_line(mut buff: String, target_filepath: &Path, hash: &Digest) -> String {
-    buff.push_str(target_filepath.to_str().unwrap());
+pub fn add_hash_file_line(buff: String, target_filepath: &Path, hash: &Digest) -> String {
+    add_stamped_hash_file_line(buff, target_filepath, hash, None)
+}
+
+/// バッファにハッシュ情報を、バイト数と更新日時があればそれも付けて1行追記する。
+pub fn add_stamped_hash_file_line(
+    mut buff: String,
+    target_filepath: &Path,
+    hash: &Digest,
+    stamp: Option<&FileStamp>,
+) -> String {
+    buff.push_str(escape_path(target_filepath.to_str().unwrap()).as_str());
     buff.push(':');
     buff.push_str(hex::encode(hash.to_vec()).as_str());
+    if let Some(stamp) = stamp {
+        buff.push_str(format!("\t{}\t{}", stamp.size, stamp.modified).as_str());
+    }
     buff.push('\n');
 
     buff
@@ -190,6 +566,27 @@ pub fn delete_backup(backup_filepath: Option<PathBuf>) {
     }
 }
 
+/// 追記する前に、ハッシュファイルがなければアルゴリズムのヘッダーだけを出力する。
+pub fn prepare_hash_file(hash_filepath: &Path, algorithm: HashAlgorithm) -> Result<(), Errors> {
+    if hash_filepath.is_file() {
+        return Ok(());
+    }
+    write_calculated_hash(hash_filepath, algorithm, HashMap::new())
+}
+
+/// 追記したハッシュファイルの内容をディスクに書き出す。
+pub fn sync_hash_file(hash_file: &File, hash_filepath: &Path) -> Result<(), Errors> {
+    match hash_file.sync_all() {
+        Ok(_) => Ok(()),
+        Err(error) => Err(log::make_error!(
+            "ハッシュファイルをディスクに書き出せません。: {}",
+            hash_filepath.to_str().unwrap()
+        )
+        .with(&error)
+        .as_errors()),
+    }
+}
+
 /// ハッシュファイルを追記モードで開く。
 pub fn open_hash_file(hash_file: &Path) -> Result<File, Errors> {
     match File::options().create(true).append(true).open(hash_file) {
@@ -0,0 +1,550 @@
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::UNIX_EPOCH;
+
+use rusqlite::{params, Connection, OptionalExtension};
+
+use crate::hash_algorithm::{Digest, HashAlgorithm};
+use crate::hash_file::{self, FileStamp};
+use crate::last_verified;
+use crate::log::{self, Errors};
+
+/// ハッシュ情報の保存先
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum HashStorage {
+    /// ハッシュファイルだけに保存する
+    #[default]
+    Text,
+    /// ハッシュファイルに加えてディスクごとのSQLiteのデータベースに保存し、
+    /// 再開、検証、統合ではハッシュファイルを読み込まずにデータベースを問い合わせる
+    Sqlite,
+}
+
+impl HashStorage {
+    /// 名前から保存先を返す。名前が不正であればNoneを返す。
+    pub fn from_name(name: &str) -> Option<HashStorage> {
+        match name {
+            "text" => Some(HashStorage::Text),
+            "sqlite" => Some(HashStorage::Sqlite),
+            _ => None,
+        }
+    }
+}
+
+/// データベースのテーブル
+/// stateには、最後に同期したハッシュファイルと最後に検証した日時の記録のバイト数と更新日時を保存する。
+const SCHEMA: &str = "
+CREATE TABLE IF NOT EXISTS hashes (
+    path TEXT PRIMARY KEY,
+    hash TEXT NOT NULL,
+    size INTEGER,
+    modified INTEGER,
+    last_verified INTEGER
+);
+CREATE TABLE IF NOT EXISTS state (
+    name TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+);";
+
+/// ハッシュファイルのアルゴリズムを保存するstateの名前
+const ALGORITHM_STATE: &str = "algorithm";
+
+/// 同期したハッシュファイルを保存するstateの名前
+const HASH_FILE_STATE: &str = "hash_file";
+
+/// 同期した最後に検証した日時の記録を保存するstateの名前
+const VERIFIED_FILE_STATE: &str = "verified_file";
+
+/// ディスクのデータベースのパスを返す。
+pub fn database_filepath(output_folder: &Path, disk_id: &str) -> PathBuf {
+    output_folder
+        .join("sqlite")
+        .join(format!("{}.sqlite", disk_id))
+}
+
+/// ハッシュファイルのハッシュ情報マップと、バイト数と更新日時のマップを読み込む。
+/// SQLiteに保存する指定で、最後に同期してからハッシュファイルが変わっていなければデータベースから読み込む。
+/// データベースがないか古ければハッシュファイルを読み込み、データベースを作り直す。
+pub fn load_hash_info(
+    storage: HashStorage,
+    output_folder: &Path,
+    disk_id: &str,
+) -> Result<(HashMap<PathBuf, Digest>, HashMap<PathBuf, FileStamp>), Errors> {
+    let hash_filepath = output_folder.join(disk_id);
+    if storage == HashStorage::Text {
+        return Ok((
+            hash_file::load_hash_info(hash_filepath.as_path())?,
+            hash_file::load_file_stamps(hash_filepath.as_path())?,
+        ));
+    }
+
+    let mut connection = open(output_folder, disk_id)?;
+    if is_synced(
+        &connection,
+        disk_id,
+        HASH_FILE_STATE,
+        hash_filepath.as_path(),
+    )? {
+        query_hash_info(&connection, disk_id)
+    } else {
+        rebuild(&mut connection, output_folder, disk_id)
+    }
+}
+
+/// ファイルごとの最後に検証した日時の記録を読み込む。
+/// SQLiteに保存する指定で、最後に同期してから記録が変わっていなければデータベースから読み込む。
+/// データベースが古ければ記録を読み込み、データベースの日時を置き換える。
+pub fn load_last_verified(
+    storage: HashStorage,
+    output_folder: &Path,
+    disk_id: &str,
+) -> Result<HashMap<PathBuf, u64>, Errors> {
+    if storage == HashStorage::Text {
+        return last_verified::load_last_verified(output_folder, disk_id);
+    }
+
+    let mut connection = open(output_folder, disk_id)?;
+    let verified_filepath = last_verified::verified_filepath(output_folder, disk_id);
+    if is_synced(
+        &connection,
+        disk_id,
+        VERIFIED_FILE_STATE,
+        verified_filepath.as_path(),
+    )? {
+        return query_last_verified(&connection, disk_id);
+    }
+
+    let last_verified = last_verified::load_last_verified(output_folder, disk_id)?;
+    replace_last_verified(
+        &mut connection,
+        disk_id,
+        &last_verified,
+        verified_filepath.as_path(),
+    )?;
+    Ok(last_verified)
+}
+
+/// ハッシュファイルを書き直し、SQLiteに保存する指定ならデータベースの内容も置き換える。
+/// 書き直しに失敗してもハッシュファイルと食い違ったデータベースを使わないよう、
+/// データベースを置き換える際に同期の記録を消し、ハッシュファイルを書き直した後で記録する。
+/// 最後に検証した日時は、次に読み込む際に記録から読み込み直す。
+pub fn write_hash_info(
+    storage: HashStorage,
+    output_folder: &Path,
+    disk_id: &str,
+    algorithm: HashAlgorithm,
+    hash_info_map: HashMap<PathBuf, Digest>,
+    stamp_map: &HashMap<PathBuf, FileStamp>,
+) -> Result<(), Errors> {
+    let hash_filepath = output_folder.join(disk_id);
+    if storage == HashStorage::Text {
+        return hash_file::write_calculated_hash_with_stamps(
+            hash_filepath.as_path(),
+            algorithm,
+            hash_info_map,
+            stamp_map,
+        );
+    }
+
+    let mut connection = open(output_folder, disk_id)?;
+    replace_hashes(
+        &mut connection,
+        disk_id,
+        &hash_info_map,
+        stamp_map,
+        &HashMap::new(),
+    )?;
+    hash_file::write_calculated_hash_with_stamps(
+        hash_filepath.as_path(),
+        algorithm,
+        hash_info_map,
+        stamp_map,
+    )?;
+    record_state(&connection, disk_id, ALGORITHM_STATE, algorithm.name())?;
+    record_synced(
+        &connection,
+        disk_id,
+        HASH_FILE_STATE,
+        hash_filepath.as_path(),
+    )
+}
+
+/// ハッシュが一致したファイルの最後に検証した日時を記録する。
+/// SQLiteに保存する指定なら、データベースの日時も同じ日時に更新する。
+/// 記録する前からデータベースが古かった場合は、次に読み込む際に置き換えるので更新しない。
+pub fn record_verified(
+    storage: HashStorage,
+    output_folder: &Path,
+    disk_id: &str,
+    verified: Vec<PathBuf>,
+) -> Result<(), Errors> {
+    if storage == HashStorage::Text {
+        return last_verified::record_verified(output_folder, disk_id, verified).map(|_| ());
+    }
+
+    let mut connection = open(output_folder, disk_id)?;
+    let verified_filepath = last_verified::verified_filepath(output_folder, disk_id);
+    let synced = is_synced(
+        &connection,
+        disk_id,
+        VERIFIED_FILE_STATE,
+        verified_filepath.as_path(),
+    )?;
+    let now = last_verified::record_verified(output_folder, disk_id, verified.clone())?;
+    if !synced {
+        return Ok(());
+    }
+
+    let transaction = connection
+        .transaction()
+        .map_err(|error| database_error(disk_id, error))?;
+    {
+        let mut statement = transaction
+            .prepare("UPDATE hashes SET last_verified = ? WHERE path = ?")
+            .map_err(|error| database_error(disk_id, error))?;
+        for target_filepath in verified.iter() {
+            statement
+                .execute(params![now as i64, target_filepath.to_str().unwrap()])
+                .map_err(|error| database_error(disk_id, error))?;
+        }
+    }
+    transaction
+        .commit()
+        .map_err(|error| database_error(disk_id, error))?;
+    record_synced(
+        &connection,
+        disk_id,
+        VERIFIED_FILE_STATE,
+        verified_filepath.as_path(),
+    )
+}
+
+/// 統合するハッシュファイルのアルゴリズムと行を、ハッシュファイルを読み込まずにデータベースから作成する。
+/// 行は末尾の改行を除き、同じパスの行は1つにまとめたハッシュファイルと同じ形式にする。
+/// データベースがないか、最後に同期してから変わったハッシュファイルがあればNoneを返す。
+pub fn load_merged_lines(
+    output_folder: &Path,
+    hash_filepaths: &[PathBuf],
+) -> Result<Option<(Vec<HashAlgorithm>, Vec<String>)>, Errors> {
+    let mut algorithms = vec![];
+    let mut lines = vec![];
+    for hash_filepath in hash_filepaths {
+        let disk_id = hash_filepath.file_name().unwrap().to_str().unwrap();
+        if !database_filepath(output_folder, disk_id).is_file() {
+            return Ok(None);
+        }
+        let connection = open(output_folder, disk_id)?;
+        if !is_synced(&connection, disk_id, HASH_FILE_STATE, hash_filepath)? {
+            return Ok(None);
+        }
+        if let Some(algorithm) = read_state(&connection, disk_id, ALGORITHM_STATE)?
+            .and_then(|name| HashAlgorithm::from_name(&name))
+        {
+            if !algorithms.contains(&algorithm) {
+                algorithms.push(algorithm);
+            }
+        }
+        let (hash_info_map, stamp_map) = query_hash_info(&connection, disk_id)?;
+        for (target_filepath, hash) in hash_info_map.iter() {
+            let line = hash_file::add_stamped_hash_file_line(
+                String::new(),
+                target_filepath,
+                hash,
+                stamp_map.get(target_filepath),
+            );
+            lines.push(line.trim_end_matches('\n').to_string());
+        }
+    }
+
+    Ok(Some((algorithms, lines)))
+}
+
+/// ディスクのデータベースを開く。
+/// データベースがなければフォルダとテーブルを作成する。
+fn open(output_folder: &Path, disk_id: &str) -> Result<Connection, Errors> {
+    let database_filepath = database_filepath(output_folder, disk_id);
+    if let Err(error) = fs::create_dir_all(database_filepath.parent().unwrap()) {
+        return Err(log::make_error!(
+            "{}: ハッシュのデータベースのフォルダを作成できませんでした。",
+            disk_id
+        )
+        .with(&error)
+        .as_errors());
+    }
+    let connection = Connection::open(database_filepath.as_path())
+        .map_err(|error| database_error(disk_id, error))?;
+    connection
+        .execute_batch(SCHEMA)
+        .map_err(|error| database_error(disk_id, error))?;
+    Ok(connection)
+}
+
+/// データベースのエラーをエラー情報にする。
+fn database_error(disk_id: &str, error: rusqlite::Error) -> Errors {
+    log::make_error!(
+        "{}: ハッシュのデータベースを操作できませんでした。",
+        disk_id
+    )
+    .with(&error)
+    .as_errors()
+}
+
+/// ファイルが書き換えられたかを比べるため、バイト数と更新日時を並べた文字列を返す。
+/// ファイルがなければ空の文字列を返す。
+fn file_fingerprint(filepath: &Path) -> String {
+    match fs::metadata(filepath) {
+        Ok(metadata) => {
+            let modified = metadata
+                .modified()
+                .ok()
+                .and_then(|modified| modified.duration_since(UNIX_EPOCH).ok())
+                .unwrap_or_default();
+            format!("{}:{}", metadata.len(), modified.as_nanos())
+        }
+        Err(_) => String::new(),
+    }
+}
+
+/// stateの値を返す。なければNoneを返す。
+fn read_state(
+    connection: &Connection,
+    disk_id: &str,
+    name: &str,
+) -> Result<Option<String>, Errors> {
+    connection
+        .query_row(
+            "SELECT value FROM state WHERE name = ?",
+            params![name],
+            |row| row.get(0),
+        )
+        .optional()
+        .map_err(|error| database_error(disk_id, error))
+}
+
+/// stateに値を記録する。
+fn record_state(
+    connection: &Connection,
+    disk_id: &str,
+    name: &str,
+    value: &str,
+) -> Result<(), Errors> {
+    connection
+        .execute(
+            "INSERT OR REPLACE INTO state (name, value) VALUES (?, ?)",
+            params![name, value],
+        )
+        .map(|_| ())
+        .map_err(|error| database_error(disk_id, error))
+}
+
+/// 最後に同期してからファイルが変わっていないかを返す。
+fn is_synced(
+    connection: &Connection,
+    disk_id: &str,
+    name: &str,
+    filepath: &Path,
+) -> Result<bool, Errors> {
+    Ok(read_state(connection, disk_id, name)? == Some(file_fingerprint(filepath)))
+}
+
+/// 現在のファイルと同期したことを記録する。
+fn record_synced(
+    connection: &Connection,
+    disk_id: &str,
+    name: &str,
+    filepath: &Path,
+) -> Result<(), Errors> {
+    record_state(
+        connection,
+        disk_id,
+        name,
+        file_fingerprint(filepath).as_str(),
+    )
+}
+
+/// データベースからハッシュ情報マップと、バイト数と更新日時のマップを作成する。
+fn query_hash_info(
+    connection: &Connection,
+    disk_id: &str,
+) -> Result<(HashMap<PathBuf, Digest>, HashMap<PathBuf, FileStamp>), Errors> {
+    let mut statement = connection
+        .prepare("SELECT path, hash, size, modified FROM hashes")
+        .map_err(|error| database_error(disk_id, error))?;
+    let rows = statement
+        .query_map(params![], |row| {
+            let path: String = row.get(0)?;
+            let hash: String = row.get(1)?;
+            let size: Option<i64> = row.get(2)?;
+            let modified: Option<i64> = row.get(3)?;
+            Ok((path, hash, size, modified))
+        })
+        .map_err(|error| database_error(disk_id, error))?;
+
+    let mut hash_info_map = HashMap::new();
+    let mut stamp_map = HashMap::new();
+    for row in rows {
+        let (path, hash, size, modified) = row.map_err(|error| database_error(disk_id, error))?;
+        let hash = match hex::decode(hash.as_str()) {
+            Ok(hash) => Digest::from_slice(&hash),
+            Err(_) => {
+                return Err(log::make_error!(
+                    "{}: ハッシュのデータベースの形式が不正です。: {}",
+                    disk_id,
+                    path
+                )
+                .as_errors())
+            }
+        };
+        let path = PathBuf::from(path);
+        if let (Some(size), Some(modified)) = (size, modified) {
+            stamp_map.insert(
+                path.clone(),
+                FileStamp {
+                    size: size as u64,
+                    modified: modified as u64,
+                },
+            );
+        }
+        hash_info_map.insert(path, hash);
+    }
+
+    Ok((hash_info_map, stamp_map))
+}
+
+/// データベースからファイルごとの最後に検証した日時のマップを作成する。
+fn query_last_verified(
+    connection: &Connection,
+    disk_id: &str,
+) -> Result<HashMap<PathBuf, u64>, Errors> {
+    let mut statement = connection
+        .prepare("SELECT path, last_verified FROM hashes WHERE last_verified IS NOT NULL")
+        .map_err(|error| database_error(disk_id, error))?;
+    let rows = statement
+        .query_map(params![], |row| {
+            let path: String = row.get(0)?;
+            let last_verified: i64 = row.get(1)?;
+            Ok((PathBuf::from(path), last_verified as u64))
+        })
+        .map_err(|error| database_error(disk_id, error))?;
+
+    let mut last_verified = HashMap::new();
+    for row in rows {
+        let (path, seconds) = row.map_err(|error| database_error(disk_id, error))?;
+        last_verified.insert(path, seconds);
+    }
+    Ok(last_verified)
+}
+
+/// ハッシュファイルと最後に検証した日時の記録を読み込んで、データベースを作り直す。
+/// 読み込んだハッシュ情報マップと、バイト数と更新日時のマップを返す。
+fn rebuild(
+    connection: &mut Connection,
+    output_folder: &Path,
+    disk_id: &str,
+) -> Result<(HashMap<PathBuf, Digest>, HashMap<PathBuf, FileStamp>), Errors> {
+    let hash_filepath = output_folder.join(disk_id);
+    let verified_filepath = last_verified::verified_filepath(output_folder, disk_id);
+    let hash_info_map = hash_file::load_hash_info(hash_filepath.as_path())?;
+    let stamp_map = hash_file::load_file_stamps(hash_filepath.as_path())?;
+    let last_verified = last_verified::load_last_verified(output_folder, disk_id)?;
+    replace_hashes(
+        connection,
+        disk_id,
+        &hash_info_map,
+        &stamp_map,
+        &last_verified,
+    )?;
+    if let Some(algorithm) = hash_file::read_algorithm(hash_filepath.as_path())? {
+        record_state(connection, disk_id, ALGORITHM_STATE, algorithm.name())?;
+    }
+    record_synced(
+        connection,
+        disk_id,
+        HASH_FILE_STATE,
+        hash_filepath.as_path(),
+    )?;
+    record_synced(
+        connection,
+        disk_id,
+        VERIFIED_FILE_STATE,
+        verified_filepath.as_path(),
+    )?;
+    Ok((hash_info_map, stamp_map))
+}
+
+/// データベースのハッシュ情報と最後に検証した日時を置き換える。
+/// ハッシュファイルと記録を読み込み直すまでは食い違うので、同期の記録を消しておく。
+fn replace_hashes(
+    connection: &mut Connection,
+    disk_id: &str,
+    hash_info_map: &HashMap<PathBuf, Digest>,
+    stamp_map: &HashMap<PathBuf, FileStamp>,
+    last_verified: &HashMap<PathBuf, u64>,
+) -> Result<(), Errors> {
+    let transaction = connection
+        .transaction()
+        .map_err(|error| database_error(disk_id, error))?;
+    transaction
+        .execute(
+            "DELETE FROM state WHERE name IN (?, ?)",
+            params![HASH_FILE_STATE, VERIFIED_FILE_STATE],
+        )
+        .map_err(|error| database_error(disk_id, error))?;
+    transaction
+        .execute("DELETE FROM hashes", params![])
+        .map_err(|error| database_error(disk_id, error))?;
+    {
+        let mut statement = transaction
+            .prepare(
+                "INSERT INTO hashes (path, hash, size, modified, last_verified) VALUES (?, ?, ?, ?, ?)",
+            )
+            .map_err(|error| database_error(disk_id, error))?;
+        for (target_filepath, hash) in hash_info_map.iter() {
+            let stamp = stamp_map.get(target_filepath);
+            statement
+                .execute(params![
+                    target_filepath.to_str().unwrap(),
+                    hex::encode(hash.to_vec()),
+                    stamp.map(|stamp| stamp.size as i64),
+                    stamp.map(|stamp| stamp.modified as i64),
+                    last_verified
+                        .get(target_filepath)
+                        .map(|seconds| *seconds as i64),
+                ])
+                .map_err(|error| database_error(disk_id, error))?;
+        }
+    }
+    transaction
+        .commit()
+        .map_err(|error| database_error(disk_id, error))
+}
+
+/// データベースの最後に検証した日時を、記録の内容に置き換える。
+fn replace_last_verified(
+    connection: &mut Connection,
+    disk_id: &str,
+    last_verified: &HashMap<PathBuf, u64>,
+    verified_filepath: &Path,
+) -> Result<(), Errors> {
+    let transaction = connection
+        .transaction()
+        .map_err(|error| database_error(disk_id, error))?;
+    transaction
+        .execute("UPDATE hashes SET last_verified = NULL", params![])
+        .map_err(|error| database_error(disk_id, error))?;
+    {
+        let mut statement = transaction
+            .prepare("UPDATE hashes SET last_verified = ? WHERE path = ?")
+            .map_err(|error| database_error(disk_id, error))?;
+        for (target_filepath, seconds) in last_verified.iter() {
+            statement
+                .execute(params![*seconds as i64, target_filepath.to_str().unwrap()])
+                .map_err(|error| database_error(disk_id, error))?;
+        }
+    }
+    transaction
+        .commit()
+        .map_err(|error| database_error(disk_id, error))?;
+    record_synced(connection, disk_id, VERIFIED_FILE_STATE, verified_filepath)
+}
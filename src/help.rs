@@ -0,0 +1,548 @@
+use crate::log::{self, Errors};
+
+/// サブコマンドのヘルプ
+struct CommandHelp {
+    /// サブコマンド名
+    name: &'static str,
+    /// 引数の形式
+    usage: &'static str,
+    /// 説明
+    summary: &'static str,
+    /// 指定できるオプションと説明
+    options: &'static [(&'static str, &'static str)],
+}
+
+/// 全てのサブコマンドで指定できるオプション
+const COMMON_OPTIONS: &[(&str, &str)] = &[
+    ("--user 名前", "名前空間を使う"),
+    ("--out フォルダ", "出力フォルダ"),
+    ("--registry ファイル", "ディスクレジストリファイル"),
+    ("--fixed-time 日時", "日時を固定して決定的モードにする"),
+    ("--lang ja|en", "メッセージの言語"),
+    ("--help, -h", "ヘルプを出力する"),
+];
+
+/// ディスクを選択するオプション
+const DISK_OPTIONS: &[(&str, &str)] = &[
+    ("--discover フォルダ", "フォルダ配下からdiskファイルを探す"),
+    ("--only ID,...", "指定したディスクだけを処理する"),
+    ("--exclude-disk ID,...", "指定したディスクを処理しない"),
+    (
+        "--exclude-from ファイル",
+        "パターンに一致するファイルを対象外にする",
+    ),
+    (
+        "--include-from ファイル",
+        "パターンに一致するファイルを対象にする",
+    ),
+    ("--filter-profile 名前", "フィルタープロファイル"),
+    (
+        "--skip 種類,...",
+        "隠しファイル(hidden)、システムファイル(system)、OSの不要なファイル(junk)を対象外にする",
+    ),
+    (
+        "--normalize 手順,...",
+        "パスの正規化の手順(slash, nfc, strip:プレフィックス)",
+    ),
+    (
+        "--symlinks 扱い",
+        "シンボリックリンクを対象外にする(skip)、リンク先を対象にする(follow)、リンク先を記録する(record)",
+    ),
+    (
+        "--storage 保存先",
+        "ハッシュファイルだけに保存する(text)、SQLiteのデータベースにも保存する(sqlite)",
+    ),
+];
+
+/// サブコマンドのヘルプ一覧
+const COMMAND_HELPS: &[CommandHelp] = &[
+    CommandHelp {
+        name: "calc",
+        usage: "bcbc [calc] [オプション] ディスクルート...",
+        summary:
+            "ディスクのハッシュを計算してハッシュファイルを更新し、統合ハッシュファイルを作り直す。",
+        options: &[
+            (
+                "--no-merge",
+                "ハッシュ計算だけを行い、統合ハッシュファイルを作り直さない",
+            ),
+            (
+                "--read-only",
+                "ハッシュファイルを更新せずに差分をレポートする",
+            ),
+            (
+                "--path パス",
+                "ディスクルートからの相対パスの配下だけを計算する",
+            ),
+            ("--algo アルゴリズム", "ハッシュアルゴリズム"),
+            (
+                "--extra-algos アルゴリズム,...",
+                "同じ読み込みで追加のアルゴリズムのハッシュも計算する",
+            ),
+            ("--streams", "代替データストリームも計算する"),
+            ("--smart", "SMART情報を記録する"),
+            (
+                "--dry-run",
+                "ファイルを読み込まずに、ハッシュ計算するファイルの一覧を出力する",
+            ),
+            ("--output-format json", "--dry-runの一覧をJSONで出力する"),
+            ("--full-speed", "全速力で計算する"),
+            ("--disks 数", "同時に計算するディスクの数"),
+            ("--workers 数", "1台のディスクで同時に計算するファイルの数"),
+            ("--buffer-size MB", "読み込み用のバッファのサイズ"),
+            (
+                "--chunked-threshold MB",
+                "このサイズ以上のファイルを塊に分けて並行して読み込む(sha256-treeのみ)",
+            ),
+            ("--memory-limit MB", "メモリ使用量の上限"),
+            ("--retries 回数", "読み込みに失敗したファイルを再試行する回数"),
+            ("--retry-delay 秒数", "最初に再試行するまでの待ち時間"),
+            ("--max-duration 時間", "実行時間の上限(例: 6h, 90m)"),
+            ("--summary", "実行結果の集計をJSONのレポートにも保存する"),
+            (
+                "--verify-after-calc 割合",
+                "計算したファイルのうち割合(%)分をキャッシュを使わずに読み込み直して検証する",
+            ),
+            ("--events ファイル", "ファイルごとの処理結果を出力する"),
+            ("--progress-format text|json", "進捗状況の出力形式"),
+            (
+                "--no-tui",
+                "端末でも進捗状況をディスクごとの行で表示せず、1秒ごとにログに出力する",
+            ),
+            (
+                "--output-format coreutils",
+                "ハッシュファイルをmd5sum互換の形式でも出力する",
+            ),
+            (
+                "--heartbeat 秒数",
+                "端末以外に出力する場合の進捗状況の出力間隔",
+            ),
+        ],
+    },
+    CommandHelp {
+        name: "verify",
+        usage: "bcbc verify [オプション] ディスクルート...",
+        summary:
+            "ハッシュファイルにある全てのファイルを読み込み直して、記録されたハッシュと比較する。",
+        options: &[
+            (
+                "--path パス",
+                "ディスクルートからの相対パスの配下だけを検証する",
+            ),
+            (
+                "--older-than 期間",
+                "最後に検証してからこの期間が経ったファイルだけを検証する(例: 90d, 6m)",
+            ),
+            (
+                "--quota",
+                "検証計画の1回の読み込み量だけを、最後に検証した日時の古いファイルから検証する",
+            ),
+            ("--period 期間", "--quotaで全てのバイトを検証する周期"),
+            ("--interval 期間", "--quotaで検証を実行する間隔"),
+            ("--streams", "代替データストリームも検証する"),
+            ("--output-format json|tap", "差異を標準出力に出力する形式"),
+            (
+                "--update-renamed",
+                "移動したファイルのパスをハッシュファイルで書き換える",
+            ),
+            ("--progress-format text|json", "進捗状況の出力形式"),
+            (
+                "--no-tui",
+                "端末でも進捗状況をディスクごとの行で表示せず、1秒ごとにログに出力する",
+            ),
+            ("--full-speed", "全速力で計算する"),
+            ("--disks 数", "同時に検証するディスクの数"),
+            ("--workers 数", "1台のディスクで同時に計算するファイルの数"),
+            ("--buffer-size MB", "読み込み用のバッファのサイズ"),
+            (
+                "--chunked-threshold MB",
+                "このサイズ以上のファイルを塊に分けて並行して読み込む(sha256-treeのみ)",
+            ),
+            ("--memory-limit MB", "メモリ使用量の上限"),
+            ("--retries 回数", "読み込みに失敗したファイルを再試行する回数"),
+            ("--retry-delay 秒数", "最初に再試行するまでの待ち時間"),
+            ("--max-duration 時間", "実行時間の上限(例: 6h, 90m)"),
+            ("--summary", "実行結果の集計をJSONのレポートにも保存する"),
+            ("--events ファイル", "ファイルごとの処理結果を出力する"),
+        ],
+    },
+    CommandHelp {
+        name: "retry",
+        usage: "bcbc retry [オプション] ディスクルート...",
+        summary: "再試行しても読み込みに失敗したファイルだけを、もう一度ハッシュ計算する。",
+        options: &[
+            ("--retries 回数", "読み込みに失敗したファイルを再試行する回数"),
+            ("--retry-delay 秒数", "最初に再試行するまでの待ち時間"),
+            ("--max-duration 時間", "実行時間の上限(例: 6h, 90m)"),
+            ("--summary", "実行結果の集計をJSONのレポートにも保存する"),
+            (
+                "--verify-after-calc 割合",
+                "計算したファイルのうち割合(%)分をキャッシュを使わずに読み込み直して検証する",
+            ),
+            (
+                "--chunked-threshold MB",
+                "このサイズ以上のファイルを塊に分けて並行して読み込む(sha256-treeのみ)",
+            ),
+            (
+                "--extra-algos アルゴリズム,...",
+                "同じ読み込みで追加のアルゴリズムのハッシュも計算する",
+            ),
+            ("--progress-format text|json", "進捗状況の出力形式"),
+            (
+                "--no-tui",
+                "端末でも進捗状況をディスクごとの行で表示せず、1秒ごとにログに出力する",
+            ),
+        ],
+    },
+    CommandHelp {
+        name: "watch",
+        usage: "bcbc watch [オプション] ディスクルート...",
+        summary: "中断するまでディスクを一定間隔で確認し、追加か変更されたファイルのハッシュを計算する。",
+        options: &[
+            ("--poll 時間", "ディスクを確認する間隔(例: 60s, 5m、初期値は60s)"),
+            (
+                "--settle 時間",
+                "更新されてからこの時間が経っていないファイルは次の確認まで計算しない(初期値は30s)",
+            ),
+            (
+                "--no-merge",
+                "ハッシュ計算だけを行い、統合ハッシュファイルを作り直さない",
+            ),
+            ("--workers 数", "1台のディスクで同時に計算するファイルの数"),
+            ("--buffer-size MB", "読み込み用のバッファのサイズ"),
+            ("--events ファイル", "ファイルごとの処理結果を出力する"),
+            (
+                "--no-tui",
+                "端末でも進捗状況をディスクごとの行で表示せず、1秒ごとにログに出力する",
+            ),
+        ],
+    },
+    CommandHelp {
+        name: "check",
+        usage: "bcbc check [オプション] ファイル...",
+        summary: "ファイルを含むディスクのハッシュファイルで、ファイルのハッシュを検証する。",
+        options: &[("--buffer-size MB", "読み込み用のバッファのサイズ")],
+    },
+    CommandHelp {
+        name: "merge",
+        usage: "bcbc merge [オプション]",
+        summary: "ディスクのハッシュファイルからグループごとの統合ハッシュファイルを作る。",
+        options: &[("--rebuild", "統合ハッシュファイルを削除してから作り直す")],
+    },
+    CommandHelp {
+        name: "diff",
+        usage: "bcbc diff グループ|ディスクID|ファイル グループ|ディスクID|ファイル",
+        summary: "2つのハッシュファイルの全てのファイルを1行ずつ比較して出力する。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "clean",
+        usage: "bcbc clean",
+        summary: "中断された実行が残したハッシュファイルのバックアップと一時ファイルを削除する。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "import-sums",
+        usage: "bcbc import-sums [オプション] ファイル ディスクID",
+        summary: "md5sum互換の形式のファイルをディスクのハッシュファイルに取り込む。",
+        options: &[("--algo アルゴリズム", "ハッシュアルゴリズム")],
+    },
+    CommandHelp {
+        name: "post-restore",
+        usage: "bcbc post-restore [オプション] ディスクID ディスクルート",
+        summary: "故障したディスクのハッシュファイルで復元したディスクを検証し、ハッシュファイルを移行する。",
+        options: &[("--new-id ID", "復元したディスクに割り当てるディスクID")],
+    },
+    CommandHelp {
+        name: "import-scrub",
+        usage: "bcbc import-scrub [オプション] レポートファイル",
+        summary:
+            "ZFSかbtrfsのスクラブで検出されたファイルに、他のディスクのコピーがあるか照合する。",
+        options: &[(
+            "--mount フォルダ",
+            "btrfsのレポートのパスの起点にするマウント先",
+        )],
+    },
+    CommandHelp {
+        name: "hash",
+        usage: "bcbc hash [オプション] 入力...",
+        summary: "標準入力(-)や名前付きパイプのハッシュを計算する。",
+        options: &[
+            ("--disk ID", "記録するディスク"),
+            ("--as パス", "記録するパス"),
+            ("--algo アルゴリズム", "ハッシュアルゴリズム"),
+            ("--buffer-size MB", "読み込み用のバッファのサイズ"),
+        ],
+    },
+    CommandHelp {
+        name: "sync",
+        usage: "bcbc sync 出力フォルダ",
+        summary: "他の環境のハッシュファイルを取り込む。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "compare",
+        usage: "bcbc compare [オプション] グループ グループ",
+        summary: "2つのグループの統合ハッシュファイルを比較する。",
+        options: &[
+            ("--files-from フォルダ", "修正リストを出力する"),
+            (
+                "--prefer グループ",
+                "ハッシュが異なる場合に正しいとみなすグループ",
+            ),
+        ],
+    },
+    CommandHelp {
+        name: "usage",
+        usage: "bcbc usage [グループ...]",
+        summary: "グループごとに全てのファイルの容量と重複を除いた容量を出力する。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "init",
+        usage: "bcbc init [オプション] ディスクルート",
+        summary: "ディスクのルートに、グループ内の空いている連番のディスクIDでdiskファイルを作成する。",
+        options: &[
+            ("--group グループ", "ディスクのグループ(初期値はA)"),
+            ("--label ラベル", "ディスクに貼ったラベルなどの名前"),
+        ],
+    },
+    CommandHelp {
+        name: "disks",
+        usage: "bcbc disks",
+        summary: "ハッシュファイルのある全てのディスクを、管理用の情報、行数、最後に計算と検証した日時とともに一覧にする。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "dupes",
+        usage: "bcbc dupes [グループ...]",
+        summary: "グループごとに、ディスクをまたいで同じ内容のファイルの組と、重複を削除して空けられる容量を出力する。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "compare-dirs",
+        usage: "bcbc compare-dirs [オプション] フォルダ フォルダ",
+        summary: "2つのフォルダのファイルのハッシュを計算して比較する。",
+        options: &[("--algo アルゴリズム", "ハッシュアルゴリズム")],
+    },
+    CommandHelp {
+        name: "copy",
+        usage: "bcbc copy [オプション] コピー元 コピー先...",
+        summary: "フォルダ配下のファイルを1つ以上のフォルダにコピーする。",
+        options: &[
+            ("--verify", "コピー先を検証してハッシュファイルに記録する"),
+            ("--algo アルゴリズム", "ハッシュアルゴリズム"),
+        ],
+    },
+    CommandHelp {
+        name: "dedup",
+        usage: "bcbc dedup [ディスクID...]",
+        summary: "ハッシュファイルの重複した行を整理する。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "prune",
+        usage: "bcbc prune [オプション] ディスクルート...",
+        summary: "ハッシュファイルから、ディスクにないファイルの行を削除する。",
+        options: &[(
+            "--report-only",
+            "削除せずに、ディスクにないファイルを出力する",
+        )],
+    },
+    CommandHelp {
+        name: "restore-trimmed",
+        usage: "bcbc restore-trimmed ファイル...",
+        summary: "ハッシュファイルから削除された行を元に戻す。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "seal",
+        usage: "bcbc seal ディスクID...",
+        summary: "ディスクを封印する。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "check-pinned",
+        usage: "bcbc check-pinned",
+        summary: "全ての必須ファイルがハッシュファイルにあるか確認する。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "setup",
+        usage: "bcbc setup",
+        summary: "対話形式でBCBCHOME、設定ファイル、最初のディスクのdiskファイルを作成する。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "check-config",
+        usage: "bcbc check-config [ディスクルート...]",
+        summary: "設定とdiskファイルを確認する。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "retention",
+        usage: "bcbc retention [オプション] ディスクルート...",
+        summary: "更新日時によりファイルの保存状況を監査する。",
+        options: &[
+            ("--older-than 期間", "この期間より古いファイルを監査する"),
+            ("--newer-than 期間", "この期間より新しいファイルを監査する"),
+            ("--min-copies 数", "古いファイルが必要なコピー数"),
+            ("--copy-group グループ", "古いファイルのコピー先のグループ"),
+        ],
+    },
+    CommandHelp {
+        name: "throughput",
+        usage: "bcbc throughput [ディスクID...]",
+        summary: "読み込み速度の履歴を出力する。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "plan",
+        usage: "bcbc plan [オプション] [ディスクID...]",
+        summary: "検証計画を作成する。",
+        options: &[
+            ("--period 期間", "全てのバイトを検証する周期"),
+            ("--interval 期間", "検証を実行する間隔"),
+            ("--window 時間数", "1回の検証に使える時間数"),
+        ],
+    },
+    CommandHelp {
+        name: "tag",
+        usage: "bcbc tag ディスクID:パス タグ",
+        summary: "ファイルかフォルダにタグを付ける。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "untag",
+        usage: "bcbc untag ディスクID:パス [タグ]",
+        summary: "タグを外す。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "tags",
+        usage: "bcbc tags [ディスクID...]",
+        summary: "タグの一覧を出力する。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "export-html",
+        usage: "bcbc export-html ディスクID|グループ 出力先",
+        summary: "ハッシュファイルをHTMLファイルに出力する。",
+        options: &[],
+    },
+    CommandHelp {
+        name: "label",
+        usage: "bcbc label [オプション] ディスクID...",
+        summary: "ディスクのラベルを作成する。",
+        options: &[("--base-url URL", "QRコードに使う問い合わせサーバーのURL")],
+    },
+    CommandHelp {
+        name: "serve",
+        usage: "bcbc serve [オプション]",
+        summary: "ハッシュファイルの問い合わせサーバーを起動する。",
+        options: &[("--listen アドレス", "待ち受けるアドレス")],
+    },
+];
+
+/// ディスクを選択するオプションを指定できるサブコマンド
+const DISK_COMMANDS: [&str; 6] = [
+    "calc",
+    "verify",
+    "retry",
+    "watch",
+    "check-config",
+    "retention",
+];
+
+/// コマンドライン引数がヘルプの要求であれば、対象のサブコマンド名を返す。
+/// "bcbc help [サブコマンド]"か、"--help"か"-h"が指定された場合をヘルプの要求とする。
+/// サブコマンドが指定されなければ、外側のSomeの中身をNoneにする。
+pub fn requested_help(args: &[String]) -> Option<Option<&str>> {
+    // 1つ目はこのプログラムのパス
+    let args = args.get(1..).unwrap_or_default();
+    match args.first().map(|arg| arg.as_str()) {
+        Some("help") => Some(args.get(1).map(|arg| arg.as_str())),
+        _ if args.iter().any(|arg| arg == "--help" || arg == "-h") => {
+            let command_name = args.first().map(|arg| arg.as_str());
+            Some(command_name.filter(|name| !name.starts_with('-')))
+        }
+        _ => None,
+    }
+}
+
+/// ヘルプを出力する。
+/// サブコマンドが指定されなければサブコマンドの一覧を出力する。
+pub fn print_help(command_name: Option<&str>) -> Result<(), Errors> {
+    let command_name = match command_name {
+        Some(command_name) => command_name,
+        None => {
+            print_command_list();
+            return Ok(());
+        }
+    };
+    let command_help = match COMMAND_HELPS
+        .iter()
+        .find(|command_help| command_help.name == command_name)
+    {
+        Some(command_help) => command_help,
+        None => {
+            return Err(log::make_error!("不明なサブコマンドです。: {}", command_name).as_errors())
+        }
+    };
+
+    println!("使い方: {}", command_help.usage);
+    println!();
+    println!("{}", command_help.summary);
+    if command_help.options.len() > 0 {
+        println!();
+        println!("オプション:");
+        print_options(command_help.options);
+    }
+    if DISK_COMMANDS.contains(&command_help.name) {
+        println!();
+        println!("ディスクの選択:");
+        print_options(DISK_OPTIONS);
+    }
+    println!();
+    println!("共通のオプション:");
+    print_options(COMMON_OPTIONS);
+
+    Ok(())
+}
+
+/// サブコマンドの一覧を出力する。
+fn print_command_list() {
+    println!("使い方: bcbc [サブコマンド] [オプション] [引数...]");
+    println!();
+    println!("サブコマンドを省略した場合はcalcとする。");
+    println!();
+    println!("サブコマンド:");
+    let width = max_width(COMMAND_HELPS.iter().map(|command_help| command_help.name));
+    for command_help in COMMAND_HELPS {
+        println!(
+            "  {}  {}",
+            pad(command_help.name, width),
+            command_help.summary
+        );
+    }
+    println!();
+    println!("サブコマンドごとのヘルプは\"bcbc help サブコマンド\"で出力する。");
+}
+
+/// オプションと説明を揃えて出力する。
+fn print_options(options: &[(&str, &str)]) {
+    let width = max_width(options.iter().map(|(option, _)| *option));
+    for (option, description) in options {
+        println!("  {}  {}", pad(option, width), description);
+    }
+}
+
+/// 文字列の最大の文字数を返す。
+fn max_width<'a>(texts: impl Iterator<Item = &'a str>) -> usize {
+    texts.map(|text| text.chars().count()).max().unwrap_or(0)
+}
+
+/// 文字数が揃うよう末尾を空白で埋める。
+fn pad(text: &str, width: usize) -> String {
+    format!("{}{}", text, " ".repeat(width - text.chars().count()))
+}
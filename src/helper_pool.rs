@@ -0,0 +1,80 @@
+use std::path::Path;
+use std::sync::Mutex;
+
+/// 計算を終えたディスクの空いた計算スレッドの枠
+/// 並行して読み込んでも遅くならないディスクは、空いた枠で計算スレッドを追加して残りのファイルを計算する。
+pub struct HelperPool {
+    /// 空いている枠の数
+    idle: Mutex<usize>,
+}
+
+/// 使用中の枠
+/// 破棄されると枠を空け、他のディスクが使えるようにする。
+pub struct HelperSlot<'a> {
+    helper_pool: &'a HelperPool,
+}
+
+impl HelperPool {
+    pub fn new() -> HelperPool {
+        HelperPool {
+            idle: Mutex::new(0),
+        }
+    }
+
+    /// 計算を終えたディスクの計算スレッドの枠を空ける。
+    pub fn release(&self, workers: usize) {
+        *self.idle.lock().unwrap() += workers;
+    }
+
+    /// 空いている枠があれば1つ使う。
+    pub fn try_acquire(&self) -> Option<HelperSlot<'_>> {
+        let mut idle = self.idle.lock().unwrap();
+        if *idle == 0 {
+            return None;
+        }
+        *idle -= 1;
+        Some(HelperSlot { helper_pool: self })
+    }
+}
+
+impl Drop for HelperSlot<'_> {
+    fn drop(&mut self) {
+        self.helper_pool.release(1);
+    }
+}
+
+/// ディスクルートがあるデバイスが、SSDのように並行して読み込んでも遅くならないデバイスかを返す。
+/// 判定できなければ、HDDと同じく並行して読み込まないようfalseを返す。
+#[cfg(target_os = "linux")]
+pub fn is_solid_state(root: &Path) -> bool {
+    use std::fs;
+    use std::path::PathBuf;
+
+    use crate::smart;
+
+    let device = match smart::device_of(root) {
+        Some(device) => device,
+        None => return false,
+    };
+    // /dev/mapper/名前などはリンク先のdm-0などで判定する
+    let device = fs::canonicalize(&device).unwrap_or(PathBuf::from(device));
+    let block = match device
+        .file_name()
+        .and_then(|name| fs::canonicalize(Path::new("/sys/class/block").join(name)).ok())
+    {
+        Some(block) => block,
+        None => return false,
+    };
+    // パーティションには回転の有無がないので、パーティションを含むディスクで判定する
+    let rotational = [block.as_path(), block.parent().unwrap_or(block.as_path())]
+        .iter()
+        .find_map(|block| fs::read_to_string(block.join("queue").join("rotational")).ok());
+    rotational.map_or(false, |rotational| rotational.trim() == "0")
+}
+
+/// ディスクルートがあるデバイスが、SSDのように並行して読み込んでも遅くならないデバイスかを返す。
+/// Linux以外では判定できないのでfalseを返す。
+#[cfg(not(target_os = "linux"))]
+pub fn is_solid_state(_root: &Path) -> bool {
+    false
+}
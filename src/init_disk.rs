@@ -0,0 +1,133 @@
+use std::collections::HashSet;
+use std::path::Path;
+
+use crate::atomic_write;
+use crate::clock;
+use crate::disk;
+use crate::log::{self, Errors};
+use crate::merged_hash_file;
+use crate::registry;
+
+/// ディスクのルートにdiskファイルを作成する。
+/// ディスクIDは、グループ内でレジストリにも出力フォルダのハッシュファイルにもない最小の連番にする。
+/// ディスクIDのほか、ラベル、作成した日付、ディスクの容量を記録し、ディスクIDをレジストリに登録する。
+/// diskファイルが既にあれば上書きせずにエラーにする。
+pub fn init_disk(
+    disk_root: &Path,
+    group: char,
+    label: Option<&str>,
+    output_folder: &Path,
+    registry_filepath: &Path,
+) -> Result<(), Errors> {
+    if !disk_root.is_dir() {
+        return Err(log::make_error!(
+            "ディスクのルートフォルダがありません。: {}",
+            disk_root.to_str().unwrap()
+        )
+        .as_errors());
+    }
+    let disk_file = disk_root.join("disk");
+    if disk_file.exists() {
+        return Err(log::make_error!(
+            "diskファイルは作成済みです。上書きしません。: {}",
+            disk_file.to_str().unwrap()
+        )
+        .as_errors());
+    }
+    if label.map_or(false, |label| label.contains(['\r', '\n'])) {
+        return Err(log::make_error!("ラベルに改行は使えません。").as_errors());
+    }
+
+    let disk_id = next_disk_id(group, output_folder, registry_filepath)?;
+    let mut contents = format!("{}\n", disk_id);
+    if let Some(label) = label {
+        contents.push_str(format!("label={}\n", label).as_str());
+    }
+    contents.push_str(format!("created={}\n", clock::now().format(disk::DATE_FORMAT)).as_str());
+    if let Some(capacity) = capacity_of(disk_root) {
+        contents.push_str(format!("capacity={}\n", capacity).as_str());
+    }
+    if let Err(error) = atomic_write::write(disk_file.as_path(), contents) {
+        return Err(log::make_error!(
+            "diskファイルを作成できませんでした。: {}",
+            disk_file.to_str().unwrap()
+        )
+        .with(&error)
+        .as_errors());
+    }
+    log::info(
+        format!(
+            "diskファイルを作成しました。: {} ({})",
+            disk_file.to_str().unwrap(),
+            &disk_id
+        )
+        .as_str(),
+    );
+
+    // 続けて別のディスクを作成しても同じIDにならないよう、すぐにレジストリに登録する
+    let disk_info = disk::find_disk_containing(disk_root)?;
+    match disk_info.metadata.capacity {
+        Some(capacity) => log::info(
+            format!(
+                "{}: ディスクの容量は{:.2}GBです。",
+                &disk_id,
+                capacity as f64 / (1u64 << 30) as f64
+            )
+            .as_str(),
+        ),
+        None => log::warn(format!("{}: ディスクの容量を取得できませんでした。", &disk_id).as_str()),
+    }
+    registry::check_and_register(registry_filepath, &vec![disk_info], true)
+}
+
+/// グループ内で、レジストリにも出力フォルダのハッシュファイルにもない最小の連番のディスクIDを返す。
+/// 取り外したまま登録されていないディスクのハッシュファイルと重ならないよう、出力フォルダも確認する。
+fn next_disk_id(
+    group: char,
+    output_folder: &Path,
+    registry_filepath: &Path,
+) -> Result<String, Errors> {
+    let registry = registry::load_registry(registry_filepath)?;
+    let used_disk_ids: HashSet<String> = if output_folder.is_dir() {
+        merged_hash_file::find_hash_files(output_folder)?
+            .iter()
+            .map(|path| path.file_name().unwrap().to_str().unwrap().to_string())
+            .collect()
+    } else {
+        HashSet::new()
+    };
+    let disk_id = (1..)
+        .map(|number| format!("{}{}", group, number))
+        .find(|disk_id| !used_disk_ids.contains(disk_id) && registry.root_of(disk_id).is_none())
+        .unwrap();
+    Ok(disk_id)
+}
+
+/// ディスクのルートがあるファイルシステムの容量のバイト数を返す。
+/// 取得できなければNoneを返す。
+#[cfg(not(windows))]
+fn capacity_of(disk_root: &Path) -> Option<u64> {
+    use std::process::Command;
+
+    // dfの2行目の2列目が1024バイト単位の容量
+    let output = Command::new("df")
+        .arg("-P")
+        .arg("-k")
+        .arg(disk_root)
+        .output()
+        .ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    let output = String::from_utf8_lossy(&output.stdout).to_string();
+    let line = output.lines().nth(1)?;
+    let blocks = line.split_whitespace().nth(1)?.parse::<u64>().ok()?;
+    Some(blocks * 1024)
+}
+
+/// ディスクのルートがあるファイルシステムの容量のバイト数を返す。
+/// Windowsでは取得しないのでNoneを返す。
+#[cfg(windows)]
+fn capacity_of(_disk_root: &Path) -> Option<u64> {
+    None
+}
@@ -1,16 +1,131 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process;
 use std::sync::atomic::{AtomicBool, Ordering};
-use std::sync::Arc;
+use std::sync::Mutex;
+use std::time::{Duration, Instant, SystemTime};
+
+use once_cell::sync::OnceCell;
 
 use crate::log::{self, Errors};
 
-/// Ctrl+Cハンドラを設定する。
-pub fn set_interruption_handler() -> Result<Arc<AtomicBool>, Errors> {
-    let interruption_flag = Arc::new(AtomicBool::new(false));
-    let flag_for_handler = interruption_flag.clone();
-    match ctrlc::set_handler(move || flag_for_handler.store(true, Ordering::Relaxed)) {
-        Ok(_) => Ok(interruption_flag),
+/// 割り込みにより停止した場合の終了コード
+pub const INTERRUPTED_EXIT_CODE: i32 = 130;
+
+/// 割り込みを受けたか
+static INTERRUPTED: AtomicBool = AtomicBool::new(false);
+
+/// 実行時間の上限の日時
+static DEADLINE: Mutex<Option<Instant>> = Mutex::new(None);
+
+/// 実行時間の上限に達したか
+static TIME_LIMIT_REACHED: AtomicBool = AtomicBool::new(false);
+
+/// 停止ファイルを確認する間隔
+const STOP_FILE_CHECK_INTERVAL: Duration = Duration::from_secs(1);
+
+/// 停止ファイルの監視状態
+struct StopFileWatch {
+    /// 停止ファイルのパス
+    filepath: PathBuf,
+    /// 監視を開始した日時
+    since: SystemTime,
+    /// 最後に確認した時点
+    last_checked: Instant,
+}
+
+/// 監視している停止ファイル
+static STOP_FILE_WATCH: Mutex<Option<StopFileWatch>> = Mutex::new(None);
+
+/// ハンドラの設定結果
+/// ハンドラはプロセスで1回しか設定できないため、2回目以降は最初の結果を使う。
+static HANDLER_RESULT: OnceCell<Result<(), String>> = OnceCell::new();
+
+/// Ctrl+CとSIGTERMのハンドラを設定する。
+/// 割り込みを受けたらフラグを立て、処理はファイルの区切りで停止する。
+/// 停止を待たずにもう一度割り込みを受けたら、その場で終了する。
+pub fn set_interruption_handler() -> Result<(), Errors> {
+    let result = HANDLER_RESULT.get_or_init(|| {
+        ctrlc::set_handler(|| {
+            if INTERRUPTED.swap(true, Ordering::Relaxed) {
+                process::exit(INTERRUPTED_EXIT_CODE);
+            }
+            log::warn("中断を受け付けました。計算中のファイルが終わったら停止します。もう一度押すと直ちに終了します。");
+        })
+        .map_err(|error| error.to_string())
+    });
+    match result {
+        Ok(_) => Ok(()),
         Err(error) => Err(log::make_error!("Ctrl+Cハンドラが設定できませんでした。")
-            .with(&error)
+            .with(error)
             .as_errors()),
     }
 }
+
+/// 実行時間の上限を設定する。
+/// 上限に達したら割り込みを受けた場合と同じく、ファイルの区切りで停止する。
+pub fn set_time_limit(max_duration: Option<Duration>) {
+    *DEADLINE.lock().unwrap() = max_duration.map(|max_duration| Instant::now() + max_duration);
+    TIME_LIMIT_REACHED.store(false, Ordering::Relaxed);
+}
+
+/// 停止ファイルの監視を開始する。
+/// 監視を開始した後に停止ファイルが作成か更新されたら、割り込みを受けた場合と同じくファイルの区切りで停止する。
+/// 開始前からある停止ファイルは以前の停止の名残なので無視する。
+pub fn watch_stop_file(stop_filepath: &Path) {
+    *STOP_FILE_WATCH.lock().unwrap() = Some(StopFileWatch {
+        filepath: stop_filepath.to_path_buf(),
+        since: SystemTime::now(),
+        last_checked: Instant::now(),
+    });
+}
+
+/// 監視を開始した後に停止ファイルが作成か更新されたかを返す。
+/// ファイルシステムへの問い合わせを減らすため、一定間隔より短い間は確認しない。
+fn is_stop_file_touched() -> Option<PathBuf> {
+    let mut stop_file_watch = STOP_FILE_WATCH.lock().unwrap();
+    let stop_file_watch = stop_file_watch.as_mut()?;
+    if stop_file_watch.last_checked.elapsed() < STOP_FILE_CHECK_INTERVAL {
+        return None;
+    }
+    stop_file_watch.last_checked = Instant::now();
+    match fs::metadata(stop_file_watch.filepath.as_path()).and_then(|metadata| metadata.modified())
+    {
+        Ok(modified) if modified >= stop_file_watch.since => Some(stop_file_watch.filepath.clone()),
+        _ => None,
+    }
+}
+
+/// 割り込みを受けたか、実行時間の上限に達したかを返す。
+/// 停止ファイルが作成されていれば割り込みを受けたものとする。
+pub fn is_interrupted() -> bool {
+    if INTERRUPTED.load(Ordering::Relaxed) {
+        return true;
+    }
+    if let Some(stop_filepath) = is_stop_file_touched() {
+        if !INTERRUPTED.swap(true, Ordering::Relaxed) {
+            log::warn(
+                format!(
+                    "停止ファイルを検出しました。計算中のファイルが終わったら停止します。: {}",
+                    stop_filepath.to_str().unwrap()
+                )
+                .as_str(),
+            );
+        }
+        return true;
+    }
+    match *DEADLINE.lock().unwrap() {
+        Some(deadline) if Instant::now() >= deadline => {
+            if !TIME_LIMIT_REACHED.swap(true, Ordering::Relaxed) {
+                log::warn("実行時間の上限に達しました。計算中のファイルが終わったら停止します。");
+            }
+            true
+        }
+        _ => false,
+    }
+}
+
+/// 割り込みを受けずに、実行時間の上限に達して停止したかを返す。
+pub fn is_time_limit_reached() -> bool {
+    TIME_LIMIT_REACHED.load(Ordering::Relaxed) && !INTERRUPTED.load(Ordering::Relaxed)
+}
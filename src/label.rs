@@ -0,0 +1,188 @@
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+#[cfg(not(windows))]
+use std::process::Command;
+
+use chrono::{DateTime, Local};
+use qrcode::render::svg;
+use qrcode::QrCode;
+
+use crate::atomic_write;
+use crate::clock;
+use crate::hash_algorithm::Digest;
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::registry;
+
+/// ラベルの情報
+struct Label {
+    disk_id: String,
+    /// ディスクの容量
+    /// ディスクが接続されていなければNone
+    capacity: Option<u64>,
+    /// 最後にハッシュを計算した日時
+    filled_at: Option<DateTime<Local>>,
+    number_of_files: usize,
+    /// ハッシュファイルの内容のダイジェスト
+    root_digest: String,
+    /// QRコードにする内容
+    qr_contents: String,
+}
+
+/// ディスクに貼るラベルを印刷できるHTMLファイルに出力する。
+/// URLが指定されればQRコードを問い合わせサーバーのそのディスクのファイル一覧のURLにする。
+/// ディスクはディスクIDとハッシュファイルのある出力フォルダの組で渡し、ラベルは出力フォルダに出力する。
+pub fn write_labels(
+    output_folder: &Path,
+    registry_filepath: &Path,
+    disks: &[(String, &Path)],
+    base_url: Option<&str>,
+) -> Result<(), Errors> {
+    let registry = registry::load_registry(registry_filepath)?;
+
+    let mut labels = vec![];
+    for (disk_id, disk_output_folder) in disks {
+        let hash_filepath = disk_output_folder.join(disk_id);
+        if !hash_filepath.is_file() {
+            return Err(
+                log::make_error!("ディスク{}のハッシュファイルがありません。", disk_id).as_errors(),
+            );
+        }
+
+        let hash_info_map = hash_file::load_hash_info(hash_filepath.as_path())?;
+        let root_digest = root_digest(&hash_info_map);
+        let qr_contents = match base_url {
+            Some(base_url) => format!("{}/disks/{}/files", base_url.trim_end_matches('/'), disk_id),
+            None => format!("bcbc:{}:{}", disk_id, root_digest),
+        };
+
+        labels.push(Label {
+            disk_id: disk_id.clone(),
+            capacity: registry.root_of(disk_id).and_then(capacity_of),
+            filled_at: fs::metadata(hash_filepath.as_path())
+                .and_then(|metadata| metadata.modified())
+                .ok()
+                .map(DateTime::<Local>::from),
+            number_of_files: hash_info_map.len(),
+            root_digest,
+            qr_contents,
+        });
+    }
+
+    let mut page = String::from(
+        "<!DOCTYPE html>\n<html lang=\"ja\">\n<head>\n<meta charset=\"utf-8\">\n<title>bcbc labels</title>\n<style>\n\
+         .label { display: inline-flex; gap: 1em; border: 1px solid #000; padding: 0.8em; margin: 0.5em; font-family: sans-serif; page-break-inside: avoid; }\n\
+         .id { font-size: 2em; font-weight: bold; }\n\
+         .digest { font-family: monospace; }\n\
+         </style>\n</head>\n<body>\n",
+    );
+    for label in labels.iter() {
+        page.push_str(render_label(label)?.as_str());
+    }
+    page.push_str("</body>\n</html>\n");
+
+    let labels_folder = output_folder.join("labels");
+    if let Err(error) = fs::create_dir_all(labels_folder.as_path()) {
+        return Err(log::make_error!("ラベルのフォルダを作成できませんでした。")
+            .with(&error)
+            .as_errors());
+    }
+    let timestamp = clock::now().format("%Y%m%d%H%M%S");
+    let labels_filepath = labels_folder.join(format!("labels-{}.html", timestamp));
+    if let Err(error) = atomic_write::write(labels_filepath.as_path(), page) {
+        return Err(log::make_error!("ラベルの出力に失敗しました。")
+            .with(&error)
+            .as_errors());
+    }
+
+    log::info(
+        format!(
+            "{}枚のラベルを出力しました。: {}",
+            labels.len(),
+            labels_filepath.to_str().unwrap()
+        )
+        .as_str(),
+    );
+
+    Ok(())
+}
+
+/// ハッシュファイルの内容をパス順に並べてハッシュを計算する。
+/// 行の順序に関係なく、内容が同じなら同じダイジェストになる。
+fn root_digest(hash_info_map: &HashMap<PathBuf, Digest>) -> String {
+    let mut hash_info: Vec<(&PathBuf, &Digest)> = hash_info_map.iter().collect();
+    hash_info.sort_by_key(|(target_filepath, _)| *target_filepath);
+
+    let mut context = md5::Context::new();
+    for (target_filepath, hash) in hash_info {
+        let line = hash_file::add_hash_file_line(String::new(), target_filepath, hash);
+        context.consume(line.as_bytes());
+    }
+    hex::encode(context.compute().to_vec())
+}
+
+/// 1枚のラベルのHTMLを作成する。
+fn render_label(label: &Label) -> Result<String, Errors> {
+    let qr_code = match QrCode::new(label.qr_contents.as_bytes()) {
+        Ok(qr_code) => qr_code,
+        Err(error) => {
+            return Err(log::make_error!("QRコードを作成できませんでした。")
+                .with(&error)
+                .as_errors())
+        }
+    };
+    let qr_svg = qr_code
+        .render::<svg::Color>()
+        .min_dimensions(120, 120)
+        .build();
+    // HTMLに埋め込むためXML宣言を取り除く
+    let qr_svg = match qr_svg.find("<svg") {
+        Some(i) => qr_svg[i..].to_string(),
+        None => qr_svg,
+    };
+
+    let capacity = match label.capacity {
+        Some(capacity) => format!("{:.2}TB", capacity as f64 / 1e12),
+        None => "-".to_string(),
+    };
+    let filled_at = match label.filled_at {
+        Some(filled_at) => filled_at.format("%Y-%m-%d").to_string(),
+        None => "-".to_string(),
+    };
+
+    Ok(format!(
+        "<div class=\"label\">\n<div>{}</div>\n<div>\n<div class=\"id\">{}</div>\n\
+         <div>グループ {}</div>\n<div>容量 {}</div>\n<div>計算日 {}</div>\n<div>{}ファイル</div>\n\
+         <div class=\"digest\">{}</div>\n</div>\n</div>\n",
+        qr_svg,
+        label.disk_id,
+        label.disk_id.chars().next().unwrap(),
+        capacity,
+        filled_at,
+        label.number_of_files,
+        &label.root_digest[..16]
+    ))
+}
+
+/// ディスクルートがあるファイルシステムの容量を返す。
+/// ディスクが接続されていないなどで取得できなければNoneを返す。
+#[cfg(not(windows))]
+fn capacity_of(root: &Path) -> Option<u64> {
+    // dfの2行目の2列目が1024バイト単位の容量
+    let output = Command::new("df").arg("-P").arg(root).output().ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    let output = String::from_utf8_lossy(&output.stdout).to_string();
+    let line = output.lines().nth(1)?;
+    let blocks = line.split_whitespace().nth(1)?.parse::<u64>().ok()?;
+    Some(blocks * 1024)
+}
+
+/// ディスクルートがあるファイルシステムの容量を返す。
+/// Windowsでは取得しない。
+#[cfg(windows)]
+fn capacity_of(_root: &Path) -> Option<u64> {
+    None
+}
@@ -0,0 +1,131 @@
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::clock;
+use crate::hash_file;
+use crate::log::{self, Errors};
+
+/// 1日の秒数
+const SECONDS_PER_DAY: u64 = 24 * 60 * 60;
+
+/// ファイルごとの最後に検証した日時の記録を保存するフォルダを返す。
+fn verified_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("verified")
+}
+
+/// ディスクのファイルごとの最後に検証した日時の記録のパスを返す。
+pub fn verified_filepath(output_folder: &Path, disk_id: &str) -> PathBuf {
+    verified_folder(output_folder).join(disk_id)
+}
+
+/// ファイルごとの最後に検証した日時の記録を読み込む。
+/// 値は最後に検証した日時のUNIX時間の秒数とする。
+/// 記録がなければ空のマップを返す。
+pub fn load_last_verified(
+    output_folder: &Path,
+    disk_id: &str,
+) -> Result<HashMap<PathBuf, u64>, Errors> {
+    let verified_filepath = verified_filepath(output_folder, disk_id);
+    let mut last_verified = HashMap::new();
+    if !verified_filepath.is_file() {
+        return Ok(last_verified);
+    }
+
+    let contents = match fs::read_to_string(verified_filepath.as_path()) {
+        Ok(contents) => contents,
+        Err(error) => {
+            return Err(log::make_error!(
+                "{}: 最後に検証した日時の記録を読み込めませんでした。",
+                disk_id
+            )
+            .with(&error)
+            .as_errors())
+        }
+    };
+
+    for (i, line) in contents.lines().enumerate() {
+        // パスにタブを含んでも区切れるよう、最後のタブで区切る
+        match line
+            .rsplit_once('\t')
+            .and_then(|(path, seconds)| Some((path, seconds.parse::<u64>().ok()?)))
+        {
+            Some((path, seconds)) => {
+                last_verified.insert(PathBuf::from(path), seconds);
+            }
+            None => {
+                return log::with_line_number(
+                    Err(log::make_error!("最後に検証した日時の記録の形式が不正です。").as_errors()),
+                    verified_filepath.as_path(),
+                    i + 1,
+                )
+            }
+        }
+    }
+
+    Ok(last_verified)
+}
+
+/// 最後に検証してから指定された日数が経ったかを返す。
+/// 一度も検証していなければ経ったものとする。
+pub fn is_due(last_verified: &HashMap<PathBuf, u64>, target_filepath: &Path, days: u64) -> bool {
+    let now = clock::now().timestamp().max(0) as u64;
+    match last_verified.get(target_filepath) {
+        Some(seconds) => seconds + days * SECONDS_PER_DAY <= now,
+        None => true,
+    }
+}
+
+/// ハッシュが一致したファイルの最後に検証した日時を現在日時にして記録する。
+/// 中断した場合も、次回の検証で続きから検証できるよう検証できたファイルを記録する。
+/// ハッシュファイルからなくなったファイルの記録は削除する。
+/// 記録した日時のUNIX時間の秒数を返す。
+pub fn record_verified(
+    output_folder: &Path,
+    disk_id: &str,
+    verified: Vec<PathBuf>,
+) -> Result<u64, Errors> {
+    let verified_filepath = verified_filepath(output_folder, disk_id);
+    let now = clock::now().timestamp().max(0) as u64;
+    // 検証したファイルがなく前回の記録もなければ何も作成しない
+    if verified.len() == 0 && !verified_filepath.is_file() {
+        return Ok(now);
+    }
+    let hash_info_map = hash_file::load_hash_info(output_folder.join(disk_id).as_path())?;
+    let recorded: HashSet<&PathBuf> = hash_info_map.keys().collect();
+    let mut last_verified: BTreeMap<PathBuf, u64> = load_last_verified(output_folder, disk_id)?
+        .into_iter()
+        .filter(|(path, _)| recorded.contains(path))
+        .collect();
+    for target_filepath in verified {
+        last_verified.insert(target_filepath, now);
+    }
+
+    if let Err(error) = fs::create_dir_all(verified_filepath.parent().unwrap()) {
+        return Err(log::make_error!(
+            "{}: 最後に検証した日時の記録フォルダを作成できませんでした。",
+            disk_id
+        )
+        .with(&error)
+        .as_errors());
+    }
+
+    let mut contents = String::new();
+    for (path, seconds) in last_verified.iter() {
+        contents.push_str(path.to_str().unwrap());
+        contents.push('\t');
+        contents.push_str(seconds.to_string().as_str());
+        contents.push('\n');
+    }
+
+    match atomic_write::write(verified_filepath.as_path(), &contents) {
+        Ok(_) => Ok(now),
+        Err(error) => Err(log::make_error!(
+            "{}: 最後に検証した日時の記録に失敗しました。",
+            disk_id
+        )
+        .with(&error)
+        .as_errors()),
+    }
+}
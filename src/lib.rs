@@ -0,0 +1,115 @@
+//! ディスクのファイルのハッシュを計算して記録するライブラリ。
+//! コマンドラインと同じ処理を実行し、ハッシュ計算の進捗状況を購読できる。
+//! ディスクやハッシュファイルを扱う個別の処理も、終了せずにエラーを返す関数として利用できる。
+
+use std::collections::HashMap;
+use std::path::PathBuf;
+
+mod api;
+mod atomic_write;
+mod auto_ignore;
+mod buffer_pool;
+mod calc;
+mod callbacks;
+mod check_config;
+mod checkpoint;
+mod clock;
+mod compare;
+mod compare_dirs;
+mod completion_action;
+mod copy;
+mod coreutils;
+mod dedup;
+mod diff;
+mod disk;
+mod disks;
+mod dry_run;
+mod dupes;
+mod events;
+mod export_html;
+mod extra_hashes;
+mod file_error;
+mod filter;
+mod flow;
+mod glob;
+mod hash_algorithm;
+mod hash_file;
+mod hash_store;
+mod help;
+mod helper_pool;
+mod init_disk;
+mod interruption;
+mod label;
+mod last_verified;
+pub mod log;
+mod memory;
+mod merged_hash_file;
+mod messages;
+mod mismatch_report;
+mod output_lock;
+mod page_cache;
+mod path_normalizer;
+mod pinned;
+mod plan;
+mod post_restore;
+mod progress;
+mod prune;
+mod read_back;
+mod read_only;
+mod registry;
+mod retention;
+mod retry;
+mod run_options;
+mod run_summary;
+mod scrub;
+mod seal;
+mod serve;
+mod serve_auth;
+mod settings;
+mod setup;
+mod smart;
+mod spot_check;
+mod stream_hash;
+mod streams;
+mod symlinks;
+mod sync;
+mod tags;
+mod target_file;
+mod target_queue;
+mod throughput;
+mod trimmed;
+mod truncation;
+mod usage;
+
+pub use api::{calc_disk_hashes, calc_file_hash, parse_filters, Disk, HashSet};
+pub use calc::{has_disk_failures, PARTIAL_FAILURE_EXIT_CODE};
+pub use callbacks::{Callbacks, DiskDone, FileDone, FileFailure, FileStart};
+pub use filter::Filters;
+pub use hash_algorithm::{Digest, HashAlgorithm};
+pub use interruption::{is_interrupted, INTERRUPTED_EXIT_CODE};
+pub use mismatch_report::{has_mismatches, MISMATCH_EXIT_CODE};
+pub use progress::{channel_subscriber, DiskSnapshot, ProgressSubscriber, Snapshot};
+
+/// コマンドライン引数と環境変数を指定して処理を実行する。
+/// 引数の1つ目はプログラムのパスとして読み飛ばす。
+/// 購読者が指定された場合はハッシュ計算の進捗状況のスナップショットを進捗監視スレッドから通知する。
+pub fn run(
+    current_folder: PathBuf,
+    args: Vec<String>,
+    envs: HashMap<String, String>,
+    subscriber: Option<ProgressSubscriber>,
+) -> Result<(), log::Errors> {
+    run_with_callbacks(current_folder, args, envs, subscriber, Callbacks::new())
+}
+
+/// コールバックを指定して処理を実行する。
+/// ハッシュ計算と検証では、ファイルの開始と完了、エラー、ディスクの完了をハッシュ計算スレッドから通知する。
+pub fn run_with_callbacks(
+    current_folder: PathBuf,
+    args: Vec<String>,
+    envs: HashMap<String, String>,
+    subscriber: Option<ProgressSubscriber>,
+    callbacks: Callbacks,
+) -> Result<(), log::Errors> {
+    flow::main_procedure(current_folder, args, envs, subscriber, callbacks)
+}
@@ -1,11 +1,76 @@
-use chrono::Local;
 use std::fmt::{Display, Write};
+use std::io::{self, Write as _};
 use std::path::Path;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Mutex;
+
+use crate::clock;
+use crate::messages;
+
+/// ログを標準エラー出力に出力するか
+/// 標準出力を機械処理用の出力に使う場合に設定する。
+static TO_STDERR: AtomicBool = AtomicBool::new(false);
+
+/// ログの出力先を標準エラー出力にするかを設定する。
+pub fn use_stderr(to_stderr: bool) {
+    TO_STDERR.store(to_stderr, Ordering::Relaxed);
+}
+
+/// 端末の下部に表示している状態表示の行
+/// 状態表示の行は標準出力に描くので、ログを標準出力に出力する場合は出力の前に消して出力の後に描き直す。
+static STATUS_LINES: Mutex<Vec<String>> = Mutex::new(Vec::new());
+
+/// ログを1行出力する。
+fn write_line(line: &str) {
+    if TO_STDERR.load(Ordering::Relaxed) {
+        eprintln!("{}", line);
+        return;
+    }
+    let status_lines = STATUS_LINES.lock().unwrap();
+    let mut stdout = io::stdout().lock();
+    erase_lines(&mut stdout, status_lines.len());
+    let _ = writeln!(stdout, "{}", line);
+    draw_lines(&mut stdout, &status_lines);
+    let _ = stdout.flush();
+}
+
+/// 端末の下部の状態表示の行を描き直す。
+/// 空の一覧を指定すると状態表示を消す。
+pub fn set_status_lines(lines: Vec<String>) {
+    let mut status_lines = STATUS_LINES.lock().unwrap();
+    let mut stdout = io::stdout().lock();
+    erase_lines(&mut stdout, status_lines.len());
+    draw_lines(&mut stdout, &lines);
+    let _ = stdout.flush();
+    *status_lines = lines;
+}
+
+/// 端末の下部の状態表示の行を、消さずにそのまま残して状態表示を終える。
+/// 以降のログは状態表示の行の後に出力する。
+pub fn keep_status_lines() {
+    STATUS_LINES.lock().unwrap().clear();
+}
+
+/// 直前に描いた行をカーソルを上に戻しながら消す。
+fn erase_lines(stdout: &mut impl io::Write, number_of_lines: usize) {
+    for _ in 0..number_of_lines {
+        let _ = write!(stdout, "\x1b[1A\x1b[2K");
+    }
+}
+
+/// 行を描く。
+fn draw_lines(stdout: &mut impl io::Write, lines: &[String]) {
+    for line in lines {
+        let _ = writeln!(stdout, "{}", line);
+    }
+}
 
 /// タイムスタンプ付きでログを出力する。
+/// メッセージは設定された言語に翻訳する。
 pub fn log(level: &str, message: &str) {
-    let timestamp = Local::now().format("%Y-%m-%d %H:%M:%S");
-    println!("{} [{}] {}", timestamp, level, message);
+    let timestamp = clock::now().format("%Y-%m-%d %H:%M:%S");
+    let message = messages::translate(message);
+    write_line(format!("{} [{}] {}", timestamp, level, message).as_str());
 }
 
 /// 情報ログを出力する。
@@ -27,6 +92,7 @@ pub fn error(message: &str) {
 pub type Errors = Vec<Error>;
 
 /// エラー情報
+#[derive(Debug)]
 pub struct Error {
     message: String,
     additional: Option<String>,
@@ -52,6 +118,16 @@ impl Error {
     }
 }
 
+impl Display for Error {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let message = messages::translate(&self.message);
+        match &self.additional {
+            Some(additional) => write!(f, "{}: {}", message, additional),
+            None => write!(f, "{}", message),
+        }
+    }
+}
+
 /// エラー情報を作成する。
 #[macro_export]
 macro_rules! make_error {
@@ -59,7 +135,7 @@ macro_rules! make_error {
         use std::fmt::Write;
         let mut message = String::new();
         write!(message, $($s),+).unwrap();
-        crate::log::Error::new(message.as_str())
+        $crate::log::Error::new(message.as_str())
     }}
 }
 
@@ -76,7 +152,7 @@ pub fn log_errors(errors: Errors) {
 pub fn log_error(error: &Error) {
     log("ERROR", error.message.as_str());
     if let Some(additional) = &error.additional {
-        println!("{}", additional);
+        write_line(additional);
     }
 }
 
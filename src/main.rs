@@ -1,24 +1,31 @@
 use std::collections::HashMap;
 use std::env;
 use std::path::PathBuf;
+use std::process;
 
-mod calc;
-mod disk;
-mod filter;
-mod flow;
-mod hash_file;
-mod interruption;
-mod log;
-mod merged_hash_file;
-mod progress;
-mod run_options;
-mod target_file;
+use bcbc::log;
+
+/// 設定の誤りなどで処理を続けられなかった場合の終了コード
+const FATAL_EXIT_CODE: i32 = 2;
 
 /// エントリーポイント。
 fn main() {
     if let Err(errors) = execute() {
         log::log_errors(errors);
+        // 中断した場合は次回の実行で続きから計算できるよう、他のエラーと区別できる終了コードにする
+        if bcbc::is_interrupted() {
+            process::exit(bcbc::INTERRUPTED_EXIT_CODE);
+        }
+        // 検証で差異が見つかった場合はCIで判定できるよう、専用の終了コードにする
+        if bcbc::has_mismatches() {
+            process::exit(bcbc::MISMATCH_EXIT_CODE);
+        }
+        process::exit(FATAL_EXIT_CODE);
     };
+    // 一部のディスクの処理に失敗しても残りのディスクは処理を終えるので、スクリプトで判定できるよう区別する
+    if bcbc::has_disk_failures() {
+        process::exit(bcbc::PARTIAL_FAILURE_EXIT_CODE);
+    }
 }
 
 /// 処理を実行する。
@@ -26,7 +33,7 @@ fn execute() -> Result<(), log::Errors> {
     let current_folder = get_current_folder()?;
     let args = env::args().collect();
     let envs = get_envs();
-    flow::main_procedure(current_folder, args, envs)?;
+    bcbc::run(current_folder, args, envs, None)?;
     Ok(())
 }
 
@@ -34,7 +41,7 @@ fn execute() -> Result<(), log::Errors> {
 fn get_current_folder() -> Result<PathBuf, log::Errors> {
     match env::current_dir() {
         Ok(current_folder) => Ok(current_folder),
-        Err(_) => Err(log::make_error!("カレントフォルダが参照できません。").as_errors()),
+        Err(_) => Err(bcbc::make_error!("カレントフォルダが参照できません。").as_errors()),
     }
 }
 
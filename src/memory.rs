@@ -0,0 +1,118 @@
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::thread;
+use std::time::Duration;
+
+use crate::log;
+
+/// メモリ使用量の確認間隔
+const CHECK_INTERVAL: Duration = Duration::from_secs(1);
+
+/// メモリ使用量が上限を超えた後に使う読み込み用のバッファのサイズ
+pub const LOW_MEMORY_BUFFER_SIZE: usize = 1 << 20;
+
+/// メモリ使用量を監視するスレッドを開始し、上限を超えたかのフラグを返す。
+/// 上限が指定されなければ監視せず、フラグは立たない。
+/// フラグは一度立てたら戻さない。フラグを参照する側が全て破棄されたら監視を終了する。
+pub fn start_memory_watchdog(limit: Option<u64>) -> Arc<AtomicBool> {
+    let exceeded_flag = Arc::new(AtomicBool::new(false));
+    let limit = match limit {
+        Some(limit) => limit,
+        None => return exceeded_flag,
+    };
+    if resident_size().is_none() {
+        log::warn("この環境ではメモリ使用量を取得できないため、メモリ使用量の上限を無視します。");
+        return exceeded_flag;
+    }
+
+    let flag_for_watchdog = exceeded_flag.clone();
+    thread::spawn(move || {
+        while Arc::strong_count(&flag_for_watchdog) > 1 {
+            if let Some(resident_size) = resident_size() {
+                if resident_size > limit {
+                    log::warn(
+                        format!(
+                            "メモリ使用量が上限を超えました。({}MB > {}MB) 読み込み用のバッファを{}MBに縮小し、ディスクごとに1ファイルずつ計算します。",
+                            resident_size >> 20,
+                            limit >> 20,
+                            LOW_MEMORY_BUFFER_SIZE >> 20
+                        )
+                        .as_str(),
+                    );
+                    flag_for_watchdog.store(true, Ordering::Relaxed);
+                    break;
+                }
+            }
+            thread::sleep(CHECK_INTERVAL);
+        }
+    });
+
+    exceeded_flag
+}
+
+/// 自プロセスの常駐メモリのバイト数を返す。
+/// 取得できなければNoneを返す。
+#[cfg(target_os = "linux")]
+fn resident_size() -> Option<u64> {
+    // "VmRSS:     1234 kB"の行から取得する
+    let status = std::fs::read_to_string("/proc/self/status").ok()?;
+    let line = status.lines().find(|line| line.starts_with("VmRSS:"))?;
+    let kilobytes = line
+        .trim_start_matches("VmRSS:")
+        .trim()
+        .trim_end_matches("kB")
+        .trim()
+        .parse::<u64>()
+        .ok()?;
+    Some(kilobytes << 10)
+}
+
+/// 自プロセスの常駐メモリのバイト数を返す。
+/// 取得できなければNoneを返す。
+#[cfg(windows)]
+fn resident_size() -> Option<u64> {
+    use std::ffi::c_void;
+    use std::mem;
+
+    /// PROCESS_MEMORY_COUNTERS
+    #[repr(C)]
+    struct ProcessMemoryCounters {
+        cb: u32,
+        page_fault_count: u32,
+        peak_working_set_size: usize,
+        working_set_size: usize,
+        quota_peak_paged_pool_usage: usize,
+        quota_paged_pool_usage: usize,
+        quota_peak_non_paged_pool_usage: usize,
+        quota_non_paged_pool_usage: usize,
+        pagefile_usage: usize,
+        peak_pagefile_usage: usize,
+    }
+
+    #[link(name = "kernel32")]
+    extern "system" {
+        fn GetCurrentProcess() -> *mut c_void;
+        fn K32GetProcessMemoryInfo(
+            process: *mut c_void,
+            counters: *mut ProcessMemoryCounters,
+            cb: u32,
+        ) -> i32;
+    }
+
+    let cb = mem::size_of::<ProcessMemoryCounters>() as u32;
+    let mut counters: ProcessMemoryCounters = unsafe { mem::zeroed() };
+    counters.cb = cb;
+    let succeeded = unsafe { K32GetProcessMemoryInfo(GetCurrentProcess(), &mut counters, cb) };
+    if succeeded == 0 {
+        None
+    } else {
+        Some(counters.working_set_size as u64)
+    }
+}
+
+/// 自プロセスの常駐メモリのバイト数を返す。
+/// LinuxとWindows以外では取得できないのでNoneを返す。
+#[cfg(not(any(target_os = "linux", windows)))]
+fn resident_size() -> Option<u64> {
+    None
+}
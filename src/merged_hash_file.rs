@@ -2,7 +2,11 @@ use std::collections::HashMap;
 use std::fs;
 use std::path::{Path, PathBuf};
 
+use crate::atomic_write;
 use crate::disk;
+use crate::hash_algorithm::HashAlgorithm;
+use crate::hash_file;
+use crate::hash_store;
 use crate::log::{self, Errors};
 
 /// ハッシュファイルを統合する。
@@ -25,8 +29,64 @@ pub fn integrate_hash_files(output_folder: &Path) -> Result<(), Errors> {
     Ok(())
 }
 
+/// 既存の統合ハッシュファイルを全て削除する。
+/// ディスクがなくなったグループの統合ハッシュファイルも残らないようにする。
+pub fn remove_merged_hash_files(output_folder: &Path) -> Result<(), Errors> {
+    let read_dir = match output_folder.read_dir() {
+        Ok(read_dir) => read_dir,
+        Err(error) => {
+            return Err(
+                log::make_error!("出力ファイルの一覧を取得できませんでした。")
+                    .with(&error)
+                    .as_errors(),
+            )
+        }
+    };
+
+    let mut errors = vec![];
+    for entry in read_dir {
+        if let Ok(entry) = entry {
+            let path = entry.path();
+            if !path.is_file() || !is_merged_hash_file_name(path.file_name().unwrap().to_str()) {
+                continue;
+            }
+            match fs::remove_file(path.as_path()) {
+                Ok(_) => log::info(
+                    format!(
+                        "統合ハッシュファイルを削除しました。: {}",
+                        path.to_str().unwrap()
+                    )
+                    .as_str(),
+                ),
+                Err(error) => errors.push(
+                    log::make_error!(
+                        "統合ハッシュファイルを削除できませんでした。: {}",
+                        path.to_str().unwrap()
+                    )
+                    .with(&error),
+                ),
+            }
+        }
+    }
+
+    if errors.len() == 0 {
+        Ok(())
+    } else {
+        Err(errors)
+    }
+}
+
+/// 統合ハッシュファイルのファイル名であるかを返す。
+/// 統合ハッシュファイルはグループ名の1文字だけのファイル名にしている。
+fn is_merged_hash_file_name(file_name: Option<&str>) -> bool {
+    match file_name.map(|file_name| file_name.chars().collect::<Vec<char>>()) {
+        Some(chars) => chars.len() == 1 && chars[0].is_ascii_uppercase(),
+        None => false,
+    }
+}
+
 /// ハッシュファイルを一覧にする
-fn find_hash_files(output_folder: &Path) -> Result<Vec<PathBuf>, Errors> {
+pub fn find_hash_files(output_folder: &Path) -> Result<Vec<PathBuf>, Errors> {
     let mut hash_files = vec![];
 
     match output_folder.read_dir() {
@@ -88,8 +148,8 @@ fn write_merged_hash_file(
     hash_filepaths: &Vec<PathBuf>,
 ) -> Result<(), Errors> {
     let merged_hash_filepath = output_folder.join(disk_group.to_string());
-    let merged_hash_file_contents = merge_hash_files_contents(hash_filepaths)?;
-    match fs::write(&merged_hash_filepath, &merged_hash_file_contents) {
+    let merged_hash_file_contents = merge_hash_files_contents(output_folder, hash_filepaths)?;
+    match atomic_write::write(&merged_hash_filepath, &merged_hash_file_contents) {
         Ok(_) => Ok(()),
         Err(error) => Err(
             log::make_error!("統合ハッシュファイルの作成に失敗しました。")
@@ -100,19 +160,68 @@ fn write_merged_hash_file(
 }
 
 /// ハッシュファイルの内容を統合する。
-fn merge_hash_files_contents(hash_filepaths: &Vec<PathBuf>) -> Result<String, Errors> {
-    let merged_contents = read_hash_files(hash_filepaths)?;
-    let mut lines: Vec<&str> = merged_contents.lines().collect();
+/// 全てのハッシュファイルのアルゴリズムが同じならそのヘッダーを出力する。
+/// 全てのハッシュファイルをデータベースにも保存していれば、ハッシュファイルを読み込まずにデータベースから統合する。
+fn merge_hash_files_contents(
+    output_folder: &Path,
+    hash_filepaths: &Vec<PathBuf>,
+) -> Result<String, Errors> {
+    let (algorithms, mut lines) =
+        match hash_store::load_merged_lines(output_folder, hash_filepaths)? {
+            Some(merged) => merged,
+            None => read_hash_file_lines(hash_filepaths)?,
+        };
     lines.sort();
-    let mut merged_contents = String::new();
+
+    let mut merged_contents = match algorithms.as_slice() {
+        [algorithm] => hash_file::algorithm_header(*algorithm),
+        [] => String::new(),
+        _ => {
+            log::warn(
+                format!(
+                    "アルゴリズムが異なるハッシュファイルを統合します。: {}",
+                    algorithms
+                        .iter()
+                        .map(|algorithm| algorithm.name())
+                        .collect::<Vec<&str>>()
+                        .join(", ")
+                )
+                .as_str(),
+            );
+            String::new()
+        }
+    };
     for line in lines {
-        merged_contents.push_str(line);
+        merged_contents.push_str(&line);
         merged_contents.push('\n');
     }
 
     Ok(merged_contents)
 }
 
+/// 指定された一覧のハッシュファイルを読み込んで、アルゴリズムの一覧と全ての行を返す。
+/// 各ハッシュファイルのヘッダーは統合したファイルの途中に入らないよう除く。
+fn read_hash_file_lines(
+    hash_filepaths: &Vec<PathBuf>,
+) -> Result<(Vec<HashAlgorithm>, Vec<String>), Errors> {
+    let mut algorithms = vec![];
+    for hash_filepath in hash_filepaths {
+        if let Some(algorithm) = hash_file::read_algorithm(hash_filepath)? {
+            if !algorithms.contains(&algorithm) {
+                algorithms.push(algorithm);
+            }
+        }
+    }
+
+    let merged_contents = read_hash_files(hash_filepaths)?;
+    let lines = merged_contents
+        .lines()
+        .filter(|line| hash_file::parse_algorithm_header(line).is_none())
+        .map(|line| line.to_string())
+        .collect();
+    Ok((algorithms, lines))
+}
+
 /// 指定された一覧のハッシュファイルを読み込んで内容を連結して返す。
 fn read_hash_files(hash_filepaths: &Vec<PathBuf>) -> Result<String, Errors> {
     let mut merged_contents = vec![];
@@ -120,7 +229,13 @@ fn read_hash_files(hash_filepaths: &Vec<PathBuf>) -> Result<String, Errors> {
 
     for hash_filepath in hash_filepaths.iter() {
         match fs::read(hash_filepath) {
-            Ok(mut contents) => merged_contents.append(&mut contents),
+            Ok(mut contents) => {
+                // 最後の行に改行がなければ次のハッシュファイルの行と繋がらないよう補う
+                if contents.last().map_or(false, |last| *last != b'\n') {
+                    contents.push(b'\n');
+                }
+                merged_contents.append(&mut contents)
+            }
             Err(error) => {
                 let error =
                     log::make_error!("ハッシュファイルが読み込めませんでした。").with(&error);
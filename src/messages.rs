@@ -0,0 +1,665 @@
+use std::borrow::Cow;
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicBool, Ordering};
+
+use once_cell::sync::Lazy;
+use regex::{Captures, Regex, RegexSet};
+
+use crate::settings;
+
+/// メッセージの言語
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Language {
+    /// 日本語(初期値)
+    Japanese,
+    /// 英語
+    English,
+}
+
+impl Language {
+    /// 言語名から言語を返す。
+    pub fn from_name(name: &str) -> Option<Language> {
+        match name.to_ascii_lowercase().as_str() {
+            "ja" => Some(Language::Japanese),
+            "en" => Some(Language::English),
+            _ => None,
+        }
+    }
+}
+
+/// メッセージを英語で出力するか
+static ENGLISH: AtomicBool = AtomicBool::new(false);
+
+/// メッセージの言語を設定する。
+pub fn set_language(language: Language) {
+    ENGLISH.store(language == Language::English, Ordering::Relaxed);
+}
+
+/// コマンドラインオプションと環境変数で指定された言語を返す。
+/// 起動設定の読み込みで発生したエラーも指定の言語で出力できるよう、
+/// 設定ファイルより先に判定する。不正な値は起動設定の読み込みでエラーにするので無視する。
+pub fn requested_language(args: &[String], envs: &HashMap<String, String>) -> Option<Language> {
+    let mut value = envs
+        .get(settings::LANG.env_name)
+        .map(|value| value.as_str());
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        if arg == settings::LANG.option_name {
+            value = args.next().map(|value| value.as_str());
+        } else if let Some(inline_value) = arg
+            .strip_prefix(settings::LANG.option_name)
+            .and_then(|rest| rest.strip_prefix('='))
+        {
+            value = Some(inline_value);
+        }
+    }
+    value.and_then(Language::from_name)
+}
+
+/// 日本語のメッセージの書式と英語のメッセージの書式の一覧
+/// 英語の書式の"{}"は日本語の書式の値を順に、"{1}"などは指定の位置の値を埋め込む。
+const CATALOG: &[(&str, &str)] = &[
+    ("ハッシュファイルがありません。: {}", "The hash file does not exist.: {}"),
+    ("中断された実行の一時ファイルを{}件削除しました。: {}", "Removed {} temporary files left by an interrupted run.: {}"),
+    ("一時ファイルを削除できませんでした。: {}: {}", "Could not remove the temporary file.: {}: {}"),
+    ("{}: 繰り返しエラーになった{}件のファイルを除外しました。: {}", "{}: Excluded {} files that failed repeatedly.: {}"),
+    ("{}: 読み込みに失敗しました。再試行します。({}/{}): {}", "{}: Failed to read. Retrying. ({}/{}): {}"),
+    ("{}: 再試行で読み込めました。: {}", "{}: Read successfully on retry.: {}"),
+    ("失敗したファイルの一覧を削除できませんでした。", "Could not remove the list of failed files."),
+    ("失敗したファイルの一覧のフォルダを作成できませんでした。", "Could not create the folder for the list of failed files."),
+    ("失敗したファイルの一覧の出力に失敗しました。", "Failed to write the list of failed files."),
+    ("{}: 読み込みに失敗した{}件のファイルを記録しました。bcbc retryで再試行できます。: {}", "{}: Recorded {} files that failed to read. Retry them with bcbc retry.: {}"),
+    ("失敗したファイルの一覧を読み込めませんでした。", "Could not read the list of failed files."),
+    ("失敗したファイルの一覧の形式が不正です。", "The list of failed files is malformed."),
+    ("{}: {}回続けてエラーになった{}件のファイルを次回から除外します。: {}", "{}: {2} files that failed {1} times in a row will be excluded from the next run.: {3}"),
+    ("除外するファイルの一覧を読み込めませんでした。", "Could not read the list of excluded files."),
+    ("除外するファイルの一覧", "the list of excluded files"),
+    ("エラー回数の記録を読み込めませんでした。", "Could not read the error count record."),
+    ("エラー回数の記録の形式が不正です。", "The error count record is malformed."),
+    ("エラー回数の記録", "the error count record"),
+    ("除外レポート", "the exclusion report"),
+    ("{}のフォルダを作成できませんでした。", "Could not create the folder for {}."),
+    ("{}の出力に失敗しました。", "Failed to write {}."),
+    ("{}: 一覧にした後に削除されたファイルです。: {}", "{}: The file was deleted after it was listed.: {}"),
+    ("ハッシュファイルに書き込めません。", "Cannot write to the hash file."),
+    ("{}: 処理中に削除された{}件のファイルを対象から除外しました。", "{}: Excluded {} files that were deleted during processing."),
+    ("{}: 検証するハッシュファイルがありません。", "{}: There is no hash file to verify."),
+    ("封印されたディスク", "the sealed disk"),
+    ("ディスク", "the disk"),
+    ("{}: {}のファイルのハッシュが異なります。: {}", "{}: The hash of a file on {} differs.: {}"),
+    ("{}: {}からファイルがなくなっています。: {}", "{}: A file is missing from {}.: {}"),
+    ("{}: 封印されたディスクにファイルが追加されています。: {}", "{}: A file has been added to the sealed disk.: {}"),
+    ("{}: ハッシュファイルのパスを移動先に更新しました。: {} -> {}", "{}: Updated the path in the hash file to the new location.: {} -> {}"),
+    ("{}: {}のファイルが移動されています。: {} -> {}", "{}: A file on {} has been moved.: {} -> {}"),
+    ("{}: --update-renamedを付けて検証すると、ハッシュファイルのパスを移動先に更新します。", "{}: Verify with --update-renamed to update the paths in the hash file to the new locations."),
+    ("{}: {}の検証で差異はありませんでした。({}ファイル)", "{}: No differences were found while verifying {}. ({} files)"),
+    ("{}: {}に{}件の差異があります。(ハッシュ不一致 {}件 / 消失 {}件 / 移動 {}件 / 読み込み不可 {}件)", "{}: {} has {} differences. (hash mismatch {} / missing {} / moved {} / unreadable {})"),
+    ("{}: 書き込んだハッシュファイルを読み込み直せませんでした。出力先のディスクを確認してください。", "{}: Could not re-read the written hash file. Check the output disk."),
+    ("{}: 書き込んだハッシュファイルの行数が一致しません。出力先のディスクを確認してください。(書き込み {}件 / 読み込み {}件)", "{}: The line count of the written hash file does not match. Check the output disk. (written {} / read {})"),
+    ("{}: 前回の計算から変更されたファイルです。ハッシュを計算し直します。: {}", "{}: The file has changed since the last calculation. Recalculating its hash.: {}"),
+    ("{}: 代替データストリームが{}件あります。", "{}: There are {} alternate data streams."),
+    ("対象ファイルを読み込めません。", "Cannot read the target file."),
+    ("{}: 保存された途中経過から計算を再開します。({}MB目から): {}", "{}: Resuming the calculation from the saved checkpoint. (from {}MB): {}"),
+    ("対象ファイルが開けませんでした。", "Could not open the target file."),
+    ("{}: ハッシュ計算するファイルは{}件 / {:.2}GBです。", "{}: {} files / {}GB to hash."),
+    ("ハッシュ計算するファイルは合計{}件 / {:.2}GBです。ファイルの読み込みとハッシュファイルの更新は行いませんでした。", "{} files / {}GB to hash in total. No files were read and no hash files were updated."),
+    ("{}: 封印されたディスクは検証だけを行います。", "{}: Sealed disks are only verified."),
+    ("--new-idはpost-restoreでのみ指定できます。", "--new-id can only be used with post-restore."),
+    ("post-restoreには故障したディスクのIDと復元したディスクのルートを指定してください。", "Specify the ID of the failed disk and the root of the restored disk for post-restore."),
+    ("復元したディスクのルートがありません。: {}", "The root of the restored disk does not exist.: {}"),
+    ("{}: 割り当てるディスクIDのハッシュファイルが既にあります。", "{}: A hash file for the disk ID to assign already exists."),
+    ("ディスクID{}は別のディスクに登録済みです。", "Disk ID {} is already registered to another disk."),
+    ("{}: 復元したディスクで{}件のファイルを検証します。: {}", "{}: Verifying {} files on the restored disk.: {}"),
+    ("{}: 復元したディスクにファイルがありません。: {}", "{}: The file is missing on the restored disk.: {}"),
+    ("{}: 復元したファイルのハッシュが異なります。: {}", "{}: The hash of the restored file differs.: {}"),
+    ("{}: 復元の検証で{}件の差異がありました。ハッシュファイルは移行しません。", "{}: Found {} differences while verifying the restore. The hash file is not migrated."),
+    ("故障したディスクのハッシュファイルを移動できませんでした。: {}", "Could not move the hash file of the failed disk.: {}"),
+    ("{}: 復元したディスクを検証し、ハッシュファイルをディスク{}に移行しました。", "{}: Verified the restored disk and migrated the hash file to disk {}."),
+    ("--mountはimport-scrubでのみ指定できます。", "--mount can only be used with import-scrub."),
+    ("import-scrubにはスクラブのレポートのファイルを1つ指定してください。", "Specify one scrub report file for import-scrub."),
+    ("スクラブのレポートが読み込めませんでした。: {}", "Could not read the scrub report.: {}"),
+    ("ファイルのパスを特定できませんでした。: {}", "Could not determine the file path.: {}"),
+    ("スクラブのレポートにパスを特定できたファイルがありません。btrfsのレポートは--mountでマウント先を指定してください。", "No file paths could be determined from the scrub report. For btrfs reports, specify the mount point with --mount."),
+    ("スクラブのレポートにエラーのあるファイルはありません。", "The scrub report has no files with errors."),
+    ("スクラブで検出された{}件のファイルのうち、{}件は他のディスクに正常なコピーが見つかりません。", "Of the {} files flagged by the scrub, {} have no good copy on another disk."),
+    ("スクラブで検出された{}件のファイルは全て他のディスクにコピーがあります。", "All {} files flagged by the scrub have a copy on another disk."),
+    ("--dry-runはハッシュ計算でのみ指定できます。", "--dry-run can only be used for calc."),
+    ("--dry-runの--output-formatはjsonのみ指定できます。", "--output-format with --dry-run must be json."),
+    ("{}: 中断したため、計算済みのファイルまでで停止しました。(残り {}ファイル / {:.2}GB)", "{}: Interrupted; stopped after the files already calculated. (remaining {} files / {}GB)"),
+    ("ディスク({}のハッシュ計算中に問題が発生しました。", "A problem occurred while calculating the hashes of disk ({}."),
+    ("実行時間の上限に達したため停止しました。次回の実行では計算済みのファイルの続きから計算します。", "Stopped because the time limit was reached. The next run continues after the files already calculated."),
+    ("ユーザーにより処理が停止されました。次回の実行では計算済みのファイルの続きから計算します。", "Stopped by the user. The next run continues after the files already calculated."),
+    ("フォルダを確認します。", "Checking folders."),
+    ("フィルター設定を確認します。", "Checking filter settings."),
+    ("必須ファイル設定ファイルを確認します。", "Checking the pinned file settings."),
+    ("アクセス制御の設定ファイルを確認します。", "Checking the access control settings."),
+    ("ディスクレジストリを確認します。", "Checking the disk registry."),
+    ("diskファイルを確認します。", "Checking disk files."),
+    ("設定に問題はありません。", "No problems found in the settings."),
+    ("{}件の問題が見つかりました。", "Found {} problems."),
+    ("設定フォルダが読み込めません。: {}", "Cannot read the settings folder.: {}"),
+    ("出力フォルダに書き込めません。: {}", "Cannot write to the output folder.: {}"),
+    ("ディスクレジストリのフォルダに書き込めません。: {}", "Cannot write to the disk registry folder.: {}"),
+    ("ハッシュ計算の途中経過を保存できませんでした。: {}: {}", "Could not save the calculation checkpoint.: {}: {}"),
+    ("{}のみ {}件 / {}のみ {}件 / 不一致 {}件", "only in {} {} / only in {} {} / mismatched {}"),
+    ("グループ{}のハッシュファイルがありません。", "There are no hash files for group {}."),
+    ("修正リストのフォルダを作成できませんでした。: {}", "Could not create the folder for the fix list.: {}"),
+    ("修正リストの作成に失敗しました。: {}", "Failed to create the fix list.: {}"),
+    ("修正リストを出力しました。: {} ({}件)", "Wrote the fix list.: {} ({} entries)"),
+    ("フォルダではありません。: {}", "Not a folder.: {}"),
+    ("フォルダの比較を開始します。", "Starting the folder comparison."),
+    ("一致 {}件 / 1つ目のみ {}件 / 2つ目のみ {}件 / 不一致 {}件", "matched {} / only in first {} / only in second {} / mismatched {}"),
+    ("コピー元がフォルダではありません。: {}", "The copy source is not a folder.: {}"),
+    ("コピーを開始します。", "Starting the copy."),
+    ("コピー先にファイルがあるためスキップします。: {}", "Skipping because the file exists at the destination.: {}"),
+    ("コピーしました。: {}", "Copied.: {}"),
+    ("コピーを終了しました。コピー {}件 / スキップ {}件 / エラー {}件", "Finished the copy. copied {} / skipped {} / errors {}"),
+    ("コピー先のフォルダを作成できませんでした。: {}", "Could not create the destination folder.: {}"),
+    ("ディスク{}は封印されているためコピーできません。", "Cannot copy because disk {} is sealed."),
+    ("コピー先のディスクのハッシュアルゴリズムが揃っていません。: {}({}) / {}", "The hash algorithms of the destination disks differ.: {}({}) / {}"),
+    ("コピー元のファイルが開けませんでした。: {}", "Could not open the source file.: {}"),
+    ("コピー元のファイルを読み込めません。: {}", "Cannot read the source file.: {}"),
+    ("コピー先のファイルに書き込めません。: {}", "Cannot write to the destination file.: {}"),
+    ("コピー先のファイルをディスクに書き込めません。: {}", "Cannot flush the destination file to disk.: {}"),
+    ("コピー先のファイルを作成できませんでした。: {}", "Could not create the destination file.: {}"),
+    ("コピー先のハッシュがコピー元と異なります。: {}", "The hash of the destination differs from the source.: {}"),
+    ("コピー先がディスク{}の中にありません。: {}", "The destination is not inside disk {}.: {}"),
+    ("md5sum互換のファイルの出力先を作成できませんでした。: {}", "Could not create the folder for md5sum-compatible files.: {}"),
+    ("md5sum互換のファイルを出力できませんでした。: {}", "Could not write the md5sum-compatible file.: {}"),
+    ("md5sum互換のファイルを出力しました。: {}", "Wrote the md5sum-compatible file.: {}"),
+    ("ディスク{}は封印されているため取り込めません。", "Cannot import because disk {} is sealed."),
+    ("md5sum互換のファイルを読み込めませんでした。: {}", "Could not read the md5sum-compatible file.: {}"),
+    ("ハッシュの長さがアルゴリズム{}と一致しません。: {}: {}番目のハッシュ", "The hash length does not match algorithm {}.: {}: hash #{}"),
+    ("{}件のハッシュをディスク{}のハッシュファイルに取り込みました。", "Imported {} hashes into the hash file of disk {}."),
+    ("行の形式が不正です。", "The line is malformed."),
+    ("ハッシュが不正です。: {}", "Invalid hash.: {}"),
+    ("パスが不正です。: {}", "Invalid path.: {}"),
+    ("ハッシュの長さからアルゴリズムを判定できません。--algoで指定してください。", "Cannot determine the algorithm from the hash length. Specify it with --algo."),
+    ("ディスク{}のハッシュファイルがありません。", "There is no hash file for disk {}."),
+    ("{}: 重複した行はありません。", "{}: There are no duplicate lines."),
+    ("{}: 重複した行が{}件ありますが、封印されたディスクのため変更しません。", "{}: There are {} duplicate lines, but the disk is sealed and will not be changed."),
+    ("{}: 重複した行を{}件削除しました。: {}", "{}: Removed {} duplicate lines.: {}"),
+    ("重複レポートのフォルダを作成できませんでした。", "Could not create the folder for the duplicate report."),
+    ("重複レポートの作成に失敗しました。", "Failed to create the duplicate report."),
+    ("ハッシュファイルのアルゴリズムが異なるため比較できません。: {}={}, {}={}", "Cannot compare because the hash file algorithms differ.: {}={}, {}={}"),
+    ("一致 {}件 / {}のみ {}件 / {}のみ {}件 / 不一致 {}件", "matched {} / only in {} {} / only in {} {} / mismatched {}"),
+    ("処理対象のディスクがありません。", "There are no disks to process."),
+    ("{}個のdiskファイルが見つかりました。: {}", "Found {} disk files.: {}"),
+    ("diskファイルがありません。", "There is no disk file."),
+    ("ディスクIDが書かれていないdiskファイルを無視します。: {}", "Ignoring a disk file without a disk ID.: {}"),
+    ("指定されたフォルダにdiskファイルがありません。: {}", "There is no disk file in the specified folder.: {}"),
+    ("パスを絶対パスにできませんでした。: {}", "Could not make the path absolute.: {}"),
+    ("ディスクの中のパスではありません。: {}", "The path is not inside a disk.: {}"),
+    ("diskファイルの内容が不正です。: {}", "The disk file is malformed.: {}"),
+    ("diskファイルが読み込めませんでした。: {}", "Could not read the disk file.: {}"),
+    ("diskファイルの内容が不正です。: {}: {}行目: {}", "The disk file is malformed.: {}: line {}: {}"),
+    ("\"キー=値\"の形式ではありません。", "Not in the form \"key=value\"."),
+    ("サブルートのプレフィックスが重複しています。", "The subroot prefix is duplicated."),
+    ("サブルートのフォルダがありません。", "The subroot folder does not exist."),
+    ("優先度はhigh、normal、lowのいずれかを指定してください。", "The priority must be one of high, normal or low."),
+    ("完了時の処理はunmount、eject、spindown、run コマンドのいずれかを指定してください。", "The completion action must be one of unmount, eject, spindown or run COMMAND."),
+    ("{}: 完了時の処理を行いました。: {}", "{}: Ran the completion action.: {}"),
+    ("{}: 完了時の処理に失敗したため、残りの処理を中止します。: {}", "{}: The completion action failed, so the remaining actions are skipped.: {}"),
+    ("ディスクのデバイスがわかりません。: {}", "Could not determine the device of the disk.: {}"),
+    ("コマンドを実行できませんでした。: {}", "Could not run the command.: {}"),
+    ("コマンドが失敗しました。: {}: {}", "The command failed.: {}: {}"),
+    ("この環境ではspindownを行えません。", "spindown is not available on this platform."),
+    ("この環境では{}を行えません。", "{} is not available on this platform."),
+    ("不明なキーです。", "Unknown key."),
+    ("サブルートのプレフィックスにパス区切り文字は使えません。", "A subroot prefix cannot contain a path separator."),
+    ("サブルートのプレフィックスがディスクルート直下のファイルかフォルダと同じ名前です。", "The subroot prefix has the same name as a file or folder directly under the disk root."),
+    ("サブルートがディスクルートの中にあります。", "The subroot is inside the disk root."),
+    ("サブルートは\"プレフィックス パス\"の形式で指定してください。", "Specify a subroot in the form \"prefix path\"."),
+    ("指定されたディスク{}が見つかりません。", "The specified disk {} was not found."),
+    ("ディスクID{}が複数のディスクで使われています。: {}", "Disk ID {} is used by more than one disk.: {}"),
+    ("イベントログファイルを開けませんでした。: {}", "Could not open the event log file.: {}"),
+    ("イベントログに書き込めませんでした。: {}", "Could not write to the event log.: {}"),
+    ("{}のハッシュファイルがありません。", "There is no hash file for {}."),
+    ("出力先のフォルダを作成できませんでした。: {}", "Could not create the destination folder.: {}"),
+    ("HTMLファイルの出力に失敗しました。", "Failed to write the HTML file."),
+    ("{}件のファイルをHTMLファイルに出力しました。: {}", "Wrote {} files to the HTML file.: {}"),
+    ("権限なし", "permission denied"),
+    ("読み込み失敗", "read failure"),
+    ("処理中に消失", "vanished during processing"),
+    ("パスが長すぎる", "path too long"),
+    ("中断", "interrupted"),
+    ("その他", "other"),
+    ("計算の途中で中断しました。: {}", "Interrupted during the calculation.: {}"),
+    ("{} {}件", "{} {}"),
+    ("{}: ファイルのエラー: {}", "{}: file errors: {}"),
+    ("パターンファイルがUTF-8のテキストファイルではありません。: {}", "The pattern file is not a UTF-8 text file.: {}"),
+    ("パターンファイルが読み込めませんでした。: {}", "Could not read the pattern file.: {}"),
+    ("パターンファイルのglobパターンが不正です。: {}: {}行目: {}", "Invalid glob pattern in the pattern file.: {}: line {}: {}"),
+    ("パターンファイルのパターンが不正です。: {}: {}行目: {}", "Invalid pattern in the pattern file.: {}: line {}: {}"),
+    ("globパターンがありません。", "The glob pattern is missing."),
+    ("globパターンの\"**\"はフォルダ名全体に書いてください。", "\"**\" in a glob pattern must be a whole folder name."),
+    ("globパターンの\"[\"が閉じていません。", "\"[\" in the glob pattern is not closed."),
+    ("globパターンの\"{\"が閉じていません。", "\"{\" in the glob pattern is not closed."),
+    ("globパターンが\"\\\"で終わっています。", "The glob pattern ends with \"\\\"."),
+    ("globパターンが不正です。", "Invalid glob pattern."),
+    ("パターンファイルの正規表現パターンが不正です。: {}: {}行目", "Invalid regular expression in the pattern file.: {}: line {}"),
+    ("フィルター設定ファイルが見つかりません。", "The filter settings file was not found."),
+    ("フィルター設定ファイルがUTF-8のテキストファイルではありません。", "The filter settings file is not a UTF-8 text file."),
+    ("フィルター設定ファイルの形式が不正です。: {}行目: {}", "The filter settings file is malformed.: line {}: {}"),
+    ("プロファイル名が空か、重複しています。", "The profile name is empty or duplicated."),
+    ("フィルタープロファイル{}がありません。", "Filter profile {} does not exist."),
+    ("サイズの条件が不正です。(例: size>100M, size<=1K)", "The size condition is invalid. (e.g. size>100M, size<=1K)"),
+    ("拡張子がありません。", "No extensions are given."),
+    ("正規表現パターンが不正です。", "Invalid regular expression."),
+    ("正規表現パターンがありません。", "The regular expression is missing."),
+    ("行頭が'+'または'-'ではありません。", "The line does not start with '+' or '-'."),
+    ("名前空間{}を使用します。: {}", "Using namespace {}.: {}"),
+    ("出力フォルダかディスクレジストリのフォルダに書き込めないため、読み取り専用モードで実行します。", "Running in read-only mode because the output folder or the disk registry folder is not writable."),
+    ("ハッシュ計算を中止しました。", "Cancelled the hash calculation."),
+    ("代替データストリームはWindowsでのみ扱えるため、--streamsを無視します。", "Ignoring --streams because alternate data streams are only supported on Windows."),
+    ("ハッシュファイルの検証を開始します。", "Starting to verify the hash files."),
+    ("ハッシュ計算を開始します。", "Starting the hash calculation."),
+    ("失敗したファイルのハッシュ計算を再試行します。", "Retrying the hash calculation of the failed files."),
+    ("{}: 再試行するファイルはありません。", "{}: There are no files to retry."),
+    ("{}: 空いた枠で計算スレッドを{}個追加しました。", "{}: Added {} calculation threads using freed slots."),
+    ("ハッシュファイルの検証を終了しました。", "Finished verifying the hash files."),
+    ("検証で{}件の差異がありました。", "Verification found {} differences."),
+    ("統合ハッシュファイルは作り直しません。bcbc mergeで作り直してください。", "The merged hash file is not rebuilt. Rebuild it with bcbc merge."),
+    ("ハッシュ計算を終了しました。", "Finished the hash calculation."),
+    ("全速力でハッシュ計算を行います。", "Calculating hashes at full speed."),
+    ("読み込み用のバッファをディスクごとに{}MBから{}MBに増やします。", "Increasing the read buffer per disk from {}MB to {}MB."),
+    ("ディスクごとに読み込みスレッドを追加し、計算スレッドを{}から{}に増やします。", "Adding a read thread per disk and increasing the calculation threads from {} to {}."),
+    ("進捗状況はファイルごとには出力せず、1秒ごとに出力します。", "Progress is reported every second instead of per file."),
+    ("続行しますか？ [y/N] ", "Continue? [y/N] "),
+    ("確認を表示できませんでした。", "Could not show the confirmation."),
+    ("確認の回答を読み込めませんでした。", "Could not read the confirmation answer."),
+    ("全ての必須ファイルがあります。", "All pinned files are present."),
+    ("ハッシュファイルがありません。", "The hash file does not exist."),
+    ("出力フォルダを作成できませんでした。: {}", "Could not create the output folder.: {}"),
+    ("同じパスの行が{}件重複しています。うち{}件はハッシュが異なります。最後の行を使用します。: {}", "{} lines have duplicate paths, {} of which have different hashes. Using the last line.: {}"),
+    ("ハッシュファイルが読み込めませんでした。: {}", "Could not read the hash file.: {}"),
+    ("ハッシュファイルのアルゴリズム{}と指定されたアルゴリズム{}が異なります。: {}", "The hash file algorithm {} differs from the specified algorithm {}.: {}"),
+    ("ハッシュファイルのアルゴリズムが不明です。: {}", "Unknown hash file algorithm.: {}"),
+    ("ハッシュファイルのエンコーディングが不正です。", "The hash file encoding is invalid."),
+    ("ハッシュファイルの形式が不正です。", "The hash file is malformed."),
+    ("ハッシュファイルのパスのエスケープが不正です。", "Invalid path escaping in the hash file."),
+    ("ハッシュの長さが{}のハッシュではありません。", "The hash length does not match {}."),
+    ("ハッシュファイルのバックアップに失敗しました。", "Failed to back up the hash file."),
+    ("出力フォルダが読み込めません。: {}", "Cannot read the output folder.: {}"),
+    ("元のハッシュファイルがないバックアップは削除しません。: {}", "Not removing a backup whose original hash file is missing.: {}"),
+    ("ハッシュファイルのバックアップを削除できませんでした。: {}", "Could not remove the hash file backup.: {}"),
+    ("ハッシュファイルのバックアップを{}件削除しました。: {}", "Removed {} hash file backups.: {}"),
+    ("ハッシュファイルの作成に失敗しました", "Failed to create the hash file"),
+    ("ハッシュファイルのバックアップを削除できませんでした。", "Could not remove the hash file backup."),
+    ("ハッシュファイルをディスクに書き出せません。: {}", "Cannot flush the hash file to disk.: {}"),
+    ("ハッシュファイルを開けません。: {}", "Cannot open the hash file.: {}"),
+    ("中断を受け付けました。計算中のファイルが終わったら停止します。もう一度押すと直ちに終了します。", "Interrupt received. Stopping after the files being calculated. Press again to exit immediately."),
+    ("実行時間の上限に達しました。計算中のファイルが終わったら停止します。", "The time limit was reached. Stopping after the files being calculated."),
+    ("停止ファイルを検出しました。計算中のファイルが終わったら停止します。: {}", "Detected the stop file. Stopping after the files being calculated.: {}"),
+    ("Ctrl+Cハンドラが設定できませんでした。", "Could not set the Ctrl+C handler."),
+    ("カレントフォルダが参照できません。", "Cannot access the current folder."),
+    ("この環境ではメモリ使用量を取得できないため、メモリ使用量の上限を無視します。", "Ignoring the memory limit because memory usage is not available in this environment."),
+    ("メモリ使用量が上限を超えました。({}MB > {}MB) 読み込み用のバッファを{}MBに縮小し、ディスクごとに1ファイルずつ計算します。", "Memory usage exceeded the limit. ({}MB > {}MB) Shrinking the read buffer to {}MB and calculating one file at a time per disk."),
+    ("ハッシュファイルの統合を開始します。", "Starting to merge the hash files."),
+    ("ハッシュファイルの統合を終了しました。", "Finished merging the hash files."),
+    ("出力ファイルの一覧を取得できませんでした。", "Could not list the output files."),
+    ("統合ハッシュファイルを削除しました。: {}", "Removed the merged hash file.: {}"),
+    ("統合ハッシュファイルを削除できませんでした。: {}", "Could not remove the merged hash file.: {}"),
+    ("統合ハッシュファイルの作成に失敗しました。", "Failed to create the merged hash file."),
+    ("アルゴリズムが異なるハッシュファイルを統合します。: {}", "Merging hash files with different algorithms.: {}"),
+    ("ハッシュファイルが読み込めませんでした。", "Could not read the hash file."),
+    ("ハッシュファイルの内容が不正です。", "The hash file content is invalid."),
+    ("ロックファイルを開けませんでした。: {}", "Could not open the lock file.: {}"),
+    ("他のbcbcが出力フォルダを使用中です。終了してから実行してください。: {}", "Another bcbc is using the output folder. Run again after it finishes.: {}"),
+    ("出力フォルダをロックできませんでした。: {}", "Could not lock the output folder.: {}"),
+    ("{}: 必須ファイルがありません。: {}", "{}: A pinned file is missing.: {}"),
+    ("必須ファイル設定ファイルが読み込めませんでした。", "Could not read the pinned file settings."),
+    ("必須ファイルの前にディスクIDかグループ名の行がありません。", "There is no disk ID or group name line before the pinned files."),
+    ("ディスクIDかグループ名ではありません。: {}", "Not a disk ID or group name.: {}"),
+    ("{}日ごとに全てのバイトを読み込むため、{}日ごとに検証します。(通常の優先度のディスクは{}回に分けて検証します)", "To read every byte every {} days, verifying every {} days. (Disks with normal priority are verified in {} parts.)"),
+    ("{}\t{}\t{}\t{}/回\t{}\t{:.0}%/{:.0}%", "{}\t{}\t{}\t{}/run\t{}\t{}%/{}%"),
+    ("{:.1}時間", "{} hours"),
+    ("{}: 1回の検証が{}時間に収まりません。(見込み {:.1}時間) 間隔を短くしてください。", "{}: One verification does not fit in {} hours. (estimated {} hours) Shorten the interval."),
+    ("{}: 検証が予定より遅れています。(読み込み済み {:.0}% / 予定 {:.0}%)", "{}: Verification is behind schedule. (read {}% / planned {}%)"),
+    ("1回の実行で読み込む量の合計: {} / 予定より遅れているディスク: {}台", "Total read per run: {} / disks behind schedule: {}"),
+    ("{}: ファイルサイズの記録がないため計画できません。", "{}: Cannot plan because there is no file size record."),
+    ("ディスク情報が1つもない状態で進捗ログ出力が実行されました。", "Progress was logged without any disk information."),
+    ("経過{}:{:02}:{:02}", "elapsed {}:{}:{}"),
+    (" ディスク{}/{}", " disks {}/{}"),
+    (" ファイル{}/{}", " files {}/{}"),
+    (" - 全体 ", " - total "),
+    ("残り{:.2}GB/{}ファイル", "remaining {}GB/{} files"),
+    ("進捗更新メッセージの種別が不正です。: status={:?} message_type={:?}", "Invalid progress update message type.: status={} message_type={}"),
+    ("進捗更新メッセージの送信に失敗しました。", "Failed to send the progress update message."),
+    ("{}: ハッシュファイルがありません。", "{}: The hash file does not exist."),
+    ("ファイルではありません。: {}", "Not a file.: {}"),
+    ("ファイルがありません。: {}", "The file does not exist.: {}"),
+    ("{}: ハッシュファイルに記録されていないファイルです。: {}", "{}: The file is not recorded in the hash file.: {}"),
+    ("{}: ハッシュが異なります。: {}", "{}: The hash differs.: {}"),
+    ("{}: ハッシュが一致しました。: {}", "{}: The hash matched.: {}"),
+    ("シンボリックリンクは対象外です。: {}", "Symbolic links are not targets.: {}"),
+    ("シンボリックリンクのリンク先を読み込めません。: {}", "Cannot read the target of the symbolic link.: {}"),
+    ("{}件のファイルのハッシュが異なります。", "The hashes of {} files differ."),
+    ("{}: 封印されたディスクのハッシュファイルは変更できません。", "{}: The hash file of a sealed disk cannot be changed."),
+    ("{}: 削除する行はありません。", "{}: There are no lines to remove."),
+    ("{}: ディスクにないファイルの行が{}件あります。", "{}: There are {} lines for files not on the disk."),
+    ("{}: ディスクにないファイルの行を{}件削除しました。", "{}: Removed {} lines for files not on the disk."),
+    ("ハッシュファイルを作業フォルダにコピーできませんでした。: {}", "Could not copy the hash file to the work folder.: {}"),
+    ("読み取り専用モードで実行します。作業フォルダ: {}", "Running in read-only mode. Work folder: {}"),
+    ("{}: 追加 {}行 / 削除 {}行", "{}: added {} lines / removed {} lines"),
+    ("レポートを出力しました。: {}", "Wrote the report.: {}"),
+    ("レポートの作成に失敗しました。", "Failed to create the report."),
+    ("ディスクレジストリが読み込めませんでした。: {}", "Could not read the disk registry.: {}"),
+    ("ディスクレジストリの形式が不正です。", "The disk registry is malformed."),
+    ("ディスク{}をレジストリに登録します。: {}", "Registering disk {} in the registry.: {}"),
+    ("ディスクID{}は別のディスクに発行済みです。: {} (登録済み: {})", "Disk ID {} has already been issued to another disk.: {} (registered: {})"),
+    ("ディスク{}のルートを更新します。: {} -> {}", "Updating the root of disk {}.: {} -> {}"),
+    ("ディスクレジストリの書き込みに失敗しました。", "Failed to write the disk registry."),
+    ("{}: 更新日時を取得できませんでした。: {}", "{}: Could not get the modification time.: {}"),
+    ("{}: 全 {}ファイル {}", "{}: all {} files {}"),
+    (" / {}日より古い {}ファイル {}", " / older than {} days {} files {}"),
+    (" / {}日より新しい {}ファイル {}", " / newer than {} days {} files {}"),
+    ("グループ{}のディスク{}台以上にないファイルが{}件あります。", "{2} files are not on at least {1} disks of group {0}."),
+    ("古いファイルは全てグループ{}のディスク{}台以上にあります。", "All old files are on at least {1} disks of group {0}."),
+    ("オプション{}にはディスクIDを1つ指定してください。", "Specify one disk ID for option {}."),
+    ("不明なオプションです。: {}", "Unknown option.: {}"),
+    ("--diskと--asは同時に指定してください。", "Specify --disk and --as together."),
+    ("--asを指定する場合は入力を1つだけ指定してください。", "Specify only one input with --as."),
+    ("--min-copiesと--copy-groupは同時に指定してください。", "Specify --min-copies and --copy-group together."),
+    ("--min-copiesには--older-thanも指定してください。", "Specify --older-than with --min-copies."),
+    ("--older-thanと--newer-thanは検証とretentionでのみ指定できます。", "--older-than and --newer-than can only be used with verification and retention."),
+    ("--newer-thanは検証では指定できません。", "--newer-than cannot be used with verification."),
+    ("{}: {}日以内に検証した{}件のファイルは検証しません。", "{}: Skipping {2} files verified within the last {1} days."),
+    ("{}: 検証計画の1回の読み込み量({:.2}GB)を超える{}件のファイルは次の実行で検証します。", "{}: {2} files beyond the planned amount per run ({1}GB) will be verified in a later run."),
+    ("{}: 最後に検証した日時の記録を読み込めませんでした。", "{}: Could not read the last verification times."),
+    ("{}: ハッシュのデータベースのフォルダを作成できませんでした。", "{}: Could not create the folder for the hash database."),
+    ("{}: ハッシュのデータベースを操作できませんでした。", "{}: Could not access the hash database."),
+    ("{}: ハッシュのデータベースの形式が不正です。: {}", "{}: The hash database is malformed.: {}"),
+    ("最後に検証した日時の記録の形式が不正です。", "The last verification time record has an invalid format."),
+    ("{}: 最後に検証した日時の記録フォルダを作成できませんでした。", "{}: Could not create the folder for the last verification times."),
+    ("{}: 最後に検証した日時の記録に失敗しました。", "{}: Failed to record the last verification times."),
+    ("--periodと--intervalには1日以上を指定してください。", "Specify at least one day for --period and --interval."),
+    ("--pathはハッシュ計算と検証でのみ指定できます。", "--path can only be used for hash calculation and verification."),
+    ("--streamsはハッシュ計算と検証でのみ指定できます。", "--streams can only be used for hash calculation and verification."),
+    ("--algoはcalc、hash、copy、compare-dirs、import-sumsでのみ指定できます。", "--algo can only be used with calc, hash, copy, compare-dirs and import-sums."),
+    ("--output-formatは検証でのみ指定できます。", "--output-format can only be used for verification."),
+    ("--output-format coreutilsはハッシュ計算でのみ指定できます。", "--output-format coreutils can only be used for hash calculation."),
+    ("--progress-formatはハッシュ計算、検証、retryでのみ指定できます。", "--progress-format can only be used for hash calculation, verification and retry."),
+    ("--progress-format jsonと--output-formatは同時に指定できません。", "--progress-format json and --output-format cannot be used together."),
+    ("--no-mergeはハッシュ計算とwatchでのみ指定できます。", "--no-merge can only be used for hash calculation and watch."),
+    ("--pollと--settleはwatchでのみ指定できます。", "--poll and --settle can only be used with watch."),
+    ("--full-speedはwatchでは指定できません。", "--full-speed cannot be used with watch."),
+    ("--groupと--labelはinitでのみ指定できます。", "--group and --label can only be used with init."),
+    ("initにはdiskファイルを作成するディスクのルートを1つ指定してください。", "Specify one disk root to create the disk file for init."),
+    ("ディスクのルートフォルダがありません。: {}", "The disk root folder does not exist.: {}"),
+    ("diskファイルは作成済みです。上書きしません。: {}", "The disk file already exists. It will not be overwritten.: {}"),
+    ("ラベルに改行は使えません。", "The label cannot contain line breaks."),
+    ("ラベル", "label"),
+    ("シリアル番号", "serial number"),
+    ("購入日", "purchased"),
+    ("ディスクID\tラベル\tシリアル番号\t購入日\t行数\t最後の計算\t最後の検証\tメモ", "disk ID\tlabel\tserial number\tpurchased\tlines\tlast calculated\tlast verified\tnotes"),
+    ("{}: ディスクの情報の保存先を作成できませんでした。", "{}: Could not create the folder for the disk information."),
+    ("{}: ディスクの情報を保存できませんでした。", "{}: Could not save the disk information."),
+    ("{}: ディスクの情報を読み込めませんでした。", "{}: Could not read the disk information."),
+    ("ディスクの情報の形式が不正です。", "The disk information has an invalid format."),
+    ("同じキーが2回指定されています。", "The same key is specified twice."),
+    ("--no-tuiはハッシュ計算、検証、retry、watchでのみ指定できます。", "--no-tui can only be specified for calc, verify, retry and watch."),
+    ("{}: ディスクの容量は{:.2}GBです。", "{}: The disk capacity is {}GB."),
+    ("{}: ディスクの容量を取得できませんでした。", "{}: Could not get the disk capacity."),
+    ("diskファイルを作成できませんでした。: {}", "Could not create the disk file.: {}"),
+    ("diskファイルを作成しました。: {} ({})", "Created the disk file.: {} ({})"),
+    ("日付はYYYY-MM-DDの形式で指定してください。", "Specify the date in YYYY-MM-DD format."),
+    ("容量はバイト数で指定してください。", "Specify the capacity in bytes."),
+    ("グループ{}に同じ内容のファイルの組が{}組あります。重複を削除すると{:.2}GB空けられます。", "Group {} has {} sets of identical files. Removing the duplicates would free {}GB."),
+    ("グループ{}の{}組はバイト数が記録されていないため、空けられる容量に含めていません。", "{1} sets in group {0} are not included in the reclaimable size because their sizes are not recorded."),
+    ("ディスクの監視を開始します。{}秒ごとに確認します。", "Starting to watch disks. Checking every {} seconds."),
+    ("出力フォルダをロックできなかったため、次の確認で計算します。", "Could not lock the output folder; will calculate at the next check."),
+    ("ディスクの監視を終了しました。", "Finished watching disks."),
+    ("{}: 更新されたばかりの{}件のファイルは次の確認で計算します。", "{}: {} recently modified files will be calculated at the next check."),
+    ("--update-renamedは検証でのみ指定できます。", "--update-renamed can only be used for verification."),
+    ("--quotaは検証でのみ指定できます。", "--quota can only be used for verification."),
+    ("--report-onlyはpruneでのみ指定できます。", "--report-only can only be used with prune."),
+    ("--max-durationはハッシュ計算、検証、retryでのみ指定できます。", "--max-duration can only be used for hash calculation, verification and retry."),
+    ("--summaryはハッシュ計算、検証、retryでのみ指定できます。", "--summary can only be used for hash calculation, verification and retry."),
+    ("--summaryは--read-onlyと--dry-runと同時に指定できません。", "--summary cannot be used with --read-only or --dry-run."),
+    ("--verify-after-calcはハッシュ計算とretryでのみ指定できます。", "--verify-after-calc can only be used for hash calculation and retry."),
+    ("--extra-algosはハッシュ計算とretryでのみ指定できます。", "--extra-algos can only be used for hash calculation and retry."),
+    ("--chunked-thresholdはハッシュ計算、検証、retryでのみ指定できます。", "--chunked-threshold can only be used for hash calculation, verification and retry."),
+    ("--read-onlyはハッシュ計算と検証でのみ指定できます。", "--read-only can only be used for hash calculation and verification."),
+    ("import-sumsには取り込むファイルと取り込み先のディスクIDを指定してください。", "Specify the file to import and the destination disk ID for import-sums."),
+    ("syncには取り込み元の出力フォルダを1つ指定してください。", "Specify one source output folder for sync."),
+    ("restore-trimmedには削除した行の保存ファイルを指定してください。", "Specify the saved file of removed lines for restore-trimmed."),
+    ("checkには検証するファイルを指定してください。", "Specify the files to verify for check."),
+    ("serveには引数を指定できません。", "serve takes no arguments."),
+    ("mergeには引数を指定できません。", "merge takes no arguments."),
+    ("cleanには引数を指定できません。", "clean takes no arguments."),
+    ("sealには封印するディスクIDを指定してください。", "Specify the disk ID to seal for seal."),
+    ("diffには比較するグループ名、ディスクID、ハッシュファイルを2つ指定してください。", "Specify two group names, disk IDs or hash files to compare for diff."),
+    ("compare-dirsには比較するフォルダを2つ指定してください。", "Specify two folders to compare for compare-dirs."),
+    ("hashには入力を指定してください。標準入力なら\"-\"を指定してください。", "Specify the input for hash. Use \"-\" for standard input."),
+    ("copyにはコピー元と1つ以上のコピー先のフォルダを指定してください。", "Specify the source folder and one or more destination folders for copy."),
+    ("labelにはディスクIDを指定してください。", "Specify the disk ID for label."),
+    ("export-htmlにはディスクIDかグループと、出力先のフォルダを指定してください。", "Specify a disk ID or group and the destination folder for export-html."),
+    ("tagには\"ディスクID:パス\"とタグを指定してください。", "Specify \"disk ID:path\" and tags for tag."),
+    ("untagには\"ディスクID:パス\"と、外すタグを指定してください。", "Specify \"disk ID:path\" and the tags to remove for untag."),
+    ("compareには比較するグループを2つ指定してください。", "Specify two groups to compare for compare."),
+    ("{}の値がグループ名ではありません。: {}", "The value of {} is not a group name.: {}"),
+    ("{}の値はjson、tap、coreutilsのいずれかを指定してください。: {}", "The value of {} must be one of json, tap or coreutils.: {}"),
+    ("{}の値はtextかjsonを指定してください。: {}", "The value of {} must be text or json.: {}"),
+    ("グループの出力フォルダの名前に使えません。: {}", "Cannot be used as the name of a group output folder.: {}"),
+    ("名前空間の名前に使えません。: {}", "Cannot be used as a namespace name.: {}"),
+    ("{}にはディスクルートからの相対パスを指定してください。: {}", "Specify a path relative to the disk root for {}.: {}"),
+    ("オプション{}の値がありません。", "Option {} has no value."),
+    ("オプション{}の値が1以上の整数ではありません。: {}", "The value of option {} is not an integer of 1 or more.: {}"),
+    ("オプション{}の値が1から100までの整数ではありません。: {}", "The value of option {} is not an integer from 1 to 100.: {}"),
+    ("オプション{}の値が時間ではありません。(例: 6h, 90m): {}", "The value of option {} is not a duration. (e.g. 6h, 90m): {}"),
+    ("オプション{}の値が期間ではありません。(例: 5y, 6m, 30d): {}", "The value of option {} is not a period. (e.g. 5y, 6m, 30d): {}"),
+    ("オプション{}の値がディスクIDではありません。: {}", "The value of option {} is not a disk ID.: {}"),
+    ("環境変数BCBCHOMEが設定されていません。初めて使う場合はbcbc setupで初期設定を作成してください。", "Environment variable BCBCHOME is not set. If this is your first time, run bcbc setup to create the initial settings."),
+    ("bcbcの初期設定を作成します。Enterキーだけを押すと[ ]内の値を使います。", "Creating the initial settings for bcbc. Press Enter alone to use the value in [ ]."),
+    ("BCBCHOMEのフォルダ", "BCBCHOME folder"),
+    ("最初のディスクのルートフォルダ(省略するとスキップします)", "Root folder of the first disk (leave empty to skip)"),
+    ("ディスクID", "Disk ID"),
+    ("質問を表示できませんでした。", "Could not show the question."),
+    ("回答を読み込めませんでした。", "Could not read the answer."),
+    ("フォルダは作成済みです。: {}", "The folder already exists.: {}"),
+    ("フォルダを作成しました。: {}", "Created the folder.: {}"),
+    ("フォルダを作成できませんでした。: {}", "Could not create the folder.: {}"),
+    ("フォルダに書き込めません。: {}", "Cannot write to the folder.: {}"),
+    ("フォルダがありません。: {}", "The folder does not exist.: {}"),
+    ("設定ファイルは作成済みのため変更しません。: {}", "The settings file already exists and is left unchanged.: {}"),
+    ("設定ファイルを作成しました。: {}", "Created the settings file.: {}"),
+    ("フィルター設定ファイルが読み込めませんでした。: {}", "Could not read the filter settings file.: {}"),
+    ("フィルター設定ファイルは作成済みのため変更しません。: {}", "The filter settings file already exists and is left unchanged.: {}"),
+    ("フィルター設定ファイルを作成しました。: {}", "Created the filter settings file.: {}"),
+    ("ファイルを作成できませんでした。: {}", "Could not create the file.: {}"),
+    ("diskファイルは作成済みです。: {} ({})", "The disk file already exists.: {} ({})"),
+    ("diskファイルのディスクIDが不正です。: {}", "The disk ID in the disk file is invalid.: {}"),
+    ("ディスクIDはグループ名の英大文字と連番にしてください。(例: A1): {}", "The disk ID must be an uppercase group letter followed by a number (e.g. A1).: {}"),
+    ("ディスクIDは別のディスクに登録済みです。: {} ({})", "The disk ID is already registered to another disk.: {} ({})"),
+    ("diskファイルを作成しました。: {}", "Created the disk file.: {}"),
+    ("初期設定を作成しました。", "Created the initial settings."),
+    ("環境変数BCBCHOMEに{}を設定してください。", "Set the environment variable BCBCHOME to {}."),
+    ("bcbc check-config {0}で設定を確認し、bcbc {0}でハッシュ計算を開始できます。", "Check the settings with bcbc check-config {0} and start hashing with bcbc {0}."),
+    ("ディスクのルートにdiskファイルを作成してから、ハッシュ計算を開始してください。", "Create a disk file in the root of each disk before starting hashing."),
+    ("封印されたディスクの一覧を取得できませんでした。", "Could not list the sealed disks."),
+    ("封印の保存フォルダを作成できませんでした。", "Could not create the seal folder."),
+    ("ディスク{}のハッシュファイルがないため封印できません。", "Cannot seal disk {} because it has no hash file."),
+    ("ディスク{}はすでに封印されています。", "Disk {} is already sealed."),
+    ("ディスク{}を封印しました。", "Sealed disk {}."),
+    ("ディスク{}の封印に失敗しました。", "Failed to seal disk {}."),
+    ("アクセス制御が設定されていないため、閲覧だけを受け付けます。", "Accepting read-only requests because no access control is configured."),
+    ("{}で待ち受けできませんでした。", "Could not listen on {}."),
+    ("{}で問い合わせを待ち受けます。", "Listening for queries on {}."),
+    ("接続を受け付けられませんでした。: {}", "Could not accept the connection.: {}"),
+    ("要求を読み込めませんでした。", "Could not read the request."),
+    ("認証が必要です。", "Authentication is required."),
+    ("管理者の権限が必要です。", "Administrator permission is required."),
+    ("GETとPOSTのみ受け付けます。", "Only GET and POST are accepted."),
+    ("応答を送信できませんでした。", "Could not send the response."),
+    ("不明なパスです。", "Unknown path."),
+    ("アクセス制御の設定ファイルを読み込めませんでした。: {}", "Could not read the access control settings.: {}"),
+    ("アクセス制御の設定ファイルの形式が不正です。", "The access control settings are malformed."),
+    ("環境変数{}", "environment variable {}"),
+    ("オプション{}", "option {}"),
+    ("{}の値が1以上の整数ではありません。: {}", "The value of {} is not an integer of 1 or more.: {}"),
+    ("{}の値が0以上の整数ではありません。: {}", "The value of {} is not an integer of 0 or more.: {}"),
+    ("{}の値が日時(YYYY-MM-DD HH:MM:SS)ではありません。: {}", "The value of {} is not a date and time (YYYY-MM-DD HH:MM:SS).: {}"),
+    ("{}の値が不正です。(hidden, system, junk, noneをカンマ区切り): {}", "The value of {} is invalid. (comma-separated hidden, system, junk, none): {}"),
+    ("{}の値が不正です。(slash, nfc, strip:プレフィックス, noneをカンマ区切り): {}", "The value of {} is invalid. (comma-separated slash, nfc, strip:prefix, none): {}"),
+    ("{}の値はjaかenを指定してください。: {}", "The value of {} must be ja or en.: {}"),
+    ("{}の値はskip、follow、recordのいずれかを指定してください。: {}", "The value of {} must be skip, follow or record.: {}"),
+    ("{}の値はtextかsqliteを指定してください。: {}", "The value of {} must be text or sqlite.: {}"),
+    ("{}の値がハッシュアルゴリズムではありません。(md5, sha1, sha256, sha512, blake2b, xxhash64, sha256-tree): {}", "The value of {} is not a hash algorithm. (md5, sha1, sha256, sha512, blake2b, xxhash64, sha256-tree): {}"),
+    ("{}の値がハッシュアルゴリズムではありません。(md5, sha1, sha256, sha512, blake2b, xxhash64, sha256-treeをカンマ区切り): {}", "The value of {} is not a list of hash algorithms. (comma-separated md5, sha1, sha256, sha512, blake2b, xxhash64, sha256-tree): {}"),
+    ("追加のハッシュファイルの保存先を作成できませんでした。: {}", "Could not create the folder for the extra hash files.: {}"),
+    ("{}: {}件のファイルは{}のハッシュがありません。追加のアルゴリズムは計算したファイルにだけ記録します。", "{}: {} files have no {} hash. Extra algorithms are only recorded for files that are hashed."),
+    ("設定ファイルが読み込めませんでした。: {}", "Could not read the settings file.: {}"),
+    ("グループ名ではありません。: {}", "Not a group name.: {}"),
+    ("設定ファイルのグループ{}の{}", "{1} of group {0} in the settings file"),
+    ("設定ファイルの{}", "{} in the settings file"),
+    ("不明な設定です。: {}", "Unknown setting.: {}"),
+    ("代替処理済みセクタ", "reallocated sectors"),
+    ("代替保留中セクタ", "pending sectors"),
+    ("回復不能セクタ", "uncorrectable sectors"),
+    ("{}: ディスクルートのデバイスが分かりませんでした。", "{}: Could not determine the device of the disk root."),
+    ("{}: SMART情報を取得できませんでした。: {}", "{}: Could not get SMART information.: {}"),
+    ("smartctlを実行できませんでした。", "Could not run smartctl."),
+    ("smartctlの出力を解析できませんでした。", "Could not parse the output of smartctl."),
+    ("smartctlの出力にSMART属性がありません。", "The output of smartctl has no SMART attributes."),
+    ("SMART情報の履歴フォルダを作成できませんでした。", "Could not create the SMART history folder."),
+    ("SMART情報の記録に失敗しました。", "Failed to record SMART information."),
+    ("ディスク{}は封印されているため記録できません。", "Cannot record because disk {} is sealed."),
+    ("入力を開けませんでした。: {}", "Could not open the input.: {}"),
+    ("入力を読み込めません。: {}", "Cannot read the input.: {}"),
+    ("{}: {}として記録しました。", "{}: Recorded as {}."),
+    ("ハッシュファイルの取り込みを開始します。", "Starting to import hash files."),
+    ("ハッシュファイルの取り込みを終了しました。", "Finished importing hash files."),
+    ("{}: 封印されたディスクのため取り込みません。", "{}: Not importing because the disk is sealed."),
+    ("{}: 追加 {}件 / 更新 {}件 / 競合 {}件", "{}: added {} / updated {} / conflicts {}"),
+    ("{}: ハッシュが異なるファイルがあります。この環境の内容を残しました。: {}", "{}: A file has a different hash. Kept the content of this environment.: {}"),
+    ("競合レポートのフォルダを作成できませんでした。", "Could not create the folder for the conflict report."),
+    ("競合レポートの作成に失敗しました。", "Failed to create the conflict report."),
+    ("タグの対象は\"ディスクID:パス\"の形式で指定してください。: {}", "Specify the tag target in the form \"disk ID:path\".: {}"),
+    ("タグの一覧を取得できませんでした。", "Could not list the tags."),
+    ("タグを読み込めませんでした。: {}", "Could not read the tags.: {}"),
+    ("タグの形式が不正です。", "The tags are malformed."),
+    ("タグのフォルダを作成できませんでした。", "Could not create the tag folder."),
+    ("タグの出力に失敗しました。", "Failed to write the tags."),
+    ("タグに使えない文字が含まれています。: {}", "The tag contains characters that cannot be used.: {}"),
+    ("すでにタグが付いています。: {}", "Already tagged.: {}"),
+    ("{}:{}にタグを付けました。: {}", "Tagged {}:{}.: {}"),
+    ("外すタグがありません。", "There are no tags to remove."),
+    ("{}:{}のタグを{}件外しました。", "Removed {2} tags from {0}:{1}."),
+    ("{}: 読み込み速度が過去の中央値より{:.0}%遅くなっています。({:.1}MB/s -> {:.1}MB/s) ディスクの状態を確認してください。", "{}: The read speed is {}% slower than the past median. ({}MB/s -> {}MB/s) Check the condition of the disk."),
+    ("読み込み速度の履歴フォルダを作成できませんでした。", "Could not create the read speed history folder."),
+    ("読み込み速度の記録に失敗しました。", "Failed to record the read speed."),
+    ("{}: 読み込み速度の記録がありません。", "{}: There is no read speed record."),
+    ("読み込み速度の履歴を読み込めませんでした。", "Could not read the read speed history."),
+    ("読み込み速度の履歴の形式が不正です。", "The read speed history is malformed."),
+    ("{}: {}ファイル / {:.2}GB / {}秒 / {:.1}MB/s (計算済み {}件 / フィルターで対象外 {}件 / 読み込みエラー {}件)", "{}: {} files / {}GB / {}s / {}MB/s (already calculated {} / filtered out {} / read errors {})"),
+    ("合計", "total"),
+    ("集計レポートのフォルダを作成できませんでした。", "Could not create the summary report folder."),
+    ("集計レポートを保存できませんでした。: {}", "Could not save the summary report.: {}"),
+    ("集計レポートを保存しました。: {}", "Saved the summary report.: {}"),
+    ("この環境ではページキャッシュを使わずに読み込めないため、キャッシュから読み込むことがあります。", "Reads cannot bypass the page cache on this platform, so files may be read from the cache."),
+    ("{}: 計算した{}件のファイルのうち{}件を読み込み直して検証します。", "{}: Of the {} hashed files, re-reading {} to verify them."),
+    ("{}: 読み込み直したファイルのハッシュが計算したハッシュと異なります。: {}", "{}: The re-read file's hash differs from the calculated hash.: {}"),
+    ("{}: 読み込み直した{}件のファイルのハッシュが一致しました。", "{}: The hashes of the {} re-read files matched."),
+    ("{}: 読み込み直して検証した{}件のファイルのうち{}件が一致しませんでした。", "{}: Of the {} re-read files, {} did not match."),
+    ("削除した行の保存フォルダを作成できませんでした。", "Could not create the folder for removed lines."),
+    ("{}: 存在しないファイルの行を{}件削除しました。: {}", "{}: Removed {} lines for files that no longer exist.: {}"),
+    ("削除した行の保存に失敗しました。", "Failed to save the removed lines."),
+    ("ディスク{}は封印されているため行を戻せません。", "Cannot restore lines because disk {} is sealed."),
+    ("削除した行の保存ファイルがないか、空です。: {}", "The saved file of removed lines is missing or empty.: {}"),
+    ("{}: {}件の行を戻しました。すでにあった{}件は戻していません。", "{}: Restored {} lines. {} lines that already existed were not restored."),
+    ("削除した行の保存ファイルの名前が不正です。: {}", "Invalid name for the saved file of removed lines.: {}"),
+    ("{}: 空のファイルが{}件、前回より極端に小さくなったファイルが{}件あります。: {}", "{}: {} files are empty and {} files are drastically smaller than last time.: {}"),
+    ("ファイルサイズの記録を読み込めませんでした。", "Could not read the file size record."),
+    ("ファイルサイズの記録の形式が不正です。", "The file size record is malformed."),
+    ("ファイルサイズの記録フォルダを作成できませんでした。", "Could not create the file size record folder."),
+    ("ファイルサイズの記録に失敗しました。", "Failed to record the file sizes."),
+    ("切り詰めレポートのフォルダを作成できませんでした。", "Could not create the folder for the truncation report."),
+    ("切り詰めレポートの作成に失敗しました。", "Failed to create the truncation report."),
+    ("シンボリックリンクのリンク先の記録を読み込めませんでした。", "Could not read the record of symbolic link targets."),
+    ("シンボリックリンクのリンク先の記録の形式が不正です。", "The record of symbolic link targets has an invalid format."),
+    ("シンボリックリンクのリンク先の記録フォルダを作成できませんでした。", "Could not create the folder for the record of symbolic link targets."),
+    ("シンボリックリンクのリンク先の記録に失敗しました。", "Failed to record the symbolic link targets."),
+    ("グループ{}の{}件のファイルはバイト数が記録されていないため容量に含めていません。", "{1} files of group {0} are not counted in the size because their byte counts are not recorded."),
+    ("グループ\tファイル数\t容量\t内容の異なるファイル数\t重複を除いた容量\t重複の容量", "group\tfiles\tsize\tunique files\tunique size\tduplicate size"),
+];
+
+/// 書式の値の部分
+static PLACEHOLDER_PATTERN: Lazy<Regex> = Lazy::new(|| Regex::new(r"\{(\d*)(:[^{}]*)?\}").unwrap());
+
+/// 日本語の書式に一致させるパターン
+/// 末尾には設定ファイルの行番号などの"[パス:行番号]"が付いていてもよい。
+static TEMPLATE_PATTERNS: Lazy<(RegexSet, Vec<Regex>)> = Lazy::new(|| {
+    let patterns: Vec<String> = CATALOG
+        .iter()
+        .map(|(japanese, _)| {
+            let literals: Vec<String> = PLACEHOLDER_PATTERN
+                .split(japanese)
+                .map(regex::escape)
+                .collect();
+            format!(r"(?s)^{}((?:\[[^\[\]]*\])*)$", literals.join("(.*?)"))
+        })
+        .collect();
+    let regexes = patterns
+        .iter()
+        .map(|pattern| Regex::new(pattern).unwrap())
+        .collect();
+    (RegexSet::new(&patterns).unwrap(), regexes)
+});
+
+/// 書式の値以外の文字数
+/// 複数の書式に一致した場合は、最も具体的な書式を使う。
+fn literal_length(template: &str) -> usize {
+    PLACEHOLDER_PATTERN
+        .replace_all(template, "")
+        .chars()
+        .count()
+}
+
+/// メッセージを設定された言語に翻訳する。
+/// 日本語ならそのまま返す。一覧にないメッセージもそのまま返す。
+pub fn translate(message: &str) -> Cow<'_, str> {
+    if !ENGLISH.load(Ordering::Relaxed) {
+        return Cow::Borrowed(message);
+    }
+    let (set, regexes) = &*TEMPLATE_PATTERNS;
+    let index = match set
+        .matches(message)
+        .into_iter()
+        .max_by_key(|&index| literal_length(CATALOG[index].0))
+    {
+        Some(index) => index,
+        None => return Cow::Borrowed(message),
+    };
+    let captures = regexes[index].captures(message).unwrap();
+    let mut translated = fill(CATALOG[index].1, &captures);
+    // 末尾の"[パス:行番号]"はそのまま付ける
+    translated.push_str(&captures[captures.len() - 1]);
+    Cow::Owned(translated)
+}
+
+/// 英語の書式に日本語のメッセージから取り出した値を埋め込む。
+fn fill(template: &str, captures: &Captures) -> String {
+    let mut next = 0;
+    PLACEHOLDER_PATTERN
+        .replace_all(template, |placeholder: &Captures| {
+            let position = match placeholder[1].parse::<usize>() {
+                Ok(position) => position,
+                Err(_) => {
+                    next += 1;
+                    next - 1
+                }
+            };
+            match captures.get(position + 1) {
+                Some(value) => translate_value(value.as_str()),
+                None => String::new(),
+            }
+        })
+        .into_owned()
+}
+
+/// メッセージに埋め込まれた値を翻訳する。
+/// "ディスク"などの語句や"環境変数{}"などの設定の場所も値として埋め込まれる。
+fn translate_value(value: &str) -> String {
+    translate(value).into_owned()
+}
@@ -0,0 +1,261 @@
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex};
+
+use serde_json::json;
+
+use crate::file_error::FileError;
+use crate::hash_algorithm::Digest;
+use crate::log::Errors;
+
+/// 検証で差異が見つかった場合の終了コード
+pub const MISMATCH_EXIT_CODE: i32 = 3;
+
+/// 直前の検証で差異が見つかったか
+static MISMATCHED: AtomicBool = AtomicBool::new(false);
+
+/// 差異の出力形式
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum OutputFormat {
+    /// JSONの配列
+    Json,
+    /// TAP(Test Anything Protocol)
+    Tap,
+}
+
+impl OutputFormat {
+    /// 名前から出力形式を返す。
+    /// 出力形式の名前でなければNoneを返す。
+    pub fn from_name(name: &str) -> Option<OutputFormat> {
+        match name {
+            "json" => Some(OutputFormat::Json),
+            "tap" => Some(OutputFormat::Tap),
+            _ => None,
+        }
+    }
+}
+
+/// 差異の種類
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+enum MismatchStatus {
+    /// ハッシュが異なる
+    Mismatch,
+    /// ディスクからなくなった
+    Missing,
+    /// 封印されたディスクに追加された
+    Added,
+    /// 移動された
+    Renamed,
+    /// 読み込めない
+    Unreadable,
+    /// ディスクを検証できなかった
+    Error,
+}
+
+impl MismatchStatus {
+    /// 出力する名前を返す。
+    fn name(&self) -> &'static str {
+        match self {
+            MismatchStatus::Mismatch => "mismatch",
+            MismatchStatus::Missing => "missing",
+            MismatchStatus::Added => "added",
+            MismatchStatus::Renamed => "renamed",
+            MismatchStatus::Unreadable => "unreadable",
+            MismatchStatus::Error => "error",
+        }
+    }
+}
+
+/// 差異
+struct Mismatch {
+    disk_id: String,
+    status: MismatchStatus,
+    /// ファイルのパス
+    /// ディスクを検証できなかった場合はNone
+    path: Option<PathBuf>,
+    /// 移動されたファイルの移動元のパス
+    from: Option<PathBuf>,
+    /// ハッシュファイルに記録されたハッシュ
+    expected: Option<Digest>,
+    /// 計算したハッシュ
+    actual: Option<Digest>,
+    /// 読み込めなかったファイルのエラーの分類
+    category: Option<&'static str>,
+    /// エラーの内容
+    error: Option<String>,
+}
+
+impl Mismatch {
+    fn new(disk_id: &str, status: MismatchStatus, path: Option<&Path>) -> Mismatch {
+        Mismatch {
+            disk_id: disk_id.to_string(),
+            status,
+            path: path.map(|path| path.to_path_buf()),
+            from: None,
+            expected: None,
+            actual: None,
+            category: None,
+            error: None,
+        }
+    }
+
+    /// JSONに変換する。
+    /// 値がない項目はnullにする。
+    fn to_json(&self) -> serde_json::Value {
+        json!({
+            "disk": self.disk_id,
+            "status": self.status.name(),
+            "path": self.path.as_ref().map(|path| path.to_str().unwrap()),
+            "from": self.from.as_ref().map(|from| from.to_str().unwrap()),
+            "expected": self.expected.map(|hash| hex::encode(hash.to_vec())),
+            "actual": self.actual.map(|hash| hex::encode(hash.to_vec())),
+            "category": self.category,
+            "error": self.error,
+        })
+    }
+
+    /// TAPの診断行に変換する。
+    fn to_tap_diagnostic(&self) -> String {
+        let mut line = format!("# {}", self.status.name());
+        if let Some(path) = &self.path {
+            line.push('\t');
+            line.push_str(path.to_str().unwrap());
+        }
+        if let Some(from) = &self.from {
+            line.push_str("\tfrom ");
+            line.push_str(from.to_str().unwrap());
+        }
+        if let Some(error) = &self.error {
+            line.push('\t');
+            line.push_str(error);
+        }
+        line
+    }
+}
+
+/// 検証で見つかった差異の記録
+/// ディスクごとのスレッドで共有する。
+#[derive(Clone)]
+pub struct MismatchReport {
+    mismatches: Arc<Mutex<Vec<Mismatch>>>,
+}
+
+impl MismatchReport {
+    pub fn new() -> MismatchReport {
+        MismatchReport {
+            mismatches: Arc::new(Mutex::new(vec![])),
+        }
+    }
+
+    /// ハッシュが異なるファイルを記録する。
+    pub fn mismatch(&self, disk_id: &str, path: &Path, expected: Option<&Digest>, actual: &Digest) {
+        let mut mismatch = Mismatch::new(disk_id, MismatchStatus::Mismatch, Some(path));
+        mismatch.expected = expected.copied();
+        mismatch.actual = Some(*actual);
+        self.push(mismatch);
+    }
+
+    /// ディスクからなくなったファイルを記録する。
+    pub fn missing(&self, disk_id: &str, path: &Path, expected: &Digest) {
+        let mut mismatch = Mismatch::new(disk_id, MismatchStatus::Missing, Some(path));
+        mismatch.expected = Some(*expected);
+        self.push(mismatch);
+    }
+
+    /// 封印されたディスクに追加されたファイルを記録する。
+    pub fn added(&self, disk_id: &str, path: &Path) {
+        self.push(Mismatch::new(disk_id, MismatchStatus::Added, Some(path)));
+    }
+
+    /// 移動されたファイルを移動先のパスで記録する。
+    pub fn renamed(&self, disk_id: &str, from: &Path, to: &Path) {
+        let mut mismatch = Mismatch::new(disk_id, MismatchStatus::Renamed, Some(to));
+        mismatch.from = Some(from.to_path_buf());
+        self.push(mismatch);
+    }
+
+    /// 読み込めなかったファイルを記録する。
+    pub fn unreadable(&self, disk_id: &str, path: &Path, file_error: &FileError) {
+        let mut mismatch = Mismatch::new(disk_id, MismatchStatus::Unreadable, Some(path));
+        mismatch.category = Some(file_error.category.name());
+        mismatch.error = Some(file_error.error.to_string());
+        self.push(mismatch);
+    }
+
+    /// ディスクを検証できなかったことを記録する。
+    /// すでにそのディスクの差異を記録していれば、差異による失敗なので記録しない。
+    pub fn failed(&self, disk_id: &str, errors: &Errors) {
+        let mut mismatches = self.mismatches.lock().unwrap();
+        if mismatches
+            .iter()
+            .any(|mismatch| mismatch.disk_id == disk_id)
+        {
+            return;
+        }
+        let mut mismatch = Mismatch::new(disk_id, MismatchStatus::Error, None);
+        mismatch.error = Some(
+            errors
+                .iter()
+                .map(|error| error.to_string())
+                .collect::<Vec<String>>()
+                .join(" / "),
+        );
+        mismatches.push(mismatch);
+    }
+
+    /// 差異を追加する。
+    fn push(&self, mismatch: Mismatch) {
+        self.mismatches.lock().unwrap().push(mismatch);
+    }
+
+    /// 記録した差異の件数を返す。
+    pub fn len(&self) -> usize {
+        self.mismatches.lock().unwrap().len()
+    }
+
+    /// 記録した差異をディスクID、パス、種類の順に並べて標準出力に出力する。
+    /// TAPでは検証したディスクごとに1つのテストとする。
+    pub fn print(&self, output_format: OutputFormat, disk_ids: &[String]) {
+        let mut mismatches = self.mismatches.lock().unwrap();
+        mismatches
+            .sort_by(|a, b| (&a.disk_id, &a.path, a.status).cmp(&(&b.disk_id, &b.path, b.status)));
+
+        match output_format {
+            OutputFormat::Json => {
+                let records: Vec<serde_json::Value> = mismatches
+                    .iter()
+                    .map(|mismatch| mismatch.to_json())
+                    .collect();
+                println!("{}", serde_json::Value::Array(records));
+            }
+            OutputFormat::Tap => {
+                println!("TAP version 13");
+                println!("1..{}", disk_ids.len());
+                for (i, disk_id) in disk_ids.iter().enumerate() {
+                    let disk_mismatches: Vec<&Mismatch> = mismatches
+                        .iter()
+                        .filter(|mismatch| &mismatch.disk_id == disk_id)
+                        .collect();
+                    if disk_mismatches.len() == 0 {
+                        println!("ok {} - {}", i + 1, disk_id);
+                    } else {
+                        println!("not ok {} - {}", i + 1, disk_id);
+                        for mismatch in disk_mismatches {
+                            println!("{}", mismatch.to_tap_diagnostic());
+                        }
+                    }
+                }
+            }
+        }
+    }
+}
+
+/// 検証で差異が見つかったかを記録する。
+pub fn set_mismatched(mismatched: bool) {
+    MISMATCHED.store(mismatched, Ordering::Relaxed);
+}
+
+/// 直前の検証で差異が見つかったかを返す。
+pub fn has_mismatches() -> bool {
+    MISMATCHED.load(Ordering::Relaxed)
+}
@@ -0,0 +1,64 @@
+use std::fs::{File, OpenOptions, TryLockError};
+use std::path::Path;
+
+use crate::log::{self, Errors};
+
+/// ロックファイルの名前
+/// ディスクIDの形式ではないので、ハッシュファイルとして扱われることはない。
+const LOCK_FILENAME: &str = ".lock";
+
+/// 出力フォルダのロック
+/// 破棄されるとロックを解除する。
+pub struct OutputLock {
+    _file: File,
+}
+
+/// 出力フォルダをロックする。
+/// 他のbcbcのプロセスがロックしていれば待たずにエラーにする。
+/// まだ作成されていない出力フォルダはロックしない。
+/// ロックはOSのアドバイザリーロックなので、プロセスが異常終了しても残らない。
+pub fn lock_output_folders(output_folders: &[&Path]) -> Result<Vec<OutputLock>, Errors> {
+    let mut locks = vec![];
+    for output_folder in output_folders {
+        if !output_folder.is_dir() {
+            continue;
+        }
+        locks.push(lock_output_folder(output_folder)?);
+    }
+    Ok(locks)
+}
+
+/// 出力フォルダを1つロックする。
+fn lock_output_folder(output_folder: &Path) -> Result<OutputLock, Errors> {
+    let lock_filepath = output_folder.join(LOCK_FILENAME);
+    let file = match OpenOptions::new()
+        .create(true)
+        .write(true)
+        .open(lock_filepath.as_path())
+    {
+        Ok(file) => file,
+        Err(error) => {
+            return Err(log::make_error!(
+                "ロックファイルを開けませんでした。: {}",
+                lock_filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors())
+        }
+    };
+
+    match file.try_lock() {
+        Ok(_) => Ok(OutputLock { _file: file }),
+        Err(TryLockError::WouldBlock) => Err(log::make_error!(
+            "他のbcbcが出力フォルダを使用中です。終了してから実行してください。: {}",
+            output_folder.to_str().unwrap()
+        )
+        .as_errors()),
+        Err(TryLockError::Error(error)) => Err(log::make_error!(
+            "出力フォルダをロックできませんでした。: {}",
+            output_folder.to_str().unwrap()
+        )
+        .with(&error)
+        .as_errors()),
+    }
+}
@@ -0,0 +1,45 @@
+use std::fs::File;
+
+/// ページキャッシュを使わずに読み込めるか
+pub const SUPPORTED: bool = cfg!(any(target_os = "linux", target_os = "macos"));
+
+/// ファイルのページキャッシュを破棄し、以降の読み込みでディスクから読み込むようにする。
+/// 書き込み中のページは破棄できないので、先にディスクに書き出す。
+#[cfg(target_os = "linux")]
+pub fn bypass(file: &File) {
+    use std::os::unix::io::AsRawFd;
+
+    extern "C" {
+        fn posix_fadvise(fd: i32, offset: i64, len: i64, advice: i32) -> i32;
+    }
+
+    /// POSIX_FADV_DONTNEED
+    const POSIX_FADV_DONTNEED: i32 = 4;
+
+    let _ = file.sync_data();
+    unsafe {
+        posix_fadvise(file.as_raw_fd(), 0, 0, POSIX_FADV_DONTNEED);
+    }
+}
+
+/// ファイルのページキャッシュを使わずに読み込むようにする。
+#[cfg(target_os = "macos")]
+pub fn bypass(file: &File) {
+    use std::os::unix::io::AsRawFd;
+
+    extern "C" {
+        fn fcntl(fd: i32, cmd: i32, ...) -> i32;
+    }
+
+    /// F_NOCACHE
+    const F_NOCACHE: i32 = 48;
+
+    let _ = file.sync_data();
+    unsafe {
+        fcntl(file.as_raw_fd(), F_NOCACHE, 1);
+    }
+}
+
+/// LinuxとmacOS以外ではページキャッシュを使わずに読み込めないので何もしない。
+#[cfg(not(any(target_os = "linux", target_os = "macos")))]
+pub fn bypass(_file: &File) {}
@@ -0,0 +1,92 @@
+use std::path::Path;
+use std::sync::Arc;
+
+use path_slash::PathExt;
+use unicode_normalization::UnicodeNormalization;
+
+/// 正規化ファイルパスを変換する関数
+pub(crate) type CustomStep = Arc<dyn Fn(&str) -> String + Send + Sync>;
+
+/// パスの正規化の手順
+#[derive(Clone)]
+enum Step {
+    /// Windowsの区切り文字をスラッシュにする
+    Slash,
+    /// Unicodeの正規化形式をNFCにする
+    Nfc,
+    /// 先頭のプレフィックスを取り除く
+    StripPrefix(String),
+    /// ライブラリの利用者が登録した変換
+    Custom(CustomStep),
+}
+
+/// 対象ファイルのパスをハッシュファイルに記録する正規化ファイルパスにする手順の一覧
+/// 初期値はスラッシュ区切りとNFCへの変換で、OSやファイルシステムが違っても同じパスになる。
+#[derive(Clone)]
+pub struct PathNormalizer {
+    steps: Vec<Step>,
+}
+
+impl Default for PathNormalizer {
+    fn default() -> Self {
+        PathNormalizer {
+            steps: vec![Step::Slash, Step::Nfc],
+        }
+    }
+}
+
+impl PathNormalizer {
+    /// "slash,nfc,strip:プレフィックス"のようにカンマ区切りの手順名をパースする。
+    /// 手順は書いた順に適用する。"none"は何も変換しない。手順名が不正であればNoneを返す。
+    pub fn from_names(names: &str) -> Option<PathNormalizer> {
+        let mut steps = vec![];
+        for name in names.split(',').map(|name| name.trim()) {
+            match name {
+                "slash" => steps.push(Step::Slash),
+                "nfc" => steps.push(Step::Nfc),
+                "none" => (),
+                _ => match name.strip_prefix("strip:") {
+                    Some(prefix) if prefix.len() > 0 => {
+                        steps.push(Step::StripPrefix(prefix.to_string()))
+                    }
+                    _ => return None,
+                },
+            }
+        }
+        Some(PathNormalizer { steps })
+    }
+
+    /// 独自の変換を最後の手順として追加する。
+    /// 変換は正規化の途中のパスを受け取り、変換後のパスを返す。
+    pub fn with_step(
+        mut self,
+        step: impl Fn(&str) -> String + Send + Sync + 'static,
+    ) -> PathNormalizer {
+        self.steps.push(Step::Custom(Arc::new(step)));
+        self
+    }
+
+    /// 独自の変換を登録済みの関数のまま追加する。
+    pub(crate) fn with_custom_steps(mut self, steps: &[CustomStep]) -> PathNormalizer {
+        self.steps
+            .extend(steps.iter().map(|step| Step::Custom(step.clone())));
+        self
+    }
+
+    /// ディスクルートかサブルートのプレフィックスからの相対パスを正規化する。
+    pub fn normalize(&self, path: &Path) -> String {
+        let mut normalized = path.to_str().unwrap().to_string();
+        for step in self.steps.iter() {
+            normalized = match step {
+                Step::Slash => Path::new(&normalized).to_slash().unwrap().to_string(),
+                Step::Nfc => normalized.nfc().to_string(),
+                Step::StripPrefix(prefix) => match normalized.strip_prefix(prefix.as_str()) {
+                    Some(stripped) => stripped.to_string(),
+                    None => normalized,
+                },
+                Step::Custom(step) => step(&normalized),
+            };
+        }
+        normalized
+    }
+}
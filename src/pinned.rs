@@ -0,0 +1,176 @@
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use unicode_normalization::UnicodeNormalization;
+
+use crate::disk;
+use crate::hash_algorithm::Digest;
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::merged_hash_file;
+
+/// 必須ファイル
+/// ディスクかグループに必ず存在しなければならないファイル。
+struct PinnedFile {
+    /// ディスクIDかグループ名
+    target: String,
+    /// ディスクルートからの相対パス
+    /// '/'で終わる場合はそのフォルダ配下にファイルが1つ以上あればよい。
+    path: String,
+}
+
+/// 必須ファイル設定ファイルのパスを返す。
+fn pinned_conf_filepath(config_folder: &Path) -> PathBuf {
+    config_folder.join("pinned.conf")
+}
+
+/// 必須ファイル設定ファイルの形式を確認する。
+pub fn check_pinned_conf(config_folder: &Path) -> Result<(), Errors> {
+    load_pinned_files(config_folder).map(|_| ())
+}
+
+/// 必須ファイルがハッシュファイルにあるか確認する。
+/// ディスクIDの一覧が指定された場合はそのディスクとグループの必須ファイルだけを確認する。
+pub fn check_pinned_files(
+    output_folder: &Path,
+    config_folder: &Path,
+    disk_ids: Option<&Vec<String>>,
+) -> Result<(), Errors> {
+    let pinned_files = load_pinned_files(config_folder)?;
+    if pinned_files.len() == 0 {
+        return Ok(());
+    }
+
+    // 全ディスクのハッシュファイルを読み込む
+    let mut hash_info_maps = HashMap::<String, HashMap<PathBuf, Digest>>::new();
+    for hash_filepath in merged_hash_file::find_hash_files(output_folder)? {
+        let disk_id = hash_filepath
+            .file_name()
+            .unwrap()
+            .to_str()
+            .unwrap()
+            .to_string();
+        let hash_info_map = hash_file::load_hash_info(hash_filepath.as_path())?;
+        hash_info_maps.insert(disk_id, hash_info_map);
+    }
+
+    let mut errors = vec![];
+    for pinned_file in pinned_files.iter() {
+        // 確認対象のディスクに関係しない必須ファイルは確認しない
+        if let Some(disk_ids) = disk_ids {
+            if !disk_ids
+                .iter()
+                .any(|disk_id| disk_id.starts_with(&pinned_file.target))
+            {
+                continue;
+            }
+        }
+
+        // ディスクIDならそのディスク、グループ名ならグループのいずれかのディスクにあればよい
+        let found = hash_info_maps
+            .iter()
+            .filter(|(disk_id, _)| {
+                **disk_id == pinned_file.target
+                    || (pinned_file.target.len() == 1 && disk_id.starts_with(&pinned_file.target))
+            })
+            .any(|(_, hash_info_map)| contains_pinned_file(hash_info_map, &pinned_file.path));
+
+        if !found {
+            errors.push(log::make_error!(
+                "{}: 必須ファイルがありません。: {}",
+                &pinned_file.target,
+                &pinned_file.path
+            ));
+        }
+    }
+
+    if errors.len() == 0 {
+        Ok(())
+    } else {
+        Err(errors)
+    }
+}
+
+/// ハッシュ情報マップに必須ファイルがあるかを返す。
+fn contains_pinned_file(hash_info_map: &HashMap<PathBuf, Digest>, pinned_path: &str) -> bool {
+    if pinned_path.ends_with('/') {
+        hash_info_map
+            .keys()
+            .any(|target_filepath| target_filepath.to_str().unwrap().starts_with(pinned_path))
+    } else {
+        hash_info_map.contains_key(Path::new(pinned_path))
+    }
+}
+
+/// 必須ファイル設定ファイルを読み込む。
+/// ファイルがなければ空の一覧を返す。
+fn load_pinned_files(config_folder: &Path) -> Result<Vec<PinnedFile>, Errors> {
+    let pinned_conf_filepath = pinned_conf_filepath(config_folder);
+    if !pinned_conf_filepath.is_file() {
+        return Ok(vec![]);
+    }
+
+    let pinned_conf = match fs::read_to_string(pinned_conf_filepath.as_path()) {
+        Ok(pinned_conf) => pinned_conf,
+        Err(error) => {
+            return Err(
+                log::make_error!("必須ファイル設定ファイルが読み込めませんでした。")
+                    .with(&error)
+                    .as_errors(),
+            )
+        }
+    };
+    // ハッシュファイルのパスと比較するためNFCにする
+    let pinned_conf = pinned_conf.nfc().collect::<String>();
+
+    let mut pinned_files = vec![];
+    let mut target = None;
+    for (i, line) in pinned_conf.lines().enumerate() {
+        let line = line.trim();
+        // 空白行とコメント行は無視する
+        if line.len() == 0 || line.starts_with('#') {
+            continue;
+        }
+
+        // "[ディスクIDまたはグループ名]"の行から次の"[...]"の行までがそのディスクかグループの必須ファイル
+        if line.starts_with('[') && line.ends_with(']') {
+            let name = &line[1..line.len() - 1];
+            target = Some(log::with_line_number(
+                parse_target(name),
+                pinned_conf_filepath.as_path(),
+                i + 1,
+            )?);
+            continue;
+        }
+
+        match &target {
+            Some(target) => pinned_files.push(PinnedFile {
+                target: target.clone(),
+                path: line.replace('\\', "/"),
+            }),
+            None => {
+                return log::with_line_number(
+                    Err(log::make_error!(
+                        "必須ファイルの前にディスクIDかグループ名の行がありません。"
+                    )
+                    .as_errors()),
+                    pinned_conf_filepath.as_path(),
+                    i + 1,
+                )
+            }
+        }
+    }
+
+    Ok(pinned_files)
+}
+
+/// ディスクIDかグループ名をパースする。
+fn parse_target(name: &str) -> Result<String, Errors> {
+    let is_group = name.len() == 1 && name.chars().all(|c| c.is_ascii_uppercase());
+    if is_group || disk::DISK_ID_PATTERN.is_match(name) {
+        Ok(name.to_string())
+    } else {
+        Err(log::make_error!("ディスクIDかグループ名ではありません。: {}", name).as_errors())
+    }
+}
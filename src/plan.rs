@@ -0,0 +1,225 @@
+use std::path::Path;
+
+use chrono::Duration;
+
+use crate::clock;
+use crate::disk::Priority;
+use crate::log::{self, Errors};
+use crate::messages;
+use crate::registry;
+use crate::throughput;
+use crate::truncation;
+
+/// 検証計画の条件
+#[derive(Clone)]
+pub struct VerificationPlan {
+    /// 全てのバイトを読み込む周期の日数
+    pub period_days: u64,
+    /// 検証を実行する間隔の日数
+    pub interval_days: u64,
+    /// 1回の実行に使える時間数
+    pub window_hours: Option<u64>,
+}
+
+/// ディスクごとの検証の割り当て
+struct Quota {
+    disk_id: String,
+    /// ディスクの優先度
+    priority: Priority,
+    /// ディスクのファイルサイズの合計
+    size: u64,
+    /// 1回の実行で読み込むバイト数
+    bytes_per_run: u64,
+    /// 1回の実行にかかる見込みの時間数
+    hours_per_run: Option<f64>,
+    /// 直近の周期で読み込んだ割合
+    coverage: f64,
+    /// 現時点で読み込んでいるべき割合
+    expected_coverage: f64,
+}
+
+/// ディスクごとに1回の実行で読み込むバイト数を求めて出力する。
+/// 直近の周期で読み込んだ量が予定より少ないディスクは警告する。
+/// ディスクはディスクIDとハッシュファイルのある出力フォルダの組で渡す。
+/// 優先度の高いディスクは実行回数を2倍、低いディスクは半分にして割り当てる。
+pub fn plan_verification(
+    registry_filepath: &Path,
+    disks: &[(String, &Path)],
+    plan: &VerificationPlan,
+) -> Result<(), Errors> {
+    let registry = registry::load_registry(registry_filepath)?;
+
+    log::info(
+        format!(
+            "{}日ごとに全てのバイトを読み込むため、{}日ごとに検証します。(通常の優先度のディスクは{}回に分けて検証します)",
+            plan.period_days,
+            plan.interval_days,
+            runs_per_period(plan, Priority::Normal)
+        )
+        .as_str(),
+    );
+
+    let mut total_bytes_per_run = 0;
+    let mut number_of_behind = 0;
+
+    for (disk_id, output_folder) in disks {
+        let priority = registry.priority_of(disk_id);
+        let quota = match make_quota(output_folder, disk_id, priority, plan)? {
+            Some(quota) => quota,
+            None => continue,
+        };
+
+        let line = format!(
+            "{}\t{}\t{}\t{}/回\t{}\t{:.0}%/{:.0}%",
+            quota.disk_id,
+            quota.priority.name(),
+            format_size(quota.size),
+            format_size(quota.bytes_per_run),
+            match quota.hours_per_run {
+                Some(hours) => format!("{:.1}時間", hours),
+                None => "-".to_string(),
+            },
+            quota.coverage * 100.0,
+            quota.expected_coverage * 100.0
+        );
+        println!("{}", messages::translate(&line));
+
+        if let (Some(hours), Some(window_hours)) = (quota.hours_per_run, plan.window_hours) {
+            if hours > window_hours as f64 {
+                log::warn(
+                    format!(
+                        "{}: 1回の検証が{}時間に収まりません。(見込み {:.1}時間) 間隔を短くしてください。",
+                        quota.disk_id, window_hours, hours
+                    )
+                    .as_str(),
+                );
+            }
+        }
+        if quota.coverage < quota.expected_coverage {
+            number_of_behind += 1;
+            log::warn(
+                format!(
+                    "{}: 検証が予定より遅れています。(読み込み済み {:.0}% / 予定 {:.0}%)",
+                    quota.disk_id,
+                    quota.coverage * 100.0,
+                    quota.expected_coverage * 100.0
+                )
+                .as_str(),
+            );
+        }
+
+        total_bytes_per_run += quota.bytes_per_run;
+    }
+
+    log::info(
+        format!(
+            "1回の実行で読み込む量の合計: {} / 予定より遅れているディスク: {}台",
+            format_size(total_bytes_per_run),
+            number_of_behind
+        )
+        .as_str(),
+    );
+
+    Ok(())
+}
+
+/// 優先度に応じた、周期内の実行回数を返す。
+/// 優先度の高いディスクは通常の2倍、低いディスクは半分にする。
+fn runs_per_period(plan: &VerificationPlan, priority: Priority) -> u64 {
+    let runs_per_period = ((plan.period_days + plan.interval_days - 1) / plan.interval_days).max(1);
+    match priority {
+        Priority::High => runs_per_period * 2,
+        Priority::Normal => runs_per_period,
+        Priority::Low => (runs_per_period / 2).max(1),
+    }
+}
+
+/// ディスクのファイルサイズの合計と、1回の実行で読み込むバイト数を返す。
+/// ファイルサイズの記録がなければ警告してNoneを返す。
+fn size_and_bytes_per_run(
+    output_folder: &Path,
+    disk_id: &str,
+    priority: Priority,
+    plan: &VerificationPlan,
+) -> Result<Option<(u64, u64)>, Errors> {
+    let size: u64 = truncation::load_recorded_sizes(output_folder, disk_id)?
+        .values()
+        .sum();
+    if size == 0 {
+        log::warn(
+            format!(
+                "{}: ファイルサイズの記録がないため計画できません。",
+                disk_id
+            )
+            .as_str(),
+        );
+        return Ok(None);
+    }
+
+    let runs_per_period = runs_per_period(plan, priority);
+    Ok(Some((size, (size + runs_per_period - 1) / runs_per_period)))
+}
+
+/// 検証計画でディスクに割り当てた、1回の実行で読み込むバイト数を返す。
+/// ファイルサイズの記録がなければ警告してNoneを返す。
+pub fn bytes_per_run(
+    output_folder: &Path,
+    disk_id: &str,
+    priority: Priority,
+    plan: &VerificationPlan,
+) -> Result<Option<u64>, Errors> {
+    Ok(
+        size_and_bytes_per_run(output_folder, disk_id, priority, plan)?
+            .map(|(_, bytes_per_run)| bytes_per_run),
+    )
+}
+
+/// ディスクの検証の割り当てを求める。
+/// ファイルサイズの記録がなければNoneを返す。
+fn make_quota(
+    output_folder: &Path,
+    disk_id: &str,
+    priority: Priority,
+    plan: &VerificationPlan,
+) -> Result<Option<Quota>, Errors> {
+    let (size, bytes_per_run) =
+        match size_and_bytes_per_run(output_folder, disk_id, priority, plan)? {
+            Some(size_and_bytes_per_run) => size_and_bytes_per_run,
+            None => return Ok(None),
+        };
+
+    let now = clock::now().naive_local();
+    let period_start = now - Duration::days(plan.period_days as i64);
+    let summary = throughput::summarize_reads(output_folder, disk_id, period_start)?;
+
+    let hours_per_run = summary
+        .median_megabytes_per_second
+        .filter(|speed| *speed > 0.0)
+        .map(|speed| bytes_per_run as f64 / (1u64 << 20) as f64 / speed / 3600.0);
+
+    // 記録を始めてから周期が経過していなければ経過した割合だけ読み込んでいればよい
+    let expected_coverage = match summary.first_recorded {
+        Some(first_recorded) if first_recorded > period_start => {
+            let elapsed = (now - first_recorded).num_seconds().max(0) as f64;
+            elapsed / (plan.period_days * 24 * 60 * 60) as f64
+        }
+        Some(_) => 1.0,
+        None => 0.0,
+    };
+    let coverage = (summary.bytes_since as f64 / size as f64).min(1.0);
+
+    Ok(Some(Quota {
+        disk_id: disk_id.to_string(),
+        priority,
+        size,
+        bytes_per_run,
+        hours_per_run,
+        coverage,
+        expected_coverage,
+    }))
+}
+
+/// 容量をGB単位の文字列にする。
+fn format_size(size: u64) -> String {
+    format!("{:.2}GB", size as f64 / (1u64 << 30) as f64)
+}
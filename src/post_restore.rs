@@ -0,0 +1,210 @@
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::UNIX_EPOCH;
+
+use crate::atomic_write;
+use crate::calc;
+use crate::disk;
+use crate::hash_algorithm::Digest;
+use crate::hash_file::{self, FileStamp};
+use crate::log::{self, Error, Errors};
+use crate::merged_hash_file;
+use crate::mismatch_report;
+use crate::registry;
+use crate::run_options::RunOptions;
+
+/// 移行元のハッシュファイルを移動するフォルダを返す。
+fn retired_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("retired")
+}
+
+/// 故障したディスクのハッシュファイルで、バックアップから復元したディスクをファイルごとに検証する。
+/// 全てのファイルが一致すれば、復元したディスクにディスクIDを割り当ててハッシュファイルを移行する。
+/// ディスクIDは復元したディスクのdiskファイル、--new-idの指定、故障したディスクのグループの未登録の連番の順に決める。
+/// 故障したディスクと別のディスクIDにした場合、故障したディスクのハッシュファイルはretiredフォルダに移動する。
+/// 差異があれば何も変更せずに差異をエラーにする。
+pub fn post_restore(run_options: &RunOptions) -> Result<(), Errors> {
+    let (old_disk_id, new_root) = run_options.post_restore_target();
+    let old_output_folder = run_options.output_folder_of(old_disk_id.chars().next().unwrap());
+    let old_hash_filepath = old_output_folder.join(old_disk_id);
+    if !old_hash_filepath.is_file() {
+        return Err(
+            log::make_error!("{}: ハッシュファイルがありません。", old_disk_id).as_errors(),
+        );
+    }
+    if !new_root.is_dir() {
+        return Err(log::make_error!(
+            "復元したディスクのルートがありません。: {}",
+            new_root.to_str().unwrap()
+        )
+        .as_errors());
+    }
+
+    let registry = registry::load_registry(run_options.registry_filepath())?;
+    let new_disk_file = new_root.join("disk");
+    let has_disk_file = new_disk_file.is_file();
+    let new_disk_id = if has_disk_file {
+        let contents = match fs::read_to_string(new_disk_file.as_path()) {
+            Ok(contents) => contents,
+            Err(error) => {
+                return Err(log::make_error!(
+                    "diskファイルが読み込めませんでした。: {}",
+                    new_disk_file.to_str().unwrap()
+                )
+                .with(&error)
+                .as_errors())
+            }
+        };
+        match disk::read_disk_id(&contents) {
+            Some(disk_id) => disk_id.to_string(),
+            None => {
+                return Err(log::make_error!(
+                    "diskファイルのディスクIDが不正です。: {}",
+                    new_disk_file.to_str().unwrap()
+                )
+                .as_errors())
+            }
+        }
+    } else {
+        match run_options.new_disk_id() {
+            Some(disk_id) => disk_id.to_string(),
+            None => registry.unregistered_disk_id(old_disk_id.chars().next().unwrap()),
+        }
+    };
+    if new_disk_id != old_disk_id && registry.root_of(&new_disk_id).is_some() {
+        return Err(
+            log::make_error!("ディスクID{}は別のディスクに登録済みです。", &new_disk_id)
+                .as_errors(),
+        );
+    }
+    let new_output_folder = run_options.output_folder_of(new_disk_id.chars().next().unwrap());
+    let new_hash_filepath = new_output_folder.join(&new_disk_id);
+    if new_disk_id != old_disk_id && new_hash_filepath.is_file() {
+        return Err(log::make_error!(
+            "{}: 割り当てるディスクIDのハッシュファイルが既にあります。",
+            &new_disk_id
+        )
+        .as_errors());
+    }
+
+    // 故障したディスクのハッシュファイルにある全てのファイルを、復元したディスクで読み込み直して比較する
+    let algorithm = hash_file::resolve_algorithm(old_hash_filepath.as_path(), None)?;
+    // diskファイルは割り当てるディスクIDで作り直すので検証せず、次のハッシュ計算で記録し直す
+    let mut hash_info_map = hash_file::load_hash_info(old_hash_filepath.as_path())?;
+    hash_info_map.remove(Path::new("disk"));
+    log::info(
+        format!(
+            "{}: 復元したディスクで{}件のファイルを検証します。: {}",
+            old_disk_id,
+            hash_info_map.len(),
+            new_root.to_str().unwrap()
+        )
+        .as_str(),
+    );
+    let mut buffer = vec![0u8; calc::BUFFER_SIZE];
+    let mut differences: Vec<Error> = vec![];
+    let mut stamp_map: HashMap<PathBuf, FileStamp> = HashMap::new();
+    for (target_filepath, expected_hash) in hash_file::sorted_hash_info(&hash_info_map) {
+        let restored_filepath = new_root.join(target_filepath);
+        if !restored_filepath.is_file() {
+            differences.push(log::make_error!(
+                "{}: 復元したディスクにファイルがありません。: {}",
+                old_disk_id,
+                target_filepath.to_str().unwrap()
+            ));
+            continue;
+        }
+        let restored_hash: Digest =
+            match calc::calc_file_hash(restored_filepath.as_path(), &mut buffer, algorithm) {
+                Ok(hash) => hash,
+                Err(file_error) => {
+                    differences.push(file_error.error);
+                    continue;
+                }
+            };
+        if &restored_hash != expected_hash {
+            differences.push(log::make_error!(
+                "{}: 復元したファイルのハッシュが異なります。: {}",
+                old_disk_id,
+                target_filepath.to_str().unwrap()
+            ));
+            continue;
+        }
+        if let Ok(metadata) = fs::metadata(restored_filepath.as_path()) {
+            if let Some(modified) = metadata
+                .modified()
+                .ok()
+                .and_then(|modified| modified.duration_since(UNIX_EPOCH).ok())
+            {
+                stamp_map.insert(
+                    target_filepath.clone(),
+                    FileStamp {
+                        size: metadata.len(),
+                        modified: modified.as_secs(),
+                    },
+                );
+            }
+        }
+    }
+    if differences.len() > 0 {
+        mismatch_report::set_mismatched(true);
+        differences.push(log::make_error!(
+            "{}: 復元の検証で{}件の差異がありました。ハッシュファイルは移行しません。",
+            old_disk_id,
+            differences.len()
+        ));
+        return Err(differences);
+    }
+
+    // 復元したディスクにディスクIDを割り当てて、レジストリに登録する
+    if !has_disk_file {
+        if let Err(error) =
+            atomic_write::write(new_disk_file.as_path(), format!("{}\n", new_disk_id))
+        {
+            return Err(log::make_error!(
+                "diskファイルを作成できませんでした。: {}",
+                new_disk_file.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors());
+        }
+    }
+    let new_disk_info = disk::find_disk_containing(new_root)?;
+    registry::check_and_register(run_options.registry_filepath(), &vec![new_disk_info], true)?;
+
+    // 検証したハッシュを復元したディスクのバイト数と更新日時とともに記録する
+    hash_file::ensure_output_folder(new_output_folder)?;
+    hash_file::write_calculated_hash_with_stamps(
+        new_hash_filepath.as_path(),
+        algorithm,
+        hash_info_map,
+        &stamp_map,
+    )?;
+    if new_disk_id != old_disk_id {
+        let retired_folder = retired_folder(old_output_folder);
+        hash_file::ensure_output_folder(retired_folder.as_path())?;
+        if let Err(error) = fs::rename(
+            old_hash_filepath.as_path(),
+            retired_folder.join(old_disk_id).as_path(),
+        ) {
+            return Err(log::make_error!(
+                "故障したディスクのハッシュファイルを移動できませんでした。: {}",
+                old_hash_filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors());
+        }
+        merged_hash_file::integrate_hash_files(old_output_folder)?;
+    }
+    merged_hash_file::integrate_hash_files(new_output_folder)?;
+
+    log::info(
+        format!(
+            "{}: 復元したディスクを検証し、ハッシュファイルをディスク{}に移行しました。",
+            old_disk_id, new_disk_id
+        )
+        .as_str(),
+    );
+    Ok(())
+}
@@ -1,16 +1,129 @@
+use std::collections::HashMap;
 use std::sync::mpsc::{self, Receiver, Sender};
 use std::thread;
-use std::time::Instant;
+use std::time::{Duration, Instant};
 
+use serde_json::json;
+
+use crate::clock;
 use crate::log::{self, Errors};
+use crate::messages;
 use std::fmt::Write;
 use std::path::PathBuf;
 
+/// 購読者に進捗状況を通知する最小の間隔のミリ秒数
+/// 読み込みのたびに通知すると購読者の描画が追いつかないため間引く。
+const SUBSCRIBER_INTERVAL_MILLIS: u64 = 200;
+
+/// 端末表示の進捗バーの幅
+const TUI_BAR_WIDTH: usize = 20;
+
+/// 端末の幅がわからない場合の幅
+const DEFAULT_TERMINAL_WIDTH: usize = 80;
+
+/// 現在の読み込み速度を計測する区間の秒数
+const RATE_SAMPLE_SECONDS: f64 = 1.0;
+
+/// 読み込み速度を平滑化する指数移動平均の時定数の秒数
+/// ファイルの大きさによって速度が揺れても、残り時間が大きく変わらないよう直近の数十秒をならす。
+const RATE_TIME_CONSTANT_SECONDS: f64 = 20.0;
+
+/// 進捗状況の出力形式
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ProgressFormat {
+    /// ログに人が読む形式で出力する
+    Text,
+    /// 標準出力に1回の更新ごとに1行のJSON(NDJSON)を出力する
+    Json,
+}
+
+impl ProgressFormat {
+    /// 名前から出力形式を返す。
+    /// 出力形式の名前でなければNoneを返す。
+    pub fn from_name(name: &str) -> Option<ProgressFormat> {
+        match name {
+            "text" => Some(ProgressFormat::Text),
+            "json" => Some(ProgressFormat::Json),
+            _ => None,
+        }
+    }
+}
+
+/// 進捗状況のスナップショット
+/// 進捗監視スレッドが作成した複製なので、購読者は他のスレッドを気にせず参照できる。
+#[derive(Debug, Clone)]
+pub struct Snapshot {
+    /// 開始からの経過時間
+    pub elapsed: Duration,
+    /// 初期化済みのディスクの進捗
+    pub disks: Vec<DiskSnapshot>,
+    /// 全てのディスクの処理が終わったか
+    pub finished: bool,
+}
+
+/// ディスクの進捗状況のスナップショット
+#[derive(Debug, Clone)]
+pub struct DiskSnapshot {
+    /// ディスクID
+    pub disk_id: String,
+    /// 対象ファイル一覧を作成済みであるか
+    pub listed: bool,
+    /// 総ファイル数
+    pub number_of_files: usize,
+    /// 完了したファイル数
+    pub number_of_done_files: usize,
+    /// 総容量
+    pub total_size: u64,
+    /// 読み込んだ容量
+    pub red_size: u64,
+    /// 処理中のファイル
+    pub current_file: Option<PathBuf>,
+}
+
+/// 進捗状況の購読者
+/// 進捗監視スレッドから呼び出される。
+pub type ProgressSubscriber = Box<dyn FnMut(&Snapshot) + Send>;
+
+/// スナップショットをチャネルに送信する購読者と、その受信側を作成する。
+/// 受信側が破棄された後のスナップショットは捨てる。
+pub fn channel_subscriber() -> (ProgressSubscriber, Receiver<Snapshot>) {
+    let (tx, rx) = mpsc::channel::<Snapshot>();
+    let subscriber: ProgressSubscriber = Box::new(move |snapshot: &Snapshot| {
+        let _ = tx.send(snapshot.clone());
+    });
+    (subscriber, rx)
+}
+
 /// 進捗監視スレッドを開始する。
-pub fn start_progress_monitor() -> Sender<ProgressUpdate> {
+/// ハートビート間隔が指定された場合は、その間隔で累計の進捗状況だけを出力する。
+/// ファイルごとに出力しない指定なら、ファイルの処理完了時には出力しない。
+/// 購読者が指定された場合は、出力とは別に進捗状況のスナップショットを通知する。
+/// JSONで出力する場合は、ハートビート間隔とファイルごとの出力の指定に関わらず更新ごとに出力する。
+/// 端末表示が指定された場合は、ログの代わりに端末の下部にディスクごとの行を描いて更新する。
+/// 決定的モードでは端末表示を行わない。
+pub fn start_progress_monitor(
+    progress_format: ProgressFormat,
+    heartbeat_interval: Option<Duration>,
+    output_each_file: bool,
+    tui: bool,
+    subscriber: Option<ProgressSubscriber>,
+) -> Sender<ProgressUpdate> {
     let (tx, rx) = mpsc::channel::<ProgressUpdate>();
     thread::spawn(move || {
-        if let Err(errors) = progress_monitor_routine(rx) {
+        let mut notifier = SnapshotNotifier::new(subscriber);
+        let result = match (progress_format, heartbeat_interval) {
+            (ProgressFormat::Json, _) => json_routine(rx, &mut notifier),
+            (ProgressFormat::Text, _) if tui && !clock::is_deterministic() => {
+                tui_routine(rx, &mut notifier)
+            }
+            (ProgressFormat::Text, Some(heartbeat_interval)) => {
+                heartbeat_routine(rx, heartbeat_interval, &mut notifier)
+            }
+            (ProgressFormat::Text, None) => {
+                progress_monitor_routine(rx, output_each_file, &mut notifier)
+            }
+        };
+        if let Err(errors) = result {
             log::log_errors(errors);
         };
     });
@@ -18,7 +131,11 @@ pub fn start_progress_monitor() -> Sender<ProgressUpdate> {
 }
 
 /// 進捗監視ルーチン。
-fn progress_monitor_routine(rx: Receiver<ProgressUpdate>) -> Result<(), Errors> {
+fn progress_monitor_routine(
+    rx: Receiver<ProgressUpdate>,
+    output_each_file: bool,
+    notifier: &mut SnapshotNotifier,
+) -> Result<(), Errors> {
     let mut progress_summary = ProgressSummary::new();
 
     let mut prev_output_time = Instant::now();
@@ -29,19 +146,268 @@ fn progress_monitor_routine(rx: Receiver<ProgressUpdate>) -> Result<(), Errors>
             None => break,
         };
 
-        let is_done = progress_update.message_type == ProgressUpdateType::Done;
+        let is_frequent = progress_update.message_type.is_frequent();
+        let is_done = output_each_file && progress_update.message_type == ProgressUpdateType::Done;
         progress_summary.update(progress_update)?;
+        notifier.notify(&progress_summary, is_frequent);
 
         // ファイルの処理完了か、前回の出力から1秒以上経過していれば進捗状況を出力する
+        // 決定的モードでは出力の回数と経過時間が実行ごとに変わるため出力しない
+        if clock::is_deterministic() {
+            continue;
+        }
         if is_done || prev_output_time.elapsed().as_secs() >= 1 {
             log::info(&progress_summary.log_line()?);
             prev_output_time = Instant::now();
         }
     }
 
+    notifier.finish(&progress_summary);
+
+    Ok(())
+}
+
+/// ハートビートルーチン。
+/// 端末以外に出力する場合に、ログが読みにくくならないよう間隔を空けて進捗状況を出力する。
+fn heartbeat_routine(
+    rx: Receiver<ProgressUpdate>,
+    interval: Duration,
+    notifier: &mut SnapshotNotifier,
+) -> Result<(), Errors> {
+    let mut progress_summary = ProgressSummary::new();
+
+    let mut prev_output_time = Instant::now();
+
+    while let Some(progress_update) = receive_progress_update(&rx) {
+        let is_frequent = progress_update.message_type.is_frequent();
+        progress_summary.update(progress_update)?;
+        notifier.notify(&progress_summary, is_frequent);
+
+        if prev_output_time.elapsed() >= interval && !clock::is_deterministic() {
+            log::info(&progress_summary.heartbeat_line());
+            prev_output_time = Instant::now();
+        }
+    }
+
+    // 最後の進捗状況を出力する
+    if progress_summary.disk_progresses.len() > 0 && !clock::is_deterministic() {
+        log::info(&progress_summary.heartbeat_line());
+    }
+
+    notifier.finish(&progress_summary);
+
+    Ok(())
+}
+
+/// JSON出力ルーチン。
+/// 更新されたディスクの進捗状況を1行のJSONで標準出力に出力する。
+/// 読み込みと一覧への追加の更新はディスクごとに間隔を空けて出力する。
+/// 決定的モードでは経過時間で変わる読み込みと一覧への追加の更新を出力せず、速度と残り時間も出力しない。
+fn json_routine(
+    rx: Receiver<ProgressUpdate>,
+    notifier: &mut SnapshotNotifier,
+) -> Result<(), Errors> {
+    let mut progress_summary = ProgressSummary::new();
+    let deterministic = clock::is_deterministic();
+
+    // ディスクごとの前回の読み込みの出力時刻
+    let mut prev_read_output_times: HashMap<usize, Instant> = HashMap::new();
+
+    while let Some(progress_update) = receive_progress_update(&rx) {
+        let disk_index = progress_update.disk_index;
+        let message_type = progress_update.message_type.name();
+        let is_frequent = progress_update.message_type.is_frequent();
+        progress_summary.update(progress_update)?;
+        notifier.notify(&progress_summary, is_frequent);
+
+        if is_frequent {
+            if deterministic {
+                continue;
+            }
+            let throttled = prev_read_output_times
+                .get(&disk_index)
+                .map_or(false, |time| {
+                    time.elapsed() < Duration::from_millis(SUBSCRIBER_INTERVAL_MILLIS)
+                });
+            if throttled {
+                continue;
+            }
+            prev_read_output_times.insert(disk_index, Instant::now());
+        }
+        println!(
+            "{}",
+            progress_summary.json_record(disk_index, message_type, deterministic)
+        );
+    }
+
+    notifier.finish(&progress_summary);
+
+    Ok(())
+}
+
+/// 端末表示ルーチン。
+/// 端末の下部にディスクごとの行を描き、更新のたびに描き直す。
+/// 読み込みと一覧への追加の更新は間隔を空けて描き直す。
+/// 終了時やエラー時は最後の進捗状況を消さずに残す。
+fn tui_routine(
+    rx: Receiver<ProgressUpdate>,
+    notifier: &mut SnapshotNotifier,
+) -> Result<(), Errors> {
+    let mut progress_summary = ProgressSummary::new();
+    let width = terminal_width();
+
+    let mut prev_draw_time = Instant::now();
+
+    while let Some(progress_update) = receive_progress_update(&rx) {
+        let is_frequent = progress_update.message_type.is_frequent();
+        if let Err(errors) = progress_summary.update(progress_update) {
+            log::keep_status_lines();
+            return Err(errors);
+        }
+        notifier.notify(&progress_summary, is_frequent);
+
+        if is_frequent
+            && prev_draw_time.elapsed() < Duration::from_millis(SUBSCRIBER_INTERVAL_MILLIS)
+        {
+            continue;
+        }
+        log::set_status_lines(progress_summary.tui_lines(width));
+        prev_draw_time = Instant::now();
+    }
+
+    // 最後の進捗状況を描いて残す
+    if progress_summary.disk_progresses.len() > 0 {
+        log::set_status_lines(progress_summary.tui_lines(width));
+    }
+    log::keep_status_lines();
+
+    notifier.finish(&progress_summary);
+
     Ok(())
 }
 
+/// 端末の幅の文字数を返す。
+/// 環境変数COLUMNSがなければ80文字とする。
+fn terminal_width() -> usize {
+    std::env::var("COLUMNS")
+        .ok()
+        .and_then(|columns| columns.parse::<usize>().ok())
+        .filter(|columns| *columns > 0)
+        .unwrap_or(DEFAULT_TERMINAL_WIDTH)
+}
+
+/// 文字の端末での表示幅を返す。
+/// 全角の文字を2、それ以外を1とする。
+fn char_width(c: char) -> usize {
+    let code = c as u32;
+    let wide = matches!(code,
+        0x1100..=0x115F
+        | 0x2E80..=0xA4CF
+        | 0xAC00..=0xD7A3
+        | 0xF900..=0xFAFF
+        | 0xFE30..=0xFE4F
+        | 0xFF00..=0xFF60
+        | 0xFFE0..=0xFFE6
+        | 0x1F300..=0x1FAFF
+        | 0x20000..=0x3FFFD);
+    if wide {
+        2
+    } else {
+        1
+    }
+}
+
+/// 文字列の端末での表示幅を返す。
+fn display_width(text: &str) -> usize {
+    text.chars().map(char_width).sum()
+}
+
+/// 行が端末の幅に収まるよう、末尾を切り詰める。
+/// 端末の幅を超えて折り返すと描き直す際に消す行の数がずれるため、必ず幅に収める。
+fn truncate_to_width(line: &str, width: usize) -> String {
+    let mut truncated = String::new();
+    let mut truncated_width = 0;
+    for c in line.chars() {
+        truncated_width += char_width(c);
+        if truncated_width > width {
+            break;
+        }
+        truncated.push(c);
+    }
+    truncated
+}
+
+/// パスが指定された幅に収まるよう、先頭を"..."に置き換えて省略する。
+/// ファイル名が見えるよう末尾を残す。
+fn shorten_path(path: &str, width: usize) -> String {
+    if display_width(path) <= width {
+        return path.to_string();
+    }
+    if width <= 3 {
+        return String::new();
+    }
+    let mut tail: Vec<char> = vec![];
+    let mut tail_width = 0;
+    for c in path.chars().rev() {
+        tail_width += char_width(c);
+        if tail_width > width - 3 {
+            break;
+        }
+        tail.push(c);
+    }
+    format!("...{}", tail.iter().rev().collect::<String>())
+}
+
+/// 進捗バーを行に追加する。
+/// 進捗率がわからなければ空のバーにする。
+fn push_bar(line: &mut String, rate: Option<f64>) {
+    let filled = rate.map_or(0, |rate| {
+        ((rate.clamp(0.0, 1.0) * TUI_BAR_WIDTH as f64) as usize).min(TUI_BAR_WIDTH)
+    });
+    line.push('[');
+    line.push_str(&"#".repeat(filled));
+    line.push_str(&"-".repeat(TUI_BAR_WIDTH - filled));
+    line.push(']');
+}
+
+/// スナップショットの通知
+struct SnapshotNotifier {
+    subscriber: Option<ProgressSubscriber>,
+    prev_notify_time: Instant,
+}
+
+impl SnapshotNotifier {
+    fn new(subscriber: Option<ProgressSubscriber>) -> SnapshotNotifier {
+        SnapshotNotifier {
+            subscriber,
+            prev_notify_time: Instant::now(),
+        }
+    }
+
+    /// 購読者に進捗状況を通知する。
+    /// 読み込みの通知は間隔を空けて通知する。
+    fn notify(&mut self, progress_summary: &ProgressSummary, throttled: bool) {
+        let subscriber = match self.subscriber.as_mut() {
+            Some(subscriber) => subscriber,
+            None => return,
+        };
+        if throttled
+            && self.prev_notify_time.elapsed() < Duration::from_millis(SUBSCRIBER_INTERVAL_MILLIS)
+        {
+            return;
+        }
+        subscriber(&progress_summary.snapshot(false));
+        self.prev_notify_time = Instant::now();
+    }
+
+    /// 購読者に最後の進捗状況を通知する。
+    fn finish(&mut self, progress_summary: &ProgressSummary) {
+        if let Some(subscriber) = self.subscriber.as_mut() {
+            subscriber(&progress_summary.snapshot(true));
+        }
+    }
+}
+
 /// 進捗更新メッセージを受信する。
 fn receive_progress_update(rx: &Receiver<ProgressUpdate>) -> Option<ProgressUpdate> {
     match rx.recv() {
@@ -54,9 +420,10 @@ fn receive_progress_update(rx: &Receiver<ProgressUpdate>) -> Option<ProgressUpda
 ///
 /// # Examples
 ///
-/// ```
-/// use crate::progress::seconds_to_hms;
-/// (h, m, s) = seconds_to_hms(2 * 3600 + 19 * 60 + 37);
+/// 非公開の関数のため、例はドキュメントテストとして実行しない。
+///
+/// ```ignore
+/// let (h, m, s) = seconds_to_hms(2 * 3600 + 19 * 60 + 37);
 /// assert_eq!((h, m, s), (2, 19, 37));
 /// ```
 fn seconds_to_hms(seconds: u32) -> (u32, u32, u32) {
@@ -99,6 +466,71 @@ impl ProgressSummary {
         self.disk_progresses.get_mut(index).unwrap()
     }
 
+    /// 進捗状況のスナップショットを作成する。
+    fn snapshot(&self, finished: bool) -> Snapshot {
+        let disks = self
+            .disk_progresses
+            .iter()
+            .filter(|disk_progress| disk_progress.status != DiskProgressStatus::New)
+            .map(|disk_progress| DiskSnapshot {
+                disk_id: disk_progress.disk_id.clone().unwrap(),
+                listed: disk_progress.status.is_rate_available(),
+                number_of_files: disk_progress.number_of_files,
+                number_of_done_files: disk_progress.number_of_done_files,
+                total_size: disk_progress.total_size,
+                red_size: disk_progress.red_size,
+                current_file: disk_progress.current_file.clone(),
+            })
+            .collect();
+
+        Snapshot {
+            elapsed: self.start_time.elapsed(),
+            disks,
+            finished,
+        }
+    }
+
+    /// ディスクの進捗状況をJSONで出力する1行を作成する。
+    /// 速度は読み込んだバイト数を経過時間で割った1秒あたりのバイト数とし、現在の速度は直近の区間の速度とする。
+    /// 速度と残り時間を計算できない場合や出力しない場合はnullにする。
+    fn json_record(&self, disk_index: usize, event: &str, without_time: bool) -> String {
+        let disk_progress = &self.disk_progresses[disk_index];
+        let elapsed_seconds = self.start_time.elapsed().as_secs_f64();
+        let (rate, eta_seconds) =
+            if without_time || disk_progress.red_size == 0 || elapsed_seconds == 0.0 {
+                (None, None)
+            } else {
+                (
+                    Some((disk_progress.red_size as f64 / elapsed_seconds) as u64),
+                    Some(disk_progress.remain_time_seconds(&self.start_time)),
+                )
+            };
+        let current_rate = if without_time {
+            None
+        } else {
+            disk_progress
+                .current_rate
+                .map(|current_rate| current_rate as u64)
+        };
+
+        json!({
+            "disk": disk_progress.disk_id,
+            "event": event,
+            "files_done": disk_progress.number_of_done_files,
+            "files_total": disk_progress.number_of_files,
+            "bytes_done": disk_progress.red_size,
+            "bytes_total": disk_progress.total_size,
+            "rate": rate,
+            "current_rate": current_rate,
+            "eta_seconds": eta_seconds,
+            "current_file": disk_progress
+                .current_file
+                .as_ref()
+                .map(|current_file| current_file.to_str().unwrap()),
+        })
+        .to_string()
+    }
+
     /// ログに出力する1行の文字列を作成する。
     fn log_line(&self) -> Result<String, Errors> {
         match self.disk_progresses.len() {
@@ -111,6 +543,118 @@ impl ProgressSummary {
         }
     }
 
+    /// 端末表示の行を作成する。
+    /// ディスクごとにID順に1行ずつ、進捗バー、進捗率、現在の読み込み速度、残り時間、処理中のファイルを並べる。
+    /// 複数のディスクを処理している場合は、最後に経過時間と全体の累計の行を加える。
+    /// 行は端末の幅に収まるよう、処理中のファイルのパスを先頭から省略する。
+    fn tui_lines(&self, width: usize) -> Vec<String> {
+        // 初期化済みのディスク進捗をディスクID順に並べる
+        let mut disk_progresses: Vec<&DiskProgress> = self
+            .disk_progresses
+            .iter()
+            .filter(|disk_progress| disk_progress.status != DiskProgressStatus::New)
+            .collect();
+        disk_progresses.sort_by(|a, b| a.disk_id.cmp(&b.disk_id));
+
+        let mut lines = vec![];
+        for disk_progress in disk_progresses.iter() {
+            let mut line = String::new();
+
+            // ディスクID
+            line.push_str(disk_progress.disk_id.as_ref().unwrap().as_str());
+            line.push(' ');
+            // 進捗バーと進捗率
+            if disk_progress.status.is_rate_available() {
+                push_bar(&mut line, Some(disk_progress.rate()));
+                write!(line, " {:6.2}", disk_progress.rate() * 100.0).unwrap();
+            } else {
+                push_bar(&mut line, None);
+                line.push_str("   -.--");
+            }
+            line.push('%');
+            // 現在の読み込み速度
+            line.push(' ');
+            push_current_rate(&mut line, disk_progress.current_rate);
+            // 残り時間
+            if disk_progress.red_size > 0 {
+                let (hours, minutes, seconds) =
+                    seconds_to_hms(disk_progress.remain_time_seconds(&self.start_time));
+                write!(line, " {:3}:{:02}:{:02}", hours, minutes, seconds).unwrap();
+            } else {
+                line.push_str("   -:--:--");
+            }
+            // 処理中ファイル
+            if disk_progress.status == DiskProgressStatus::Calculating {
+                if let Some(current_file) = &disk_progress.current_file {
+                    let rest_width = width.saturating_sub(display_width(&line) + 1);
+                    let current_file = shorten_path(current_file.to_str().unwrap(), rest_width);
+                    if current_file.len() > 0 {
+                        line.push(' ');
+                        line.push_str(&current_file);
+                    }
+                }
+            }
+
+            lines.push(truncate_to_width(&line, width));
+        }
+
+        if disk_progresses.len() > 1 {
+            lines.push(truncate_to_width(&self.heartbeat_line(), width));
+        }
+
+        lines
+    }
+
+    /// ハートビートの出力行を作成する。
+    /// 経過時間と全ディスクの累計を出力する。
+    fn heartbeat_line(&self) -> String {
+        let mut total = ProgressTotal::new();
+        let mut number_of_calculating_disks = 0;
+        for disk_progress in self.disk_progresses.iter() {
+            total.add(disk_progress);
+            // 対象ファイル一覧の作成中か、残りのファイルがあるディスクを処理中とする
+            let calculating = match disk_progress.status {
+                DiskProgressStatus::New => false,
+                DiskProgressStatus::Initialized => true,
+                _ => disk_progress.remain_files() > 0,
+            };
+            if calculating {
+                number_of_calculating_disks += 1;
+            }
+        }
+
+        let mut line = String::new();
+        // 経過時間
+        let (hours, minutes, seconds) = seconds_to_hms(self.start_time.elapsed().as_secs() as u32);
+        line.push_str(&messages::translate(&format!(
+            "経過{}:{:02}:{:02}",
+            hours, minutes, seconds
+        )));
+        // 処理中のディスク数/全ディスク数
+        line.push_str(&messages::translate(&format!(
+            " ディスク{}/{}",
+            number_of_calculating_disks,
+            self.disk_progresses.len()
+        )));
+        // 完了ファイル数/総ファイル数
+        line.push_str(&messages::translate(&format!(
+            " ファイル{}/{}",
+            total.number_of_done_files, total.number_of_files
+        )));
+        // 読み込んだ容量/総容量
+        write!(
+            line,
+            " {:.2}/{:.2}GB ",
+            total.red_size as f64 / (1u64 << 30) as f64,
+            total.total_size as f64 / (1u64 << 30) as f64
+        )
+        .unwrap();
+        // 進捗率
+        total.push_rate(&mut line);
+
+        line
+    }
+
     /// ディスク情報が1つである場合のログ出力行を作成する。
     fn log_line_for_single_disk(&self) -> String {
         let disk_progress = &self.disk_progresses[0];
@@ -138,6 +682,9 @@ impl ProgressSummary {
         }
         line.push('%');
         line.push(' ');
+        // 現在の読み込み速度
+        push_current_rate(&mut line, disk_progress.current_rate);
+        line.push(' ');
         // 残り時間
         if disk_progress.red_size > 0 {
             let (hours, minutes, seconds) =
@@ -146,6 +693,15 @@ impl ProgressSummary {
         } else {
             line.push_str("  -:--:--");
         }
+        // 残りの容量とファイル数
+        if disk_progress.status.is_rate_available() {
+            line.push(' ');
+            push_remaining(
+                &mut line,
+                disk_progress.remain_size(),
+                disk_progress.remain_files(),
+            );
+        }
 
         // 処理中ファイル
         if let Some(current_file) = &disk_progress.current_file {
@@ -157,52 +713,188 @@ impl ProgressSummary {
     }
 
     /// ディスク情報が複数である場合のログ出力行を作成する。
+    /// ディスクはID順に並べ、グループごとの進捗率と全体の進捗率も出力する。
     fn log_line_for_multiple_disks(&self) -> String {
         let mut line = String::new();
         let mut show_remain_time = false;
         let mut max_remain_time_seconds = 0;
+        let mut total_current_rate: Option<f64> = None;
+        let mut total = ProgressTotal::new();
 
-        for disk_progress in self.disk_progresses.iter() {
-            if disk_progress.status == DiskProgressStatus::New {
-                continue;
-            }
+        // 初期化済みのディスク進捗をディスクID順に並べる
+        let mut disk_progresses: Vec<&DiskProgress> = self
+            .disk_progresses
+            .iter()
+            .filter(|disk_progress| disk_progress.status != DiskProgressStatus::New)
+            .collect();
+        disk_progresses.sort_by(|a, b| a.disk_id.cmp(&b.disk_id));
 
+        // グループごとに出力する
+        for group_progresses in disk_progresses.chunk_by(|a, b| a.disk_group() == b.disk_group()) {
             if line.len() > 0 {
                 line.push_str(" / ");
             }
 
-            // ディスクID
-            line.push_str(disk_progress.disk_id.as_ref().unwrap().as_str());
-            line.push(' ');
-            // 進捗率
-            if disk_progress.status.is_rate_available() {
-                write!(line, "{:6.2}", disk_progress.rate() * 100.0).unwrap();
-            } else {
-                line.push_str("  -.--");
-            }
-            line.push('%');
+            let mut group_total = ProgressTotal::new();
+            let mut group_line = String::new();
+            for disk_progress in group_progresses {
+                group_total.add(disk_progress);
 
-            // 残り時間の最大を更新する
-            if disk_progress.red_size > 0 {
-                let remain_time_seconds = disk_progress.remain_time_seconds(&self.start_time);
-                if remain_time_seconds > max_remain_time_seconds {
-                    max_remain_time_seconds = remain_time_seconds;
+                // ディスクID
+                group_line.push(' ');
+                group_line.push_str(disk_progress.disk_id.as_ref().unwrap().as_str());
+                group_line.push(' ');
+                // 進捗率
+                if disk_progress.status.is_rate_available() {
+                    write!(group_line, "{:6.2}", disk_progress.rate() * 100.0).unwrap();
+                } else {
+                    group_line.push_str("  -.--");
+                }
+                group_line.push('%');
+                // 残りの容量とファイル数
+                if disk_progress.status.is_rate_available() {
+                    group_line.push(' ');
+                    push_remaining(
+                        &mut group_line,
+                        disk_progress.remain_size(),
+                        disk_progress.remain_files(),
+                    );
+                }
+
+                // 全ディスクの現在の読み込み速度を合計する
+                if let Some(current_rate) = disk_progress.current_rate {
+                    *total_current_rate.get_or_insert(0.0) += current_rate;
+                }
+                // 残り時間の最大を更新する
+                if disk_progress.red_size > 0 {
+                    let remain_time_seconds = disk_progress.remain_time_seconds(&self.start_time);
+                    if remain_time_seconds > max_remain_time_seconds {
+                        max_remain_time_seconds = remain_time_seconds;
+                    }
+                    show_remain_time = true;
                 }
-                show_remain_time = true;
             }
+
+            // グループ名とグループの進捗率
+            write!(line, "[{} ", group_progresses[0].disk_group()).unwrap();
+            group_total.push_rate(&mut line);
+            line.push(']');
+            line.push_str(&group_line);
+
+            total.append(group_total);
         }
 
+        // 全体の進捗率
+        line.push_str(&messages::translate(" - 全体 "));
+        total.push_rate(&mut line);
+
+        // 全ディスクの現在の読み込み速度
+        line.push(' ');
+        push_current_rate(&mut line, total_current_rate);
         if show_remain_time {
-            line.push_str(" - ");
+            line.push(' ');
 
             let (hours, minutes, seconds) = seconds_to_hms(max_remain_time_seconds);
             write!(line, "{:3}:{:02}:{:02}", hours, minutes, seconds).unwrap();
         }
+        // 全ディスクの残りの容量とファイル数
+        if total.available {
+            line.push(' ');
+            push_remaining(&mut line, total.remain_size(), total.remain_files());
+        }
 
         line
     }
 }
 
+/// 複数のディスク進捗の合計
+struct ProgressTotal {
+    /// 進捗率を計算できるディスクがあるか
+    available: bool,
+    number_of_files: usize,
+    number_of_done_files: usize,
+    total_size: u64,
+    red_size: u64,
+}
+
+impl ProgressTotal {
+    fn new() -> ProgressTotal {
+        ProgressTotal {
+            available: false,
+            number_of_files: 0,
+            number_of_done_files: 0,
+            total_size: 0,
+            red_size: 0,
+        }
+    }
+
+    /// ディスク進捗を合計に加える。
+    /// 対象ファイル一覧が作成されていないディスクは加えない。
+    fn add(&mut self, disk_progress: &DiskProgress) {
+        if !disk_progress.status.is_rate_available() {
+            return;
+        }
+        self.available = true;
+        self.number_of_files += disk_progress.number_of_files;
+        self.number_of_done_files += disk_progress.number_of_done_files;
+        self.total_size += disk_progress.total_size;
+        self.red_size += disk_progress.red_size;
+    }
+
+    /// 別の合計を合計に加える。
+    fn append(&mut self, other: ProgressTotal) {
+        self.available |= other.available;
+        self.number_of_files += other.number_of_files;
+        self.number_of_done_files += other.number_of_done_files;
+        self.total_size += other.total_size;
+        self.red_size += other.red_size;
+    }
+
+    /// 進捗率をログ出力行に追加する。
+    fn push_rate(&self, line: &mut String) {
+        if !self.available {
+            line.push_str("  -.--");
+        } else if self.total_size > 0 {
+            let rate = (self.red_size as f64) / (self.total_size as f64);
+            write!(line, "{:6.2}", rate * 100.0).unwrap();
+        } else {
+            write!(line, "{:6.2}", 100.0).unwrap();
+        }
+        line.push('%');
+    }
+
+    /// 残りの容量を計算する。
+    fn remain_size(&self) -> u64 {
+        self.total_size.saturating_sub(self.red_size)
+    }
+
+    /// 残りのファイル数を計算する。
+    fn remain_files(&self) -> usize {
+        self.number_of_files
+            .saturating_sub(self.number_of_done_files)
+    }
+}
+
+/// 現在の読み込み速度を出力行に追加する。
+/// まだ計測できていなければ"-.-"にする。
+fn push_current_rate(line: &mut String, current_rate: Option<f64>) {
+    match current_rate {
+        Some(current_rate) => {
+            write!(line, "{:7.1}MB/s", current_rate / (1u64 << 20) as f64).unwrap()
+        }
+        None => line.push_str("    -.-MB/s"),
+    }
+}
+
+/// 残りの容量とファイル数をログ出力行に追加する。
+fn push_remaining(line: &mut String, remain_size: u64, remain_files: usize) {
+    let remain_gigabytes = remain_size as f64 / (1u64 << 30) as f64;
+    line.push_str(&messages::translate(&format!(
+        "残り{:.2}GB/{}ファイル",
+        remain_gigabytes, remain_files
+    )));
+}
+
 #[derive(Debug, PartialEq)]
 enum DiskProgressStatus {
     /// 新規
@@ -215,6 +907,7 @@ enum DiskProgressStatus {
     WaitNewFile,
     /// 計算中
     /// ファイルのハッシュ計算を行っている。
+    /// 複数のファイルを並行して計算している場合は、全てのファイルが終わるまで計算中とする。
     Calculating,
 }
 
@@ -223,12 +916,18 @@ impl DiskProgressStatus {
     fn check_status(&self, message_type: &ProgressUpdateType) -> Result<(), Errors> {
         let ok = match self {
             DiskProgressStatus::Calculating => {
-                *message_type == ProgressUpdateType::Read
+                *message_type == ProgressUpdateType::NewFile
+                    || *message_type == ProgressUpdateType::Read
                     || *message_type == ProgressUpdateType::Done
+                    || *message_type == ProgressUpdateType::Vanished
+                    || *message_type == ProgressUpdateType::AddTargets
             }
             DiskProgressStatus::New => *message_type == ProgressUpdateType::Init,
             DiskProgressStatus::Initialized => *message_type == ProgressUpdateType::ListTargets,
-            DiskProgressStatus::WaitNewFile => *message_type == ProgressUpdateType::NewFile,
+            DiskProgressStatus::WaitNewFile => {
+                *message_type == ProgressUpdateType::NewFile
+                    || *message_type == ProgressUpdateType::AddTargets
+            }
         };
 
         match ok {
@@ -262,6 +961,16 @@ struct DiskProgress {
     total_size: u64,
     red_size: u64,
     current_file: Option<PathBuf>,
+    /// 計算中のファイルの数
+    number_of_calculating_files: usize,
+    /// 計測中の区間の開始時刻
+    rate_sample_start: Option<Instant>,
+    /// 計測中の区間に読み込んだバイト数
+    rate_sample_bytes: u64,
+    /// 直近の区間の読み込み速度(1秒あたりのバイト数)
+    current_rate: Option<f64>,
+    /// 区間ごとの読み込み速度を指数移動平均で平滑化した速度(1秒あたりのバイト数)
+    smoothed_rate: Option<f64>,
 }
 
 impl DiskProgress {
@@ -274,6 +983,11 @@ impl DiskProgress {
             total_size: 0,
             red_size: 0,
             current_file: None,
+            number_of_calculating_files: 0,
+            rate_sample_start: None,
+            rate_sample_bytes: 0,
+            current_rate: None,
+            smoothed_rate: None,
         }
     }
 
@@ -289,18 +1003,65 @@ impl DiskProgress {
                 self.number_of_files = update_info.number_of_files;
                 self.total_size = update_info.total_size;
             }
+            ProgressUpdateType::AddTargets => {
+                // 一覧にしながら計算する場合は、一覧にした分だけ総ファイル数と総容量を増やす
+                self.number_of_files += update_info.number_of_files;
+                self.total_size += update_info.total_size;
+            }
             ProgressUpdateType::NewFile => {
                 self.status = DiskProgressStatus::Calculating;
                 self.current_file = update_info.file_path;
+                self.number_of_calculating_files += 1;
+                // 最初のファイルの読み込みを始めた時刻から速度を計測する
+                self.rate_sample_start.get_or_insert_with(Instant::now);
             }
             ProgressUpdateType::Read => {
                 self.red_size += update_info.red_size;
+                self.sample_rate(update_info.red_size);
             }
             ProgressUpdateType::Done => {
-                self.status = DiskProgressStatus::WaitNewFile;
+                self.finish_file();
                 self.number_of_done_files += 1;
             }
+            ProgressUpdateType::Vanished => {
+                // 消えたファイルは総ファイル数と総容量から除外する
+                self.finish_file();
+                self.number_of_files = self.number_of_files.saturating_sub(1);
+                self.total_size = self.total_size.saturating_sub(update_info.total_size);
+            }
+        }
+    }
+
+    /// ファイルの計算が終わったことを記録する。
+    /// 計算中のファイルがなくなれば新規ファイル待ちにする。
+    fn finish_file(&mut self) {
+        self.number_of_calculating_files = self.number_of_calculating_files.saturating_sub(1);
+        if self.number_of_calculating_files == 0 {
+            self.status = DiskProgressStatus::WaitNewFile;
+        }
+    }
+
+    /// 読み込んだバイト数を計測中の区間に加える。
+    /// 区間の長さが計測する秒数に達したら、現在の速度と平滑化した速度を更新して次の区間を始める。
+    fn sample_rate(&mut self, red_size: u64) {
+        let now = Instant::now();
+        let sample_start = *self.rate_sample_start.get_or_insert(now);
+        self.rate_sample_bytes += red_size;
+        let sample_seconds = now.duration_since(sample_start).as_secs_f64();
+        if sample_seconds < RATE_SAMPLE_SECONDS {
+            return;
         }
+
+        let current_rate = self.rate_sample_bytes as f64 / sample_seconds;
+        self.current_rate = Some(current_rate);
+        // 区間の長さに応じて重みを決め、区間の長さが揃わなくても同じ時定数でならす
+        let weight = 1.0 - (-sample_seconds / RATE_TIME_CONSTANT_SECONDS).exp();
+        self.smoothed_rate = Some(match self.smoothed_rate {
+            Some(smoothed_rate) => smoothed_rate + weight * (current_rate - smoothed_rate),
+            None => current_rate,
+        });
+        self.rate_sample_start = Some(now);
+        self.rate_sample_bytes = 0;
     }
 
     /// 進捗率を計算する。
@@ -312,8 +1073,29 @@ impl DiskProgress {
         }
     }
 
+    /// 残りの容量を計算する。
+    fn remain_size(&self) -> u64 {
+        self.total_size.saturating_sub(self.red_size)
+    }
+
+    /// 残りのファイル数を計算する。
+    fn remain_files(&self) -> usize {
+        self.number_of_files
+            .saturating_sub(self.number_of_done_files)
+    }
+
+    /// ディスクのグループ名を返す。
+    fn disk_group(&self) -> char {
+        self.disk_id.as_ref().unwrap().chars().next().unwrap()
+    }
+
     /// 残り時間の秒数を計算する。
+    /// 平滑化した読み込み速度があれば残りの容量をその速度で割る。
+    /// まだ計測できていなければ、開始からの平均の速度で計算する。
     fn remain_time_seconds(&self, start_time: &Instant) -> u32 {
+        if let Some(smoothed_rate) = self.smoothed_rate.filter(|rate| *rate > 0.0) {
+            return (self.remain_size() as f64 / smoothed_rate) as u32;
+        }
         let seconds = start_time.elapsed().as_secs() as f64;
         (seconds / self.rate() - seconds) as u32
     }
@@ -324,9 +1106,31 @@ impl DiskProgress {
 enum ProgressUpdateType {
     Init,
     ListTargets,
+    AddTargets,
     NewFile,
     Read,
     Done,
+    Vanished,
+}
+
+impl ProgressUpdateType {
+    /// JSONで出力する名前を返す。
+    fn name(&self) -> &'static str {
+        match self {
+            ProgressUpdateType::Init => "init",
+            ProgressUpdateType::ListTargets => "list_targets",
+            ProgressUpdateType::AddTargets => "add_targets",
+            ProgressUpdateType::NewFile => "new_file",
+            ProgressUpdateType::Read => "read",
+            ProgressUpdateType::Done => "done",
+            ProgressUpdateType::Vanished => "vanished",
+        }
+    }
+
+    /// 読み込みのように頻繁に送信され、間隔を空けて出力する種別かを返す。
+    fn is_frequent(&self) -> bool {
+        *self == ProgressUpdateType::Read || *self == ProgressUpdateType::AddTargets
+    }
 }
 
 /// 進捗更新メッセージ
@@ -368,6 +1172,16 @@ impl ProgressUpdate {
         }
     }
 
+    /// 一覧にしながら計算する場合に、追加で一覧にしたファイルを通知するメッセージを作成する。
+    pub fn add_targets(number_of_files: usize, total_size: u64) -> ProgressUpdate {
+        ProgressUpdate {
+            message_type: ProgressUpdateType::AddTargets,
+            number_of_files,
+            total_size,
+            ..EMPTY_PROGRESS_UPDATE
+        }
+    }
+
     pub fn new_file(filepath: PathBuf) -> ProgressUpdate {
         ProgressUpdate {
             message_type: ProgressUpdateType::NewFile,
@@ -384,6 +1198,15 @@ impl ProgressUpdate {
         }
     }
 
+    /// ファイルが消えていたことを通知するメッセージを作成する。
+    pub fn vanished(size: u64) -> ProgressUpdate {
+        ProgressUpdate {
+            message_type: ProgressUpdateType::Vanished,
+            total_size: size,
+            ..EMPTY_PROGRESS_UPDATE
+        }
+    }
+
     pub fn done() -> ProgressUpdate {
         ProgressUpdate {
             message_type: ProgressUpdateType::Done,
@@ -0,0 +1,91 @@
+use std::collections::HashMap;
+use std::path::Path;
+
+use crate::disk::DiskInfo;
+use crate::filter::Filters;
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::seal;
+use crate::target_file;
+use crate::trimmed;
+
+/// ハッシュファイルから、ディスクに対象ファイルがなくなった行を削除する。
+/// ハッシュは計算せず、対象ファイルの一覧とだけ照合する。
+/// 報告だけを行う指定なら、削除する行のパスを出力してハッシュファイルは変更しない。
+/// 削除した行はハッシュ計算と同じく後で戻せるように保存する。
+/// 削除した行数を返す。
+pub fn prune_hash_file(
+    output_folder: &Path,
+    disk_info: &DiskInfo,
+    filters: &Filters,
+    report_only: bool,
+) -> Result<usize, Errors> {
+    let hash_filepath = output_folder.join(&disk_info.id);
+    if !hash_filepath.is_file() {
+        return Err(
+            log::make_error!("{}: ハッシュファイルがありません。", &disk_info.id).as_errors(),
+        );
+    }
+    if !report_only && seal::is_sealed(output_folder, &disk_info.id) {
+        return Err(log::make_error!(
+            "{}: 封印されたディスクのハッシュファイルは変更できません。",
+            &disk_info.id
+        )
+        .as_errors());
+    }
+
+    let algorithm = hash_file::resolve_algorithm(hash_filepath.as_path(), None)?;
+    // 代替データストリームの行はファイルの一覧と照合できないので残す
+    let (hash_info_map, stream_hash_info_map): (HashMap<_, _>, HashMap<_, _>) =
+        hash_file::load_hash_info(hash_filepath.as_path())?
+            .into_iter()
+            .partition(|(target_filepath, _)| !target_file::is_alternate_stream(target_filepath));
+    let target_files = target_file::list_target_files(disk_info, filters);
+    let (mut hash_info_map, pruned_hash_info_map) =
+        hash_file::remove_hash_info_for_missing_file(hash_info_map, &target_files);
+
+    if pruned_hash_info_map.len() == 0 {
+        log::info(format!("{}: 削除する行はありません。", &disk_info.id).as_str());
+        return Ok(0);
+    }
+
+    if report_only {
+        for (target_filepath, _) in hash_file::sorted_hash_info(&pruned_hash_info_map) {
+            println!("{}:{}", &disk_info.id, target_filepath.to_str().unwrap());
+        }
+        log::info(
+            format!(
+                "{}: ディスクにないファイルの行が{}件あります。",
+                &disk_info.id,
+                pruned_hash_info_map.len()
+            )
+            .as_str(),
+        );
+        return Ok(0);
+    }
+
+    trimmed::save_trimmed_hash_info(
+        output_folder,
+        &disk_info.id,
+        algorithm,
+        &pruned_hash_info_map,
+    )?;
+    hash_info_map.extend(stream_hash_info_map);
+    let stamp_map = hash_file::load_file_stamps(hash_filepath.as_path())?;
+    hash_file::write_calculated_hash_with_stamps(
+        hash_filepath.as_path(),
+        algorithm,
+        hash_info_map,
+        &stamp_map,
+    )?;
+    log::info(
+        format!(
+            "{}: ディスクにないファイルの行を{}件削除しました。",
+            &disk_info.id,
+            pruned_hash_info_map.len()
+        )
+        .as_str(),
+    );
+
+    Ok(pruned_hash_info_map.len())
+}
@@ -0,0 +1,89 @@
+use std::path::PathBuf;
+
+use crate::calc;
+use crate::hash_algorithm::{Digest, HashAlgorithm};
+use crate::interruption;
+use crate::log::{self, Errors};
+use crate::page_cache;
+
+/// 書き込み直後の検証で読み込み直すファイル
+pub struct ReadBackTarget {
+    /// 読み込むファイルのパス
+    pub actual_path: PathBuf,
+    /// ハッシュファイルに記録したパス
+    pub normalized_path: PathBuf,
+    /// 計算したハッシュ
+    pub hash: Digest,
+}
+
+/// 計算したファイルを書き込み直後の検証の標本に含めるかを返す。
+/// パスや順序によらず偏りなく選べるよう、ハッシュの先頭の2バイトで選ぶ。
+pub fn is_sampled(hash: &Digest, percent: u64) -> bool {
+    percent >= 100 || (u16::from_be_bytes([hash[0], hash[1]]) as u64 % 100) < percent
+}
+
+/// 計算したばかりのファイルをページキャッシュを使わずに読み込み直し、ハッシュが一致するか検証する。
+/// ディスクを保管する前に、書き込みやハッシュ計算の誤りを見つけるために使う。
+/// 一致しないファイルと読み込めないファイルをエラーにして返す。
+pub fn verify_read_back(
+    disk_id: &str,
+    number_of_hashed: usize,
+    targets: &[ReadBackTarget],
+    buffer: &mut [u8],
+    algorithm: HashAlgorithm,
+) -> Errors {
+    if targets.len() == 0 {
+        return vec![];
+    }
+    if !page_cache::SUPPORTED {
+        log::warn("この環境ではページキャッシュを使わずに読み込めないため、キャッシュから読み込むことがあります。");
+    }
+    log::info(
+        format!(
+            "{}: 計算した{}件のファイルのうち{}件を読み込み直して検証します。",
+            disk_id,
+            number_of_hashed,
+            targets.len()
+        )
+        .as_str(),
+    );
+
+    let mut errors: Errors = vec![];
+    let mut number_of_verified = 0;
+    for target in targets {
+        // 中断を受けたら残りは検証しない
+        if interruption::is_interrupted() {
+            break;
+        }
+        match calc::calc_uncached_file_hash(target.actual_path.as_path(), buffer, algorithm) {
+            Ok(hash) if hash == target.hash => number_of_verified += 1,
+            Ok(_) => errors.push(log::make_error!(
+                "{}: 読み込み直したファイルのハッシュが計算したハッシュと異なります。: {}",
+                disk_id,
+                target.normalized_path.to_str().unwrap()
+            )),
+            Err(file_error) => errors.push(file_error.error),
+        }
+    }
+
+    if errors.len() == 0 {
+        log::info(
+            format!(
+                "{}: 読み込み直した{}件のファイルのハッシュが一致しました。",
+                disk_id, number_of_verified
+            )
+            .as_str(),
+        );
+    } else {
+        log::warn(
+            format!(
+                "{}: 読み込み直して検証した{}件のファイルのうち{}件が一致しませんでした。",
+                disk_id,
+                number_of_verified + errors.len(),
+                errors.len()
+            )
+            .as_str(),
+        );
+    }
+    errors
+}
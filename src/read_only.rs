@@ -0,0 +1,123 @@
+use std::env;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::clock;
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::merged_hash_file;
+
+/// 読み取り専用モードの作業フォルダを用意する。
+/// 一時フォルダを作成して出力フォルダのハッシュファイルをコピーし、そのパスを返す。
+pub fn prepare_work_folder(output_folder: &Path) -> Result<PathBuf, Errors> {
+    let timestamp = clock::now().format("%Y%m%d%H%M%S");
+    // グループごとの出力フォルダで続けて作成しても重ならないよう連番を付ける
+    let mut work_folder = env::temp_dir().join(format!("bcbc-{}", timestamp));
+    let mut serial_number = 1;
+    while work_folder.exists() {
+        serial_number += 1;
+        work_folder = env::temp_dir().join(format!("bcbc-{}-{}", timestamp, serial_number));
+    }
+    hash_file::ensure_output_folder(work_folder.as_path())?;
+
+    if output_folder.is_dir() {
+        for hash_filepath in merged_hash_file::find_hash_files(output_folder)? {
+            let work_filepath = work_folder.join(hash_filepath.file_name().unwrap());
+            if let Err(error) = fs::copy(hash_filepath.as_path(), work_filepath.as_path()) {
+                return Err(log::make_error!(
+                    "ハッシュファイルを作業フォルダにコピーできませんでした。: {}",
+                    hash_filepath.to_str().unwrap()
+                )
+                .with(&error)
+                .as_errors());
+            }
+        }
+    }
+
+    log::info(
+        format!(
+            "読み取り専用モードで実行します。作業フォルダ: {}",
+            work_folder.to_str().unwrap()
+        )
+        .as_str(),
+    );
+
+    Ok(work_folder)
+}
+
+/// 出力フォルダと作業フォルダのハッシュファイルの差分をレポートに出力する。
+/// 1行に1つの差分を"記号パス:ハッシュ"の形式で出力する。
+/// 記号は追加された行なら'+'、削除された行なら'-'とする。
+pub fn write_report(
+    output_folder: &Path,
+    work_folder: &Path,
+    disk_ids: &Vec<String>,
+) -> Result<(), Errors> {
+    let mut report_contents = String::new();
+
+    for disk_id in disk_ids {
+        let original_lines = hash_file_lines(output_folder.join(disk_id).as_path())?;
+        let work_lines = hash_file_lines(work_folder.join(disk_id).as_path())?;
+
+        let added_lines: Vec<&String> = work_lines
+            .iter()
+            .filter(|line| original_lines.binary_search(line).is_err())
+            .collect();
+        let removed_lines: Vec<&String> = original_lines
+            .iter()
+            .filter(|line| work_lines.binary_search(line).is_err())
+            .collect();
+
+        log::info(
+            format!(
+                "{}: 追加 {}行 / 削除 {}行",
+                disk_id,
+                added_lines.len(),
+                removed_lines.len()
+            )
+            .as_str(),
+        );
+
+        report_contents.push_str(format!("[{}]\n", disk_id).as_str());
+        for line in added_lines {
+            report_contents.push('+');
+            report_contents.push_str(line);
+            report_contents.push('\n');
+        }
+        for line in removed_lines {
+            report_contents.push('-');
+            report_contents.push_str(line);
+            report_contents.push('\n');
+        }
+    }
+
+    let report_filepath = work_folder.join("report");
+    match atomic_write::write(report_filepath.as_path(), &report_contents) {
+        Ok(_) => {
+            log::info(
+                format!(
+                    "レポートを出力しました。: {}",
+                    report_filepath.to_str().unwrap()
+                )
+                .as_str(),
+            );
+            Ok(())
+        }
+        Err(error) => Err(log::make_error!("レポートの作成に失敗しました。")
+            .with(&error)
+            .as_errors()),
+    }
+}
+
+/// ハッシュファイルの行をソートして一覧にする。
+/// ハッシュファイルがなければ空の一覧を返す。
+fn hash_file_lines(hash_filepath: &Path) -> Result<Vec<String>, Errors> {
+    let mut lines = vec![];
+    for (target_filepath, hash) in hash_file::load_hash_info(hash_filepath)? {
+        let line = hash_file::add_hash_file_line(String::new(), target_filepath.as_path(), &hash);
+        lines.push(line.trim_end().to_string());
+    }
+    lines.sort();
+    Ok(lines)
+}
@@ -0,0 +1,236 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::disk::{self, DiskInfo, Priority};
+use crate::log::{self, Error, Errors};
+
+/// ディスクレジストリ
+/// 発行済みのディスクIDと、そのディスクが最後に確認されたルートのパスと優先度を保持する。
+pub struct DiskRegistry {
+    entries: BTreeMap<String, PathBuf>,
+    priorities: BTreeMap<String, Priority>,
+}
+
+impl DiskRegistry {
+    /// 指定されたディスクの登録済みのルートを返す。
+    pub fn root_of(&self, disk_id: &str) -> Option<&Path> {
+        self.entries.get(disk_id).map(|root| root.as_path())
+    }
+
+    /// 指定されたパスを含むディスクのIDと、ルートからの相対パスを返す。
+    /// 複数のルートが含む場合は最も深いルートのディスクとする。
+    pub fn find_disk_of<'a>(&self, path: &'a Path) -> Option<(&str, &'a Path)> {
+        self.entries
+            .iter()
+            .filter_map(|(disk_id, root)| {
+                path.strip_prefix(root)
+                    .ok()
+                    .map(|relative_path| (disk_id.as_str(), root, relative_path))
+            })
+            .max_by_key(|(_, root, _)| root.components().count())
+            .map(|(disk_id, _, relative_path)| (disk_id, relative_path))
+    }
+
+    /// グループ内で登録されていない最小の連番のディスクIDを返す。
+    pub fn unregistered_disk_id(&self, group: char) -> String {
+        (1..)
+            .map(|number| format!("{}{}", group, number))
+            .find(|disk_id| !self.entries.contains_key(disk_id))
+            .unwrap()
+    }
+
+    /// 登録済みのディスクのルートを返す。
+    pub fn roots(&self) -> impl Iterator<Item = &Path> {
+        self.entries.values().map(|root| root.as_path())
+    }
+
+    /// 指定されたディスクの最後に確認された優先度を返す。
+    pub fn priority_of(&self, disk_id: &str) -> Priority {
+        self.priorities
+            .get(disk_id)
+            .copied()
+            .unwrap_or(Priority::Normal)
+    }
+}
+
+/// ディスクレジストリを読み込む。
+/// ファイルがなければ空のレジストリを返す。
+pub fn load_registry(registry_filepath: &Path) -> Result<DiskRegistry, Errors> {
+    let mut entries = BTreeMap::new();
+    let mut priorities = BTreeMap::new();
+
+    if !registry_filepath.is_file() {
+        return Ok(DiskRegistry {
+            entries,
+            priorities,
+        });
+    }
+
+    let contents = match fs::read_to_string(registry_filepath) {
+        Ok(contents) => contents,
+        Err(error) => {
+            return Err(log::make_error!(
+                "ディスクレジストリが読み込めませんでした。: {}",
+                registry_filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors())
+        }
+    };
+
+    for (i, line) in contents.lines().enumerate() {
+        let (disk_id, root, priority) =
+            log::with_line_number(parse_registry_line(line), registry_filepath, i + 1)?;
+        if priority != Priority::Normal {
+            priorities.insert(disk_id.clone(), priority);
+        }
+        entries.insert(disk_id, root);
+    }
+
+    Ok(DiskRegistry {
+        entries,
+        priorities,
+    })
+}
+
+/// ディスクレジストリの行をパースする。
+/// 優先度は通常でなければルートの後にタブ区切りで記録されている。
+fn parse_registry_line(line: &str) -> Result<(String, PathBuf, Priority), Errors> {
+    let columns: Vec<&str> = line.split('\t').collect();
+    let (disk_id, root, priority) = match columns[..] {
+        [disk_id, root] => (disk_id, root, Some(Priority::Normal)),
+        [disk_id, root, priority] => (disk_id, root, Priority::from_name(priority)),
+        _ => ("", "", None),
+    };
+    match priority {
+        Some(priority) if disk::DISK_ID_PATTERN.is_match(disk_id) => {
+            Ok((disk_id.to_string(), PathBuf::from(root), priority))
+        }
+        _ => Err(log::make_error!("ディスクレジストリの形式が不正です。").as_errors()),
+    }
+}
+
+/// ディスク情報一覧をディスクレジストリと照合し、問題がなければ登録する。
+/// 別のディスクが使用中のIDを名乗っている場合はエラーを返す。
+/// 更新しない指定ならレジストリのファイルは書き換えない。
+pub fn check_and_register(
+    registry_filepath: &Path,
+    disk_info_list: &Vec<DiskInfo>,
+    writable: bool,
+) -> Result<(), Errors> {
+    let mut registry = load_registry(registry_filepath)?;
+
+    let mut errors = Vec::<Error>::new();
+    let mut updated = false;
+
+    for disk_info in disk_info_list {
+        let root = canonical_root(disk_info.root_path.as_path());
+
+        match registry.entries.get(&disk_info.id) {
+            // 未登録のIDなら登録する
+            None => {
+                log::info(
+                    format!(
+                        "ディスク{}をレジストリに登録します。: {}",
+                        &disk_info.id,
+                        root.to_str().unwrap()
+                    )
+                    .as_str(),
+                );
+                registry.entries.insert(disk_info.id.clone(), root);
+                updated = true;
+            }
+            Some(registered_root) if *registered_root == root => {}
+            // 登録済みのルートに同じIDのディスクが残っていれば別のディスクとみなす
+            Some(registered_root) if claims_same_id(registered_root, &disk_info.id) => {
+                errors.push(log::make_error!(
+                    "ディスクID{}は別のディスクに発行済みです。: {} (登録済み: {})",
+                    &disk_info.id,
+                    root.to_str().unwrap(),
+                    registered_root.to_str().unwrap()
+                ));
+            }
+            // 登録済みのルートにディスクがなければ付け替えられたとみなす
+            Some(registered_root) => {
+                log::info(
+                    format!(
+                        "ディスク{}のルートを更新します。: {} -> {}",
+                        &disk_info.id,
+                        registered_root.to_str().unwrap(),
+                        root.to_str().unwrap()
+                    )
+                    .as_str(),
+                );
+                registry.entries.insert(disk_info.id.clone(), root);
+                updated = true;
+            }
+        }
+    }
+
+    if errors.len() > 0 {
+        return Err(errors);
+    }
+
+    // diskファイルの優先度が変わっていれば記録し直す
+    for disk_info in disk_info_list {
+        if registry.priority_of(&disk_info.id) != disk_info.priority {
+            if disk_info.priority == Priority::Normal {
+                registry.priorities.remove(&disk_info.id);
+            } else {
+                registry
+                    .priorities
+                    .insert(disk_info.id.clone(), disk_info.priority);
+            }
+            updated = true;
+        }
+    }
+
+    if updated && writable {
+        write_registry(registry_filepath, &registry)?;
+    }
+
+    Ok(())
+}
+
+/// ルートのパスを比較のため絶対パスにする。
+/// 変換できなければそのまま返す。
+fn canonical_root(root: &Path) -> PathBuf {
+    match fs::canonicalize(root) {
+        Ok(root) => root,
+        Err(_) => root.to_path_buf(),
+    }
+}
+
+/// 指定されたルートのdiskファイルが指定されたIDであるかを返す。
+fn claims_same_id(root: &Path, disk_id: &str) -> bool {
+    match fs::read_to_string(root.join("disk")) {
+        Ok(contents) => disk::read_disk_id(&contents) == Some(disk_id),
+        Err(_) => false,
+    }
+}
+
+/// ディスクレジストリをファイルに出力する。
+fn write_registry(registry_filepath: &Path, registry: &DiskRegistry) -> Result<(), Errors> {
+    let mut contents = String::new();
+    for (disk_id, root) in registry.entries.iter() {
+        contents.push_str(disk_id);
+        contents.push('\t');
+        contents.push_str(root.to_str().unwrap());
+        if let Some(priority) = registry.priorities.get(disk_id) {
+            contents.push('\t');
+            contents.push_str(priority.name());
+        }
+        contents.push('\n');
+    }
+
+    match atomic_write::write(registry_filepath, &contents) {
+        Ok(_) => Ok(()),
+        Err(error) => Err(
+            log::make_error!("ディスクレジストリの書き込みに失敗しました。")
+                .with(&error)
+                .as_errors(),
+        ),
+    }
+}
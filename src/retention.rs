@@ -0,0 +1,210 @@
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::path::Path;
+use std::time::{Duration, SystemTime};
+
+use crate::disk::DiskInfo;
+use crate::filter::Filters;
+use crate::hash_algorithm::Digest;
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::merged_hash_file;
+use crate::messages;
+use crate::target_file::{self, TargetFile};
+
+/// 1日の秒数
+const SECONDS_PER_DAY: u64 = 24 * 60 * 60;
+
+/// 保存方針
+pub struct RetentionPolicy {
+    /// この日数より古いファイルを数える
+    pub older_than_days: Option<u64>,
+    /// この日数より新しいファイルを数える
+    pub newer_than_days: Option<u64>,
+    /// 古いファイルが必要なコピー数とコピー先のグループ
+    pub min_copies: Option<(usize, char)>,
+}
+
+/// 集計
+struct Tally {
+    number_of_files: usize,
+    size: u64,
+}
+
+impl Tally {
+    fn new() -> Tally {
+        Tally {
+            number_of_files: 0,
+            size: 0,
+        }
+    }
+
+    fn add(&mut self, target_file: &TargetFile) {
+        self.number_of_files += 1;
+        self.size += target_file.size;
+    }
+}
+
+/// ディスクのファイルを更新日時で集計し、保存方針を満たさないファイルを出力する。
+/// 保存方針を満たさないファイルは1行に1つ、パス、ディスクID、コピー数をタブ区切りで出力する。
+pub fn audit_retention(
+    output_folder: &Path,
+    disk_info_list: &Vec<DiskInfo>,
+    filters: &Filters,
+    policy: &RetentionPolicy,
+) -> Result<(), Errors> {
+    let now = SystemTime::now();
+    let older_than = policy.older_than_days.map(|days| days_before(now, days));
+    let newer_than = policy.newer_than_days.map(|days| days_before(now, days));
+
+    // コピー数を確認する場合はコピー先のグループのハッシュを集める
+    let copies = match policy.min_copies {
+        Some((_, copy_group)) => Some(count_copies(output_folder, copy_group)?),
+        None => None,
+    };
+
+    let mut number_of_violations = 0;
+
+    for disk_info in disk_info_list {
+        let hash_info_map = hash_file::load_hash_info(output_folder.join(&disk_info.id).as_path())?;
+
+        let mut all = Tally::new();
+        let mut old = Tally::new();
+        let mut new = Tally::new();
+
+        for target_file in target_file::list_target_files(disk_info, filters) {
+            all.add(&target_file);
+
+            let modified = match fs::metadata(target_file.actual_path()) {
+                Ok(metadata) => metadata.modified().ok(),
+                Err(_) => None,
+            };
+            let modified = match modified {
+                Some(modified) => modified,
+                None => {
+                    log::warn(
+                        format!(
+                            "{}: 更新日時を取得できませんでした。: {}",
+                            &disk_info.id,
+                            target_file.normalized_path().to_str().unwrap()
+                        )
+                        .as_str(),
+                    );
+                    continue;
+                }
+            };
+
+            if let Some(newer_than) = newer_than {
+                if modified > newer_than {
+                    new.add(&target_file);
+                }
+            }
+
+            // 古いファイルでなければコピー数は確認しない
+            match older_than {
+                Some(older_than) if modified < older_than => old.add(&target_file),
+                _ => continue,
+            }
+
+            // 古いファイルのコピー数を確認する
+            if let (Some(copies), Some((min_copies, _))) = (&copies, policy.min_copies) {
+                let number_of_copies = match hash_info_map.get(target_file.normalized_path()) {
+                    Some(hash) => copies.get(hash).map_or(0, |disk_ids| disk_ids.len()),
+                    None => 0,
+                };
+                if number_of_copies < min_copies {
+                    println!(
+                        "{}\t{}\t{}",
+                        target_file.normalized_path().to_str().unwrap(),
+                        &disk_info.id,
+                        number_of_copies
+                    );
+                    number_of_violations += 1;
+                }
+            }
+        }
+
+        let mut line = messages::translate(&format!(
+            "{}: 全 {}ファイル {}",
+            &disk_info.id,
+            all.number_of_files,
+            format_size(all.size)
+        ))
+        .into_owned();
+        if let Some(days) = policy.older_than_days {
+            line.push_str(&messages::translate(&format!(
+                " / {}日より古い {}ファイル {}",
+                days,
+                old.number_of_files,
+                format_size(old.size)
+            )));
+        }
+        if let Some(days) = policy.newer_than_days {
+            line.push_str(&messages::translate(&format!(
+                " / {}日より新しい {}ファイル {}",
+                days,
+                new.number_of_files,
+                format_size(new.size)
+            )));
+        }
+        log::info(line.as_str());
+    }
+
+    if let Some((min_copies, copy_group)) = policy.min_copies {
+        if number_of_violations > 0 {
+            log::warn(
+                format!(
+                    "グループ{}のディスク{}台以上にないファイルが{}件あります。",
+                    copy_group, min_copies, number_of_violations
+                )
+                .as_str(),
+            );
+        } else {
+            log::info(
+                format!(
+                    "古いファイルは全てグループ{}のディスク{}台以上にあります。",
+                    copy_group, min_copies
+                )
+                .as_str(),
+            );
+        }
+    }
+
+    Ok(())
+}
+
+/// 指定された日数前の日時を返す。
+fn days_before(now: SystemTime, days: u64) -> SystemTime {
+    now.checked_sub(Duration::from_secs(days * SECONDS_PER_DAY))
+        .unwrap_or(SystemTime::UNIX_EPOCH)
+}
+
+/// グループのハッシュファイルから、ハッシュごとにそのハッシュのファイルがあるディスクを集める。
+fn count_copies(
+    output_folder: &Path,
+    copy_group: char,
+) -> Result<HashMap<Digest, HashSet<String>>, Errors> {
+    let mut copies = HashMap::<Digest, HashSet<String>>::new();
+
+    for hash_filepath in merged_hash_file::find_hash_files(output_folder)? {
+        let disk_id = hash_filepath
+            .file_name()
+            .unwrap()
+            .to_str()
+            .unwrap()
+            .to_string();
+        if !disk_id.starts_with(copy_group) {
+            continue;
+        }
+        for (_, hash) in hash_file::load_hash_info(hash_filepath.as_path())? {
+            copies.entry(hash).or_default().insert(disk_id.clone());
+        }
+    }
+
+    Ok(copies)
+}
+
+/// 容量をGB単位の文字列にする。
+fn format_size(size: u64) -> String {
+    format!("{:.2}GB", size as f64 / (1u64 << 30) as f64)
+}
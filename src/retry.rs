@@ -0,0 +1,171 @@
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::thread;
+use std::time::Duration;
+
+use crate::atomic_write;
+use crate::file_error::FileErrorCategory;
+use crate::interruption;
+use crate::log::{self, Errors};
+use crate::target_file;
+
+/// 読み込みに失敗したファイルを再試行する回数の初期値
+pub const DEFAULT_RETRIES: u64 = 2;
+
+/// 最初に再試行するまでの待ち時間の秒数の初期値
+pub const DEFAULT_RETRY_DELAY_SECONDS: u64 = 1;
+
+/// 再試行を待つ間に中断を確認する間隔
+const INTERRUPTION_CHECK_INTERVAL: Duration = Duration::from_millis(100);
+
+/// 読み込みに失敗したファイルの再試行の方針
+#[derive(Clone, Copy)]
+pub struct RetryPolicy {
+    /// 再試行する回数
+    pub retries: u64,
+    /// 最初に再試行するまでの待ち時間
+    /// 再試行するごとに倍にする。
+    pub delay: Duration,
+}
+
+impl RetryPolicy {
+    /// 何回目かの失敗の後に再試行するかを返す。
+    /// USB接続の瞬断などで一時的に失敗しうる読み込みの失敗だけを再試行する。
+    pub fn should_retry(&self, category: FileErrorCategory, attempt: u64) -> bool {
+        category == FileErrorCategory::IoError
+            && attempt < self.retries
+            && !interruption::is_interrupted()
+    }
+
+    /// 何回目かの失敗の後、再試行するまで待つ。
+    /// 待っている間に中断を受けたらその場で戻る。
+    pub fn wait(&self, attempt: u64) {
+        let delay = self.delay * 2u32.saturating_pow(attempt.min(16) as u32);
+        let mut waited = Duration::ZERO;
+        while waited < delay && !interruption::is_interrupted() {
+            let interval = INTERRUPTION_CHECK_INTERVAL.min(delay - waited);
+            thread::sleep(interval);
+            waited += interval;
+        }
+    }
+}
+
+/// 再試行しても失敗したファイルの一覧を保存するフォルダを返す。
+fn failed_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("failed")
+}
+
+/// 再試行しても失敗したファイルを一覧に記録する。
+/// 前回の一覧は今回の結果で置き換え、範囲が指定された場合は範囲外のファイルをそのまま残す。
+/// 失敗したファイルがなくなれば一覧を削除する。
+pub fn record_failed(
+    output_folder: &Path,
+    disk_id: &str,
+    failures: &Vec<(PathBuf, FileErrorCategory)>,
+    scope: Option<&Path>,
+) -> Result<(), Errors> {
+    let failed_filepath = failed_folder(output_folder).join(disk_id);
+    let mut failed: BTreeMap<PathBuf, FileErrorCategory> = load_failed(failed_filepath.as_path())?
+        .into_iter()
+        .filter(|(path, _)| !target_file::is_in_scope(path, scope))
+        .collect();
+    for (path, category) in failures {
+        failed.insert(path.clone(), *category);
+    }
+
+    if failed.len() == 0 {
+        if failed_filepath.is_file() {
+            if let Err(error) = fs::remove_file(failed_filepath.as_path()) {
+                return Err(
+                    log::make_error!("失敗したファイルの一覧を削除できませんでした。")
+                        .with(&error)
+                        .as_errors(),
+                );
+            }
+        }
+        return Ok(());
+    }
+
+    let mut contents = String::new();
+    for (path, category) in failed.iter() {
+        contents.push_str(format!("{}\t{}\n", path.to_str().unwrap(), category.name()).as_str());
+    }
+    if let Err(error) = fs::create_dir_all(failed_folder(output_folder)) {
+        return Err(
+            log::make_error!("失敗したファイルの一覧のフォルダを作成できませんでした。")
+                .with(&error)
+                .as_errors(),
+        );
+    }
+    if let Err(error) = atomic_write::write(failed_filepath.as_path(), contents) {
+        return Err(
+            log::make_error!("失敗したファイルの一覧の出力に失敗しました。")
+                .with(&error)
+                .as_errors(),
+        );
+    }
+    if failures.len() > 0 {
+        log::warn(
+            format!(
+                "{}: 読み込みに失敗した{}件のファイルを記録しました。bcbc retryで再試行できます。: {}",
+                disk_id,
+                failures.len(),
+                failed_filepath.to_str().unwrap()
+            )
+            .as_str(),
+        );
+    }
+
+    Ok(())
+}
+
+/// 失敗したファイルの一覧のパスを読み込む。
+/// 一覧がなければ空のセットを返す。
+pub fn load_failed_paths(output_folder: &Path, disk_id: &str) -> Result<BTreeSet<PathBuf>, Errors> {
+    let failed_filepath = failed_folder(output_folder).join(disk_id);
+    Ok(load_failed(failed_filepath.as_path())?
+        .into_keys()
+        .collect())
+}
+
+/// 失敗したファイルの一覧を読み込む。
+/// 一覧がなければ空のマップを返す。
+fn load_failed(failed_filepath: &Path) -> Result<BTreeMap<PathBuf, FileErrorCategory>, Errors> {
+    let mut failed = BTreeMap::new();
+    if !failed_filepath.is_file() {
+        return Ok(failed);
+    }
+
+    let contents = match fs::read_to_string(failed_filepath) {
+        Ok(contents) => contents,
+        Err(error) => {
+            return Err(
+                log::make_error!("失敗したファイルの一覧を読み込めませんでした。")
+                    .with(&error)
+                    .as_errors(),
+            )
+        }
+    };
+
+    for (i, line) in contents.lines().enumerate() {
+        let mut fields = line.split('\t');
+        match (
+            fields.next(),
+            fields.next().and_then(FileErrorCategory::from_name),
+        ) {
+            (Some(path), Some(category)) if path.len() > 0 => {
+                failed.insert(PathBuf::from(path), category);
+            }
+            _ => {
+                return log::with_line_number(
+                    Err(log::make_error!("失敗したファイルの一覧の形式が不正です。").as_errors()),
+                    failed_filepath,
+                    i + 1,
+                )
+            }
+        }
+    }
+
+    Ok(failed)
+}
@@ -1,7 +1,212 @@
 use std::collections::HashMap;
 use std::path::{Path, PathBuf};
+use std::time::Duration;
 
+use chrono::NaiveDateTime;
+use once_cell::sync::Lazy;
+use regex::Regex;
+
+use crate::coreutils;
+use crate::disk;
+use crate::filter::{SkipRules, SymlinkPolicy};
+use crate::hash_algorithm::HashAlgorithm;
+use crate::hash_store::HashStorage;
 use crate::log::{self, Errors};
+use crate::messages::Language;
+use crate::mismatch_report::OutputFormat;
+use crate::path_normalizer::{CustomStep, PathNormalizer};
+use crate::plan::VerificationPlan;
+use crate::progress::ProgressFormat;
+use crate::retention::RetentionPolicy;
+use crate::retry::{self, RetryPolicy};
+use crate::settings::{self, Settings};
+use crate::stream_hash::StreamTarget;
+use crate::tags::TagTarget;
+use crate::target_file;
+
+/// 端末以外に出力する場合の進捗状況の出力間隔の秒数の初期値
+const DEFAULT_HEARTBEAT_SECONDS: u64 = 5 * 60;
+
+/// 問い合わせサーバーが待ち受けるアドレスの初期値
+const DEFAULT_LISTEN_ADDRESS: &str = "127.0.0.1:8080";
+
+/// 全てのバイトを検証する周期の日数の初期値
+const DEFAULT_PLAN_PERIOD_DAYS: u64 = 365;
+
+/// 検証を実行する間隔の日数の初期値
+const DEFAULT_PLAN_INTERVAL_DAYS: u64 = 7;
+
+/// 監視でディスクを確認する間隔の初期値
+const DEFAULT_POLL_INTERVAL: Duration = Duration::from_secs(60);
+
+/// 監視で計算を待つ、更新されてからの時間の初期値
+const DEFAULT_SETTLE: Duration = Duration::from_secs(30);
+
+/// 名前空間の名前に使える形式
+static NAMESPACE_PATTERN: Lazy<Regex> = Lazy::new(|| Regex::new(r"^[a-z][a-z0-9_]*$").unwrap());
+
+/// 出力フォルダのサブフォルダと重なるため名前空間に使えない名前
+const RESERVED_NAMESPACES: [&str; 19] = [
+    "checkpoints",
+    "conflicts",
+    "coreutils",
+    "digests",
+    "disks",
+    "duplicates",
+    "failures",
+    "ignored",
+    "labels",
+    "sealed",
+    "sizes",
+    "smart",
+    "symlinks",
+    "tags",
+    "throughput",
+    "trimmed",
+    "truncation",
+    "verified",
+    "backup",
+];
+
+/// サブコマンド
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Command {
+    /// ハッシュ計算
+    Calc,
+    /// ハッシュファイルの検証
+    Verify,
+    /// 他の環境のハッシュファイルの取り込み
+    Sync,
+    /// グループ間の比較
+    Compare,
+    /// 削除した行の復元
+    RestoreTrimmed,
+    /// ハッシュファイルの問い合わせサーバー
+    Serve,
+    /// ディスクの封印
+    Seal,
+    /// 必須ファイルの確認
+    CheckPinned,
+    /// 更新日時による保存状況の監査
+    Retention,
+    /// 読み込み速度の履歴の表示
+    Throughput,
+    /// フォルダの比較
+    CompareDirs,
+    /// コピー
+    Copy,
+    /// 標準入力などのハッシュ計算
+    Hash,
+    /// ハッシュファイルの統合
+    Merge,
+    /// ハッシュファイルの重複した行の削除
+    Dedup,
+    /// タグを付ける
+    Tag,
+    /// タグを外す
+    Untag,
+    /// タグの一覧
+    Tags,
+    /// HTMLファイルへの出力
+    ExportHtml,
+    /// ラベルの作成
+    Label,
+    /// 検証計画の作成
+    Plan,
+    /// 設定の確認
+    CheckConfig,
+    /// 2つのハッシュファイルの比較
+    Diff,
+    /// 中断された実行の後始末
+    Clean,
+    /// md5sum互換のファイルの取り込み
+    ImportSums,
+    /// ZFSかbtrfsのスクラブのレポートの照合
+    ImportScrub,
+    /// バックアップから復元したディスクの検証とハッシュファイルの移行
+    PostRestore,
+    /// 読み込みに失敗したファイルの再試行
+    Retry,
+    /// グループごとの容量の集計
+    Usage,
+    /// ディスクにないファイルの行の削除
+    Prune,
+    /// 1つのファイルの検証
+    Check,
+    /// ディスクの監視
+    Watch,
+    /// 同じ内容のファイルの一覧
+    Dupes,
+    /// diskファイルの作成
+    Init,
+    /// ディスクの一覧
+    Disks,
+}
+
+impl Command {
+    /// サブコマンド名からサブコマンドを返す。
+    /// サブコマンド名でなければNoneを返す。
+    fn from_name(name: &str) -> Option<Command> {
+        match name {
+            "calc" => Some(Command::Calc),
+            "verify" => Some(Command::Verify),
+            "sync" => Some(Command::Sync),
+            "compare" => Some(Command::Compare),
+            "restore-trimmed" => Some(Command::RestoreTrimmed),
+            "serve" => Some(Command::Serve),
+            "seal" => Some(Command::Seal),
+            "check-pinned" => Some(Command::CheckPinned),
+            "retention" => Some(Command::Retention),
+            "throughput" => Some(Command::Throughput),
+            "compare-dirs" => Some(Command::CompareDirs),
+            "copy" => Some(Command::Copy),
+            "hash" => Some(Command::Hash),
+            "merge" => Some(Command::Merge),
+            "dedup" => Some(Command::Dedup),
+            "tag" => Some(Command::Tag),
+            "untag" => Some(Command::Untag),
+            "tags" => Some(Command::Tags),
+            "export-html" => Some(Command::ExportHtml),
+            "label" => Some(Command::Label),
+            "plan" => Some(Command::Plan),
+            "check-config" => Some(Command::CheckConfig),
+            "diff" => Some(Command::Diff),
+            "clean" => Some(Command::Clean),
+            "import-sums" => Some(Command::ImportSums),
+            "import-scrub" => Some(Command::ImportScrub),
+            "post-restore" => Some(Command::PostRestore),
+            "retry" => Some(Command::Retry),
+            "usage" => Some(Command::Usage),
+            "prune" => Some(Command::Prune),
+            "check" => Some(Command::Check),
+            "watch" => Some(Command::Watch),
+            "dupes" => Some(Command::Dupes),
+            "init" => Some(Command::Init),
+            "disks" => Some(Command::Disks),
+            _ => None,
+        }
+    }
+}
+
+/// グループごとの設定
+/// 設定されていない項目は全体の設定を使う。
+struct GroupSettings {
+    /// 出力フォルダ
+    output_folder: Option<PathBuf>,
+    /// ハッシュアルゴリズム
+    algorithm: Option<HashAlgorithm>,
+    /// フィルタープロファイル
+    filter_profile: Option<String>,
+}
+
+/// パターンファイル
+/// コマンドラインで指定された、1行に1つのrsyncのフィルターパターンが書かれたファイル。
+pub struct PatternFile {
+    /// ファイルのパス
+    pub path: PathBuf,
+    /// マッチしたファイルを対象にするならtrue、対象外にするならfalse
+    pub inclusive: bool,
+}
 
 /// 起動設定
 pub struct RunOptions {
@@ -11,8 +216,143 @@ pub struct RunOptions {
     output_folder: PathBuf,
     /// 設定フォルダ
     config_folder: PathBuf,
+    /// ディスクレジストリファイル
+    registry_filepath: PathBuf,
+    /// 実行中のハッシュ計算と検証を外部から停止する停止ファイル
+    stop_filepath: PathBuf,
+    /// 名前空間
+    namespace: Option<String>,
+    /// サブコマンド
+    command: Command,
+    /// オプション以外のコマンドライン引数
+    operands: Vec<String>,
     /// ディスクルート一覧
     disk_roots: Vec<PathBuf>,
+    /// diskファイルを探索するフォルダ一覧
+    discovery_folders: Vec<PathBuf>,
+    /// パターンファイル一覧
+    pattern_files: Vec<PatternFile>,
+    /// フィルタープロファイル
+    filter_profile: Option<String>,
+    /// 処理するディスクのID一覧
+    /// 空なら全てのディスクを処理する。
+    only_disk_ids: Vec<String>,
+    /// 処理しないディスクのID一覧
+    excluded_disk_ids: Vec<String>,
+    /// 読み取り専用モード
+    read_only: bool,
+    /// 修正リストの出力先フォルダ
+    fix_list_folder: Option<PathBuf>,
+    /// 比較で正しいとみなすグループ
+    preferred_group: Option<char>,
+    /// 端末以外に出力する場合の進捗状況の出力間隔の秒数
+    heartbeat_seconds: u64,
+    /// ファイルごとの処理結果を出力するイベントログファイル
+    event_filepath: Option<PathBuf>,
+    /// 問い合わせサーバーが待ち受けるアドレス
+    listen_address: String,
+    /// 種類で対象外にするファイル
+    skip_rules: SkipRules,
+    /// メッセージの言語
+    language: Language,
+    /// パスの正規化の手順
+    path_normalizer: PathNormalizer,
+    /// シンボリックリンクの扱い
+    symlink_policy: SymlinkPolicy,
+    /// ハッシュ情報の保存先
+    hash_storage: HashStorage,
+    /// この日数より古いファイルを監査する
+    older_than_days: Option<u64>,
+    /// この日数より新しいファイルを監査する
+    newer_than_days: Option<u64>,
+    /// 古いファイルが必要なコピー数
+    min_copies: Option<usize>,
+    /// 古いファイルのコピー先のグループ
+    copy_group: Option<char>,
+    /// 全てのバイトを検証する周期の日数
+    plan_period_days: u64,
+    /// 検証を実行する間隔の日数
+    plan_interval_days: u64,
+    /// 1回の検証に使える時間数
+    window_hours: Option<u64>,
+    /// ハッシュ計算と検証の実行時間の上限
+    max_duration: Option<Duration>,
+    /// 監視でディスクを確認する間隔
+    poll_interval: Duration,
+    /// 監視で計算を待つ、更新されてからの時間
+    settle: Option<Duration>,
+    /// ハッシュ計算と検証の集計をJSONのレポートにも保存するか
+    summary: bool,
+    verify_after_calc: Option<u64>,
+    /// SMART情報を取得するか
+    smart: bool,
+    /// 全速力で計算するか
+    full_speed: bool,
+    /// 統合ハッシュファイルを作り直すか
+    rebuild: bool,
+    /// ハッシュ計算の後に統合ハッシュファイルを作り直さないか
+    no_merge: bool,
+    /// 検証で見つかった移動したファイルのパスをハッシュファイルで書き換えるか
+    update_renamed: bool,
+    /// 検証で、検証計画の1回の読み込み量だけを検証するか
+    quota: bool,
+    /// ディスクにないファイルの行を削除せずに報告だけを行うか
+    report_only: bool,
+    /// ファイルを読み込まずに、ハッシュ計算するファイルの一覧だけを出力するか
+    dry_run: bool,
+    /// ハッシュ計算の範囲
+    /// ディスクルートからの相対パスで、指定された場合はその配下だけを処理する。
+    scope: Option<PathBuf>,
+    /// 代替データストリームも計算するか
+    alternate_streams: bool,
+    /// ラベルのQRコードに使う問い合わせサーバーのURL
+    base_url: Option<String>,
+    /// btrfsのスクラブのレポートのパスの起点にするマウント先
+    mount_folder: Option<PathBuf>,
+    /// 作成するdiskファイルのグループ
+    init_group: Option<char>,
+    /// 作成するdiskファイルに記録するラベル
+    disk_label: Option<String>,
+    /// 復元したディスクに割り当てるディスクID
+    new_disk_id: Option<String>,
+    /// コピー先を検証するか
+    verify: bool,
+    /// 検証の差異を標準出力に出力する形式
+    output_format: Option<OutputFormat>,
+    /// ハッシュファイルをmd5sum互換の形式でも出力するか
+    coreutils_output: bool,
+    /// 進捗状況の出力形式
+    progress_format: ProgressFormat,
+    /// 端末でも進捗状況を端末表示にせずログに出力するか
+    no_tui: bool,
+    /// ハッシュアルゴリズム
+    /// 指定されなければハッシュファイルのアルゴリズムか、新規ならMD5を使う。
+    algorithm: Option<HashAlgorithm>,
+    /// 1回の読み込みで追加で計算するハッシュアルゴリズム
+    extra_algorithms: Vec<HashAlgorithm>,
+    /// 同時にハッシュ計算するディスクの数
+    /// 指定されなければ全てのディスクを同時に計算する。
+    disks: Option<usize>,
+    /// 1台のディスクで同時にハッシュ計算するファイルの数
+    /// 指定されなければ1ファイルずつ計算する。
+    workers: Option<usize>,
+    /// 読み込み用のバッファのバイト数
+    buffer_size: Option<usize>,
+    /// 塊を並行して計算するファイルのバイト数の下限
+    /// 指定されなければ塊を並行して計算しない。
+    chunked_threshold: Option<u64>,
+    /// メモリ使用量の上限のバイト数
+    memory_limit: Option<u64>,
+    /// 読み込みに失敗したファイルの再試行の方針
+    retry_policy: RetryPolicy,
+    /// 決定的モードで使う固定の日時
+    fixed_time: Option<NaiveDateTime>,
+    /// グループごとの設定
+    group_settings: HashMap<char, GroupSettings>,
+    /// 標準入力などのハッシュを記録するディスクID
+    stream_disk_id: Option<String>,
+    /// 標準入力などのハッシュを記録するパス
+    stream_pseudo_path: Option<String>,
 }
 
 impl RunOptions {
@@ -21,23 +361,591 @@ impl RunOptions {
         args: Vec<String>,
         envs: HashMap<String, String>,
     ) -> Result<RunOptions, Errors> {
-        // コマンドライン引数をディスクルートにパースする
         // 1つ目はこのプログラムのパス
-        let mut disk_roots = Vec::with_capacity(args.len());
-        for arg in args.iter().skip(1) {
-            disk_roots.push(tilde_to_home(PathBuf::from(arg)));
+        let mut args = args.into_iter().skip(1).peekable();
+        // 2つ目がサブコマンド名ならサブコマンドとする
+        // サブコマンドが省略された場合はハッシュ計算とする
+        let command = match args.peek().and_then(|arg| Command::from_name(arg)) {
+            Some(command) => {
+                args.next();
+                command
+            }
+            None => Command::Calc,
+        };
+        // 残りのコマンドライン引数をオプションとディスクルートにパースする
+        let mut operands = vec![];
+        let mut disk_roots = vec![];
+        let mut discovery_folders = vec![];
+        let mut pattern_files = vec![];
+        let mut only_disk_ids = vec![];
+        let mut excluded_disk_ids = vec![];
+        let mut read_only = false;
+        let mut fix_list_folder = None;
+        let mut preferred_group = None;
+        let mut event_filepath = None;
+        let mut older_than_days = None;
+        let mut newer_than_days = None;
+        let mut min_copies = None;
+        let mut copy_group = None;
+        let mut plan_period_days = DEFAULT_PLAN_PERIOD_DAYS;
+        let mut plan_interval_days = DEFAULT_PLAN_INTERVAL_DAYS;
+        let mut window_hours = None;
+        let mut max_duration = None;
+        let mut poll_interval = None;
+        let mut settle = None;
+        let mut summary = false;
+        let mut verify_after_calc = None;
+        let mut smart = false;
+        let mut full_speed = false;
+        let mut rebuild = false;
+        let mut no_merge = false;
+        let mut update_renamed = false;
+        let mut quota = false;
+        let mut report_only = false;
+        let mut dry_run = false;
+        let mut scope = None;
+        let mut alternate_streams = false;
+        let mut base_url = None;
+        let mut init_group = None;
+        let mut disk_label = None;
+        let mut mount_folder = None;
+        let mut new_disk_id = None;
+        let mut verify = false;
+        let mut output_format = None;
+        let mut coreutils_output = false;
+        let mut progress_format = ProgressFormat::Text;
+        let mut no_tui = false;
+        // 設定項目のオプションは設定ファイルと環境変数の値を上書きするので、後でまとめて読み込む
+        let mut setting_options = HashMap::new();
+        let mut stream_disk_id = None;
+        let mut stream_pseudo_path = None;
+        // 名前空間はオプションがなければ環境変数から取得する
+        let mut namespace = envs.get("BCBCUSER").cloned();
+        while let Some(arg) = args.next() {
+            if !arg.starts_with("--") {
+                disk_roots.push(tilde_to_home(PathBuf::from(&arg)));
+                operands.push(arg);
+                continue;
+            }
+            // "--オプション=値"の形式なら値を分割する
+            let (name, inline_value) = match arg.split_once('=') {
+                Some((name, value)) => (name.to_string(), Some(value.to_string())),
+                None => (arg, None),
+            };
+            if let Some(key) = settings::key_of_option(&name) {
+                let value = option_value(&name, inline_value, &mut args)?;
+                setting_options.insert(key.name, value);
+                continue;
+            }
+            match name.as_str() {
+                "--discover" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    discovery_folders.push(tilde_to_home(PathBuf::from(value)));
+                }
+                "--exclude-from" | "--include-from" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    pattern_files.push(PatternFile {
+                        path: tilde_to_home(PathBuf::from(value)),
+                        inclusive: name == "--include-from",
+                    });
+                }
+                "--only" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    only_disk_ids.append(&mut parse_disk_id_list(&name, &value)?);
+                }
+                "--exclude-disk" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    excluded_disk_ids.append(&mut parse_disk_id_list(&name, &value)?);
+                }
+                "--read-only" => read_only = true,
+                "--smart" => smart = true,
+                "--full-speed" => full_speed = true,
+                "--no-tui" => no_tui = true,
+                "--rebuild" => rebuild = true,
+                "--no-merge" => no_merge = true,
+                "--update-renamed" => update_renamed = true,
+                "--quota" => quota = true,
+                "--report-only" => report_only = true,
+                "--summary" => summary = true,
+                "--dry-run" => dry_run = true,
+                "--base-url" => base_url = Some(option_value(&name, inline_value, &mut args)?),
+                "--label" => disk_label = Some(option_value(&name, inline_value, &mut args)?),
+                "--group" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    init_group = Some(parse_disk_group(&name, &value)?);
+                }
+                "--new-id" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    let mut disk_ids = parse_disk_id_list(&name, &value)?;
+                    if disk_ids.len() != 1 {
+                        return Err(log::make_error!(
+                            "オプション{}にはディスクIDを1つ指定してください。",
+                            name
+                        )
+                        .as_errors());
+                    }
+                    new_disk_id = disk_ids.pop();
+                }
+                "--mount" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    mount_folder = Some(tilde_to_home(PathBuf::from(value)));
+                }
+                "--path" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    scope = Some(parse_scope(&name, &value)?);
+                }
+                "--verify" => verify = true,
+                "--output-format" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    if value == coreutils::FORMAT_NAME {
+                        coreutils_output = true;
+                    } else {
+                        output_format = Some(parse_output_format(&name, &value)?);
+                    }
+                }
+                "--progress-format" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    progress_format = parse_progress_format(&name, &value)?;
+                }
+                "--streams" => alternate_streams = true,
+                "--disk" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    let mut disk_ids = parse_disk_id_list(&name, &value)?;
+                    if disk_ids.len() != 1 {
+                        return Err(log::make_error!(
+                            "オプション{}にはディスクIDを1つ指定してください。",
+                            name
+                        )
+                        .as_errors());
+                    }
+                    stream_disk_id = disk_ids.pop();
+                }
+                "--as" => stream_pseudo_path = Some(option_value(&name, inline_value, &mut args)?),
+                "--files-from" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    fix_list_folder = Some(tilde_to_home(PathBuf::from(value)));
+                }
+                "--prefer" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    preferred_group = Some(parse_disk_group(&name, &value)?);
+                }
+                "--events" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    event_filepath = Some(tilde_to_home(PathBuf::from(value)));
+                }
+                "--user" => namespace = Some(option_value(&name, inline_value, &mut args)?),
+                "--older-than" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    older_than_days = Some(parse_days(&name, &value)?);
+                }
+                "--newer-than" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    newer_than_days = Some(parse_days(&name, &value)?);
+                }
+                "--min-copies" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    min_copies = Some(parse_positive_number(&name, &value)? as usize);
+                }
+                "--copy-group" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    copy_group = Some(parse_disk_group(&name, &value)?);
+                }
+                "--period" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    plan_period_days = parse_days(&name, &value)?;
+                }
+                "--interval" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    plan_interval_days = parse_days(&name, &value)?;
+                }
+                "--window" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    window_hours = Some(parse_positive_number(&name, &value)?);
+                }
+                "--max-duration" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    max_duration = Some(parse_duration(&name, &value)?);
+                }
+                "--poll" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    poll_interval = Some(parse_duration(&name, &value)?);
+                }
+                "--settle" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    settle = Some(parse_duration(&name, &value)?);
+                }
+                "--verify-after-calc" => {
+                    let value = option_value(&name, inline_value, &mut args)?;
+                    verify_after_calc = Some(parse_percent(&name, &value)?);
+                }
+                _ => return Err(log::make_error!("不明なオプションです。: {}", name).as_errors()),
+            }
+        }
+        check_operands(command, &operands)?;
+        if stream_disk_id.is_some() != stream_pseudo_path.is_some() {
+            return Err(log::make_error!("--diskと--asは同時に指定してください。").as_errors());
+        }
+        if stream_pseudo_path.is_some() && operands.len() != 1 {
+            return Err(
+                log::make_error!("--asを指定する場合は入力を1つだけ指定してください。").as_errors(),
+            );
+        }
+        if min_copies.is_some() != copy_group.is_some() {
+            return Err(
+                log::make_error!("--min-copiesと--copy-groupは同時に指定してください。")
+                    .as_errors(),
+            );
+        }
+        if (older_than_days.is_some() || newer_than_days.is_some())
+            && command != Command::Retention
+            && command != Command::Verify
+        {
+            return Err(log::make_error!(
+                "--older-thanと--newer-thanは検証とretentionでのみ指定できます。"
+            )
+            .as_errors());
+        }
+        if newer_than_days.is_some() && command == Command::Verify {
+            return Err(log::make_error!("--newer-thanは検証では指定できません。").as_errors());
+        }
+        if min_copies.is_some() && older_than_days.is_none() {
+            return Err(
+                log::make_error!("--min-copiesには--older-thanも指定してください。").as_errors(),
+            );
+        }
+        if plan_period_days == 0 || plan_interval_days == 0 {
+            return Err(
+                log::make_error!("--periodと--intervalには1日以上を指定してください。").as_errors(),
+            );
+        }
+        if scope.is_some() && command != Command::Calc && command != Command::Verify {
+            return Err(
+                log::make_error!("--pathはハッシュ計算と検証でのみ指定できます。").as_errors(),
+            );
+        }
+        if alternate_streams && command != Command::Calc && command != Command::Verify {
+            return Err(
+                log::make_error!("--streamsはハッシュ計算と検証でのみ指定できます。").as_errors(),
+            );
+        }
+        if setting_options.contains_key(settings::ALGORITHM.name)
+            && ![
+                Command::Calc,
+                Command::Hash,
+                Command::Copy,
+                Command::CompareDirs,
+                Command::ImportSums,
+            ]
+            .contains(&command)
+        {
+            return Err(log::make_error!(
+                "--algoはcalc、hash、copy、compare-dirs、import-sumsでのみ指定できます。"
+            )
+            .as_errors());
+        }
+        if setting_options.contains_key(settings::EXTRA_ALGORITHMS.name)
+            && command != Command::Calc
+            && command != Command::Retry
+        {
+            return Err(
+                log::make_error!("--extra-algosはハッシュ計算とretryでのみ指定できます。")
+                    .as_errors(),
+            );
+        }
+        if setting_options.contains_key(settings::CHUNKED_THRESHOLD.name)
+            && ![Command::Calc, Command::Verify, Command::Retry].contains(&command)
+        {
+            return Err(log::make_error!(
+                "--chunked-thresholdはハッシュ計算、検証、retryでのみ指定できます。"
+            )
+            .as_errors());
+        }
+        if new_disk_id.is_some() && command != Command::PostRestore {
+            return Err(log::make_error!("--new-idはpost-restoreでのみ指定できます。").as_errors());
+        }
+        if (init_group.is_some() || disk_label.is_some()) && command != Command::Init {
+            return Err(log::make_error!("--groupと--labelはinitでのみ指定できます。").as_errors());
+        }
+        if mount_folder.is_some() && command != Command::ImportScrub {
+            return Err(log::make_error!("--mountはimport-scrubでのみ指定できます。").as_errors());
+        }
+        if dry_run && command != Command::Calc {
+            return Err(
+                log::make_error!("--dry-runはハッシュ計算でのみ指定できます。").as_errors(),
+            );
+        }
+        // ハッシュ計算の一覧はJSONでも出力できる
+        if dry_run && output_format.is_some() && output_format != Some(OutputFormat::Json) {
+            return Err(
+                log::make_error!("--dry-runの--output-formatはjsonのみ指定できます。").as_errors(),
+            );
+        }
+        if output_format.is_some() && command != Command::Verify && !dry_run {
+            return Err(log::make_error!("--output-formatは検証でのみ指定できます。").as_errors());
+        }
+        if coreutils_output && command != Command::Calc {
+            return Err(log::make_error!(
+                "--output-format coreutilsはハッシュ計算でのみ指定できます。"
+            )
+            .as_errors());
+        }
+        if progress_format != ProgressFormat::Text
+            && command != Command::Calc
+            && command != Command::Verify
+            && command != Command::Retry
+        {
+            return Err(log::make_error!(
+                "--progress-formatはハッシュ計算、検証、retryでのみ指定できます。"
+            )
+            .as_errors());
+        }
+        if no_tui
+            && command != Command::Calc
+            && command != Command::Verify
+            && command != Command::Retry
+            && command != Command::Watch
+        {
+            return Err(log::make_error!(
+                "--no-tuiはハッシュ計算、検証、retry、watchでのみ指定できます。"
+            )
+            .as_errors());
+        }
+        // どちらも標準出力に出力するので同時には指定できない
+        if progress_format == ProgressFormat::Json && output_format.is_some() {
+            return Err(log::make_error!(
+                "--progress-format jsonと--output-formatは同時に指定できません。"
+            )
+            .as_errors());
+        }
+        if no_merge && command != Command::Calc && command != Command::Watch {
+            return Err(
+                log::make_error!("--no-mergeはハッシュ計算とwatchでのみ指定できます。").as_errors(),
+            );
+        }
+        if (poll_interval.is_some() || settle.is_some()) && command != Command::Watch {
+            return Err(
+                log::make_error!("--pollと--settleはwatchでのみ指定できます。").as_errors(),
+            );
+        }
+        // 監視では確認のたびに計算するので、全速力の確認を求められない
+        if full_speed && command == Command::Watch {
+            return Err(log::make_error!("--full-speedはwatchでは指定できません。").as_errors());
+        }
+        // 監視では書き込み中のファイルを計算しないよう、指定がなくても更新されたばかりのファイルを待つ
+        if command == Command::Watch && settle.is_none() {
+            settle = Some(DEFAULT_SETTLE);
+        }
+        if update_renamed && command != Command::Verify {
+            return Err(log::make_error!("--update-renamedは検証でのみ指定できます。").as_errors());
+        }
+        if quota && command != Command::Verify {
+            return Err(log::make_error!("--quotaは検証でのみ指定できます。").as_errors());
+        }
+        if report_only && command != Command::Prune {
+            return Err(log::make_error!("--report-onlyはpruneでのみ指定できます。").as_errors());
+        }
+        if read_only && command != Command::Calc && command != Command::Verify {
+            return Err(
+                log::make_error!("--read-onlyはハッシュ計算と検証でのみ指定できます。").as_errors(),
+            );
+        }
+        if max_duration.is_some()
+            && command != Command::Calc
+            && command != Command::Verify
+            && command != Command::Retry
+        {
+            return Err(log::make_error!(
+                "--max-durationはハッシュ計算、検証、retryでのみ指定できます。"
+            )
+            .as_errors());
+        }
+        if summary
+            && command != Command::Calc
+            && command != Command::Verify
+            && command != Command::Retry
+        {
+            return Err(log::make_error!(
+                "--summaryはハッシュ計算、検証、retryでのみ指定できます。"
+            )
+            .as_errors());
+        }
+        if verify_after_calc.is_some() && command != Command::Calc && command != Command::Retry {
+            return Err(log::make_error!(
+                "--verify-after-calcはハッシュ計算とretryでのみ指定できます。"
+            )
+            .as_errors());
+        }
+        if summary && (read_only || dry_run) {
+            return Err(log::make_error!(
+                "--summaryは--read-onlyと--dry-runと同時に指定できません。"
+            )
+            .as_errors());
         }
         // BCBCHOMEから各パスを求める
-        let home_folder = require_env(&envs, "BCBCHOME")?;
+        let home_folder = match envs.get("BCBCHOME") {
+            Some(home_folder) => home_folder,
+            None => {
+                return Err(log::make_error!(
+                    "環境変数BCBCHOMEが設定されていません。初めて使う場合はbcbc setupで初期設定を作成してください。"
+                )
+                .as_errors())
+            }
+        };
         let home_folder = tilde_to_home(PathBuf::from(home_folder));
-        let output_folder = home_folder.join("out");
-        let config_folder = home_folder.join("configs");
+        // 停止ファイルは名前空間に関係なく、BCBCHOMEを使う全ての実行を停止する
+        let stop_filepath = home_folder.join("stop");
+        let (output_folder, config_folder, registry_filepath) = match &namespace {
+            None => (
+                home_folder.join("out"),
+                home_folder.join("configs"),
+                home_folder.join("registry"),
+            ),
+            Some(namespace) => namespace_paths(home_folder.as_path(), namespace)?,
+        };
+        // 設定フォルダの設定ファイル、環境変数、オプションの順に優先して設定を決める
+        let settings = Settings::load(config_folder.as_path(), &envs, &setting_options)?;
+        let output_folder = match settings.get(&settings::OUTPUT_FOLDER) {
+            Some(output_folder) => tilde_to_home(PathBuf::from(output_folder)),
+            None => output_folder,
+        };
+        let registry_filepath = match settings.get(&settings::REGISTRY) {
+            Some(registry_filepath) => tilde_to_home(PathBuf::from(registry_filepath)),
+            None => registry_filepath,
+        };
+        let algorithm = settings.algorithm(&settings::ALGORITHM)?;
+        let extra_algorithms = settings.algorithms(&settings::EXTRA_ALGORITHMS)?;
+        let disks = settings
+            .positive_number(&settings::DISKS)?
+            .map(|disks| disks as usize);
+        let workers = settings
+            .positive_number(&settings::WORKERS)?
+            .map(|workers| workers as usize);
+        let buffer_size = settings
+            .positive_number(&settings::BUFFER_SIZE)?
+            .map(|megabytes| (megabytes as usize) << 20);
+        let chunked_threshold = settings
+            .positive_number(&settings::CHUNKED_THRESHOLD)?
+            .map(|megabytes| megabytes << 20);
+        let memory_limit = settings
+            .positive_number(&settings::MEMORY_LIMIT)?
+            .map(|megabytes| megabytes << 20);
+        let retry_policy = RetryPolicy {
+            retries: settings
+                .number(&settings::RETRIES)?
+                .unwrap_or(retry::DEFAULT_RETRIES),
+            delay: Duration::from_secs(
+                settings
+                    .number(&settings::RETRY_DELAY)?
+                    .unwrap_or(retry::DEFAULT_RETRY_DELAY_SECONDS),
+            ),
+        };
+        let fixed_time = settings.datetime(&settings::FIXED_TIME)?;
+        let heartbeat_seconds = settings
+            .positive_number(&settings::HEARTBEAT)?
+            .unwrap_or(DEFAULT_HEARTBEAT_SECONDS);
+        let listen_address = settings
+            .get(&settings::LISTEN)
+            .unwrap_or(DEFAULT_LISTEN_ADDRESS)
+            .to_string();
+        let skip_rules = settings.skip_rules(&settings::SKIP)?;
+        let language = settings
+            .language(&settings::LANG)?
+            .unwrap_or(Language::Japanese);
+        let path_normalizer = settings.path_normalizer(&settings::NORMALIZE)?;
+        let symlink_policy = settings.symlink_policy(&settings::SYMLINKS)?;
+        let hash_storage = settings.hash_storage(&settings::STORAGE)?;
+        let filter_profile = settings
+            .get(&settings::FILTER_PROFILE)
+            .map(|filter_profile| filter_profile.to_string());
+        // グループごとの設定を決める
+        let mut group_settings = HashMap::new();
+        for group in settings.groups() {
+            let group_output_folder = match settings.group_get(group, &settings::OUTPUT_FOLDER) {
+                Some(folder) => Some(group_output_folder(output_folder.as_path(), folder)?),
+                None => None,
+            };
+            group_settings.insert(
+                group,
+                GroupSettings {
+                    output_folder: group_output_folder,
+                    algorithm: settings.group_algorithm(group, &settings::ALGORITHM)?,
+                    filter_profile: settings
+                        .group_get(group, &settings::FILTER_PROFILE)
+                        .map(|filter_profile| filter_profile.to_string()),
+                },
+            );
+        }
 
         Ok(RunOptions {
             current_folder,
             output_folder,
             config_folder,
+            registry_filepath,
+            stop_filepath,
+            namespace,
+            command,
+            operands,
             disk_roots,
+            discovery_folders,
+            pattern_files,
+            filter_profile,
+            only_disk_ids,
+            excluded_disk_ids,
+            read_only,
+            fix_list_folder,
+            preferred_group,
+            heartbeat_seconds,
+            event_filepath,
+            listen_address,
+            skip_rules,
+            language,
+            path_normalizer,
+            symlink_policy,
+            hash_storage,
+            older_than_days,
+            newer_than_days,
+            min_copies,
+            copy_group,
+            plan_period_days,
+            plan_interval_days,
+            window_hours,
+            max_duration,
+            poll_interval: poll_interval.unwrap_or(DEFAULT_POLL_INTERVAL),
+            settle,
+            summary,
+            verify_after_calc,
+            smart,
+            full_speed,
+            rebuild,
+            no_merge,
+            update_renamed,
+            quota,
+            report_only,
+            dry_run,
+            scope,
+            alternate_streams,
+            base_url,
+            init_group,
+            disk_label,
+            mount_folder,
+            new_disk_id,
+            verify,
+            output_format,
+            coreutils_output,
+            progress_format,
+            no_tui,
+            algorithm,
+            extra_algorithms,
+            disks,
+            workers,
+            buffer_size,
+            chunked_threshold,
+            memory_limit,
+            retry_policy,
+            fixed_time,
+            group_settings,
+            stream_disk_id,
+            stream_pseudo_path,
         })
     }
 
@@ -46,6 +954,11 @@ impl RunOptions {
         self.current_folder.as_path()
     }
 
+    /// 名前空間を返す。
+    pub fn namespace(&self) -> Option<&str> {
+        self.namespace.as_deref()
+    }
+
     /// 出力フォルダのパスを返す。
     pub fn output_folder(&self) -> &Path {
         self.output_folder.as_path()
@@ -56,26 +969,877 @@ impl RunOptions {
         self.config_folder.as_path()
     }
 
+    /// 停止ファイルのパスを返す。
+    pub fn stop_filepath(&self) -> &Path {
+        self.stop_filepath.as_path()
+    }
+
+    /// ディスクレジストリファイルのパスを返す。
+    pub fn registry_filepath(&self) -> &Path {
+        self.registry_filepath.as_path()
+    }
+
+    /// サブコマンドを返す。
+    pub fn command(&self) -> Command {
+        self.command
+    }
+
     /// ディスクルート一覧を返す。
     pub fn disk_roots(&self) -> &Vec<PathBuf> {
         &self.disk_roots
     }
+
+    /// diskファイルを探索するフォルダ一覧を返す。
+    pub fn discovery_folders(&self) -> &Vec<PathBuf> {
+        &self.discovery_folders
+    }
+
+    /// パターンファイル一覧を返す。
+    pub fn pattern_files(&self) -> &Vec<PatternFile> {
+        &self.pattern_files
+    }
+
+    /// 種類で対象外にするファイルを返す。
+    pub fn skip_rules(&self) -> SkipRules {
+        self.skip_rules
+    }
+
+    /// メッセージの言語を返す。
+    pub fn language(&self) -> Language {
+        self.language
+    }
+
+    /// ハッシュ計算と検証の実行時間の上限を返す。
+    pub fn max_duration(&self) -> Option<Duration> {
+        self.max_duration
+    }
+
+    /// 監視でディスクを確認する間隔を返す。
+    pub fn poll_interval(&self) -> Duration {
+        self.poll_interval
+    }
+
+    /// 監視で計算を待つ、更新されてからの時間を返す。
+    /// 監視以外ではNoneを返す。
+    pub fn settle(&self) -> Option<Duration> {
+        self.settle
+    }
+
+    /// ハッシュ計算と検証の集計をJSONのレポートにも保存するかを返す。
+    pub fn summary(&self) -> bool {
+        self.summary
+    }
+
+    /// 書き込み直後の検証で読み込み直すファイルの割合(%)を返す。
+    /// 指定されていなければNoneを返す。
+    pub fn verify_after_calc(&self) -> Option<u64> {
+        self.verify_after_calc
+    }
+
+    /// パスの正規化の手順を返す。
+    pub fn path_normalizer(&self) -> &PathNormalizer {
+        &self.path_normalizer
+    }
+
+    /// シンボリックリンクの扱いを返す。
+    pub fn symlink_policy(&self) -> SymlinkPolicy {
+        self.symlink_policy
+    }
+
+    /// ハッシュ情報の保存先を返す。
+    pub fn hash_storage(&self) -> HashStorage {
+        self.hash_storage
+    }
+
+    /// ライブラリの利用者が登録したパスの変換を正規化の手順に追加する。
+    pub fn add_path_normalizers(&mut self, steps: &[CustomStep]) {
+        self.path_normalizer = self.path_normalizer.clone().with_custom_steps(steps);
+    }
+
+    /// フィルタープロファイル名を返す。
+    pub fn filter_profile(&self) -> Option<&str> {
+        self.filter_profile.as_deref()
+    }
+
+    /// グループのフィルタープロファイル名を返す。
+    pub fn filter_profile_of(&self, group: char) -> Option<&str> {
+        self.group_settings
+            .get(&group)
+            .and_then(|group_settings| group_settings.filter_profile.as_deref())
+            .or(self.filter_profile())
+    }
+
+    /// グループのハッシュアルゴリズムを返す。
+    pub fn algorithm_of(&self, group: char) -> Option<HashAlgorithm> {
+        self.group_settings
+            .get(&group)
+            .and_then(|group_settings| group_settings.algorithm)
+            .or(self.algorithm)
+    }
+
+    /// グループの出力フォルダのパスを返す。
+    /// グループごとの出力フォルダが設定されていなければ出力フォルダを返す。
+    pub fn output_folder_of(&self, group: char) -> &Path {
+        self.group_settings
+            .get(&group)
+            .and_then(|group_settings| group_settings.output_folder.as_deref())
+            .unwrap_or(self.output_folder())
+    }
+
+    /// 出力フォルダとグループごとの出力フォルダの一覧を返す。
+    pub fn output_folders(&self) -> Vec<&Path> {
+        let mut output_folders = vec![self.output_folder()];
+        for group in self.configured_groups() {
+            let output_folder = self.output_folder_of(group);
+            if !output_folders.contains(&output_folder) {
+                output_folders.push(output_folder);
+            }
+        }
+        output_folders
+    }
+
+    /// グループごとの設定があるグループの一覧を返す。
+    pub fn configured_groups(&self) -> Vec<char> {
+        let mut groups: Vec<char> = self.group_settings.keys().copied().collect();
+        groups.sort();
+        groups
+    }
+
+    /// 処理するディスクのID一覧を返す。
+    pub fn only_disk_ids(&self) -> &Vec<String> {
+        &self.only_disk_ids
+    }
+
+    /// 処理しないディスクのID一覧を返す。
+    pub fn excluded_disk_ids(&self) -> &Vec<String> {
+        &self.excluded_disk_ids
+    }
+
+    /// 読み取り専用モードであるかを返す。
+    pub fn read_only(&self) -> bool {
+        self.read_only
+    }
+
+    /// 出力フォルダなどに書き込めない場合に、読み取り専用モードに切り替える。
+    pub fn fall_back_to_read_only(&mut self) {
+        self.read_only = true;
+    }
+
+    /// SMART情報を取得するかを返す。
+    pub fn smart(&self) -> bool {
+        self.smart
+    }
+
+    /// 全速力で計算するかを返す。
+    pub fn full_speed(&self) -> bool {
+        self.full_speed
+    }
+
+    /// ハッシュ計算の範囲を返す。
+    pub fn scope(&self) -> Option<&Path> {
+        self.scope.as_deref()
+    }
+
+    /// 代替データストリームも計算するかを返す。
+    pub fn alternate_streams(&self) -> bool {
+        self.alternate_streams
+    }
+
+    /// 統合ハッシュファイルを作り直すかを返す。
+    pub fn rebuild(&self) -> bool {
+        self.rebuild
+    }
+
+    /// ハッシュ計算の後に統合ハッシュファイルを作り直さないかを返す。
+    pub fn no_merge(&self) -> bool {
+        self.no_merge
+    }
+
+    /// 検証で見つかった移動したファイルのパスをハッシュファイルで書き換えるかを返す。
+    pub fn update_renamed(&self) -> bool {
+        self.update_renamed
+    }
+
+    /// 検証で、検証計画の1回の読み込み量だけを検証する場合に、検証計画の条件を返す。
+    pub fn verify_quota(&self) -> Option<VerificationPlan> {
+        match self.command {
+            Command::Verify if self.quota => Some(self.verification_plan()),
+            _ => None,
+        }
+    }
+
+    /// ディスクにないファイルの行を削除せずに報告だけを行うかを返す。
+    pub fn report_only(&self) -> bool {
+        self.report_only
+    }
+
+    /// ハッシュ計算するファイルの一覧だけを出力するかを返す。
+    pub fn dry_run(&self) -> bool {
+        self.dry_run
+    }
+
+    /// コピー先を検証するかを返す。
+    pub fn verify(&self) -> bool {
+        self.verify
+    }
+
+    /// 検証の差異を標準出力に出力する形式を返す。
+    pub fn output_format(&self) -> Option<OutputFormat> {
+        self.output_format
+    }
+
+    /// ハッシュファイルをmd5sum互換の形式でも出力するかを返す。
+    pub fn coreutils_output(&self) -> bool {
+        self.coreutils_output
+    }
+
+    /// 進捗状況の出力形式を返す。
+    pub fn progress_format(&self) -> ProgressFormat {
+        self.progress_format
+    }
+
+    /// 端末でも進捗状況を端末表示にせずログに出力するかを返す。
+    pub fn no_tui(&self) -> bool {
+        self.no_tui
+    }
+
+    /// 出力フォルダのハッシュファイルなどを変更する処理かを返す。
+    /// 問い合わせサーバーは常駐するので、他の処理を妨げないよう含めない。
+    pub fn modifies_output(&self) -> bool {
+        match self.command {
+            Command::Calc => !self.read_only && !self.dry_run,
+            // 移動したファイルのパスを書き換えなくても、検証日時の記録や集計レポートを書き込む
+            Command::Verify => !self.read_only,
+            Command::Copy => self.verify,
+            Command::Hash => self.stream_disk_id.is_some(),
+            Command::Sync
+            | Command::RestoreTrimmed
+            | Command::Seal
+            | Command::Merge
+            | Command::Dedup
+            | Command::Tag
+            | Command::Untag
+            | Command::Clean
+            | Command::ImportSums
+            | Command::PostRestore
+            | Command::Retry => true,
+            Command::Prune => !self.report_only,
+            _ => false,
+        }
+    }
+
+    /// 標準出力を機械処理用の出力に使うかを返す。
+    pub fn uses_stdout_for_output(&self) -> bool {
+        self.output_format.is_some()
+            || self.progress_format == ProgressFormat::Json
+            || self.report_only
+            || self.dry_run
+            || self.command == Command::Dupes
+            || self.command == Command::Disks
+    }
+
+    /// 指定されたハッシュアルゴリズムを返す。
+    pub fn algorithm(&self) -> Option<HashAlgorithm> {
+        self.algorithm
+    }
+
+    /// 追加で計算するハッシュアルゴリズムを返す。
+    pub fn extra_algorithms(&self) -> &[HashAlgorithm] {
+        &self.extra_algorithms
+    }
+
+    /// 同時にハッシュ計算するディスクの数を返す。
+    pub fn disks(&self) -> Option<usize> {
+        self.disks
+    }
+
+    /// 1台のディスクで同時にハッシュ計算するファイルの数を返す。
+    pub fn workers(&self) -> Option<usize> {
+        self.workers
+    }
+
+    /// 指定された読み込み用のバッファのバイト数を返す。
+    pub fn buffer_size(&self) -> Option<usize> {
+        self.buffer_size
+    }
+
+    /// 塊を並行して計算するファイルのバイト数の下限を返す。
+    pub fn chunked_threshold(&self) -> Option<u64> {
+        self.chunked_threshold
+    }
+
+    /// 指定されたメモリ使用量の上限のバイト数を返す。
+    pub fn memory_limit(&self) -> Option<u64> {
+        self.memory_limit
+    }
+
+    /// 読み込みに失敗したファイルの再試行の方針を返す。
+    pub fn retry_policy(&self) -> RetryPolicy {
+        self.retry_policy
+    }
+
+    /// 決定的モードで使う固定の日時を返す。
+    pub fn fixed_time(&self) -> Option<NaiveDateTime> {
+        self.fixed_time
+    }
+
+    /// 標準入力などの入力一覧を返す。
+    pub fn stream_inputs(&self) -> &Vec<String> {
+        &self.operands
+    }
+
+    /// 標準入力などのハッシュの記録先を返す。
+    pub fn stream_target(&self) -> Option<StreamTarget<'_>> {
+        match (&self.stream_disk_id, &self.stream_pseudo_path) {
+            (Some(disk_id), Some(pseudo_path)) => Some(StreamTarget {
+                disk_id: disk_id.as_str(),
+                pseudo_path: pseudo_path.as_str(),
+            }),
+            _ => None,
+        }
+    }
+
+    /// 修正リストの出力先フォルダを返す。
+    pub fn fix_list_folder(&self) -> Option<&Path> {
+        self.fix_list_folder.as_deref()
+    }
+
+    /// 比較で正しいとみなすグループを返す。
+    pub fn preferred_group(&self) -> Option<char> {
+        self.preferred_group
+    }
+
+    /// 端末以外に出力する場合の進捗状況の出力間隔の秒数を返す。
+    pub fn heartbeat_seconds(&self) -> u64 {
+        self.heartbeat_seconds
+    }
+
+    /// イベントログファイルのパスを返す。
+    pub fn event_filepath(&self) -> Option<&Path> {
+        self.event_filepath.as_deref()
+    }
+
+    /// 問い合わせサーバーが待ち受けるアドレスを返す。
+    pub fn listen_address(&self) -> &str {
+        self.listen_address.as_str()
+    }
+
+    /// 保存状況の監査の方針を返す。
+    pub fn retention_policy(&self) -> RetentionPolicy {
+        RetentionPolicy {
+            older_than_days: self.older_than_days,
+            newer_than_days: self.newer_than_days,
+            min_copies: self.min_copies.zip(self.copy_group),
+        }
+    }
+
+    /// 検証で、最後に検証してからこの日数が経ったファイルだけを検証する場合に、その日数を返す。
+    pub fn verify_older_than_days(&self) -> Option<u64> {
+        match self.command {
+            Command::Verify => self.older_than_days,
+            _ => None,
+        }
+    }
+
+    /// 検証計画の条件を返す。
+    pub fn verification_plan(&self) -> VerificationPlan {
+        VerificationPlan {
+            period_days: self.plan_period_days,
+            interval_days: self.plan_interval_days,
+            window_hours: self.window_hours,
+        }
+    }
+
+    /// 検証計画を作成するディスクのID一覧を返す。
+    pub fn plan_disk_ids(&self) -> &Vec<String> {
+        &self.operands
+    }
+
+    /// 封印するディスクのID一覧を返す。
+    pub fn seal_disk_ids(&self) -> &Vec<String> {
+        &self.operands
+    }
+
+    /// 読み込み速度の履歴を表示するディスクのID一覧を返す。
+    pub fn throughput_disk_ids(&self) -> &Vec<String> {
+        &self.operands
+    }
+
+    /// 重複した行を削除するディスクのID一覧を返す。
+    pub fn dedup_disk_ids(&self) -> &Vec<String> {
+        &self.operands
+    }
+
+    /// タグを付ける対象を"ディスクID:パス"の形式で返す。
+    pub fn tag_target(&self) -> &str {
+        self.operands[0].as_str()
+    }
+
+    /// 付けるか外すタグを返す。
+    pub fn tag(&self) -> Option<&str> {
+        self.operands.get(1).map(|tag| tag.as_str())
+    }
+
+    /// タグの一覧を表示するディスクのID一覧を返す。
+    pub fn tags_disk_ids(&self) -> &Vec<String> {
+        &self.operands
+    }
+
+    /// HTMLファイルに出力するディスクIDかグループと、出力先のフォルダを返す。
+    pub fn export_html_target(&self) -> (&str, &Path) {
+        (self.operands[0].as_str(), self.disk_roots[1].as_path())
+    }
+
+    /// ラベルを作成するディスクのID一覧を返す。
+    pub fn label_disk_ids(&self) -> &Vec<String> {
+        &self.operands
+    }
+
+    /// ラベルのQRコードに使う問い合わせサーバーのURLを返す。
+    pub fn base_url(&self) -> Option<&str> {
+        self.base_url.as_deref()
+    }
+
+    /// diskファイルを作成するディスクのルート、グループ、ラベルを返す。
+    /// グループが指定されなければAグループとする。
+    pub fn init_target(&self) -> (&Path, char, Option<&str>) {
+        (
+            self.disk_roots[0].as_path(),
+            self.init_group.unwrap_or('A'),
+            self.disk_label.as_deref(),
+        )
+    }
+
+    /// 照合するスクラブのレポートのファイルを返す。
+    pub fn scrub_report_filepath(&self) -> &Path {
+        self.disk_roots[0].as_path()
+    }
+
+    /// 故障したディスクのIDと、復元したディスクのルートを返す。
+    pub fn post_restore_target(&self) -> (&str, &Path) {
+        (self.operands[0].as_str(), self.disk_roots[1].as_path())
+    }
+
+    /// checkで検証するファイルの一覧を返す。
+    pub fn check_filepaths(&self) -> &Vec<PathBuf> {
+        &self.disk_roots
+    }
+
+    /// 復元したディスクに割り当てるディスクIDを返す。
+    pub fn new_disk_id(&self) -> Option<&str> {
+        self.new_disk_id.as_deref()
+    }
+
+    /// btrfsのスクラブのレポートのパスの起点にするマウント先を返す。
+    pub fn mount_folder(&self) -> Option<&Path> {
+        self.mount_folder.as_deref()
+    }
+
+    /// 削除した行の保存ファイル一覧を返す。
+    pub fn trimmed_filepaths(&self) -> &Vec<PathBuf> {
+        &self.disk_roots
+    }
+
+    /// 取り込むmd5sum互換のファイルと、取り込み先のディスクIDを返す。
+    pub fn import_sums_target(&self) -> (&Path, &str) {
+        (self.disk_roots[0].as_path(), self.operands[1].as_str())
+    }
+
+    /// 取り込み元の出力フォルダを返す。
+    pub fn sync_source(&self) -> &Path {
+        self.disk_roots[0].as_path()
+    }
+
+    /// 比較する2つのフォルダを返す。
+    pub fn compared_dirs(&self) -> (&Path, &Path) {
+        (self.disk_roots[0].as_path(), self.disk_roots[1].as_path())
+    }
+
+    /// コピー元と1つ以上のコピー先のフォルダを返す。
+    pub fn copy_folders(&self) -> (&Path, &[PathBuf]) {
+        (self.disk_roots[0].as_path(), &self.disk_roots[1..])
+    }
+
+    /// 比較する2つのハッシュファイルの指定を返す。
+    pub fn diff_targets(&self) -> (&str, &str) {
+        (self.operands[0].as_str(), self.operands[1].as_str())
+    }
+
+    /// 容量を集計するグループの一覧を返す。
+    pub fn usage_groups(&self) -> Vec<char> {
+        self.operands
+            .iter()
+            .map(|operand| operand.chars().next().unwrap())
+            .collect()
+    }
+
+    /// 同じ内容のファイルを一覧にするグループを返す。
+    pub fn dupes_groups(&self) -> Vec<char> {
+        self.operands
+            .iter()
+            .map(|operand| operand.chars().next().unwrap())
+            .collect()
+    }
+
+    /// 比較する2つのグループを返す。
+    pub fn compared_groups(&self) -> (char, char) {
+        let mut groups = self
+            .operands
+            .iter()
+            .map(|operand| operand.chars().next().unwrap());
+        (groups.next().unwrap(), groups.next().unwrap())
+    }
+}
+
+/// サブコマンドに対して引数が正しいか確認する。
+fn check_operands(command: Command, operands: &Vec<String>) -> Result<(), Errors> {
+    match command {
+        Command::ImportSums => {
+            if operands.len() != 2 {
+                return Err(log::make_error!(
+                    "import-sumsには取り込むファイルと取り込み先のディスクIDを指定してください。"
+                )
+                .as_errors());
+            }
+            parse_disk_id_list("import-sums", &operands[1]).map(|_| ())
+        }
+        Command::PostRestore => {
+            if operands.len() != 2 {
+                return Err(log::make_error!(
+                    "post-restoreには故障したディスクのIDと復元したディスクのルートを指定してください。"
+                )
+                .as_errors());
+            }
+            parse_disk_id_list("post-restore", &operands[0]).map(|_| ())
+        }
+        Command::Init if operands.len() != 1 => Err(log::make_error!(
+            "initにはdiskファイルを作成するディスクのルートを1つ指定してください。"
+        )
+        .as_errors()),
+        Command::ImportScrub if operands.len() != 1 => Err(log::make_error!(
+            "import-scrubにはスクラブのレポートのファイルを1つ指定してください。"
+        )
+        .as_errors()),
+        Command::Sync if operands.len() != 1 => Err(log::make_error!(
+            "syncには取り込み元の出力フォルダを1つ指定してください。"
+        )
+        .as_errors()),
+        Command::RestoreTrimmed if operands.len() == 0 => Err(log::make_error!(
+            "restore-trimmedには削除した行の保存ファイルを指定してください。"
+        )
+        .as_errors()),
+        Command::Serve if operands.len() > 0 => {
+            Err(log::make_error!("serveには引数を指定できません。").as_errors())
+        }
+        Command::Merge if operands.len() > 0 => {
+            Err(log::make_error!("mergeには引数を指定できません。").as_errors())
+        }
+        Command::Clean if operands.len() > 0 => {
+            Err(log::make_error!("cleanには引数を指定できません。").as_errors())
+        }
+        Command::Seal => {
+            if operands.len() == 0 {
+                return Err(
+                    log::make_error!("sealには封印するディスクIDを指定してください。").as_errors(),
+                );
+            }
+            for operand in operands {
+                parse_disk_id_list("seal", operand)?;
+            }
+            Ok(())
+        }
+        Command::Diff if operands.len() != 2 => Err(log::make_error!(
+            "diffには比較するグループ名、ディスクID、ハッシュファイルを2つ指定してください。"
+        )
+        .as_errors()),
+        Command::CompareDirs if operands.len() != 2 => Err(log::make_error!(
+            "compare-dirsには比較するフォルダを2つ指定してください。"
+        )
+        .as_errors()),
+        Command::Check if operands.len() == 0 => {
+            Err(log::make_error!("checkには検証するファイルを指定してください。").as_errors())
+        }
+        Command::Hash if operands.len() == 0 => Err(log::make_error!(
+            "hashには入力を指定してください。標準入力なら\"-\"を指定してください。"
+        )
+        .as_errors()),
+        Command::Copy if operands.len() < 2 => Err(log::make_error!(
+            "copyにはコピー元と1つ以上のコピー先のフォルダを指定してください。"
+        )
+        .as_errors()),
+        Command::Throughput => {
+            for operand in operands {
+                parse_disk_id_list("throughput", operand)?;
+            }
+            Ok(())
+        }
+        Command::Dedup => {
+            for operand in operands {
+                parse_disk_id_list("dedup", operand)?;
+            }
+            Ok(())
+        }
+        Command::Plan => {
+            for operand in operands {
+                parse_disk_id_list("plan", operand)?;
+            }
+            Ok(())
+        }
+        Command::Tags => {
+            for operand in operands {
+                parse_disk_id_list("tags", operand)?;
+            }
+            Ok(())
+        }
+        Command::Label => {
+            if operands.len() == 0 {
+                return Err(log::make_error!("labelにはディスクIDを指定してください。").as_errors());
+            }
+            for operand in operands {
+                parse_disk_id_list("label", operand)?;
+            }
+            Ok(())
+        }
+        Command::ExportHtml => {
+            if operands.len() != 2 {
+                return Err(log::make_error!(
+                    "export-htmlにはディスクIDかグループと、出力先のフォルダを指定してください。"
+                )
+                .as_errors());
+            }
+            if !disk::DISK_ID_PATTERN.is_match(&operands[0]) {
+                parse_disk_group("export-html", &operands[0])?;
+            }
+            Ok(())
+        }
+        Command::Tag if operands.len() != 2 => Err(log::make_error!(
+            "tagには\"ディスクID:パス\"とタグを指定してください。"
+        )
+        .as_errors()),
+        Command::Untag if operands.len() != 1 && operands.len() != 2 => Err(log::make_error!(
+            "untagには\"ディスクID:パス\"と、外すタグを指定してください。"
+        )
+        .as_errors()),
+        Command::Tag | Command::Untag => TagTarget::parse(&operands[0]).map(|_| ()),
+        Command::Compare => {
+            if operands.len() != 2 {
+                return Err(
+                    log::make_error!("compareには比較するグループを2つ指定してください。")
+                        .as_errors(),
+                );
+            }
+            for operand in operands {
+                parse_disk_group("compare", operand)?;
+            }
+            Ok(())
+        }
+        Command::Usage => {
+            for operand in operands {
+                parse_disk_group("usage", operand)?;
+            }
+            Ok(())
+        }
+        Command::Dupes => {
+            for operand in operands {
+                parse_disk_group("dupes", operand)?;
+            }
+            Ok(())
+        }
+        _ => Ok(()),
+    }
 }
 
-/// 環境変数マップから指定された環境変数を取得する。
-/// 変数がない場合はエラーを返す。
-fn require_env<'a>(
-    envs: &'a HashMap<String, String>,
-    env_name: &str,
-) -> Result<&'a String, Errors> {
-    match envs.get(env_name) {
-        Some(env_value) => Ok(env_value),
-        None => Err(log::make_error!("環境変数{}が設定されていません。", env_name).as_errors()),
+/// ディスクのグループ名をパースする。
+fn parse_disk_group(name: &str, value: &str) -> Result<char, Errors> {
+    let mut chars = value.chars();
+    match (chars.next(), chars.next()) {
+        (Some(disk_group), None) if disk_group.is_ascii_uppercase() => Ok(disk_group),
+        _ => {
+            Err(log::make_error!("{}の値がグループ名ではありません。: {}", name, value).as_errors())
+        }
+    }
+}
+
+/// 差異の出力形式のオプションの値をパースする。
+fn parse_output_format(name: &str, value: &str) -> Result<OutputFormat, Errors> {
+    match OutputFormat::from_name(value) {
+        Some(output_format) => Ok(output_format),
+        None => Err(log::make_error!(
+            "{}の値はjson、tap、coreutilsのいずれかを指定してください。: {}",
+            name,
+            value
+        )
+        .as_errors()),
+    }
+}
+
+/// 進捗状況の出力形式のオプションの値をパースする。
+fn parse_progress_format(name: &str, value: &str) -> Result<ProgressFormat, Errors> {
+    match ProgressFormat::from_name(value) {
+        Some(progress_format) => Ok(progress_format),
+        None => Err(
+            log::make_error!("{}の値はtextかjsonを指定してください。: {}", name, value).as_errors(),
+        ),
+    }
+}
+
+/// グループの出力フォルダのパスを返す。
+/// 名前だけが指定された場合は出力フォルダのサブフォルダとする。
+fn group_output_folder(output_folder: &Path, folder: &str) -> Result<PathBuf, Errors> {
+    let path = tilde_to_home(PathBuf::from(folder));
+    if path.is_absolute() {
+        return Ok(path);
+    }
+
+    // 出力フォルダの他のサブフォルダと重ならない名前に限る
+    if !NAMESPACE_PATTERN.is_match(folder) || RESERVED_NAMESPACES.contains(&folder) {
+        return Err(
+            log::make_error!("グループの出力フォルダの名前に使えません。: {}", folder).as_errors(),
+        );
+    }
+
+    Ok(output_folder.join(folder))
+}
+
+/// 名前空間の出力フォルダ、設定フォルダ、ディスクレジストリファイルのパスを返す。
+/// 名前空間の設定フォルダがなければ共通の設定フォルダを使う。
+fn namespace_paths(
+    home_folder: &Path,
+    namespace: &str,
+) -> Result<(PathBuf, PathBuf, PathBuf), Errors> {
+    if !NAMESPACE_PATTERN.is_match(namespace) || RESERVED_NAMESPACES.contains(&namespace) {
+        return Err(log::make_error!("名前空間の名前に使えません。: {}", namespace).as_errors());
+    }
+
+    let output_folder = home_folder.join("out").join(namespace);
+    let config_folder = home_folder.join("configs").join(namespace);
+    let config_folder = if config_folder.is_dir() {
+        config_folder
+    } else {
+        home_folder.join("configs")
+    };
+    let registry_filepath = home_folder.join(format!("registry-{}", namespace));
+
+    Ok((output_folder, config_folder, registry_filepath))
+}
+
+/// ハッシュ計算の範囲をハッシュファイルのパスと同じ形式にする。
+fn parse_scope(name: &str, value: &str) -> Result<PathBuf, Errors> {
+    match target_file::normalize_relative_path(value) {
+        Some(scope) if scope.as_os_str().len() > 0 => Ok(scope),
+        _ => Err(log::make_error!(
+            "{}にはディスクルートからの相対パスを指定してください。: {}",
+            name,
+            value
+        )
+        .as_errors()),
+    }
+}
+
+/// オプションの値を返す。
+/// "--オプション=値"の形式でなければ次のコマンドライン引数を値とする。
+fn option_value(
+    name: &str,
+    inline_value: Option<String>,
+    args: &mut impl Iterator<Item = String>,
+) -> Result<String, Errors> {
+    match inline_value.or_else(|| args.next()) {
+        Some(value) => Ok(value),
+        None => Err(log::make_error!("オプション{}の値がありません。", name).as_errors()),
+    }
+}
+
+/// 1以上の整数のオプションの値をパースする。
+fn parse_positive_number(name: &str, value: &str) -> Result<u64, Errors> {
+    match value.parse::<u64>() {
+        Ok(number) if number > 0 => Ok(number),
+        _ => Err(log::make_error!(
+            "オプション{}の値が1以上の整数ではありません。: {}",
+            name,
+            value
+        )
+        .as_errors()),
+    }
+}
+
+/// 1から100までの割合(%)をパースする。
+fn parse_percent(name: &str, value: &str) -> Result<u64, Errors> {
+    match value.parse::<u64>() {
+        Ok(percent) if percent > 0 && percent <= 100 => Ok(percent),
+        _ => Err(log::make_error!(
+            "オプション{}の値が1から100までの整数ではありません。: {}",
+            name,
+            value
+        )
+        .as_errors()),
+    }
+}
+
+/// "6h"、"90m"のような時間をパースする。
+/// 単位はd(日)、h(時間)、m(分)、s(秒)で、0より長い時間だけを受け付ける。
+fn parse_duration(name: &str, value: &str) -> Result<Duration, Errors> {
+    let seconds_per_unit = match value.chars().last() {
+        Some('d') => Some(24 * 60 * 60),
+        Some('h') => Some(60 * 60),
+        Some('m') => Some(60),
+        Some('s') => Some(1),
+        _ => None,
+    };
+    let number = value[..value.len().saturating_sub(1)].parse::<u64>();
+    match (seconds_per_unit, number) {
+        (Some(seconds_per_unit), Ok(number)) if number > 0 => {
+            Ok(Duration::from_secs(number * seconds_per_unit))
+        }
+        _ => Err(log::make_error!(
+            "オプション{}の値が時間ではありません。(例: 6h, 90m): {}",
+            name,
+            value
+        )
+        .as_errors()),
+    }
+}
+
+/// "5y"、"6m"、"30d"のような期間をパースして日数を返す。
+/// 単位はy(年)、m(月)、w(週)、d(日)で、1年は365日、1か月は30日とする。
+fn parse_days(name: &str, value: &str) -> Result<u64, Errors> {
+    let days_per_unit = match value.chars().last() {
+        Some('y') => Some(365),
+        Some('m') => Some(30),
+        Some('w') => Some(7),
+        Some('d') => Some(1),
+        _ => None,
+    };
+    let number = value[..value.len().saturating_sub(1)].parse::<u64>();
+    match (days_per_unit, number) {
+        (Some(days_per_unit), Ok(number)) => Ok(number * days_per_unit),
+        _ => Err(log::make_error!(
+            "オプション{}の値が期間ではありません。(例: 5y, 6m, 30d): {}",
+            name,
+            value
+        )
+        .as_errors()),
+    }
+}
+
+/// カンマ区切りのディスクIDの一覧をパースする。
+fn parse_disk_id_list(name: &str, value: &str) -> Result<Vec<String>, Errors> {
+    let mut disk_ids = vec![];
+    for disk_id in value.split(',').map(|disk_id| disk_id.trim()) {
+        if !disk::DISK_ID_PATTERN.is_match(disk_id) {
+            return Err(log::make_error!(
+                "オプション{}の値がディスクIDではありません。: {}",
+                name,
+                disk_id
+            )
+            .as_errors());
+        }
+        disk_ids.push(disk_id.to_string());
     }
+    Ok(disk_ids)
 }
 
 /// 指定されたパスが"~"で始まる場合、ホームフォルダに置き換える。
-fn tilde_to_home(path: PathBuf) -> PathBuf {
+pub(crate) fn tilde_to_home(path: PathBuf) -> PathBuf {
     if path.starts_with("~") {
         let suffix = path.strip_prefix("~").unwrap();
         let home = dirs::home_dir().unwrap();
@@ -0,0 +1,186 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+use serde_json::json;
+
+use crate::atomic_write;
+use crate::clock;
+use crate::log::{self, Errors};
+
+/// 集計レポートのファイル名の日時の形式
+const REPORT_NAME_FORMAT: &str = "%Y%m%d-%H%M%S";
+
+/// ディスクごとのハッシュ計算の集計
+#[derive(Default, Clone)]
+pub struct DiskSummary {
+    /// ハッシュを計算したファイルの数
+    pub files_hashed: usize,
+    /// 読み込んだバイト数
+    pub bytes: u64,
+    /// 読み込みにかかった時間
+    pub elapsed: Duration,
+    /// 計算済みのため読み込まなかったファイルの数
+    pub resume_skipped: usize,
+    /// フィルターで対象外にしたファイルの数
+    pub filter_skipped: usize,
+    /// 読み込めなかったファイルの数
+    pub read_errors: usize,
+    /// ディスクのラベル
+    pub label: Option<String>,
+}
+
+impl DiskSummary {
+    /// JSONに変換する。
+    /// 決定的モードでは所要時間と速度を0にする。
+    fn to_json(&self) -> serde_json::Value {
+        let elapsed = clock::reported_duration(self.elapsed);
+        let mut record = json!({
+            "files_hashed": self.files_hashed,
+            "bytes": self.bytes,
+            "elapsed_seconds": elapsed.as_secs_f64(),
+            "megabytes_per_second": megabytes_per_second(self.bytes, elapsed),
+            "resume_skipped": self.resume_skipped,
+            "filter_skipped": self.filter_skipped,
+            "read_errors": self.read_errors,
+        });
+        if let Some(label) = &self.label {
+            record["label"] = json!(label);
+        }
+        record
+    }
+}
+
+/// 実行全体のハッシュ計算の集計
+/// ディスクごとのスレッドで共有する。
+#[derive(Clone)]
+pub struct RunSummary {
+    disk_summaries: Arc<Mutex<BTreeMap<String, DiskSummary>>>,
+}
+
+impl RunSummary {
+    pub fn new() -> RunSummary {
+        RunSummary {
+            disk_summaries: Arc::new(Mutex::new(BTreeMap::new())),
+        }
+    }
+
+    /// ディスクの集計を記録する。
+    pub fn record(&self, disk_id: &str, disk_summary: DiskSummary) {
+        self.disk_summaries
+            .lock()
+            .unwrap()
+            .insert(disk_id.to_string(), disk_summary);
+    }
+
+    /// 全てのディスクの合計を返す。
+    /// 所要時間はディスクを並行して処理するため合計せず、実行全体の経過時間を使う。
+    fn total(&self, elapsed: Duration) -> DiskSummary {
+        let mut total = DiskSummary {
+            elapsed,
+            ..Default::default()
+        };
+        for disk_summary in self.disk_summaries.lock().unwrap().values() {
+            total.files_hashed += disk_summary.files_hashed;
+            total.bytes += disk_summary.bytes;
+            total.resume_skipped += disk_summary.resume_skipped;
+            total.filter_skipped += disk_summary.filter_skipped;
+            total.read_errors += disk_summary.read_errors;
+        }
+        total
+    }
+
+    /// ディスクごとと全体の集計をログに出力する。
+    /// 記録したディスクがなければ何も出力しない。
+    pub fn log(&self, elapsed: Duration) {
+        let disk_summaries = self.disk_summaries.lock().unwrap().clone();
+        if disk_summaries.len() == 0 {
+            return;
+        }
+
+        for (disk_id, disk_summary) in disk_summaries.iter() {
+            log_summary(disk_id, disk_summary);
+        }
+        log_summary("合計", &self.total(elapsed));
+    }
+
+    /// ディスクごとと全体の集計をJSONのレポートにして出力フォルダに保存する。
+    /// 保存したファイルのパスを返す。
+    pub fn write_report(&self, output_folder: &Path, elapsed: Duration) -> Result<PathBuf, Errors> {
+        let disks: Vec<serde_json::Value> = self
+            .disk_summaries
+            .lock()
+            .unwrap()
+            .iter()
+            .map(|(disk_id, disk_summary)| {
+                let mut record = disk_summary.to_json();
+                record["disk"] = json!(disk_id);
+                record
+            })
+            .collect();
+        let now = clock::now();
+        let report = json!({
+            "finished": now.format("%Y-%m-%d %H:%M:%S").to_string(),
+            "disks": disks,
+            "total": self.total(elapsed).to_json(),
+        });
+
+        let summary_folder = summary_folder(output_folder);
+        if let Err(error) = fs::create_dir_all(summary_folder.as_path()) {
+            return Err(
+                log::make_error!("集計レポートのフォルダを作成できませんでした。")
+                    .with(&error)
+                    .as_errors(),
+            );
+        }
+        let report_filepath =
+            summary_folder.join(format!("{}.json", now.format(REPORT_NAME_FORMAT)));
+        if let Err(error) = atomic_write::write(
+            report_filepath.as_path(),
+            format!("{}\n", serde_json::to_string_pretty(&report).unwrap()),
+        ) {
+            return Err(log::make_error!(
+                "集計レポートを保存できませんでした。: {}",
+                report_filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors());
+        }
+        Ok(report_filepath)
+    }
+}
+
+/// 集計レポートを保存するフォルダを返す。
+fn summary_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("summary")
+}
+
+/// 1件の集計をログに出力する。
+fn log_summary(name: &str, disk_summary: &DiskSummary) {
+    let elapsed = clock::reported_duration(disk_summary.elapsed);
+    log::info(
+        format!(
+            "{}: {}ファイル / {:.2}GB / {}秒 / {:.1}MB/s (計算済み {}件 / フィルターで対象外 {}件 / 読み込みエラー {}件)",
+            name,
+            disk_summary.files_hashed,
+            disk_summary.bytes as f64 / (1u64 << 30) as f64,
+            elapsed.as_secs(),
+            megabytes_per_second(disk_summary.bytes, elapsed),
+            disk_summary.resume_skipped,
+            disk_summary.filter_skipped,
+            disk_summary.read_errors
+        )
+        .as_str(),
+    );
+}
+
+/// 1秒あたりのメガバイト数を返す。
+fn megabytes_per_second(bytes: u64, elapsed: Duration) -> f64 {
+    if elapsed.is_zero() {
+        0.0
+    } else {
+        bytes as f64 / (1u64 << 20) as f64 / elapsed.as_secs_f64()
+    }
+}
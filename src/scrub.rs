@@ -0,0 +1,222 @@
+use std::collections::{BTreeSet, HashMap};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use once_cell::sync::Lazy;
+use regex::Regex;
+
+use crate::hash_algorithm::Digest;
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::merged_hash_file;
+use crate::path_normalizer::PathNormalizer;
+use crate::registry;
+
+/// zpool status -vでエラーのあるファイルの一覧が始まる行
+const ZFS_ERRORS_HEADER: &str = "Permanent errors have been detected in the following files:";
+
+/// btrfsのカーネルログのチェックサムエラーの行からパスを取り出すパターン
+/// パスはサブボリュームのルートからの相対パスになる。
+static BTRFS_PATH_PATTERN: Lazy<Regex> =
+    Lazy::new(|| Regex::new(r"BTRFS .*\(path: (.+)\)\s*$").unwrap());
+
+/// スクラブで検出されたファイルの照合結果
+enum ScrubStatus {
+    /// 他のディスクに同じハッシュのファイルがある
+    Copied(Vec<String>),
+    /// 他のディスクに同じハッシュのファイルがない
+    NoCopy,
+    /// ハッシュファイルに記録されていない
+    NotRecorded,
+    /// レジストリに登録されたディスクのパスではない
+    UnknownDisk,
+}
+
+impl ScrubStatus {
+    /// 出力する状態の名前を返す。
+    fn name(&self) -> &'static str {
+        match self {
+            ScrubStatus::Copied(_) => "copied",
+            ScrubStatus::NoCopy => "no-copy",
+            ScrubStatus::NotRecorded => "not-recorded",
+            ScrubStatus::UnknownDisk => "unknown-disk",
+        }
+    }
+}
+
+/// ZFSかbtrfsのスクラブで検出されたファイルを、ハッシュファイルと照合して標準出力に出力する。
+/// ファイルはディスクレジストリのルートでディスクを特定し、ハッシュファイルに記録されたハッシュと同じファイルが
+/// 他のディスクにあれば、そのディスクIDとパスを正常なコピーの候補として出力する。
+/// btrfsのパスはマウント先からの相対パスなので、マウント先が指定されなければ特定できない。
+pub fn import_scrub_report(
+    report_filepath: &Path,
+    mount_folder: Option<&Path>,
+    registry_filepath: &Path,
+    output_folders: &[&Path],
+    path_normalizer: &PathNormalizer,
+) -> Result<(), Errors> {
+    let report = match fs::read_to_string(report_filepath) {
+        Ok(report) => report,
+        Err(error) => {
+            return Err(log::make_error!(
+                "スクラブのレポートが読み込めませんでした。: {}",
+                report_filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors())
+        }
+    };
+    // レジストリのルートと比較できるよう、マウント先は絶対パスにしておく
+    let mount_folder = mount_folder
+        .map(|mount_folder| fs::canonicalize(mount_folder).unwrap_or(mount_folder.to_path_buf()));
+    let (flagged_paths, unresolved) = parse_scrub_report(&report, mount_folder.as_deref());
+    for entry in unresolved.iter() {
+        log::warn(format!("ファイルのパスを特定できませんでした。: {}", entry).as_str());
+    }
+    if flagged_paths.len() == 0 && unresolved.len() > 0 {
+        log::warn("スクラブのレポートにパスを特定できたファイルがありません。btrfsのレポートは--mountでマウント先を指定してください。");
+        return Ok(());
+    }
+    if flagged_paths.len() == 0 {
+        log::info("スクラブのレポートにエラーのあるファイルはありません。");
+        return Ok(());
+    }
+
+    let registry = registry::load_registry(registry_filepath)?;
+    // 全てのハッシュファイルを読み込み、ハッシュごとにファイルがあるディスクとパスを引けるようにする
+    let mut hash_info_maps: HashMap<String, HashMap<PathBuf, Digest>> = HashMap::new();
+    for output_folder in output_folders {
+        if !output_folder.is_dir() {
+            continue;
+        }
+        for hash_filepath in merged_hash_file::find_hash_files(output_folder)? {
+            let disk_id = hash_filepath.file_name().unwrap().to_str().unwrap();
+            let hash_info_map = hash_file::load_hash_info(hash_filepath.as_path())?;
+            hash_info_maps.insert(disk_id.to_string(), hash_info_map);
+        }
+    }
+    let mut copies: HashMap<&Digest, Vec<(&str, &Path)>> = HashMap::new();
+    for (disk_id, hash_info_map) in hash_info_maps.iter() {
+        for (target_filepath, hash) in hash_info_map.iter() {
+            copies
+                .entry(hash)
+                .or_default()
+                .push((disk_id.as_str(), target_filepath.as_path()));
+        }
+    }
+
+    let mut number_of_no_copies = 0;
+    for flagged_path in flagged_paths.iter() {
+        let status = match registry.find_disk_of(flagged_path) {
+            None => ScrubStatus::UnknownDisk,
+            Some((disk_id, relative_path)) => {
+                let normalized_path = PathBuf::from(path_normalizer.normalize(relative_path));
+                match hash_info_maps
+                    .get(disk_id)
+                    .and_then(|hash_info_map| hash_info_map.get(&normalized_path))
+                {
+                    None => ScrubStatus::NotRecorded,
+                    Some(hash) => {
+                        let mut other_copies: Vec<String> = copies
+                            .get(hash)
+                            .into_iter()
+                            .flatten()
+                            .filter(|(copy_disk_id, _)| *copy_disk_id != disk_id)
+                            .map(|(copy_disk_id, copy_path)| {
+                                format!("{}:{}", copy_disk_id, copy_path.to_str().unwrap())
+                            })
+                            .collect();
+                        other_copies.sort();
+                        if other_copies.len() > 0 {
+                            ScrubStatus::Copied(other_copies)
+                        } else {
+                            ScrubStatus::NoCopy
+                        }
+                    }
+                }
+            }
+        };
+        match &status {
+            ScrubStatus::Copied(other_copies) => println!(
+                "{}\t{}\t{}",
+                flagged_path.to_str().unwrap(),
+                status.name(),
+                other_copies.join("\t")
+            ),
+            _ => {
+                number_of_no_copies += 1;
+                println!("{}\t{}", flagged_path.to_str().unwrap(), status.name());
+            }
+        }
+    }
+
+    if number_of_no_copies > 0 {
+        log::warn(
+            format!(
+                "スクラブで検出された{}件のファイルのうち、{}件は他のディスクに正常なコピーが見つかりません。",
+                flagged_paths.len(),
+                number_of_no_copies
+            )
+            .as_str(),
+        );
+    } else {
+        log::info(
+            format!(
+                "スクラブで検出された{}件のファイルは全て他のディスクにコピーがあります。",
+                flagged_paths.len()
+            )
+            .as_str(),
+        );
+    }
+
+    Ok(())
+}
+
+/// zpool status -vの出力かbtrfsのカーネルログから、エラーのあるファイルの絶対パスを重複なく取り出す。
+/// パスにできなかった項目は別に返す。
+fn parse_scrub_report(
+    report: &str,
+    mount_folder: Option<&Path>,
+) -> (BTreeSet<PathBuf>, BTreeSet<String>) {
+    let mut flagged_paths = BTreeSet::new();
+    let mut unresolved = BTreeSet::new();
+    // ZFSのエラーのあるファイルの一覧の中か
+    let mut in_zfs_errors = false;
+
+    for line in report.lines() {
+        if line.contains(ZFS_ERRORS_HEADER) {
+            in_zfs_errors = true;
+            continue;
+        }
+        if in_zfs_errors {
+            let entry = line.trim();
+            if entry.len() == 0 {
+                continue;
+            }
+            // 一覧の行はインデントされている
+            if line.starts_with(char::is_whitespace) {
+                // マウントされていないデータセットやメタデータは"データセット:<0x...>"の形式になる
+                if entry.starts_with('/') {
+                    flagged_paths.insert(PathBuf::from(entry));
+                } else {
+                    unresolved.insert(entry.to_string());
+                }
+                continue;
+            }
+            in_zfs_errors = false;
+        }
+        if let Some(captures) = BTRFS_PATH_PATTERN.captures(line) {
+            let path = &captures[1];
+            match mount_folder {
+                Some(mount_folder) => {
+                    flagged_paths.insert(mount_folder.join(path));
+                }
+                None => {
+                    unresolved.insert(path.to_string());
+                }
+            }
+        }
+    }
+
+    (flagged_paths, unresolved)
+}
@@ -0,0 +1,96 @@
+use std::collections::HashSet;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::clock;
+use crate::disk;
+use crate::log::{self, Errors};
+
+/// 封印の印を保存するフォルダを返す。
+/// 封印されたディスクごとにディスクIDの名前のファイルを置く。
+fn sealed_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("sealed")
+}
+
+/// 封印されたディスクのID一覧を返す。
+pub fn load_sealed_disk_ids(output_folder: &Path) -> Result<HashSet<String>, Errors> {
+    let mut sealed_disk_ids = HashSet::new();
+
+    let sealed_folder = sealed_folder(output_folder);
+    if !sealed_folder.is_dir() {
+        return Ok(sealed_disk_ids);
+    }
+
+    match sealed_folder.read_dir() {
+        Ok(read_dir) => {
+            for entry in read_dir {
+                if let Ok(entry) = entry {
+                    let file_name = entry.file_name();
+                    let file_name = file_name.to_str().unwrap_or("");
+                    if disk::DISK_ID_PATTERN.is_match(file_name) {
+                        sealed_disk_ids.insert(file_name.to_string());
+                    }
+                }
+            }
+        }
+        Err(error) => {
+            return Err(
+                log::make_error!("封印されたディスクの一覧を取得できませんでした。")
+                    .with(&error)
+                    .as_errors(),
+            );
+        }
+    }
+
+    Ok(sealed_disk_ids)
+}
+
+/// 指定されたディスクが封印されているかを返す。
+pub fn is_sealed(output_folder: &Path, disk_id: &str) -> bool {
+    sealed_folder(output_folder).join(disk_id).is_file()
+}
+
+/// ディスクを封印する。
+/// 封印したディスクのハッシュファイルは確定したものとし、以降は検証だけを行う。
+pub fn seal_disks(output_folder: &Path, disk_ids: &Vec<String>) -> Result<(), Errors> {
+    let sealed_folder = sealed_folder(output_folder);
+    if let Err(error) = fs::create_dir_all(sealed_folder.as_path()) {
+        return Err(
+            log::make_error!("封印の保存フォルダを作成できませんでした。")
+                .with(&error)
+                .as_errors(),
+        );
+    }
+
+    let mut errors = vec![];
+    for disk_id in disk_ids {
+        // ハッシュを計算していないディスクは封印できない
+        let hash_filepath = output_folder.join(disk_id);
+        if !hash_filepath.is_file() {
+            errors.push(log::make_error!(
+                "ディスク{}のハッシュファイルがないため封印できません。",
+                disk_id
+            ));
+            continue;
+        }
+
+        if is_sealed(output_folder, disk_id) {
+            log::info(format!("ディスク{}はすでに封印されています。", disk_id).as_str());
+            continue;
+        }
+
+        let timestamp = clock::now().format("%Y-%m-%d %H:%M:%S").to_string();
+        match atomic_write::write(sealed_folder.join(disk_id), timestamp + "\n") {
+            Ok(_) => log::info(format!("ディスク{}を封印しました。", disk_id).as_str()),
+            Err(error) => errors
+                .push(log::make_error!("ディスク{}の封印に失敗しました。", disk_id).with(&error)),
+        }
+    }
+
+    if errors.len() == 0 {
+        Ok(())
+    } else {
+        Err(errors)
+    }
+}
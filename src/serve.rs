@@ -0,0 +1,407 @@
+use std::collections::{BTreeMap, HashMap};
+use std::fs;
+use std::io::{BufRead, BufReader, Write};
+use std::net::{TcpListener, TcpStream};
+use std::path::{Path, PathBuf};
+use std::time::SystemTime;
+
+use serde_json::{json, Value};
+
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::merged_hash_file;
+use crate::output_lock;
+use crate::registry::{self, DiskRegistry};
+use crate::run_options::RunOptions;
+use crate::seal;
+use crate::serve_auth::{AccessControl, Role};
+use crate::tags;
+
+/// ハッシュファイルの索引
+/// 全ディスクのハッシュファイルを読み込み、ハッシュからもファイルを引けるようにしたもの。
+struct CatalogIndex {
+    /// 読み込んだハッシュファイルとその更新日時
+    hash_file_times: Vec<(PathBuf, Option<SystemTime>)>,
+    /// ディスクIDごとのファイルパスとハッシュ
+    disks: BTreeMap<String, BTreeMap<PathBuf, String>>,
+    /// ハッシュごとのディスクIDとファイルパス
+    hashes: HashMap<String, Vec<(String, PathBuf)>>,
+}
+
+/// ハッシュファイルを問い合わせるHTTPサーバーを起動する。
+/// グループごとの出力フォルダも含め、全ての出力フォルダのハッシュファイルを対象にする。
+/// 終了されるまで戻らない。
+pub fn serve(run_options: &RunOptions) -> Result<(), Errors> {
+    let listen_address = run_options.listen_address();
+    let access_control = AccessControl::load(run_options.config_folder())?;
+    if !access_control.is_enabled() {
+        log::info("アクセス制御が設定されていないため、閲覧だけを受け付けます。");
+    }
+
+    let listener = match TcpListener::bind(listen_address) {
+        Ok(listener) => listener,
+        Err(error) => {
+            return Err(
+                log::make_error!("{}で待ち受けできませんでした。", listen_address)
+                    .with(&error)
+                    .as_errors(),
+            )
+        }
+    };
+
+    let mut index = load_catalog_index(run_options)?;
+    log::info(format!("{}で問い合わせを待ち受けます。", listen_address).as_str());
+
+    for stream in listener.incoming() {
+        let stream = match stream {
+            Ok(stream) => stream,
+            Err(error) => {
+                log::warn(format!("接続を受け付けられませんでした。: {}", error).as_str());
+                continue;
+            }
+        };
+
+        // ハッシュファイルが更新されていれば読み込み直す
+        if index.is_outdated(run_options) {
+            match load_catalog_index(run_options) {
+                Ok(new_index) => index = new_index,
+                Err(errors) => log::log_errors(errors),
+            }
+        }
+
+        if let Err(errors) = handle_connection(stream, &index, run_options, &access_control) {
+            log::log_errors(errors);
+        }
+    }
+
+    Ok(())
+}
+
+/// 出力フォルダのハッシュファイルを読み込んで索引を作成する。
+fn load_catalog_index(run_options: &RunOptions) -> Result<CatalogIndex, Errors> {
+    let mut index = CatalogIndex {
+        hash_file_times: vec![],
+        disks: BTreeMap::new(),
+        hashes: HashMap::new(),
+    };
+
+    for hash_filepath in find_hash_files(run_options)? {
+        let disk_id = hash_filepath
+            .file_name()
+            .unwrap()
+            .to_str()
+            .unwrap()
+            .to_string();
+        let modified = modified_time(hash_filepath.as_path());
+        let hash_info_map = hash_file::load_hash_info(hash_filepath.as_path())?;
+
+        let mut files = BTreeMap::new();
+        for (target_filepath, hash) in hash_info_map {
+            let hash = hex::encode(hash.to_vec());
+            index
+                .hashes
+                .entry(hash.clone())
+                .or_insert_with(|| vec![])
+                .push((disk_id.clone(), target_filepath.clone()));
+            files.insert(target_filepath, hash);
+        }
+
+        index.disks.insert(disk_id, files);
+        index.hash_file_times.push((hash_filepath, modified));
+    }
+
+    Ok(index)
+}
+
+/// 全ての出力フォルダのハッシュファイルを一覧にする。
+/// グループの出力フォルダを設定する前のハッシュファイルが残っていても、グループの出力フォルダのものだけを一覧にする。
+fn find_hash_files(run_options: &RunOptions) -> Result<Vec<PathBuf>, Errors> {
+    let mut hash_filepaths = vec![];
+    for output_folder in run_options.output_folders() {
+        if !output_folder.is_dir() {
+            continue;
+        }
+        for hash_filepath in merged_hash_file::find_hash_files(output_folder)? {
+            let disk_id = hash_filepath.file_name().unwrap().to_str().unwrap();
+            if run_options.output_folder_of(disk_id.chars().next().unwrap()) == output_folder {
+                hash_filepaths.push(hash_filepath);
+            }
+        }
+    }
+    Ok(hash_filepaths)
+}
+
+/// ファイルの更新日時を返す。
+/// 取得できなければNoneを返す。
+fn modified_time(filepath: &Path) -> Option<SystemTime> {
+    match fs::metadata(filepath) {
+        Ok(metadata) => metadata.modified().ok(),
+        Err(_) => None,
+    }
+}
+
+impl CatalogIndex {
+    /// 索引を作成した後にハッシュファイルが追加、更新されたかを返す。
+    fn is_outdated(&self, run_options: &RunOptions) -> bool {
+        let hash_filepaths = match find_hash_files(run_options) {
+            Ok(hash_filepaths) => hash_filepaths,
+            Err(_) => return false,
+        };
+        if hash_filepaths.len() != self.hash_file_times.len() {
+            return true;
+        }
+        for (hash_filepath, modified) in self.hash_file_times.iter() {
+            if modified_time(hash_filepath.as_path()) != *modified {
+                return true;
+            }
+        }
+        false
+    }
+}
+
+/// 1つの接続の要求に応答する。
+fn handle_connection(
+    mut stream: TcpStream,
+    index: &CatalogIndex,
+    run_options: &RunOptions,
+    access_control: &AccessControl,
+) -> Result<(), Errors> {
+    // 要求行を読み込み、ヘッダーはAuthorizationだけを取り出す
+    let mut reader = BufReader::new(&stream);
+    let mut request_line = String::new();
+    if let Err(error) = reader.read_line(&mut request_line) {
+        return Err(log::make_error!("要求を読み込めませんでした。")
+            .with(&error)
+            .as_errors());
+    }
+    let mut authorization = None;
+    loop {
+        let mut header_line = String::new();
+        match reader.read_line(&mut header_line) {
+            Ok(0) => break,
+            Ok(_) if header_line.trim().len() == 0 => break,
+            Ok(_) => {
+                if let Some((name, value)) = header_line.split_once(':') {
+                    if name.trim().eq_ignore_ascii_case("authorization") {
+                        authorization = Some(value.trim().to_string());
+                    }
+                }
+            }
+            Err(_) => break,
+        }
+    }
+
+    let role = access_control.authorize(authorization.as_deref());
+    let request: Vec<&str> = request_line.split_whitespace().collect();
+    let (status, body) = match (&request[..], role) {
+        (_, None) => (401, json!({ "error": "認証が必要です。" })),
+        (["GET", target, _], Some(_)) => route(
+            target,
+            index,
+            &run_options.output_folders(),
+            run_options.registry_filepath(),
+        ),
+        (["POST", target, _], Some(Role::Admin)) => route_admin(target, run_options),
+        (["POST", _, _], Some(_)) => (403, json!({ "error": "管理者の権限が必要です。" })),
+        _ => (405, json!({ "error": "GETとPOSTのみ受け付けます。" })),
+    };
+
+    let body = body.to_string();
+    let response = format!(
+        "HTTP/1.1 {} {}\r\nContent-Type: application/json; charset=utf-8\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+        status,
+        status_text(status),
+        body.len(),
+        body
+    );
+    if let Err(error) = stream.write_all(response.as_bytes()) {
+        return Err(log::make_error!("応答を送信できませんでした。")
+            .with(&error)
+            .as_errors());
+    }
+
+    Ok(())
+}
+
+/// 要求パスに応じた応答を作成する。
+fn route(
+    target: &str,
+    index: &CatalogIndex,
+    output_folders: &[&Path],
+    registry_filepath: &Path,
+) -> (u16, Value) {
+    let (path, query) = match target.split_once('?') {
+        Some((path, query)) => (path, query),
+        None => (target, ""),
+    };
+    let segments: Vec<String> = path
+        .split('/')
+        .filter(|segment| segment.len() > 0)
+        .map(percent_decode)
+        .collect();
+    let segments: Vec<&str> = segments.iter().map(|segment| segment.as_str()).collect();
+    // タグは変更されても索引を作り直さずに済むよう要求ごとに読み込む
+    // 読み込めなくてもタグ以外は返す
+    let tag_index = tags::load_tag_index(output_folders).ok();
+    let tags_of = |disk_id: &str, target_filepath: &Path| -> Vec<String> {
+        match &tag_index {
+            Some(tag_index) => tag_index
+                .tags_of(disk_id, target_filepath)
+                .into_iter()
+                .map(|tag| tag.to_string())
+                .collect(),
+            None => vec![],
+        }
+    };
+
+    match segments[..] {
+        ["disks"] => (200, list_disks(index, registry_filepath)),
+        ["disks", disk_id, "files"] => match index.disks.get(disk_id) {
+            Some(files) => {
+                let prefix = query_value(query, "prefix").unwrap_or_default();
+                (
+                    200,
+                    list_files(files, prefix.as_str(), |target_filepath| {
+                        tags_of(disk_id, target_filepath)
+                    }),
+                )
+            }
+            None => (
+                404,
+                json!({ "error": format!("ディスク{}のハッシュファイルがありません。", disk_id) }),
+            ),
+        },
+        ["hashes", hash] => {
+            let locations = match index.hashes.get(&hash.to_lowercase()) {
+                Some(locations) => locations
+                    .iter()
+                    .map(|(disk_id, target_filepath)| {
+                        json!({
+                            "disk": disk_id,
+                            "path": target_filepath.to_str().unwrap(),
+                            "tags": tags_of(disk_id, target_filepath),
+                        })
+                    })
+                    .collect(),
+                None => vec![],
+            };
+            (200, Value::Array(locations))
+        }
+        _ => (404, json!({ "error": "不明なパスです。" })),
+    }
+}
+
+/// 管理者の要求パスに応じて処理を行い、応答を作成する。
+fn route_admin(target: &str, run_options: &RunOptions) -> (u16, Value) {
+    let segments: Vec<String> = target
+        .split('/')
+        .filter(|segment| segment.len() > 0)
+        .map(percent_decode)
+        .collect();
+    let segments: Vec<&str> = segments.iter().map(|segment| segment.as_str()).collect();
+
+    match segments[..] {
+        ["disks", disk_id, "seal"] => {
+            // 封印はディスクのグループの出力フォルダに記録する
+            // 他のbcbcがハッシュファイルを書き換えている間は封印しないよう、封印する間だけ出力フォルダをロックする
+            let output_folder = run_options.output_folder_of(disk_id.chars().next().unwrap());
+            let result =
+                output_lock::lock_output_folders(&[output_folder]).and_then(|_output_locks| {
+                    seal::seal_disks(output_folder, &vec![disk_id.to_string()])
+                });
+            match result {
+                Ok(_) => (200, json!({ "sealed": disk_id })),
+                Err(errors) => {
+                    let messages: Vec<String> =
+                        errors.iter().map(|error| error.to_string()).collect();
+                    (400, json!({ "error": messages.join("\n") }))
+                }
+            }
+        }
+        _ => (404, json!({ "error": "不明なパスです。" })),
+    }
+}
+
+/// ディスクの一覧を作成する。
+fn list_disks(index: &CatalogIndex, registry_filepath: &Path) -> Value {
+    // レジストリが読めなくてもルート以外は返す
+    let registry = registry::load_registry(registry_filepath).ok();
+
+    let disks = index
+        .disks
+        .iter()
+        .map(|(disk_id, files)| {
+            let root = registry
+                .as_ref()
+                .and_then(|registry: &DiskRegistry| registry.root_of(disk_id))
+                .map(|root| root.to_str().unwrap().to_string());
+            json!({ "id": disk_id, "files": files.len(), "root": root })
+        })
+        .collect();
+
+    Value::Array(disks)
+}
+
+/// 指定されたパスで始まるファイルの一覧を作成する。
+fn list_files(
+    files: &BTreeMap<PathBuf, String>,
+    prefix: &str,
+    tags_of: impl Fn(&Path) -> Vec<String>,
+) -> Value {
+    let files = files
+        .iter()
+        .filter(|(target_filepath, _)| target_filepath.to_str().unwrap().starts_with(prefix))
+        .map(|(target_filepath, hash)| {
+            json!({
+                "path": target_filepath.to_str().unwrap(),
+                "hash": hash,
+                "tags": tags_of(target_filepath),
+            })
+        })
+        .collect();
+
+    Value::Array(files)
+}
+
+/// クエリ文字列から指定された名前の値を返す。
+fn query_value(query: &str, name: &str) -> Option<String> {
+    query
+        .split('&')
+        .filter_map(|pair| pair.split_once('='))
+        .find(|(key, _)| *key == name)
+        .map(|(_, value)| percent_decode(&value.replace('+', " ")))
+}
+
+/// パーセントエンコードされた文字列を戻す。
+/// 不正なエンコードはそのまま残す。
+fn percent_decode(value: &str) -> String {
+    let bytes = value.as_bytes();
+    let mut decoded = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        if bytes[i] == b'%' && i + 2 < bytes.len() {
+            let hex_digits = std::str::from_utf8(&bytes[i + 1..i + 3]).unwrap_or("");
+            if let Ok(byte) = u8::from_str_radix(hex_digits, 16) {
+                decoded.push(byte);
+                i += 3;
+                continue;
+            }
+        }
+        decoded.push(bytes[i]);
+        i += 1;
+    }
+    String::from_utf8_lossy(&decoded).to_string()
+}
+
+/// HTTPステータスコードの説明を返す。
+fn status_text(status: u16) -> &'static str {
+    match status {
+        200 => "OK",
+        400 => "Bad Request",
+        401 => "Unauthorized",
+        403 => "Forbidden",
+        404 => "Not Found",
+        405 => "Method Not Allowed",
+        _ => "Internal Server Error",
+    }
+}
@@ -0,0 +1,109 @@
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::log::{self, Errors};
+
+/// 問い合わせサーバーの利用者の権限
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Role {
+    /// ハッシュファイルの閲覧だけができる
+    Reader,
+    /// 封印などの変更もできる
+    Admin,
+}
+
+impl Role {
+    /// 設定ファイルに記載する名前から権限を返す。
+    fn from_name(name: &str) -> Option<Role> {
+        match name {
+            "reader" => Some(Role::Reader),
+            "admin" => Some(Role::Admin),
+            _ => None,
+        }
+    }
+}
+
+/// 問い合わせサーバーのアクセス制御
+/// 設定ファイルがなければ認証せず、全ての要求を閲覧の権限で受け付ける。
+pub struct AccessControl {
+    /// トークンごとの権限
+    tokens: Option<HashMap<String, Role>>,
+}
+
+/// アクセス制御の設定ファイルのパスを返す。
+fn serve_conf_filepath(config_folder: &Path) -> PathBuf {
+    config_folder.join("serve.conf")
+}
+
+impl AccessControl {
+    /// 設定ファイルからアクセス制御を読み込む。
+    /// 1行に"権限:トークン"の形式で記載する。空行と"#"で始まる行は無視する。
+    pub fn load(config_folder: &Path) -> Result<AccessControl, Errors> {
+        let conf_filepath = serve_conf_filepath(config_folder);
+        if !conf_filepath.is_file() {
+            return Ok(AccessControl { tokens: None });
+        }
+
+        let contents = match fs::read_to_string(conf_filepath.as_path()) {
+            Ok(contents) => contents,
+            Err(error) => {
+                return Err(log::make_error!(
+                    "アクセス制御の設定ファイルを読み込めませんでした。: {}",
+                    conf_filepath.to_str().unwrap()
+                )
+                .with(&error)
+                .as_errors())
+            }
+        };
+
+        let mut tokens = HashMap::new();
+        for (i, line) in contents.lines().enumerate() {
+            let line = line.trim();
+            if line.len() == 0 || line.starts_with('#') {
+                continue;
+            }
+            match line
+                .split_once(':')
+                .and_then(|(role, token)| Role::from_name(role).map(|role| (role, token)))
+            {
+                Some((role, token)) if token.len() > 0 => {
+                    tokens.insert(token.to_string(), role);
+                }
+                _ => {
+                    return log::with_line_number(
+                        Err(
+                            log::make_error!("アクセス制御の設定ファイルの形式が不正です。")
+                                .as_errors(),
+                        ),
+                        conf_filepath.as_path(),
+                        i + 1,
+                    )
+                }
+            }
+        }
+
+        Ok(AccessControl {
+            tokens: Some(tokens),
+        })
+    }
+
+    /// 認証が有効かを返す。
+    pub fn is_enabled(&self) -> bool {
+        self.tokens.is_some()
+    }
+
+    /// Authorizationヘッダーの値から利用者の権限を返す。
+    /// 認証できなければNoneを返す。
+    pub fn authorize(&self, authorization: Option<&str>) -> Option<Role> {
+        let tokens = match &self.tokens {
+            Some(tokens) => tokens,
+            None => return Some(Role::Reader),
+        };
+
+        authorization
+            .and_then(|authorization| authorization.trim().strip_prefix("Bearer "))
+            .and_then(|token| tokens.get(token.trim()))
+            .copied()
+    }
+}
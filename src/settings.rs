@@ -0,0 +1,570 @@
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use chrono::NaiveDateTime;
+
+use crate::clock;
+use crate::filter::{SkipRules, SymlinkPolicy};
+use crate::hash_algorithm::HashAlgorithm;
+use crate::hash_store::HashStorage;
+use crate::log::{self, Errors};
+use crate::messages::Language;
+use crate::path_normalizer::PathNormalizer;
+
+/// 設定項目
+/// 同じ設定を設定ファイル、環境変数、コマンドラインオプションで指定できる。
+pub struct Key {
+    /// 設定ファイルでの名前
+    pub name: &'static str,
+    /// 環境変数名
+    pub env_name: &'static str,
+    /// コマンドラインオプション名
+    pub option_name: &'static str,
+}
+
+/// ハッシュアルゴリズム
+pub const ALGORITHM: Key = Key {
+    name: "algo",
+    env_name: "BCBCALGO",
+    option_name: "--algo",
+};
+
+/// 追加で計算するハッシュアルゴリズム
+pub const EXTRA_ALGORITHMS: Key = Key {
+    name: "extra-algos",
+    env_name: "BCBCEXTRAALGOS",
+    option_name: "--extra-algos",
+};
+
+/// 同時にハッシュ計算するディスクの数
+pub const DISKS: Key = Key {
+    name: "disks",
+    env_name: "BCBCDISKS",
+    option_name: "--disks",
+};
+
+/// 1台のディスクで同時にハッシュ計算するファイルの数
+pub const WORKERS: Key = Key {
+    name: "workers",
+    env_name: "BCBCWORKERS",
+    option_name: "--workers",
+};
+
+/// 読み込み用のバッファのMB数
+pub const BUFFER_SIZE: Key = Key {
+    name: "buffer-size",
+    env_name: "BCBCBUFFERSIZE",
+    option_name: "--buffer-size",
+};
+
+/// 塊を並行して計算するファイルのMB数の下限
+pub const CHUNKED_THRESHOLD: Key = Key {
+    name: "chunked-threshold",
+    env_name: "BCBCCHUNKEDTHRESHOLD",
+    option_name: "--chunked-threshold",
+};
+
+/// メモリ使用量の上限のMB数
+pub const MEMORY_LIMIT: Key = Key {
+    name: "memory-limit",
+    env_name: "BCBCMEMORYLIMIT",
+    option_name: "--memory-limit",
+};
+
+/// 読み込みに失敗したファイルを再試行する回数
+pub const RETRIES: Key = Key {
+    name: "retries",
+    env_name: "BCBCRETRIES",
+    option_name: "--retries",
+};
+
+/// 最初に再試行するまでの待ち時間の秒数
+pub const RETRY_DELAY: Key = Key {
+    name: "retry-delay",
+    env_name: "BCBCRETRYDELAY",
+    option_name: "--retry-delay",
+};
+
+/// 端末以外に出力する場合の進捗状況の出力間隔の秒数
+pub const HEARTBEAT: Key = Key {
+    name: "heartbeat",
+    env_name: "BCBCHEARTBEAT",
+    option_name: "--heartbeat",
+};
+
+/// 問い合わせサーバーが待ち受けるアドレス
+pub const LISTEN: Key = Key {
+    name: "listen",
+    env_name: "BCBCLISTEN",
+    option_name: "--listen",
+};
+
+/// 出力フォルダ
+pub const OUTPUT_FOLDER: Key = Key {
+    name: "out",
+    env_name: "BCBCOUT",
+    option_name: "--out",
+};
+
+/// ディスクレジストリファイル
+pub const REGISTRY: Key = Key {
+    name: "registry",
+    env_name: "BCBCREGISTRY",
+    option_name: "--registry",
+};
+
+/// フィルタープロファイル
+pub const FILTER_PROFILE: Key = Key {
+    name: "filter-profile",
+    env_name: "BCBCFILTERPROFILE",
+    option_name: "--filter-profile",
+};
+
+/// 決定的モードで使う固定の日時
+pub const FIXED_TIME: Key = Key {
+    name: "fixed-time",
+    env_name: "BCBCFIXEDTIME",
+    option_name: "--fixed-time",
+};
+
+/// 種類で対象外にするファイル
+pub const SKIP: Key = Key {
+    name: "skip",
+    env_name: "BCBCSKIP",
+    option_name: "--skip",
+};
+
+/// メッセージの言語
+pub const LANG: Key = Key {
+    name: "lang",
+    env_name: "BCBCLANG",
+    option_name: "--lang",
+};
+
+/// パスの正規化の手順
+pub const NORMALIZE: Key = Key {
+    name: "normalize",
+    env_name: "BCBCNORMALIZE",
+    option_name: "--normalize",
+};
+
+/// シンボリックリンクの扱い
+pub const SYMLINKS: Key = Key {
+    name: "symlinks",
+    env_name: "BCBCSYMLINKS",
+    option_name: "--symlinks",
+};
+
+/// ハッシュ情報の保存先
+pub const STORAGE: Key = Key {
+    name: "storage",
+    env_name: "BCBCSTORAGE",
+    option_name: "--storage",
+};
+
+/// 全ての設定項目
+const KEYS: [&Key; 20] = [
+    &ALGORITHM,
+    &EXTRA_ALGORITHMS,
+    &DISKS,
+    &WORKERS,
+    &BUFFER_SIZE,
+    &CHUNKED_THRESHOLD,
+    &MEMORY_LIMIT,
+    &RETRIES,
+    &RETRY_DELAY,
+    &HEARTBEAT,
+    &LISTEN,
+    &OUTPUT_FOLDER,
+    &REGISTRY,
+    &FILTER_PROFILE,
+    &FIXED_TIME,
+    &SKIP,
+    &LANG,
+    &NORMALIZE,
+    &SYMLINKS,
+    &STORAGE,
+];
+
+/// グループごとに指定できる設定項目
+const GROUP_KEYS: [&Key; 3] = [&ALGORITHM, &OUTPUT_FOLDER, &FILTER_PROFILE];
+
+/// 設定値
+struct Value {
+    value: String,
+    /// どこで指定された値か
+    source: String,
+}
+
+/// 設定
+/// 初期値 < 設定ファイル < 設定ファイルのグループの設定 < 環境変数 < コマンドラインオプションの順に優先する。
+pub struct Settings {
+    values: HashMap<&'static str, Value>,
+    /// 設定ファイルのグループごとの設定
+    group_values: HashMap<char, HashMap<&'static str, Value>>,
+    /// 環境変数かコマンドラインオプションで指定された設定項目の名前
+    overridden: HashSet<&'static str>,
+}
+
+/// 設定ファイルのパスを返す。
+fn settings_filepath(config_folder: &Path) -> PathBuf {
+    config_folder.join("bcbc.conf")
+}
+
+/// コマンドラインオプション名から設定項目を返す。
+/// 設定項目のオプションでなければNoneを返す。
+pub fn key_of_option(option_name: &str) -> Option<&'static Key> {
+    KEYS.iter()
+        .find(|key| key.option_name == option_name)
+        .copied()
+}
+
+impl Settings {
+    /// 設定ファイル、環境変数、コマンドラインオプションの順に読み込み、後から読み込んだ値で上書きする。
+    /// コマンドラインオプションは設定ファイルでの名前をキーにしたマップで渡す。
+    pub fn load(
+        config_folder: &Path,
+        envs: &HashMap<String, String>,
+        options: &HashMap<&'static str, String>,
+    ) -> Result<Settings, Errors> {
+        let (mut values, group_values) = load_settings_file(config_folder)?;
+        let mut overridden = HashSet::new();
+
+        for key in KEYS {
+            if let Some(value) = envs.get(key.env_name) {
+                values.insert(
+                    key.name,
+                    Value {
+                        value: value.clone(),
+                        source: format!("環境変数{}", key.env_name),
+                    },
+                );
+                overridden.insert(key.name);
+            }
+            if let Some(value) = options.get(key.name) {
+                values.insert(
+                    key.name,
+                    Value {
+                        value: value.clone(),
+                        source: format!("オプション{}", key.option_name),
+                    },
+                );
+                overridden.insert(key.name);
+            }
+        }
+
+        Ok(Settings {
+            values,
+            group_values,
+            overridden,
+        })
+    }
+
+    /// 設定値を返す。
+    pub fn get(&self, key: &Key) -> Option<&str> {
+        self.values.get(key.name).map(|value| value.value.as_str())
+    }
+
+    /// 設定ファイルでグループごとの設定があるグループの一覧を返す。
+    pub fn groups(&self) -> Vec<char> {
+        let mut groups: Vec<char> = self.group_values.keys().copied().collect();
+        groups.sort();
+        groups
+    }
+
+    /// 設定ファイルのグループの設定値を返す。
+    /// 環境変数かコマンドラインオプションで指定された設定項目はグループの設定より優先するのでNoneを返す。
+    pub fn group_get(&self, group: char, key: &Key) -> Option<&str> {
+        self.group_value(group, key)
+            .map(|value| value.value.as_str())
+    }
+
+    /// ハッシュアルゴリズムのグループの設定値を返す。
+    pub fn group_algorithm(&self, group: char, key: &Key) -> Result<Option<HashAlgorithm>, Errors> {
+        parse_algorithm(self.group_value(group, key))
+    }
+
+    /// 設定ファイルのグループの設定値を返す。
+    fn group_value(&self, group: char, key: &Key) -> Option<&Value> {
+        if self.overridden.contains(key.name) {
+            return None;
+        }
+        self.group_values
+            .get(&group)
+            .and_then(|group_values| group_values.get(key.name))
+    }
+
+    /// 1以上の整数の設定値を返す。
+    pub fn positive_number(&self, key: &Key) -> Result<Option<u64>, Errors> {
+        match self.values.get(key.name) {
+            None => Ok(None),
+            Some(value) => match value.value.parse::<u64>() {
+                Ok(number) if number > 0 => Ok(Some(number)),
+                _ => Err(log::make_error!(
+                    "{}の値が1以上の整数ではありません。: {}",
+                    value.source,
+                    value.value
+                )
+                .as_errors()),
+            },
+        }
+    }
+
+    /// 0以上の整数の設定値を返す。
+    pub fn number(&self, key: &Key) -> Result<Option<u64>, Errors> {
+        match self.values.get(key.name) {
+            None => Ok(None),
+            Some(value) => match value.value.parse::<u64>() {
+                Ok(number) => Ok(Some(number)),
+                _ => Err(log::make_error!(
+                    "{}の値が0以上の整数ではありません。: {}",
+                    value.source,
+                    value.value
+                )
+                .as_errors()),
+            },
+        }
+    }
+
+    /// 日時の設定値を返す。
+    pub fn datetime(&self, key: &Key) -> Result<Option<NaiveDateTime>, Errors> {
+        match self.values.get(key.name) {
+            None => Ok(None),
+            Some(value) => {
+                match NaiveDateTime::parse_from_str(&value.value, clock::FIXED_TIME_FORMAT) {
+                    Ok(datetime) => Ok(Some(datetime)),
+                    Err(_) => Err(log::make_error!(
+                        "{}の値が日時(YYYY-MM-DD HH:MM:SS)ではありません。: {}",
+                        value.source,
+                        value.value
+                    )
+                    .as_errors()),
+                }
+            }
+        }
+    }
+
+    /// ハッシュアルゴリズムの設定値を返す。
+    pub fn algorithm(&self, key: &Key) -> Result<Option<HashAlgorithm>, Errors> {
+        parse_algorithm(self.values.get(key.name))
+    }
+
+    /// カンマ区切りの複数のハッシュアルゴリズムの設定値を返す。
+    /// 同じアルゴリズムは1つにまとめる。
+    pub fn algorithms(&self, key: &Key) -> Result<Vec<HashAlgorithm>, Errors> {
+        let value = match self.values.get(key.name) {
+            None => return Ok(vec![]),
+            Some(value) => value,
+        };
+        let mut algorithms = vec![];
+        for name in value.value.split(',').map(|name| name.trim()) {
+            match HashAlgorithm::from_name(name) {
+                Some(algorithm) if algorithms.contains(&algorithm) => {}
+                Some(algorithm) => algorithms.push(algorithm),
+                None => return Err(log::make_error!(
+                    "{}の値がハッシュアルゴリズムではありません。(md5, sha1, sha256, sha512, blake2b, xxhash64, sha256-treeをカンマ区切り): {}",
+                    value.source,
+                    value.value
+                )
+                .as_errors()),
+            }
+        }
+        Ok(algorithms)
+    }
+
+    /// 種類で対象外にするファイルの設定値を返す。
+    pub fn skip_rules(&self, key: &Key) -> Result<SkipRules, Errors> {
+        match self.values.get(key.name) {
+            None => Ok(SkipRules::default()),
+            Some(value) => match SkipRules::from_names(&value.value) {
+                Some(skip_rules) => Ok(skip_rules),
+                None => Err(log::make_error!(
+                    "{}の値が不正です。(hidden, system, junk, noneをカンマ区切り): {}",
+                    value.source,
+                    value.value
+                )
+                .as_errors()),
+            },
+        }
+    }
+
+    /// シンボリックリンクの扱いの設定値を返す。
+    pub fn symlink_policy(&self, key: &Key) -> Result<SymlinkPolicy, Errors> {
+        match self.values.get(key.name) {
+            None => Ok(SymlinkPolicy::default()),
+            Some(value) => match SymlinkPolicy::from_name(&value.value) {
+                Some(symlink_policy) => Ok(symlink_policy),
+                None => Err(log::make_error!(
+                    "{}の値はskip、follow、recordのいずれかを指定してください。: {}",
+                    value.source,
+                    value.value
+                )
+                .as_errors()),
+            },
+        }
+    }
+
+    /// ハッシュ情報の保存先の設定値を返す。
+    pub fn hash_storage(&self, key: &Key) -> Result<HashStorage, Errors> {
+        match self.values.get(key.name) {
+            None => Ok(HashStorage::default()),
+            Some(value) => match HashStorage::from_name(&value.value) {
+                Some(hash_storage) => Ok(hash_storage),
+                None => Err(log::make_error!(
+                    "{}の値はtextかsqliteを指定してください。: {}",
+                    value.source,
+                    value.value
+                )
+                .as_errors()),
+            },
+        }
+    }
+
+    /// パスの正規化の手順の設定値を返す。
+    pub fn path_normalizer(&self, key: &Key) -> Result<PathNormalizer, Errors> {
+        match self.values.get(key.name) {
+            None => Ok(PathNormalizer::default()),
+            Some(value) => match PathNormalizer::from_names(&value.value) {
+                Some(path_normalizer) => Ok(path_normalizer),
+                None => Err(log::make_error!(
+                    "{}の値が不正です。(slash, nfc, strip:プレフィックス, noneをカンマ区切り): {}",
+                    value.source,
+                    value.value
+                )
+                .as_errors()),
+            },
+        }
+    }
+
+    /// メッセージの言語の設定値を返す。
+    pub fn language(&self, key: &Key) -> Result<Option<Language>, Errors> {
+        match self.values.get(key.name) {
+            None => Ok(None),
+            Some(value) => match Language::from_name(&value.value) {
+                Some(language) => Ok(Some(language)),
+                None => Err(log::make_error!(
+                    "{}の値はjaかenを指定してください。: {}",
+                    value.source,
+                    value.value
+                )
+                .as_errors()),
+            },
+        }
+    }
+}
+
+/// ハッシュアルゴリズムの設定値をパースする。
+fn parse_algorithm(value: Option<&Value>) -> Result<Option<HashAlgorithm>, Errors> {
+    match value {
+        None => Ok(None),
+        Some(value) => match HashAlgorithm::from_name(&value.value) {
+            Some(algorithm) => Ok(Some(algorithm)),
+            None => Err(log::make_error!(
+                "{}の値がハッシュアルゴリズムではありません。(md5, sha1, sha256, sha512, blake2b, xxhash64, sha256-tree): {}",
+                value.source,
+                value.value
+            )
+            .as_errors()),
+        },
+    }
+}
+
+/// 設定ファイルを読み込んで、全体の設定とグループごとの設定を返す。
+/// "[グループ名]"の行から次の"[...]"の行まではそのグループの設定とする。
+/// ファイルがなければ空のマップを返す。
+fn load_settings_file(
+    config_folder: &Path,
+) -> Result<
+    (
+        HashMap<&'static str, Value>,
+        HashMap<char, HashMap<&'static str, Value>>,
+    ),
+    Errors,
+> {
+    let settings_filepath = settings_filepath(config_folder);
+    if !settings_filepath.is_file() {
+        return Ok((HashMap::new(), HashMap::new()));
+    }
+
+    let settings = match fs::read_to_string(settings_filepath.as_path()) {
+        Ok(settings) => settings,
+        Err(error) => {
+            return Err(log::make_error!(
+                "設定ファイルが読み込めませんでした。: {}",
+                settings_filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors())
+        }
+    };
+
+    let mut values = HashMap::new();
+    let mut group_values: HashMap<char, HashMap<&'static str, Value>> = HashMap::new();
+    let mut group = None;
+    for (i, line) in settings.lines().enumerate() {
+        let line = line.trim();
+        // 空白行とコメント行は無視する
+        if line.len() == 0 || line.starts_with('#') {
+            continue;
+        }
+
+        if line.starts_with('[') && line.ends_with(']') {
+            let name = &line[1..line.len() - 1];
+            let mut chars = name.chars();
+            match (chars.next(), chars.next()) {
+                (Some(name), None) if name.is_ascii_uppercase() => {
+                    group_values.entry(name).or_default();
+                    group = Some(name);
+                }
+                _ => {
+                    return log::with_line_number(
+                        Err(log::make_error!("グループ名ではありません。: {}", name).as_errors()),
+                        settings_filepath.as_path(),
+                        i + 1,
+                    )
+                }
+            }
+            continue;
+        }
+
+        // "名前=値"の形式
+        // グループの設定ではグループごとに指定できる設定項目だけを使える
+        let keys: &[&Key] = match group {
+            Some(_) => &GROUP_KEYS,
+            None => &KEYS,
+        };
+        let key = line.split_once('=').and_then(|(name, value)| {
+            keys.iter()
+                .find(|key| key.name == name.trim())
+                .map(|key| (*key, value.trim()))
+        });
+        match key {
+            Some((key, value)) => {
+                let (values, source) = match group {
+                    Some(group) => (
+                        group_values.get_mut(&group).unwrap(),
+                        format!("設定ファイルのグループ{}の{}", group, key.name),
+                    ),
+                    None => (&mut values, format!("設定ファイルの{}", key.name)),
+                };
+                values.insert(
+                    key.name,
+                    Value {
+                        value: value.to_string(),
+                        source,
+                    },
+                );
+            }
+            None => {
+                return log::with_line_number(
+                    Err(log::make_error!("不明な設定です。: {}", line).as_errors()),
+                    settings_filepath.as_path(),
+                    i + 1,
+                )
+            }
+        }
+    }
+
+    Ok((values, group_values))
+}
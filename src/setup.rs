@@ -0,0 +1,311 @@
+use std::collections::HashMap;
+use std::fs;
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::disk;
+use crate::filter;
+use crate::log::{self, Errors};
+use crate::messages;
+use crate::registry::{self, DiskRegistry};
+use crate::run_options;
+use crate::settings::Settings;
+
+/// BCBCHOMEが設定されていない場合に提案するフォルダ
+const DEFAULT_HOME_FOLDER: &str = "~/.bcbc";
+
+/// 作成する設定ファイルの内容
+/// 全て初期値のままでよいので、設定はコメントにして書き方だけを示す。
+const SETTINGS_TEMPLATE: &str = "\
+# bcbcの設定
+# 1行に1つ\"名前=値\"の形式で書く。空白行と#から始まるコメント行は無視する。
+#
+# disks=2
+# workers=1
+# buffer-size=32
+# out=/mnt/NAS/bcbc/out
+# lang=en
+";
+
+/// 作成するフィルター設定ファイルの内容
+const FILTER_CONF_TEMPLATE: &str = include_str!("../configs/filter.conf.sample");
+
+/// コマンドライン引数が初期設定の作成の要求であるかを返す。
+/// 初期設定はBCBCHOMEがなくても作成できるよう、起動設定を読み込む前に判定する。
+pub fn requested_setup(args: &[String]) -> bool {
+    // 1つ目はこのプログラムのパス
+    args.get(1).map(|arg| arg.as_str()) == Some("setup")
+}
+
+/// 対話形式でBCBCHOME、設定ファイル、フィルター設定ファイル、最初のディスクのdiskファイルを作成する。
+/// 作成済みのファイルは変更せず、内容が正しいかだけを確認する。
+pub fn setup(envs: &HashMap<String, String>) -> Result<(), Errors> {
+    log::info("bcbcの初期設定を作成します。Enterキーだけを押すと[ ]内の値を使います。");
+
+    let home_env = envs.get("BCBCHOME");
+    let home_answer = ask(
+        "BCBCHOMEのフォルダ",
+        home_env
+            .map(|home| home.as_str())
+            .unwrap_or(DEFAULT_HOME_FOLDER),
+    )?;
+    let home_folder = run_options::tilde_to_home(PathBuf::from(&home_answer));
+    create_folder(home_folder.as_path())?;
+    if !atomic_write::is_writable(home_folder.as_path()) {
+        return Err(log::make_error!(
+            "フォルダに書き込めません。: {}",
+            home_folder.to_str().unwrap()
+        )
+        .as_errors());
+    }
+    let config_folder = home_folder.join("configs");
+    create_folder(config_folder.as_path())?;
+    create_folder(home_folder.join("out").as_path())?;
+
+    create_settings_file(config_folder.as_path())?;
+    create_filter_conf(config_folder.as_path())?;
+
+    let registry = registry::load_registry(home_folder.join("registry").as_path())?;
+    let disk_root = create_disk_file(&registry)?;
+
+    log::info("初期設定を作成しました。");
+    if home_env.map(|home| home.as_str()) != Some(home_answer.as_str()) {
+        log::info(format!("環境変数BCBCHOMEに{}を設定してください。", &home_answer).as_str());
+    }
+    match disk_root {
+        Some(disk_root) => log::info(
+            format!(
+                "bcbc check-config {0}で設定を確認し、bcbc {0}でハッシュ計算を開始できます。",
+                disk_root
+            )
+            .as_str(),
+        ),
+        None => log::info(
+            "ディスクのルートにdiskファイルを作成してから、ハッシュ計算を開始してください。",
+        ),
+    }
+
+    Ok(())
+}
+
+/// 質問を出力して回答を読み込む。
+/// 何も入力されないか入力が終わっていれば初期値を返す。
+fn ask(question: &str, default: &str) -> Result<String, Errors> {
+    if default.len() > 0 {
+        print!("{} [{}]: ", messages::translate(question), default);
+    } else {
+        print!("{}: ", messages::translate(question));
+    }
+    if let Err(error) = io::stdout().flush() {
+        return Err(log::make_error!("質問を表示できませんでした。")
+            .with(&error)
+            .as_errors());
+    }
+    let mut answer = String::new();
+    if let Err(error) = io::stdin().read_line(&mut answer) {
+        return Err(log::make_error!("回答を読み込めませんでした。")
+            .with(&error)
+            .as_errors());
+    }
+    let answer = answer.trim();
+    if answer.len() == 0 {
+        Ok(default.to_string())
+    } else {
+        Ok(answer.to_string())
+    }
+}
+
+/// フォルダがなければ作成する。
+fn create_folder(folder: &Path) -> Result<(), Errors> {
+    if folder.is_dir() {
+        log::info(format!("フォルダは作成済みです。: {}", folder.to_str().unwrap()).as_str());
+        return Ok(());
+    }
+    if let Err(error) = fs::create_dir_all(folder) {
+        return Err(log::make_error!(
+            "フォルダを作成できませんでした。: {}",
+            folder.to_str().unwrap()
+        )
+        .with(&error)
+        .as_errors());
+    }
+    log::info(format!("フォルダを作成しました。: {}", folder.to_str().unwrap()).as_str());
+    Ok(())
+}
+
+/// 設定ファイルがなければ作成する。
+/// 作成済みであれば読み込めるかを確認する。
+fn create_settings_file(config_folder: &Path) -> Result<(), Errors> {
+    let settings_filepath = config_folder.join("bcbc.conf");
+    if settings_filepath.is_file() {
+        Settings::load(config_folder, &HashMap::new(), &HashMap::new())?;
+        log::info(
+            format!(
+                "設定ファイルは作成済みのため変更しません。: {}",
+                settings_filepath.to_str().unwrap()
+            )
+            .as_str(),
+        );
+        return Ok(());
+    }
+
+    write_file(settings_filepath.as_path(), SETTINGS_TEMPLATE)?;
+    log::info(
+        format!(
+            "設定ファイルを作成しました。: {}",
+            settings_filepath.to_str().unwrap()
+        )
+        .as_str(),
+    );
+    Ok(())
+}
+
+/// フィルター設定ファイルがなければサンプルから作成する。
+/// 作成済みであれば正しく書かれているかを確認する。
+fn create_filter_conf(config_folder: &Path) -> Result<(), Errors> {
+    let filter_conf_file = config_folder.join("filter.conf");
+    if filter_conf_file.is_file() {
+        let filter_conf = match fs::read_to_string(filter_conf_file.as_path()) {
+            Ok(filter_conf) => filter_conf,
+            Err(error) => {
+                return Err(log::make_error!(
+                    "フィルター設定ファイルが読み込めませんでした。: {}",
+                    filter_conf_file.to_str().unwrap()
+                )
+                .with(&error)
+                .as_errors())
+            }
+        };
+        filter::parse_filters(&filter_conf)?;
+        log::info(
+            format!(
+                "フィルター設定ファイルは作成済みのため変更しません。: {}",
+                filter_conf_file.to_str().unwrap()
+            )
+            .as_str(),
+        );
+        return Ok(());
+    }
+
+    write_file(filter_conf_file.as_path(), FILTER_CONF_TEMPLATE)?;
+    log::info(
+        format!(
+            "フィルター設定ファイルを作成しました。: {}",
+            filter_conf_file.to_str().unwrap()
+        )
+        .as_str(),
+    );
+    Ok(())
+}
+
+/// ファイルを作成する。
+fn write_file(filepath: &Path, contents: &str) -> Result<(), Errors> {
+    match atomic_write::write(filepath, contents) {
+        Ok(_) => Ok(()),
+        Err(error) => Err(log::make_error!(
+            "ファイルを作成できませんでした。: {}",
+            filepath.to_str().unwrap()
+        )
+        .with(&error)
+        .as_errors()),
+    }
+}
+
+/// 最初のディスクのルートを尋ね、diskファイルがなければ作成する。
+/// ルートが入力されなければ作成しない。入力されたルートを返す。
+fn create_disk_file(registry: &DiskRegistry) -> Result<Option<String>, Errors> {
+    let (answer, disk_root) = loop {
+        let answer = ask(
+            "最初のディスクのルートフォルダ(省略するとスキップします)",
+            "",
+        )?;
+        if answer.len() == 0 {
+            return Ok(None);
+        }
+        let disk_root = run_options::tilde_to_home(PathBuf::from(&answer));
+        if disk_root.is_dir() {
+            break (answer, disk_root);
+        }
+        log::warn(format!("フォルダがありません。: {}", &answer).as_str());
+    };
+
+    let disk_file = disk_root.join("disk");
+    if disk_file.is_file() {
+        let contents = match fs::read_to_string(disk_file.as_path()) {
+            Ok(contents) => contents,
+            Err(error) => {
+                return Err(log::make_error!(
+                    "diskファイルが読み込めませんでした。: {}",
+                    disk_file.to_str().unwrap()
+                )
+                .with(&error)
+                .as_errors())
+            }
+        };
+        return match disk::read_disk_id(&contents) {
+            Some(disk_id) => {
+                log::info(
+                    format!(
+                        "diskファイルは作成済みです。: {} ({})",
+                        disk_file.to_str().unwrap(),
+                        disk_id
+                    )
+                    .as_str(),
+                );
+                Ok(Some(answer))
+            }
+            None => Err(log::make_error!(
+                "diskファイルのディスクIDが不正です。: {}",
+                disk_file.to_str().unwrap()
+            )
+            .as_errors()),
+        };
+    }
+
+    let default_disk_id = registry.unregistered_disk_id('A');
+    let disk_id = loop {
+        let disk_id = ask("ディスクID", &default_disk_id)?;
+        if !disk::DISK_ID_PATTERN.is_match(&disk_id) {
+            log::warn(
+                format!(
+                    "ディスクIDはグループ名の英大文字と連番にしてください。(例: A1): {}",
+                    &disk_id
+                )
+                .as_str(),
+            );
+            continue;
+        }
+        match registry.root_of(&disk_id) {
+            Some(registered_root) if !is_same_folder(registered_root, disk_root.as_path()) => {
+                log::warn(
+                    format!(
+                        "ディスクIDは別のディスクに登録済みです。: {} ({})",
+                        &disk_id,
+                        registered_root.to_str().unwrap()
+                    )
+                    .as_str(),
+                );
+            }
+            _ => break disk_id,
+        }
+    };
+
+    write_file(disk_file.as_path(), format!("{}\n", disk_id).as_str())?;
+    log::info(
+        format!(
+            "diskファイルを作成しました。: {}",
+            disk_file.to_str().unwrap()
+        )
+        .as_str(),
+    );
+    Ok(Some(answer))
+}
+
+/// 2つのパスが同じフォルダを指しているかを返す。
+fn is_same_folder(a: &Path, b: &Path) -> bool {
+    match (fs::canonicalize(a), fs::canonicalize(b)) {
+        (Ok(a), Ok(b)) => a == b,
+        _ => a == b,
+    }
+}
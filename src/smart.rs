@@ -0,0 +1,186 @@
+use std::fs::{self, OpenOptions};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+use serde_json::Value;
+
+use crate::clock;
+use crate::disk::DiskInfo;
+use crate::log::{self, Errors};
+
+/// 記録するSMART属性のIDと名前
+const SMART_ATTRIBUTES: [(u64, &str); 3] = [
+    (5, "代替処理済みセクタ"),
+    (197, "代替保留中セクタ"),
+    (198, "回復不能セクタ"),
+];
+
+/// SMART情報の履歴を保存するフォルダを返す。
+fn smart_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("smart")
+}
+
+/// 各ディスクのデバイスのSMART情報をsmartctlで取得し、ログと履歴に出力する。
+/// 取得できなかったディスクは警告を出して処理を続ける。
+pub fn capture_smart_data(
+    output_folder: &Path,
+    disk_info_list: &Vec<DiskInfo>,
+) -> Result<(), Errors> {
+    for disk_info in disk_info_list {
+        let device = match device_of(disk_info.root_path.as_path()) {
+            Some(device) => device,
+            None => {
+                log::warn(
+                    format!(
+                        "{}: ディスクルートのデバイスが分かりませんでした。",
+                        &disk_info.id
+                    )
+                    .as_str(),
+                );
+                continue;
+            }
+        };
+
+        let attributes = match read_smart_attributes(&device) {
+            Ok(attributes) => attributes,
+            Err(errors) => {
+                log::warn(
+                    format!(
+                        "{}: SMART情報を取得できませんでした。: {}",
+                        &disk_info.id, device
+                    )
+                    .as_str(),
+                );
+                log::log_errors(errors);
+                continue;
+            }
+        };
+
+        let mut line = format!("{}: SMART {}", &disk_info.id, device);
+        let mut has_problem = false;
+        for (name, value) in attributes.iter() {
+            line.push_str(format!(" {}={}", name, value).as_str());
+            has_problem |= *value > 0;
+        }
+        if has_problem {
+            log::warn(line.as_str());
+        } else {
+            log::info(line.as_str());
+        }
+
+        write_smart_history(output_folder, &disk_info.id, &device, &attributes)?;
+    }
+
+    Ok(())
+}
+
+/// ディスクルートがあるデバイスを返す。
+#[cfg(windows)]
+pub fn device_of(root: &Path) -> Option<String> {
+    // smartctlはドライブ文字でデバイスを指定できる
+    let root = root.to_str()?;
+    match root.find(':') {
+        Some(i) => Some(root[..=i].to_string()),
+        None => None,
+    }
+}
+
+/// ディスクルートがあるデバイスを返す。
+#[cfg(not(windows))]
+pub fn device_of(root: &Path) -> Option<String> {
+    // dfの2行目の1列目がデバイス
+    let output = Command::new("df").arg("-P").arg(root).output().ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    let output = String::from_utf8_lossy(&output.stdout).to_string();
+    let line = output.lines().nth(1)?;
+    let device = line.split_whitespace().next()?;
+    if device.starts_with("/dev/") {
+        Some(device.to_string())
+    } else {
+        None
+    }
+}
+
+/// smartctlを実行してSMART属性の生の値を取得する。
+fn read_smart_attributes(device: &str) -> Result<Vec<(&'static str, u64)>, Errors> {
+    let output = match Command::new("smartctl")
+        .arg("--json")
+        .arg("-A")
+        .arg(device)
+        .output()
+    {
+        Ok(output) => output,
+        Err(error) => {
+            return Err(log::make_error!("smartctlを実行できませんでした。")
+                .with(&error)
+                .as_errors())
+        }
+    };
+
+    // smartctlは問題を検出すると0以外で終了するため、終了コードではなく出力で判断する
+    let json: Value = match serde_json::from_slice(&output.stdout) {
+        Ok(json) => json,
+        Err(error) => {
+            return Err(log::make_error!("smartctlの出力を解析できませんでした。")
+                .with(&error)
+                .as_errors())
+        }
+    };
+
+    let table = match json["ata_smart_attributes"]["table"].as_array() {
+        Some(table) => table,
+        None => return Err(log::make_error!("smartctlの出力にSMART属性がありません。").as_errors()),
+    };
+
+    let mut attributes = vec![];
+    for (id, name) in SMART_ATTRIBUTES.iter() {
+        let value = table
+            .iter()
+            .find(|attribute| attribute["id"].as_u64() == Some(*id))
+            .and_then(|attribute| attribute["raw"]["value"].as_u64());
+        if let Some(value) = value {
+            attributes.push((*name, value));
+        }
+    }
+
+    Ok(attributes)
+}
+
+/// SMART属性を履歴に追記する。
+/// 1行に日時、デバイス、各属性を"名前=値"の形式でタブ区切りで出力する。
+fn write_smart_history(
+    output_folder: &Path,
+    disk_id: &str,
+    device: &str,
+    attributes: &Vec<(&'static str, u64)>,
+) -> Result<(), Errors> {
+    let smart_folder = smart_folder(output_folder);
+    if let Err(error) = fs::create_dir_all(smart_folder.as_path()) {
+        return Err(
+            log::make_error!("SMART情報の履歴フォルダを作成できませんでした。")
+                .with(&error)
+                .as_errors(),
+        );
+    }
+
+    let mut line = format!("{}\t{}", clock::now().format("%Y-%m-%d %H:%M:%S"), device);
+    for (name, value) in attributes.iter() {
+        line.push_str(format!("\t{}={}", name, value).as_str());
+    }
+    line.push('\n');
+
+    let result = OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(smart_folder.join(disk_id))
+        .and_then(|mut file| file.write_all(line.as_bytes()));
+    match result {
+        Ok(_) => Ok(()),
+        Err(error) => Err(log::make_error!("SMART情報の記録に失敗しました。")
+            .with(&error)
+            .as_errors()),
+    }
+}
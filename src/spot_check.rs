@@ -0,0 +1,188 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::calc;
+use crate::disk::{self, DiskInfo};
+use crate::filter::{self, Filters, SymlinkPolicy};
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::mismatch_report;
+use crate::run_options::RunOptions;
+use crate::target_file::TargetFile;
+
+/// 指定されたファイルを、それぞれを含むディスクのハッシュファイルで検証する。
+/// ハッシュファイルを編集しなくても、1つのファイルが壊れていないかをすぐに確認できるようにする。
+/// ハッシュが異なるファイル、ハッシュファイルにないファイル、読み込めないファイルをエラーにする。
+pub fn check_files(run_options: &RunOptions) -> Result<(), Errors> {
+    let mut errors: Errors = vec![];
+    let mut number_of_mismatched = 0;
+    for filepath in run_options.check_filepaths() {
+        match check_file(run_options, filepath.as_path()) {
+            Ok(true) => {}
+            Ok(false) => number_of_mismatched += 1,
+            Err(mut file_errors) => errors.append(&mut file_errors),
+        }
+    }
+
+    // ハッシュが異なるファイルがあれば検証の差異と同じ終了コードにする
+    if number_of_mismatched > 0 {
+        mismatch_report::set_mismatched(true);
+        errors.push(log::make_error!(
+            "{}件のファイルのハッシュが異なります。",
+            number_of_mismatched
+        ));
+    }
+    if errors.len() > 0 {
+        return Err(errors);
+    }
+    Ok(())
+}
+
+/// 1つのファイルを検証し、ハッシュが一致したかを返す。
+fn check_file(run_options: &RunOptions, filepath: &Path) -> Result<bool, Errors> {
+    let link_metadata = match fs::symlink_metadata(filepath) {
+        Ok(link_metadata) => link_metadata,
+        Err(error) => {
+            return Err(
+                log::make_error!("ファイルがありません。: {}", filepath.to_str().unwrap())
+                    .with(&error)
+                    .as_errors(),
+            )
+        }
+    };
+
+    // シンボリックリンクを辿らないよう、フォルダだけを絶対パスにしてディスクを探す
+    let folder = match filepath.parent() {
+        Some(folder) if folder.as_os_str().len() > 0 => folder,
+        _ => Path::new("."),
+    };
+    let disk_info = disk::find_disk_containing(folder)?;
+    let filters = filter::load_group_filters(run_options, disk_info.group())?;
+    let link_target = link_target_of(&filters, filepath, &link_metadata)?;
+    let size = match &link_target {
+        Some(_) => link_metadata.len(),
+        None => match fs::metadata(filepath) {
+            Ok(metadata) if metadata.is_file() => metadata.len(),
+            _ => {
+                return Err(log::make_error!(
+                    "ファイルではありません。: {}",
+                    filepath.to_str().unwrap()
+                )
+                .as_errors())
+            }
+        },
+    };
+    let actual_path = absolute_path(folder, filepath)?;
+    let normalized_path = normalized_path_of(&filters, &disk_info, actual_path, size);
+
+    let hash_filepath = run_options
+        .output_folder_of(disk_info.group())
+        .join(&disk_info.id);
+    if !hash_filepath.is_file() {
+        return Err(
+            log::make_error!("{}: ハッシュファイルがありません。", &disk_info.id).as_errors(),
+        );
+    }
+    let algorithm = hash_file::resolve_algorithm(hash_filepath.as_path(), None)?;
+    let hash_info_map = hash_file::load_hash_info(hash_filepath.as_path())?;
+    let expected_hash = match hash_info_map.get(normalized_path.as_path()) {
+        Some(expected_hash) => expected_hash,
+        None => {
+            return Err(log::make_error!(
+                "{}: ハッシュファイルに記録されていないファイルです。: {}",
+                &disk_info.id,
+                normalized_path.to_str().unwrap()
+            )
+            .as_errors())
+        }
+    };
+
+    let hash = match &link_target {
+        Some(link_target) => calc::calc_link_target_hash(link_target, algorithm),
+        None => {
+            let mut buffer = vec![0u8; run_options.buffer_size().unwrap_or(calc::BUFFER_SIZE)];
+            calc::calc_file_hash(filepath, &mut buffer, algorithm)
+                .map_err(|file_error| file_error.error.as_errors())?
+        }
+    };
+    if &hash != expected_hash {
+        log::error(
+            format!(
+                "{}: ハッシュが異なります。: {}",
+                &disk_info.id,
+                normalized_path.to_str().unwrap()
+            )
+            .as_str(),
+        );
+        return Ok(false);
+    }
+    log::info(
+        format!(
+            "{}: ハッシュが一致しました。: {}",
+            &disk_info.id,
+            normalized_path.to_str().unwrap()
+        )
+        .as_str(),
+    );
+    Ok(true)
+}
+
+/// シンボリックリンクのリンク先を記録する設定であれば、リンク先を返す。
+/// シンボリックリンクを対象外にする設定であればエラーを返す。
+fn link_target_of(
+    filters: &Filters,
+    filepath: &Path,
+    link_metadata: &fs::Metadata,
+) -> Result<Option<PathBuf>, Errors> {
+    if !link_metadata.file_type().is_symlink() {
+        return Ok(None);
+    }
+    match filters.symlink_policy() {
+        SymlinkPolicy::Follow => Ok(None),
+        SymlinkPolicy::Skip => Err(log::make_error!(
+            "シンボリックリンクは対象外です。: {}",
+            filepath.to_str().unwrap()
+        )
+        .as_errors()),
+        SymlinkPolicy::Record => match fs::read_link(filepath) {
+            Ok(link_target) => Ok(Some(link_target)),
+            Err(error) => Err(log::make_error!(
+                "シンボリックリンクのリンク先を読み込めません。: {}",
+                filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors()),
+        },
+    }
+}
+
+/// ファイルのパスを、フォルダだけを絶対パスにしたパスにする。
+fn absolute_path(folder: &Path, filepath: &Path) -> Result<PathBuf, Errors> {
+    match fs::canonicalize(folder) {
+        Ok(folder) => Ok(folder.join(filepath.file_name().unwrap())),
+        Err(error) => Err(log::make_error!(
+            "パスを絶対パスにできませんでした。: {}",
+            folder.to_str().unwrap()
+        )
+        .with(&error)
+        .as_errors()),
+    }
+}
+
+/// ファイルのハッシュファイルでのパスを返す。
+/// ハッシュ計算と同じく、ディスクのグループのパスの正規化を適用する。
+fn normalized_path_of(
+    filters: &Filters,
+    disk_info: &DiskInfo,
+    actual_path: PathBuf,
+    size: u64,
+) -> PathBuf {
+    let target_file = TargetFile::new(
+        disk_info.root_path.as_path(),
+        Path::new(""),
+        actual_path,
+        size,
+        filters.path_normalizer(),
+    );
+    target_file.normalized_path().to_path_buf()
+}
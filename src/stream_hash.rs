@@ -0,0 +1,134 @@
+use std::fs::File;
+use std::io::{self, Read, Write};
+use std::path::{Path, PathBuf};
+
+use unicode_normalization::UnicodeNormalization;
+
+use crate::hash_algorithm::{Digest, HashAlgorithm};
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::seal;
+
+/// ハッシュファイルへの記録先
+pub struct StreamTarget<'a> {
+    /// ディスクID
+    pub disk_id: &'a str,
+    /// ハッシュファイルに記録するパス
+    pub pseudo_path: &'a str,
+}
+
+/// 標準入力か名前付きパイプなどのファイルからデータを読み込んでハッシュを計算する。
+/// 入力ごとに"ハッシュ サイズ 入力名"をタブ区切りで1行出力する。
+/// 記録先が指定された場合はそのディスクのハッシュファイルに記録する。
+/// 記録先のハッシュファイルがあればそのアルゴリズムで計算する。
+pub fn hash_streams(
+    output_folder: &Path,
+    inputs: &Vec<String>,
+    target: Option<StreamTarget>,
+    algorithm: Option<HashAlgorithm>,
+    buffer_size: usize,
+) -> Result<(), Errors> {
+    let algorithm = match &target {
+        Some(target) => {
+            if seal::is_sealed(output_folder, target.disk_id) {
+                return Err(log::make_error!(
+                    "ディスク{}は封印されているため記録できません。",
+                    target.disk_id
+                )
+                .as_errors());
+            }
+            hash_file::resolve_algorithm(output_folder.join(target.disk_id).as_path(), algorithm)?
+        }
+        None => algorithm.unwrap_or(HashAlgorithm::Md5),
+    };
+
+    let mut buffer = vec![0u8; buffer_size];
+
+    for input in inputs {
+        let (hash, size) = if input == "-" {
+            read_stream(&mut io::stdin().lock(), input, &mut buffer, algorithm)?
+        } else {
+            match File::open(input) {
+                Ok(mut file) => read_stream(&mut file, input, &mut buffer, algorithm)?,
+                Err(error) => {
+                    return Err(log::make_error!("入力を開けませんでした。: {}", input)
+                        .with(&error)
+                        .as_errors())
+                }
+            }
+        };
+
+        println!("{}\t{}\t{}", hex::encode(hash.to_vec()), size, input);
+
+        if let Some(target) = &target {
+            record_hash(output_folder, target, algorithm, &hash)?;
+        }
+    }
+
+    Ok(())
+}
+
+/// 入力を最後まで読み込んでハッシュとバイト数を返す。
+fn read_stream(
+    reader: &mut dyn Read,
+    input: &str,
+    buffer: &mut [u8],
+    algorithm: HashAlgorithm,
+) -> Result<(Digest, u64), Errors> {
+    let mut context = algorithm.context();
+    let mut size = 0;
+
+    loop {
+        let red_size = match reader.read(buffer) {
+            Ok(red_size) => red_size,
+            Err(error) if error.kind() == io::ErrorKind::Interrupted => continue,
+            Err(error) => {
+                return Err(log::make_error!("入力を読み込めません。: {}", input)
+                    .with(&error)
+                    .as_errors())
+            }
+        };
+        if red_size == 0 {
+            break;
+        }
+
+        context.consume(&buffer[..red_size]);
+        size += red_size as u64;
+    }
+
+    Ok((context.compute(), size))
+}
+
+/// ディスクのハッシュファイルに指定されたパスでハッシュを追記する。
+fn record_hash(
+    output_folder: &Path,
+    target: &StreamTarget,
+    algorithm: HashAlgorithm,
+    hash: &Digest,
+) -> Result<(), Errors> {
+    hash_file::ensure_output_folder(output_folder)?;
+
+    // ハッシュファイルの他のパスに合わせてスラッシュ区切りのNFCにする
+    let pseudo_path = PathBuf::from(target.pseudo_path.replace('\\', "/").nfc().to_string());
+
+    let hash_filepath = output_folder.join(target.disk_id);
+    hash_file::prepare_hash_file(hash_filepath.as_path(), algorithm)?;
+    let mut hash_file = hash_file::open_hash_file(hash_filepath.as_path())?;
+    let hash_file_line = hash_file::add_hash_file_line(String::new(), pseudo_path.as_path(), hash);
+    if let Err(error) = hash_file.write_all(hash_file_line.as_bytes()) {
+        return Err(log::make_error!("ハッシュファイルに書き込めません。")
+            .with(&error)
+            .as_errors());
+    }
+
+    log::info(
+        format!(
+            "{}: {}として記録しました。",
+            target.disk_id,
+            pseudo_path.to_str().unwrap()
+        )
+        .as_str(),
+    );
+
+    Ok(())
+}
@@ -0,0 +1,91 @@
+use std::path::Path;
+
+/// 代替データストリームを扱えるか
+pub const SUPPORTED: bool = cfg!(windows);
+
+/// ファイルの代替データストリームの名前とバイト数を一覧にする。
+/// メインのストリームは含めない。取得できなければ空の一覧を返す。
+#[cfg(windows)]
+pub fn list_alternate_streams(path: &Path) -> Vec<(String, u64)> {
+    use std::ffi::c_void;
+    use std::os::windows::ffi::OsStrExt;
+
+    /// WIN32_FIND_STREAM_DATA
+    #[repr(C)]
+    struct FindStreamData {
+        stream_size: i64,
+        /// MAX_PATH + 36
+        stream_name: [u16; 296],
+    }
+
+    #[link(name = "kernel32")]
+    extern "system" {
+        fn FindFirstStreamW(
+            file_name: *const u16,
+            info_level: i32,
+            find_stream_data: *mut c_void,
+            flags: u32,
+        ) -> *mut c_void;
+        fn FindNextStreamW(find_stream: *mut c_void, find_stream_data: *mut c_void) -> i32;
+        fn FindClose(find_file: *mut c_void) -> i32;
+    }
+
+    /// FindStreamInfoStandard
+    const FIND_STREAM_INFO_STANDARD: i32 = 0;
+    const INVALID_HANDLE_VALUE: *mut c_void = -1isize as *mut c_void;
+
+    let file_name: Vec<u16> = path.as_os_str().encode_wide().chain(Some(0)).collect();
+    let mut data = FindStreamData {
+        stream_size: 0,
+        stream_name: [0; 296],
+    };
+
+    let mut streams = vec![];
+    unsafe {
+        let handle = FindFirstStreamW(
+            file_name.as_ptr(),
+            FIND_STREAM_INFO_STANDARD,
+            &mut data as *mut FindStreamData as *mut c_void,
+            0,
+        );
+        if handle == INVALID_HANDLE_VALUE {
+            return streams;
+        }
+        loop {
+            let length = data
+                .stream_name
+                .iter()
+                .position(|c| *c == 0)
+                .unwrap_or(data.stream_name.len());
+            let stream_name = String::from_utf16_lossy(&data.stream_name[..length]);
+            if let Some(stream_name) = parse_stream_name(&stream_name) {
+                streams.push((stream_name.to_string(), data.stream_size as u64));
+            }
+            if FindNextStreamW(handle, &mut data as *mut FindStreamData as *mut c_void) == 0 {
+                break;
+            }
+        }
+        FindClose(handle);
+    }
+
+    streams
+}
+
+/// ファイルの代替データストリームの名前とバイト数を一覧にする。
+/// Windows以外では代替データストリームがないので空の一覧を返す。
+#[cfg(not(windows))]
+pub fn list_alternate_streams(_path: &Path) -> Vec<(String, u64)> {
+    vec![]
+}
+
+/// ":名前:$DATA"の形式のストリーム名から名前を取り出す。
+/// メインのストリーム("::$DATA")ならNoneを返す。
+#[cfg(windows)]
+fn parse_stream_name(stream_name: &str) -> Option<&str> {
+    let name = stream_name.strip_prefix(':')?.strip_suffix(":$DATA")?;
+    if name.len() == 0 {
+        None
+    } else {
+        Some(name)
+    }
+}
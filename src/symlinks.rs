@@ -0,0 +1,107 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::log::{self, Errors};
+use crate::target_file;
+
+/// シンボリックリンクのリンク先の記録を保存するフォルダを返す。
+fn symlinks_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("symlinks")
+}
+
+/// リンク先を記録するシンボリックリンクの正規化ファイルパスとリンク先を保存する。
+/// ハッシュファイルにはリンク先のパスのハッシュしか残らないため、リンク先自体を読める形で残す。
+/// 範囲が指定された場合は、範囲外のシンボリックリンクの前回の記録をそのまま残す。
+pub fn record_link_targets(
+    output_folder: &Path,
+    disk_id: &str,
+    symlinks: Vec<(PathBuf, PathBuf)>,
+    scope: Option<&Path>,
+) -> Result<(), Errors> {
+    let symlinks_filepath = symlinks_folder(output_folder).join(disk_id);
+    let mut link_targets: BTreeMap<PathBuf, PathBuf> =
+        load_link_targets(symlinks_filepath.as_path())?
+            .into_iter()
+            .filter(|(path, _)| !target_file::is_in_scope(path, scope))
+            .collect();
+    link_targets.extend(symlinks);
+    // シンボリックリンクがなく前回の記録もなければ何も作成しない
+    if link_targets.len() == 0 && !symlinks_filepath.is_file() {
+        return Ok(());
+    }
+    write_link_targets(symlinks_filepath.as_path(), &link_targets)
+}
+
+/// シンボリックリンクのリンク先の記録を読み込む。
+/// 記録がなければ空のマップを返す。
+fn load_link_targets(symlinks_filepath: &Path) -> Result<BTreeMap<PathBuf, PathBuf>, Errors> {
+    let mut link_targets = BTreeMap::new();
+    if !symlinks_filepath.is_file() {
+        return Ok(link_targets);
+    }
+
+    let contents = match fs::read_to_string(symlinks_filepath) {
+        Ok(contents) => contents,
+        Err(error) => {
+            return Err(log::make_error!(
+                "シンボリックリンクのリンク先の記録を読み込めませんでした。"
+            )
+            .with(&error)
+            .as_errors())
+        }
+    };
+
+    for (i, line) in contents.lines().enumerate() {
+        match line.split_once('\t') {
+            Some((path, link_target)) => {
+                link_targets.insert(PathBuf::from(path), PathBuf::from(link_target));
+            }
+            None => {
+                return log::with_line_number(
+                    Err(
+                        log::make_error!("シンボリックリンクのリンク先の記録の形式が不正です。")
+                            .as_errors(),
+                    ),
+                    symlinks_filepath,
+                    i + 1,
+                )
+            }
+        }
+    }
+
+    Ok(link_targets)
+}
+
+/// シンボリックリンクのリンク先を記録する。
+/// 1行に"パス リンク先"をタブ区切りで出力する。
+fn write_link_targets(
+    symlinks_filepath: &Path,
+    link_targets: &BTreeMap<PathBuf, PathBuf>,
+) -> Result<(), Errors> {
+    if let Err(error) = fs::create_dir_all(symlinks_filepath.parent().unwrap()) {
+        return Err(log::make_error!(
+            "シンボリックリンクのリンク先の記録フォルダを作成できませんでした。"
+        )
+        .with(&error)
+        .as_errors());
+    }
+
+    let mut contents = String::new();
+    for (path, link_target) in link_targets {
+        contents.push_str(path.to_str().unwrap());
+        contents.push('\t');
+        contents.push_str(link_target.to_string_lossy().as_ref());
+        contents.push('\n');
+    }
+
+    match atomic_write::write(symlinks_filepath, &contents) {
+        Ok(_) => Ok(()),
+        Err(error) => Err(
+            log::make_error!("シンボリックリンクのリンク先の記録に失敗しました。")
+                .with(&error)
+                .as_errors(),
+        ),
+    }
+}
@@ -0,0 +1,222 @@
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::clock;
+use crate::hash_algorithm::{Digest, HashAlgorithm};
+use crate::hash_file::{self, FileStamp};
+use crate::log::{self, Errors};
+use crate::merged_hash_file;
+use crate::seal;
+
+/// 競合
+/// 同じファイルのハッシュが両方の環境で異なり、どちらが新しいか判断できなかったもの。
+struct Conflict {
+    target_filepath: PathBuf,
+    local_hash: Digest,
+    source_hash: Digest,
+}
+
+/// 取り込み結果
+struct SyncResult {
+    hash_info_map: HashMap<PathBuf, Digest>,
+    /// 取り込み元の内容を採用したファイル
+    imported_filepaths: Vec<PathBuf>,
+    number_of_added: usize,
+    number_of_replaced: usize,
+    conflicts: Vec<Conflict>,
+}
+
+/// 他の環境の出力フォルダにあるハッシュファイルをこの環境のハッシュファイルに取り込む。
+/// ハッシュファイルはディスクのグループの出力フォルダに取り込む。
+pub fn sync_hash_files<'a>(
+    output_folder_of: impl Fn(char) -> &'a Path,
+    source_folder: &Path,
+) -> Result<(), Errors> {
+    log::info("ハッシュファイルの取り込みを開始します。");
+
+    let source_hash_files = merged_hash_file::find_hash_files(source_folder)?;
+
+    // 1つのハッシュファイルで問題が発生しても他のハッシュファイルは取り込む
+    let mut errors = vec![];
+    for source_hash_file in source_hash_files {
+        let disk_id = source_hash_file.file_name().unwrap().to_str().unwrap();
+        let output_folder = output_folder_of(disk_id.chars().next().unwrap());
+        if let Err(mut sync_errors) = sync_hash_file(output_folder, source_hash_file.as_path()) {
+            errors.append(&mut sync_errors);
+        }
+    }
+
+    log::info("ハッシュファイルの取り込みを終了しました。");
+
+    if errors.len() == 0 {
+        Ok(())
+    } else {
+        Err(errors)
+    }
+}
+
+/// ハッシュファイルを1つ取り込む。
+fn sync_hash_file(output_folder: &Path, source_filepath: &Path) -> Result<(), Errors> {
+    let disk_id = source_filepath.file_name().unwrap().to_str().unwrap();
+    let local_filepath = output_folder.join(disk_id);
+
+    // 封印されたディスクのハッシュファイルは変更しない
+    if seal::is_sealed(output_folder, disk_id) {
+        log::warn(format!("{}: 封印されたディスクのため取り込みません。", disk_id).as_str());
+        return Ok(());
+    }
+
+    // アルゴリズムが異なるハッシュファイルは取り込めない
+    let source_algorithm =
+        hash_file::read_algorithm(source_filepath)?.unwrap_or(HashAlgorithm::Md5);
+    let algorithm = hash_file::resolve_algorithm(local_filepath.as_path(), Some(source_algorithm))?;
+
+    // 両方のハッシュファイルを読み込む
+    let local_hash_info_map = hash_file::load_hash_info(local_filepath.as_path())?;
+    let source_hash_info_map = hash_file::load_hash_info(source_filepath)?;
+    let mut stamp_map = hash_file::load_file_stamps(local_filepath.as_path())?;
+    let mut source_stamp_map = hash_file::load_file_stamps(source_filepath)?;
+
+    let sync_result = merge_hash_info(
+        local_hash_info_map,
+        source_hash_info_map,
+        &stamp_map,
+        &source_stamp_map,
+    );
+
+    // 取り込み元の内容を採用したファイルは取り込み元のバイト数と更新日時にする
+    for target_filepath in sync_result.imported_filepaths.iter() {
+        match source_stamp_map.remove(target_filepath) {
+            Some(stamp) => stamp_map.insert(target_filepath.clone(), stamp),
+            None => stamp_map.remove(target_filepath),
+        };
+    }
+
+    hash_file::write_calculated_hash_with_stamps(
+        local_filepath.as_path(),
+        algorithm,
+        sync_result.hash_info_map,
+        &stamp_map,
+    )?;
+
+    log::info(
+        format!(
+            "{}: 追加 {}件 / 更新 {}件 / 競合 {}件",
+            disk_id,
+            sync_result.number_of_added,
+            sync_result.number_of_replaced,
+            sync_result.conflicts.len()
+        )
+        .as_str(),
+    );
+
+    if sync_result.conflicts.len() > 0 {
+        let report_filepath =
+            write_conflict_report(output_folder, disk_id, &sync_result.conflicts)?;
+        log::warn(
+            format!(
+                "{}: ハッシュが異なるファイルがあります。この環境の内容を残しました。: {}",
+                disk_id,
+                report_filepath.to_str().unwrap()
+            )
+            .as_str(),
+        );
+    }
+
+    Ok(())
+}
+
+/// 2つのハッシュ情報マップを統合する。
+/// 片方にしかないファイルはそのまま取り込み、ハッシュが異なるファイルは行に記録された対象ファイルの更新日時が新しい方を採用する。
+/// どちらかの行に更新日時が記録されていないか、更新日時が同じで判断できない場合はこの環境の内容を残して競合とする。
+fn merge_hash_info(
+    mut local_hash_info_map: HashMap<PathBuf, Digest>,
+    source_hash_info_map: HashMap<PathBuf, Digest>,
+    local_stamp_map: &HashMap<PathBuf, FileStamp>,
+    source_stamp_map: &HashMap<PathBuf, FileStamp>,
+) -> SyncResult {
+    let mut imported_filepaths = vec![];
+    let mut number_of_added = 0;
+    let mut number_of_replaced = 0;
+    let mut conflicts = vec![];
+
+    for (target_filepath, source_hash) in source_hash_info_map {
+        match local_hash_info_map.get(&target_filepath) {
+            None => {
+                imported_filepaths.push(target_filepath.clone());
+                local_hash_info_map.insert(target_filepath, source_hash);
+                number_of_added += 1;
+            }
+            Some(local_hash) if *local_hash == source_hash => {}
+            Some(local_hash) => match (
+                local_stamp_map.get(&target_filepath),
+                source_stamp_map.get(&target_filepath),
+            ) {
+                (Some(local_stamp), Some(source_stamp))
+                    if source_stamp.modified > local_stamp.modified =>
+                {
+                    imported_filepaths.push(target_filepath.clone());
+                    local_hash_info_map.insert(target_filepath, source_hash);
+                    number_of_replaced += 1;
+                }
+                (Some(local_stamp), Some(source_stamp))
+                    if local_stamp.modified > source_stamp.modified => {}
+                _ => conflicts.push(Conflict {
+                    local_hash: *local_hash,
+                    target_filepath,
+                    source_hash,
+                }),
+            },
+        }
+    }
+
+    // レポートの行の順序が実行ごとに変わらないようパス順に並べる
+    conflicts.sort_by(|a, b| a.target_filepath.cmp(&b.target_filepath));
+
+    SyncResult {
+        hash_info_map: local_hash_info_map,
+        imported_filepaths,
+        number_of_added,
+        number_of_replaced,
+        conflicts,
+    }
+}
+
+/// 競合の一覧をファイルに出力する。
+/// 1行に対象ファイルのパス、この環境のハッシュ、取り込み元のハッシュをコロン区切りで出力する。
+fn write_conflict_report(
+    output_folder: &Path,
+    disk_id: &str,
+    conflicts: &Vec<Conflict>,
+) -> Result<PathBuf, Errors> {
+    let report_folder = output_folder.join("conflicts");
+    if let Err(error) = fs::create_dir_all(report_folder.as_path()) {
+        return Err(
+            log::make_error!("競合レポートのフォルダを作成できませんでした。")
+                .with(&error)
+                .as_errors(),
+        );
+    }
+
+    let timestamp = clock::now().format("%Y%m%d%H%M%S");
+    let report_filepath = report_folder.join(format!("{}-{}", disk_id, timestamp));
+
+    let mut report_contents = String::new();
+    for conflict in conflicts {
+        report_contents.push_str(conflict.target_filepath.to_str().unwrap());
+        report_contents.push(':');
+        report_contents.push_str(hex::encode(conflict.local_hash.to_vec()).as_str());
+        report_contents.push(':');
+        report_contents.push_str(hex::encode(conflict.source_hash.to_vec()).as_str());
+        report_contents.push('\n');
+    }
+
+    match atomic_write::write(report_filepath.as_path(), &report_contents) {
+        Ok(_) => Ok(report_filepath),
+        Err(error) => Err(log::make_error!("競合レポートの作成に失敗しました。")
+            .with(&error)
+            .as_errors()),
+    }
+}
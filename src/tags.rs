@@ -0,0 +1,261 @@
+use std::collections::{BTreeMap, HashMap};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::disk;
+use crate::log::{self, Errors};
+use crate::target_file;
+
+/// タグを付ける対象
+/// ディスクIDとディスクルートからの相対パスで、パスがフォルダならその配下の全ファイルが対象になる。
+pub struct TagTarget {
+    pub disk_id: String,
+    pub path: PathBuf,
+}
+
+impl TagTarget {
+    /// "ディスクID:パス"の形式の文字列から対象を作成する。
+    /// パスを省略した場合はディスク全体を対象にする。
+    pub fn parse(value: &str) -> Result<TagTarget, Errors> {
+        let (disk_id, path) = value.split_once(':').unwrap_or((value, ""));
+        let path = target_file::normalize_relative_path(path);
+        match path {
+            Some(path) if disk::DISK_ID_PATTERN.is_match(disk_id) => Ok(TagTarget {
+                disk_id: disk_id.to_string(),
+                path,
+            }),
+            _ => Err(log::make_error!(
+                "タグの対象は\"ディスクID:パス\"の形式で指定してください。: {}",
+                value
+            )
+            .as_errors()),
+        }
+    }
+}
+
+/// 全ディスクのタグ
+pub struct TagIndex {
+    /// ディスクIDごとのパスとタグ
+    disks: HashMap<String, Vec<(PathBuf, String)>>,
+}
+
+impl TagIndex {
+    /// 指定されたファイルに付いているタグを返す。
+    /// ファイルのパスを含むフォルダに付いているタグも返す。
+    pub fn tags_of(&self, disk_id: &str, target_filepath: &Path) -> Vec<&str> {
+        match self.disks.get(disk_id) {
+            Some(entries) => entries
+                .iter()
+                .filter(|(path, _)| target_filepath.starts_with(path))
+                .map(|(_, tag)| tag.as_str())
+                .collect(),
+            None => vec![],
+        }
+    }
+}
+
+/// タグを保存するフォルダを返す。
+fn tags_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("tags")
+}
+
+/// 出力フォルダごとに保存された全ディスクのタグを読み込む。
+/// 同じ出力フォルダが複数回渡されても1回だけ読み込む。
+pub fn load_tag_index(output_folders: &[&Path]) -> Result<TagIndex, Errors> {
+    let mut disks: HashMap<String, Vec<(PathBuf, String)>> = HashMap::new();
+
+    for (i, output_folder) in output_folders.iter().enumerate() {
+        let tags_folder = tags_folder(output_folder);
+        if !tags_folder.is_dir() || output_folders[..i].contains(output_folder) {
+            continue;
+        }
+
+        let read_dir = match tags_folder.read_dir() {
+            Ok(read_dir) => read_dir,
+            Err(error) => {
+                return Err(log::make_error!("タグの一覧を取得できませんでした。")
+                    .with(&error)
+                    .as_errors())
+            }
+        };
+        for entry in read_dir {
+            if let Ok(entry) = entry {
+                let file_name = entry.file_name();
+                let disk_id = file_name.to_str().unwrap_or("");
+                if disk::DISK_ID_PATTERN.is_match(disk_id) {
+                    disks
+                        .entry(disk_id.to_string())
+                        .or_default()
+                        .append(&mut load_tags(output_folder, disk_id)?);
+                }
+            }
+        }
+    }
+
+    Ok(TagIndex { disks })
+}
+
+/// ディスクのタグを読み込む。
+/// タグがなければ空の一覧を返す。
+fn load_tags(output_folder: &Path, disk_id: &str) -> Result<Vec<(PathBuf, String)>, Errors> {
+    let tags_filepath = tags_folder(output_folder).join(disk_id);
+    if !tags_filepath.is_file() {
+        return Ok(vec![]);
+    }
+
+    let contents = match fs::read_to_string(tags_filepath.as_path()) {
+        Ok(contents) => contents,
+        Err(error) => {
+            return Err(log::make_error!(
+                "タグを読み込めませんでした。: {}",
+                tags_filepath.to_str().unwrap()
+            )
+            .with(&error)
+            .as_errors())
+        }
+    };
+
+    let mut tags = vec![];
+    for (i, line) in contents.lines().enumerate() {
+        match line.split_once('\t') {
+            Some((path, tag)) if tag.len() > 0 => tags.push((PathBuf::from(path), tag.to_string())),
+            _ => {
+                return log::with_line_number(
+                    Err(log::make_error!("タグの形式が不正です。").as_errors()),
+                    tags_filepath.as_path(),
+                    i + 1,
+                )
+            }
+        }
+    }
+
+    Ok(tags)
+}
+
+/// ディスクのタグを出力する。
+/// 1行に"パス タグ"をタブ区切りで出力する。
+fn write_tags(
+    output_folder: &Path,
+    disk_id: &str,
+    tags: &Vec<(PathBuf, String)>,
+) -> Result<(), Errors> {
+    let tags_folder = tags_folder(output_folder);
+    if let Err(error) = fs::create_dir_all(tags_folder.as_path()) {
+        return Err(log::make_error!("タグのフォルダを作成できませんでした。")
+            .with(&error)
+            .as_errors());
+    }
+
+    let mut contents = String::new();
+    for (path, tag) in tags {
+        contents.push_str(path.to_str().unwrap());
+        contents.push('\t');
+        contents.push_str(tag);
+        contents.push('\n');
+    }
+
+    match atomic_write::write(tags_folder.join(disk_id), &contents) {
+        Ok(_) => Ok(()),
+        Err(error) => Err(log::make_error!("タグの出力に失敗しました。")
+            .with(&error)
+            .as_errors()),
+    }
+}
+
+/// ファイルかフォルダにタグを付ける。
+pub fn add_tag(output_folder: &Path, target: &TagTarget, tag: &str) -> Result<(), Errors> {
+    // タブと改行はファイルの、カンマは出力するタグの区切りに使うため含められない
+    if tag.trim().len() == 0 || tag.contains(['\t', '\n', '\r', ',']) {
+        return Err(log::make_error!("タグに使えない文字が含まれています。: {}", tag).as_errors());
+    }
+
+    let mut tags = load_tags(output_folder, &target.disk_id)?;
+    if tags
+        .iter()
+        .any(|(path, existing_tag)| *path == target.path && existing_tag == tag)
+    {
+        log::info(format!("すでにタグが付いています。: {}", tag).as_str());
+        return Ok(());
+    }
+    tags.push((target.path.clone(), tag.to_string()));
+    tags.sort();
+    write_tags(output_folder, &target.disk_id, &tags)?;
+
+    log::info(
+        format!(
+            "{}:{}にタグを付けました。: {}",
+            &target.disk_id,
+            target.path.to_str().unwrap(),
+            tag
+        )
+        .as_str(),
+    );
+
+    Ok(())
+}
+
+/// ファイルかフォルダのタグを外す。
+/// タグが指定されなければ全てのタグを外す。
+pub fn remove_tag(
+    output_folder: &Path,
+    target: &TagTarget,
+    tag: Option<&str>,
+) -> Result<(), Errors> {
+    let tags = load_tags(output_folder, &target.disk_id)?;
+    let number_of_tags = tags.len();
+    let tags: Vec<(PathBuf, String)> = tags
+        .into_iter()
+        .filter(|(path, existing_tag)| {
+            *path != target.path || tag.map_or(false, |tag| tag != existing_tag)
+        })
+        .collect();
+
+    if tags.len() == number_of_tags {
+        log::info("外すタグがありません。");
+        return Ok(());
+    }
+    write_tags(output_folder, &target.disk_id, &tags)?;
+
+    log::info(
+        format!(
+            "{}:{}のタグを{}件外しました。",
+            &target.disk_id,
+            target.path.to_str().unwrap(),
+            number_of_tags - tags.len()
+        )
+        .as_str(),
+    );
+
+    Ok(())
+}
+
+/// タグの一覧を出力する。
+/// 1行に"ディスクID:パス タグ"をタブ区切りで出力する。
+/// ディスクIDが指定されなければ全ディスクのタグを出力する。
+pub fn list_tags(output_folders: &[&Path], disk_ids: &Vec<String>) -> Result<(), Errors> {
+    let tag_index = load_tag_index(output_folders)?;
+
+    let sorted_disks: BTreeMap<&String, &Vec<(PathBuf, String)>> = tag_index
+        .disks
+        .iter()
+        .filter(|(disk_id, _)| disk_ids.len() == 0 || disk_ids.contains(disk_id))
+        .collect();
+    for (disk_id, tags) in sorted_disks {
+        for (path, tag) in tags {
+            println!("{}:{}\t{}", disk_id, path.to_str().unwrap(), tag);
+        }
+    }
+
+    Ok(())
+}
+
+/// 出力する行の末尾に付けるタグの列を作成する。
+/// タグがなければ空文字列を返す。
+pub fn tags_column(tags: &Vec<&str>) -> String {
+    if tags.len() == 0 {
+        String::new()
+    } else {
+        format!("\t{}", tags.join(","))
+    }
+}
@@ -1,38 +1,71 @@
 use std::collections::HashMap;
+use std::fs;
 use std::path::{Path, PathBuf};
+use std::time::{SystemTime, UNIX_EPOCH};
 
-use md5::Digest;
-use path_slash::PathExt;
 use unicode_normalization::UnicodeNormalization;
 
-use crate::filter::Filters;
+use crate::disk::DiskInfo;
+use crate::filter::{Filters, SymlinkPolicy};
+use crate::hash_algorithm::Digest;
+use crate::hash_file::FileStamp;
+use crate::path_normalizer::PathNormalizer;
+use crate::streams;
 
 /// 対象ファイル
 pub struct TargetFile {
     actual_path: PathBuf,
     normalized_path: PathBuf,
     pub size: u64,
+    /// 更新日時のUNIX時間の秒数
+    /// 取得できなければNone
+    modified: Option<u64>,
+    /// リンク先を記録するシンボリックリンクのリンク先
+    link_target: Option<PathBuf>,
 }
 
 impl TargetFile {
     /// インスタンスを作成する。
-    pub fn new(disk_root: &Path, actual_path: PathBuf, size: u64) -> TargetFile {
-        let normalized_path = actual_path
-            .strip_prefix(disk_root)
-            .unwrap()
-            .to_slash()
-            .unwrap()
-            .nfc()
-            .to_string();
+    /// 正規化ファイルパスはプレフィックスにルートからの相対パスを連結し、正規化の手順を適用したものにする。
+    pub fn new(
+        disk_root: &Path,
+        prefix: &Path,
+        actual_path: PathBuf,
+        size: u64,
+        path_normalizer: &PathNormalizer,
+    ) -> TargetFile {
+        let normalized_path =
+            path_normalizer.normalize(&prefix.join(actual_path.strip_prefix(disk_root).unwrap()));
         let normalized_path = PathBuf::from(normalized_path);
 
         TargetFile {
             actual_path,
             normalized_path,
             size,
+            modified: None,
+            link_target: None,
         }
     }
 
+    /// 更新日時を設定する。
+    pub fn with_modified(mut self, modified: Option<SystemTime>) -> TargetFile {
+        self.modified = modified
+            .and_then(|modified| modified.duration_since(UNIX_EPOCH).ok())
+            .map(|duration| duration.as_secs());
+        self
+    }
+
+    /// リンク先を記録するシンボリックリンクのリンク先を設定する。
+    pub fn with_link_target(mut self, link_target: Option<PathBuf>) -> TargetFile {
+        self.link_target = link_target;
+        self
+    }
+
+    /// リンク先を記録するシンボリックリンクであればリンク先を返す。
+    pub fn link_target(&self) -> Option<&Path> {
+        self.link_target.as_deref()
+    }
+
     /// ファイルパスを返す。
     pub fn actual_path(&self) -> &Path {
         self.actual_path.as_path()
@@ -42,49 +75,296 @@ impl TargetFile {
     pub fn normalized_path(&self) -> &Path {
         self.normalized_path.as_path()
     }
+
+    /// ハッシュファイルに記録するバイト数と更新日時を返す。
+    /// 更新日時が取得できなければNoneを返す。
+    pub fn stamp(&self) -> Option<FileStamp> {
+        self.modified.map(|modified| FileStamp {
+            size: self.size,
+            modified,
+        })
+    }
+
+    /// このファイルの代替データストリームの対象ファイルを作成する。
+    /// パスは"ファイルパス:ストリーム名"とする。更新日時はファイルと同じとする。
+    pub fn alternate_stream(&self, stream_name: &str, size: u64) -> TargetFile {
+        let mut actual_path = self.actual_path.clone().into_os_string();
+        actual_path.push(":");
+        actual_path.push(stream_name);
+        let normalized_path = format!(
+            "{}:{}",
+            self.normalized_path.to_str().unwrap(),
+            stream_name.nfc().to_string()
+        );
+
+        TargetFile {
+            actual_path: PathBuf::from(actual_path),
+            normalized_path: PathBuf::from(normalized_path),
+            size,
+            modified: self.modified,
+            link_target: None,
+        }
+    }
+}
+
+/// ディスクのルートとサブルートから対象ファイルを一覧にする。
+pub fn list_target_files(disk_info: &DiskInfo, filters: &Filters) -> Vec<TargetFile> {
+    list_scoped_target_files(disk_info, filters, None)
+}
+
+/// ディスクのルートとサブルートの実際のパスを、探索するフォルダの一覧として返す。
+/// シンボリックリンクのリンク先がこれらと重なるフォルダは、同じファイルを重複して一覧にしないよう辿らない。
+fn walked_roots(disk_info: &DiskInfo) -> Vec<PathBuf> {
+    [disk_info.root_path.as_path()]
+        .into_iter()
+        .chain(
+            disk_info
+                .sub_roots
+                .iter()
+                .map(|sub_root| sub_root.path.as_path()),
+        )
+        .filter_map(|root| fs::canonicalize(root).ok())
+        .collect()
 }
 
 /// 対象ファイルを一覧にする。
-pub fn list_target_files(disk_root: &Path, filters: &Filters) -> Vec<TargetFile> {
+/// 範囲が指定された場合は、正規化ファイルパスがその範囲に含まれるファイルだけを一覧にする。
+pub fn list_scoped_target_files(
+    disk_info: &DiskInfo,
+    filters: &Filters,
+    scope: Option<&Path>,
+) -> Vec<TargetFile> {
+    count_filtered_scoped_target_files(disk_info, filters, scope).0
+}
+
+/// 範囲内の対象ファイルを一覧にし、フィルターで対象外にしたファイルの数とともに返す。
+/// 種類で対象外にしたフォルダの配下は探索しないので数えない。
+pub fn count_filtered_scoped_target_files(
+    disk_info: &DiskInfo,
+    filters: &Filters,
+    scope: Option<&Path>,
+) -> (Vec<TargetFile>, usize) {
     let mut target_files = vec![];
-    collect_dir_entries_recursive(&mut target_files, disk_root, disk_root, filters);
-    target_files
+    let number_of_filtered =
+        walk_scoped_target_files(disk_info, filters, scope, &mut |target_file| {
+            target_files.push(target_file);
+            true
+        });
+    (target_files, number_of_filtered)
 }
 
-/// 指定されたフォルダ配下のエントリーを一覧に追加する。
-fn collect_dir_entries_recursive(
-    target_files: &mut Vec<TargetFile>,
-    disk_root: &Path,
-    folder: &Path,
+/// 範囲内の対象ファイルを見つけた順に1件ずつ渡し、フィルターで対象外にしたファイルの数を返す。
+/// 一覧の全体をメモリに持たずに処理できるよう、探索しながら渡す。
+/// 渡した処理がfalseを返したら残りは探索しない。
+pub fn walk_scoped_target_files(
+    disk_info: &DiskInfo,
     filters: &Filters,
-) {
-    // フォルダのエントリーをループするイテレーターを取得する
-    // 取得できなければこのフォルダは処理しない
-    if let Ok(dir_entry_iter) = folder.read_dir() {
+    scope: Option<&Path>,
+    on_file: &mut dyn FnMut(TargetFile) -> bool,
+) -> usize {
+    let mut walker = Walker {
+        filters,
+        on_file,
+        number_of_filtered: 0,
+        walked_folders: walked_roots(disk_info),
+    };
+
+    let root_path = disk_info.root_path.as_path();
+    let folder = match scope {
+        Some(scope) => root_path.join(scope),
+        None => root_path.to_path_buf(),
+    };
+    if !walker.walk(root_path, Path::new(""), folder.as_path()) {
+        return walker.number_of_filtered;
+    }
+    for sub_root in disk_info.sub_roots.iter() {
+        let prefix = Path::new(&sub_root.prefix);
+        let sub_root_path = sub_root.path.as_path();
+        // 範囲がサブルートの中ならその部分だけを、サブルートが範囲の中ならサブルート全体を探索する
+        let folder = match scope {
+            None => sub_root_path.to_path_buf(),
+            Some(scope) => {
+                if let Ok(relative_scope) = scope.strip_prefix(prefix) {
+                    sub_root_path.join(relative_scope)
+                } else if prefix.starts_with(scope) {
+                    sub_root_path.to_path_buf()
+                } else {
+                    continue;
+                }
+            }
+        };
+        if !walker.walk(sub_root_path, prefix, folder.as_path()) {
+            break;
+        }
+    }
+    walker.number_of_filtered
+}
+
+/// 対象ファイルの一覧に各ファイルの代替データストリームを追加する。
+/// 代替データストリームはフィルターに関係なく、ファイルが対象なら対象にする。
+pub fn add_alternate_streams(target_files: Vec<TargetFile>) -> Vec<TargetFile> {
+    let mut with_streams = Vec::with_capacity(target_files.len());
+    for target_file in target_files {
+        // リンク先を記録するシンボリックリンクはリンク先のストリームを読まない
+        if target_file.link_target().is_some() {
+            with_streams.push(target_file);
+            continue;
+        }
+        let streams = streams::list_alternate_streams(target_file.actual_path());
+        with_streams.push(target_file);
+        let target_file = with_streams.last().unwrap();
+        let alternate_streams: Vec<TargetFile> = streams
+            .iter()
+            .map(|(stream_name, size)| target_file.alternate_stream(stream_name, *size))
+            .collect();
+        with_streams.extend(alternate_streams);
+    }
+    with_streams
+}
+
+/// 正規化ファイルパスが代替データストリームのものかを返す。
+/// ファイル名に':'を使えないWindowsでだけ判定し、他のOSでは':'を含むファイル名も通常のファイルとする。
+pub fn is_alternate_stream(normalized_path: &Path) -> bool {
+    streams::SUPPORTED
+        && normalized_path
+            .file_name()
+            .and_then(|file_name| file_name.to_str())
+            .map_or(false, |file_name| file_name.contains(':'))
+}
+
+/// ディスクルートからの相対パスをハッシュファイルのパスと同じ形式にする。
+/// 区切り文字をスラッシュにしてNFCにし、前後のスラッシュを取り除く。
+/// ".."を含む場合はNoneを返す。
+pub fn normalize_relative_path(value: &str) -> Option<PathBuf> {
+    let path = value.replace('\\', "/").nfc().to_string();
+    let path = path.trim_matches('/');
+    if path.split('/').any(|segment| segment == "..") {
+        None
+    } else {
+        Some(PathBuf::from(path))
+    }
+}
+
+/// 正規化ファイルパスが範囲に含まれるかを返す。
+/// 範囲が指定されなければ全てのパスを含むとする。
+pub fn is_in_scope(normalized_path: &Path, scope: Option<&Path>) -> bool {
+    match scope {
+        Some(scope) => normalized_path.starts_with(scope),
+        None => true,
+    }
+}
+
+/// フォルダを探索して対象ファイルを渡す処理の状態
+struct Walker<'a> {
+    filters: &'a Filters,
+    /// 対象ファイルを渡す処理
+    on_file: &'a mut dyn FnMut(TargetFile) -> bool,
+    /// フィルターで対象外にしたファイルの数
+    number_of_filtered: usize,
+    /// 探索するフォルダとシンボリックリンクで辿ったフォルダの実際のパス
+    walked_folders: Vec<PathBuf>,
+}
+
+impl Walker<'_> {
+    /// 指定されたフォルダ配下の対象ファイルを渡す。
+    /// シンボリックリンクはフィルターのシンボリックリンクの扱いに従う。
+    /// リンク切れのシンボリックリンクは読み込めないので対象外にする。
+    /// 渡した処理がfalseを返したら探索をやめてfalseを返す。
+    fn walk(&mut self, disk_root: &Path, prefix: &Path, folder: &Path) -> bool {
+        // フォルダのエントリーをループするイテレーターを取得する
+        // 取得できなければこのフォルダは処理しない
+        let dir_entry_iter = match folder.read_dir() {
+            Ok(dir_entry_iter) => dir_entry_iter,
+            Err(_) => return true,
+        };
         for dir_entry_result in dir_entry_iter {
             // エントリーを取得する
             // 取得できなければこのエントリーは処理しない
-            if let Ok(dir_entry) = dir_entry_result {
-                // フォルダなら再帰的にエントリー取得を行う
-                // ファイルなら一覧に追加する
-                if let Ok(metadata) = dir_entry.metadata() {
-                    let dir_entry_path = dir_entry.path();
-                    if metadata.is_dir() {
-                        collect_dir_entries_recursive(
-                            target_files,
-                            disk_root,
-                            dir_entry_path.as_path(),
-                            filters,
-                        );
-                    } else if filters.is_target(dir_entry_path.strip_prefix(disk_root).unwrap()) {
-                        let target_file =
-                            TargetFile::new(disk_root, dir_entry_path, metadata.len());
-                        target_files.push(target_file);
+            let dir_entry = match dir_entry_result {
+                Ok(dir_entry) => dir_entry,
+                Err(_) => continue,
+            };
+            let mut metadata = match dir_entry.metadata() {
+                Ok(metadata) => metadata,
+                Err(_) => continue,
+            };
+            let is_symlink = metadata.file_type().is_symlink();
+            let mut link_target = None;
+            if is_symlink {
+                let resolved = match self.filters.symlink_policy() {
+                    SymlinkPolicy::Skip => None,
+                    SymlinkPolicy::Follow => fs::metadata(dir_entry.path()).ok(),
+                    // サイズと更新日時はシンボリックリンク自体のものを使う
+                    SymlinkPolicy::Record => {
+                        link_target = fs::read_link(dir_entry.path()).ok();
+                        link_target.is_some().then_some(metadata)
                     }
+                };
+                match resolved {
+                    Some(resolved) => metadata = resolved,
+                    None => {
+                        self.number_of_filtered += 1;
+                        continue;
+                    }
+                }
+            }
+            // 種類で対象外にするものはフォルダであれば配下も処理しない
+            if self.filters.skips(&dir_entry.file_name(), &metadata) {
+                if !metadata.is_dir() {
+                    self.number_of_filtered += 1;
+                }
+                continue;
+            }
+            // フォルダなら再帰的にエントリー取得を行う
+            // ファイルなら対象ファイルとして渡す
+            let dir_entry_path = dir_entry.path();
+            if metadata.is_dir() {
+                if is_symlink && !walks_linked_folder(&dir_entry_path, &mut self.walked_folders) {
+                    continue;
+                }
+                if !self.walk(disk_root, prefix, dir_entry_path.as_path()) {
+                    return false;
+                }
+            } else if !self.filters.is_target(
+                &prefix.join(dir_entry_path.strip_prefix(disk_root).unwrap()),
+                metadata.len(),
+            ) {
+                self.number_of_filtered += 1;
+            } else {
+                let target_file = TargetFile::new(
+                    disk_root,
+                    prefix,
+                    dir_entry_path,
+                    metadata.len(),
+                    self.filters.path_normalizer(),
+                )
+                .with_modified(metadata.modified().ok())
+                .with_link_target(link_target);
+                if !(self.on_file)(target_file) {
+                    return false;
                 }
             }
         }
+        true
+    }
+}
+
+/// フォルダへのシンボリックリンクを辿るかを返す。
+/// リンク先が探索済みか探索するフォルダと重なる場合は、重複や循環を避けるため辿らない。
+/// 辿る場合はリンク先を探索するフォルダの一覧に追加する。
+fn walks_linked_folder(link_path: &Path, walked_folders: &mut Vec<PathBuf>) -> bool {
+    let linked_folder = match fs::canonicalize(link_path) {
+        Ok(linked_folder) => linked_folder,
+        Err(_) => return false,
+    };
+    if walked_folders
+        .iter()
+        .any(|folder| linked_folder.starts_with(folder) || folder.starts_with(&linked_folder))
+    {
+        return false;
     }
+    walked_folders.push(linked_folder);
+    true
 }
 
 /// 対象ファイルの一覧からハッシュファイルに情報があったものを除外する。
@@ -0,0 +1,130 @@
+use std::collections::VecDeque;
+use std::sync::{Condvar, Mutex};
+
+use crate::target_file::TargetFile;
+
+/// 計算スレッドに渡すまで溜めておく対象ファイルの上限
+const CAPACITY: usize = 4096;
+
+/// 計算する対象ファイルの待ち行列
+/// ディスクを探索し終える前から計算を始められるよう、一覧にしたファイルから順に計算スレッドに渡す。
+/// 一覧の全体をメモリに持たないよう、溜まったファイルが上限に達したら一覧にするのを待たせる。
+pub struct TargetQueue {
+    state: Mutex<QueueState>,
+    changed: Condvar,
+}
+
+/// 待ち行列の状態
+struct QueueState {
+    /// 計算スレッドに渡していない対象ファイル
+    files: VecDeque<TargetFile>,
+    /// 一覧にし終えたか
+    finished: bool,
+    /// 計算をやめたか
+    closed: bool,
+    /// 一覧にしたファイルの数
+    number_of_listed: usize,
+    /// 一覧にしたファイルの容量の合計
+    listed_size: u64,
+}
+
+impl TargetQueue {
+    /// 一覧にしながらファイルを追加する待ち行列を作成する。
+    pub fn new() -> TargetQueue {
+        TargetQueue {
+            state: Mutex::new(QueueState {
+                files: VecDeque::new(),
+                finished: false,
+                closed: false,
+                number_of_listed: 0,
+                listed_size: 0,
+            }),
+            changed: Condvar::new(),
+        }
+    }
+
+    /// 一覧にし終えた対象ファイルから待ち行列を作成する。
+    pub fn from_files(target_files: Vec<TargetFile>) -> TargetQueue {
+        let number_of_listed = target_files.len();
+        let listed_size = target_files
+            .iter()
+            .map(|target_file| target_file.size)
+            .sum();
+        TargetQueue {
+            state: Mutex::new(QueueState {
+                files: VecDeque::from(target_files),
+                finished: true,
+                closed: false,
+                number_of_listed,
+                listed_size,
+            }),
+            changed: Condvar::new(),
+        }
+    }
+
+    /// 対象ファイルを追加する。
+    /// 溜まったファイルが上限に達していれば、計算スレッドが取り出すまで待つ。
+    /// 計算をやめていれば追加せずにfalseを返す。
+    pub fn push(&self, target_file: TargetFile) -> bool {
+        let mut state = self.state.lock().unwrap();
+        while state.files.len() >= CAPACITY && !state.closed {
+            state = self.changed.wait(state).unwrap();
+        }
+        if state.closed {
+            return false;
+        }
+        state.number_of_listed += 1;
+        state.listed_size += target_file.size;
+        state.files.push_back(target_file);
+        self.changed.notify_all();
+        true
+    }
+
+    /// 一覧にし終えたことを記録し、待っている計算スレッドを起こす。
+    pub fn finish(&self) {
+        self.state.lock().unwrap().finished = true;
+        self.changed.notify_all();
+    }
+
+    /// 計算をやめたことを記録し、一覧にするのをやめさせる。
+    pub fn close(&self) {
+        self.state.lock().unwrap().closed = true;
+        self.changed.notify_all();
+    }
+
+    /// 次に計算するファイルを取り出す。
+    /// ファイルが追加されるまで待ち、一覧にし終えたか計算をやめていればNoneを返す。
+    pub fn pop(&self) -> Option<TargetFile> {
+        let mut state = self.state.lock().unwrap();
+        loop {
+            if state.closed {
+                return None;
+            }
+            if let Some(target_file) = state.files.pop_front() {
+                self.changed.notify_all();
+                return Some(target_file);
+            }
+            if state.finished {
+                return None;
+            }
+            state = self.changed.wait(state).unwrap();
+        }
+    }
+
+    /// 計算スレッドに渡していないファイルの数を返す。
+    /// 一覧にしている途中で、まだ増える場合はNoneを返す。
+    pub fn remaining(&self) -> Option<usize> {
+        let state = self.state.lock().unwrap();
+        if state.finished {
+            Some(state.files.len())
+        } else {
+            None
+        }
+    }
+
+    /// 一覧にしたファイルの数と容量の合計を返す。
+    pub fn listed(&self) -> (usize, u64) {
+        let state = self.state.lock().unwrap();
+        (state.number_of_listed, state.listed_size)
+    }
+}
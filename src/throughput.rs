@@ -0,0 +1,249 @@
+use std::fs::{self, OpenOptions};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+use chrono::NaiveDateTime;
+
+use crate::clock;
+use crate::log::{self, Errors};
+use crate::merged_hash_file;
+
+/// 記録する最小の読み込み量
+/// 読み込み量が少ないと速度が安定しないため記録しない。
+const MIN_RECORDED_BYTES: u64 = 100 << 20;
+
+/// 過去の速度の中央値からこの割合以上遅くなったら警告する
+const SLOWDOWN_WARNING_RATE: f64 = 0.3;
+
+/// 記録日時の形式
+const TIMESTAMP_FORMAT: &str = "%Y-%m-%d %H:%M:%S";
+
+/// 読み込み速度の記録
+struct ThroughputRecord {
+    /// 記録日時
+    timestamp: String,
+    /// 読み込んだバイト数
+    bytes: u64,
+    /// 読み込みにかかった秒数
+    seconds: f64,
+}
+
+impl ThroughputRecord {
+    /// 1秒あたりのメガバイト数を返す。
+    fn megabytes_per_second(&self) -> f64 {
+        if self.seconds > 0.0 {
+            self.bytes as f64 / (1u64 << 20) as f64 / self.seconds
+        } else {
+            0.0
+        }
+    }
+}
+
+/// 読み込み速度の履歴を保存するフォルダを返す。
+fn throughput_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("throughput")
+}
+
+/// ディスクの読み込み速度を履歴に記録する。
+/// 過去の記録より大幅に遅くなっていれば警告する。
+pub fn record_throughput(
+    output_folder: &Path,
+    disk_id: &str,
+    bytes: u64,
+    duration: Duration,
+) -> Result<(), Errors> {
+    // 決定的モードでは速度が実行ごとに変わるため記録しない
+    if bytes < MIN_RECORDED_BYTES || clock::is_deterministic() {
+        return Ok(());
+    }
+
+    let record = ThroughputRecord {
+        timestamp: clock::now().format(TIMESTAMP_FORMAT).to_string(),
+        bytes,
+        seconds: duration.as_secs_f64(),
+    };
+
+    // 記録する前に過去の記録と比較する
+    let history = load_history(output_folder, disk_id)?;
+    if let Some(median) = median_megabytes_per_second(&history) {
+        let current = record.megabytes_per_second();
+        if current < median * (1.0 - SLOWDOWN_WARNING_RATE) {
+            log::warn(
+                format!(
+                    "{}: 読み込み速度が過去の中央値より{:.0}%遅くなっています。({:.1}MB/s -> {:.1}MB/s) ディスクの状態を確認してください。",
+                    disk_id,
+                    (1.0 - current / median) * 100.0,
+                    median,
+                    current
+                )
+                .as_str(),
+            );
+        }
+    }
+
+    let throughput_folder = throughput_folder(output_folder);
+    if let Err(error) = fs::create_dir_all(throughput_folder.as_path()) {
+        return Err(
+            log::make_error!("読み込み速度の履歴フォルダを作成できませんでした。")
+                .with(&error)
+                .as_errors(),
+        );
+    }
+
+    let line = format!(
+        "{}\t{}\t{:.3}\n",
+        record.timestamp, record.bytes, record.seconds
+    );
+    let result = OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(throughput_folder.join(disk_id))
+        .and_then(|mut file| file.write_all(line.as_bytes()));
+    match result {
+        Ok(_) => Ok(()),
+        Err(error) => Err(log::make_error!("読み込み速度の記録に失敗しました。")
+            .with(&error)
+            .as_errors()),
+    }
+}
+
+/// ディスクの読み込み速度の履歴を出力する。
+/// ディスクIDが指定されなければ全てのディスクの履歴を出力する。
+pub fn report_throughput(output_folder: &Path, disk_ids: &Vec<String>) -> Result<(), Errors> {
+    let disk_ids = if disk_ids.len() > 0 {
+        disk_ids.clone()
+    } else {
+        let mut disk_ids: Vec<String> =
+            merged_hash_file::find_hash_files(throughput_folder(output_folder).as_path())
+                .unwrap_or_default()
+                .iter()
+                .map(|path| path.file_name().unwrap().to_str().unwrap().to_string())
+                .collect();
+        disk_ids.sort();
+        disk_ids
+    };
+
+    for disk_id in disk_ids.iter() {
+        let history = load_history(output_folder, disk_id)?;
+        if history.len() == 0 {
+            log::info(format!("{}: 読み込み速度の記録がありません。", disk_id).as_str());
+            continue;
+        }
+
+        // 初回の記録からの変化率も出力する
+        let first = history[0].megabytes_per_second();
+        for record in history.iter() {
+            let current = record.megabytes_per_second();
+            let change = if first > 0.0 {
+                (current / first - 1.0) * 100.0
+            } else {
+                0.0
+            };
+            println!(
+                "{}\t{}\t{:.1}MB/s\t{:+.0}%",
+                disk_id, record.timestamp, current, change
+            );
+        }
+    }
+
+    Ok(())
+}
+
+/// 読み込みの実績
+pub struct ReadSummary {
+    /// 集計開始日時以降に読み込んだバイト数
+    pub bytes_since: u64,
+    /// 最初の記録日時
+    pub first_recorded: Option<NaiveDateTime>,
+    /// 読み込み速度の中央値(MB/s)
+    pub median_megabytes_per_second: Option<f64>,
+}
+
+/// ディスクの読み込みの実績を履歴から集計する。
+pub fn summarize_reads(
+    output_folder: &Path,
+    disk_id: &str,
+    since: NaiveDateTime,
+) -> Result<ReadSummary, Errors> {
+    let history = load_history(output_folder, disk_id)?;
+
+    let mut bytes_since = 0;
+    let mut first_recorded = None;
+    for record in history.iter() {
+        let recorded = match NaiveDateTime::parse_from_str(&record.timestamp, TIMESTAMP_FORMAT) {
+            Ok(recorded) => recorded,
+            Err(_) => continue,
+        };
+        if first_recorded.is_none() {
+            first_recorded = Some(recorded);
+        }
+        if recorded >= since {
+            bytes_since += record.bytes;
+        }
+    }
+
+    Ok(ReadSummary {
+        bytes_since,
+        first_recorded,
+        median_megabytes_per_second: median_megabytes_per_second(&history),
+    })
+}
+
+/// ディスクの読み込み速度の履歴を読み込む。
+/// 履歴がなければ空の一覧を返す。
+fn load_history(output_folder: &Path, disk_id: &str) -> Result<Vec<ThroughputRecord>, Errors> {
+    let history_filepath = throughput_folder(output_folder).join(disk_id);
+    if !history_filepath.is_file() {
+        return Ok(vec![]);
+    }
+
+    let contents = match fs::read_to_string(history_filepath.as_path()) {
+        Ok(contents) => contents,
+        Err(error) => {
+            return Err(
+                log::make_error!("読み込み速度の履歴を読み込めませんでした。")
+                    .with(&error)
+                    .as_errors(),
+            )
+        }
+    };
+
+    let mut history = vec![];
+    for (i, line) in contents.lines().enumerate() {
+        let record =
+            log::with_line_number(parse_history_line(line), history_filepath.as_path(), i + 1)?;
+        history.push(record);
+    }
+
+    Ok(history)
+}
+
+/// 読み込み速度の履歴の行をパースする。
+fn parse_history_line(line: &str) -> Result<ThroughputRecord, Errors> {
+    let columns: Vec<&str> = line.split('\t').collect();
+    if let [timestamp, bytes, seconds] = columns[..] {
+        if let (Ok(bytes), Ok(seconds)) = (bytes.parse::<u64>(), seconds.parse::<f64>()) {
+            return Ok(ThroughputRecord {
+                timestamp: timestamp.to_string(),
+                bytes,
+                seconds,
+            });
+        }
+    }
+    Err(log::make_error!("読み込み速度の履歴の形式が不正です。").as_errors())
+}
+
+/// 読み込み速度の中央値を返す。
+/// 記録がなければNoneを返す。
+fn median_megabytes_per_second(history: &Vec<ThroughputRecord>) -> Option<f64> {
+    if history.len() == 0 {
+        return None;
+    }
+    let mut speeds: Vec<f64> = history
+        .iter()
+        .map(|record| record.megabytes_per_second())
+        .collect();
+    speeds.sort_by(|a, b| a.partial_cmp(b).unwrap());
+    Some(speeds[speeds.len() / 2])
+}
@@ -0,0 +1,148 @@
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::clock;
+use crate::disk;
+use crate::hash_algorithm::{Digest, HashAlgorithm};
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::seal;
+
+/// ハッシュ情報マップから削除された行を保存するフォルダを返す。
+pub fn trimmed_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("trimmed")
+}
+
+/// ハッシュ情報マップから削除された行をファイルに保存する。
+/// ファイル名は"ディスクID-日時"とし、ハッシュファイルと同じ形式で出力する。
+pub fn save_trimmed_hash_info(
+    output_folder: &Path,
+    disk_id: &str,
+    algorithm: HashAlgorithm,
+    trimmed_hash_info_map: &HashMap<PathBuf, Digest>,
+) -> Result<(), Errors> {
+    if trimmed_hash_info_map.len() == 0 {
+        return Ok(());
+    }
+
+    let trimmed_folder = trimmed_folder(output_folder);
+    if let Err(error) = fs::create_dir_all(trimmed_folder.as_path()) {
+        return Err(
+            log::make_error!("削除した行の保存フォルダを作成できませんでした。")
+                .with(&error)
+                .as_errors(),
+        );
+    }
+
+    let timestamp = clock::now().format("%Y%m%d%H%M%S");
+    let trimmed_filepath = trimmed_folder.join(format!("{}-{}", disk_id, timestamp));
+    // 戻すときにハッシュファイルとアルゴリズムが一致するか確認できるようヘッダーを出力する
+    let mut contents = hash_file::algorithm_header(algorithm);
+    for (target_filepath, hash) in hash_file::sorted_hash_info(trimmed_hash_info_map) {
+        contents = hash_file::add_hash_file_line(contents, target_filepath, hash);
+    }
+
+    match atomic_write::write(trimmed_filepath.as_path(), &contents) {
+        Ok(_) => {
+            log::info(
+                format!(
+                    "{}: 存在しないファイルの行を{}件削除しました。: {}",
+                    disk_id,
+                    trimmed_hash_info_map.len(),
+                    trimmed_filepath.to_str().unwrap()
+                )
+                .as_str(),
+            );
+            Ok(())
+        }
+        Err(error) => Err(log::make_error!("削除した行の保存に失敗しました。")
+            .with(&error)
+            .as_errors()),
+    }
+}
+
+/// 削除した行を保存したファイルからハッシュファイルに行を戻す。
+/// ハッシュファイルにすでにあるファイルの行は戻さない。
+pub fn restore_trimmed_hash_info(
+    output_folder: &Path,
+    trimmed_filepath: &Path,
+) -> Result<(), Errors> {
+    // 名前だけ指定された場合は保存フォルダのファイルとする
+    let trimmed_filepath = if trimmed_filepath.is_file() {
+        trimmed_filepath.to_path_buf()
+    } else {
+        trimmed_folder(output_folder).join(trimmed_filepath)
+    };
+
+    let disk_id = disk_id_of(trimmed_filepath.as_path())?;
+    let hash_filepath = output_folder.join(disk_id.as_str());
+
+    // 封印されたディスクのハッシュファイルは変更しない
+    if seal::is_sealed(output_folder, &disk_id) {
+        return Err(
+            log::make_error!("ディスク{}は封印されているため行を戻せません。", disk_id).as_errors(),
+        );
+    }
+
+    let trimmed_hash_info_map = hash_file::load_hash_info(trimmed_filepath.as_path())?;
+    if trimmed_hash_info_map.len() == 0 {
+        return Err(log::make_error!(
+            "削除した行の保存ファイルがないか、空です。: {}",
+            trimmed_filepath.to_str().unwrap()
+        )
+        .as_errors());
+    }
+
+    // アルゴリズムが異なるハッシュは混在させられない
+    let algorithm =
+        hash_file::read_algorithm(trimmed_filepath.as_path())?.unwrap_or(HashAlgorithm::Md5);
+    let algorithm = hash_file::resolve_algorithm(hash_filepath.as_path(), Some(algorithm))?;
+
+    let mut hash_info_map = hash_file::load_hash_info(hash_filepath.as_path())?;
+    let stamp_map = hash_file::load_file_stamps(hash_filepath.as_path())?;
+    let mut number_of_restored = 0;
+    let mut number_of_skipped = 0;
+    for (target_filepath, hash) in trimmed_hash_info_map {
+        if hash_info_map.contains_key(&target_filepath) {
+            number_of_skipped += 1;
+        } else {
+            hash_info_map.insert(target_filepath, hash);
+            number_of_restored += 1;
+        }
+    }
+
+    hash_file::write_calculated_hash_with_stamps(
+        hash_filepath.as_path(),
+        algorithm,
+        hash_info_map,
+        &stamp_map,
+    )?;
+
+    log::info(
+        format!(
+            "{}: {}件の行を戻しました。すでにあった{}件は戻していません。",
+            disk_id, number_of_restored, number_of_skipped
+        )
+        .as_str(),
+    );
+
+    Ok(())
+}
+
+/// 削除した行の保存ファイルの名前からディスクIDを取り出す。
+pub fn disk_id_of(trimmed_filepath: &Path) -> Result<String, Errors> {
+    let file_name = trimmed_filepath
+        .file_name()
+        .and_then(|file_name| file_name.to_str())
+        .unwrap_or("");
+    match file_name.split_once('-') {
+        Some((disk_id, _)) if disk::DISK_ID_PATTERN.is_match(disk_id) => Ok(disk_id.to_string()),
+        _ => Err(log::make_error!(
+            "削除した行の保存ファイルの名前が不正です。: {}",
+            trimmed_filepath.to_str().unwrap()
+        )
+        .as_errors()),
+    }
+}
@@ -0,0 +1,235 @@
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::atomic_write;
+use crate::clock;
+use crate::log::{self, Errors};
+use crate::target_file::{self, TargetFile};
+
+/// 前回のサイズのこの割合より小さくなったファイルを切り詰められた疑いがあるとする
+const TRUNCATION_RATE: f64 = 0.5;
+
+/// ファイルサイズの記録を保存するフォルダを返す。
+fn sizes_folder(output_folder: &Path) -> PathBuf {
+    output_folder.join("sizes")
+}
+
+/// 空のファイルと、前回の記録より極端に小さくなったファイルの確認
+/// 対象ファイルを一覧にしながら確認できるよう、ファイルを1件ずつ受け取る。
+pub struct TruncationCheck {
+    sizes_filepath: PathBuf,
+    /// 前回のハッシュ計算で記録したファイルサイズ
+    previous_sizes: HashMap<PathBuf, u64>,
+    /// 空のファイル
+    empty_files: Vec<PathBuf>,
+    /// 小さくなったファイルとその前回のサイズと今回のサイズ
+    truncated_files: Vec<(PathBuf, u64, u64)>,
+    /// 今回のファイルサイズの記録の内容
+    sizes_contents: String,
+}
+
+impl TruncationCheck {
+    /// ディスクの前回のファイルサイズの記録を読み込んで確認を始める。
+    pub fn new(output_folder: &Path, disk_id: &str) -> Result<TruncationCheck, Errors> {
+        let sizes_filepath = sizes_folder(output_folder).join(disk_id);
+        let previous_sizes = load_sizes(sizes_filepath.as_path())?;
+        Ok(TruncationCheck {
+            sizes_filepath,
+            previous_sizes,
+            empty_files: vec![],
+            truncated_files: vec![],
+            sizes_contents: String::new(),
+        })
+    }
+
+    /// 対象ファイルが空か、前回より極端に小さくなっていないか確認し、今回のファイルサイズを記録に加える。
+    pub fn observe(&mut self, target_file: &TargetFile) {
+        let normalized_path = target_file.normalized_path();
+        if target_file.size == 0 {
+            self.empty_files.push(normalized_path.to_path_buf());
+        }
+        if let Some(previous_size) = self.previous_sizes.get(normalized_path) {
+            if (target_file.size as f64) < (*previous_size as f64) * TRUNCATION_RATE {
+                self.truncated_files.push((
+                    normalized_path.to_path_buf(),
+                    *previous_size,
+                    target_file.size,
+                ));
+            }
+        }
+        self.sizes_contents
+            .push_str(normalized_path.to_str().unwrap());
+        self.sizes_contents.push(':');
+        self.sizes_contents
+            .push_str(target_file.size.to_string().as_str());
+        self.sizes_contents.push('\n');
+    }
+
+    /// 空のファイルと、前回の記録より極端に小さくなったファイルを報告する。
+    /// 報告した後に今回のファイルサイズを記録する。
+    /// 範囲が指定された場合は、範囲外のファイルの前回の記録をそのまま残す。
+    pub fn finish(
+        self,
+        output_folder: &Path,
+        disk_id: &str,
+        scope: Option<&Path>,
+    ) -> Result<(), Errors> {
+        let empty_files = self.empty_files;
+        let truncated_files = self.truncated_files;
+        if truncated_files.len() > 0 || empty_files.len() > 0 {
+            let report_filepath =
+                write_report(output_folder, disk_id, &empty_files, &truncated_files)?;
+            let message = format!(
+                "{}: 空のファイルが{}件、前回より極端に小さくなったファイルが{}件あります。: {}",
+                disk_id,
+                empty_files.len(),
+                truncated_files.len(),
+                report_filepath.to_str().unwrap()
+            );
+            // 小さくなったファイルはコピー中の切り詰めの可能性が高い
+            if truncated_files.len() > 0 {
+                log::warn(message.as_str());
+            } else {
+                log::info(message.as_str());
+            }
+        }
+
+        let retained_sizes = self
+            .previous_sizes
+            .into_iter()
+            .filter(|(path, _)| !target_file::is_in_scope(path, scope))
+            .collect();
+        write_sizes(
+            self.sizes_filepath.as_path(),
+            self.sizes_contents,
+            &retained_sizes,
+        )
+    }
+}
+
+/// ディスクの前回のハッシュ計算で記録したファイルサイズを返す。
+pub fn load_recorded_sizes(
+    output_folder: &Path,
+    disk_id: &str,
+) -> Result<HashMap<PathBuf, u64>, Errors> {
+    load_sizes(sizes_folder(output_folder).join(disk_id).as_path())
+}
+
+/// ファイルサイズの記録を読み込む。
+/// 記録がなければ空のマップを返す。
+fn load_sizes(sizes_filepath: &Path) -> Result<HashMap<PathBuf, u64>, Errors> {
+    let mut sizes = HashMap::new();
+    if !sizes_filepath.is_file() {
+        return Ok(sizes);
+    }
+
+    let contents = match fs::read_to_string(sizes_filepath) {
+        Ok(contents) => contents,
+        Err(error) => {
+            return Err(
+                log::make_error!("ファイルサイズの記録を読み込めませんでした。")
+                    .with(&error)
+                    .as_errors(),
+            )
+        }
+    };
+
+    for (i, line) in contents.lines().enumerate() {
+        // パスにコロンが含まれる可能性があるので最後のコロンで分割する
+        match line
+            .rsplit_once(':')
+            .map(|(path, size)| (path, size.parse::<u64>()))
+        {
+            Some((path, Ok(size))) => {
+                sizes.insert(PathBuf::from(path), size);
+            }
+            _ => {
+                return log::with_line_number(
+                    Err(log::make_error!("ファイルサイズの記録の形式が不正です。").as_errors()),
+                    sizes_filepath,
+                    i + 1,
+                )
+            }
+        }
+    }
+
+    Ok(sizes)
+}
+
+/// ファイルサイズを記録する。
+/// 1行に"パス:サイズ"の形式で出力する。
+/// 今回のファイルサイズの記録の後に、残す前回の記録を出力する。
+fn write_sizes(
+    sizes_filepath: &Path,
+    mut contents: String,
+    retained_sizes: &HashMap<PathBuf, u64>,
+) -> Result<(), Errors> {
+    if let Err(error) = fs::create_dir_all(sizes_filepath.parent().unwrap()) {
+        return Err(
+            log::make_error!("ファイルサイズの記録フォルダを作成できませんでした。")
+                .with(&error)
+                .as_errors(),
+        );
+    }
+
+    let mut retained_sizes: Vec<(&PathBuf, &u64)> = retained_sizes.iter().collect();
+    retained_sizes.sort();
+    for (path, size) in retained_sizes {
+        contents.push_str(path.to_str().unwrap());
+        contents.push(':');
+        contents.push_str(size.to_string().as_str());
+        contents.push('\n');
+    }
+
+    match atomic_write::write(sizes_filepath, &contents) {
+        Ok(_) => Ok(()),
+        Err(error) => Err(log::make_error!("ファイルサイズの記録に失敗しました。")
+            .with(&error)
+            .as_errors()),
+    }
+}
+
+/// 空のファイルと小さくなったファイルの一覧を出力する。
+/// 空のファイルは"0 パス"、小さくなったファイルは"< パス 前回のサイズ 今回のサイズ"をタブ区切りで出力する。
+fn write_report(
+    output_folder: &Path,
+    disk_id: &str,
+    empty_files: &Vec<PathBuf>,
+    truncated_files: &Vec<(PathBuf, u64, u64)>,
+) -> Result<PathBuf, Errors> {
+    let report_folder = output_folder.join("truncation");
+    if let Err(error) = fs::create_dir_all(report_folder.as_path()) {
+        return Err(
+            log::make_error!("切り詰めレポートのフォルダを作成できませんでした。")
+                .with(&error)
+                .as_errors(),
+        );
+    }
+
+    let timestamp = clock::now().format("%Y%m%d%H%M%S");
+    let report_filepath = report_folder.join(format!("{}-{}", disk_id, timestamp));
+
+    let mut contents = String::new();
+    for (target_filepath, previous_size, size) in truncated_files {
+        contents.push_str(
+            format!(
+                "<\t{}\t{}\t{}\n",
+                target_filepath.to_str().unwrap(),
+                previous_size,
+                size
+            )
+            .as_str(),
+        );
+    }
+    for target_filepath in empty_files {
+        contents.push_str(format!("0\t{}\n", target_filepath.to_str().unwrap()).as_str());
+    }
+
+    match atomic_write::write(report_filepath.as_path(), &contents) {
+        Ok(_) => Ok(report_filepath),
+        Err(error) => Err(log::make_error!("切り詰めレポートの作成に失敗しました。")
+            .with(&error)
+            .as_errors()),
+    }
+}
@@ -0,0 +1,133 @@
+use std::collections::HashMap;
+use std::path::Path;
+
+use crate::hash_algorithm::Digest;
+use crate::hash_file;
+use crate::log::{self, Errors};
+use crate::merged_hash_file;
+use crate::messages;
+
+/// グループの容量の集計
+#[derive(Default)]
+struct GroupUsage {
+    /// ファイル数
+    number_of_files: usize,
+    /// 全てのファイルの容量
+    logical_size: u64,
+    /// 内容の異なるファイル数
+    number_of_unique_files: usize,
+    /// ハッシュが同じファイルを1つと数えた容量
+    unique_size: u64,
+    /// バイト数が記録されていないファイル数
+    number_of_unknown_size: usize,
+}
+
+/// 出力フォルダのハッシュファイルからグループを一覧にする。
+pub fn list_groups(output_folders: &[&Path]) -> Result<Vec<char>, Errors> {
+    let mut groups = vec![];
+    for output_folder in output_folders {
+        for hash_filepath in merged_hash_file::find_hash_files(output_folder)? {
+            groups.push(disk_group_of(hash_filepath.as_path()));
+        }
+    }
+    groups.sort();
+    groups.dedup();
+    Ok(groups)
+}
+
+/// グループごとに、全てのファイルの容量と重複を除いた容量を出力する。
+/// 重複はハッシュで判定し、同じハッシュのファイルは1つだけを数える。
+pub fn report_usage(groups: &[(char, &Path)]) -> Result<(), Errors> {
+    // 集計できないグループがあれば何も出力しない
+    let mut usages = vec![];
+    for (group, output_folder) in groups {
+        usages.push((*group, summarize_group(*group, output_folder)?));
+    }
+
+    println!(
+        "{}",
+        messages::translate(
+            "グループ\tファイル数\t容量\t内容の異なるファイル数\t重複を除いた容量\t重複の容量"
+        )
+    );
+    for (group, usage) in usages.iter() {
+        println!(
+            "{}\t{}\t{}\t{}\t{}\t{}",
+            group,
+            usage.number_of_files,
+            format_size(usage.logical_size),
+            usage.number_of_unique_files,
+            format_size(usage.unique_size),
+            format_size(usage.logical_size.saturating_sub(usage.unique_size))
+        );
+    }
+
+    for (group, usage) in usages.iter() {
+        if usage.number_of_unknown_size > 0 {
+            log::warn(
+                format!(
+                    "グループ{}の{}件のファイルはバイト数が記録されていないため容量に含めていません。",
+                    group, usage.number_of_unknown_size
+                )
+                .as_str(),
+            );
+        }
+    }
+
+    Ok(())
+}
+
+/// グループのハッシュファイルを読み込んで容量を集計する。
+/// バイト数はハッシュファイルに記録されたものを使う。
+fn summarize_group(group: char, output_folder: &Path) -> Result<GroupUsage, Errors> {
+    let mut usage = GroupUsage::default();
+    // ハッシュごとのバイト数
+    // 同じハッシュのファイルのうち1つでもバイト数が記録されていればそのバイト数を使う
+    let mut unique_sizes: HashMap<Digest, Option<u64>> = HashMap::new();
+
+    for hash_filepath in merged_hash_file::find_hash_files(output_folder)? {
+        if disk_group_of(hash_filepath.as_path()) != group {
+            continue;
+        }
+        let stamp_map = hash_file::load_file_stamps(hash_filepath.as_path())?;
+        for (target_filepath, hash) in hash_file::load_hash_info(hash_filepath.as_path())? {
+            let size = stamp_map.get(&target_filepath).map(|stamp| stamp.size);
+            usage.number_of_files += 1;
+            match size {
+                Some(size) => usage.logical_size += size,
+                None => usage.number_of_unknown_size += 1,
+            }
+            let unique_size = unique_sizes.entry(hash).or_insert(None);
+            if unique_size.is_none() {
+                *unique_size = size;
+            }
+        }
+    }
+
+    if usage.number_of_files == 0 {
+        return Err(
+            log::make_error!("グループ{}のハッシュファイルがありません。", group).as_errors(),
+        );
+    }
+
+    usage.number_of_unique_files = unique_sizes.len();
+    usage.unique_size = unique_sizes.values().flatten().sum();
+    Ok(usage)
+}
+
+/// ハッシュファイルのパスからグループを返す。
+fn disk_group_of(hash_filepath: &Path) -> char {
+    hash_filepath
+        .file_name()
+        .unwrap()
+        .to_str()
+        .unwrap()
+        .chars()
+        .next()
+        .unwrap()
+}
+
+/// 容量をGB単位の文字列にする。
+fn format_size(size: u64) -> String {
+    format!("{:.2}GB", size as f64 / (1u64 << 30) as f64)
+}